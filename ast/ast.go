@@ -1,5 +1,12 @@
-// GoAWK parser - abstract syntax tree structs
-
+// Package ast defines the abstract syntax tree of a parsed AWK
+// program, as found in a parser.Program.
+//
+// Use Walk or Inspect to traverse a tree, for example to find the
+// variables a program uses, and the New* constructors to build or
+// transform one. Position information is available from the
+// parser.Program the tree came from. A *Program can be encoded as JSON
+// (and decoded again) with the encoding/json package, for tools
+// written in other languages.
 package ast
 
 import (
@@ -18,12 +25,80 @@ type Program struct {
 	Functions []Function
 	Scalars   map[string]int
 	Arrays    map[string]int
+
+	// Names of the extensions loaded by @load directives, in order.
+	Loads []string
+
+	// Source positions of statements and of pattern expressions, used
+	// to map compiled code back to the source.
+	StmtPositions    map[Stmt]Position
+	PatternPositions map[Expr]Position
+
+	// Source positions of all expressions (where each one starts),
+	// including patterns.
+	ExprPositions map[Expr]Position
+
+	// Source positions of the BEGIN blocks, actions, END blocks, and
+	// functions, in the same order as Begin, Actions, End, and
+	// Functions.
+	BeginPositions    []Position
+	ActionPositions   []Position
+	EndPositions      []Position
+	FunctionPositions []Position
+
+	// Source positions of the @load directives, in the same order as
+	// Loads.
+	LoadPositions []Position
+
+	// All the comments in the source, in order, and the ones attached
+	// to statements and to the BEGIN blocks, actions, END blocks, and
+	// functions (in the same order as Begin, Actions, End, and
+	// Functions). Nodes without comments have no entry, or a nil one.
+	Comments         []Comment
+	StmtComments     map[Stmt]*Comments
+	BeginComments    []*Comments
+	ActionComments   []*Comments
+	EndComments      []*Comments
+	FunctionComments []*Comments
+}
+
+// Comment is a "#" comment in the source. Text includes the "#" but
+// not the newline at the end.
+type Comment struct {
+	Position Position
+	Text     string
+}
+
+// Comments are the comments attached to a statement or top-level item.
+type Comments struct {
+	// Leading comments are on the lines just before the node.
+	Leading []Comment
+
+	// Trailing comments are after the start of the node on its last
+	// line (usually just one after the end of the node), or inside it
+	// but not part of any statement in it.
+	Trailing []Comment
+
+	// After comments are on the lines after the node when it's the
+	// last one in a block (or in the program).
+	After []Comment
+
+	// Inner comments are inside the node's braces when its block is
+	// empty, as in "BEGIN { # nothing yet }".
+	Inner []Comment
 }
 
 // String returns an indented, pretty-printed version of the parsed
 // program.
 func (p *Program) String() string {
 	parts := []string{}
+	if len(p.Loads) > 0 {
+		loads := make([]string, len(p.Loads))
+		for i, name := range p.Loads {
+			loads[i] = "@load " + strconv.Quote(name)
+		}
+		parts = append(parts, strings.Join(loads, "\n"))
+	}
 	for _, ss := range p.Begin {
 		parts = append(parts, "BEGIN {\n"+ss.String()+"}")
 	}
@@ -500,21 +575,27 @@ func (s *DoWhileStmt) String() string {
 }
 
 // BreakStmt is a break statement.
-type BreakStmt struct{}
+type BreakStmt struct {
+	_ byte // so pointers to different ones are distinct map keys
+}
 
 func (s *BreakStmt) String() string {
 	return "break"
 }
 
 // ContinueStmt is a continue statement.
-type ContinueStmt struct{}
+type ContinueStmt struct {
+	_ byte
+}
 
 func (s *ContinueStmt) String() string {
 	return "continue"
 }
 
 // NextStmt is a next statement.
-type NextStmt struct{}
+type NextStmt struct {
+	_ byte
+}
 
 func (s *NextStmt) String() string {
 	return "next"
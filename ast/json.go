@@ -0,0 +1,750 @@
+// Encoding syntax trees as JSON and decoding them
+
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	. "github.com/benhoyt/goawk/lexer"
+)
+
+// The JSON form of a program is an object with "begin", "actions",
+// "end", and "functions" lists, the "scalars" and "arrays" variable
+// indexes, and the program's "comments" (and a "loads" list of its
+// @load directives, if it has any). Each statement and expression
+// is an object whose "type" is the name of its Go type, like
+// "PrintStmt" or "BinaryExpr", and whose other keys are the type's
+// field names in lower case. Tokens (operators, redirects, and builtin
+// functions) are their String form, like "+" or "length", and optional
+// fields that are nil or ILLEGAL are left out. Nodes whose position is
+// known have "line" and "column" keys. For example, the expression
+// x + 1 is:
+//
+//	{"type":"BinaryExpr","line":1,"column":9,
+//	 "left":{"type":"VarExpr","line":1,"column":9,"scope":"global","index":0,"name":"x"},
+//	 "op":"+",
+//	 "right":{"type":"NumExpr","line":1,"column":13,"value":1}}
+
+// MarshalJSON encodes the program as JSON, including its positions
+// and comments (but not the comments attached to each node).
+func (p *Program) MarshalJSON() ([]byte, error) {
+	e := jsonEncoder{p}
+	var begin, actions, end, functions []interface{}
+	for i, stmts := range p.Begin {
+		begin = append(begin, e.item(p.BeginPositions, i, object{{"stmts", e.stmts(stmts)}}))
+	}
+	for i, action := range p.Actions {
+		pattern := make([]interface{}, len(action.Pattern))
+		for j, expr := range action.Pattern {
+			pattern[j] = e.expr(expr)
+		}
+		actions = append(actions, e.item(p.ActionPositions, i, object{
+			{"pattern", pattern},
+			{"stmts", e.stmts(action.Stmts)},
+		}))
+	}
+	for i, stmts := range p.End {
+		end = append(end, e.item(p.EndPositions, i, object{{"stmts", e.stmts(stmts)}}))
+	}
+	for i, f := range p.Functions {
+		functions = append(functions, e.item(p.FunctionPositions, i, object{
+			{"name", f.Name},
+			{"params", nonNil(f.Params)},
+			{"arrays", f.Arrays},
+			{"body", e.stmts(f.Body)},
+		}))
+	}
+	comments := make([]interface{}, len(p.Comments))
+	for i, c := range p.Comments {
+		comments[i] = object{{"line", c.Position.Line}, {"column", c.Position.Column}, {"text", c.Text}}
+	}
+	var fields object
+	if len(p.Loads) > 0 {
+		loads := make([]interface{}, len(p.Loads))
+		for i, name := range p.Loads {
+			loads[i] = e.item(p.LoadPositions, i, object{{"name", name}})
+		}
+		fields = append(fields, field{"loads", loads})
+	}
+	return json.Marshal(append(fields, object{
+		{"begin", nonNil(begin)},
+		{"actions", nonNil(actions)},
+		{"end", nonNil(end)},
+		{"functions", nonNil(functions)},
+		{"scalars", p.Scalars},
+		{"arrays", p.Arrays},
+		{"comments", comments},
+	}...))
+}
+
+// An object is a JSON object whose keys are in the given order.
+type object []field
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+func (o object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.key)
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Return list, or an empty list if it's nil (so it's [] rather than null).
+func nonNil(list interface{}) interface{} {
+	switch l := list.(type) {
+	case []interface{}:
+		if l == nil {
+			return []interface{}{}
+		}
+	case []string:
+		if l == nil {
+			return []string{}
+		}
+	}
+	return list
+}
+
+var scopeNames = map[VarScope]string{
+	ScopeSpecial: "special",
+	ScopeGlobal:  "global",
+	ScopeLocal:   "local",
+}
+
+type jsonEncoder struct {
+	prog *Program
+}
+
+// Return the fields of the i'th BEGIN block, action, END block, or
+// function, with its position from positions, if there is one.
+func (e jsonEncoder) item(positions []Position, i int, fields object) object {
+	if i < len(positions) {
+		pos := positions[i]
+		return append(object{{"line", pos.Line}, {"column", pos.Column}}, fields...)
+	}
+	return fields
+}
+
+// Return a node object with the given type, position, and fields.
+func (e jsonEncoder) node(typ string, pos Position, ok bool, fields ...field) object {
+	o := object{{"type", typ}}
+	if ok {
+		o = append(o, field{"line", pos.Line}, field{"column", pos.Column})
+	}
+	return append(o, fields...)
+}
+
+// Return stmts as a list, or nil if it's nil (like an action with no
+// body, which means the default { print $0 }).
+func (e jsonEncoder) stmts(stmts Stmts) interface{} {
+	if stmts == nil {
+		return nil
+	}
+	list := make([]interface{}, len(stmts))
+	for i, s := range stmts {
+		list[i] = e.stmt(s)
+	}
+	return list
+}
+
+func (e jsonEncoder) exprs(exprs []Expr) []interface{} {
+	list := make([]interface{}, len(exprs))
+	for i, expr := range exprs {
+		list[i] = e.expr(expr)
+	}
+	return list
+}
+
+// Append the optional field key to fields if it's not nil.
+func (e jsonEncoder) optExpr(fields []field, key string, expr Expr) []field {
+	if expr != nil {
+		fields = append(fields, field{key, e.expr(expr)})
+	}
+	return fields
+}
+
+// Append the fields of a print or printf statement's redirect, if it
+// has one.
+func (e jsonEncoder) redirect(fields []field, redirect Token, dest Expr) []field {
+	if redirect != ILLEGAL {
+		fields = append(fields, field{"redirect", redirect.String()}, field{"dest", e.expr(dest)})
+	}
+	return fields
+}
+
+func (e jsonEncoder) stmt(stmt Stmt) object {
+	pos, ok := e.prog.StmtPositions[stmt]
+	var typ string
+	var fields []field
+	switch s := stmt.(type) {
+	case *PrintStmt:
+		typ = "PrintStmt"
+		fields = e.redirect([]field{{"args", e.exprs(s.Args)}}, s.Redirect, s.Dest)
+	case *PrintfStmt:
+		typ = "PrintfStmt"
+		fields = e.redirect([]field{{"args", e.exprs(s.Args)}}, s.Redirect, s.Dest)
+	case *ExprStmt:
+		typ = "ExprStmt"
+		fields = []field{{"expr", e.expr(s.Expr)}}
+	case *IfStmt:
+		typ = "IfStmt"
+		fields = []field{{"cond", e.expr(s.Cond)}, {"body", e.stmts(s.Body)}}
+		if s.Else != nil {
+			fields = append(fields, field{"else", e.stmts(s.Else)})
+		}
+	case *ForStmt:
+		typ = "ForStmt"
+		if s.Pre != nil {
+			fields = append(fields, field{"pre", e.stmt(s.Pre)})
+		}
+		fields = e.optExpr(fields, "cond", s.Cond)
+		if s.Post != nil {
+			fields = append(fields, field{"post", e.stmt(s.Post)})
+		}
+		fields = append(fields, field{"body", e.stmts(s.Body)})
+	case *ForInStmt:
+		typ = "ForInStmt"
+		fields = []field{{"var", e.expr(s.Var)}, {"array", e.expr(s.Array)}, {"body", e.stmts(s.Body)}}
+	case *WhileStmt:
+		typ = "WhileStmt"
+		fields = []field{{"cond", e.expr(s.Cond)}, {"body", e.stmts(s.Body)}}
+	case *DoWhileStmt:
+		typ = "DoWhileStmt"
+		fields = []field{{"body", e.stmts(s.Body)}, {"cond", e.expr(s.Cond)}}
+	case *BreakStmt:
+		typ = "BreakStmt"
+	case *ContinueStmt:
+		typ = "ContinueStmt"
+	case *NextStmt:
+		typ = "NextStmt"
+	case *ExitStmt:
+		typ = "ExitStmt"
+		fields = e.optExpr(nil, "status", s.Status)
+	case *DeleteStmt:
+		typ = "DeleteStmt"
+		fields = []field{{"array", e.expr(s.Array)}}
+		if s.Index != nil {
+			fields = append(fields, field{"index", e.exprs(s.Index)})
+		}
+	case *ReturnStmt:
+		typ = "ReturnStmt"
+		fields = e.optExpr(nil, "value", s.Value)
+	case *BlockStmt:
+		typ = "BlockStmt"
+		fields = []field{{"body", e.stmts(s.Body)}}
+	default:
+		panic(fmt.Sprintf("unexpected stmt type: %T", stmt))
+	}
+	return e.node(typ, pos, ok, fields...)
+}
+
+func (e jsonEncoder) expr(expr Expr) object {
+	pos, ok := e.prog.ExprPositions[expr]
+	var typ string
+	var fields []field
+	switch ex := expr.(type) {
+	case *FieldExpr:
+		typ = "FieldExpr"
+		fields = []field{{"index", e.expr(ex.Index)}}
+	case *UnaryExpr:
+		typ = "UnaryExpr"
+		fields = []field{{"op", ex.Op.String()}, {"value", e.expr(ex.Value)}}
+	case *BinaryExpr:
+		typ = "BinaryExpr"
+		fields = []field{{"left", e.expr(ex.Left)}, {"op", ex.Op.String()}, {"right", e.expr(ex.Right)}}
+	case *ArrayExpr:
+		typ = "ArrayExpr"
+		fields = []field{{"scope", scopeNames[ex.Scope]}, {"index", ex.Index}, {"name", ex.Name}}
+	case *InExpr:
+		typ = "InExpr"
+		fields = []field{{"index", e.exprs(ex.Index)}, {"array", e.expr(ex.Array)}}
+	case *CondExpr:
+		typ = "CondExpr"
+		fields = []field{{"cond", e.expr(ex.Cond)}, {"true", e.expr(ex.True)}, {"false", e.expr(ex.False)}}
+	case *NumExpr:
+		typ = "NumExpr"
+		var value interface{} = ex.Value
+		if math.IsInf(ex.Value, 0) || math.IsNaN(ex.Value) {
+			// JSON has no infinity or NaN, so use a string (like 1e999
+			// would be)
+			value = fmt.Sprint(ex.Value)
+		}
+		fields = []field{{"value", value}}
+	case *StrExpr:
+		typ = "StrExpr"
+		fields = []field{{"value", ex.Value}}
+	case *RegExpr:
+		typ = "RegExpr"
+		fields = []field{{"regex", ex.Regex}}
+	case *VarExpr:
+		typ = "VarExpr"
+		fields = []field{{"scope", scopeNames[ex.Scope]}, {"index", ex.Index}, {"name", ex.Name}}
+	case *IndexExpr:
+		typ = "IndexExpr"
+		fields = []field{{"array", e.expr(ex.Array)}, {"index", e.exprs(ex.Index)}}
+	case *AssignExpr:
+		typ = "AssignExpr"
+		fields = []field{{"left", e.expr(ex.Left)}, {"right", e.expr(ex.Right)}}
+	case *AugAssignExpr:
+		typ = "AugAssignExpr"
+		fields = []field{{"left", e.expr(ex.Left)}, {"op", ex.Op.String()}, {"right", e.expr(ex.Right)}}
+	case *IncrExpr:
+		typ = "IncrExpr"
+		fields = []field{{"expr", e.expr(ex.Expr)}, {"op", ex.Op.String()}, {"pre", ex.Pre}}
+	case *CallExpr:
+		typ = "CallExpr"
+		fields = []field{{"func", ex.Func.String()}, {"args", e.exprs(ex.Args)}}
+	case *UserCallExpr:
+		typ = "UserCallExpr"
+		fields = []field{{"native", ex.Native}, {"index", ex.Index}, {"name", ex.Name}, {"args", e.exprs(ex.Args)}}
+	case *MultiExpr:
+		typ = "MultiExpr"
+		fields = []field{{"exprs", e.exprs(ex.Exprs)}}
+	case *GetlineExpr:
+		typ = "GetlineExpr"
+		fields = e.optExpr(fields, "command", ex.Command)
+		fields = e.optExpr(fields, "target", ex.Target)
+		fields = e.optExpr(fields, "file", ex.File)
+	default:
+		panic(fmt.Sprintf("unexpected expr type: %T", expr))
+	}
+	return e.node(typ, pos, ok, fields...)
+}
+
+// UnmarshalJSON decodes a program from the JSON form MarshalJSON
+// produces, replacing the contents of p. Use String and
+// parser.ParseProgram to run the decoded program.
+func (p *Program) UnmarshalJSON(data []byte) (err error) {
+	defer func() {
+		// Like the parser, the decoder panics with a *jsonError to
+		// signal errors, and they're caught here.
+		if r := recover(); r != nil {
+			e, ok := r.(*jsonError)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+
+	var prog struct {
+		Loads     []jsonItem
+		Begin     []jsonItem
+		Actions   []jsonItem
+		End       []jsonItem
+		Functions []jsonItem
+		Scalars   map[string]int
+		Arrays    map[string]int
+		Comments  []struct {
+			Line   int
+			Column int
+			Text   string
+		}
+	}
+	if err := json.Unmarshal(data, &prog); err != nil {
+		return err
+	}
+	*p = Program{
+		Scalars:          prog.Scalars,
+		Arrays:           prog.Arrays,
+		StmtPositions:    make(map[Stmt]Position),
+		PatternPositions: make(map[Expr]Position),
+		ExprPositions:    make(map[Expr]Position),
+		StmtComments:     make(map[Stmt]*Comments),
+	}
+	d := jsonDecoder{p}
+	for _, item := range prog.Loads {
+		p.Loads = append(p.Loads, item.Name)
+		p.LoadPositions = append(p.LoadPositions, item.position())
+	}
+	for _, item := range prog.Begin {
+		p.Begin = append(p.Begin, d.stmts(item.Stmts))
+		p.BeginPositions = append(p.BeginPositions, item.position())
+	}
+	for _, item := range prog.Actions {
+		var pattern []Expr
+		for _, raw := range item.Pattern {
+			expr := d.expr(raw)
+			if pos, ok := p.ExprPositions[expr]; ok {
+				p.PatternPositions[expr] = pos
+			}
+			pattern = append(pattern, expr)
+		}
+		p.Actions = append(p.Actions, Action{Pattern: pattern, Stmts: d.stmts(item.Stmts)})
+		p.ActionPositions = append(p.ActionPositions, item.position())
+	}
+	for _, item := range prog.End {
+		p.End = append(p.End, d.stmts(item.Stmts))
+		p.EndPositions = append(p.EndPositions, item.position())
+	}
+	for _, item := range prog.Functions {
+		arrays := item.Arrays
+		if len(arrays) != len(item.Params) {
+			arrays = make([]bool, len(item.Params))
+		}
+		p.Functions = append(p.Functions, Function{
+			Name:   item.Name,
+			Params: item.Params,
+			Arrays: arrays,
+			Body:   d.stmts(item.Body),
+		})
+		p.FunctionPositions = append(p.FunctionPositions, item.position())
+	}
+	for _, c := range prog.Comments {
+		p.Comments = append(p.Comments, Comment{Position{Line: c.Line, Column: c.Column}, c.Text})
+	}
+	return nil
+}
+
+// jsonItem is the JSON form of a BEGIN or END block, action, or
+// function.
+type jsonItem struct {
+	Line    int
+	Column  int
+	Pattern []json.RawMessage
+	Stmts   json.RawMessage
+	Name    string
+	Params  []string
+	Arrays  []bool
+	Body    json.RawMessage
+}
+
+func (i jsonItem) position() Position {
+	return Position{Line: i.Line, Column: i.Column}
+}
+
+// jsonNode is the JSON form of a statement or expression, with the
+// fields of every type (only the ones a node's type has are used).
+type jsonNode struct {
+	Type     string
+	Line     int
+	Column   int
+	Args     []json.RawMessage
+	Redirect string
+	Dest     json.RawMessage
+	Expr     json.RawMessage
+	Cond     json.RawMessage
+	Body     json.RawMessage
+	Else     json.RawMessage
+	Pre      json.RawMessage
+	Post     json.RawMessage
+	Var      json.RawMessage
+	Array    json.RawMessage
+	Status   json.RawMessage
+	Index    json.RawMessage
+	Value    json.RawMessage
+	Left     json.RawMessage
+	Op       string
+	Right    json.RawMessage
+	True     json.RawMessage
+	False    json.RawMessage
+	Scope    string
+	Name     string
+	Regex    string
+	Func     string
+	Native   bool
+	Exprs    []json.RawMessage
+	Command  json.RawMessage
+	Target   json.RawMessage
+	File     json.RawMessage
+}
+
+type jsonError struct {
+	message string
+}
+
+func (e *jsonError) Error() string {
+	return "invalid program JSON: " + e.message
+}
+
+func jsonErrorf(format string, args ...interface{}) *jsonError {
+	return &jsonError{fmt.Sprintf(format, args...)}
+}
+
+type jsonDecoder struct {
+	prog *Program
+}
+
+// Return true if raw is missing or null.
+func isNull(raw json.RawMessage) bool {
+	return len(raw) == 0 || string(raw) == "null"
+}
+
+func (d jsonDecoder) node(raw json.RawMessage) *jsonNode {
+	var n jsonNode
+	if err := json.Unmarshal(raw, &n); err != nil {
+		panic(jsonErrorf("%v", err))
+	}
+	return &n
+}
+
+// Decode a list of statements; null is nil, as opposed to an empty list.
+func (d jsonDecoder) stmts(raw json.RawMessage) Stmts {
+	if isNull(raw) {
+		return nil
+	}
+	var list []json.RawMessage
+	if err := json.Unmarshal(raw, &list); err != nil {
+		panic(jsonErrorf("%v", err))
+	}
+	stmts := Stmts{}
+	for _, r := range list {
+		stmts = append(stmts, d.stmt(r))
+	}
+	return stmts
+}
+
+func (d jsonDecoder) exprs(list []json.RawMessage) []Expr {
+	var exprs []Expr
+	for _, raw := range list {
+		exprs = append(exprs, d.expr(raw))
+	}
+	return exprs
+}
+
+// Decode an index list, which is a JSON list of expressions.
+func (d jsonDecoder) index(raw json.RawMessage) []Expr {
+	if isNull(raw) {
+		return nil
+	}
+	var list []json.RawMessage
+	if err := json.Unmarshal(raw, &list); err != nil {
+		panic(jsonErrorf("%v", err))
+	}
+	return d.exprs(list)
+}
+
+// Decode an optional expression, returning nil if it's missing.
+func (d jsonDecoder) optExpr(raw json.RawMessage) Expr {
+	if isNull(raw) {
+		return nil
+	}
+	return d.expr(raw)
+}
+
+func (d jsonDecoder) optStmt(raw json.RawMessage) Stmt {
+	if isNull(raw) {
+		return nil
+	}
+	return d.stmt(raw)
+}
+
+func (d jsonDecoder) redirect(n *jsonNode) (Token, Expr) {
+	if n.Redirect == "" {
+		return ILLEGAL, nil
+	}
+	redirect := d.token(n.Redirect, GREATER, APPEND, PIPE)
+	return redirect, d.expr(n.Dest)
+}
+
+// Return the token named name, which must be one of the given tokens.
+func (d jsonDecoder) token(name string, tokens ...Token) Token {
+	for _, t := range tokens {
+		if t.String() == name {
+			return t
+		}
+	}
+	panic(jsonErrorf("unexpected token %q", name))
+}
+
+func (d jsonDecoder) stmt(raw json.RawMessage) Stmt {
+	n := d.node(raw)
+	var s Stmt
+	switch n.Type {
+	case "PrintStmt":
+		redirect, dest := d.redirect(n)
+		s = &PrintStmt{d.exprs(n.Args), redirect, dest}
+	case "PrintfStmt":
+		redirect, dest := d.redirect(n)
+		s = &PrintfStmt{d.exprs(n.Args), redirect, dest}
+	case "ExprStmt":
+		s = &ExprStmt{d.expr(n.Expr)}
+	case "IfStmt":
+		s = &IfStmt{d.expr(n.Cond), d.stmts(n.Body), d.stmts(n.Else)}
+	case "ForStmt":
+		s = &ForStmt{d.optStmt(n.Pre), d.optExpr(n.Cond), d.optStmt(n.Post), d.stmts(n.Body)}
+	case "ForInStmt":
+		s = &ForInStmt{d.varExpr(n.Var), d.arrayExpr(n.Array), d.stmts(n.Body)}
+	case "WhileStmt":
+		s = &WhileStmt{d.expr(n.Cond), d.stmts(n.Body)}
+	case "DoWhileStmt":
+		s = &DoWhileStmt{d.stmts(n.Body), d.expr(n.Cond)}
+	case "BreakStmt":
+		s = &BreakStmt{}
+	case "ContinueStmt":
+		s = &ContinueStmt{}
+	case "NextStmt":
+		s = &NextStmt{}
+	case "ExitStmt":
+		s = &ExitStmt{d.optExpr(n.Status)}
+	case "DeleteStmt":
+		s = &DeleteStmt{d.arrayExpr(n.Array), d.index(n.Index)}
+	case "ReturnStmt":
+		s = &ReturnStmt{d.optExpr(n.Value)}
+	case "BlockStmt":
+		s = &BlockStmt{d.stmts(n.Body)}
+	default:
+		panic(jsonErrorf("unexpected statement type %q", n.Type))
+	}
+	if n.Line > 0 {
+		d.prog.StmtPositions[s] = Position{Line: n.Line, Column: n.Column}
+	}
+	return s
+}
+
+func (d jsonDecoder) expr(raw json.RawMessage) Expr {
+	if isNull(raw) {
+		panic(jsonErrorf("expected expression, got null"))
+	}
+	n := d.node(raw)
+	var e Expr
+	switch n.Type {
+	case "FieldExpr":
+		e = &FieldExpr{d.expr(n.Index)}
+	case "UnaryExpr":
+		e = &UnaryExpr{d.token(n.Op, SUB, ADD, NOT), d.expr(n.Value)}
+	case "BinaryExpr":
+		op := d.token(n.Op, ADD, SUB, MUL, DIV, MOD, POW, CONCAT, AND, OR,
+			EQUALS, NOT_EQUALS, LESS, LTE, GREATER, GTE, MATCH, NOT_MATCH)
+		e = &BinaryExpr{d.expr(n.Left), op, d.expr(n.Right)}
+	case "ArrayExpr":
+		e = d.arrayExpr(raw)
+	case "InExpr":
+		e = &InExpr{d.index(n.Index), d.arrayExpr(n.Array)}
+	case "CondExpr":
+		e = &CondExpr{d.expr(n.Cond), d.expr(n.True), d.expr(n.False)}
+	case "NumExpr":
+		var value interface{}
+		if err := json.Unmarshal(n.Value, &value); err != nil {
+			panic(jsonErrorf("%v", err))
+		}
+		var num float64
+		switch v := value.(type) {
+		case float64:
+			num = v
+		case string:
+			if _, err := fmt.Sscan(v, &num); err != nil {
+				panic(jsonErrorf("invalid number %q", v))
+			}
+		default:
+			panic(jsonErrorf("invalid number %s", n.Value))
+		}
+		e = &NumExpr{num}
+	case "StrExpr":
+		var value string
+		if err := json.Unmarshal(n.Value, &value); err != nil {
+			panic(jsonErrorf("%v", err))
+		}
+		e = &StrExpr{value}
+	case "RegExpr":
+		e = &RegExpr{n.Regex}
+	case "VarExpr":
+		e = d.varExpr(raw)
+	case "IndexExpr":
+		e = &IndexExpr{d.arrayExpr(n.Array), d.index(n.Index)}
+	case "AssignExpr":
+		e = &AssignExpr{d.expr(n.Left), d.expr(n.Right)}
+	case "AugAssignExpr":
+		op := d.token(n.Op, ADD, SUB, MUL, DIV, MOD, POW)
+		e = &AugAssignExpr{d.expr(n.Left), op, d.expr(n.Right)}
+	case "IncrExpr":
+		var pre bool
+		if !isNull(n.Pre) {
+			if err := json.Unmarshal(n.Pre, &pre); err != nil {
+				panic(jsonErrorf("%v", err))
+			}
+		}
+		e = &IncrExpr{d.expr(n.Expr), d.token(n.Op, INCR, DECR), pre}
+	case "CallExpr":
+		f := KeywordToken(n.Func)
+		if f < FIRST_FUNC || f > LAST_FUNC {
+			f = ExtensionToken(n.Func)
+		}
+		if f == ILLEGAL {
+			panic(jsonErrorf("unexpected builtin function %q", n.Func))
+		}
+		e = &CallExpr{f, d.exprs(n.Args)}
+	case "UserCallExpr":
+		var index int
+		if !isNull(n.Index) {
+			if err := json.Unmarshal(n.Index, &index); err != nil {
+				panic(jsonErrorf("%v", err))
+			}
+		}
+		e = &UserCallExpr{n.Native, index, n.Name, d.exprs(n.Args)}
+	case "MultiExpr":
+		e = &MultiExpr{d.exprs(n.Exprs)}
+	case "GetlineExpr":
+		e = &GetlineExpr{d.optExpr(n.Command), d.optExpr(n.Target), d.optExpr(n.File)}
+	default:
+		panic(jsonErrorf("unexpected expression type %q", n.Type))
+	}
+	if n.Line > 0 {
+		d.prog.ExprPositions[e] = Position{Line: n.Line, Column: n.Column}
+	}
+	return e
+}
+
+// Decode the scope, index, and name of a variable or array.
+func (d jsonDecoder) variable(n *jsonNode) (VarScope, int, string) {
+	scope := VarScope(-1)
+	for s, name := range scopeNames {
+		if name == n.Scope {
+			scope = s
+		}
+	}
+	if scope < 0 {
+		panic(jsonErrorf("unexpected scope %q", n.Scope))
+	}
+	var index int
+	if !isNull(n.Index) {
+		if err := json.Unmarshal(n.Index, &index); err != nil {
+			panic(jsonErrorf("%v", err))
+		}
+	}
+	return scope, index, n.Name
+}
+
+func (d jsonDecoder) varExpr(raw json.RawMessage) *VarExpr {
+	n := d.node(raw)
+	if n.Type != "VarExpr" {
+		panic(jsonErrorf("expected VarExpr, got %q", n.Type))
+	}
+	scope, index, name := d.variable(n)
+	e := &VarExpr{scope, index, name}
+	if n.Line > 0 {
+		d.prog.ExprPositions[e] = Position{Line: n.Line, Column: n.Column}
+	}
+	return e
+}
+
+func (d jsonDecoder) arrayExpr(raw json.RawMessage) *ArrayExpr {
+	n := d.node(raw)
+	if n.Type != "ArrayExpr" {
+		panic(jsonErrorf("expected ArrayExpr, got %q", n.Type))
+	}
+	scope, index, name := d.variable(n)
+	e := &ArrayExpr{scope, index, name}
+	if n.Line > 0 {
+		d.prog.ExprPositions[e] = Position{Line: n.Line, Column: n.Column}
+	}
+	return e
+}
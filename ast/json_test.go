@@ -0,0 +1,107 @@
+package ast_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/benhoyt/goawk/ast"
+	"github.com/benhoyt/goawk/parser"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	prog, err := parser.ParseProgram([]byte(`BEGIN { print x + 1 > "out" }`), nil)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	data, err := json.Marshal(prog.AST())
+	if err != nil {
+		t.Fatalf("error marshaling: %v", err)
+	}
+	expected := `{"begin":[{"line":1,"column":1,"stmts":[` +
+		`{"type":"PrintStmt","line":1,"column":9,"args":[` +
+		`{"type":"BinaryExpr","line":1,"column":15,` +
+		`"left":{"type":"VarExpr","line":1,"column":15,"scope":"global","index":0,"name":"x"},` +
+		`"op":"+",` +
+		`"right":{"type":"NumExpr","line":1,"column":19,"value":1}}],` +
+		`"redirect":"\u003e","dest":{"type":"StrExpr","line":1,"column":23,"value":"out"}}]}],` +
+		`"actions":[],"end":[],"functions":[],"scalars":{"x":0},` +
+		// Global array indexes are assigned in map iteration order
+		fmt.Sprintf(`"arrays":{"ARGV":%d,"ENVIRON":%d},`, prog.AST().Arrays["ARGV"], prog.AST().Arrays["ENVIRON"]) +
+		`"comments":[]}`
+	if string(data) != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, data)
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	src := `
+@load "ext"
+# count things
+BEGIN { FS = ":"; n = split("a b", parts) }
+$1 ~ /x/, !seen[$2]++ { sum += $3 * -2; printf "%s\n", $0 | "sort" }
+NR > 1
+END {
+	for (k in seen) delete seen[k]
+	for (i = 0; i < 3; i++) { if (i == 1) continue; else break }
+	while ((getline line < "f") > 0) print line
+	do { x = x "y" } while (length(x) < 3)
+	print (1, 2) in a, f(1e999), substr(x, 2) ? 1 : 0
+	delete a; exit 1
+}
+function f(n, arr) { arr[1]; "date" | getline; return n ^ 2 }
+`
+	config := &parser.ParserConfig{
+		Load: func(name string) (map[string]interface{}, error) { return nil, nil },
+	}
+	prog, err := parser.ParseProgram([]byte(src), config)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	tree := prog.AST()
+	data, err := json.Marshal(tree)
+	if err != nil {
+		t.Fatalf("error marshaling: %v", err)
+	}
+	var decoded ast.Program
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatalf("error unmarshaling: %v", err)
+	}
+	if decoded.String() != tree.String() {
+		t.Fatalf("expected:\n%s\ngot:\n%s", tree, &decoded)
+	}
+	// Positions are encoded, so they're the same if the encoding is
+	again, err := json.Marshal(&decoded)
+	if err != nil {
+		t.Fatalf("error marshaling again: %v", err)
+	}
+	if string(again) != string(data) {
+		t.Fatalf("expected:\n%s\ngot:\n%s", data, again)
+	}
+	if !reflect.DeepEqual(decoded.Comments, tree.Comments) {
+		t.Fatalf("expected comments %v, got %v", tree.Comments, decoded.Comments)
+	}
+}
+
+func TestUnmarshalJSONError(t *testing.T) {
+	tests := []struct {
+		data  string
+		error string
+	}{
+		{`{"begin":[{"stmts":[{"type":"GotoStmt"}]}]}`, `unexpected statement type "GotoStmt"`},
+		{`{"begin":[{"stmts":[{"type":"ExprStmt"}]}]}`, `expected expression, got null`},
+		{`{"end":[{"stmts":[{"type":"ExprStmt","expr":{"type":"BinaryExpr","op":"=",` +
+			`"left":{"type":"NumExpr","value":1},"right":{"type":"NumExpr","value":2}}}]}]}`, `unexpected token "="`},
+		{`{"actions":[{"pattern":[{"type":"VarExpr","scope":"outer","name":"x"}]}]}`, `unexpected scope "outer"`},
+	}
+	for _, test := range tests {
+		var prog ast.Program
+		err := json.Unmarshal([]byte(test.data), &prog)
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("%s: expected error containing %q, got %v", test.data, test.error, err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Constructors for building and transforming syntax trees
+
+package ast
+
+import (
+	. "github.com/benhoyt/goawk/lexer"
+)
+
+// The constructors below create nodes for tools that build or
+// transform programs. Variables, arrays, and calls of user-defined
+// functions are created unresolved (with Index 0 and global scope), so
+// a program built with them should be turned back into source with
+// String and parsed again with parser.ParseProgram to run it.
+
+// NewProgram returns a program with the given parts.
+func NewProgram(begin []Stmts, actions []Action, end []Stmts, functions []Function) *Program {
+	return &Program{Begin: begin, Actions: actions, End: end, Functions: functions}
+}
+
+// NewAction returns a pattern-action block. Pattern has zero, one, or
+// two (for a range pattern) expressions, and nil stmts means the
+// default action, { print $0 }.
+func NewAction(pattern []Expr, stmts Stmts) Action {
+	return Action{Pattern: pattern, Stmts: stmts}
+}
+
+// NewFunction returns a function definition. Each element of arrays
+// says whether the corresponding parameter is used as an array.
+func NewFunction(name string, params []string, arrays []bool, body Stmts) Function {
+	return Function{Name: name, Params: params, Arrays: arrays, Body: body}
+}
+
+// NewFieldExpr returns a field expression like $index.
+func NewFieldExpr(index Expr) *FieldExpr {
+	return &FieldExpr{Index: index}
+}
+
+// NewUnaryExpr returns a unary expression; op is SUB, ADD, or NOT.
+func NewUnaryExpr(op Token, value Expr) *UnaryExpr {
+	return &UnaryExpr{Op: op, Value: value}
+}
+
+// NewBinaryExpr returns a binary expression like "left + right". Use
+// CONCAT for concatenation, and AND or OR for && and ||.
+func NewBinaryExpr(left Expr, op Token, right Expr) *BinaryExpr {
+	return &BinaryExpr{Left: left, Op: op, Right: right}
+}
+
+// NewArrayExpr returns a reference to the named array.
+func NewArrayExpr(name string) *ArrayExpr {
+	return &ArrayExpr{Scope: ScopeGlobal, Name: name}
+}
+
+// NewInExpr returns an expression like "(index) in array".
+func NewInExpr(index []Expr, array *ArrayExpr) *InExpr {
+	return &InExpr{Index: index, Array: array}
+}
+
+// NewCondExpr returns a conditional expression like "cond ? t : f".
+func NewCondExpr(cond, t, f Expr) *CondExpr {
+	return &CondExpr{Cond: cond, True: t, False: f}
+}
+
+// NewNumExpr returns a number constant.
+func NewNumExpr(value float64) *NumExpr {
+	return &NumExpr{Value: value}
+}
+
+// NewStrExpr returns a string constant.
+func NewStrExpr(value string) *StrExpr {
+	return &StrExpr{Value: value}
+}
+
+// NewRegExpr returns a regex constant like /regex/.
+func NewRegExpr(regex string) *RegExpr {
+	return &RegExpr{Regex: regex}
+}
+
+// NewVarExpr returns a reference to the named scalar variable, which
+// may be a special variable like NR.
+func NewVarExpr(name string) *VarExpr {
+	if index := SpecialVarIndex(name); index > 0 {
+		return &VarExpr{Scope: ScopeSpecial, Index: index, Name: name}
+	}
+	return &VarExpr{Scope: ScopeGlobal, Name: name}
+}
+
+// NewIndexExpr returns an array element expression like array[index].
+func NewIndexExpr(array *ArrayExpr, index []Expr) *IndexExpr {
+	return &IndexExpr{Array: array, Index: index}
+}
+
+// NewAssignExpr returns an assignment like "left = right". Left must
+// be a variable, array element, or field.
+func NewAssignExpr(left, right Expr) *AssignExpr {
+	return &AssignExpr{Left: left, Right: right}
+}
+
+// NewAugAssignExpr returns an augmented assignment like "left += right"
+// (op is ADD for +=, and so on).
+func NewAugAssignExpr(left Expr, op Token, right Expr) *AugAssignExpr {
+	return &AugAssignExpr{Left: left, Op: op, Right: right}
+}
+
+// NewIncrExpr returns an increment or decrement; op is INCR or DECR.
+func NewIncrExpr(expr Expr, op Token, pre bool) *IncrExpr {
+	return &IncrExpr{Expr: expr, Op: op, Pre: pre}
+}
+
+// NewCallExpr returns a call of a builtin function, like F_LENGTH.
+func NewCallExpr(function Token, args []Expr) *CallExpr {
+	return &CallExpr{Func: function, Args: args}
+}
+
+// NewUserCallExpr returns a call of the named user-defined function.
+func NewUserCallExpr(name string, args []Expr) *UserCallExpr {
+	return &UserCallExpr{Name: name, Args: args}
+}
+
+// NewGetlineExpr returns a getline expression: "command | getline
+// target" if command is not nil, otherwise "getline target < file".
+// Target and file may be nil.
+func NewGetlineExpr(command, target, file Expr) *GetlineExpr {
+	return &GetlineExpr{Command: command, Target: target, File: file}
+}
+
+// NewPrintStmt returns a print statement. Redirect is ILLEGAL if
+// there's no redirect, otherwise GREATER, APPEND, or PIPE.
+func NewPrintStmt(args []Expr, redirect Token, dest Expr) *PrintStmt {
+	return &PrintStmt{Args: args, Redirect: redirect, Dest: dest}
+}
+
+// NewPrintfStmt returns a printf statement (see NewPrintStmt).
+func NewPrintfStmt(args []Expr, redirect Token, dest Expr) *PrintfStmt {
+	return &PrintfStmt{Args: args, Redirect: redirect, Dest: dest}
+}
+
+// NewExprStmt returns an expression statement.
+func NewExprStmt(expr Expr) *ExprStmt {
+	return &ExprStmt{Expr: expr}
+}
+
+// NewIfStmt returns an if statement; elseBody may be nil.
+func NewIfStmt(cond Expr, body, elseBody Stmts) *IfStmt {
+	return &IfStmt{Cond: cond, Body: body, Else: elseBody}
+}
+
+// NewForStmt returns a C-like for loop. Pre, cond, and post may be nil.
+func NewForStmt(pre Stmt, cond Expr, post Stmt, body Stmts) *ForStmt {
+	return &ForStmt{Pre: pre, Cond: cond, Post: post, Body: body}
+}
+
+// NewForInStmt returns a "for (v in array)" loop.
+func NewForInStmt(v *VarExpr, array *ArrayExpr, body Stmts) *ForInStmt {
+	return &ForInStmt{Var: v, Array: array, Body: body}
+}
+
+// NewWhileStmt returns a while loop.
+func NewWhileStmt(cond Expr, body Stmts) *WhileStmt {
+	return &WhileStmt{Cond: cond, Body: body}
+}
+
+// NewDoWhileStmt returns a do-while loop.
+func NewDoWhileStmt(body Stmts, cond Expr) *DoWhileStmt {
+	return &DoWhileStmt{Body: body, Cond: cond}
+}
+
+// NewExitStmt returns an exit statement; status may be nil.
+func NewExitStmt(status Expr) *ExitStmt {
+	return &ExitStmt{Status: status}
+}
+
+// NewDeleteStmt returns a delete statement. If index is nil, it
+// deletes the whole array.
+func NewDeleteStmt(array *ArrayExpr, index []Expr) *DeleteStmt {
+	return &DeleteStmt{Array: array, Index: index}
+}
+
+// NewReturnStmt returns a return statement; value may be nil.
+func NewReturnStmt(value Expr) *ReturnStmt {
+	return &ReturnStmt{Value: value}
+}
+
+// NewBlockStmt returns a { ... } block statement.
+func NewBlockStmt(body Stmts) *BlockStmt {
+	return &BlockStmt{Body: body}
+}
@@ -10,6 +10,7 @@ const (
 	V_ILLEGAL = iota
 	V_ARGC
 	V_CONVFMT
+	V_ERRNO
 	V_FILENAME
 	V_FNR
 	V_FS
@@ -30,6 +31,7 @@ const (
 var specialVars = map[string]int{
 	"ARGC":     V_ARGC,
 	"CONVFMT":  V_CONVFMT,
+	"ERRNO":    V_ERRNO,
 	"FILENAME": V_FILENAME,
 	"FNR":      V_FNR,
 	"FS":       V_FS,
@@ -60,6 +62,8 @@ func SpecialVarName(index int) string {
 		return "ARGC"
 	case V_CONVFMT:
 		return "CONVFMT"
+	case V_ERRNO:
+		return "ERRNO"
 	case V_FILENAME:
 		return "FILENAME"
 	case V_FNR:
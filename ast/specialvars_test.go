@@ -12,6 +12,7 @@ func TestNameIndex(t *testing.T) {
 		{"ILLEGAL", V_ILLEGAL},
 		{"ARGC", V_ARGC},
 		{"CONVFMT", V_CONVFMT},
+		{"ERRNO", V_ERRNO},
 		{"FILENAME", V_FILENAME},
 		{"FNR", V_FNR},
 		{"FS", V_FS},
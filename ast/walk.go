@@ -0,0 +1,201 @@
+// Walking the abstract syntax tree
+
+package ast
+
+// Node is any node of the abstract syntax tree: a *Program, an
+// *Action, a *Function, a block of Stmts, a Stmt, or an Expr.
+type Node interface {
+	String() string
+}
+
+// A Visitor's Visit method is called by Walk for each node it walks.
+// If the result w is not nil, Walk walks each of the node's children
+// with w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses the tree rooted at node in source order. It starts by
+// calling v.Visit(node), and then walks the node's children as
+// described for Visitor. Optional children that are nil (like the
+// destination of a print without a redirect) aren't walked.
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		for _, stmts := range n.Begin {
+			Walk(v, stmts)
+		}
+		for i := range n.Actions {
+			Walk(v, &n.Actions[i])
+		}
+		for _, stmts := range n.End {
+			Walk(v, stmts)
+		}
+		for i := range n.Functions {
+			Walk(v, &n.Functions[i])
+		}
+
+	case *Action:
+		walkExprs(v, n.Pattern)
+		walkStmts(v, n.Stmts)
+
+	case *Function:
+		walkStmts(v, n.Body)
+
+	case Stmts:
+		for _, stmt := range n {
+			Walk(v, stmt)
+		}
+
+	// Statements
+	case *PrintStmt:
+		walkExprs(v, n.Args)
+		walkExpr(v, n.Dest)
+
+	case *PrintfStmt:
+		walkExprs(v, n.Args)
+		walkExpr(v, n.Dest)
+
+	case *ExprStmt:
+		Walk(v, n.Expr)
+
+	case *IfStmt:
+		Walk(v, n.Cond)
+		walkStmts(v, n.Body)
+		walkStmts(v, n.Else)
+
+	case *ForStmt:
+		if n.Pre != nil {
+			Walk(v, n.Pre)
+		}
+		walkExpr(v, n.Cond)
+		if n.Post != nil {
+			Walk(v, n.Post)
+		}
+		walkStmts(v, n.Body)
+
+	case *ForInStmt:
+		Walk(v, n.Var)
+		Walk(v, n.Array)
+		walkStmts(v, n.Body)
+
+	case *WhileStmt:
+		Walk(v, n.Cond)
+		walkStmts(v, n.Body)
+
+	case *DoWhileStmt:
+		walkStmts(v, n.Body)
+		Walk(v, n.Cond)
+
+	case *BreakStmt, *ContinueStmt, *NextStmt:
+		// Nothing to walk
+
+	case *ExitStmt:
+		walkExpr(v, n.Status)
+
+	case *DeleteStmt:
+		Walk(v, n.Array)
+		walkExprs(v, n.Index)
+
+	case *ReturnStmt:
+		walkExpr(v, n.Value)
+
+	case *BlockStmt:
+		walkStmts(v, n.Body)
+
+	// Expressions
+	case *FieldExpr:
+		Walk(v, n.Index)
+
+	case *UnaryExpr:
+		Walk(v, n.Value)
+
+	case *BinaryExpr:
+		Walk(v, n.Left)
+		Walk(v, n.Right)
+
+	case *InExpr:
+		walkExprs(v, n.Index)
+		Walk(v, n.Array)
+
+	case *CondExpr:
+		Walk(v, n.Cond)
+		Walk(v, n.True)
+		Walk(v, n.False)
+
+	case *ArrayExpr, *NumExpr, *StrExpr, *RegExpr, *VarExpr:
+		// Nothing to walk
+
+	case *IndexExpr:
+		Walk(v, n.Array)
+		walkExprs(v, n.Index)
+
+	case *AssignExpr:
+		Walk(v, n.Left)
+		Walk(v, n.Right)
+
+	case *AugAssignExpr:
+		Walk(v, n.Left)
+		Walk(v, n.Right)
+
+	case *IncrExpr:
+		Walk(v, n.Expr)
+
+	case *CallExpr:
+		walkExprs(v, n.Args)
+
+	case *UserCallExpr:
+		walkExprs(v, n.Args)
+
+	case *MultiExpr:
+		walkExprs(v, n.Exprs)
+
+	case *GetlineExpr:
+		walkExpr(v, n.Command)
+		walkExpr(v, n.Target)
+		walkExpr(v, n.File)
+	}
+
+	v.Visit(nil)
+}
+
+// Walk expr if it's not nil.
+func walkExpr(v Visitor, expr Expr) {
+	if expr != nil {
+		Walk(v, expr)
+	}
+}
+
+func walkExprs(v Visitor, exprs []Expr) {
+	for _, expr := range exprs {
+		Walk(v, expr)
+	}
+}
+
+// Walk stmts if it's not nil (an empty block is still walked).
+func walkStmts(v Visitor, stmts Stmts) {
+	if stmts != nil {
+		Walk(v, stmts)
+	}
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses the tree rooted at node in source order, like
+// Walk. It starts by calling f(node); if that returns true, Inspect
+// calls itself for each of the node's children, followed by a call of
+// f(nil).
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
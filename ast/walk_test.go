@@ -0,0 +1,136 @@
+package ast_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/benhoyt/goawk/ast"
+	. "github.com/benhoyt/goawk/lexer"
+	"github.com/benhoyt/goawk/parser"
+)
+
+func TestWalk(t *testing.T) {
+	src := `
+BEGIN { x = 1 }
+$1 ~ /a/ { a[$2]++; print x, f(NR) > "out" }
+END { for (k in a) delete a[k] }
+function f(n) { return n * 2 }
+`
+	prog, err := parser.ParseProgram([]byte(src), nil)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	var nodes []string
+	depth := 0
+	ast.Inspect(prog.AST(), func(node ast.Node) bool {
+		if node == nil {
+			depth--
+			return false
+		}
+		// Skip the whole-program and block nodes, as their String
+		// output is long
+		switch node.(type) {
+		case *ast.Program, ast.Stmts, *ast.Action, *ast.Function:
+		default:
+			nodes = append(nodes, fmt.Sprintf("%d %T %s", depth, node, node))
+		}
+		depth++
+		return true
+	})
+	expected := `
+2 *ast.ExprStmt x = 1
+3 *ast.AssignExpr x = 1
+4 *ast.VarExpr x
+4 *ast.NumExpr 1
+2 *ast.BinaryExpr ($1 ~ "a")
+3 *ast.FieldExpr $1
+4 *ast.NumExpr 1
+3 *ast.StrExpr "a"
+3 *ast.ExprStmt a[$2]++
+4 *ast.IncrExpr a[$2]++
+5 *ast.IndexExpr a[$2]
+6 *ast.ArrayExpr a
+6 *ast.FieldExpr $2
+7 *ast.NumExpr 2
+3 *ast.PrintStmt print x, f(NR) >"out"
+4 *ast.VarExpr x
+4 *ast.UserCallExpr f(NR)
+5 *ast.VarExpr NR
+4 *ast.StrExpr "out"
+2 *ast.ForInStmt for (k in a) {
+    delete a[k]
+}
+3 *ast.VarExpr k
+3 *ast.ArrayExpr a
+4 *ast.DeleteStmt delete a[k]
+5 *ast.ArrayExpr a
+5 *ast.VarExpr k
+3 *ast.ReturnStmt return (n * 2)
+4 *ast.BinaryExpr (n * 2)
+5 *ast.VarExpr n
+5 *ast.NumExpr 2
+`[1:]
+	got := strings.Join(nodes, "\n") + "\n"
+	if got != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+type countingVisitor struct {
+	counts map[string]int
+}
+
+func (v countingVisitor) Visit(node ast.Node) ast.Visitor {
+	switch node.(type) {
+	case *ast.FieldExpr:
+		v.counts["fields"]++
+	case *ast.UserCallExpr:
+		v.counts["calls"]++
+		return nil // don't count fields in arguments
+	}
+	return v
+}
+
+func TestWalkVisitor(t *testing.T) {
+	prog, err := parser.ParseProgram([]byte(`{ print $1, f($2, $3) } function f(a, b) { return $4 }`), nil)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	v := countingVisitor{make(map[string]int)}
+	ast.Walk(v, prog.AST())
+	if v.counts["fields"] != 2 || v.counts["calls"] != 1 {
+		t.Fatalf("expected 2 fields and 1 call, got %v", v.counts)
+	}
+}
+
+func TestConstructors(t *testing.T) {
+	// Build the equivalent of: $3 > 10 { n++; s = s $1 } END { print n, s > "/dev/stderr" }
+	n := ast.NewVarExpr("n")
+	s := ast.NewVarExpr("s")
+	prog := ast.NewProgram(nil, []ast.Action{
+		ast.NewAction(
+			[]ast.Expr{ast.NewBinaryExpr(ast.NewFieldExpr(ast.NewNumExpr(3)), GREATER, ast.NewNumExpr(10))},
+			ast.Stmts{
+				ast.NewExprStmt(ast.NewIncrExpr(n, INCR, false)),
+				ast.NewExprStmt(ast.NewAssignExpr(s, ast.NewBinaryExpr(s, CONCAT, ast.NewFieldExpr(ast.NewNumExpr(1))))),
+			},
+		),
+	}, []ast.Stmts{{
+		ast.NewPrintStmt([]ast.Expr{n, s}, GREATER, ast.NewStrExpr("/dev/stderr")),
+	}}, nil)
+
+	if nr := ast.NewVarExpr("NR"); nr.Scope != ast.ScopeSpecial || nr.Index != ast.V_NR {
+		t.Errorf("expected NR to be special variable %d, got %v %d", ast.V_NR, nr.Scope, nr.Index)
+	}
+
+	// The program's source should parse to the same program
+	src := prog.String()
+	parsed, err := parser.ParseProgram([]byte(src), nil)
+	if err != nil {
+		t.Fatalf("error parsing %q: %v", src, err)
+	}
+	if parsed.String() != src {
+		t.Fatalf("expected:\n%s\ngot:\n%s", src, parsed.String())
+	}
+}
@@ -2,7 +2,9 @@
 
 /*
 NOT SUPPORTED:
-- functions
+- native Go functions, and "next" inside functions
+- functions that return different types, or whose return value is
+  used but that don't return one
 - dynamic typing
 - non-literal [s]printf format strings?
 - assigning numStr values (but using $0 in conditionals works)
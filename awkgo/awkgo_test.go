@@ -117,7 +117,7 @@ BEGIN {
 
 	// next statement
 	{`{ if (NR==2) next; print }`, "a\nb\nc", "a\nc\n", ""},
-	//{`{ if (NR==2) f(); print }  function f() { next }`, "a\nb\nc", "a\nc\n", "functions not yet supported"},
+	{`{ if (NR==2) f(); print }  function f() { next }`, "a\nb\nc", "a\nc\n", `"next" inside a function not yet supported`},
 	{`BEGIN { next }`, "", "", "parse error at 1:9: next can't be inside BEGIN or END"},
 	{`END { next }`, "", "", "parse error at 1:7: next can't be inside BEGIN or END"},
 
@@ -158,26 +158,26 @@ BEGIN {
 	{`{ print ($1>=2) }`, "1\n1.0\n+1", "0\n0\n0\n", ""},
 
 	// Short-circuit && and || operators
-	//	{`
-	//function t() { print "t"; return 1 }
-	//function f() { print "f"; return 0 }
-	//BEGIN {
-	//	print f() && f()
-	//	print f() && t()
-	//	print t() && f()
-	//	print t() && t()
-	//}
-	//`, "", "f\n0\nf\n0\nt\nf\n0\nt\nt\n1\n", ""},
-	//	{`
-	//function t() { print "t"; return 1 }
-	//function f() { print "f"; return 0 }
-	//BEGIN {
-	//	print f() || f()
-	//	print f() || t()
-	//	print t() || f()
-	//	print t() || t()
-	//}
-	//`, "", "f\nf\n0\nf\nt\n1\nt\n1\nt\n1\n", ""},
+	{`
+function t() { print "t"; return 1 }
+function f() { print "f"; return 0 }
+BEGIN {
+	print f() && f()
+	print f() && t()
+	print t() && f()
+	print t() && t()
+}
+`, "", "f\n0\nf\n0\nt\nf\n0\nt\nt\n1\n", ""},
+	{`
+function t() { print "t"; return 1 }
+function f() { print "f"; return 0 }
+BEGIN {
+	print f() || f()
+	print f() || t()
+	print t() || f()
+	print t() || t()
+}
+`, "", "f\nf\n0\nf\nt\n1\nt\n1\nt\n1\n", ""},
 
 	// Other binary expressions: + - * ^ / % CONCAT ~ !~
 	{`BEGIN { print 1+2, 1+2+3, 1+-2, -1+2, "1"+"2", 3+.14 }`, "", "3 6 -1 1 3 3.14\n", ""},
@@ -444,93 +444,93 @@ BEGIN {
 	{`BEGIN { print(1 ? x="t" : "f"); print x; }`, "", "t\nt\n", ""},
 
 	// Locals vs globals, array params, and recursion
-	//	{`
-	//function f(loc) {
-	//	glob += 1
-	//	loc += 1
-	//	print glob, loc
-	//}
-	//BEGIN {
-	//	glob = 1
-	//	loc = 42
-	//	f(3)
-	//	print loc
-	//	f(4)
-	//	print loc
-	//}
-	//`, "", "2 4\n42\n3 5\n42\n", ""},
-	//	{`
-	//function set(a, x, v) {
-	//	a[x] = v
-	//}
-	//function get(a, x) {
-	//	return a[x]
-	//}
-	//BEGIN {
-	//	a["x"] = 1
-	//	set(b, "y", 2)
-	//	for (k in a) print k, a[k]
-	//	print "---"
-	//	for (k in b) print k, b[k]
-	//	print "---"
-	//	print get(a, "x"), get(b, "y")
-	//}
-	//`, "", "x 1\n---\ny 2\n---\n1 2\n", ""},
-	//	{`
-	//function fib(n) {
-	//	return n < 3 ? 1 : fib(n-2) + fib(n-1)
-	//}
-	//BEGIN {
-	//	for (i = 1; i <= 7; i++) {
-	//		printf "%d ", fib(i)
-	//	}
-	//}
-	//`, "", "1 1 2 3 5 8 13 ", ""},
-	//	{`
-	//function f(a, x) { return a[x] }
-	//function g(b, y) { f(b, y) }
-	//BEGIN { c[1]=2; print f(c, 1); print g(c, 1) }
-	//`, "", "2\n\n", ""},
-	//	{`
-	//function g(b, y) { return f(b, y) }
-	//function f(a, x) { return a[x] }
-	//BEGIN { c[1]=2; print f(c, 1); print g(c, 1) }
-	//`, "", "2\n2\n", ""},
-	//	{`
-	//function h(b, y) { g(b, y) }
-	//function g(b, y) { f(b, y) }
-	//function f(a, x) { return a[x] }
-	//BEGIN { c[1]=2; print f(c, 1); print g(c, 1) }
-	//`, "", "2\n\n", ""},
-	//	{`
-	//function h(b, y) { return g(b, y) }
-	//function g(b, y) { return f(b, y) }
-	//function f(a, x) { return a[x] }
-	//BEGIN { c[1]=2; print f(c, 1); print g(c, 1); print h(c, 1) }
-	//`, "", "2\n2\n2\n", ""},
-	//	{`
-	//function get(a, x) { return a[x] }
-	//BEGIN { a[1]=2; print get(a, x); print get(1, 2); }
-	//# !awk - awk doesn't detect this
-	//`, "", "", `parse error at 3:40: can't pass scalar 1 as array param`},
-	//	{`
-	//function early() {
-	//	print "x"
-	//	return
-	//	print "y"
-	//}
-	//BEGIN { early() }
-	//`, "", "x\n", ""},
-	//	{`BEGIN { return }`, "", "", "parse error at 1:9: return must be inside a function"},
-	//	{`function f() { printf "x" }; BEGIN { f() } `, "", "x", ""},
-	//	{`function f(x) { 0 in _; f(_) }  BEGIN { f() }  # !awk !gawk`, "", "",
-	//		`parse error at 1:25: can't pass array "_" as scalar param`},
-	//	{`BEGIN { for (i=0; i<1001; i++) f(); print x }  function f() { x++ }`, "", "1001\n", ""},
-	//	{`
-	//function bar(y) { return y[1] }
-	//function foo() { return bar(x) }
-	//BEGIN { x[1] = 42; print foo() }
-	//`, "", "42\n", ""},
+	{`
+function f(loc) {
+	glob += 1
+	loc += 1
+	print glob, loc
+}
+BEGIN {
+	glob = 1
+	loc = 42
+	f(3)
+	print loc
+	f(4)
+	print loc
+}
+`, "", "2 4\n42\n3 5\n42\n", ""},
+	{`
+function set(a, x, v) {
+	a[x] = v
+}
+function get(a, x) {
+	return a[x]
+}
+BEGIN {
+	a["x"] = 1
+	set(b, "y", 2)
+	for (k in a) print k, a[k]
+	print "---"
+	for (k in b) print k, b[k]
+	print "---"
+	print get(a, "x"), get(b, "y")
+}
+`, "", "x 1\n---\ny 2\n---\n1 2\n", ""},
+	{`
+function fib(n) {
+	return n < 3 ? 1 : fib(n-2) + fib(n-1)
+}
+BEGIN {
+	for (i = 1; i <= 7; i++) {
+		printf "%d ", fib(i)
+	}
+}
+`, "", "1 1 2 3 5 8 13 ", ""},
+	{`
+function f(a, x) { return a[x] }
+function g(b, y) { f(b, y) }
+BEGIN { c[1]=2; print f(c, 1); print g(c, 1) }
+`, "", "", `return value of function "g" used, but it doesn't return a value`},
+	{`
+function g(b, y) { return f(b, y) }
+function f(a, x) { return a[x] }
+BEGIN { c[1]=2; print f(c, 1); print g(c, 1) }
+`, "", "2\n2\n", ""},
+	{`
+function h(b, y) { g(b, y) }
+function g(b, y) { f(b, y) }
+function f(a, x) { return a[x] }
+BEGIN { c[1]=2; print f(c, 1); print g(c, 1) }
+`, "", "", `type of "y" in function "h" not known; need assignment or argument?`},
+	{`
+function h(b, y) { return g(b, y) }
+function g(b, y) { return f(b, y) }
+function f(a, x) { return a[x] }
+BEGIN { c[1]=2; print f(c, 1); print g(c, 1); print h(c, 1) }
+`, "", "2\n2\n2\n", ""},
+	{`
+function get(a, x) { return a[x] }
+BEGIN { a[1]=2; print get(a, x); print get(1, 2); }
+# !awk - awk doesn't detect this
+`, "", "", `parse error at 3:40: can't pass scalar 1 as array param`},
+	{`
+function early() {
+	print "x"
+	return
+	print "y"
+}
+BEGIN { early() }
+`, "", "x\n", ""},
+	{`BEGIN { return }`, "", "", "parse error at 1:9: return must be inside a function"},
+	{`function f() { printf "x" }; BEGIN { f() } `, "", "x", ""},
+	//{`function f(x) { 0 in _; f(_) }  BEGIN { f() }  # !awk !gawk`, "", "",
+	//	`parse error at 1:25: can't pass array "_" as scalar param`},
+	{`BEGIN { for (i=0; i<1001; i++) f(); print x }  function f() { x++ }`, "", "1001\n", ""},
+	{`
+function bar(y) { return y[1] }
+function foo() { return bar(x) }
+BEGIN { x[1] = 42; print foo() }
+`, "", "42\n", ""},
 	// failing because f1 doesn't use x, so resolver assumes its type is scalar
 	// 		{`
 	// function f1(x) { }
@@ -541,26 +541,26 @@ BEGIN {
 	// Type checking / resolver tests
 	{`BEGIN { a[x]; a=42 }`, "", "", `parse error at 1:15: can't use array "a" as scalar`},
 	{`BEGIN { s=42; s[x] }`, "", "", `parse error at 1:15: can't use scalar "s" as array`},
-	//	{`function get(a, k) { return a[k] }  BEGIN { a = 42; print get(a, 1); }  # !awk - doesn't error in awk`,
-	//		"", "", `parse error at 1:59: can't pass scalar "a" as array param`},
-	//	{`function get(a, k) { return a+k } BEGIN { a[42]; print get(a, 1); }`,
-	//		"", "", `parse error at 1:56: can't pass array "a" as scalar param`},
-	//	{`{ f(z) }  function f(x) { print NR }`, "abc", "1\n", ""},
-	//	{`function f() { f() }  BEGIN { f() }  # !awk !gawk`, "", "", `calling "f" exceeded maximum call depth of 1000`},
-	//	{`function f(x) { 0 in x }  BEGIN { f(FS) }  # !awk`, "", "", `parse error at 1:35: can't pass scalar "FS" as array param`},
-	//	{`
-	//function foo(x) { print "foo", x }
-	//function bar(foo) { print "bar", foo }
-	//BEGIN { foo(5); bar(10) }
-	//`, "", "foo 5\nbar 10\n", ""},
-	//	{`
-	//function foo(foo) { print "foo", foo }
-	//function bar(foo) { print "bar", foo }
-	//BEGIN { foo(5); bar(10) }
-	//`, "", "", `parse error at 2:14: can't use function name as parameter name`},
-	//	{`function foo() { print foo }  BEGIN { foo() }`,
-	//		"", "", `parse error at 1:46: global var "foo" can't also be a function`},
-	//	{`function f(x) { print x, x(); }  BEGIN { f() }`, "", "", `parse error at 1:27: can't call local variable "x" as function`},
+	{`function get(a, k) { return a[k] }  BEGIN { a = 42; print get(a, 1); }  # !awk - doesn't error in awk`,
+		"", "", `parse error at 1:59: can't pass scalar "a" as array param`},
+	{`function get(a, k) { return a+k } BEGIN { a[42]; print get(a, 1); }`,
+		"", "", `parse error at 1:56: can't pass array "a" as scalar param`},
+	//{`{ f(z) }  function f(x) { print NR }`, "abc", "1\n", ""},
+	//{`function f() { f() }  BEGIN { f() }  # !awk !gawk`, "", "", `calling "f" exceeded maximum call depth of 1000`},
+	{`function f(x) { 0 in x }  BEGIN { f(FS) }  # !awk`, "", "", `parse error at 1:35: can't pass scalar "FS" as array param`},
+	{`
+function foo(x) { print "foo", x }
+function bar(foo) { print "bar", foo }
+BEGIN { foo(5); bar(10) }
+`, "", "foo 5\nbar 10\n", ""},
+	{`
+function foo(foo) { print "foo", foo }
+function bar(foo) { print "bar", foo }
+BEGIN { foo(5); bar(10) }
+`, "", "", `parse error at 2:14: can't use function name as parameter name`},
+	{`function foo() { print foo }  BEGIN { foo() }`,
+		"", "", `parse error at 1:46: global var "foo" can't also be a function`},
+	{`function f(x) { print x, x(); }  BEGIN { f() }`, "", "", `parse error at 1:27: can't call local variable "x" as function`},
 
 	// Redirected I/O (we give explicit errors, awk and gawk don't)
 	// the following two tests sometimes fail under TravisCI with: "write |1: broken pipe"
@@ -11,7 +11,7 @@ import (
 	"sort"
 	"strconv"
 
-	"github.com/benhoyt/goawk/internal/ast"
+	"github.com/benhoyt/goawk/ast"
 	. "github.com/benhoyt/goawk/lexer"
 	"github.com/benhoyt/goawk/parser"
 )
@@ -35,10 +35,17 @@ func compile(prog *parser.Program, writer io.Writer) (err error) {
 	t := newTyper()
 	t.program(prog)
 
-	// Do a second typing pass over the program to ensure we detect the types
-	// of variables assigned after they're used, for example:
+	// Do more typing passes over the program until no more types are
+	// found, to ensure we detect the types of variables assigned after
+	// they're used, for example:
 	// BEGIN { while (i<5) { i++; print i } }
-	t.program(prog)
+	// Types also flow between functions and their callers this way.
+	t.changed = true
+	for t.changed {
+		t.changed = false
+		t.program(prog)
+	}
+	t.check()
 
 	c := &compiler{
 		typer:   t,
@@ -63,9 +70,10 @@ func errorf(format string, args ...interface{}) error {
 }
 
 type compiler struct {
-	typer   *typer
-	writer  io.Writer
-	regexen map[string]int
+	typer    *typer
+	writer   io.Writer
+	regexen  map[string]int
+	function *funcType // function being compiled, or nil
 }
 
 func (c *compiler) output(s string) {
@@ -181,6 +189,12 @@ func main() {
 
 	c.output("}\n")
 
+	for _, f := range c.typer.funcs {
+		c.function = f
+		c.functionDecl(f)
+	}
+	c.function = nil
+
 	type regex struct {
 		pattern string
 		n       int
@@ -203,6 +217,54 @@ func main() {
 	c.outputHelpers()
 }
 
+// Output a Go func for an AWK function. Scalars are passed by value
+// and arrays (maps) by reference, as in AWK.
+func (c *compiler) functionDecl(f *funcType) {
+	c.outputf("\nfunc %s(", f.function.Name)
+	for i, param := range f.function.Params {
+		if i > 0 {
+			c.output(", ")
+		}
+		c.outputf("%s %s", param, c.goType(f.locals[param]))
+	}
+	c.output(")")
+	if f.ret != typeUnknown {
+		c.outputf(" %s", c.goType(f.ret))
+	}
+	c.output(" {\n")
+	c.stmts(f.function.Body)
+	if f.ret != typeUnknown {
+		// Falling off the end of a function returns null
+		c.outputf("return %s\n", c.zeroValue(f.ret))
+	}
+	c.output("}\n")
+}
+
+// Return the Go code for a call to AWK function f with the given args.
+// Missing arguments (often used as local variables) are passed as
+// zero values, or new maps for arrays.
+func (c *compiler) userCall(e *ast.UserCallExpr) string {
+	f := c.typer.funcs[e.Index]
+	str := f.function.Name + "("
+	for i, param := range f.function.Params {
+		if i > 0 {
+			str += ", "
+		}
+		typ := f.locals[param]
+		switch {
+		case i >= len(e.Args):
+			str += c.zeroValue(typ)
+		case f.function.Arrays[i]:
+			str += e.Args[i].(*ast.VarExpr).Name
+		case typ == typeStr:
+			str += c.strExpr(e.Args[i])
+		default:
+			str += c.numExpr(e.Args[i])
+		}
+	}
+	return str + ")"
+}
+
 func (c *compiler) actions(actions []ast.Action) {
 	for i, action := range actions {
 		c.output("\n")
@@ -332,6 +394,9 @@ func (c *compiler) stmtNoNewline(stmt ast.Stmt) {
 					c.intExpr(left.Index), op)
 			}
 
+		case *ast.UserCallExpr:
+			c.output(c.userCall(e))
+
 		default:
 			c.outputf("_ = %s", c.expr(s.Expr))
 		}
@@ -472,6 +537,17 @@ func (c *compiler) stmtNoNewline(stmt ast.Stmt) {
 			c.outputf("for _k := range %s {\ndelete(%s, _k)\n}", s.Array.Name, s.Array.Name)
 		}
 
+	case *ast.ReturnStmt:
+		ret := c.function.ret
+		switch {
+		case ret == typeUnknown:
+			c.output("return")
+		case s.Value == nil:
+			c.outputf("return %s", c.zeroValue(ret))
+		default:
+			c.outputf("return %s", c.expr(s.Value))
+		}
+
 	case *ast.BlockStmt:
 		c.output("{\n")
 		c.stmts(s.Body)
@@ -533,7 +609,7 @@ func (c *compiler) expr(expr ast.Expr) string {
 		switch e.Scope {
 		case ast.ScopeSpecial:
 			return c.special(e.Name, e.Index)
-		case ast.ScopeGlobal:
+		case ast.ScopeGlobal, ast.ScopeLocal:
 			return e.Name
 		default:
 			panic(errorf("unexpected scope %v", e.Scope))
@@ -577,7 +653,7 @@ func (c *compiler) expr(expr ast.Expr) string {
 		switch e.Array.Scope {
 		case ast.ScopeSpecial:
 			panic(errorf("special variable %s not yet supported", e.Array.Name))
-		case ast.ScopeGlobal:
+		case ast.ScopeGlobal, ast.ScopeLocal:
 			return e.Array.Name + "[" + c.index(e.Index) + "]"
 		default:
 			panic(errorf("unexpected scope %v", e.Array.Scope))
@@ -627,6 +703,9 @@ func (c *compiler) expr(expr ast.Expr) string {
 			return "math.Log(" + c.numExpr(e.Args[0]) + ")"
 
 		case F_MATCH:
+			if len(e.Args) > 2 {
+				panic(errorf("match() array argument not supported"))
+			}
 			if strExpr, ok := e.Args[1].(*ast.StrExpr); ok {
 				return fmt.Sprintf("_match(%s, %s)", c.strExpr(e.Args[0]), c.regexLiteral(strExpr.Value))
 			}
@@ -745,6 +824,12 @@ func (c *compiler) expr(expr ast.Expr) string {
 		return fmt.Sprintf("func() float64 { _, ok := %s[%s]; if ok { return 1 }; return 0 }()",
 			e.Array.Name, c.index(e.Index))
 
+	case *ast.UserCallExpr:
+		if c.typer.funcs[e.Index].ret == typeUnknown {
+			panic(errorf("return value of function %q used, but it doesn't return a value", e.Name))
+		}
+		return c.userCall(e)
+
 	default:
 		panic(errorf("%T not yet supported", expr))
 	}
@@ -934,6 +1019,19 @@ func (c *compiler) goType(typ valueType) string {
 	}
 }
 
+// Return the Go zero value (or a new map) for type typ, which is also
+// the value of an uninitialized AWK variable.
+func (c *compiler) zeroValue(typ valueType) string {
+	switch typ {
+	case typeStr:
+		return `""`
+	case typeNum:
+		return "0.0"
+	default:
+		return "make(" + c.goType(typ) + ")"
+	}
+}
+
 func (c *compiler) printfArgs(format string, args []ast.Expr) []string {
 	argIndex := 0
 	nextArg := func() ast.Expr {
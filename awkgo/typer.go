@@ -3,7 +3,7 @@
 package main
 
 import (
-	"github.com/benhoyt/goawk/internal/ast"
+	"github.com/benhoyt/goawk/ast"
 	. "github.com/benhoyt/goawk/lexer"
 	"github.com/benhoyt/goawk/parser"
 )
@@ -15,9 +15,23 @@ type typer struct {
 	scalarRefs   map[string]bool
 	arrayRefs    map[string]bool
 	exprs        map[ast.Expr]valueType
-	funcName     string // function name if inside a func, else ""
+	funcs        []*funcType
+	funcName     string    // function name if inside a func, else ""
+	function     *funcType // function being typed, or nil
 	nextUsed     bool
 	oFSRSChanged bool
+	changed      bool // a variable or function type was determined this pass
+}
+
+// funcType holds the types of a function's parameters (including
+// arrays) and its return value, which is typeUnknown if it never
+// returns a value.
+type funcType struct {
+	function   ast.Function
+	locals     map[string]valueType
+	scalarRefs map[string]bool
+	arrayRefs  map[string]bool
+	ret        valueType
 }
 
 func newTyper() *typer {
@@ -39,6 +53,20 @@ func newTyper() *typer {
 }
 
 func (t *typer) program(prog *parser.Program) {
+	if t.funcs == nil {
+		for _, f := range prog.Functions {
+			if f.Name == "main" || f.Name == "init" {
+				panic(errorf("function name %q not supported", f.Name))
+			}
+			t.funcs = append(t.funcs, &funcType{
+				function:   f,
+				locals:     make(map[string]valueType),
+				scalarRefs: make(map[string]bool),
+				arrayRefs:  make(map[string]bool),
+			})
+		}
+	}
+
 	for _, stmts := range prog.Begin {
 		t.stmts(stmts)
 	}
@@ -46,10 +74,18 @@ func (t *typer) program(prog *parser.Program) {
 	for _, stmts := range prog.End {
 		t.stmts(stmts)
 	}
-	for range prog.Functions {
-		panic(errorf("functions not yet supported"))
+	for _, f := range t.funcs {
+		t.funcName = f.function.Name
+		t.function = f
+		t.stmts(f.function.Body)
 	}
+	t.funcName = ""
+	t.function = nil
+}
 
+// Check that the types of all variables used are known (call after
+// the last typing pass).
+func (t *typer) check() {
 	for name := range t.scalarRefs {
 		if t.globals[name] == typeUnknown {
 			panic(errorf("type of %q not known; need assignment?", name))
@@ -60,6 +96,29 @@ func (t *typer) program(prog *parser.Program) {
 			panic(errorf("type of array %q not known; need array assignment?", name))
 		}
 	}
+	for _, f := range t.funcs {
+		for name := range f.scalarRefs {
+			if f.locals[name] == typeUnknown {
+				panic(errorf("type of %q in function %q not known; need assignment or argument?", name, f.function.Name))
+			}
+		}
+		for name := range f.arrayRefs {
+			if f.locals[name] == typeUnknown {
+				panic(errorf("type of array %q in function %q not known; need array assignment or argument?", name, f.function.Name))
+			}
+		}
+		for i, name := range f.function.Params {
+			if f.locals[name] == typeUnknown {
+				// Parameters that are never used or passed get a
+				// placeholder type
+				if f.function.Arrays[i] {
+					f.locals[name] = typeArrayNum
+				} else {
+					f.locals[name] = typeNum
+				}
+			}
+		}
+	}
 }
 
 func (t *typer) stmts(stmts ast.Stmts) {
@@ -116,7 +175,7 @@ func (t *typer) stmt(stmt ast.Stmt) {
 		t.stmts(s.Body)
 
 	case *ast.ForInStmt:
-		t.setType(s.Var.Name, typeStr)
+		t.setType(s.Var.Scope, s.Var.Name, typeStr)
 		t.stmts(s.Body)
 
 	case *ast.WhileStmt:
@@ -149,7 +208,16 @@ func (t *typer) stmt(stmt ast.Stmt) {
 
 	case *ast.ReturnStmt:
 		if s.Value != nil {
-			t.expr(s.Value)
+			typ := t.expr(s.Value)
+			f := t.function
+			switch {
+			case typ == typeUnknown || typ == f.ret:
+			case f.ret == typeUnknown:
+				f.ret = typ
+				t.changed = true
+			default:
+				panic(errorf("function %q returns both %s and %s", f.function.Name, f.ret, typ))
+			}
 		}
 
 	case *ast.BlockStmt:
@@ -160,17 +228,32 @@ func (t *typer) stmt(stmt ast.Stmt) {
 	}
 }
 
-func (t *typer) setType(name string, typ valueType) {
-	if t.globals[name] == typ {
+func (t *typer) setType(scope ast.VarScope, name string, typ valueType) {
+	types := t.globals
+	if scope == ast.ScopeLocal {
+		types = t.function.locals
+	}
+	t.setMapType(types, name, typ)
+}
+
+func (t *typer) setMapType(types map[string]valueType, name string, typ valueType) {
+	if typ == typeUnknown || types[name] == typ {
 		return
 	}
-	if t.globals[name] != typeUnknown {
+	if types[name] != typeUnknown {
 		panic(errorf("variable %q already set to %s, can't set to %s",
-			name, t.globals[name], typ))
+			name, types[name], typ))
 	}
-	if typ != typeUnknown {
-		t.globals[name] = typ
+	types[name] = typ
+	t.changed = true
+}
+
+// Return the type of the variable with the given scope and name.
+func (t *typer) varType(scope ast.VarScope, name string) valueType {
+	if scope == ast.ScopeLocal {
+		return t.function.locals[name]
 	}
+	return t.globals[name]
 }
 
 func (t *typer) expr(expr ast.Expr) (typ valueType) {
@@ -233,17 +316,24 @@ func (t *typer) expr(expr ast.Expr) (typ valueType) {
 		case ast.ScopeGlobal:
 			t.scalarRefs[e.Name] = true
 			return t.globals[e.Name]
+		case ast.ScopeLocal:
+			t.function.scalarRefs[e.Name] = true
+			return t.function.locals[e.Name]
 		default:
 			panic(errorf("unexpected scope %v", e.Scope))
 		}
 
 	case *ast.IndexExpr:
-		t.arrayRefs[e.Array.Name] = true
+		if e.Array.Scope == ast.ScopeLocal {
+			t.function.arrayRefs[e.Array.Name] = true
+		} else {
+			t.arrayRefs[e.Array.Name] = true
+		}
 		t.expr(e.Array)
 		for _, index := range e.Index {
 			t.expr(index)
 		}
-		switch t.globals[e.Array.Name] {
+		switch t.varType(e.Array.Scope, e.Array.Name) {
 		case typeArrayStr:
 			return typeStr
 		case typeArrayNum:
@@ -256,7 +346,7 @@ func (t *typer) expr(expr ast.Expr) (typ valueType) {
 		switch left := e.Left.(type) {
 		case *ast.VarExpr:
 			// x = right
-			t.setType(left.Name, rightType)
+			t.setType(left.Scope, left.Name, rightType)
 			if left.Name == "OFS" || left.Name == "ORS" {
 				t.oFSRSChanged = true
 			}
@@ -264,9 +354,9 @@ func (t *typer) expr(expr ast.Expr) (typ valueType) {
 			// m[k] = right
 			switch rightType {
 			case typeStr:
-				t.setType(left.Array.Name, typeArrayStr)
+				t.setType(left.Array.Scope, left.Array.Name, typeArrayStr)
 			case typeNum:
-				t.setType(left.Array.Name, typeArrayNum)
+				t.setType(left.Array.Scope, left.Array.Name, typeArrayNum)
 			}
 		case *ast.FieldExpr:
 			// $1 = right
@@ -279,13 +369,13 @@ func (t *typer) expr(expr ast.Expr) (typ valueType) {
 		switch left := e.Left.(type) {
 		case *ast.VarExpr:
 			// x += right
-			t.setType(left.Name, typeNum)
+			t.setType(left.Scope, left.Name, typeNum)
 			if left.Name == "OFS" || left.Name == "ORS" {
 				t.oFSRSChanged = true
 			}
 		case *ast.IndexExpr:
 			// m[k] += right
-			t.setType(left.Array.Name, typeArrayNum)
+			t.setType(left.Array.Scope, left.Array.Name, typeArrayNum)
 		case *ast.FieldExpr:
 			// $1 += right
 		}
@@ -296,13 +386,13 @@ func (t *typer) expr(expr ast.Expr) (typ valueType) {
 		switch left := e.Expr.(type) {
 		case *ast.VarExpr:
 			// x++
-			t.setType(left.Name, typeNum)
+			t.setType(left.Scope, left.Name, typeNum)
 			if left.Name == "OFS" || left.Name == "ORS" {
 				t.oFSRSChanged = true
 			}
 		case *ast.IndexExpr:
 			// m[k]++
-			t.setType(left.Array.Name, typeArrayNum)
+			t.setType(left.Array.Scope, left.Array.Name, typeArrayNum)
 		case *ast.FieldExpr:
 			// $1++
 		}
@@ -313,13 +403,17 @@ func (t *typer) expr(expr ast.Expr) (typ valueType) {
 		switch e.Func {
 		case F_SPLIT:
 			// split's second arg is an array arg
+			if len(e.Args) > 3 {
+				panic(errorf("split() seps argument not supported"))
+			}
 			t.expr(e.Args[0])
 			arrayExpr := e.Args[1].(*ast.ArrayExpr)
-			if t.globals[arrayExpr.Name] != typeUnknown && t.globals[arrayExpr.Name] != typeArrayStr {
+			arrayType := t.varType(arrayExpr.Scope, arrayExpr.Name)
+			if arrayType != typeUnknown && arrayType != typeArrayStr {
 				panic(errorf("%q already set to %s, can't use as %s in split()",
-					arrayExpr.Name, t.globals[arrayExpr.Name], typeArrayStr))
+					arrayExpr.Name, arrayType, typeArrayStr))
 			}
-			t.globals[arrayExpr.Name] = typeArrayStr
+			t.setType(arrayExpr.Scope, arrayExpr.Name, typeArrayStr)
 			if len(e.Args) == 3 {
 				t.expr(e.Args[2])
 			}
@@ -331,9 +425,9 @@ func (t *typer) expr(expr ast.Expr) (typ valueType) {
 				// sub and gsub's third arg is actually an lvalue
 				switch left := e.Args[2].(type) {
 				case *ast.VarExpr:
-					t.setType(left.Name, typeStr)
+					t.setType(left.Scope, left.Name, typeStr)
 				case *ast.IndexExpr:
-					t.setType(left.Array.Name, typeArrayStr)
+					t.setType(left.Array.Scope, left.Array.Name, typeArrayStr)
 				}
 			}
 			return typeNum
@@ -352,7 +446,27 @@ func (t *typer) expr(expr ast.Expr) (typ valueType) {
 		}
 
 	case *ast.UserCallExpr:
-		panic(errorf("functions not yet supported"))
+		if e.Native {
+			panic(errorf("native functions not supported"))
+		}
+		f := t.funcs[e.Index]
+		for i, arg := range e.Args {
+			param := f.function.Params[i]
+			if f.function.Arrays[i] {
+				// Array arguments are passed by reference, so their
+				// type is shared by the argument and the parameter
+				argExpr := arg.(*ast.VarExpr)
+				argType := t.varType(argExpr.Scope, argExpr.Name)
+				if argType == typeUnknown {
+					t.setType(argExpr.Scope, argExpr.Name, f.locals[param])
+				} else {
+					t.setMapType(f.locals, param, argType)
+				}
+				continue
+			}
+			t.setMapType(f.locals, param, t.expr(arg))
+		}
+		return f.ret
 
 	case *ast.GetlineExpr:
 		return typeNum
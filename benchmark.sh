@@ -1,2 +1,3 @@
 #!/bin/sh
 go test ./interp -bench=. -count=5 > benchmarks_new.txt
+./benchmark_check.py benchmarks.txt benchmarks_new.txt
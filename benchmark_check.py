@@ -0,0 +1,78 @@
+#!/usr/bin/env python3
+# Check Go benchmark results for performance regressions
+#
+# Compares the output of "go test -bench" (usually from benchmark.sh) with
+# a baseline, and exits with status 1 if any benchmark got slower by more
+# than the given threshold, or if the geometric mean of all of them did.
+# With -count=N, the median of each benchmark's runs is used.
+
+from __future__ import print_function
+
+import argparse
+import collections
+import math
+import re
+import statistics
+import sys
+
+BENCH_RE = re.compile(r'^(Benchmark\S+?)(?:-\d+)?\s+\d+\s+([0-9.]+) ns/op')
+
+
+def read_results(filename):
+    results = collections.defaultdict(list)
+    with open(filename) as f:
+        for line in f:
+            match = BENCH_RE.match(line)
+            if match:
+                results[match.group(1)].append(float(match.group(2)))
+    return {name: statistics.median(times) for name, times in results.items()}
+
+
+def main():
+    parser = argparse.ArgumentParser(description='Check Go benchmarks for regressions')
+    parser.add_argument('old', nargs='?', default='benchmarks.txt',
+                        help='baseline results (default %(default)s)')
+    parser.add_argument('new', nargs='?', default='benchmarks_new.txt',
+                        help='new results (default %(default)s)')
+    parser.add_argument('-threshold', type=float, default=10,
+                        help='max %% slowdown of a single benchmark (default %(default)s)')
+    parser.add_argument('-geomean', type=float, default=3,
+                        help='max %% slowdown of the geometric mean (default %(default)s)')
+    args = parser.parse_args()
+
+    old = read_results(args.old)
+    new = read_results(args.new)
+    names = sorted(set(old) & set(new))
+    if not names:
+        print('no benchmarks in common between {} and {}'.format(args.old, args.new),
+              file=sys.stderr)
+        sys.exit(2)
+
+    failed = False
+    log_sum = 0
+    print('{:32} {:>12} {:>12} {:>8}'.format('benchmark', 'old ns/op', 'new ns/op', 'delta'))
+    for name in names:
+        ratio = new[name] / old[name]
+        log_sum += math.log(ratio)
+        delta = (ratio - 1) * 100
+        mark = ''
+        if delta > args.threshold:
+            mark = '  REGRESSION'
+            failed = True
+        print('{:32} {:12.1f} {:12.1f} {:+7.1f}%{}'.format(
+            name, old[name], new[name], delta, mark))
+    geomean_delta = (math.exp(log_sum / len(names)) - 1) * 100
+    mark = ''
+    if geomean_delta > args.geomean:
+        mark = '  REGRESSION'
+        failed = True
+    print('{:32} {:>12} {:>12} {:+7.1f}%{}'.format('[geomean]', '', '', geomean_delta, mark))
+
+    for name in sorted(set(old) ^ set(new)):
+        print('{} only in {}'.format(name, args.old if name in old else args.new))
+    if failed:
+        sys.exit(1)
+
+
+if __name__ == '__main__':
+    main()
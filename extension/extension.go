@@ -0,0 +1,125 @@
+// Package extension loads GoAWK extensions: sets of native Go
+// functions that an AWK program loads by name with an @load "name"
+// directive, like gawk's @load.
+//
+// An extension is either registered with Register, usually from the
+// init function of a package that's compiled into a custom goawk
+// binary, or it's a Go plugin (a shared object built with "go build
+// -buildmode=plugin") whose main package exports the functions as:
+//
+//	var Funcs = map[string]interface{}{
+//		"double": func(n float64) float64 { return 2 * n },
+//	}
+//
+// The functions have the same form as in interp.Config.Funcs. Go
+// plugins are only supported on some platforms (Linux, macOS, and
+// FreeBSD, when built with cgo), and a plugin must be built with the
+// same Go version and versions of GoAWK's packages as the goawk binary
+// that loads it.
+//
+// A package compiled into a custom goawk binary can also add input
+// sources with RegisterSource, for reading input file arguments that
+// are URLs, like amqp://host/queue, with a client library.
+package extension
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	mu         sync.Mutex
+	registered = make(map[string]map[string]interface{})
+)
+
+// Register makes funcs available to AWK programs as the extension
+// name, which takes precedence over a plugin with the same name. It
+// panics if an extension with that name is already registered.
+func Register(name string, funcs map[string]interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := registered[name]; ok {
+		panic(fmt.Sprintf("extension %q already registered", name))
+	}
+	registered[name] = funcs
+}
+
+// Lookup returns the functions of the registered extension name, and
+// whether there is one.
+func Lookup(name string) (map[string]interface{}, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	funcs, ok := registered[name]
+	return funcs, ok
+}
+
+// Names returns the names of the registered extensions, in order.
+func Names() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	names := make([]string, 0, len(registered))
+	for name := range registered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Load returns the functions of the extension name: the registered
+// one, if there is one, otherwise the plugin found by FindPlugin. It
+// can be used as parser.ParserConfig.Load.
+func Load(name string, path []string) (map[string]interface{}, error) {
+	if funcs, ok := Lookup(name); ok {
+		return funcs, nil
+	}
+	if !pluginsSupported {
+		return nil, fmt.Errorf("extension %q not registered (and plugins aren't supported on this platform)", name)
+	}
+	file, err := FindPlugin(name, path)
+	if err != nil {
+		return nil, err
+	}
+	return openPlugin(file)
+}
+
+// FindPlugin returns the path of the plugin file for the extension
+// name, searching the directories in path in order (for example the
+// AWKLIBPATH environment variable split with filepath.SplitList), or
+// just the current directory if path is empty. In each directory it
+// tries name, then name with ".so" appended if it doesn't already
+// have that extension. An empty directory means the current
+// directory.
+//
+// If name contains a directory separator (like "lib/ext.so"), name is
+// returned as is without checking that it exists. If the file isn't
+// found, the error lists the paths tried.
+func FindPlugin(name string, path []string) (string, error) {
+	if strings.ContainsRune(name, '/') || strings.ContainsRune(name, filepath.Separator) {
+		return name, nil
+	}
+	if len(path) == 0 {
+		path = []string{""}
+	}
+	var tried []string
+	for _, dir := range path {
+		if dir == "" {
+			dir = "."
+		}
+		candidates := []string{filepath.Join(dir, name)}
+		if filepath.Ext(name) != ".so" {
+			candidates = append(candidates, filepath.Join(dir, name+".so"))
+		}
+		for _, candidate := range candidates {
+			info, err := os.Stat(candidate)
+			if err == nil && !info.IsDir() {
+				return candidate, nil
+			}
+			tried = append(tried, candidate)
+		}
+	}
+	return "", fmt.Errorf("extension %q not registered or found in AWKLIBPATH (tried %s)", name, strings.Join(tried, ", "))
+}
@@ -0,0 +1,95 @@
+package extension_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/benhoyt/goawk/extension"
+	"github.com/benhoyt/goawk/interp"
+)
+
+func TestRegister(t *testing.T) {
+	funcs := map[string]interface{}{"hello": func() string { return "hi" }}
+	extension.Register("test-register", funcs)
+	got, ok := extension.Lookup("test-register")
+	if !ok || len(got) != 1 || got["hello"] == nil {
+		t.Fatalf("expected registered funcs, got %v, %v", got, ok)
+	}
+	got, err := extension.Load("test-register", nil)
+	if err != nil || len(got) != 1 {
+		t.Fatalf("expected registered funcs, got %v, %v", got, err)
+	}
+	if !reflect.DeepEqual(extension.Names(), []string{"test-register"}) {
+		t.Fatalf("expected one name, got %v", extension.Names())
+	}
+	if _, ok := extension.Lookup("test-nope"); ok {
+		t.Fatalf("expected test-nope not to be registered")
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("expected panic registering name twice")
+		}
+	}()
+	extension.Register("test-register", funcs)
+}
+
+func TestFindPlugin(t *testing.T) {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "ext.so"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		path  []string
+		found string
+		err   string
+	}{
+		{"ext", []string{"nope", dir}, filepath.Join(dir, "ext.so"), ""},
+		{"ext.so", []string{dir}, filepath.Join(dir, "ext.so"), ""},
+		{"lib/ext.so", []string{dir}, "lib/ext.so", ""},
+		{"other", []string{dir}, "", "tried " + filepath.Join(dir, "other") + ", " + filepath.Join(dir, "other.so")},
+		{"other", nil, "", "tried other, other.so"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			found, err := extension.FindPlugin(test.name, test.path)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if found != test.found {
+				t.Fatalf("expected %q, got %q", test.found, found)
+			}
+		})
+	}
+}
+
+func TestRegisterSource(t *testing.T) {
+	if extension.Sources() != nil {
+		t.Fatalf("expected no sources, got %v", extension.Sources())
+	}
+	open := func(url string) (interp.RecordSource, error) { return nil, nil }
+	extension.RegisterSource("test", open)
+	sources := extension.Sources()
+	if len(sources) != 1 || sources["test"] == nil {
+		t.Fatalf("expected test source, got %v", sources)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("expected panic registering scheme twice")
+		}
+	}()
+	extension.RegisterSource("test", open)
+}
@@ -0,0 +1,29 @@
+//go:build (linux || darwin || freebsd) && cgo
+// +build linux darwin freebsd
+// +build cgo
+
+package extension
+
+import (
+	"fmt"
+	"plugin"
+)
+
+const pluginsSupported = true
+
+// Open the plugin file and return its exported Funcs.
+func openPlugin(file string) (map[string]interface{}, error) {
+	plug, err := plugin.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := plug.Lookup("Funcs")
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s doesn't export Funcs", file)
+	}
+	funcs, ok := sym.(*map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("plugin %s exports Funcs as %T, not map[string]interface{}", file, sym)
+	}
+	return *funcs, nil
+}
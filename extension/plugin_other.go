@@ -0,0 +1,12 @@
+//go:build !((linux || darwin || freebsd) && cgo)
+// +build !linux,!darwin,!freebsd !cgo
+
+package extension
+
+import "errors"
+
+const pluginsSupported = false
+
+func openPlugin(file string) (map[string]interface{}, error) {
+	return nil, errors.New("plugins aren't supported on this platform")
+}
@@ -0,0 +1,40 @@
+// Input sources for URL schemes, like amqp://host/queue
+
+package extension
+
+import (
+	"fmt"
+
+	"github.com/benhoyt/goawk/interp"
+)
+
+var sources = make(map[string]func(url string) (interp.RecordSource, error))
+
+// RegisterSource makes open the way to read input file arguments that
+// are URLs with the given scheme, such as "amqp" for
+// amqp://host/queue, usually from the init function of a package
+// that's compiled into a custom goawk binary and wraps a client
+// library. It panics if the scheme is already registered.
+func RegisterSource(scheme string, open func(url string) (interp.RecordSource, error)) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := sources[scheme]; ok {
+		panic(fmt.Sprintf("source scheme %q already registered", scheme))
+	}
+	sources[scheme] = open
+}
+
+// Sources returns the registered sources, keyed by scheme, for use as
+// interp.Config.Sources. It returns nil if there aren't any.
+func Sources() map[string]func(url string) (interp.RecordSource, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sources) == 0 {
+		return nil
+	}
+	result := make(map[string]func(url string) (interp.RecordSource, error), len(sources))
+	for scheme, open := range sources {
+		result[scheme] = open
+	}
+	return result
+}
@@ -0,0 +1,846 @@
+// Package format formats AWK source code in a canonical style, much
+// as gofmt does for Go: statements one per line and indented with a
+// tab, blocks always in braces, operators spaced consistently, and
+// parentheses only where they're needed. Comments are kept with the
+// statements they're attached to (see ast.Comments).
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/benhoyt/goawk/ast"
+	. "github.com/benhoyt/goawk/lexer"
+	"github.com/benhoyt/goawk/parser"
+)
+
+// Source parses the AWK program src and returns it in the canonical
+// format. If there's a syntax error, it returns a *parser.ParseError.
+func Source(src []byte) ([]byte, error) {
+	prog, err := parser.ParseProgram(src, nil)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = Fprint(&buf, prog.AST(), src)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Fprint writes prog to w in the canonical format. If src is the
+// source prog was parsed from, Fprint uses it to keep the order of the
+// top-level items, single blank lines between statements, the spelling
+// of numbers, and regex constants like the right side of ~ (which the
+// tree records as strings). Otherwise src should be nil.
+func Fprint(w io.Writer, prog *ast.Program, src []byte) error {
+	p := &printer{prog: prog, src: src}
+	if src != nil {
+		p.lines = []int{0}
+		for i, c := range src {
+			if c == '\n' {
+				p.lines = append(p.lines, i+1)
+			}
+		}
+	}
+	p.program()
+	_, err := w.Write(p.buf.Bytes())
+	return err
+}
+
+type printer struct {
+	buf    bytes.Buffer
+	prog   *ast.Program
+	src    []byte
+	lines  []int // offset in src of the start of each line
+	indent int
+}
+
+// Operator precedence levels, lowest first. A subexpression with lower
+// precedence than its context requires is printed in parentheses.
+const (
+	precAny = iota
+	precGetline
+	precAssign
+	precCond
+	precOr
+	precAnd
+	precIn
+	precMatch
+	precCompare
+	precConcat
+	precAdd
+	precMul
+	precUnary
+	precPow
+	precIncr
+	precPrimary
+)
+
+// A top-level item: BEGIN or END block, pattern-action, or function.
+type item struct {
+	pos      Position
+	comments *ast.Comments
+	keyword  string // "BEGIN" or "END", for those blocks
+	load     string // extension name, for an @load directive
+	action   *ast.Action
+	fn       *ast.Function
+	stmts    ast.Stmts
+}
+
+func (p *printer) program() {
+	var items []item
+	positions := func(ps []Position, i int) Position {
+		if i < len(ps) {
+			return ps[i]
+		}
+		return Position{}
+	}
+	comments := func(cs []*ast.Comments, i int) *ast.Comments {
+		if i < len(cs) {
+			return cs[i]
+		}
+		return nil
+	}
+	for i, name := range p.prog.Loads {
+		items = append(items, item{pos: positions(p.prog.LoadPositions, i), keyword: "@load", load: name})
+	}
+	for i, stmts := range p.prog.Begin {
+		items = append(items, item{pos: positions(p.prog.BeginPositions, i),
+			comments: comments(p.prog.BeginComments, i), keyword: "BEGIN", stmts: stmts})
+	}
+	for i := range p.prog.Actions {
+		items = append(items, item{pos: positions(p.prog.ActionPositions, i),
+			comments: comments(p.prog.ActionComments, i), action: &p.prog.Actions[i]})
+	}
+	for i, stmts := range p.prog.End {
+		items = append(items, item{pos: positions(p.prog.EndPositions, i),
+			comments: comments(p.prog.EndComments, i), keyword: "END", stmts: stmts})
+	}
+	for i := range p.prog.Functions {
+		items = append(items, item{pos: positions(p.prog.FunctionPositions, i),
+			comments: comments(p.prog.FunctionComments, i), fn: &p.prog.Functions[i]})
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return before(items[i].pos, items[j].pos)
+	})
+
+	if len(items) == 0 {
+		// Program with nothing but comments
+		p.commentLines(p.prog.Comments, 0)
+		return
+	}
+	lastLine := 0
+	for i, it := range items {
+		line := startLine(it.pos.Line, it.comments)
+		if i > 0 && (p.src == nil || p.blankBetween(lastLine, line)) {
+			p.buf.WriteByte('\n')
+		}
+		if it.keyword == "@load" {
+			p.buf.WriteString("@load " + strconv.Quote(it.load) + "\n")
+			lastLine = it.pos.Line
+			continue
+		}
+		var node ast.Node
+		p.leading(it.comments, it.pos.Line)
+		switch {
+		case it.action != nil:
+			p.action(it.action, inner(it.comments))
+			node = it.action
+		case it.fn != nil:
+			p.buf.WriteString("function " + it.fn.Name + "(" + strings.Join(it.fn.Params, ", ") + ") ")
+			p.block(it.fn.Body, inner(it.comments))
+			node = it.fn.Body
+		default:
+			p.buf.WriteString(it.keyword + " ")
+			p.block(it.stmts, inner(it.comments))
+			node = it.stmts
+		}
+		lastLine = p.trailing(it.comments, p.lastLine(node, it.pos.Line))
+	}
+}
+
+func before(a, b Position) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+}
+
+func (p *printer) action(a *ast.Action, inner []ast.Comment) {
+	for i, pattern := range a.Pattern {
+		if i > 0 {
+			p.buf.WriteString(", ")
+		}
+		p.expr(pattern, precAny)
+	}
+	if a.Stmts == nil {
+		return
+	}
+	if len(a.Pattern) > 0 {
+		p.buf.WriteByte(' ')
+	}
+	p.block(a.Stmts, inner)
+}
+
+// Print a block of statements in braces, without a final newline. If
+// the block is empty, inner are the comments to print inside it.
+func (p *printer) block(stmts ast.Stmts, inner []ast.Comment) {
+	p.buf.WriteString("{\n")
+	p.indent++
+	if len(stmts) == 0 {
+		p.commentLines(inner, 0)
+	}
+	lastLine := 0
+	for i, stmt := range stmts {
+		pos, hasPos := p.prog.StmtPositions[stmt]
+		comments := p.prog.StmtComments[stmt]
+		if i > 0 && hasPos && p.src != nil && p.blankBetween(lastLine, startLine(pos.Line, comments)) {
+			p.buf.WriteByte('\n')
+		}
+		p.leading(comments, pos.Line)
+		p.writeIndent()
+		if chained := p.stmt(stmt); chained != nil {
+			merged := &ast.Comments{}
+			if comments != nil {
+				*merged = *comments
+			}
+			merged.Trailing = append(chained, merged.Trailing...)
+			sort.SliceStable(merged.Trailing, func(i, j int) bool {
+				return before(merged.Trailing[i].Position, merged.Trailing[j].Position)
+			})
+			comments = merged
+		}
+		if hasPos {
+			lastLine = p.trailing(comments, p.lastLine(stmt, pos.Line))
+		} else {
+			p.trailing(comments, 0)
+		}
+	}
+	p.indent--
+	p.writeIndent()
+	p.buf.WriteByte('}')
+}
+
+// Return the line a node starts on, including its leading comments.
+func startLine(line int, comments *ast.Comments) int {
+	if comments != nil && len(comments.Leading) > 0 {
+		return comments.Leading[0].Position.Line
+	}
+	return line
+}
+
+func inner(comments *ast.Comments) []ast.Comment {
+	if comments == nil {
+		return nil
+	}
+	return comments.Inner
+}
+
+// Print the leading comments of a node starting on line, each on its
+// own line.
+func (p *printer) leading(comments *ast.Comments, line int) {
+	if comments == nil || len(comments.Leading) == 0 {
+		return
+	}
+	p.commentLines(comments.Leading, 0)
+	if p.src != nil && p.blankBetween(comments.Leading[len(comments.Leading)-1].Position.Line, line) {
+		p.buf.WriteByte('\n')
+	}
+}
+
+// Print a node's trailing comments after it, and end the line it's on
+// (lastLine). Then print its "after" comments on the following lines.
+// Return the last source line used.
+func (p *printer) trailing(comments *ast.Comments, lastLine int) int {
+	if comments == nil {
+		p.buf.WriteByte('\n')
+		return lastLine
+	}
+	for i, c := range comments.Trailing {
+		if i > 0 {
+			p.writeIndent()
+		} else {
+			p.buf.WriteByte(' ')
+		}
+		p.buf.WriteString(c.Text + "\n")
+	}
+	if len(comments.Trailing) == 0 {
+		p.buf.WriteByte('\n')
+	}
+	if len(comments.After) > 0 {
+		p.commentLines(comments.After, lastLine)
+		lastLine = comments.After[len(comments.After)-1].Position.Line
+	}
+	return lastLine
+}
+
+// Print comments, each on its own line, keeping single blank lines
+// between them (and before the first one, after line "from", if from
+// is greater than zero).
+func (p *printer) commentLines(comments []ast.Comment, from int) {
+	for i, c := range comments {
+		if p.src != nil && (i > 0 || from > 0) && p.blankBetween(from, c.Position.Line) {
+			p.buf.WriteByte('\n')
+		}
+		p.writeIndent()
+		p.buf.WriteString(c.Text + "\n")
+		from = c.Position.Line
+	}
+}
+
+func (p *printer) writeIndent() {
+	for i := 0; i < p.indent; i++ {
+		p.buf.WriteByte('\t')
+	}
+}
+
+// Return the last source line node (which starts on line) is known to
+// occupy, based on the positions of the statements and expressions in
+// it. The closing brace of a block may be on a later line.
+func (p *printer) lastLine(node ast.Node, line int) int {
+	ast.Inspect(node, func(n ast.Node) bool {
+		var pos Position
+		switch n := n.(type) {
+		case ast.Stmt:
+			pos = p.prog.StmtPositions[n]
+		case ast.Expr:
+			pos = p.prog.ExprPositions[n]
+		}
+		if pos.Line > line {
+			line = pos.Line
+		}
+		return n != nil
+	})
+	return line
+}
+
+// Report whether there's a blank line in the source after line "from"
+// and before line "to".
+func (p *printer) blankBetween(from, to int) bool {
+	for line := from + 1; line < to && line <= len(p.lines); line++ {
+		start := p.lines[line-1]
+		end := len(p.src)
+		if line < len(p.lines) {
+			end = p.lines[line]
+		}
+		if len(bytes.TrimSpace(p.src[start:end])) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Print stmt (without its comments), returning the trailing comments
+// of any else-if statements chained after it.
+func (p *printer) stmt(stmt ast.Stmt) []ast.Comment {
+	in := inner(p.prog.StmtComments[stmt])
+	var chained []ast.Comment
+	switch s := stmt.(type) {
+	case *ast.PrintStmt:
+		p.print("print", s.Args, s.Redirect, s.Dest)
+
+	case *ast.PrintfStmt:
+		p.print("printf", s.Args, s.Redirect, s.Dest)
+
+	case *ast.ExprStmt:
+		p.expr(s.Expr, precAny)
+
+	case *ast.IfStmt:
+		for {
+			p.buf.WriteString("if (")
+			p.expr(s.Cond, precAny)
+			p.buf.WriteString(") ")
+			p.block(s.Body, in)
+			if len(s.Body) == 0 {
+				in = nil
+			}
+			if len(s.Else) == 0 {
+				break
+			}
+			p.buf.WriteString(" else ")
+			// Chain "else if" unless there are comments between the
+			// else and the if
+			if elseIf, ok := s.Else[0].(*ast.IfStmt); ok && len(s.Else) == 1 {
+				comments := p.prog.StmtComments[elseIf]
+				if comments == nil {
+					s = elseIf
+					continue
+				}
+				if len(comments.Leading) == 0 {
+					chained = append(chained, comments.Trailing...)
+					in = append(in, comments.Inner...)
+					s = elseIf
+					continue
+				}
+			}
+			p.block(s.Else, in)
+			break
+		}
+
+	case *ast.ForStmt:
+		p.buf.WriteString("for (")
+		if s.Pre != nil {
+			p.stmt(s.Pre)
+		}
+		p.buf.WriteString(";")
+		if s.Cond != nil {
+			p.buf.WriteByte(' ')
+			p.expr(s.Cond, precAny)
+		}
+		p.buf.WriteString(";")
+		if s.Post != nil {
+			p.buf.WriteByte(' ')
+			p.stmt(s.Post)
+		}
+		p.buf.WriteString(") ")
+		p.block(s.Body, in)
+
+	case *ast.ForInStmt:
+		p.buf.WriteString("for (" + s.Var.Name + " in " + s.Array.Name + ") ")
+		p.block(s.Body, in)
+
+	case *ast.WhileStmt:
+		p.buf.WriteString("while (")
+		p.expr(s.Cond, precAny)
+		p.buf.WriteString(") ")
+		p.block(s.Body, in)
+
+	case *ast.DoWhileStmt:
+		p.buf.WriteString("do ")
+		p.block(s.Body, in)
+		p.buf.WriteString(" while (")
+		p.expr(s.Cond, precAny)
+		p.buf.WriteString(")")
+
+	case *ast.BreakStmt:
+		p.buf.WriteString("break")
+
+	case *ast.ContinueStmt:
+		p.buf.WriteString("continue")
+
+	case *ast.NextStmt:
+		p.buf.WriteString("next")
+
+	case *ast.ExitStmt:
+		p.buf.WriteString("exit")
+		if s.Status != nil {
+			p.buf.WriteByte(' ')
+			p.expr(s.Status, precAny)
+		}
+
+	case *ast.DeleteStmt:
+		p.buf.WriteString("delete " + s.Array.Name)
+		if s.Index != nil {
+			p.buf.WriteByte('[')
+			p.exprs(s.Index)
+			p.buf.WriteByte(']')
+		}
+
+	case *ast.ReturnStmt:
+		p.buf.WriteString("return")
+		if s.Value != nil {
+			p.buf.WriteByte(' ')
+			p.expr(s.Value, precAny)
+		}
+
+	case *ast.BlockStmt:
+		p.block(s.Body, in)
+
+	default:
+		panic(fmt.Sprintf("unexpected stmt type: %T", stmt))
+	}
+	return chained
+}
+
+func (p *printer) print(name string, args []ast.Expr, redirect Token, dest ast.Expr) {
+	p.buf.WriteString(name)
+	for i, arg := range args {
+		if i > 0 {
+			p.buf.WriteByte(',')
+		}
+		p.buf.WriteByte(' ')
+		// An unparenthesized ">" or "|" in an argument would be taken
+		// as a redirect, and a redirect after an argument ending in a
+		// conditional or assignment would be parsed as part of it
+		if hasRedirectOp(arg) || dest != nil && endsInCondOrAssign(arg) {
+			p.buf.WriteByte('(')
+			p.expr(arg, precAny)
+			p.buf.WriteByte(')')
+		} else {
+			p.expr(arg, precAny)
+		}
+	}
+	if dest != nil {
+		p.buf.WriteString(" " + redirect.String() + " ")
+		p.expr(dest, precAny)
+	}
+}
+
+// Report whether expr is a conditional or assignment, whose right-hand
+// side would take in a following redirect.
+func endsInCondOrAssign(expr ast.Expr) bool {
+	switch expr.(type) {
+	case *ast.CondExpr, *ast.AssignExpr, *ast.AugAssignExpr:
+		return true
+	}
+	return false
+}
+
+// Report whether expr, printed as a print argument, might contain a
+// ">" comparison or "| getline" that's not in parentheses.
+func hasRedirectOp(expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case GREATER:
+			return true
+		case OR, AND, MATCH, NOT_MATCH, EQUALS, NOT_EQUALS, LESS, LTE, GTE:
+			return hasRedirectOp(e.Left) || hasRedirectOp(e.Right)
+		}
+	case *ast.GetlineExpr:
+		return e.Command != nil
+	case *ast.AssignExpr:
+		return hasRedirectOp(e.Right)
+	case *ast.AugAssignExpr:
+		return hasRedirectOp(e.Right)
+	case *ast.CondExpr:
+		return hasRedirectOp(e.Cond)
+	case *ast.InExpr:
+		return len(e.Index) == 1 && hasRedirectOp(e.Index[0])
+	}
+	return false
+}
+
+func (p *printer) exprs(exprs []ast.Expr) {
+	for i, expr := range exprs {
+		if i > 0 {
+			p.buf.WriteString(", ")
+		}
+		p.expr(expr, precAny)
+	}
+}
+
+// Print expr, in parentheses if its precedence is lower than prec.
+func (p *printer) expr(expr ast.Expr, prec int) {
+	if precedence(expr) < prec {
+		p.buf.WriteByte('(')
+		p.expr(expr, precAny)
+		p.buf.WriteByte(')')
+		return
+	}
+
+	switch e := expr.(type) {
+	case *ast.FieldExpr:
+		p.buf.WriteByte('$')
+		p.expr(e.Index, precPrimary)
+
+	case *ast.UnaryExpr:
+		p.buf.WriteString(e.Op.String())
+		// Avoid "--x" or "-+x" being lexed as a different operator
+		if start := p.exprString(e.Value, precUnary); e.Op != NOT && (start[0] == '-' || start[0] == '+') {
+			p.buf.WriteString("(" + start + ")")
+		} else {
+			p.buf.WriteString(start)
+		}
+
+	case *ast.BinaryExpr:
+		p.binary(e)
+
+	case *ast.InExpr:
+		if len(e.Index) == 1 {
+			p.expr(e.Index[0], precIn)
+		} else {
+			p.buf.WriteByte('(')
+			p.exprs(e.Index)
+			p.buf.WriteByte(')')
+		}
+		p.buf.WriteString(" in " + e.Array.Name)
+
+	case *ast.CondExpr:
+		p.expr(e.Cond, precOr)
+		p.buf.WriteString(" ? ")
+		p.expr(e.True, precAny)
+		p.buf.WriteString(" : ")
+		p.expr(e.False, precAny)
+
+	case *ast.NumExpr:
+		p.buf.WriteString(p.number(e))
+
+	case *ast.StrExpr:
+		if p.isRegex(e) {
+			p.buf.WriteString(regexString(e.Value))
+		} else {
+			p.buf.WriteString(quote(e.Value))
+		}
+
+	case *ast.RegExpr:
+		p.buf.WriteString(regexString(e.Regex))
+
+	case *ast.VarExpr:
+		p.buf.WriteString(e.Name)
+
+	case *ast.ArrayExpr:
+		p.buf.WriteString(e.Name)
+
+	case *ast.IndexExpr:
+		p.buf.WriteString(e.Array.Name + "[")
+		p.exprs(e.Index)
+		p.buf.WriteByte(']')
+
+	case *ast.AssignExpr:
+		p.expr(e.Left, precPrimary)
+		p.buf.WriteString(" = ")
+		p.expr(e.Right, precAssign)
+
+	case *ast.AugAssignExpr:
+		p.expr(e.Left, precPrimary)
+		p.buf.WriteString(" " + e.Op.String() + "= ")
+		p.expr(e.Right, precAssign)
+
+	case *ast.IncrExpr:
+		if e.Pre {
+			p.buf.WriteString(e.Op.String())
+			p.expr(e.Expr, precPrimary)
+		} else {
+			p.expr(e.Expr, precPrimary)
+			p.buf.WriteString(e.Op.String())
+		}
+
+	case *ast.CallExpr:
+		p.buf.WriteString(e.Func.String() + "(")
+		p.exprs(e.Args)
+		p.buf.WriteByte(')')
+
+	case *ast.UserCallExpr:
+		p.buf.WriteString(e.Name + "(")
+		p.exprs(e.Args)
+		p.buf.WriteByte(')')
+
+	case *ast.MultiExpr:
+		p.buf.WriteByte('(')
+		p.exprs(e.Exprs)
+		p.buf.WriteByte(')')
+
+	case *ast.GetlineExpr:
+		if e.Command != nil {
+			p.expr(e.Command, precAssign)
+			p.buf.WriteString(" | ")
+		}
+		p.buf.WriteString("getline")
+		if e.Target != nil {
+			p.buf.WriteByte(' ')
+			p.expr(e.Target, precPrimary)
+		}
+		if e.File != nil {
+			p.buf.WriteString(" < ")
+			p.expr(e.File, precPrimary)
+		}
+
+	default:
+		panic(fmt.Sprintf("unexpected expr type: %T", expr))
+	}
+}
+
+func (p *printer) binary(e *ast.BinaryExpr) {
+	// Precedence the left and right operands need, which determines
+	// associativity
+	var left, right int
+	switch e.Op {
+	case OR:
+		left, right = precOr, precAnd
+	case AND:
+		left, right = precAnd, precIn
+	case MATCH, NOT_MATCH:
+		left, right = precCompare, precCompare
+	case EQUALS, NOT_EQUALS, LESS, LTE, GREATER, GTE:
+		left, right = precConcat, precConcat
+	case CONCAT:
+		left, right = precConcat, precAdd
+	case ADD, SUB:
+		left, right = precAdd, precMul
+	case MUL, DIV, MOD:
+		left, right = precMul, precUnary
+	case POW:
+		left, right = precIncr, precUnary
+	default:
+		panic(fmt.Sprintf("unexpected binary operator: %s", e.Op))
+	}
+
+	// Operators after "getline < file" are ambiguous in some AWKs,
+	// and a plain getline before "<" would read that as its file
+	if _, ok := e.Left.(*ast.GetlineExpr); ok {
+		left = precPrimary + 1
+	}
+	p.expr(e.Left, left)
+
+	if e.Op != CONCAT {
+		p.buf.WriteString(" " + e.Op.String() + " ")
+		p.expr(e.Right, right)
+		return
+	}
+	// The right side of a concatenation must start with a token that
+	// can't continue the left side, such as a name or a string
+	p.buf.WriteByte(' ')
+	s := p.exprString(e.Right, right)
+	if !canStartConcat(s) {
+		s = "(" + s + ")"
+	}
+	p.buf.WriteString(s)
+}
+
+// Return expr as printed in a context requiring precedence prec.
+func (p *printer) exprString(expr ast.Expr, prec int) string {
+	sub := &printer{prog: p.prog, src: p.src, lines: p.lines}
+	sub.expr(expr, prec)
+	return sub.buf.String()
+}
+
+func canStartConcat(s string) bool {
+	if strings.HasPrefix(s, "getline") && (len(s) == len("getline") || !isNameByte(s[len("getline")])) {
+		return false
+	}
+	c := s[0]
+	return c == '$' || c == '!' || c == '"' || c == '(' || c == '.' ||
+		c >= '0' && c <= '9' || isNameByte(c)
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func precedence(expr ast.Expr) int {
+	switch e := expr.(type) {
+	case *ast.GetlineExpr:
+		if e.Command != nil {
+			return precGetline
+		}
+	case *ast.AssignExpr, *ast.AugAssignExpr:
+		return precAssign
+	case *ast.CondExpr:
+		return precCond
+	case *ast.InExpr:
+		return precIn
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case OR:
+			return precOr
+		case AND:
+			return precAnd
+		case MATCH, NOT_MATCH:
+			return precMatch
+		case EQUALS, NOT_EQUALS, LESS, LTE, GREATER, GTE:
+			return precCompare
+		case CONCAT:
+			return precConcat
+		case ADD, SUB:
+			return precAdd
+		case MUL, DIV, MOD:
+			return precMul
+		case POW:
+			return precPow
+		}
+	case *ast.UnaryExpr:
+		return precUnary
+	case *ast.NumExpr:
+		if e.Value < 0 || e.Value == 0 && strconv.FormatFloat(e.Value, 'g', -1, 64) == "-0" {
+			return precUnary
+		}
+	case *ast.IncrExpr:
+		return precIncr
+	}
+	return precPrimary
+}
+
+// Return the number as spelled in the source, if known, otherwise in
+// its shortest form.
+func (p *printer) number(e *ast.NumExpr) string {
+	if pos, ok := p.prog.ExprPositions[e]; ok && p.src != nil {
+		if offset, ok := p.offset(pos); ok {
+			// If it's a hexadecimal or octal number (parsed with
+			// ParserConfig.NonDecimal), keep that form. It's not, but
+			// 0 followed by a name, if the value is different (zero
+			// is written as 0 either way).
+			l := NewLexer(p.src[offset:])
+			l.NonDecimal()
+			_, tok, val := l.Scan()
+			if u, err := strconv.ParseUint(val, 0, 64); tok == NUMBER && err == nil && u != 0 &&
+				len(val) > 2 && strings.IndexByte("xXoO", val[1]) >= 0 && float64(u) == e.Value {
+				return val
+			}
+			_, tok, val = NewLexer(p.src[offset:]).Scan()
+			if tok == NUMBER {
+				return val
+			}
+		}
+	}
+	if e.Value == float64(int64(e.Value)) && e.Value > -1e15 && e.Value < 1e15 {
+		return strconv.FormatInt(int64(e.Value), 10)
+	}
+	return strconv.FormatFloat(e.Value, 'g', -1, 64)
+}
+
+// Report whether string constant e was written as a regex constant, as
+// is common for arguments like the right side of ~.
+func (p *printer) isRegex(e *ast.StrExpr) bool {
+	pos, ok := p.prog.ExprPositions[e]
+	if !ok || p.src == nil {
+		return false
+	}
+	offset, ok := p.offset(pos)
+	return ok && p.src[offset] == '/'
+}
+
+// Convert pos to an offset in the source.
+func (p *printer) offset(pos Position) (int, bool) {
+	if pos.Line < 1 || pos.Line > len(p.lines) {
+		return 0, false
+	}
+	offset := p.lines[pos.Line-1] + pos.Column - 1
+	if offset < 0 || offset >= len(p.src) {
+		return 0, false
+	}
+	return offset, true
+}
+
+func regexString(regex string) string {
+	return "/" + strings.Replace(regex, "/", `\/`, -1) + "/"
+}
+
+// Quote s as an AWK string constant.
+func quote(s string) string {
+	var buf strings.Builder
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\a':
+			buf.WriteString(`\a`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\v':
+			buf.WriteString(`\v`)
+		default:
+			if c < ' ' || c == 0x7f {
+				fmt.Fprintf(&buf, `\%03o`, c)
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
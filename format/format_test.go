@@ -0,0 +1,190 @@
+package format_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/benhoyt/goawk/format"
+	"github.com/benhoyt/goawk/parser"
+)
+
+func TestSource(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected string
+	}{
+		// Layout
+		{`BEGIN{x=1;y=2}`, "BEGIN {\n\tx = 1\n\ty = 2\n}\n"},
+		{`NR==1`, "NR == 1\n"},
+		{`/a/,/b/{print}`, "/a/, /b/ {\n\tprint\n}\n"},
+		{`{}`, "{\n}\n"},
+		{"END{print}\n\n\nfunction f(a,b){return a}", "END {\n\tprint\n}\n\nfunction f(a, b) {\n\treturn a\n}\n"},
+		{"BEGIN {\n\tx = 1\n\n\n\ty = 2\n\tz = 3\n}", "BEGIN {\n\tx = 1\n\n\ty = 2\n\tz = 3\n}\n"},
+		{"BEGIN {\n\tif (x) {\n\t\ty\n\t}\n\tz\n}", "BEGIN {\n\tif (x) {\n\t\ty\n\t}\n\tz\n}\n"},
+		{`BEGIN { if (a) print 1; else if (b) print 2; else print 3 }`,
+			"BEGIN {\n\tif (a) {\n\t\tprint 1\n\t} else if (b) {\n\t\tprint 2\n\t} else {\n\t\tprint 3\n\t}\n}\n"},
+		{`BEGIN { for(i=0;i<3;i++); for(;;) break; for (k in a) delete a[k] }`,
+			"BEGIN {\n\tfor (i = 0; i < 3; i++) {\n\t}\n\tfor (;;) {\n\t\tbreak\n\t}\n\tfor (k in a) {\n\t\tdelete a[k]\n\t}\n}\n"},
+		{`BEGIN { do x--; while (x) }`, "BEGIN {\n\tdo {\n\t\tx--\n\t} while (x)\n}\n"},
+		{`{ { next } }`, "{\n\t{\n\t\tnext\n\t}\n}\n"},
+
+		// Comments
+		{"# only a comment", "# only a comment\n"},
+		{"# doc\n\n# more\nBEGIN { x=1   # one\n}  # end\n# bye", "# doc\n\n# more\nBEGIN {\n\tx = 1 # one\n} # end\n# bye\n"},
+		{"{\n\t# about a\n\ta\n\n\tb\n\t# last\n}", "{\n\t# about a\n\ta\n\n\tb\n\t# last\n}\n"},
+		{"function f() {\n# TODO\n}", "function f() {\n\t# TODO\n}\n"},
+		{"{ if (a) { # none\n} else if (b) print # b\n}",
+			"{\n\tif (a) {\n\t\t# none\n\t} else if (b) {\n\t\tprint # b\n\t}\n}\n"},
+		{"{ if (a) x; else\n# about b\nif (b) y }",
+			"{\n\tif (a) {\n\t\tx\n\t} else {\n\t\t# about b\n\t\tif (b) {\n\t\t\ty\n\t\t}\n\t}\n}\n"},
+
+		// Expressions
+		{`BEGIN { print (a+b)*c, a+(b*c), a-(b-c), (a-b)-c, 2^3^4, (2^3)^4 }`,
+			"BEGIN {\n\tprint (a + b) * c, a + b * c, a - (b - c), a - b - c, 2 ^ 3 ^ 4, (2 ^ 3) ^ 4\n}\n"},
+		{`BEGIN { print -2^2, (-2)^2, 2^-2, -(-x), !(a==b), !a==b }`,
+			"BEGIN {\n\tprint -2 ^ 2, (-2) ^ 2, 2 ^ -2, -(-x), !(a == b), !a == b\n}\n"},
+		{`BEGIN { print (a>b), a, (x|getline) }`, "BEGIN {\n\tprint (a > b), a, (x | getline)\n}\n"},
+		{`BEGIN { printf("%d\n", x ? 1 : 2) | "cat"; print(y = 1) > "f"; print x ? 1 : 2, y = 1 }`,
+			"BEGIN {\n\tprintf \"%d\\n\", (x ? 1 : 2) | \"cat\"\n\tprint (y = 1) > \"f\"\n\tprint x ? 1 : 2, y = 1\n}\n"},
+		{`BEGIN { print a (-1), a (b c), $(i+1), $(i++), $i++ }`,
+			"BEGIN {\n\tprint a (-1), a (b c), $(i + 1), $(i++), $i++\n}\n"},
+		{`BEGIN { while ((getline line < f) > 0) n++ }`,
+			"BEGIN {\n\twhile ((getline line < f) > 0) {\n\t\tn++\n\t}\n}\n"},
+		{`BEGIN { x = y = c ? 1 : 2; x += (y = 1); (1,2) in a }`,
+			"BEGIN {\n\tx = y = c ? 1 : 2\n\tx += y = 1\n\t(1, 2) in a\n}\n"},
+
+		// Constants
+		{`BEGIN { print 1e3, 0.10, "a\tb\"\\\001" }`, "BEGIN {\n\tprint 1e3, 0.10, \"a\\tb\\\"\\\\\\001\"\n}\n"},
+		{`$0 ~ /a\/b/ { sub(/x/, "y"); n = split($0, a, /,/); print match($0, "r") }`,
+			"$0 ~ /a\\/b/ {\n\tsub(/x/, \"y\")\n\tn = split($0, a, /,/)\n\tprint match($0, \"r\")\n}\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			out, err := format.Source([]byte(test.src))
+			if err != nil {
+				t.Fatalf("error formatting: %v", err)
+			}
+			if string(out) != test.expected {
+				t.Fatalf("expected:\n%s\ngot:\n%s", test.expected, out)
+			}
+
+			// Formatted source should format the same, and parse to
+			// the same program as the original
+			again, err := format.Source(out)
+			if err != nil {
+				t.Fatalf("error formatting again: %v", err)
+			}
+			if string(again) != string(out) {
+				t.Fatalf("not idempotent, got:\n%s", again)
+			}
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			formatted, err := parser.ParseProgram(out, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if formatted.String() != prog.String() {
+				t.Fatalf("expected same program:\n%s\ngot:\n%s", prog, formatted)
+			}
+		})
+	}
+}
+
+// Formatting each AWK program in testdata (that GoAWK can parse)
+// should give source that parses to the same program.
+func TestSourceTestdata(t *testing.T) {
+	var paths []string
+	for _, pattern := range []string{"t.*", "p.*", "tt.*", "gawk/*.awk"} {
+		matches, err := filepath.Glob(filepath.Join("..", "testdata", pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, matches...)
+	}
+	for _, path := range paths {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prog, err := parser.ParseProgram(src, nil)
+		if err != nil {
+			continue
+		}
+		t.Run(path, func(t *testing.T) {
+			out, err := format.Source(src)
+			if err != nil {
+				t.Fatalf("error formatting: %v", err)
+			}
+			formatted, err := parser.ParseProgram(out, nil)
+			if err != nil {
+				t.Fatalf("error parsing formatted source: %v\n%s", err, out)
+			}
+			if formatted.String() != prog.String() {
+				t.Fatalf("expected same program:\n%s\ngot:\n%s", prog, formatted)
+			}
+		})
+	}
+}
+
+func TestSourceError(t *testing.T) {
+	_, err := format.Source([]byte(`BEGIN { x* }`))
+	if _, ok := err.(*parser.ParseError); !ok {
+		t.Fatalf("expected *parser.ParseError, got %v", err)
+	}
+}
+
+func TestFprintNonDecimal(t *testing.T) {
+	src := []byte(`BEGIN{print 0x1A+0o17,0x0}`)
+	prog, err := parser.ParseProgram(src, &parser.ParserConfig{NonDecimal: true})
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	var buf bytes.Buffer
+	err = format.Fprint(&buf, prog.AST(), src)
+	if err != nil {
+		t.Fatalf("error formatting: %v", err)
+	}
+	expected := "BEGIN {\n\tprint 0x1A + 0o17, 0\n}\n"
+	if buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf.String())
+	}
+
+	// Without NonDecimal, 0x1A is 0 followed by the variable x1A
+	formatted, err := format.Source([]byte(`BEGIN{print 0x1A}`))
+	if err != nil {
+		t.Fatalf("error formatting: %v", err)
+	}
+	expected = "BEGIN {\n\tprint 0 x1A\n}\n"
+	if string(formatted) != expected {
+		t.Fatalf("expected %q, got %q", expected, formatted)
+	}
+}
+
+func TestFprintLoad(t *testing.T) {
+	src := []byte("@load \"a\"\n@load \"b\"\nBEGIN{print double(1)}")
+	config := &parser.ParserConfig{
+		Load: func(name string) (map[string]interface{}, error) {
+			if name == "a" {
+				return map[string]interface{}{"double": func(n int) int { return 2 * n }}, nil
+			}
+			return nil, nil
+		},
+	}
+	prog, err := parser.ParseProgram(src, config)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	var buf bytes.Buffer
+	err = format.Fprint(&buf, prog.AST(), src)
+	if err != nil {
+		t.Fatalf("error formatting: %v", err)
+	}
+	expected := "@load \"a\"\n@load \"b\"\nBEGIN {\n\tprint double(1)\n}\n"
+	if buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf.String())
+	}
+}
@@ -22,24 +22,54 @@
 //     $ goawk '{ sum += $2 } END { print sum }' file.txt
 //     102
 //
+// The "goawk serve name=progfile ..." subcommand runs one or more AWK
+// programs as an HTTP service: POST input to /run/name and the response
+// is the program's output. Run "goawk serve -h" for details.
+//
+// A program can load extensions, native Go functions that it calls
+// like built-in functions, with an @load "name" directive. An
+// extension is either compiled into a custom goawk binary (see the
+// "extension" package's Register) or is a Go plugin, which is looked
+// for in the AWKLIBPATH directories (or the current directory).
+//
+// Input files can also be objects in Amazon S3 (s3://bucket/key) or
+// Google Cloud Storage (gs://bucket/object), which are streamed rather
+// than downloaded first; see the "objstore" package for where the
+// credentials come from. Input files that are Kafka topics, like
+// kafka://broker:9092/topic, are read a message per record with the
+// "kafka" package's consumer.
+//
 // To use GoAWK in your Go programs, see README.md or the "interp"
 // docs.
 //
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
+	"github.com/benhoyt/goawk/extension"
+	"github.com/benhoyt/goawk/format"
 	"github.com/benhoyt/goawk/interp"
+	"github.com/benhoyt/goawk/kafka"
 	"github.com/benhoyt/goawk/lexer"
+	goawklint "github.com/benhoyt/goawk/lint"
+	"github.com/benhoyt/goawk/objstore"
 	"github.com/benhoyt/goawk/parser"
 )
 
@@ -53,32 +83,202 @@ const (
   -v assignment
         name=value variable assignment (multiple allowed)
   -f progfile
-        load AWK source from progfile (multiple allowed)
+        load AWK source from progfile (multiple allowed), searching
+        the AWKPATH directories if it's set and progfile has no "/"
+        (as for @include "file" directives)
 
 Additional GoAWK arguments:
+  -ballast size
+        hold a size-byte allocation while running, to make garbage
+        collection less frequent (size can have a K, M, or G suffix)
+  -color[=when]
+        highlight the parts of records matched by /regex/ tests in
+        printed output; when is auto (the default: only if stdout is
+        a terminal and NO_COLOR isn't set), always, or never
+  -c progfile
+        compile AWK source from progfile (multiple allowed, like -f)
+        to a bytecode file instead of running it; run the result
+        with "goawk prog.awkc" or "goawk -f prog.awkc"
+  -coverlisting file
+        write program source annotated with how many times each
+        line's statements ran to file
+  -coverprofile file
+        write statement coverage report to file in LCOV format
   -cpuprofile file
-        write CPU profile to file
+        write CPU profile to file in pprof format (for "go tool pprof")
   -d    print parsed syntax tree to stderr (debug mode)
-  -da   print virtual machine assembly instructions to stderr
+  -da   print virtual machine assembly instructions to stderr,
+        with the source lines they were compiled from
+  -daj  print assembly instructions to stderr as JSON Lines, one
+        object per instruction with its source line and column
   -dt   print variable type information to stderr
+  -dump-ast[=json]
+        print the parsed syntax tree to stdout, as AWK source or as
+        JSON, instead of running the program
+  -dump-bytecode[=json]
+        print the compiled virtual machine instructions to stdout,
+        with the source lines they came from or as JSON Lines,
+        instead of running the program
+  -flush-interval duration
+        flush buffered output at least this often, like "100ms" or
+        "2s", for consumers that stream the output
+  -format
+        print the program to stdout in canonical format instead of
+        running it
+  -gcpercent percent
+        garbage collection target percentage, like GOGC; higher
+        values speed up programs that build large arrays
   -h    show this usage message
+  -jobs n
+        run the program separately on each input file, up to n files
+        at once, each with its own BEGIN, END, and variables
+  -jobs-order order
+        with -jobs, write each file's output after the previous
+        files' ("args", the default) or as soon as it's done ("finish")
+  -line-buffered
+        flush output after each line instead of when the buffer is
+        full
+  -lint
+        print warnings about likely mistakes, like unused variables,
+        and code that can never run to stderr
+  -memlimit size
+        soft memory limit, like GOMEMLIMIT (size can have a K, M, or
+        G suffix); useful with a high -gcpercent
+  -mmap
+        map input files into memory instead of reading them, which can
+        be faster for very large files (stdin and pipes are read as
+        usual)
+  -o file
+        with -c, write the bytecode to file (default stdout)
+  -ordered-arrays
+        make for (k in a) loops visit array elements in the order
+        they were added
+  -output-buffer size
+        size of the buffers for output to stdout, files, and commands
+        (default 64K; size can have a K, M, or G suffix)
+  -no-split
+        don't split records into fields: $1 is the whole record and
+        NF is 1, which is faster for programs that don't need fields
+  -non-decimal
+        accept hexadecimal (0x1A) and octal (0o17) numbers in the
+        program and in input data
+  -persist name=file
+        keep the array name in file instead of in memory, so its
+        elements persist between runs and it can be larger than
+        memory (multiple allowed)
+  -pipeline
+        read and split input files' records in the background while
+        the program processes earlier ones
+  -posix
+        only allow POSIX AWK syntax and functions, so the program
+        also runs under other AWKs
+  -posix-numbers
+        treat input strings as numbers whenever POSIX says to, like
+        hexadecimal (0x1A), inf, and nan (like gawk --posix), rather
+        than only decimal numbers
+  -prefetch
+        read the next input file in the background while processing
+        the current one, decompressing gzip-compressed input files
+  -S, -sandbox
+        don't allow system(), pipes, writing to files with > or >>, or
+        reading files other than the input files named on the command
+        line, or loading plugins with @load (like gawk's --sandbox)
+  -strict
+        make it an error to use a global variable that's never
+        assigned (other than with -v), to catch typos in names
+  -timings
+        after running, print the program to stderr with the time
+        spent in, and records matched by, each rule and function
+  -trace
+        print each statement and pattern to stderr as it runs, with
+        its file and line and the current NR
+  -trace-funcs names
+        with -trace, only trace statements in these functions
+        (comma-separated)
+  -trace-limit n
+        with -trace, stop tracing after n lines
+  -use-lc-numeric
+        use the decimal point of the locale named by LC_ALL,
+        LC_NUMERIC, or LANG (like "," for de_DE) for input and
+        output numbers, like gawk's --use-lc-numeric
   -version
         show GoAWK version and exit
+
+GoAWK subcommands:
+  goawk serve [-addr addr] name=progfile ...
+        run programs as an HTTP service (see "goawk serve -h")
+
+The sql_open() function needs a SQLite database/sql driver, which this
+goawk binary doesn't include: build goawk (or a Go program that uses
+GoAWK) with one imported to use the sql_* functions.
 `
 )
 
+// Stop parsing after reporting this many syntax errors
+const maxParseErrors = 10
+
+// Extension of compiled program files, and the first line in them
+// (followed by the version that compiled them)
+const (
+	bytecodeExt    = ".awkc"
+	bytecodeHeader = "# GoAWK bytecode"
+)
+
+// Command-line argument that assigns a variable instead of naming an
+// input file
+var varArgRegex = regexp.MustCompile(`^([_a-zA-Z][_a-zA-Z0-9]*)=`)
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serveMain(os.Args[2:])
+		return
+	}
+
 	// Parse command line arguments manually rather than using the
 	// "flag" package, so we can support flags with no space between
 	// flag and argument, like '-F:' (allowed by POSIX)
 	var progFiles []string
 	var vars []string
+	var persists []string
 	fieldSep := " "
+	ballast := ""
+	color := "never"
+	compile := false
+	compileOutput := "-"
+	coverlisting := ""
+	coverprofile := ""
 	cpuprofile := ""
 	debug := false
 	debugAsm := false
+	debugAsmJSON := false
 	debugTypes := false
+	dumpAST := ""
+	dumpBytecode := ""
+	flushInterval := ""
+	formatProg := false
+	gcPercent := ""
+	jobs := ""
+	jobsOrder := jobsOrderArgs
+	lineBuffered := false
+	lint := false
+	memLimit := ""
 	memprofile := ""
+	noSplit := false
+	nonDecimal := false
+	outputBuffer := ""
+	posix := false
+	posixNumbers := false
+	useLocaleNumeric := false
+	orderedArrays := false
+	prefetch := false
+	mmapFiles := false
+	pipeline := false
+	sandbox := false
+	strict := false
+	timings := false
+	trace := false
+	traceFuncs := ""
+	traceLimit := ""
 
 	var i int
 	for i = 1; i < len(os.Args); i++ {
@@ -111,7 +311,34 @@ func main() {
 			}
 			i++
 			vars = append(vars, os.Args[i])
-		case "-cpuprofile":
+		case "-ballast":
+			if i+1 >= len(os.Args) {
+				errorExitf("flag needs an argument: -ballast")
+			}
+			i++
+			ballast = os.Args[i]
+		case "-c":
+			if i+1 >= len(os.Args) {
+				errorExitf("flag needs an argument: -c")
+			}
+			i++
+			compile = true
+			progFiles = append(progFiles, os.Args[i])
+		case "-color", "--color":
+			color = "auto"
+		case "-coverlisting":
+			if i+1 >= len(os.Args) {
+				errorExitf("flag needs an argument: -coverlisting")
+			}
+			i++
+			coverlisting = os.Args[i]
+		case "-coverprofile":
+			if i+1 >= len(os.Args) {
+				errorExitf("flag needs an argument: -coverprofile")
+			}
+			i++
+			coverprofile = os.Args[i]
+		case "-cpuprofile", "--cpuprofile":
 			if i+1 >= len(os.Args) {
 				errorExitf("flag needs an argument: -cpuprofile")
 			}
@@ -121,32 +348,162 @@ func main() {
 			debug = true
 		case "-da":
 			debugAsm = true
+		case "-daj":
+			debugAsmJSON = true
 		case "-dt":
 			debugTypes = true
+		case "-dump-ast", "--dump-ast":
+			dumpAST = "pretty"
+		case "-dump-bytecode", "--dump-bytecode":
+			dumpBytecode = "text"
+		case "-flush-interval":
+			if i+1 >= len(os.Args) {
+				errorExitf("flag needs an argument: -flush-interval")
+			}
+			i++
+			flushInterval = os.Args[i]
+		case "-format", "--format":
+			formatProg = true
+		case "-gcpercent":
+			if i+1 >= len(os.Args) {
+				errorExitf("flag needs an argument: -gcpercent")
+			}
+			i++
+			gcPercent = os.Args[i]
 		case "-h", "--help":
 			fmt.Printf("%s\n\n%s\n\n%s", copyright, shortUsage, longUsage)
 			os.Exit(0)
+		case "-jobs", "--jobs":
+			if i+1 >= len(os.Args) {
+				errorExitf("flag needs an argument: -jobs")
+			}
+			i++
+			jobs = os.Args[i]
+		case "-jobs-order", "--jobs-order":
+			if i+1 >= len(os.Args) {
+				errorExitf("flag needs an argument: -jobs-order")
+			}
+			i++
+			jobsOrder = os.Args[i]
+		case "-line-buffered", "--line-buffered":
+			lineBuffered = true
+		case "-lint", "--lint":
+			lint = true
+		case "-memlimit":
+			if i+1 >= len(os.Args) {
+				errorExitf("flag needs an argument: -memlimit")
+			}
+			i++
+			memLimit = os.Args[i]
 		case "-memprofile":
 			if i+1 >= len(os.Args) {
 				errorExitf("flag needs an argument: -memprofile")
 			}
 			i++
 			memprofile = os.Args[i]
+		case "-no-split", "--no-split":
+			noSplit = true
+		case "-non-decimal", "--non-decimal":
+			nonDecimal = true
+		case "-ordered-arrays", "--ordered-arrays":
+			orderedArrays = true
+		case "-output-buffer":
+			if i+1 >= len(os.Args) {
+				errorExitf("flag needs an argument: -output-buffer")
+			}
+			i++
+			outputBuffer = os.Args[i]
+		case "-o":
+			if i+1 >= len(os.Args) {
+				errorExitf("flag needs an argument: -o")
+			}
+			i++
+			compileOutput = os.Args[i]
+		case "-posix", "--posix":
+			posix = true
+		case "-posix-numbers", "--posix-numbers":
+			posixNumbers = true
+		case "-use-lc-numeric", "--use-lc-numeric":
+			useLocaleNumeric = true
+		case "-prefetch", "--prefetch":
+			prefetch = true
+		case "-mmap", "--mmap":
+			mmapFiles = true
+		case "-persist", "--persist":
+			if i+1 >= len(os.Args) {
+				errorExitf("flag needs an argument: -persist")
+			}
+			i++
+			persists = append(persists, os.Args[i])
+		case "-pipeline", "--pipeline":
+			pipeline = true
+		case "-S", "-sandbox", "--sandbox":
+			sandbox = true
+		case "-strict", "--strict":
+			strict = true
+		case "-timings", "--timings":
+			timings = true
+		case "-trace", "--trace":
+			trace = true
+		case "-trace-funcs":
+			if i+1 >= len(os.Args) {
+				errorExitf("flag needs an argument: -trace-funcs")
+			}
+			i++
+			traceFuncs = os.Args[i]
+		case "-trace-limit":
+			if i+1 >= len(os.Args) {
+				errorExitf("flag needs an argument: -trace-limit")
+			}
+			i++
+			traceLimit = os.Args[i]
 		case "-version", "--version":
 			fmt.Println(version)
 			os.Exit(0)
 		default:
 			switch {
+			case strings.HasPrefix(arg, "-flush-interval="):
+				flushInterval = arg[16:]
 			case strings.HasPrefix(arg, "-F"):
 				fieldSep = arg[2:]
 			case strings.HasPrefix(arg, "-f"):
 				progFiles = append(progFiles, arg[2:])
 			case strings.HasPrefix(arg, "-v"):
 				vars = append(vars, arg[2:])
+			case strings.HasPrefix(arg, "-ballast="):
+				ballast = arg[9:]
+			case strings.HasPrefix(arg, "-color="):
+				color = arg[7:]
+			case strings.HasPrefix(arg, "--color="):
+				color = arg[8:]
+			case strings.HasPrefix(arg, "-coverlisting="):
+				coverlisting = arg[14:]
+			case strings.HasPrefix(arg, "-coverprofile="):
+				coverprofile = arg[14:]
 			case strings.HasPrefix(arg, "-cpuprofile="):
 				cpuprofile = arg[12:]
+			case strings.HasPrefix(arg, "-dump-ast="), strings.HasPrefix(arg, "--dump-ast="):
+				dumpAST = arg[strings.IndexByte(arg, '=')+1:]
+			case strings.HasPrefix(arg, "-dump-bytecode="), strings.HasPrefix(arg, "--dump-bytecode="):
+				dumpBytecode = arg[strings.IndexByte(arg, '=')+1:]
+			case strings.HasPrefix(arg, "-gcpercent="):
+				gcPercent = arg[11:]
+			case strings.HasPrefix(arg, "-jobs="):
+				jobs = arg[6:]
+			case strings.HasPrefix(arg, "-persist="):
+				persists = append(persists, arg[9:])
+			case strings.HasPrefix(arg, "-jobs-order="):
+				jobsOrder = arg[12:]
+			case strings.HasPrefix(arg, "-memlimit="):
+				memLimit = arg[10:]
 			case strings.HasPrefix(arg, "-memprofile="):
 				memprofile = arg[12:]
+			case strings.HasPrefix(arg, "-output-buffer="):
+				outputBuffer = arg[15:]
+			case strings.HasPrefix(arg, "-trace-funcs="):
+				traceFuncs = arg[13:]
+			case strings.HasPrefix(arg, "-trace-limit="):
+				traceLimit = arg[13:]
 			default:
 				errorExitf("flag provided but not defined: %s", arg)
 			}
@@ -156,76 +513,315 @@ func main() {
 	// Any remaining args are program and input files
 	args := os.Args[i:]
 
+	// A compiled program is run without parsing it
+	bytecodeFile := ""
+	switch {
+	case compile:
+	case len(progFiles) == 1 && filepath.Ext(progFiles[0]) == bytecodeExt:
+		bytecodeFile = progFiles[0]
+	case len(progFiles) == 0 && len(args) > 0 && filepath.Ext(args[0]) == bytecodeExt:
+		if _, err := os.Stat(args[0]); err == nil {
+			bytecodeFile = args[0]
+			args = args[1:]
+		}
+	}
+	if bytecodeFile != "" && (coverprofile != "" || coverlisting != "") {
+		errorExitf("can't report coverage of a compiled %s program", bytecodeExt)
+	}
+	if bytecodeFile != "" && timings {
+		errorExitf("can't report timings of a compiled %s program", bytecodeExt)
+	}
+	if bytecodeFile != "" && trace {
+		errorExitf("can't trace a compiled %s program", bytecodeExt)
+	}
+
 	var src []byte
-	var stdinBytes []byte // used if there's a parse error
-	if len(progFiles) > 0 {
+	sources := make(map[string][]byte) // by name, for showing error lines
+	var srcFiles []parser.File
+	awkPath := filepath.SplitList(os.Getenv("AWKPATH"))
+	switch {
+	case bytecodeFile != "":
+		// Compiled program, loaded below instead of parsing source
+	case len(progFiles) > 0:
 		// Read source: the concatenation of all source files specified
 		buf := &bytes.Buffer{}
 		progFiles = expandWildcardsOnWindows(progFiles)
 		for _, progFile := range progFiles {
+			progFile, err := parser.FindFile(progFile, awkPath)
+			if err != nil {
+				errorExit(err)
+			}
+			linesBefore := bytes.Count(buf.Bytes(), []byte{'\n'})
+			name := progFile
 			if progFile == "-" {
+				name = "<stdin>"
 				b, err := ioutil.ReadAll(os.Stdin)
 				if err != nil {
 					errorExit(err)
 				}
-				stdinBytes = b
+				sources[name] = b
 				_, _ = buf.Write(b)
 			} else {
-				f, err := os.Open(progFile)
+				b, err := ioutil.ReadFile(progFile)
 				if err != nil {
 					errorExit(err)
 				}
-				_, err = buf.ReadFrom(f)
-				if err != nil {
-					_ = f.Close()
-					errorExit(err)
-				}
-				_ = f.Close()
+				sources[name] = b
+				_, _ = buf.Write(b)
 			}
 			// Append newline to file in case it doesn't end with one
 			_ = buf.WriteByte('\n')
+			numLines := bytes.Count(buf.Bytes(), []byte{'\n'}) - linesBefore
+			srcFiles = append(srcFiles, parser.File{Name: name, Lines: numLines})
 		}
 		src = buf.Bytes()
-	} else {
+	default:
 		if len(args) < 1 {
 			errorExitf(shortUsage)
 		}
 		src = []byte(args[0])
 		args = args[1:]
+		numLines := bytes.Count(src, []byte{'\n'}) + 1
+		sources["<cmdline>"] = src
+		srcFiles = []parser.File{{Name: "<cmdline>", Lines: numLines}}
 	}
 
 	// Parse source code and setup interpreter
 	parserConfig := &parser.ParserConfig{
 		DebugTypes:  debugTypes,
 		DebugWriter: os.Stderr,
+		Coverage:    coverprofile != "" || coverlisting != "" || trace,
+		NoInline:    timings,
+		MaxErrors:   maxParseErrors,
+		POSIX:       posix,
+		NonDecimal:  nonDecimal,
+		Files:       srcFiles,
+		IncludePath: awkPath,
+	}
+	libPath := filepath.SplitList(os.Getenv("AWKLIBPATH"))
+	parserConfig.Load = func(name string) (map[string]interface{}, error) {
+		if sandbox {
+			// Only extensions compiled in, as a plugin runs arbitrary code
+			if funcs, ok := extension.Lookup(name); ok {
+				return funcs, nil
+			}
+			return nil, errors.New("can't load plugins in sandbox mode")
+		}
+		return extension.Load(name, libPath)
+	}
+	if lint {
+		parserConfig.WarningWriter = os.Stderr
+	}
+	if strict {
+		parserConfig.Strict = true
+		for _, v := range vars {
+			parserConfig.Assigned = append(parserConfig.Assigned, strings.SplitN(v, "=", 2)[0])
+		}
+		for _, arg := range args {
+			// Command-line assignments like "name=value" among the files
+			if m := varArgRegex.FindStringSubmatch(arg); m != nil {
+				parserConfig.Assigned = append(parserConfig.Assigned, m[1])
+			}
+		}
+	}
+	var prog *parser.Program
+	var err error
+	if bytecodeFile != "" {
+		prog, err = loadBytecode(bytecodeFile)
+	} else {
+		// Expand @include directives first, so that the listings and
+		// error lines below show the included files' source
+		src, parserConfig.Files, err = parser.ExpandIncludes(src, srcFiles, awkPath)
+		if err == nil {
+			for _, f := range parserConfig.Files {
+				if _, ok := sources[f.Name]; !ok {
+					sources[f.Name], _ = ioutil.ReadFile(f.Name)
+				}
+			}
+			prog, err = parser.ParseProgram(src, parserConfig)
+		}
 	}
-	prog, err := parser.ParseProgram(src, parserConfig)
 	if err != nil {
-		if err, ok := err.(*parser.ParseError); ok {
-			name, line := errorFileLine(progFiles, stdinBytes, err.Position.Line)
-			fmt.Fprintf(os.Stderr, "%s:%d:%d: %s\n",
-				name, line, err.Position.Column, err.Message)
-			showSourceLine(src, err.Position)
+		if errs, ok := err.(parser.ErrorList); ok {
+			for _, err := range errs {
+				fmt.Fprintf(os.Stderr, "%s:%d:%d: %s\n",
+					err.Filename, err.Position.Line, err.Position.Column, err.Message)
+				showSourceLine(sources[err.Filename], err.Position)
+			}
+			if len(errs) == maxParseErrors {
+				fmt.Fprintln(os.Stderr, "too many errors")
+			}
 			os.Exit(1)
 		}
 		errorExitf("%s", err)
 	}
 
+	if compile {
+		if len(prog.Loads) > 0 {
+			errorExitf("can't compile a program that uses @load")
+		}
+		writeBytecode(compileOutput, prog)
+		return
+	}
+
+	if lint {
+		for _, w := range goawklint.Check(prog.AST()) {
+			name, line := prog.FileLine(w.Position.Line)
+			fmt.Fprintf(os.Stderr, "%s:%d:%d: warning: %s\n",
+				name, line, w.Position.Column, w.Message)
+		}
+	}
+
 	if debug {
 		fmt.Fprintln(os.Stderr, prog)
 	}
 
 	if debugAsm {
-		err := prog.Disassemble(os.Stderr)
+		err := prog.DisassembleSource(os.Stderr, src)
+		if err != nil {
+			errorExitf("could not disassemble program: %v", err)
+		}
+	}
+
+	if debugAsmJSON {
+		err := prog.DisassembleJSON(os.Stderr)
 		if err != nil {
 			errorExitf("could not disassemble program: %v", err)
 		}
 	}
 
+	if dumpAST != "" || dumpBytecode != "" {
+		switch dumpAST {
+		case "":
+		case "pretty":
+			fmt.Println(prog)
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			err := encoder.Encode(prog.AST())
+			if err != nil {
+				errorExit(err)
+			}
+		default:
+			errorExitf("invalid -dump-ast format %q (use -dump-ast or -dump-ast=json)", dumpAST)
+		}
+		switch dumpBytecode {
+		case "":
+		case "text":
+			err := prog.DisassembleSource(os.Stdout, src)
+			if err != nil {
+				errorExitf("could not disassemble program: %v", err)
+			}
+		case "json":
+			err := prog.DisassembleJSON(os.Stdout)
+			if err != nil {
+				errorExitf("could not disassemble program: %v", err)
+			}
+		default:
+			errorExitf("invalid -dump-bytecode format %q (use -dump-bytecode or -dump-bytecode=json)", dumpBytecode)
+		}
+		return
+	}
+
+	if formatProg {
+		err := format.Fprint(os.Stdout, prog.AST(), src)
+		if err != nil {
+			errorExit(err)
+		}
+		return
+	}
+
 	config := &interp.Config{
 		Argv0: filepath.Base(os.Args[0]),
 		Args:  expandWildcardsOnWindows(args),
 		Vars:  []string{"FS", fieldSep},
+
+		NoFieldSplit:  noSplit,
+		PrefetchFiles: prefetch,
+		MmapFiles:     mmapFiles,
+		PipelineInput: pipeline,
+		OrderedArrays: orderedArrays,
+	}
+	if sandbox {
+		config.NoExec = true
+		config.NoFileWrites = true
+		config.NoFileReads = true
+		config.AllowArgFiles = true
+	}
+	switch {
+	case nonDecimal && posixNumbers:
+		config.NumberParser = func(s string) (float64, bool) {
+			if n, ok := interp.ParseNonDecimal(s); ok {
+				return n, true
+			}
+			return interp.ParsePOSIXNumber(s)
+		}
+	case nonDecimal:
+		config.NumberParser = interp.ParseNonDecimal
+	case posixNumbers:
+		config.NumberParser = interp.ParsePOSIXNumber
+	}
+	config.RedisURL = os.Getenv("GOAWK_REDIS_URL")
+	config.Sources = extension.Sources()
+	if _, ok := config.Sources["kafka"]; !ok {
+		// A custom build may register its own Kafka client instead
+		if config.Sources == nil {
+			config.Sources = make(map[string]func(url string) (interp.RecordSource, error))
+		}
+		config.Sources["kafka"] = openKafka
+	}
+	config.OpenURL = objstore.Open
+	if useLocaleNumeric {
+		name, point := numericLocale(os.Getenv)
+		config.Locale = &interp.Locale{Name: name, DecimalPoint: point}
+		config.UseLocaleNumeric = true
+	}
+	switch color {
+	case "always":
+		config.Color = true
+	case "auto":
+		config.Color = os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb" && isTerminal(os.Stdout)
+	case "never":
+	default:
+		errorExitf("invalid -color value %q (must be auto, always, or never)", color)
+	}
+	if gcPercent != "" {
+		n, err := strconv.Atoi(gcPercent)
+		if err != nil {
+			errorExitf("invalid -gcpercent value %q", gcPercent)
+		}
+		config.GCPercent = n
+	}
+	if memLimit != "" {
+		config.MemoryLimit = parseSize("-memlimit", memLimit)
+	}
+	if ballast != "" {
+		config.GCBallast = int(parseSize("-ballast", ballast))
+	}
+	if len(persists) > 0 {
+		config.PersistentArrays = make(map[string]interp.ArrayStore)
+		for _, persist := range persists {
+			parts := strings.SplitN(persist, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				errorExitf("-persist must be name=file, not %q", persist)
+			}
+			config.PersistentArrays[parts[0]] = interp.NewDiskArrayStore(parts[1])
+		}
+	}
+	if outputBuffer != "" {
+		size := parseSize("-output-buffer", outputBuffer)
+		if size < 1 || size > math.MaxInt32 {
+			errorExitf("invalid -output-buffer size %q", outputBuffer)
+		}
+		config.OutputBufferSize = int(size)
+	}
+	config.OutputLineBuffered = lineBuffered
+	if flushInterval != "" {
+		d, err := time.ParseDuration(flushInterval)
+		if err != nil || d <= 0 {
+			errorExitf("invalid -flush-interval value %q", flushInterval)
+		}
+		config.OutputFlushInterval = d
 	}
 	for _, v := range vars {
 		parts := strings.SplitN(v, "=", 2)
@@ -235,6 +831,35 @@ func main() {
 		config.Vars = append(config.Vars, parts[0], parts[1])
 	}
 
+	var coverage *interp.Coverage
+	if parserConfig.Coverage {
+		coverage, err = interp.NewCoverage(prog)
+		if err != nil {
+			errorExit(err)
+		}
+		config.Coverage = coverage
+	}
+
+	var profile *interp.Profile
+	if timings {
+		profile = interp.NewProfile(prog)
+		config.Profile = profile
+	}
+
+	if trace {
+		config.Trace = os.Stderr
+		if traceFuncs != "" {
+			config.TraceFunctions = strings.Split(traceFuncs, ",")
+		}
+		if traceLimit != "" {
+			n, err := strconv.Atoi(traceLimit)
+			if err != nil || n < 1 {
+				errorExitf("invalid -trace-limit value %q", traceLimit)
+			}
+			config.TraceLimit = n
+		}
+	}
+
 	if cpuprofile != "" {
 		f, err := os.Create(cpuprofile)
 		if err != nil {
@@ -245,15 +870,75 @@ func main() {
 		}
 	}
 
+	numJobs := 0
+	if jobs != "" {
+		n, err := strconv.Atoi(jobs)
+		if err != nil || n < 1 {
+			errorExitf("invalid -jobs value %q", jobs)
+		}
+		if jobsOrder != jobsOrderArgs && jobsOrder != jobsOrderFinish {
+			errorExitf("invalid -jobs-order value %q (must be %s or %s)", jobsOrder, jobsOrderArgs, jobsOrderFinish)
+		}
+		if coverprofile != "" || coverlisting != "" {
+			errorExitf("-jobs can't be used with coverage reports")
+		}
+		if timings {
+			errorExitf("-jobs can't be used with -timings")
+		}
+		if trace {
+			errorExitf("-jobs can't be used with -trace")
+		}
+		if len(persists) > 0 {
+			errorExitf("-jobs can't be used with -persist")
+		}
+		numJobs = n
+	}
+
 	// Run the program!
-	status, err := interp.ExecProgram(prog, config)
+	var status int
+	if numJobs > 0 && len(config.Args) > 0 {
+		status, err = runJobs(prog, config, numJobs, jobsOrder)
+	} else {
+		status, err = interp.ExecProgram(prog, config)
+	}
+	if cpuprofile != "" {
+		// Stop before handling errors so the profile is written even
+		// if the program fails
+		pprof.StopCPUProfile()
+	}
+	if timings {
+		// Like the CPU profile, show where the time went even if the
+		// program fails
+		if err := profile.WriteListing(os.Stderr, src); err != nil {
+			errorExitf("could not write timings: %v", err)
+		}
+	}
 	if err != nil {
+		if err, ok := err.(*interp.Error); ok && err.Position.Line > 0 {
+			name, line := prog.FileLine(err.Position.Line)
+			fmt.Fprintf(os.Stderr, "%s:%d:%d: %s\n",
+				name, line, err.Position.Column, err)
+			showSourceLine(sources[name], lexer.Position{Line: line, Column: err.Position.Column})
+			os.Exit(1)
+		}
 		errorExit(err)
 	}
 
-	if cpuprofile != "" {
-		pprof.StopCPUProfile()
+	if coverprofile != "" {
+		writeCoverage(coverprofile, func(w io.Writer) error {
+			var coverFiles []interp.CoverageFile
+			for _, f := range parserConfig.Files {
+				coverFiles = append(coverFiles, interp.CoverageFile{Name: f.Name, Lines: f.Lines, StartLine: f.StartLine})
+			}
+			return coverage.WriteLCOV(w, coverFiles)
+		})
 	}
+	if coverlisting != "" {
+		writeCoverage(coverlisting, func(w io.Writer) error {
+			return coverage.WriteListing(w, src)
+		})
+	}
+
 	if memprofile != "" {
 		f, err := os.Create(memprofile)
 		if err != nil {
@@ -269,47 +954,169 @@ func main() {
 	os.Exit(status)
 }
 
+// Parse a size in bytes for the named flag, like "512M" or "4GiB": an
+// integer with an optional K, M, or G suffix (powers of 1024), which
+// may be followed by "B" or "iB".
+func parseSize(flagName, s string) int64 {
+	digits := strings.TrimSuffix(strings.ToUpper(s), "B")
+	digits = strings.TrimSuffix(digits, "I")
+	shift := uint(0)
+	if i := len(digits) - 1; i >= 0 {
+		switch digits[i] {
+		case 'K':
+			shift = 10
+		case 'M':
+			shift = 20
+		case 'G':
+			shift = 30
+		}
+		if shift != 0 {
+			digits = digits[:i]
+		}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		errorExitf("invalid %s size %q", flagName, s)
+	}
+	return n << shift
+}
+
+// Create filename and write a coverage report to it using write.
+func writeCoverage(filename string, write func(w io.Writer) error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		errorExitf("could not create coverage report: %v", err)
+	}
+	err = write(f)
+	if err == nil {
+		err = f.Close()
+	} else {
+		_ = f.Close()
+	}
+	if err != nil {
+		errorExitf("could not write coverage report: %v", err)
+	}
+}
+
+// Write prog's virtual machine instructions to the named bytecode file
+// (or stdout if name is "-"), in the format Program.Disassemble writes
+// and parser.Assemble reads, after a header line with the version.
+func writeBytecode(name string, prog *parser.Program) {
+	var w io.Writer = os.Stdout
+	if name != "-" {
+		f, err := os.Create(name)
+		if err != nil {
+			errorExit(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	buf := bufio.NewWriter(w)
+	fmt.Fprintf(buf, "%s %s\n", bytecodeHeader, version)
+	err := prog.Disassemble(buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		errorExitf("could not write bytecode: %v", err)
+	}
+}
+
+// Load a program from a bytecode file written by writeBytecode.
+func loadBytecode(name string) (*parser.Program, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	header := string(b)
+	if i := strings.IndexByte(header, '\n'); i >= 0 {
+		header = header[:i]
+	}
+	if !strings.HasPrefix(header, bytecodeHeader+" ") {
+		return nil, fmt.Errorf("%s: not a GoAWK bytecode file", name)
+	}
+	if compiledBy := header[len(bytecodeHeader)+1:]; compiledBy != version {
+		// Opcodes can change between versions
+		return nil, fmt.Errorf("%s: compiled by GoAWK %s, recompile it to run with %s", name, compiledBy, version)
+	}
+	prog, err := parser.Assemble(bytes.NewReader(b), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return prog, nil
+}
+
+// Open a kafka:// input file argument with the built-in consumer.
+func openKafka(url string) (interp.RecordSource, error) {
+	c, err := kafka.Open(url)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
 // Show source line and position of error, for example:
 //
 // BEGIN { x*; }
 //           ^
 func showSourceLine(src []byte, pos lexer.Position) {
 	lines := bytes.Split(src, []byte{'\n'})
-	srcLine := string(lines[pos.Line-1])
+	var srcLine string
+	if pos.Line <= len(lines) {
+		srcLine = string(lines[pos.Line-1])
+	}
 	numTabs := strings.Count(srcLine[:pos.Column-1], "\t")
 	runeColumn := utf8.RuneCountInString(srcLine[:pos.Column-1])
 	fmt.Fprintln(os.Stderr, strings.Replace(srcLine, "\t", "    ", -1))
 	fmt.Fprintln(os.Stderr, strings.Repeat(" ", runeColumn)+strings.Repeat("   ", numTabs)+"^")
 }
 
-// Determine which filename and line number to display for the overall
-// error line number.
-func errorFileLine(progFiles []string, stdinBytes []byte, errorLine int) (string, int) {
-	if len(progFiles) == 0 {
-		return "<cmdline>", errorLine
-	}
-	startLine := 1
-	for _, progFile := range progFiles {
-		var content []byte
-		if progFile == "-" {
-			progFile = "<stdin>"
-			content = stdinBytes
-		} else {
-			b, err := ioutil.ReadFile(progFile)
-			if err != nil {
-				return "<unknown>", errorLine
-			}
-			content = b
-		}
-		content = append(content, '\n')
+// Report whether f is a terminal (or other character device).
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
 
-		numLines := bytes.Count(content, []byte{'\n'})
-		if errorLine >= startLine && errorLine < startLine+numLines {
-			return progFile, errorLine - startLine + 1
+// Languages whose locales use a "," decimal point, and the exceptions
+// for particular territories, for -use-lc-numeric. Go has no locale
+// data, so this covers only the most common locales.
+var (
+	commaDecimalLanguages = map[string]bool{
+		"az": true, "be": true, "bg": true, "bs": true, "ca": true, "cs": true,
+		"da": true, "de": true, "el": true, "es": true, "et": true, "eu": true,
+		"fi": true, "fr": true, "gl": true, "hr": true, "hu": true, "hy": true,
+		"id": true, "is": true, "it": true, "ka": true, "kk": true, "lt": true,
+		"lv": true, "mk": true, "nb": true, "nl": true, "nn": true, "no": true,
+		"pl": true, "pt": true, "ro": true, "ru": true, "sk": true, "sl": true,
+		"sq": true, "sr": true, "sv": true, "tr": true, "uk": true, "vi": true,
+	}
+	pointDecimalLocales = map[string]bool{
+		"de_CH": true, "es_MX": true, "es_US": true, "it_CH": true,
+	}
+)
+
+// Return the name and decimal point of the locale for numbers, named
+// by the first of LC_ALL, LC_NUMERIC, and LANG that's set.
+func numericLocale(getenv func(string) string) (name, point string) {
+	for _, v := range []string{"LC_ALL", "LC_NUMERIC", "LANG"} {
+		name = getenv(v)
+		if name != "" {
+			break
 		}
-		startLine += numLines
 	}
-	return "<unknown>", errorLine
+	// Names look like "language_TERRITORY.codeset@modifier"
+	base := name
+	if i := strings.IndexAny(base, ".@"); i >= 0 {
+		base = base[:i]
+	}
+	language := base
+	if i := strings.IndexByte(language, '_'); i >= 0 {
+		language = language[:i]
+	}
+	if commaDecimalLanguages[language] && !pointDecimalLocales[base] {
+		return name, ","
+	}
+	return name, "."
 }
 
 func errorExit(err error) {
@@ -12,6 +12,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -391,7 +392,7 @@ func TestCommandLine(t *testing.T) {
 		{[]string{"-v"}, "", "", "flag needs an argument: -v"},
 		{[]string{"-z"}, "", "", "flag provided but not defined: -z"},
 		{[]string{"{ print }", "notexist"}, "", "", `file "notexist" not found`},
-		{[]string{"BEGIN { print 1/0 }"}, "", "", "division by zero"},
+		{[]string{"BEGIN { print 1/0 }"}, "", "", "<cmdline>:1:9: division by zero\nBEGIN { print 1/0 }\n        ^"},
 		{[]string{"-v", "foo", "BEGIN {}"}, "", "", "-v flag must be in format name=value"},
 		{[]string{"--", "{ print $1 }", "-file"}, "", "", `file "-file" not found`},
 		{[]string{"{ print $1 }", "-file"}, "", "", `file "-file" not found`},
@@ -427,6 +428,608 @@ func TestDevStdout(t *testing.T) {
 	runAWKs(t, []string{`BEGIN { print "1"; print "2">"/dev/stdout" }`}, "", "1\n2\n", "")
 }
 
+func TestLint(t *testing.T) {
+	src := `BEGIN { print "a"; exit; print "b" }`
+	stdout, stderr, err := runGoAWK([]string{"-lint", src}, "")
+	if err != nil {
+		t.Fatalf("expected no error, got %v (%q)", err, stderr)
+	}
+	if stdout != "a\n" {
+		t.Fatalf("expected %q, got %q", "a\n", stdout)
+	}
+	expected := "warning: unreachable code after exit: print \"b\"\n"
+	if stderr != expected {
+		t.Fatalf("expected warnings %q, got %q", expected, stderr)
+	}
+
+	_, stderr, err = runGoAWK([]string{src}, "")
+	if err != nil || stderr != "" {
+		t.Fatalf("expected no warnings without -lint, got %v (%q)", err, stderr)
+	}
+
+	_, stderr, err = runGoAWK([]string{"-lint", `BEGIN { x = 1 }`}, "")
+	if err != nil {
+		t.Fatalf("expected no error, got %v (%q)", err, stderr)
+	}
+	expected = "<cmdline>:1:9: warning: global variable x is assigned but never used\n"
+	if stderr != expected {
+		t.Fatalf("expected warnings %q, got %q", expected, stderr)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	stdout, stderr, err := runGoAWK([]string{"-format", `$1>3{n++}END{print n}`}, "")
+	if err != nil {
+		t.Fatalf("expected no error, got %v (%q)", err, stderr)
+	}
+	expected := "$1 > 3 {\n\tn++\n}\nEND {\n\tprint n\n}\n"
+	if stdout != expected {
+		t.Fatalf("expected %q, got %q", expected, stdout)
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	_, stderr, err := runGoAWK([]string{"BEGIN { x = }\n{ print ) }"}, "")
+	if err == nil {
+		t.Fatalf("expected error, got none")
+	}
+	expected := `<cmdline>:1:13: expected expression instead of }
+BEGIN { x = }
+            ^
+<cmdline>:2:9: expected ; or newline between statements
+{ print ) }
+        ^
+`
+	if stderr != expected {
+		t.Fatalf("expected %q, got %q", expected, stderr)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	tests := []struct {
+		args   []string
+		output string
+		error  string
+	}{
+		{[]string{"-strict", `BEGIN { total = 3; print totl }`}, "", "<cmdline>:1:26: variable \"totl\" is never assigned (strict mode)\n" +
+			"BEGIN { total = 3; print totl }\n" +
+			"                         ^\n"},
+		{[]string{"-strict", "-v", "n=1", `BEGIN { print n }`}, "1\n", ""},
+		{[]string{"-strict", `END { print n }`, "n=2", "/dev/null"}, "2\n", ""},
+		{[]string{`BEGIN { total = 3; print totl }`}, "\n", ""},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			stdout, stderr, _ := runGoAWK(test.args, "")
+			if stdout != test.output || stderr != test.error {
+				t.Fatalf("expected %q and %q, got %q and %q", test.output, test.error, stdout, stderr)
+			}
+		})
+	}
+}
+
+func TestRuntimeErrorFile(t *testing.T) {
+	_, stderr, err := runGoAWK([]string{"-f", "testdata/parseerror/good.awk", "-f", "-"},
+		"function f(x) {\n\treturn 1/x\n}\nBEGIN { f(0) }")
+	expected := "<stdin>:4:9: division by zero\n" +
+		"BEGIN { f(0) }\n" +
+		"        ^\n"
+	if err == nil || stderr != expected {
+		t.Fatalf("expected error %q, got %v (%q)", expected, err, stderr)
+	}
+}
+
+func TestAWKPATH(t *testing.T) {
+	os.Setenv("AWKPATH", "testdata/nothere"+string(os.PathListSeparator)+"testdata/parseerror")
+	defer os.Unsetenv("AWKPATH")
+	stdout, stderr, err := runGoAWK([]string{"-f", "good"}, "a b\n")
+	if err != nil || stdout != "a\n" {
+		t.Fatalf("expected \"a\", got %q, %v (%q)", stdout, err, stderr)
+	}
+	_, stderr, err = runGoAWK([]string{"-f", "bad.awk"}, "")
+	expected := filepath.Join("testdata", "parseerror", "bad.awk") + ":2:3: expected expression instead of <newline>\n"
+	if err == nil || !strings.HasPrefix(stderr, expected) {
+		t.Fatalf("expected error %q, got %v (%q)", expected, err, stderr)
+	}
+	_, stderr, err = runGoAWK([]string{"-f", "missing.awk"}, "")
+	expected = "file \"missing.awk\" not found in AWKPATH (tried " +
+		filepath.Join("testdata", "nothere", "missing.awk") + ", " +
+		filepath.Join("testdata", "parseerror", "missing.awk") + ")\n"
+	if err == nil || stderr != expected {
+		t.Fatalf("expected error %q, got %v (%q)", expected, err, stderr)
+	}
+
+	// @include uses the same search path
+	stdout, stderr, err = runGoAWK([]string{"@include \"good\"\n{ print NR }"}, "a b\n")
+	if err != nil || stdout != "a\n1\n" {
+		t.Fatalf("expected \"a\\n1\\n\", got %q, %v (%q)", stdout, err, stderr)
+	}
+	_, stderr, err = runGoAWK([]string{"BEGIN {}\n@include \"bad\""}, "")
+	expected = filepath.Join("testdata", "parseerror", "bad.awk") + ":2:3: expected expression instead of <newline>\nx*\n  ^\n"
+	if err == nil || stderr != expected {
+		t.Fatalf("expected error %q, got %v (%q)", expected, err, stderr)
+	}
+}
+
+func TestCPUProfile(t *testing.T) {
+	for _, src := range []string{`BEGIN { for (i = 0; i < 100000; i++) s += i; print s }`, `BEGIN { print 1/0 }`} {
+		profile := filepath.Join(t.TempDir(), "cpu.prof")
+		_, stderr, _ := runGoAWK([]string{"--cpuprofile", profile, src}, "")
+		data, err := ioutil.ReadFile(profile)
+		if err != nil {
+			t.Fatalf("%s: error reading profile: %v (%q)", src, err, stderr)
+		}
+		// Profiles are gzipped protocol buffers
+		if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+			t.Fatalf("%s: expected gzipped profile, got %q", src, data)
+		}
+	}
+}
+
+func TestTimingsFlag(t *testing.T) {
+	src := `function double(n) { return n*2 }
+/a/ { s += double($2) }  /b/ { n++ }
+END { print s, n }`
+	stdout, stderr, err := runGoAWK([]string{"-timings", src}, "a 1\nb 2\na 3\n")
+	if err != nil || stdout != "8 1\n" {
+		t.Fatalf("expected %q, got %q, %v (%q)", "8 1\n", stdout, err, stderr)
+	}
+	// Compare the count, matched, and source columns (times vary)
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(stderr, "\n"), "\n") {
+		runes := []rune(line)
+		if len(runes) < 12 {
+			t.Fatalf("unexpected timings:\n%s", stderr)
+		}
+		lines = append(lines, string(runes[12:]))
+	}
+	expected := `      count    matched
+          2           :    1:function double(n) { return n*2 }
+          3          2:    2:/a/ { s += double($2) }  /b/ { n++ }
+          3          1:     :                         ^
+          1           :    3:END { print s, n }`
+	if strings.Join(lines, "\n") != expected {
+		t.Fatalf("expected timings:\n%s\ngot:\n%s", expected, stderr)
+	}
+}
+
+func TestTraceFlag(t *testing.T) {
+	progFile := filepath.Join(t.TempDir(), "prog.awk")
+	err := ioutil.WriteFile(progFile, []byte("NR == 2 { next }\n{ print }\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, err := runGoAWK([]string{"-trace", "-trace-limit=4", "-f", progFile}, "a\nb\nc\n")
+	if err != nil || stdout != "a\nc\n" {
+		t.Fatalf("expected %q, got %q, %v (%q)", "a\nc\n", stdout, err, stderr)
+	}
+	expected := progFile + ":1: NR=1: (NR == 2)\n" +
+		progFile + ":2: NR=1: print\n" +
+		progFile + ":1: NR=2: (NR == 2)\n" +
+		progFile + ":1: NR=2: next\n" +
+		"trace limit of 4 lines reached\n"
+	if stderr != expected {
+		t.Fatalf("expected trace:\n%s\ngot:\n%s", expected, stderr)
+	}
+
+	_, stderr, err = runGoAWK([]string{"-trace", "-trace-limit", "x", "{}"}, "")
+	if err == nil || stderr != "invalid -trace-limit value \"x\"\n" {
+		t.Fatalf("expected -trace-limit error, got %v (%q)", err, stderr)
+	}
+}
+
+func TestOutputBufferingFlags(t *testing.T) {
+	dir := t.TempDir()
+	// Reading the file through a different path is a separate stream,
+	// so it doesn't flush the output
+	src := `BEGIN { print "x" >"` + dir + `/out"; print ((getline line <"` + dir + `/./out") > 0) }`
+	tests := []struct {
+		args   []string
+		output string
+	}{
+		{nil, "0\n"},
+		{[]string{"-line-buffered"}, "1\n"},
+		{[]string{"-output-buffer", "1"}, "1\n"},
+		{[]string{"-output-buffer=1M"}, "0\n"},
+		{[]string{"-flush-interval=1h"}, "0\n"},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			stdout, stderr, err := runGoAWK(append(test.args, src), "")
+			if err != nil || stdout != test.output {
+				t.Fatalf("expected %q, got %q, %v (%q)", test.output, stdout, err, stderr)
+			}
+		})
+	}
+
+	errors := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-output-buffer", "0"}, "invalid -output-buffer size \"0\"\n"},
+		{[]string{"-output-buffer=x"}, "invalid -output-buffer size \"x\"\n"},
+		{[]string{"-flush-interval", "5"}, "invalid -flush-interval value \"5\"\n"},
+	}
+	for _, test := range errors {
+		_, stderr, err := runGoAWK(append(test.args, "BEGIN {}"), "")
+		if err == nil || stderr != test.err {
+			t.Fatalf("expected error %q, got %v (%q)", test.err, err, stderr)
+		}
+	}
+}
+
+func TestColorFlag(t *testing.T) {
+	tests := []struct {
+		args   []string
+		output string
+	}{
+		{[]string{"-color=always"}, "a \x1b[1;31mfoo\x1b[0m\n"},
+		{[]string{"--color"}, "a foo\n"}, // stdout isn't a terminal
+		{[]string{"-color=never"}, "a foo\n"},
+		{nil, "a foo\n"},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			args := append(test.args, `/foo/`)
+			stdout, stderr, err := runGoAWK(args, "a foo\nbar\n")
+			if err != nil || stdout != test.output {
+				t.Fatalf("expected %q, got %q, %v (%q)", test.output, stdout, err, stderr)
+			}
+		})
+	}
+	_, stderr, err := runGoAWK([]string{"-color=sometimes", `BEGIN {}`}, "")
+	expected := "invalid -color value \"sometimes\" (must be auto, always, or never)\n"
+	if err == nil || stderr != expected {
+		t.Fatalf("expected error %q, got %v (%q)", expected, err, stderr)
+	}
+}
+
+func TestPersistFlag(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "seen.db")
+	for _, test := range []struct {
+		input  string
+		output string
+	}{
+		{"a\nb\na\n", "a\nb\n"},
+		{"b\nc\n", "c\n"},
+	} {
+		stdout, stderr, err := runGoAWK([]string{"-persist", "seen=" + file, "!seen[$0]++"}, test.input)
+		if err != nil || stdout != test.output {
+			t.Fatalf("expected %q, got %q, %v (%q)", test.output, stdout, err, stderr)
+		}
+	}
+	_, stderr, err := runGoAWK([]string{"-persist=seen", "BEGIN {}"}, "")
+	expected := "-persist must be name=file, not \"seen\"\n"
+	if err == nil || stderr != expected {
+		t.Fatalf("expected error %q, got %v (%q)", expected, err, stderr)
+	}
+}
+
+func TestKafkaInput(t *testing.T) {
+	// Reading topics is tested with a fake broker in the kafka package
+	_, stderr, err := runGoAWK([]string{"{ print }", "kafka://localhost/logs?partition=x"}, "")
+	expected := "open kafka://localhost/logs?partition=x: invalid partition \"x\"\n"
+	if err == nil || stderr != expected {
+		t.Fatalf("expected error %q, got %v (%q)", expected, err, stderr)
+	}
+}
+
+func TestSQLWithoutDriver(t *testing.T) {
+	_, stderr, err := runGoAWK([]string{`BEGIN { sql_open("test.db") }`}, "")
+	expected := `<cmdline>:1:9: can't call sql_open() without a SQLite driver: the Go program using GoAWK must import one (see Config.SQLDriver)
+BEGIN { sql_open("test.db") }
+        ^
+`
+	if err == nil || stderr != expected {
+		t.Fatalf("expected error %q, got %v (%q)", expected, err, stderr)
+	}
+	if _, err := os.Stat("test.db"); err == nil {
+		t.Fatalf("expected test.db not to be created")
+	}
+}
+
+func TestSandboxFlag(t *testing.T) {
+	tests := []struct {
+		src    string
+		output string
+		error  string
+	}{
+		{`{ print; exit }`, "{\n", ""},
+		{`BEGIN { system("echo hi") }`, "", "can't call system() due to NoExec"},
+		{`BEGIN { print "x" > "out" }`, "", "can't write to file due to NoFileWrites"},
+		{`BEGIN { getline x < "testdata/parseerror/bad.awk" }`, "", "can't read from file due to NoFileReads"},
+		{`BEGIN { ARGV[1] = "testdata/parseerror/bad.awk" } { print }`, "", "can't read from file due to NoFileReads"},
+		{"@load \"ext\"\nBEGIN {}", "", `can't load "ext": can't load plugins in sandbox mode`},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			stdout, stderr, err := runGoAWK([]string{"-S", test.src, "testdata/parseerror/good.awk"}, "")
+			if test.error != "" {
+				if err == nil || !strings.Contains(stderr, test.error) {
+					t.Fatalf("expected error %q, got %v (%q)", test.error, err, stderr)
+				}
+				return
+			}
+			if err != nil || stdout != test.output {
+				t.Fatalf("expected %q, got %q, %v (%q)", test.output, stdout, err, stderr)
+			}
+		})
+	}
+}
+
+func TestDumpFlags(t *testing.T) {
+	tests := []struct {
+		args   []string
+		output string
+	}{
+		{[]string{"-dump-ast"}, "BEGIN {\n    print (x + 1)\n}\n"},
+		{[]string{"--dump-ast=json"}, `"type": "BinaryExpr"`},
+		{[]string{"-dump-bytecode"}, "0000    Global x\n"},
+		{[]string{"--dump-bytecode=json"}, `{"block":"BEGIN","addr":0,"opcode":"Global"`},
+		{[]string{"-dump-ast", "-dump-bytecode"}, "}\n        // BEGIN\n"},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			args := append(test.args, `BEGIN { print x + 1 }`)
+			stdout, stderr, err := runGoAWK(args, "")
+			if err != nil || !strings.Contains(stdout, test.output) {
+				t.Fatalf("expected output containing %q, got %q, %v (%q)", test.output, stdout, err, stderr)
+			}
+			if strings.HasSuffix(stdout, "1\n") {
+				t.Fatalf("expected program not to run, got %q", stdout)
+			}
+		})
+	}
+	_, stderr, err := runGoAWK([]string{"-dump-ast=xml", `BEGIN {}`}, "")
+	expected := "invalid -dump-ast format \"xml\" (use -dump-ast or -dump-ast=json)\n"
+	if err == nil || stderr != expected {
+		t.Fatalf("expected error %q, got %v (%q)", expected, err, stderr)
+	}
+}
+
+func TestCompileFlag(t *testing.T) {
+	dir := t.TempDir()
+	compiled := filepath.Join(dir, "prog.awkc")
+	_, stderr, err := runGoAWK([]string{"-c", "testdata/parseerror/good.awk", "-o", compiled}, "")
+	if err != nil {
+		t.Fatalf("error compiling: %v (%q)", err, stderr)
+	}
+	for _, args := range [][]string{{compiled}, {"-f", compiled}} {
+		stdout, stderr, err := runGoAWK(append(args, "-"), "a b\nc d\n")
+		if err != nil || stdout != "a\nc\n" {
+			t.Fatalf("%v: expected \"a\\nc\\n\", got %q, %v (%q)", args, stdout, err, stderr)
+		}
+	}
+
+	// Bytecode from another version or that isn't bytecode
+	b, err := ioutil.ReadFile(compiled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstLine := string(b[:bytes.IndexByte(b, '\n')])
+	old := bytes.Replace(b, []byte(firstLine), []byte("# GoAWK bytecode v0.1.0"), 1)
+	err = ioutil.WriteFile(compiled, old, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, err = runGoAWK([]string{compiled}, "")
+	expected := compiled + ": compiled by GoAWK v0.1.0, recompile it to run with " +
+		strings.TrimPrefix(firstLine, "# GoAWK bytecode ") + "\n"
+	if err == nil || stderr != expected {
+		t.Fatalf("expected error %q, got %v (%q)", expected, err, stderr)
+	}
+	err = ioutil.WriteFile(compiled, []byte("{ print }\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, err = runGoAWK([]string{"-f", compiled}, "")
+	expected = compiled + ": not a GoAWK bytecode file\n"
+	if err == nil || stderr != expected {
+		t.Fatalf("expected error %q, got %v (%q)", expected, err, stderr)
+	}
+}
+
+func TestJobsFlag(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 1; i <= 5; i++ {
+		name := filepath.Join(dir, strconv.Itoa(i))
+		content := strings.Repeat(strconv.Itoa(i)+"\n", i*1000)
+		err := ioutil.WriteFile(name, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, name)
+	}
+	src := `{ s += $1 } END { print s, NR }`
+	args := append([]string{"-jobs", "3", src}, files...)
+	stdout, stderr, err := runGoAWK(args, "")
+	expected := "1000 1000\n4000 2000\n9000 3000\n16000 4000\n25000 5000\n"
+	if err != nil || stdout != expected {
+		t.Fatalf("expected %q, got %q, %v (%q)", expected, stdout, err, stderr)
+	}
+
+	args = append([]string{"-jobs=2", "-jobs-order=finish", src}, files...)
+	stdout, stderr, err = runGoAWK(args, "")
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	sort.Strings(lines)
+	if err != nil || strings.Join(lines, "\n")+"\n" != "1000 1000\n16000 4000\n25000 5000\n4000 2000\n9000 3000\n" {
+		t.Fatalf("expected each file's output, got %q, %v (%q)", stdout, err, stderr)
+	}
+
+	// Exit status is the first non-zero one in argument order
+	args = append([]string{"-jobs", "2", `NR == 1 && $1 >= 3 { exit $1 }`}, files...)
+	_, _, err = runGoAWK(args, "")
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 3 {
+		t.Fatalf("expected exit status 3, got %v", err)
+	}
+
+	_, stderr, err = runGoAWK([]string{"-jobs", "2", src, "x=1", files[0]}, "")
+	expected = "-jobs input files can't include - or name=value assignments\n"
+	if err == nil || stderr != expected {
+		t.Fatalf("expected error %q, got %v (%q)", expected, err, stderr)
+	}
+}
+
+func TestPOSIXFlag(t *testing.T) {
+	_, stderr, err := runGoAWK([]string{"-posix", `BEGIN { print 2**3 }`}, "")
+	expected := "<cmdline>:1:16: ** operator isn't in POSIX AWK (use ^)\n" +
+		"BEGIN { print 2**3 }\n" +
+		"               ^\n"
+	if err == nil || stderr != expected {
+		t.Fatalf("expected error %q, got %v (%q)", expected, err, stderr)
+	}
+	stdout, stderr, err := runGoAWK([]string{"-posix", `BEGIN { print 2^3 }`}, "")
+	if err != nil || stdout != "8\n" {
+		t.Fatalf("expected 8, got %q, %v (%q)", stdout, err, stderr)
+	}
+}
+
+func TestNonDecimalFlag(t *testing.T) {
+	stdout, stderr, err := runGoAWK([]string{"-non-decimal", `{ print $1+0, 0x1A, 0o17 }`}, "0x10\n")
+	if err != nil || stdout != "16 26 15\n" {
+		t.Fatalf("expected \"16 26 15\", got %q, %v (%q)", stdout, err, stderr)
+	}
+	stdout, stderr, err = runGoAWK([]string{`{ print $1+0 }`}, "0x10\n")
+	if err != nil || stdout != "0\n" {
+		t.Fatalf("expected 0, got %q, %v (%q)", stdout, err, stderr)
+	}
+}
+
+func TestPOSIXNumbersFlag(t *testing.T) {
+	src := `{ print $1+0, ($1 < $2), ($3 < $2) }`
+	input := "0x1A 9 10\n"
+	stdout, stderr, err := runGoAWK([]string{"-posix-numbers", src}, input)
+	if err != nil || stdout != "26 0 0\n" {
+		t.Fatalf("expected \"26 0 0\", got %q, %v (%q)", stdout, err, stderr)
+	}
+	stdout, stderr, err = runGoAWK([]string{src}, input)
+	if err != nil || stdout != "0 1 0\n" {
+		t.Fatalf("expected \"0 1 0\", got %q, %v (%q)", stdout, err, stderr)
+	}
+	stdout, stderr, err = runGoAWK([]string{"-posix-numbers", "-non-decimal", src}, "0o17 9 10\n")
+	if err != nil || stdout != "15 0 0\n" {
+		t.Fatalf("expected \"15 0 0\", got %q, %v (%q)", stdout, err, stderr)
+	}
+}
+
+func TestUseLocaleNumericFlag(t *testing.T) {
+	tests := []struct {
+		env    []string
+		output string
+	}{
+		{[]string{"LANG=de_DE.UTF-8"}, "4,64 0,5\n"},
+		{[]string{"LANG=en_US.UTF-8", "LC_NUMERIC=fr_FR"}, "4,64 0,5\n"},
+		{[]string{"LC_ALL=C", "LC_NUMERIC=fr_FR"}, "4 0.5\n"},
+		{[]string{"LANG=de_CH.UTF-8"}, "4 0.5\n"},
+		{nil, "4 0.5\n"},
+	}
+	for _, test := range tests {
+		cmd := exec.Command(goAWKExe, "-use-lc-numeric", `{ print $1 + $2, 1/2 }`)
+		cmd.Env = test.env
+		cmd.Stdin = strings.NewReader("3,14 1,5\n")
+		output, err := cmd.Output()
+		if err != nil || string(normalizeNewlines(output)) != test.output {
+			t.Errorf("%v: expected %q, got %q, %v", test.env, test.output, output, err)
+		}
+	}
+}
+
+func TestOrderedArraysFlag(t *testing.T) {
+	src := `{ n[$1]++ } END { for (k in n) print k, n[k] }`
+	stdout, stderr, err := runGoAWK([]string{"-ordered-arrays", src}, "b\nc\na\nc\n")
+	if err != nil || stdout != "b 1\nc 2\na 1\n" {
+		t.Fatalf("expected \"b 1\\nc 2\\na 1\\n\", got %q, %v (%q)", stdout, err, stderr)
+	}
+}
+
+func TestGCFlags(t *testing.T) {
+	tests := []struct {
+		args   []string
+		output string
+		error  string
+	}{
+		{[]string{"-gcpercent", "400", "-memlimit", "1G", "-ballast=16MiB"}, "3\n", ""},
+		{[]string{"-gcpercent=-1", "-memlimit=512M"}, "3\n", ""},
+		{[]string{"-memlimit", "1X"}, "", "invalid -memlimit size \"1X\"\n"},
+		{[]string{"-ballast", "-1K"}, "", "invalid -ballast size \"-1K\"\n"},
+		{[]string{"-gcpercent", "lots"}, "", "invalid -gcpercent value \"lots\"\n"},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			args := append(test.args, `{ n += $1 } END { print n }`)
+			stdout, stderr, err := runGoAWK(args, "1\n2\n")
+			if test.error != "" {
+				if err == nil || stderr != test.error {
+					t.Fatalf("expected error %q, got %v (%q)", test.error, err, stderr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v (%q)", err, stderr)
+			}
+			if stdout != test.output {
+				t.Fatalf("expected %q, got %q", test.output, stdout)
+			}
+		})
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goawk-coverage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lib := filepath.Join(dir, "lib.awk")
+	main := filepath.Join(dir, "main.awk")
+	err = ioutil.WriteFile(lib, []byte("function f(x) {\n\treturn x * 2\n}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(main, []byte("{ print f($1) }\nEND { exit 3 }"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := filepath.Join(dir, "cover.lcov")
+	listing := filepath.Join(dir, "cover.txt")
+
+	cmd := exec.Command(goAWKExe, "-coverprofile", profile, "-coverlisting="+listing, "-f", lib, "-f", main)
+	cmd.Stdin = strings.NewReader("1\n2\n")
+	output, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 3 {
+		t.Fatalf("expected exit status 3, got %v", err)
+	}
+	if string(normalizeNewlines(output)) != "2\n4\n" {
+		t.Fatalf("expected %q, got %q", "2\n4\n", output)
+	}
+
+	b, err := ioutil.ReadFile(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "TN:\nSF:" + lib + "\nDA:2,2\nLF:1\nLH:1\nend_of_record\n" +
+		"TN:\nSF:" + main + "\nDA:1,2\nDA:2,1\nLF:2\nLH:2\nend_of_record\n"
+	if string(b) != expected {
+		t.Fatalf("expected LCOV:\n%s\ngot:\n%s", expected, b)
+	}
+
+	b, err = ioutil.ReadFile(listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `        -:    1:function f(x) {
+        2:    2:	return x * 2
+        -:    3:}
+        -:    4:
+        2:    5:{ print f($1) }
+        1:    6:END { exit 3 }
+`
+	if string(b) != expected {
+		t.Fatalf("expected listing:\n%s\ngot:\n%s", expected, b)
+	}
+}
+
 func runGoAWK(args []string, stdin string) (stdout, stderr string, err error) {
 	cmd := exec.Command(goAWKExe, args...)
 	if stdin != "" {
@@ -0,0 +1,756 @@
+// Assembles text in the disassembler's format back into a program
+
+package compiler
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/benhoyt/goawk/ast"
+	"github.com/benhoyt/goawk/lexer"
+)
+
+// Assemble parses instructions in the text format written by Disassemble
+// and returns the program they describe. This allows testing the virtual
+// machine in isolation, or editing the instructions of a compiled
+// program by hand. nativeFuncNames are the names of the native Go
+// functions CallNative may refer to, sorted by name (the order the
+// interpreter indexes Config.Funcs in).
+//
+// The addresses at the start of each instruction line must be correct,
+// as jump targets refer to them. The text doesn't include source
+// positions, so the program doesn't have any. Constants are stored at
+// the index given in parentheses, for example "Num 1 (0)". Lines
+// starting with "#" are comments, like the source lines written by
+// DisassembleSource.
+func Assemble(r io.Reader, nativeFuncNames []string) (prog *Program, err error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		// The assembler uses panic with an *assembleError to signal
+		// errors, like the compiler does (which opcodeInt may raise).
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case *assembleError:
+				err = e
+			case *compileError:
+				err = e
+			default:
+				panic(r)
+			}
+		}
+	}()
+
+	a := &assembler{
+		program:  &Program{nativeFuncNames: nativeFuncNames},
+		funcs:    make(map[string]int),
+		scalars:  make(map[string]int),
+		arrays:   make(map[string]int),
+		natives:  make(map[string]int),
+		numSet:   make(map[int]bool),
+		strSet:   make(map[int]bool),
+		regexSet: make(map[int]bool),
+	}
+	for i, name := range nativeFuncNames {
+		a.natives[name] = i
+	}
+	// The interpreter looks these up by name, so they always exist.
+	a.globalArray("ARGV")
+	a.globalArray("ENVIRON")
+
+	lines := strings.Split(string(src), "\n")
+	a.numLines = len(lines)
+	a.functions(lines)
+	a.blocks(lines)
+	return a.program, nil
+}
+
+// assembleError is the error type returned by Assemble for invalid input.
+type assembleError struct {
+	line    int
+	message string
+}
+
+func (e *assembleError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.message)
+}
+
+// Assembler state
+type assembler struct {
+	program  *Program
+	line     int // current line number, for errors
+	numLines int // number of lines in the input (bounds constant indexes)
+
+	funcs    map[string]int // function indexes by name
+	scalars  map[string]int // global scalar indexes by name
+	arrays   map[string]int // global array indexes by name
+	natives  map[string]int // native function indexes by name
+	numSet   map[int]bool   // Nums indexes that have been set
+	strSet   map[int]bool   // Strs indexes that have been set
+	regexSet map[int]bool   // Regexes indexes that have been set
+
+	// Block being assembled
+	code     []Opcode
+	starts   map[int]bool // addresses instructions start at
+	jumps    []jumpTarget // jumps whose targets need checking
+	function *Function    // function being assembled, or nil
+	store    func([]Opcode)
+}
+
+type jumpTarget struct {
+	line   int
+	target int
+}
+
+// Panic with an *assembleError for the current line.
+func (a *assembler) errorf(format string, args ...interface{}) {
+	panic(&assembleError{a.line, fmt.Sprintf(format, args...)})
+}
+
+// Define all the functions first, so that calls can refer to functions
+// defined later on.
+func (a *assembler) functions(lines []string) {
+	for i, line := range lines {
+		a.line = i + 1
+		header, ok := blockHeader(line)
+		if !ok || !strings.HasPrefix(header, "function ") {
+			continue
+		}
+		header = strings.TrimSpace(header[len("function "):])
+		name, paramList := header, ""
+		if open := strings.IndexByte(header, '('); open >= 0 {
+			if !strings.HasSuffix(header, ")") {
+				a.errorf("expected ) at end of function header")
+			}
+			name, paramList = header[:open], header[open+1:len(header)-1]
+		}
+		if name == "" {
+			a.errorf("expected function name")
+		}
+		if _, ok := a.funcs[name]; ok {
+			a.errorf("function %q defined more than once", name)
+		}
+		f := Function{Name: name}
+		if strings.TrimSpace(paramList) != "" {
+			for _, param := range strings.Split(paramList, ",") {
+				param = strings.TrimSpace(param)
+				isArray := strings.HasSuffix(param, "[]")
+				if isArray {
+					param = param[:len(param)-2]
+					f.NumArrays++
+				} else {
+					f.NumScalars++
+				}
+				if param == "" {
+					a.errorf("expected parameter name")
+				}
+				f.Params = append(f.Params, param)
+				f.Arrays = append(f.Arrays, isArray)
+			}
+		}
+		a.funcs[name] = len(a.program.Functions)
+		a.program.Functions = append(a.program.Functions, f)
+	}
+}
+
+// Assemble the code in each block, storing it in the program.
+func (a *assembler) blocks(lines []string) {
+	p := a.program
+	prevHeader := ""
+	funcIndex := 0
+	for i, line := range lines {
+		a.line = i + 1
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		header, ok := blockHeader(line)
+		if !ok {
+			if a.store == nil {
+				a.errorf("expected block header like \"// BEGIN\" before instructions")
+			}
+			a.instruction(line)
+			continue
+		}
+
+		a.endBlock()
+		a.function = nil
+		switch {
+		case header == "BEGIN":
+			if p.Begin != nil {
+				a.errorf("more than one BEGIN block")
+			}
+			a.store = func(code []Opcode) { p.Begin = append([]Opcode{}, code...) }
+		case header == "END":
+			if p.End != nil {
+				a.errorf("more than one END block")
+			}
+			a.store = func(code []Opcode) { p.End = append([]Opcode{}, code...) }
+		case header == "pattern" || header == "start":
+			p.Actions = append(p.Actions, Action{})
+			action := &p.Actions[len(p.Actions)-1]
+			a.store = func(code []Opcode) {
+				action.Pattern = [][]Opcode{code}
+				action.PatternPos = make([][]SourcePos, 1)
+			}
+		case header == "stop":
+			if prevHeader != "start" {
+				a.errorf("stop block must follow start block")
+			}
+			action := &p.Actions[len(p.Actions)-1]
+			a.store = func(code []Opcode) {
+				action.Pattern = append(action.Pattern, code)
+				action.PatternPos = append(action.PatternPos, nil)
+			}
+		case header == "{ body }":
+			if prevHeader != "pattern" && prevHeader != "stop" {
+				p.Actions = append(p.Actions, Action{})
+			}
+			action := &p.Actions[len(p.Actions)-1]
+			a.store = func(code []Opcode) { action.Body = code }
+		case strings.HasPrefix(header, "function "):
+			// Already defined by a.functions, in the same order
+			f := &p.Functions[funcIndex]
+			funcIndex++
+			a.function = f
+			a.store = func(code []Opcode) { f.Body = code }
+		default:
+			a.errorf("unknown block header %q", header)
+		}
+		prevHeader = header
+	}
+	a.line = len(lines)
+	a.endBlock()
+}
+
+// Finish the current block: check its jump targets and store its code.
+func (a *assembler) endBlock() {
+	if a.store == nil {
+		return
+	}
+	for _, jump := range a.jumps {
+		if !a.starts[jump.target] && jump.target != len(a.code) {
+			a.line = jump.line
+			a.errorf("jump target 0x%04x isn't the start of an instruction", jump.target)
+		}
+	}
+	a.store(a.code)
+	a.code = nil
+	a.starts = nil
+	a.jumps = nil
+	a.store = nil
+}
+
+// If line is a block header like "        // BEGIN", return the part
+// after the "//" and true, otherwise return false.
+func blockHeader(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "//") {
+		return "", false
+	}
+	return strings.TrimSpace(line[2:]), true
+}
+
+// Split s into its first space-separated word and the rest.
+func splitWord(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i+1:])
+}
+
+var (
+	opcodeNames    = make(map[string]Opcode)
+	augOpNames     = make(map[string]AugOp)
+	builtinOpNames = make(map[string]BuiltinOp)
+	redirectNames  = make(map[string]lexer.Token)
+)
+
+func init() {
+	for op := Nop; op < EndOpcode; op++ {
+		opcodeNames[op.String()] = op
+	}
+	for op := AugOp(0); int(op) < len(_AugOp_index)-1; op++ {
+		augOpNames[op.String()] = op
+	}
+	for op := BuiltinOp(0); int(op) < len(_BuiltinOp_index)-1; op++ {
+		builtinOpNames[op.String()] = op
+	}
+	for _, tok := range []lexer.Token{lexer.ILLEGAL, lexer.GREATER, lexer.APPEND, lexer.PIPE, lexer.LESS} {
+		redirectNames[tok.String()] = tok
+	}
+}
+
+// Assemble a single instruction line, like "0002    AssignGlobal x".
+func (a *assembler) instruction(line string) {
+	addrStr, text := splitWord(line)
+	addr, err := strconv.ParseUint(addrStr, 16, 32)
+	if err != nil {
+		a.errorf("invalid address %q", addrStr)
+	}
+	if int(addr) != len(a.code) {
+		a.errorf("address 0x%04x should be 0x%04x", addr, len(a.code))
+	}
+	name, args := splitWord(text)
+	op, ok := opcodeNames[name]
+	if !ok {
+		a.errorf("unknown opcode %q", name)
+	}
+	if a.starts == nil {
+		a.starts = make(map[int]bool)
+	}
+	a.starts[len(a.code)] = true
+	a.add(op)
+
+	kinds := operands[baseOpcode(op)]
+	var words []string
+	switch n := len(kinds); {
+	case n > 0 && kinds[n-1].restOfLine():
+		// Constants, lists, and jump tables can contain spaces, so
+		// the last operand is the rest of the line
+		for len(words) < n-1 {
+			var word string
+			word, args = splitWord(args)
+			words = append(words, word)
+		}
+		words = append(words, args)
+	case n > 0 && kinds[n-1] == optRedirectOperand:
+		words = strings.Fields(args)
+		if len(words) != n-1 && len(words) != n {
+			a.errorf("%s expects %d or %d arguments", op, n-1, n)
+		}
+	default:
+		words = a.fields(args, n)
+	}
+	for i, kind := range kinds {
+		if i < len(words) {
+			a.operand(op, kind, words[i])
+		} else {
+			a.add(Opcode(lexer.ILLEGAL)) // omitted redirect
+		}
+	}
+}
+
+// Report whether the text of an operand of this kind is the rest of the
+// instruction line.
+func (k operandKind) restOfLine() bool {
+	switch k {
+	case numOperand, strOperand, regexOperand, switchOperand, arrayListOperand, fieldListOperand:
+		return true
+	default:
+		return false
+	}
+}
+
+// Assemble the operand s of the given kind for instruction op.
+func (a *assembler) operand(op Opcode, kind operandKind, s string) {
+	switch kind {
+	case numOperand:
+		a.add(opcodeInt(a.num(s)))
+
+	case strOperand:
+		value, index := a.constant(s)
+		str := a.unquote(value)
+		for len(a.program.Strs) <= index {
+			a.program.Strs = append(a.program.Strs, "")
+		}
+		old := a.program.Strs[index]
+		if a.strSet[index] && old != str {
+			a.errorf("string index %d already used for %q", index, old)
+		}
+		a.program.Strs[index] = str
+		a.strSet[index] = true
+		a.add(opcodeInt(index))
+
+	case regexOperand:
+		value, index := a.constant(s)
+		str := a.unquote(value)
+		re, err := regexp.Compile(str)
+		if err != nil {
+			a.errorf("invalid regex %q: %v", str, err)
+		}
+		for len(a.program.Regexes) <= index {
+			a.program.Regexes = append(a.program.Regexes, nil)
+		}
+		old := a.program.Regexes[index]
+		if a.regexSet[index] && old.String() != str {
+			a.errorf("regex index %d already used for %q", index, old)
+		}
+		a.program.Regexes[index] = re
+		a.regexSet[index] = true
+		a.add(opcodeInt(index))
+
+	case intOperand:
+		a.add(opcodeInt(a.int(s)))
+
+	case globalOperand:
+		a.add(opcodeInt(a.global(s)))
+
+	case localOperand:
+		a.add(opcodeInt(a.local(s)))
+
+	case specialOperand:
+		a.add(opcodeInt(a.special(s)))
+
+	case globalArrayOperand:
+		a.add(opcodeInt(a.globalArray(s)))
+
+	case localArrayOperand:
+		a.add(opcodeInt(a.localArray(s)))
+
+	case scalarOperand:
+		scope, index := a.scalar(s)
+		a.add(Opcode(scope), opcodeInt(index))
+
+	case arrayOperand:
+		scope, index := a.array(s)
+		a.add(Opcode(scope), opcodeInt(index))
+
+	case augOpOperand:
+		a.add(Opcode(a.augOp(s)))
+
+	case compareOperand:
+		compareOp, ok := opcodeNames[s]
+		if !ok || compareOp < Equals || compareOp > GreaterOrEqual {
+			a.errorf("unknown comparison %q", s)
+		}
+		a.add(compareOp)
+
+	case jumpOperand:
+		a.jump(s)
+
+	case switchOperand:
+		a.add(opcodeInt(len(a.program.JumpTables)))
+		a.program.JumpTables = append(a.program.JumpTables, a.jumpTable(s))
+
+	case builtinOperand:
+		builtinOp, ok := builtinOpNames[s]
+		if !ok {
+			a.errorf("unknown builtin %q", s)
+		}
+		a.add(Opcode(builtinOp))
+
+	case funcOperand:
+		funcIndex, ok := a.funcs[s]
+		if !ok {
+			a.errorf("undefined function %q", s)
+		}
+		a.add(opcodeInt(funcIndex))
+
+	case nativeOperand:
+		funcIndex, ok := a.natives[s]
+		if !ok {
+			a.errorf("undefined native function %q", s)
+		}
+		a.add(opcodeInt(funcIndex))
+
+	case redirectOperand, optRedirectOperand:
+		a.add(Opcode(a.redirect(s)))
+
+	case coverOperand:
+		// Source positions aren't in the text format, so just make room
+		// for the counter.
+		index := a.int(s)
+		if index < 0 || index >= a.numLines {
+			a.errorf("invalid cover index %d", index)
+		}
+		for len(a.program.CoverPos) <= index {
+			a.program.CoverPos = append(a.program.CoverPos, lexer.Position{})
+		}
+		a.add(opcodeInt(index))
+
+	case arrayListOperand:
+		if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+			a.errorf("expected array arguments like [a, b] after function name")
+		}
+		var arrayArgs []string
+		if list := strings.TrimSpace(s[1 : len(s)-1]); list != "" {
+			arrayArgs = strings.Split(list, ",")
+		}
+		a.add(opcodeInt(len(arrayArgs)))
+		for _, arg := range arrayArgs {
+			scope, index := a.array(strings.TrimSpace(arg))
+			a.add(Opcode(scope), opcodeInt(index))
+		}
+
+	case fieldListOperand:
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			a.errorf("%s expects at least 1 field index", op)
+		}
+		a.add(opcodeInt(len(fields)))
+		for _, field := range fields {
+			a.add(opcodeInt(a.int(field)))
+		}
+	}
+}
+
+// Add opcodes (and their arguments) to the current block.
+func (a *assembler) add(ops ...Opcode) {
+	a.code = append(a.code, ops...)
+}
+
+// Add a jump offset to the absolute target address s, like "0x001a".
+func (a *assembler) jump(s string) {
+	target := a.target(s)
+	a.add(opcodeInt(target - (len(a.code) + 1)))
+}
+
+// Parse the absolute jump target address s and record it for checking
+// at the end of the block.
+func (a *assembler) target(s string) int {
+	target, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 32)
+	if err != nil || !strings.HasPrefix(s, "0x") {
+		a.errorf("invalid jump target %q", s)
+	}
+	a.jumps = append(a.jumps, jumpTarget{a.line, int(target)})
+	return int(target)
+}
+
+// Parse the key:target pairs of a Switch instruction (see
+// disassembler.jumpTable), whose code ends at the current address.
+func (a *assembler) jumpTable(args string) JumpTable {
+	table := JumpTable{Strs: make(map[string]int)}
+	end := len(a.code)
+	hasDefault, hasStrs := false, false
+	for rest := strings.TrimSpace(args); rest != ""; {
+		var key string
+		if rest[0] == '"' {
+			n := quotedLen(rest)
+			if n < 0 {
+				a.errorf("invalid quoted string %s", rest)
+			}
+			key, rest = rest[:n], rest[n:]
+		} else {
+			i := strings.IndexByte(rest, ':')
+			if i < 0 {
+				a.errorf("expected key:target, got %q", rest)
+			}
+			key, rest = rest[:i], rest[i:]
+		}
+		if !strings.HasPrefix(rest, ":") {
+			a.errorf("expected : after key %s", key)
+		}
+		var targetStr string
+		targetStr, rest = splitWord(rest[1:])
+		offset := a.target(targetStr) - end
+
+		switch {
+		case key == "default":
+			table.Default = offset
+			hasDefault = true
+		case key[0] == '"':
+			s := a.unquote(key)
+			if _, ok := table.Strs[s]; ok {
+				a.errorf("duplicate key %s", key)
+			}
+			table.Strs[s] = offset
+			hasStrs = true
+		default:
+			n, err := strconv.ParseInt(key, 10, 64)
+			if err != nil || n >= 1<<53 || n <= -1<<53 {
+				a.errorf("invalid integer key %q", key)
+			}
+			if table.Nums == nil {
+				table.Nums = make(map[float64]int)
+			}
+			if _, ok := table.Nums[float64(n)]; ok {
+				a.errorf("duplicate key %s", key)
+			}
+			table.Nums[float64(n)] = offset
+			table.Strs[strconv.FormatInt(n, 10)] = offset
+		}
+	}
+	if hasStrs && table.Nums != nil {
+		a.errorf("can't mix string and integer keys")
+	}
+	if !hasDefault {
+		a.errorf("expected default:target")
+	}
+	return table
+}
+
+// Return the length of the double-quoted string at the start of s,
+// or -1 if it doesn't start with one.
+func quotedLen(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// Split args into exactly n space-separated fields.
+func (a *assembler) fields(args string, n int) []string {
+	fields := strings.Fields(args)
+	if len(fields) != n {
+		a.errorf("expected %d argument(s), got %d", n, len(fields))
+	}
+	return fields
+}
+
+// Parse a number constant with its index, like "1.5 (3)", store it in
+// the program's numbers, and return the index.
+func (a *assembler) num(args string) int {
+	value, index := a.constant(args)
+	num, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		a.errorf("invalid number %q", value)
+	}
+	for len(a.program.Nums) <= index {
+		a.program.Nums = append(a.program.Nums, 0)
+	}
+	old := a.program.Nums[index]
+	if a.numSet[index] && math.Float64bits(old) != math.Float64bits(num) {
+		a.errorf("number index %d already used for %v", index, old)
+	}
+	a.program.Nums[index] = num
+	a.numSet[index] = true
+	return index
+}
+
+// Parse constant arguments like `"foo" (3)` into value and index. Each
+// instruction refers to at most one constant, so an index can't be more
+// than the number of lines (which stops a huge index from allocating
+// a huge table).
+func (a *assembler) constant(args string) (string, int) {
+	i := strings.LastIndex(args, " (")
+	if i < 0 || !strings.HasSuffix(args, ")") {
+		a.errorf("expected value and (index)")
+	}
+	index := a.int(args[i+2 : len(args)-1])
+	if index < 0 || index >= a.numLines {
+		a.errorf("invalid constant index %d", index)
+	}
+	return strings.TrimSpace(args[:i]), index
+}
+
+func (a *assembler) int(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		a.errorf("invalid integer %q", s)
+	}
+	return n
+}
+
+func (a *assembler) unquote(s string) string {
+	str, err := strconv.Unquote(s)
+	if err != nil {
+		a.errorf("invalid quoted string %s", s)
+	}
+	return str
+}
+
+func (a *assembler) augOp(s string) AugOp {
+	op, ok := augOpNames[s]
+	if !ok {
+		a.errorf("unknown augmented assignment operation %q", s)
+	}
+	return op
+}
+
+func (a *assembler) redirect(s string) lexer.Token {
+	tok, ok := redirectNames[s]
+	if !ok {
+		a.errorf("unknown redirect %q", s)
+	}
+	return tok
+}
+
+// Return the index of global scalar name, adding it if it's new.
+func (a *assembler) global(name string) int {
+	index, ok := a.scalars[name]
+	if !ok {
+		index = len(a.program.scalarNames)
+		a.scalars[name] = index
+		a.program.scalarNames = append(a.program.scalarNames, name)
+	}
+	return index
+}
+
+// Return the index of global array name, adding it if it's new.
+func (a *assembler) globalArray(name string) int {
+	index, ok := a.arrays[name]
+	if !ok {
+		index = len(a.program.arrayNames)
+		a.arrays[name] = index
+		a.program.arrayNames = append(a.program.arrayNames, name)
+	}
+	return index
+}
+
+func (a *assembler) special(name string) int {
+	index := ast.SpecialVarIndex(name)
+	if index <= 0 {
+		a.errorf("unknown special variable %q", name)
+	}
+	return index
+}
+
+// Return the index of the current function's local scalar or array
+// name, and whether it was found.
+func (a *assembler) findLocal(name string, isArray bool) (int, bool) {
+	if a.function == nil {
+		return 0, false
+	}
+	n := 0
+	for i, param := range a.function.Params {
+		if a.function.Arrays[i] != isArray {
+			continue
+		}
+		if param == name {
+			return n, true
+		}
+		n++
+	}
+	return 0, false
+}
+
+func (a *assembler) local(name string) int {
+	index, ok := a.findLocal(name, false)
+	if !ok {
+		a.errorf("%q isn't a scalar parameter of the current function", name)
+	}
+	return index
+}
+
+func (a *assembler) localArray(name string) int {
+	index, ok := a.findLocal(name, true)
+	if !ok {
+		a.errorf("%q isn't an array parameter of the current function", name)
+	}
+	return index
+}
+
+// Resolve scalar name, which may be special, local, or global.
+func (a *assembler) scalar(name string) (ast.VarScope, int) {
+	if index := ast.SpecialVarIndex(name); index > 0 {
+		return ast.ScopeSpecial, index
+	}
+	if index, ok := a.findLocal(name, false); ok {
+		return ast.ScopeLocal, index
+	}
+	return ast.ScopeGlobal, a.global(name)
+}
+
+// Resolve array name: parameters shadow globals, as in AWK.
+func (a *assembler) array(name string) (ast.VarScope, int) {
+	if index, ok := a.findLocal(name, true); ok {
+		return ast.ScopeLocal, index
+	}
+	return ast.ScopeGlobal, a.globalArray(name)
+}
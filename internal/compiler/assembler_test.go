@@ -0,0 +1,130 @@
+package compiler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAssemble(t *testing.T) {
+	// Not in canonical form: missing header indent, extra spaces, and
+	// constant indexes out of order.
+	src := `
+// BEGIN
+0000  Num 0.1 (1)
+0002  AssignGlobal x
+0004  Str "a \"b\"" (0)
+0006  Global x
+0008  Num 2 (0)
+000a  CallUser f [arr]
+000f  Print 2 >>
+
+        // { body }
+0000    FieldInt 1
+0002    Regex "^x" (0)
+0004    JumpFalse 0x0008
+0006    Next
+0007    Nop
+
+        // function f(a, arr[], b)
+0000    Local a
+0002    AssignArrayLocal arr
+0004    IncrLocal 1 b
+0007    ForIn k arr 0x000d
+000d    Local b
+000f    Return
+`
+	expected := `        // BEGIN
+0000    Num 0.1 (1)
+0002    AssignGlobal x
+0004    Str "a \"b\"" (0)
+0006    Global x
+0008    Num 2 (0)
+000a    CallUser f [arr]
+000f    Print 2 >>
+
+        // { body }
+0000    FieldInt 1
+0002    Regex "^x" (0)
+0004    JumpFalse 0x0008
+0006    Next
+0007    Nop
+
+        // function f(a, arr[], b)
+0000    Local a
+0002    AssignArrayLocal arr
+0004    IncrLocal 1 b
+0007    ForIn k arr 0x000d
+000d    Local b
+000f    Return
+
+`
+	prog, err := Assemble(strings.NewReader(src), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = prog.Disassemble(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+	if len(prog.Nums) != 2 || prog.Nums[0] != 2 || prog.Nums[1] != 0.1 {
+		t.Fatalf("expected Nums [2 0.1], got %v", prog.Nums)
+	}
+	if offset := prog.Actions[0].Body[5]; offset != 2 {
+		t.Fatalf("expected JumpFalse offset 2, got %d", offset)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"0000    Nop", `line 1: expected block header like "// BEGIN" before instructions`},
+		{"// BEEGIN", `line 1: unknown block header "BEEGIN"`},
+		{"// BEGIN\n0000    Foo", `line 2: unknown opcode "Foo"`},
+		{"// BEGIN\n0000    Nop\n0002    Nop", `line 3: address 0x0002 should be 0x0001`},
+		{"// BEGIN\nxyz    Nop", `line 2: invalid address "xyz"`},
+		{"// BEGIN\n0000    Nop 1", `line 2: expected 0 argument(s), got 1`},
+		{"// BEGIN\n0000    Num x (0)", `line 2: invalid number "x"`},
+		{"// BEGIN\n0000    Num 1", `line 2: expected value and (index)`},
+		{"// BEGIN\n0000    Num 1 (0)\n0002    Num 2 (0)", `line 3: number index 0 already used for 1`},
+		{"// BEGIN\n0000    Str foo (0)", `line 2: invalid quoted string foo`},
+		{"// BEGIN\n0000    Str \"hi\" (-1)", `line 2: invalid constant index -1`},
+		{"// BEGIN\n0000    Regex \"x\" (9999999999)", `line 2: invalid constant index 9999999999`},
+		{"// BEGIN\n0000    Num 1 (2)", `line 2: invalid constant index 2`},
+		{"// BEGIN\n0000    Cover 5", `line 2: invalid cover index 5`},
+		{"// BEGIN\n0000    Regex \"(\" (0)", "line 2: invalid regex \"(\": error parsing regexp: missing closing ): `(`"},
+		{"// BEGIN\n0000    Jump 0x0001", `line 2: jump target 0x0001 isn't the start of an instruction`},
+		{"// BEGIN\n0000    Jump 12", `line 2: invalid jump target "12"`},
+		{"// BEGIN\n0000    FieldInt 1\n0002    Switch \"a\":0x0004", `line 3: expected default:target`},
+		{"// BEGIN\n0000    FieldInt 1\n0002    Switch \"a\":0x0004 1:0x0004 default:0x0004", `line 3: can't mix string and integer keys`},
+		{"// BEGIN\n0000    FieldInt 1\n0002    Switch 1.5:0x0004 default:0x0004", `line 3: invalid integer key "1.5"`},
+		{"// BEGIN\n0000    FieldInt 1\n0002    Switch \"a\":0x0004 \"a\":0x0004 default:0x0004", `line 3: duplicate key "a"`},
+		{"// BEGIN\n0000    FieldInt 1\n0002    Switch \"a:0x0004", `line 3: invalid quoted string "a:0x0004`},
+		{"// BEGIN\n0000    Local x", `line 2: "x" isn't a scalar parameter of the current function`},
+		{"// function f(a[])\n0000    Local a", `line 2: "a" isn't a scalar parameter of the current function`},
+		{"// BEGIN\n0000    Special FOO", `line 2: unknown special variable "FOO"`},
+		{"// BEGIN\n0000    CallUser g []", `line 2: undefined function "g"`},
+		{"// BEGIN\n0000    CallNative g 0", `line 2: undefined native function "g"`},
+		{"// BEGIN\n0000    CallBuiltin Foo", `line 2: unknown builtin "Foo"`},
+		{"// BEGIN\n0000    AugAssignField Foo", `line 2: unknown augmented assignment operation "Foo"`},
+		{"// BEGIN\n0000    Print 1 <<", `line 2: unknown redirect "<<"`},
+		{"// BEGIN\n// BEGIN", `line 2: more than one BEGIN block`},
+		{"// pattern\n// stop", `line 2: stop block must follow start block`},
+		{"// function f(a\n", `line 1: expected ) at end of function header`},
+		{"// function f()\n// function f()", `line 2: function "f" defined more than once`},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			_, err := Assemble(strings.NewReader(test.src), nil)
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -5,11 +5,16 @@ import (
 	"fmt"
 	"math"
 	"regexp"
+	"sort"
+	"strings"
 
-	"github.com/benhoyt/goawk/internal/ast"
+	"github.com/benhoyt/goawk/ast"
 	"github.com/benhoyt/goawk/lexer"
 )
 
+// Format used by strftime() and tzconvert() if none is given.
+const defaultTimeFormat = "%a %b %e %H:%M:%S %Z %Y"
+
 // Program holds an entire compiled program.
 type Program struct {
 	Begin     []Opcode
@@ -20,16 +25,75 @@ type Program struct {
 	Strs      []string
 	Regexes   []*regexp.Regexp
 
+	// Tables for the Switch instructions, indexed by their operand
+	JumpTables []JumpTable
+
+	// Source positions for the Begin and End code (see SourcePos)
+	BeginPos []SourcePos
+	EndPos   []SourcePos
+
+	// Warnings about user code that was eliminated because it can
+	// never run, for example statements after a "return".
+	Warnings []string
+
+	// Source positions of the statements and patterns counted by the
+	// Cover instruction, in source order and indexed by its operand.
+	// This is nil if not compiled with Options.Coverage.
+	CoverPos []lexer.Position
+
 	// For disassembly
 	scalarNames     []string
 	arrayNames      []string
 	nativeFuncNames []string
+
+	inlineBodies []ast.Expr // see inlineBodies()
+	inlined      bool       // whether any calls were inlined
+	types        *typeInfo
+	stmtPos      map[ast.Stmt]lexer.Position
+	coverIndex   map[lexer.Position]int
+}
+
+// Options holds options that change the code the compiler generates.
+type Options struct {
+	// Count how many times each statement and pattern runs, by
+	// emitting a Cover instruction at the start of each. This also
+	// disables function inlining and jump tables for if-else chains,
+	// so that the statements in function bodies and each "else if"
+	// are counted.
+	Coverage bool
+
+	// Don't inline calls to small functions, so that each call runs
+	// the function's own code (for counting calls when profiling).
+	NoInline bool
+}
+
+// HasInlinedCalls reports whether any calls to user-defined functions
+// were inlined (see Options.NoInline).
+func (p *Program) HasInlinedCalls() bool {
+	return p.inlined
+}
+
+// GlobalNames returns the names of the program's global scalars and
+// arrays, indexed by variable index.
+func (p *Program) GlobalNames() (scalars, arrays []string) {
+	return p.scalarNames, p.arrayNames
+}
+
+// SourcePos records that the instructions in a block of code starting
+// at address Addr (up to the next SourcePos) were compiled from the
+// statement or pattern at source position Pos. Each block's list of
+// these is in address order.
+type SourcePos struct {
+	Addr int
+	Pos  lexer.Position
 }
 
 // Action holds a compiled pattern-action block.
 type Action struct {
-	Pattern [][]Opcode
-	Body    []Opcode
+	Pattern    [][]Opcode
+	Body       []Opcode
+	PatternPos [][]SourcePos
+	BodyPos    []SourcePos
 }
 
 // Function holds a compiled function.
@@ -40,6 +104,60 @@ type Function struct {
 	NumScalars int
 	NumArrays  int
 	Body       []Opcode
+	BodyPos    []SourcePos
+}
+
+// Position returns the source position of the statement or pattern
+// that the instruction at code[addr] was compiled from, and whether
+// it's known. code must be one of the program's blocks of code, or part
+// of one (like the body of a ForIn).
+func (p *Program) Position(code []Opcode, addr int) (lexer.Position, bool) {
+	if len(code) == 0 {
+		return lexer.Position{}, false
+	}
+	find := func(block []Opcode, positions []SourcePos) (lexer.Position, bool) {
+		for offset := range block {
+			if &block[offset] != &code[0] {
+				continue
+			}
+			var pos lexer.Position
+			found := false
+			for _, sp := range positions {
+				if sp.Addr > offset+addr {
+					break
+				}
+				pos, found = sp.Pos, true
+			}
+			return pos, found
+		}
+		return lexer.Position{}, false
+	}
+	if pos, ok := find(p.Begin, p.BeginPos); ok {
+		return pos, true
+	}
+	for _, action := range p.Actions {
+		for i, pattern := range action.Pattern {
+			var positions []SourcePos
+			if i < len(action.PatternPos) {
+				positions = action.PatternPos[i]
+			}
+			if pos, ok := find(pattern, positions); ok {
+				return pos, true
+			}
+		}
+		if pos, ok := find(action.Body, action.BodyPos); ok {
+			return pos, true
+		}
+	}
+	if pos, ok := find(p.End, p.EndPos); ok {
+		return pos, true
+	}
+	for _, f := range p.Functions {
+		if pos, ok := find(f.Body, f.BodyPos); ok {
+			return pos, true
+		}
+	}
+	return lexer.Position{}, false
 }
 
 // compileError is the internal error type raised in the rare cases when
@@ -54,7 +172,7 @@ func (e *compileError) Error() string {
 }
 
 // Compile compiles an AST (parsed program) into virtual machine instructions.
-func Compile(prog *ast.Program) (compiledProg *Program, err error) {
+func Compile(prog *ast.Program, options Options) (compiledProg *Program, err error) {
 	defer func() {
 		// The compiler uses panic with a *compileError to signal compile
 		// errors internally, and they're caught here. This avoids the
@@ -65,11 +183,14 @@ func Compile(prog *ast.Program) (compiledProg *Program, err error) {
 		}
 	}()
 
-	p := &Program{}
+	p := &Program{stmtPos: prog.StmtPositions}
+	if options.Coverage {
+		p.initCoverage(prog)
+	}
 
 	// Reuse identical constants across entire program.
 	indexes := constantIndexes{
-		nums:    make(map[float64]int),
+		nums:    make(map[uint64]int),
 		strs:    make(map[string]int),
 		regexes: make(map[string]int),
 	}
@@ -94,46 +215,74 @@ func Compile(prog *ast.Program) (compiledProg *Program, err error) {
 		}
 		p.Functions[i] = compiledFunc
 	}
+	if !options.Coverage && !options.NoInline {
+		p.inlineBodies = inlineBodies(prog.Functions)
+	}
+	p.types = inferTypes(prog)
 	for i, astFunc := range prog.Functions {
-		c := &compiler{program: p, indexes: indexes}
+		c := &compiler{program: p, indexes: indexes, locals: p.types.locals[i], function: &p.Functions[i]}
 		c.stmts(astFunc.Body)
 		p.Functions[i].Body = c.finish()
+		p.Functions[i].BodyPos = c.positions
 	}
 
 	// Compile BEGIN blocks.
 	for _, stmts := range prog.Begin {
 		c := &compiler{program: p, indexes: indexes}
 		c.stmts(stmts)
+		p.BeginPos = appendPositions(p.BeginPos, c.positions, len(p.Begin))
 		p.Begin = append(p.Begin, c.finish()...)
 	}
 
 	// Compile pattern-action blocks.
 	for _, action := range prog.Actions {
 		var pattern [][]Opcode
+		var patternPos [][]SourcePos
 		switch len(action.Pattern) {
 		case 0:
 			// Always considered a match
 		case 1:
 			c := &compiler{program: p, indexes: indexes}
+			if b, ok := c.constBool(action.Pattern[0]); ok {
+				if !b {
+					p.warnf("pattern is always false: %s", action.Pattern[0])
+					continue
+				}
+				break // always true, same as no pattern
+			}
+			c.markPattern(prog, action.Pattern[0])
 			c.expr(action.Pattern[0])
 			pattern = [][]Opcode{c.finish()}
+			patternPos = [][]SourcePos{c.positions}
 		case 2:
 			c := &compiler{program: p, indexes: indexes}
+			if b, ok := c.constBool(action.Pattern[0]); ok && !b {
+				p.warnf("range pattern start is always false: %s", action.Pattern[0])
+				continue
+			}
+			c.markPattern(prog, action.Pattern[0])
 			c.expr(action.Pattern[0])
 			pattern = append(pattern, c.finish())
+			patternPos = append(patternPos, c.positions)
 			c = &compiler{program: p, indexes: indexes}
+			c.markPattern(prog, action.Pattern[1])
 			c.expr(action.Pattern[1])
 			pattern = append(pattern, c.finish())
+			patternPos = append(patternPos, c.positions)
 		}
 		var body []Opcode
+		var bodyPos []SourcePos
 		if len(action.Stmts) > 0 {
 			c := &compiler{program: p, indexes: indexes}
 			c.stmts(action.Stmts)
 			body = c.finish()
+			bodyPos = c.positions
 		}
 		p.Actions = append(p.Actions, Action{
-			Pattern: pattern,
-			Body:    body,
+			Pattern:    pattern,
+			Body:       body,
+			PatternPos: patternPos,
+			BodyPos:    bodyPos,
 		})
 	}
 
@@ -141,6 +290,7 @@ func Compile(prog *ast.Program) (compiledProg *Program, err error) {
 	for _, stmts := range prog.End {
 		c := &compiler{program: p, indexes: indexes}
 		c.stmts(stmts)
+		p.EndPos = appendPositions(p.EndPos, c.positions, len(p.End))
 		p.End = append(p.End, c.finish()...)
 	}
 
@@ -158,8 +308,10 @@ func Compile(prog *ast.Program) (compiledProg *Program, err error) {
 }
 
 // So we can look up the indexes of constants that have been used before.
+// Numbers are keyed by their bits, so that -0 and 0 are kept apart and NaN
+// (which isn't equal to itself) is only added once.
 type constantIndexes struct {
-	nums    map[float64]int
+	nums    map[uint64]int
 	strs    map[string]int
 	regexes map[string]int
 }
@@ -171,6 +323,73 @@ type compiler struct {
 	code      []Opcode
 	breaks    [][]int
 	continues [][]int
+	folded    map[ast.Expr]ast.Expr // memoized results of foldConst
+	locals    []bool                // numeric locals if compiling a function (see typeInfo)
+	function  *Function             // function being compiled, or nil
+	positions []SourcePos
+}
+
+// Record that the code emitted from now on comes from source position
+// pos.
+func (c *compiler) mark(pos lexer.Position) {
+	n := len(c.positions)
+	switch {
+	case n > 0 && c.positions[n-1].Addr == len(c.code):
+		// No code emitted since the last mark, replace it
+		c.positions[n-1].Pos = pos
+	case n > 0 && c.positions[n-1].Pos == pos:
+		// Same position, nothing to do
+	default:
+		c.positions = append(c.positions, SourcePos{len(c.code), pos})
+	}
+}
+
+// Mark the position of the given pattern expression, if known.
+func (c *compiler) markPattern(prog *ast.Program, pattern ast.Expr) {
+	if pos, ok := prog.PatternPositions[pattern]; ok {
+		c.mark(pos)
+		c.cover(pos)
+	}
+}
+
+// Set up CoverPos with the positions of all statements and patterns,
+// including ones that are never compiled because they can't run, so
+// that they're reported as not covered.
+func (p *Program) initCoverage(prog *ast.Program) {
+	p.CoverPos = []lexer.Position{}
+	for _, pos := range prog.StmtPositions {
+		p.CoverPos = append(p.CoverPos, pos)
+	}
+	for _, pos := range prog.PatternPositions {
+		p.CoverPos = append(p.CoverPos, pos)
+	}
+	sort.Slice(p.CoverPos, func(i, j int) bool {
+		if p.CoverPos[i].Line != p.CoverPos[j].Line {
+			return p.CoverPos[i].Line < p.CoverPos[j].Line
+		}
+		return p.CoverPos[i].Column < p.CoverPos[j].Column
+	})
+	p.coverIndex = make(map[lexer.Position]int, len(p.CoverPos))
+	for i, pos := range p.CoverPos {
+		p.coverIndex[pos] = i
+	}
+}
+
+// Emit a Cover instruction for the statement or pattern at pos, if
+// compiling with coverage.
+func (c *compiler) cover(pos lexer.Position) {
+	if index, ok := c.program.coverIndex[pos]; ok {
+		c.add(Cover, opcodeInt(index))
+	}
+}
+
+// Append positions to dest, offsetting their addresses by offset (for
+// when blocks of code are concatenated).
+func appendPositions(dest, positions []SourcePos, offset int) []SourcePos {
+	for _, p := range positions {
+		dest = append(dest, SourcePos{p.Addr + offset, p.Pos})
+	}
+	return dest
 }
 
 func (c *compiler) add(ops ...Opcode) {
@@ -178,16 +397,64 @@ func (c *compiler) add(ops ...Opcode) {
 }
 
 func (c *compiler) finish() []Opcode {
+	threadJumps(c.code)
+	markSuperinstructions(c.code)
+	markCachedNF(c.code, c.program.JumpTables)
 	return c.code
 }
 
 func (c *compiler) stmts(stmts []ast.Stmt) {
-	for _, stmt := range stmts {
+	for i, stmt := range stmts {
 		c.stmt(stmt)
+		if terminates(stmt) && i+1 < len(stmts) {
+			// Rest of block can never run, don't generate code for it
+			c.program.warnf("unreachable code after %s: %s", firstLine(stmt), firstLine(stmts[i+1]))
+			break
+		}
 	}
 }
 
+// Reports whether control never continues past stmt to the next
+// statement in the same block (for example "return" or "next").
+func terminates(stmt ast.Stmt) bool {
+	switch s := stmt.(type) {
+	case *ast.ReturnStmt, *ast.ExitStmt, *ast.NextStmt, *ast.BreakStmt, *ast.ContinueStmt:
+		return true
+	case *ast.BlockStmt:
+		return blockTerminates(s.Body)
+	case *ast.IfStmt:
+		return blockTerminates(s.Body) && blockTerminates(s.Else)
+	}
+	return false
+}
+
+func blockTerminates(stmts ast.Stmts) bool {
+	for _, stmt := range stmts {
+		if terminates(stmt) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return first line of the pretty-printed stmt, for use in warnings.
+func firstLine(stmt ast.Stmt) string {
+	s := strings.TrimSpace(stmt.String())
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = strings.TrimSpace(s[:i]) + " ..."
+	}
+	return s
+}
+
+func (p *Program) warnf(format string, args ...interface{}) {
+	p.Warnings = append(p.Warnings, fmt.Sprintf(format, args...))
+}
+
 func (c *compiler) stmt(stmt ast.Stmt) {
+	if pos, ok := c.program.stmtPos[stmt]; ok {
+		c.mark(pos)
+		c.cover(pos)
+	}
 	switch s := stmt.(type) {
 	case *ast.ExprStmt:
 		// Optimize assignment expressions to avoid the extra Dupe and Drop
@@ -272,6 +539,10 @@ func (c *compiler) stmt(stmt ast.Stmt) {
 		c.add(Drop)
 
 	case *ast.PrintStmt:
+		if c.printFields(s) {
+			// Printing constant fields compiled to one instruction
+			break
+		}
 		if s.Redirect != lexer.ILLEGAL {
 			c.expr(s.Dest) // redirect destination
 		}
@@ -290,22 +561,27 @@ func (c *compiler) stmt(stmt ast.Stmt) {
 		c.add(Printf, opcodeInt(len(s.Args)), Opcode(s.Redirect))
 
 	case *ast.IfStmt:
-		if len(s.Else) == 0 {
-			jumpOp := c.condition(s.Cond, true)
-			ifMark := c.jumpForward(jumpOp)
+		switch {
+		case c.jumpTable(s):
+			// Chain of comparisons against constants compiled to a table
+		case len(s.Else) == 0:
+			ifMarks := c.jumpForwardIf(s.Cond, false)
 			c.stmts(s.Body)
-			c.patchForward(ifMark)
-		} else {
-			jumpOp := c.condition(s.Cond, true)
-			ifMark := c.jumpForward(jumpOp)
+			c.patchForwards(ifMarks)
+		default:
+			ifMarks := c.jumpForwardIf(s.Cond, false)
 			c.stmts(s.Body)
 			elseMark := c.jumpForward(Jump)
-			c.patchForward(ifMark)
+			c.patchForwards(ifMarks)
 			c.stmts(s.Else)
 			c.patchForward(elseMark)
 		}
 
 	case *ast.ForStmt:
+		if c.sumFields(s) {
+			// Loop that sums fields compiled to one instruction
+			break
+		}
 		if s.Pre != nil {
 			c.stmt(s.Pre)
 		}
@@ -316,10 +592,9 @@ func (c *compiler) stmt(stmt ast.Stmt) {
 		// This avoids one jump (a conditional jump at the top and an
 		// unconditional one at the end). This idea was stolen from an
 		// optimization CPython did recently in its "while" loop.
-		var mark int
+		var marks []int
 		if s.Cond != nil {
-			jumpOp := c.condition(s.Cond, true)
-			mark = c.jumpForward(jumpOp)
+			marks = c.jumpForwardIf(s.Cond, false)
 		}
 
 		loopStart := c.labelBackward()
@@ -330,9 +605,8 @@ func (c *compiler) stmt(stmt ast.Stmt) {
 		}
 
 		if s.Cond != nil {
-			jumpOp := c.condition(s.Cond, false)
-			c.jumpBackward(loopStart, jumpOp)
-			c.patchForward(mark)
+			c.jumpBackwardIf(loopStart, s.Cond, true)
+			c.patchForwards(marks)
 		} else {
 			c.jumpBackward(loopStart, Jump)
 		}
@@ -340,6 +614,10 @@ func (c *compiler) stmt(stmt ast.Stmt) {
 		c.patchBreaks()
 
 	case *ast.ForInStmt:
+		if c.printSorted(s) {
+			// Loop that prints an array compiled to one instruction
+			break
+		}
 		// ForIn is handled a bit differently from the other loops, because we
 		// want to use Go's "for range" construct directly in the interpreter.
 		// Otherwise we'd need to build a slice of all keys rather than
@@ -358,7 +636,13 @@ func (c *compiler) stmt(stmt ast.Stmt) {
 		c.breaks = c.breaks[:len(c.breaks)-1]
 
 	case *ast.ReturnStmt:
-		if s.Value != nil {
+		if call, ok := s.Value.(*ast.UserCallExpr); ok && c.isTailCall(call) {
+			// Self tail call: reuse the current call's frame rather
+			// than nesting a new call
+			arrayOpcodes := c.callArgs(call)
+			c.add(TailCall, opcodeInt(call.Index), opcodeInt(len(arrayOpcodes)/2))
+			c.add(arrayOpcodes...)
+		} else if s.Value != nil {
 			c.expr(s.Value)
 			c.add(Return)
 		} else {
@@ -371,16 +655,14 @@ func (c *compiler) stmt(stmt ast.Stmt) {
 
 		// Optimization: include condition once before loop and at the end.
 		// See ForStmt for more details.
-		jumpOp := c.condition(s.Cond, true)
-		mark := c.jumpForward(jumpOp)
+		marks := c.jumpForwardIf(s.Cond, false)
 
 		loopStart := c.labelBackward()
 		c.stmts(s.Body)
 		c.patchContinues()
 
-		jumpOp = c.condition(s.Cond, false)
-		c.jumpBackward(loopStart, jumpOp)
-		c.patchForward(mark)
+		c.jumpBackwardIf(loopStart, s.Cond, true)
+		c.patchForwards(marks)
 
 		c.patchBreaks()
 
@@ -392,8 +674,7 @@ func (c *compiler) stmt(stmt ast.Stmt) {
 		c.stmts(s.Body)
 		c.patchContinues()
 
-		jumpOp := c.condition(s.Cond, false)
-		c.jumpBackward(loopStart, jumpOp)
+		c.jumpBackwardIf(loopStart, s.Cond, true)
 
 		c.patchBreaks()
 
@@ -419,7 +700,7 @@ func (c *compiler) stmt(stmt ast.Stmt) {
 		if s.Status != nil {
 			c.expr(s.Status)
 		} else {
-			c.expr(&ast.NumExpr{0})
+			c.expr(&ast.NumExpr{Value: 0})
 		}
 		c.add(Exit)
 
@@ -440,6 +721,44 @@ func (c *compiler) stmt(stmt ast.Stmt) {
 	}
 }
 
+// Report whether call, the value of a return statement, is a call of
+// the function being compiled that can reuse the current call's frame.
+// It can't if the return is in a for-in loop, as the interpreter runs
+// the loop body as nested code.
+func (c *compiler) isTailCall(call *ast.UserCallExpr) bool {
+	if call.Native || c.function == nil || &c.program.Functions[call.Index] != c.function {
+		return false
+	}
+	for _, b := range c.breaks {
+		if b == nil {
+			return false
+		}
+	}
+	return c.inlineCall(call) == nil
+}
+
+// Compile the scalar arguments of user function call e (padding them
+// with Nulls if there are fewer than the function's scalar params),
+// and return the array argument opcodes for the call instruction.
+func (c *compiler) callArgs(e *ast.UserCallExpr) []Opcode {
+	f := c.program.Functions[e.Index]
+	var arrayOpcodes []Opcode
+	numScalarArgs := 0
+	for i, arg := range e.Args {
+		if f.Arrays[i] {
+			a := arg.(*ast.VarExpr)
+			arrayOpcodes = append(arrayOpcodes, Opcode(a.Scope), opcodeInt(a.Index))
+		} else {
+			c.expr(arg)
+			numScalarArgs++
+		}
+	}
+	if numScalarArgs < f.NumScalars {
+		c.add(Nulls, opcodeInt(f.NumScalars-numScalarArgs))
+	}
+	return arrayOpcodes
+}
+
 // Return the amount (+1 or -1) to add for an increment expression.
 func incrAmount(op lexer.Token) Opcode {
 	if op == lexer.INCR {
@@ -516,6 +835,13 @@ func (c *compiler) patchForward(mark int) {
 	c.code[mark-1] = opcodeInt(offset)
 }
 
+// Patch several previously-generated forward jumps.
+func (c *compiler) patchForwards(marks []int) {
+	for _, mark := range marks {
+		c.patchForward(mark)
+	}
+}
+
 // Return a "label" for a subsequent backward jump.
 func (c *compiler) labelBackward() int {
 	return len(c.code)
@@ -529,6 +855,70 @@ func (c *compiler) jumpBackward(label int, jumpOp Opcode, args ...Opcode) {
 	c.add(opcodeInt(offset))
 }
 
+// Generate forward jump(s) that are taken if the truthiness of condition
+// expr is jumpIf, otherwise fall through. Return the marks to patch.
+// Conditions using &&, ||, and ! generate jumps directly rather than
+// evaluating the boolean value and then testing it.
+func (c *compiler) jumpForwardIf(expr ast.Expr, jumpIf bool) []int {
+	if b, ok := c.constBool(expr); ok {
+		if b == jumpIf {
+			return []int{c.jumpForward(Jump)}
+		}
+		return nil // never jumps
+	}
+	switch e := expr.(type) {
+	case *ast.UnaryExpr:
+		if e.Op == lexer.NOT {
+			return c.jumpForwardIf(e.Value, !jumpIf)
+		}
+	case *ast.BinaryExpr:
+		switch {
+		case e.Op == lexer.AND && !jumpIf, e.Op == lexer.OR && jumpIf:
+			// Jump if either side says to ("a && b" is false if a is false)
+			marks := c.jumpForwardIf(e.Left, jumpIf)
+			return append(marks, c.jumpForwardIf(e.Right, jumpIf)...)
+		case e.Op == lexer.AND, e.Op == lexer.OR:
+			// Jump only if both sides say to ("a && b" is true only if
+			// both are true), so skip the right side if left says not to
+			skipMarks := c.jumpForwardIf(e.Left, !jumpIf)
+			marks := c.jumpForwardIf(e.Right, jumpIf)
+			c.patchForwards(skipMarks)
+			return marks
+		}
+	}
+	return []int{c.jumpForward(c.condition(expr, !jumpIf))}
+}
+
+// Like jumpForwardIf, but generate backward jump(s) to label.
+func (c *compiler) jumpBackwardIf(label int, expr ast.Expr, jumpIf bool) {
+	if b, ok := c.constBool(expr); ok {
+		if b == jumpIf {
+			c.jumpBackward(label, Jump)
+		}
+		return
+	}
+	switch e := expr.(type) {
+	case *ast.UnaryExpr:
+		if e.Op == lexer.NOT {
+			c.jumpBackwardIf(label, e.Value, !jumpIf)
+			return
+		}
+	case *ast.BinaryExpr:
+		switch {
+		case e.Op == lexer.AND && !jumpIf, e.Op == lexer.OR && jumpIf:
+			c.jumpBackwardIf(label, e.Left, jumpIf)
+			c.jumpBackwardIf(label, e.Right, jumpIf)
+			return
+		case e.Op == lexer.AND, e.Op == lexer.OR:
+			skipMarks := c.jumpForwardIf(e.Left, !jumpIf)
+			c.jumpBackwardIf(label, e.Right, jumpIf)
+			c.patchForwards(skipMarks)
+			return
+		}
+	}
+	c.jumpBackward(label, c.condition(expr, !jumpIf))
+}
+
 // Generate opcodes for a boolean condition.
 func (c *compiler) condition(expr ast.Expr, invert bool) Opcode {
 	jumpOp := func(normal, inverted Opcode) Opcode {
@@ -542,36 +932,32 @@ func (c *compiler) condition(expr ast.Expr, invert bool) Opcode {
 	case *ast.BinaryExpr:
 		// Optimize binary comparison expressions like "x < 10" into just
 		// JumpLess instead of two instructions (Less and JumpTrue).
+		var normal, inverted Opcode
 		switch cond.Op {
 		case lexer.EQUALS:
-			c.expr(cond.Left)
-			c.expr(cond.Right)
-			return jumpOp(JumpEquals, JumpNotEquals)
-
+			normal, inverted = JumpEquals, JumpNotEquals
 		case lexer.NOT_EQUALS:
-			c.expr(cond.Left)
-			c.expr(cond.Right)
-			return jumpOp(JumpNotEquals, JumpEquals)
-
+			normal, inverted = JumpNotEquals, JumpEquals
 		case lexer.LESS:
-			c.expr(cond.Left)
-			c.expr(cond.Right)
-			return jumpOp(JumpLess, JumpGreaterOrEqual)
-
+			normal, inverted = JumpLess, JumpGreaterOrEqual
 		case lexer.LTE:
-			c.expr(cond.Left)
-			c.expr(cond.Right)
-			return jumpOp(JumpLessOrEqual, JumpGreater)
-
+			normal, inverted = JumpLessOrEqual, JumpGreater
 		case lexer.GREATER:
-			c.expr(cond.Left)
-			c.expr(cond.Right)
-			return jumpOp(JumpGreater, JumpLessOrEqual)
-
+			normal, inverted = JumpGreater, JumpLessOrEqual
 		case lexer.GTE:
+			normal, inverted = JumpGreaterOrEqual, JumpLess
+		}
+		if normal != Nop {
+			if c.compareSpecialNum(cond) {
+				return jumpOp(JumpTrue, JumpFalse)
+			}
 			c.expr(cond.Left)
 			c.expr(cond.Right)
-			return jumpOp(JumpGreaterOrEqual, JumpLess)
+			if c.numeric(cond.Left) && c.numeric(cond.Right) {
+				normal += JumpEqualsNum - JumpEquals
+				inverted += JumpEqualsNum - JumpEquals
+			}
+			return jumpOp(normal, inverted)
 		}
 	}
 
@@ -582,6 +968,9 @@ func (c *compiler) condition(expr ast.Expr, invert bool) Opcode {
 }
 
 func (c *compiler) expr(expr ast.Expr) {
+	if folded := c.foldConst(expr); folded != nil {
+		expr = folded
+	}
 	switch e := expr.(type) {
 	case *ast.NumExpr:
 		c.add(Num, opcodeInt(c.numIndex(e.Value)))
@@ -592,6 +981,10 @@ func (c *compiler) expr(expr ast.Expr) {
 	case *ast.FieldExpr:
 		switch index := e.Index.(type) {
 		case *ast.NumExpr:
+			if index.Value == 0 {
+				c.add(Record)
+				return
+			}
 			if index.Value == float64(Opcode(index.Value)) {
 				// Optimize $i to FieldInt opcode with integer argument
 				c.add(FieldInt, opcodeInt(int(index.Value)))
@@ -608,7 +1001,14 @@ func (c *compiler) expr(expr ast.Expr) {
 		case ast.ScopeLocal:
 			c.add(Local, opcodeInt(e.Index))
 		case ast.ScopeSpecial:
-			c.add(Special, opcodeInt(e.Index))
+			switch e.Index {
+			case ast.V_NF:
+				c.add(SpecialNF)
+			case ast.V_NR:
+				c.add(SpecialNR)
+			default:
+				c.add(Special, opcodeInt(e.Index))
+			}
 		}
 
 	case *ast.RegExpr:
@@ -637,9 +1037,15 @@ func (c *compiler) expr(expr ast.Expr) {
 			c.concatOp(e)
 		default:
 			// All other binary expressions
+			if c.compareSpecialNum(e) {
+				return
+			}
 			c.expr(e.Left)
 			c.expr(e.Right)
 			c.binaryOp(e.Op)
+			if c.numeric(e.Left) && c.numeric(e.Right) {
+				c.numericCompare()
+			}
 		}
 
 	case *ast.IncrExpr:
@@ -650,15 +1056,15 @@ func (c *compiler) expr(expr ast.Expr) {
 		}
 		if e.Pre {
 			c.expr(e.Expr)
-			c.expr(&ast.NumExpr{1})
+			c.expr(&ast.NumExpr{Value: 1})
 			c.add(op)
 			c.add(Dupe)
 		} else {
 			c.expr(e.Expr)
-			c.expr(&ast.NumExpr{0})
+			c.expr(&ast.NumExpr{Value: 0})
 			c.add(Add)
 			c.add(Dupe)
-			c.expr(&ast.NumExpr{1})
+			c.expr(&ast.NumExpr{Value: 1})
 			c.add(op)
 		}
 		c.assign(e.Expr)
@@ -679,11 +1085,10 @@ func (c *compiler) expr(expr ast.Expr) {
 		c.assign(e.Left)
 
 	case *ast.CondExpr:
-		jump := c.condition(e.Cond, true)
-		ifMark := c.jumpForward(jump)
+		ifMarks := c.jumpForwardIf(e.Cond, false)
 		c.expr(e.True)
 		elseMark := c.jumpForward(Jump)
-		c.patchForward(ifMark)
+		c.patchForwards(ifMarks)
 		c.expr(e.False)
 		c.patchForward(elseMark)
 
@@ -697,24 +1102,135 @@ func (c *compiler) expr(expr ast.Expr) {
 		}
 
 	case *ast.CallExpr:
-		// split and sub/gsub require special cases as they have lvalue arguments
+		// split, sub/gsub, match with an array, and the array functions
+		// require special cases as they have lvalue or array arguments
 		switch e.Func {
 		case lexer.F_SPLIT:
 			c.expr(e.Args[0])
 			arrayExpr := e.Args[1].(*ast.ArrayExpr)
-			if len(e.Args) > 2 {
+			switch {
+			case len(e.Args) > 3:
+				c.expr(e.Args[2])
+				sepsExpr := e.Args[3].(*ast.ArrayExpr)
+				c.add(CallSplitSeps, Opcode(arrayExpr.Scope), opcodeInt(arrayExpr.Index),
+					Opcode(sepsExpr.Scope), opcodeInt(sepsExpr.Index))
+			case len(e.Args) > 2:
 				c.expr(e.Args[2])
 				c.add(CallSplitSep, Opcode(arrayExpr.Scope), opcodeInt(arrayExpr.Index))
-			} else {
+			default:
 				c.add(CallSplit, Opcode(arrayExpr.Scope), opcodeInt(arrayExpr.Index))
 			}
 			return
+		case lexer.F_MATCH:
+			if len(e.Args) < 3 {
+				break
+			}
+			c.expr(e.Args[0])
+			c.expr(e.Args[1])
+			arrayExpr := e.Args[2].(*ast.ArrayExpr)
+			c.add(CallMatch, Opcode(arrayExpr.Scope), opcodeInt(arrayExpr.Index))
+			return
+		case lexer.F_DUMPARR:
+			// Optional format and dest default to "" (TSV to stdout)
+			arrayExpr := e.Args[0].(*ast.ArrayExpr)
+			for i := 1; i < 3; i++ {
+				if i < len(e.Args) {
+					c.expr(e.Args[i])
+				} else {
+					c.expr(&ast.StrExpr{Value: ""})
+				}
+			}
+			c.add(CallDumparr, Opcode(arrayExpr.Scope), opcodeInt(arrayExpr.Index))
+			return
+		case lexer.F_COPY:
+			src := e.Args[0].(*ast.ArrayExpr)
+			dst := e.Args[1].(*ast.ArrayExpr)
+			c.add(CallCopy, Opcode(src.Scope), opcodeInt(src.Index), Opcode(dst.Scope), opcodeInt(dst.Index))
+			return
+		case lexer.F_GLOB, lexer.F_PARSEQUERY, lexer.F_STAT:
+			c.expr(e.Args[0])
+			arrayExpr := e.Args[1].(*ast.ArrayExpr)
+			var op Opcode
+			switch e.Func {
+			case lexer.F_GLOB:
+				op = CallGlob
+			case lexer.F_PARSEQUERY:
+				op = CallParsequery
+			default: // F_STAT
+				op = CallStat
+			}
+			c.add(op, Opcode(arrayExpr.Scope), opcodeInt(arrayExpr.Index))
+			return
+		case lexer.F_SQL_QUERY:
+			// The rows array isn't on the stack, so the parameters
+			// follow the database and query
+			arrayExpr := e.Args[2].(*ast.ArrayExpr)
+			c.expr(e.Args[0])
+			c.expr(e.Args[1])
+			for _, arg := range e.Args[3:] {
+				c.expr(arg)
+			}
+			c.add(CallSqlQuery, Opcode(arrayExpr.Scope), opcodeInt(arrayExpr.Index), opcodeInt(len(e.Args)-1))
+			return
+		case lexer.F_KEYS, lexer.F_VALUES:
+			// Optional sorted flag defaults to 0 (unspecified order)
+			src := e.Args[0].(*ast.ArrayExpr)
+			dst := e.Args[1].(*ast.ArrayExpr)
+			if len(e.Args) > 2 {
+				c.expr(e.Args[2])
+			} else {
+				c.expr(&ast.NumExpr{Value: 0})
+			}
+			op := CallKeys
+			if e.Func == lexer.F_VALUES {
+				op = CallValues
+			}
+			c.add(op, Opcode(src.Scope), opcodeInt(src.Index), Opcode(dst.Scope), opcodeInt(dst.Index))
+			return
+		case lexer.F_STRFTIME, lexer.F_MKTIME, lexer.F_TZCONVERT, lexer.F_HMAC,
+			lexer.F_B64DECODE, lexer.F_B64ENCODE, lexer.F_REDIS_INCR:
+			// Fill in optional arguments so each has a fixed arity
+			var defaults []ast.Expr
+			var op BuiltinOp
+			switch e.Func {
+			case lexer.F_STRFTIME:
+				// Same default format as Gawk; timestamp defaults to now
+				defaults = []ast.Expr{&ast.StrExpr{Value: defaultTimeFormat}, &ast.CallExpr{Func: lexer.F_SYSTIME}, &ast.NumExpr{Value: 0}}
+				op = BuiltinStrftime
+			case lexer.F_MKTIME:
+				defaults = []ast.Expr{nil, &ast.NumExpr{Value: 0}}
+				op = BuiltinMktime
+			case lexer.F_B64DECODE:
+				defaults = []ast.Expr{nil, &ast.NumExpr{Value: 0}}
+				op = BuiltinB64decode
+			case lexer.F_B64ENCODE:
+				defaults = []ast.Expr{nil, &ast.NumExpr{Value: 0}}
+				op = BuiltinB64encode
+			case lexer.F_HMAC:
+				defaults = []ast.Expr{nil, nil, &ast.StrExpr{Value: "sha256"}}
+				op = BuiltinHmac
+			case lexer.F_REDIS_INCR:
+				defaults = []ast.Expr{nil, &ast.NumExpr{Value: 1}}
+				op = BuiltinRedisIncr
+			default: // F_TZCONVERT
+				defaults = []ast.Expr{nil, nil, &ast.StrExpr{Value: defaultTimeFormat}}
+				op = BuiltinTzconvert
+			}
+			for i, d := range defaults {
+				if i < len(e.Args) {
+					c.expr(e.Args[i])
+				} else {
+					c.expr(d)
+				}
+			}
+			c.add(CallBuiltin, Opcode(op))
+			return
 		case lexer.F_SUB, lexer.F_GSUB:
 			op := BuiltinSub
 			if e.Func == lexer.F_GSUB {
 				op = BuiltinGsub
 			}
-			var target ast.Expr = &ast.FieldExpr{&ast.NumExpr{0}} // default value and target is $0
+			var target ast.Expr = &ast.FieldExpr{Index: &ast.NumExpr{Value: 0}} // default value and target is $0
 			if len(e.Args) == 3 {
 				target = e.Args[2]
 			}
@@ -784,6 +1300,68 @@ func (c *compiler) expr(expr ast.Expr) {
 			c.add(CallBuiltin, Opcode(BuiltinTolower))
 		case lexer.F_TOUPPER:
 			c.add(CallBuiltin, Opcode(BuiltinToupper))
+		case lexer.F_ABS:
+			c.add(CallBuiltin, Opcode(BuiltinAbs))
+		case lexer.F_CEIL:
+			c.add(CallBuiltin, Opcode(BuiltinCeil))
+		case lexer.F_FLOOR:
+			c.add(CallBuiltin, Opcode(BuiltinFloor))
+		case lexer.F_ROUND:
+			if len(e.Args) > 1 {
+				c.add(CallBuiltin, Opcode(BuiltinRoundDigits))
+			} else {
+				c.add(CallBuiltin, Opcode(BuiltinRound))
+			}
+		case lexer.F_TRUNC:
+			c.add(CallBuiltin, Opcode(BuiltinTrunc))
+		case lexer.F_MAX:
+			c.add(CallMax, opcodeInt(len(e.Args)))
+		case lexer.F_MIN:
+			c.add(CallMin, opcodeInt(len(e.Args)))
+		case lexer.F_CHR:
+			c.add(CallBuiltin, Opcode(BuiltinChr))
+		case lexer.F_ORD:
+			c.add(CallBuiltin, Opcode(BuiltinOrd))
+		case lexer.F_MD5:
+			c.add(CallBuiltin, Opcode(BuiltinMd5))
+		case lexer.F_SHA1:
+			c.add(CallBuiltin, Opcode(BuiltinSha1))
+		case lexer.F_SHA256:
+			c.add(CallBuiltin, Opcode(BuiltinSha256))
+		case lexer.F_URLDECODE:
+			c.add(CallBuiltin, Opcode(BuiltinUrldecode))
+		case lexer.F_URLENCODE:
+			c.add(CallBuiltin, Opcode(BuiltinUrlencode))
+		case lexer.F_SB_ADD:
+			c.add(CallBuiltin, Opcode(BuiltinSbAdd))
+		case lexer.F_SB_NEW:
+			c.add(CallBuiltin, Opcode(BuiltinSbNew))
+		case lexer.F_SB_STR:
+			c.add(CallBuiltin, Opcode(BuiltinSbStr))
+		case lexer.F_SYSTIME:
+			c.add(CallBuiltin, Opcode(BuiltinSystime))
+		case lexer.F_MONOTIME:
+			c.add(CallBuiltin, Opcode(BuiltinMonotime))
+		case lexer.F_SETENV:
+			c.add(CallBuiltin, Opcode(BuiltinSetenv))
+		case lexer.F_UNSETENV:
+			c.add(CallBuiltin, Opcode(BuiltinUnsetenv))
+		case lexer.F_FILESIZE:
+			c.add(CallBuiltin, Opcode(BuiltinFilesize))
+		case lexer.F_MTIME:
+			c.add(CallBuiltin, Opcode(BuiltinMtime))
+		case lexer.F_SLEEP:
+			c.add(CallBuiltin, Opcode(BuiltinSleep))
+		case lexer.F_REDIS_GET:
+			c.add(CallBuiltin, Opcode(BuiltinRedisGet))
+		case lexer.F_REDIS_SET:
+			c.add(CallBuiltin, Opcode(BuiltinRedisSet))
+		case lexer.F_SQL_OPEN:
+			c.add(CallBuiltin, Opcode(BuiltinSqlOpen))
+		case lexer.F_SQL_CLOSE:
+			c.add(CallBuiltin, Opcode(BuiltinSqlClose))
+		case lexer.F_SQL_EXEC:
+			c.add(CallSqlExec, opcodeInt(len(e.Args)))
 		default:
 			panic(fmt.Sprintf("unexpected function: %s", e.Func))
 		}
@@ -819,21 +1397,12 @@ func (c *compiler) expr(expr ast.Expr) {
 			}
 			c.program.nativeFuncNames[e.Index] = e.Name
 		} else {
-			f := c.program.Functions[e.Index]
-			var arrayOpcodes []Opcode
-			numScalarArgs := 0
-			for i, arg := range e.Args {
-				if f.Arrays[i] {
-					a := arg.(*ast.VarExpr)
-					arrayOpcodes = append(arrayOpcodes, Opcode(a.Scope), opcodeInt(a.Index))
-				} else {
-					c.expr(arg)
-					numScalarArgs++
-				}
-			}
-			if numScalarArgs < f.NumScalars {
-				c.add(Nulls, opcodeInt(f.NumScalars-numScalarArgs))
+			if inlined := c.inlineCall(e); inlined != nil {
+				c.program.inlined = true
+				c.expr(inlined)
+				return
 			}
+			arrayOpcodes := c.callArgs(e)
 			c.add(CallUser, opcodeInt(e.Index), opcodeInt(len(arrayOpcodes)/2))
 			c.add(arrayOpcodes...)
 		}
@@ -879,42 +1448,52 @@ func (c *compiler) expr(expr ast.Expr) {
 
 // Generate a Concat2 opcode or, if possible compact multiple `Concat2` into one `ConcatMulti`
 func (c *compiler) concatOp(expr *ast.BinaryExpr) {
-	var values []ast.Expr
-	for {
-		values = append(values, expr.Right)
-		left, isBinary := expr.Left.(*ast.BinaryExpr)
-		if !isBinary || left.Op != lexer.CONCAT {
-			break
+	// Concatenation is associative, so flatten nested concatenations on
+	// either side, for example (a b) (c d), into a single operand list.
+	// Merge adjacent constants as we go, for example x "a" "b".
+	var operands []ast.Expr
+	var flatten func(expr ast.Expr)
+	flatten = func(expr ast.Expr) {
+		if e, ok := expr.(*ast.BinaryExpr); ok && e.Op == lexer.CONCAT {
+			flatten(e.Left)
+			flatten(e.Right)
+			return
+		}
+		n := len(operands)
+		if n > 0 {
+			left, leftOk := c.constStr(operands[n-1])
+			right, rightOk := c.constStr(expr)
+			if leftOk && rightOk {
+				operands[n-1] = &ast.StrExpr{Value: left + right}
+				return
+			}
 		}
-		expr = left
+		operands = append(operands, expr)
 	}
-	values = append(values, expr.Left)
+	flatten(expr)
 
-	// values are appended right to left
-	// but need to pushed left to right
-
-	if len(values) == 2 {
-		c.expr(values[1])
-		c.expr(values[0])
-		c.add(Concat2)
-		return
+	for _, operand := range operands {
+		c.expr(operand)
 	}
-
-	for i := len(values) - 1; i >= 0; i-- {
-		c.expr(values[i])
+	switch len(operands) {
+	case 1:
+		// Can only happen if all operands were constant
+	case 2:
+		c.add(Concat2)
+	default:
+		c.add(ConcatMulti, opcodeInt(len(operands)))
 	}
-
-	c.add(ConcatMulti, opcodeInt(len(values)))
 }
 
 // Add (or reuse) a number constant and returns its index.
 func (c *compiler) numIndex(n float64) int {
-	if index, ok := c.indexes.nums[n]; ok {
+	bits := math.Float64bits(n)
+	if index, ok := c.indexes.nums[bits]; ok {
 		return index // reuse existing constant
 	}
 	index := len(c.program.Nums)
 	c.program.Nums = append(c.program.Nums, n)
-	c.indexes.nums[n] = index
+	c.indexes.nums[bits] = index
 	return index
 }
 
@@ -979,6 +1558,62 @@ func (c *compiler) binaryOp(op lexer.Token) {
 	c.add(opcode)
 }
 
+// Report whether expr is inferred to always be numeric (see typeInfo).
+func (c *compiler) numeric(expr ast.Expr) bool {
+	return c.program.types.numeric(expr, c.locals)
+}
+
+// Replace the comparison opcode just added, if any, with its numeric
+// version.
+func (c *compiler) numericCompare() {
+	last := len(c.code) - 1
+	if c.code[last] >= Equals && c.code[last] <= GreaterOrEqual {
+		c.code[last] += EqualsNum - Equals
+	}
+}
+
+// If expr compares NR, FNR, or NF with a number constant, like
+// "NR > 1", generate a single CompareSpecialNum opcode for it (which
+// avoids the getSpecial call and boxing the value) and return true.
+// Globals aren't worth specializing, as reading them is already just
+// a slice index.
+func (c *compiler) compareSpecialNum(expr *ast.BinaryExpr) bool {
+	var compareOp Opcode
+	switch expr.Op {
+	case lexer.EQUALS:
+		compareOp = Equals
+	case lexer.NOT_EQUALS:
+		compareOp = NotEquals
+	case lexer.LESS:
+		compareOp = Less
+	case lexer.LTE:
+		compareOp = LessOrEqual
+	case lexer.GREATER:
+		compareOp = Greater
+	case lexer.GTE:
+		compareOp = GreaterOrEqual
+	default:
+		return false
+	}
+	v, ok := expr.Left.(*ast.VarExpr)
+	if !ok || v.Scope != ast.ScopeSpecial {
+		return false
+	}
+	if v.Index != ast.V_NR && v.Index != ast.V_FNR && v.Index != ast.V_NF {
+		return false
+	}
+	right := expr.Right
+	if folded := c.foldConst(right); folded != nil {
+		right = folded
+	}
+	n, ok := right.(*ast.NumExpr)
+	if !ok {
+		return false
+	}
+	c.add(CompareSpecialNum, compareOp, opcodeInt(v.Index), opcodeInt(c.numIndex(n.Value)))
+	return true
+}
+
 // Generate an array index, handling multi-indexes properly.
 func (c *compiler) index(index []ast.Expr) {
 	for _, expr := range index {
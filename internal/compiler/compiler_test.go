@@ -0,0 +1,755 @@
+package compiler_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/benhoyt/goawk/internal/compiler"
+	"github.com/benhoyt/goawk/parser"
+)
+
+func TestConstantFolding(t *testing.T) {
+	tests := []struct {
+		src  string
+		asm  []string // expected instructions in BEGIN block, without addresses
+		none string   // opcode that mustn't appear in the disassembly
+	}{
+		{`BEGIN { print 60*60*24 }`, []string{"Num 86400 (0)", "Print 1"}, "Multiply"},
+		{`BEGIN { print -(2^10) + 1 }`, []string{"Num -1023 (0)", "Print 1"}, "Power"},
+		{`BEGIN { print 7%3, 1/4 }`, []string{"Num 1 (0)", "Num 0.25 (1)", "Print 2"}, "Divide"},
+		{`BEGIN { print "a" "b" 42 }`, []string{`Str "ab42" (0)`, "Print 1"}, "Concat"},
+		{`BEGIN { print x "a" "b" }`, []string{"Global x", `Str "ab" (0)`, "Concat2", "Print 1"}, "ConcatMulti"},
+		{`BEGIN { print "a" "b" x "c" "d" }`, []string{`Str "ab" (0)`, "Global x", `Str "cd" (1)`, "ConcatMulti 3", "Print 1"}, ""},
+		{`BEGIN { print (x "a") ("b" y) z }`, []string{"Global x", `Str "ab" (0)`, "Global y", "Global z", "ConcatMulti 4", "Print 1"}, "Concat2"},
+		{`BEGIN { print "food" ~ /fo+/, "food" !~ "fo+" }`, []string{"Num 1 (0)", "Num 0 (1)", "Print 2"}, "Match"},
+		{`BEGIN { print !"", !1 }`, []string{"Num 1 (0)", "Num 0 (1)", "Print 2"}, "Not"},
+		{`BEGIN { print -0, 0, -0 }`, []string{"Num -0 (0)", "Num 0 (1)", "Num -0 (0)", "Print 3"}, "UnaryMinus"},
+
+		// These must be left for the interpreter
+		{`BEGIN { print 1/0 }`, []string{"Num 1 (0)", "Num 0 (1)", "Divide", "Print 1"}, ""},
+		{`BEGIN { print 1 % 0 }`, []string{"Num 1 (0)", "Num 0 (1)", "Modulo", "Print 1"}, ""},
+		{`BEGIN { print "a" 0.5 }`, []string{`Str "a" (0)`, "Num 0.5 (0)", "Concat2", "Print 1"}, ""},
+		{`BEGIN { print "3" + 4 }`, []string{`Str "3" (0)`, "Num 4 (0)", "Add", "Print 1"}, ""},
+		{`BEGIN { print "x" ~ "(" }`, []string{`Str "x" (0)`, `Str "(" (1)`, "Match", "Print 1"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			var buf bytes.Buffer
+			err = prog.Disassemble(&buf)
+			if err != nil {
+				t.Fatalf("disassembly error: %v", err)
+			}
+			var asm []string
+			for _, line := range strings.Split(buf.String(), "\n")[1:] {
+				fields := strings.Fields(line)
+				if len(fields) == 0 {
+					break
+				}
+				asm = append(asm, strings.Join(fields[1:], " "))
+			}
+			if strings.Join(asm, "\n") != strings.Join(test.asm, "\n") {
+				t.Fatalf("expected:\n%s\ngot:\n%s", strings.Join(test.asm, "\n"), strings.Join(asm, "\n"))
+			}
+			if test.none != "" && strings.Contains(buf.String(), test.none) {
+				t.Fatalf("expected no %s in disassembly:\n%s", test.none, buf.String())
+			}
+		})
+	}
+}
+
+func TestConstantPool(t *testing.T) {
+	// Generated programs often repeat the same literals many times
+	var src strings.Builder
+	for i := 0; i < 1000; i++ {
+		src.WriteString(`/x+/ { print "a", 1, 2-1, "" "a"; FS = "x+" }` + "\n")
+	}
+	src.WriteString(`function f(s) { return s ~ /x+/ ? 1 : "a" }` + "\n")
+	prog, err := parser.ParseProgram([]byte(src.String()), nil)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	p := prog.Compiled
+	if !reflect.DeepEqual(p.Nums, []float64{1}) {
+		t.Errorf("expected Nums [1], got %v", p.Nums)
+	}
+	if !reflect.DeepEqual(p.Strs, []string{"x+", "a"}) {
+		t.Errorf("expected Strs [x+ a], got %q", p.Strs)
+	}
+	if len(p.Regexes) != 1 || p.Regexes[0].String() != "x+" {
+		t.Errorf("expected Regexes [x+], got %v", p.Regexes)
+	}
+}
+
+func TestDeadCode(t *testing.T) {
+	tests := []struct {
+		src      string
+		asm      string // expected disassembly
+		warnings []string
+	}{
+		{`function f() { return 1; print "x" }`, `
+        // function f()
+0000    Num 1 (0)
+0002    Return
+`, []string{`unreachable code after return 1: print "x"`}},
+		{`{ if ($1) { next } else { exit 1 } print; print }`, `
+        // { body }
+0000    FieldInt 1
+0002    JumpFalse 0x0007
+0004    Next
+0005    Jump 0x000a
+0007    Num 1 (0)
+0009    Exit
+`, []string{"unreachable code after if ($1) { ...: print"}},
+		{`{ while (1) { if ($1 == "x") { break; print "never" } print } }`, `
+        // { body }
+0000    FieldIntJump 1
+0002    Str "x" (0)
+0004    JumpNotEquals 0x0008
+0006    Jump 0x000d
+0008    PrintFields 0
+000b    Jump 0x0000
+`, []string{`unreachable code after break: print "never"`}},
+		{`0 { print "never" }  1 { print "always" }  "", /x/ { print "never" }  1, 0`, `
+        // { body }
+0000    Str "always" (0)
+0002    Print 1
+
+        // start
+0000    Num 1 (0)
+
+        // stop
+0000    Num 0 (1)
+`, []string{`pattern is always false: 0`, `range pattern start is always false: ""`}},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			var buf bytes.Buffer
+			err = prog.Disassemble(&buf)
+			if err != nil {
+				t.Fatalf("disassembly error: %v", err)
+			}
+			if buf.String() != test.asm[1:]+"\n" {
+				t.Fatalf("expected disassembly:\n%s\ngot:\n%s", test.asm[1:], buf.String())
+			}
+			warnings := strings.Join(prog.Compiled.Warnings, "\n")
+			if warnings != strings.Join(test.warnings, "\n") {
+				t.Fatalf("expected warnings:\n%s\ngot:\n%s", strings.Join(test.warnings, "\n"), warnings)
+			}
+		})
+	}
+}
+
+func TestJumps(t *testing.T) {
+	tests := []struct {
+		src string
+		asm string // expected disassembly
+	}{
+		{`{ if ($1 < 5 && $2 > 10) print }`, `
+        // { body }
+0000    FieldIntJump 1
+0002    Num 5 (0)
+0004    JumpGreaterOrEqual 0x000f
+0006    FieldIntJump 2
+0008    Num 10 (1)
+000a    JumpLessOrEqual 0x000f
+000c    PrintFields 0
+`},
+		{`{ if ($1 == "a" || !($2 != "b")) print }`, `
+        // { body }
+0000    FieldIntJump 1
+0002    Str "a" (0)
+0004    JumpEquals 0x000c
+0006    FieldIntJump 2
+0008    Str "b" (1)
+000a    JumpNotEquals 0x000f
+000c    PrintFields 0
+`},
+		{`{ while ($1 && x) x-- }`, `
+        // { body }
+0000    FieldInt 1
+0002    JumpFalse 0x0013
+0004    Global x
+0006    JumpFalse 0x0013
+0008    IncrGlobal -1 x
+000b    FieldInt 1
+000d    JumpFalse 0x0013
+000f    Global x
+0011    JumpTrue 0x0008
+`},
+		{`{ if ($1) { if ($2) print "a" } else print "b" }`, `
+        // { body }
+0000    FieldInt 1
+0002    JumpFalse 0x000f
+0004    FieldInt 2
+0006    JumpFalse 0x0014
+0008    Str "a" (0)
+000a    Print 1
+000d    Jump 0x0014
+000f    Str "b" (1)
+0011    Print 1
+`},
+		{`BEGIN { do x++; while (!0) }`, `
+        // BEGIN
+0000    IncrGlobal 1 x
+0003    Jump 0x0000
+`},
+		{`BEGIN { print 1 ? "y" : "n" }`, `
+        // BEGIN
+0000    Str "y" (0)
+0002    Jump 0x0006
+0004    Str "n" (1)
+0006    Print 1
+`},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			var buf bytes.Buffer
+			err = prog.Disassemble(&buf)
+			if err != nil {
+				t.Fatalf("disassembly error: %v", err)
+			}
+			if buf.String() != test.asm[1:]+"\n" {
+				t.Fatalf("expected disassembly:\n%s\ngot:\n%s", test.asm[1:], buf.String())
+			}
+		})
+	}
+}
+
+func TestInlining(t *testing.T) {
+	tests := []struct {
+		src     string
+		inlined bool
+	}{
+		{`function max(a, b) { return a > b ? a : b }  { m = max(m, $1) }`, true},
+		{`function f(x) { return length(x) + NR }  { print f($NF) }`, true},
+		{`function f(x) { return x ? 1 : 2 }  { print f("s") }`, true},
+		{`function f(x) { return x + 1 }  { print f($1 + 1) }`, false},    // argument is an expression
+		{`function f(x) { return x + 1 }  { print f() }`, false},          // missing argument
+		{`function f(x, y) { return x || y }  { print f(1, $2) }`, false}, // field argument not always evaluated
+		{`function f(x) { return x++ }  { print f(1) }`, false},           // side effect
+		{`function f(n) { return n < 2 ? n : f(n-1) }  { print f(1) }`, false},
+		{`function f(a) { return 1 in a }  { x[1]; print f(x) }`, false}, // array param
+		{`function f(x) { print x; return x }  { print f(1) }`, false},
+		{`function f(x) { return 1 }  { print f(x) }`, true},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			var buf bytes.Buffer
+			err = prog.Disassemble(&buf)
+			if err != nil {
+				t.Fatalf("disassembly error: %v", err)
+			}
+			section := buf.String()[:strings.Index(buf.String(), "// function")]
+			inlined := !strings.Contains(section, "CallUser")
+			if inlined != test.inlined {
+				t.Fatalf("expected inlined=%v, got %v:\n%s", test.inlined, inlined, section)
+			}
+		})
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		src      string
+		tailCall bool
+	}{
+		{`function f(n) { if (n) return f(n-1) }  BEGIN { f(5) }`, true},
+		{`function f(n, a) { if (n) return f(n-1, a) }  BEGIN { f(5, x) }`, true},
+		{`function f(n, m) { if (n) return f() }  BEGIN { f(5) }`, true},
+		{`function f(n) { if (n) return 1 + f(n-1) }  BEGIN { f(5) }`, false}, // not in tail position
+		{`function f(n) { if (n) f(n-1) }  BEGIN { f(5) }`, false},            // not returned
+		{`function f(n) { return g(n) }  function g(n) { print n }  BEGIN { f(5) }`, false},
+		{`function f(n, a, k) { for (k in a) return f(n-1, a) }  BEGIN { f(5, x) }`, false},
+		{`function f(n) { while (n) return f(n-1) }  BEGIN { f(5) }`, true},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			var buf bytes.Buffer
+			err = prog.Disassemble(&buf)
+			if err != nil {
+				t.Fatalf("disassembly error: %v", err)
+			}
+			tailCall := strings.Contains(buf.String(), "TailCall")
+			if tailCall != test.tailCall {
+				t.Fatalf("expected tailCall=%v, got %v:\n%s", test.tailCall, tailCall, buf.String())
+			}
+			err = prog.Compiled.Verify()
+			if err != nil {
+				t.Fatalf("verify error: %v", err)
+			}
+		})
+	}
+}
+
+func TestJumpTables(t *testing.T) {
+	tests := []struct {
+		src      string
+		coverage bool
+		expected string // Switch instruction, or "" if there shouldn't be one
+	}{
+		{`{ if ($1 == "a") x = 1; else if ($1 == "b") x = 2; else if ($1 == "c") x = 3; else if ($1 == "d") x = 4 }`, false,
+			`Switch "a":0x0004 "b":0x000a "c":0x0010 "d":0x0016 default:0x001a`},
+		{`{ if (n == 1) x = 1; else if (n == 2 || 3 == n) x = 2; else if (n == -1*4) x = 3; else x = 4 }`, false,
+			`Switch 1:0x0004 2:0x000a 3:0x000a -4:0x0010 default:0x0016`},
+		{`{ if (n == "a" || n == "b" || n == "c" || n == "a") x = 1; else if (n == "d") x = 2 }`, false,
+			`Switch "a":0x0004 "b":0x0004 "c":0x0004 "d":0x000a default:0x000e`},
+		{`{ if ($1 == "a") x = 1; else if ($1 == "b") x = 2; else if ($1 == "c") x = 3 }`, false, ""},
+		{`{ if ($1 == "a") x = 1; else if ($1 == 2) x = 2; else if ($1 == "c") x = 3; else if ($1 == "d") x = 4 }`, false, ""},
+		{`{ if ($1 == "a") x = 1; else if ($2 == "b") x = 2; else if ($1 == "c") x = 3; else if ($1 == "d") x = 4 }`, false, ""},
+		{`{ if (n == 1.5) x = 1; else if (n == 2) x = 2; else if (n == 3) x = 3; else if (n == 4) x = 4 }`, false, ""},
+		{`{ if ($(n+1) == 1) x = 1; else if ($(n+1) == 2) x = 2; else if ($(n+1) == 3) x = 3; else if ($(n+1) == 4) x = 4 }`, false, ""},
+		{`{ if (n == 1) x = 1; else if (n == 2) x = 2; else if (n == 3) x = 3; else if (n == 4) x = 4 }`, true, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), &parser.ParserConfig{Coverage: test.coverage})
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			var buf bytes.Buffer
+			err = prog.Disassemble(&buf)
+			if err != nil {
+				t.Fatalf("disassembly error: %v", err)
+			}
+			output := buf.String()
+			if test.expected == "" {
+				if strings.Contains(output, "Switch") {
+					t.Fatalf("expected no Switch, got:\n%s", output)
+				}
+				return
+			}
+			if !strings.Contains(output, "0002    "+test.expected+"\n") {
+				t.Fatalf("expected %q, got:\n%s", test.expected, output)
+			}
+			err = prog.Compiled.Verify()
+			if err != nil {
+				t.Fatalf("verify error: %v", err)
+			}
+
+			// Check that the table survives a round trip through the assembler
+			asm, err := compiler.Assemble(bytes.NewReader(buf.Bytes()), nil)
+			if err != nil {
+				t.Fatalf("assembly error: %v", err)
+			}
+			if !reflect.DeepEqual(asm.JumpTables, prog.Compiled.JumpTables) {
+				t.Fatalf("expected tables %v, got %v", prog.Compiled.JumpTables, asm.JumpTables)
+			}
+		})
+	}
+}
+
+func TestSuperinstructions(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected []string // instructions that should be in the disassembly
+	}{
+		{`$3 > 100`, []string{"0000    FieldIntCompare 3", "0002    Num 100 (0)", "0004    Greater"}},
+		{`{ if ($1 == "a") print }`, []string{"0000    FieldIntJump 1", "0002    Str \"a\" (0)", "0004    JumpNotEquals 0x0009"}},
+		{`{ for (i=1; i<=NF; i++) print $i }`, []string{"0004    GlobalJumpNum i", "0006    SpecialNF", "0007    JumpGreaterNum 0x0017"}},
+		{`{ x = x * 2 }`, []string{"0000    GlobalArithAssign x", "0002    Num 2 (0)", "0004    Multiply", "0005    AssignGlobal x"}},
+		{`{ y = x - 1 }`, []string{"0000    GlobalArithAssign x", "0005    AssignGlobal y"}},
+		{`{ x = x / 2 }`, []string{"0000    Global x"}},
+		{`{ print $1 == k }`, []string{"0000    FieldInt 1"}},
+		{`{ for (k in a) if ($1 == "a") n++ }`, []string{"0000    ForIn k a 0x000f", "0006    FieldIntJump 1"}},
+		{`{ for (k in a) x = 1; x = x + 1 }`, []string{"0000    ForIn k a 0x000a", "000a    GlobalArithAssign x"}},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			var buf bytes.Buffer
+			err = prog.Disassemble(&buf)
+			if err != nil {
+				t.Fatalf("disassembly error: %v", err)
+			}
+			output := buf.String()
+			for _, line := range test.expected {
+				if !strings.Contains(output, line+"\n") {
+					t.Fatalf("expected %q, got:\n%s", line, output)
+				}
+			}
+			err = prog.Compiled.Verify()
+			if err != nil {
+				t.Fatalf("verify error: %v", err)
+			}
+		})
+	}
+}
+
+func TestFieldSums(t *testing.T) {
+	tests := []struct {
+		src string
+		sum bool // whether the loop should be compiled to SumFields
+	}{
+		{`{ for (i=1; i<=NF; i++) s += $i }`, true},
+		{`{ for (i=0; i<=NF; ++i) s = s + $i }`, true},
+		{`function f(n, i, t) { for (i=3; i<=NF; i+=1) t += $i; return t }  { f() }`, true},
+		{`{ for (i=1; i<NF; i++) s += $i }`, false},
+		{`{ for (i=1; i<=NF; i++) s -= $i }`, false},
+		{`{ for (i=1; i<=NF; i++) s = $i + s }`, false},
+		{`{ for (i=1; i<=NF; i++) { s += $i; n++ } }`, false},
+		{`{ for (i=1; i<=NF; i++) s += $(i+1) }`, false},
+		{`{ for (i=1; i<=NF; i++) i += $i }`, false},
+		{`{ for (i=1; i<=NF; i++) NR += $i }`, false},
+		{`{ for (i=1.5; i<=NF; i++) s += $i }`, false},
+		{`{ for (i=-1; i<=NF; i++) s += $i }`, false},
+		{`{ for (i=1; i<=NF; i+=2) s += $i }`, false},
+		{`{ for (i=1; i<=NF; j++) s += $i }`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			var buf bytes.Buffer
+			err = prog.Disassemble(&buf)
+			if err != nil {
+				t.Fatalf("disassembly error: %v", err)
+			}
+			output := buf.String()
+			if strings.Contains(output, "SumFields") != test.sum {
+				t.Fatalf("expected SumFields %v, got:\n%s", test.sum, output)
+			}
+			err = prog.Compiled.Verify()
+			if err != nil {
+				t.Fatalf("verify error: %v", err)
+			}
+		})
+	}
+}
+
+func TestPrintSorted(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected string // PrintSorted instruction, or "" if there shouldn't be one
+	}{
+		{`END { for (k in a) print k, a[k] }`, "0000    PrintSorted k a 2"},
+		{`END { for (k in a) print k }`, "0000    PrintSorted k a 1"},
+		{`END { for (k in a) print k, a[k] > "out" }`, "0002    PrintSorted k a 2 >"},
+		{`function f(b, k) { for (k in b) print k, b[k] | "sort" }  BEGIN { f(a) }`, "0002    PrintSorted k b 2 |"},
+		{`END { for (k in a) print a[k], k }`, ""},
+		{`END { for (k in a) print k, b[k] }`, ""},
+		{`END { for (k in a) print k, a[k], 1 }`, ""},
+		{`END { for (k in a) print k, a[k] > k }`, ""},
+		{`END { for (k in a) printf "%s ", k }`, ""},
+		{`END { for (k in a) { print k; n++ } }`, ""},
+		{`END { for (SUBSEP in a) print SUBSEP }`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			var buf bytes.Buffer
+			err = prog.Disassemble(&buf)
+			if err != nil {
+				t.Fatalf("disassembly error: %v", err)
+			}
+			output := buf.String()
+			if test.expected == "" {
+				if strings.Contains(output, "PrintSorted") {
+					t.Fatalf("expected no PrintSorted, got:\n%s", output)
+				}
+				return
+			}
+			if !strings.Contains(output, test.expected+"\n") {
+				t.Fatalf("expected %q, got:\n%s", test.expected, output)
+			}
+		})
+	}
+}
+
+func TestPrintFields(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected string // PrintFields instruction, or "" if there shouldn't be one
+	}{
+		{`{ print }`, "0000    PrintFields 0"},
+		{`{ print $0 }`, "0000    PrintFields 0"},
+		{`{ print $3 }`, "0000    PrintFields 3"},
+		{`{ print $2, $1, $0, $2 }`, "0000    PrintFields 2 1 0 2"},
+		{`{ print($1, $2) }`, "0000    PrintFields 1 2"},
+		{`{ print $1 > "out" }`, ""},
+		{`{ print | "sort" }`, ""},
+		{`{ print $i }`, ""},
+		{`{ print $1, x }`, ""},
+		{`{ print $1.5 }`, ""},
+		{`{ print $-1 }`, ""},
+		{`{ printf $1 }`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			var buf bytes.Buffer
+			err = prog.Disassemble(&buf)
+			if err != nil {
+				t.Fatalf("disassembly error: %v", err)
+			}
+			output := buf.String()
+			if test.expected == "" {
+				if strings.Contains(output, "PrintFields") {
+					t.Fatalf("expected no PrintFields, got:\n%s", output)
+				}
+				return
+			}
+			if !strings.Contains(output, test.expected+"\n") {
+				t.Fatalf("expected %q, got:\n%s", test.expected, output)
+			}
+			err = prog.Compiled.Verify()
+			if err != nil {
+				t.Fatalf("verify error: %v", err)
+			}
+		})
+	}
+}
+
+func TestSpecialOpcodes(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected []string // instructions that should be in the disassembly
+		notIn    string   // opcode that shouldn't be
+	}{
+		{`{ print $0 NR }`, []string{"0000    Record", "0001    SpecialNR"}, "FieldInt"},
+		{`{ x = NF }`, []string{"0000    SpecialNF"}, "Special NF"},
+		{`{ x = NF; y = NF + NF }`, []string{"0000    SpecialNF", "0003    CachedNF", "0004    CachedNF"}, ""},
+		{`{ x = NF; if (x) y = NF }`, []string{"0000    SpecialNF", "0007    CachedNF"}, ""},
+		{`{ x = NF; $3 = "a"; y = NF }`, nil, "CachedNF"},
+		{`{ x = NF; getline; y = NF }`, nil, "CachedNF"},
+		{`{ x = NF; NF = 2; y = NF }`, nil, "CachedNF"},
+		{`{ x = NF; sub(/a/, "b"); y = NF }`, nil, "CachedNF"},
+		{`function f() { $0 = "a" }  { x = NF; f(); y = NF }`, nil, "CachedNF"},
+		{`{ while (i++ < 3) x = NF; y = NF }`, nil, "CachedNF"},
+		{`{ for (k in a) x = NF; y = NF }`, nil, "CachedNF"},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			var buf bytes.Buffer
+			err = prog.Disassemble(&buf)
+			if err != nil {
+				t.Fatalf("disassembly error: %v", err)
+			}
+			output := buf.String()
+			for _, line := range test.expected {
+				if !strings.Contains(output, line+"\n") {
+					t.Fatalf("expected %q, got:\n%s", line, output)
+				}
+			}
+			if test.notIn != "" && strings.Contains(output, test.notIn) {
+				t.Fatalf("expected no %s, got:\n%s", test.notIn, output)
+			}
+			err = prog.Compiled.Verify()
+			if err != nil {
+				t.Fatalf("verify error: %v", err)
+			}
+		})
+	}
+}
+
+func TestNumericComparisons(t *testing.T) {
+	tests := []struct {
+		src     string
+		numeric bool
+	}{
+		{`BEGIN { for (i = 1; i <= 10; i++) s += i }`, true},
+		{`{ for (i = 1; i <= NF; i++) print $i }`, true},
+		{`BEGIN { n = length("foo"); print (n == 3) }`, true},
+		{`BEGIN { x = 1; x = y + 2; if (x > y) print }`, true},
+		{`function f(a) { return a + 1 }  BEGIN { if (f(1) < 3) print }`, true},
+		{`function f(a, b) { print (a < b) }  BEGIN { f(1, 2) }`, true},
+		{`{ if ($1 < 5) print }`, false},
+		{`BEGIN { x = 1; x = "s"; if (x < 2) print }`, false},
+		{`BEGIN { x = 1 } { x = $1 } END { if (x > 0) print }`, false},
+		{`BEGIN { getline n; if (n > 1) print }`, false},
+		{`BEGIN { s = "a" "b"; if (s == "ab") print }`, false},
+		{`function f(a) { return a }  BEGIN { if (f("x") < 3) print }`, false},
+		{`function f(a, b) { print (a < b) }  BEGIN { f(1, "x") }`, false},
+		{`BEGIN { for (k in a) if (k > 1) print }`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			var buf bytes.Buffer
+			err = prog.Disassemble(&buf)
+			if err != nil {
+				t.Fatalf("disassembly error: %v", err)
+			}
+			numeric := false
+			for _, name := range []string{"EqualsNum", "NotEqualsNum", "LessNum", "GreaterNum", "LessOrEqualNum", "GreaterOrEqualNum"} {
+				numeric = numeric || strings.Contains(buf.String(), name)
+			}
+			if numeric != test.numeric {
+				t.Fatalf("expected numeric=%v, got %v:\n%s", test.numeric, numeric, buf.String())
+			}
+		})
+	}
+}
+
+func TestCompareSpecialNum(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected string // disassembly of the first action's pattern, or "" if not specialized
+	}{
+		{`NR > 1`, "CompareSpecialNum Greater NR 1 (0)"},
+		{`FNR == 1`, "CompareSpecialNum Equals FNR 1 (0)"},
+		{`NF != 2*2`, "CompareSpecialNum NotEquals NF 4 (0)"},
+		{`NR <= 1.5`, "CompareSpecialNum LessOrEqual NR 1.5 (0)"},
+		{`1 < NR`, ""},
+		{`NR > x`, ""},
+		{`NR > "1"`, ""},
+		{`RSTART > 1`, ""},
+		{`NR ~ 1`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			var buf bytes.Buffer
+			err = prog.Disassemble(&buf)
+			if err != nil {
+				t.Fatalf("disassembly error: %v", err)
+			}
+			output := buf.String()
+			if test.expected == "" {
+				if strings.Contains(output, "CompareSpecialNum") {
+					t.Fatalf("expected no CompareSpecialNum, got:\n%s", output)
+				}
+				return
+			}
+			if !strings.Contains(output, "0000    "+test.expected+"\n") {
+				t.Fatalf("expected %q, got:\n%s", test.expected, output)
+			}
+		})
+	}
+}
+
+func TestDisassembleSource(t *testing.T) {
+	src := `BEGIN { x = 1
+  print x }
+
+NR > 1 { print $1 }
+function f(a) { return a * 2 }`
+	prog, err := parser.ParseProgram([]byte(src), nil)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	var buf bytes.Buffer
+	err = prog.DisassembleSource(&buf, []byte(src))
+	if err != nil {
+		t.Fatalf("disassembly error: %v", err)
+	}
+	expected := `        // BEGIN
+        # 1: BEGIN { x = 1
+0000    Num 1 (1)
+0002    AssignGlobal x
+        # 2: print x }
+0004    Global x
+0006    Print 1
+
+        // pattern
+        # 4: NR > 1 { print $1 }
+0000    CompareSpecialNum Greater NR 1 (1)
+
+        // { body }
+        # 4: NR > 1 { print $1 }
+0000    PrintFields 1
+
+        // function f(a)
+        # 5: function f(a) { return a * 2 }
+0000    Local a
+0002    Num 2 (0)
+0004    Multiply
+0005    Return
+
+`
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	// The source comments are ignored when assembling.
+	asm, err := compiler.Assemble(&buf, nil)
+	if err != nil {
+		t.Fatalf("assemble error: %v", err)
+	}
+	var plain, reassembled bytes.Buffer
+	err = prog.Disassemble(&plain)
+	if err != nil {
+		t.Fatalf("disassembly error: %v", err)
+	}
+	err = asm.Disassemble(&reassembled)
+	if err != nil {
+		t.Fatalf("disassembly error: %v", err)
+	}
+	if reassembled.String() != plain.String() {
+		t.Fatalf("expected:\n%s\ngot:\n%s", plain.String(), reassembled.String())
+	}
+}
+
+func TestDisassembleJSON(t *testing.T) {
+	src := `BEGIN { x = 1
+  print x }
+NR > 1 { print $1 }
+function f(a) { return a * 2 }`
+	prog, err := parser.ParseProgram([]byte(src), nil)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	var buf bytes.Buffer
+	err = prog.DisassembleJSON(&buf)
+	if err != nil {
+		t.Fatalf("disassembly error: %v", err)
+	}
+	expected := []string{
+		`{"block":"BEGIN","addr":0,"opcode":"Num","operands":[1],"args":"1 (1)","line":1,"column":9}`,
+		`{"block":"BEGIN","addr":2,"opcode":"AssignGlobal","operands":[0],"args":"x","line":1,"column":9}`,
+		`{"block":"BEGIN","addr":4,"opcode":"Global","operands":[0],"args":"x","line":2,"column":3}`,
+		`{"block":"BEGIN","addr":6,"opcode":"Print","operands":[1,0],"args":"1","line":2,"column":3}`,
+		`{"block":"pattern","action":0,"addr":0,"opcode":"CompareSpecialNum","operands":[51,8,1],"args":"Greater NR 1 (1)","line":3,"column":1}`,
+		`{"block":"{ body }","action":0,"addr":0,"opcode":"PrintFields","operands":[1,1],"args":"1","line":3,"column":10}`,
+		`{"block":"function f","addr":0,"opcode":"Local","operands":[0],"args":"a","line":4,"column":17}`,
+		`{"block":"function f","addr":2,"opcode":"Num","operands":[0],"args":"2 (0)","line":4,"column":17}`,
+		`{"block":"function f","addr":4,"opcode":"Multiply","operands":[],"line":4,"column":17}`,
+		`{"block":"function f","addr":5,"opcode":"Return","operands":[],"line":4,"column":17}`,
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
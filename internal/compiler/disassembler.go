@@ -3,75 +3,98 @@
 package compiler
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math"
+	"sort"
+	"strconv"
 	"strings"
 
-	"github.com/benhoyt/goawk/internal/ast"
+	"github.com/benhoyt/goawk/ast"
 	"github.com/benhoyt/goawk/lexer"
 )
 
 // Disassemble writes a human-readable form of the program's virtual machine
 // instructions to writer.
 func (p *Program) Disassemble(writer io.Writer) error {
-	if p.Begin != nil {
+	return p.disassemble(writer, false, nil)
+}
+
+// DisassembleSource is like Disassemble, but above each group of
+// instructions it writes the line of src they were compiled from, as a
+// comment like "# 3: print x". src must be the source the program was
+// compiled from. Assemble ignores these comments.
+func (p *Program) DisassembleSource(writer io.Writer, src []byte) error {
+	return p.disassemble(writer, false, bytes.Split(src, []byte{'\n'}))
+}
+
+// DisassembleJSON writes the program's virtual machine instructions to
+// writer in JSON Lines format: one JSON object per instruction, with
+// these fields:
+//
+//	block     code block: "BEGIN", "pattern", "start", "stop" (range
+//	          pattern), "{ body }", "END", or "function name"
+//	action    index of pattern-action block (pattern and body only)
+//	addr      address of instruction within the block
+//	opcode    opcode name, for example "AssignGlobal"
+//	operands  raw operand values (array, possibly empty)
+//	args      operands as in Disassemble, with names resolved, for
+//	          example "x" for "AssignGlobal x" (omitted if none)
+//	line      source line of the statement or pattern the
+//	          instruction came from (omitted if unknown)
+//	column    source column of same (omitted if unknown)
+func (p *Program) DisassembleJSON(writer io.Writer) error {
+	return p.disassemble(writer, true, nil)
+}
+
+func (p *Program) disassemble(writer io.Writer, asJSON bool, srcLines [][]byte) error {
+	block := func(code []Opcode, positions []SourcePos, name, header string, action, funcIndex int) error {
 		d := &disassembler{
 			program:         p,
 			writer:          writer,
-			code:            p.Begin,
+			code:            code,
 			nativeFuncNames: p.nativeFuncNames,
+			funcIndex:       funcIndex,
+			json:            asJSON,
+			positions:       positions,
+			action:          action,
+			srcLines:        srcLines,
 		}
-		err := d.disassemble("BEGIN")
+		return d.disassemble(name, header)
+	}
+
+	if p.Begin != nil {
+		err := block(p.Begin, p.BeginPos, "BEGIN", "BEGIN", -1, 0)
 		if err != nil {
 			return err
 		}
 	}
 
-	for _, action := range p.Actions {
+	for i, action := range p.Actions {
 		switch len(action.Pattern) {
 		case 0:
 			// Nothing to do here.
 		case 1:
-			d := &disassembler{
-				program:         p,
-				writer:          writer,
-				code:            action.Pattern[0],
-				nativeFuncNames: p.nativeFuncNames,
-			}
-			err := d.disassemble("pattern")
+			err := block(action.Pattern[0], action.PatternPos[0], "pattern", "pattern", i, 0)
 			if err != nil {
 				return err
 			}
 		case 2:
-			d := &disassembler{
-				program:         p,
-				writer:          writer,
-				code:            action.Pattern[0],
-				nativeFuncNames: p.nativeFuncNames,
-			}
-			err := d.disassemble("start")
+			err := block(action.Pattern[0], action.PatternPos[0], "start", "start", i, 0)
 			if err != nil {
 				return err
 			}
-			d = &disassembler{
-				program:         p,
-				writer:          writer,
-				code:            action.Pattern[1],
-				nativeFuncNames: p.nativeFuncNames,
-			}
-			err = d.disassemble("stop")
+			err = block(action.Pattern[1], action.PatternPos[1], "stop", "stop", i, 0)
 			if err != nil {
 				return err
 			}
 		}
-		if len(action.Body) > 0 {
-			d := &disassembler{
-				program:         p,
-				writer:          writer,
-				code:            action.Body,
-				nativeFuncNames: p.nativeFuncNames,
-			}
-			err := d.disassemble("{ body }")
+		// An action with neither pattern nor body ("{}") still needs a
+		// header, as it makes the program read its input.
+		if len(action.Body) > 0 || len(action.Pattern) == 0 {
+			err := block(action.Body, action.BodyPos, "{ body }", "{ body }", i, 0)
 			if err != nil {
 				return err
 			}
@@ -79,27 +102,14 @@ func (p *Program) Disassemble(writer io.Writer) error {
 	}
 
 	if p.End != nil {
-		d := &disassembler{
-			program:         p,
-			writer:          writer,
-			code:            p.End,
-			nativeFuncNames: p.nativeFuncNames,
-		}
-		err := d.disassemble("END")
+		err := block(p.End, p.EndPos, "END", "END", -1, 0)
 		if err != nil {
 			return err
 		}
 	}
 
 	for i, f := range p.Functions {
-		d := &disassembler{
-			program:         p,
-			writer:          writer,
-			code:            f.Body,
-			nativeFuncNames: p.nativeFuncNames,
-			funcIndex:       i,
-		}
-		err := d.disassemble("function " + f.Name)
+		err := block(f.Body, f.BodyPos, "function "+f.Name, functionHeader(f), -1, i)
 		if err != nil {
 			return err
 		}
@@ -108,6 +118,19 @@ func (p *Program) Disassemble(writer io.Writer) error {
 	return nil
 }
 
+// Return the header line for function f, for example "function f(a, b[])",
+// with array parameters marked by "[]".
+func functionHeader(f Function) string {
+	params := make([]string, len(f.Params))
+	for i, param := range f.Params {
+		if f.Arrays[i] {
+			param += "[]"
+		}
+		params[i] = param
+	}
+	return "function " + f.Name + "(" + strings.Join(params, ", ") + ")"
+}
+
 // Disassembles a single block of opcodes.
 type disassembler struct {
 	program         *Program
@@ -117,27 +140,90 @@ type disassembler struct {
 	funcIndex       int
 	ip              int
 	opAddr          int
+	superOp         Opcode // superinstruction being written, or Nop
 	err             error
+
+	json      bool        // write JSON Lines instead of text
+	positions []SourcePos // source positions for code
+	action    int         // index of action for pattern and body blocks, else -1
+	block     string      // name of block (for JSON output)
+
+	srcLines [][]byte // source lines to write above instructions, or nil
+	posIndex int      // index of next source position to write
+	lastLine int      // source line last written, or 0
+}
+
+// Format the number constant at index with its index, like "1.5 (3)".
+func (d *disassembler) num(index Opcode) string {
+	num := d.program.Nums[index]
+	if num == math.Trunc(num) && math.Abs(num) < 1e15 && !math.Signbit(num) {
+		return fmt.Sprintf("%d (%d)", int(num), index)
+	}
+	// Full precision, so that Assemble gets the same number back
+	return fmt.Sprintf("%s (%d)", strconv.FormatFloat(num, 'g', -1, 64), index)
+}
+
+// Return the entries of a Switch instruction's table as space-separated
+// key:target pairs, like `"a":0x0010 "b":0x0014 default:0x0018`, in
+// order of target address.
+func (d *disassembler) jumpTable(table JumpTable) string {
+	type entry struct {
+		key    string
+		target int
+	}
+	var entries []entry
+	if table.Nums != nil {
+		for n, offset := range table.Nums {
+			entries = append(entries, entry{strconv.FormatFloat(n, 'f', -1, 64), d.ip + offset})
+		}
+	} else {
+		for s, offset := range table.Strs {
+			entries = append(entries, entry{strconv.Quote(s), d.ip + offset})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].target != entries[j].target {
+			return entries[i].target < entries[j].target
+		}
+		return entries[i].key < entries[j].key
+	})
+	var parts []string
+	for _, e := range entries {
+		parts = append(parts, fmt.Sprintf("%s:0x%04x", e.key, e.target))
+	}
+	parts = append(parts, fmt.Sprintf("default:0x%04x", d.ip+table.Default))
+	return strings.Join(parts, " ")
 }
 
-func (d *disassembler) disassemble(prefix string) error {
-	if prefix != "" {
-		d.writef("        // %s\n", prefix)
+func (d *disassembler) disassemble(block, header string) error {
+	d.block = block
+	if header != "" && !d.json {
+		d.writef("        // %s\n", header)
 	}
 
 	for d.ip < len(d.code) && d.err == nil {
 		d.opAddr = d.ip
+		if d.srcLines != nil {
+			d.writeSourceLine()
+		}
 		op := d.fetch()
+		d.superOp = Nop
+		if base := baseOpcode(op); base != op {
+			// Superinstruction, written like its first instruction
+			d.superOp = op
+			op = base
+		}
 
 		switch op {
 		case Num:
 			index := d.fetch()
-			num := d.program.Nums[index]
-			if num == float64(int(num)) {
-				d.writeOpf("Num %d (%d)", int(num), index)
-			} else {
-				d.writeOpf("Num %.6g (%d)", num, index)
-			}
+			d.writeOpf("Num %s", d.num(index))
+
+		case CompareSpecialNum:
+			compareOp := d.fetch()
+			index := d.fetch()
+			numIndex := d.fetch()
+			d.writeOpf("CompareSpecialNum %s %s %s", compareOp, ast.SpecialVarName(int(index)), d.num(numIndex))
 
 		case Str:
 			index := d.fetch()
@@ -251,7 +337,7 @@ func (d *disassembler) disassemble(prefix string) error {
 		case AugAssignSpecial:
 			operation := AugOp(d.fetch())
 			index := d.fetch()
-			d.writeOpf("AugAssignSpecial %s %d", operation, ast.SpecialVarName(int(index)))
+			d.writeOpf("AugAssignSpecial %s %s", operation, ast.SpecialVarName(int(index)))
 
 		case AugAssignArrayGlobal:
 			operation := AugOp(d.fetch())
@@ -283,6 +369,14 @@ func (d *disassembler) disassemble(prefix string) error {
 			offset := d.fetch()
 			d.writeOpf("JumpFalse 0x%04x", d.ip+int(offset))
 
+		case Switch:
+			table := d.program.JumpTables[d.fetch()]
+			d.writeOpf("Switch %s", d.jumpTable(table))
+
+		case SumFields:
+			start := d.fetch()
+			d.writeOpf("SumFields %d", start)
+
 		case JumpTrue:
 			offset := d.fetch()
 			d.writeOpf("JumpTrue 0x%04x", d.ip+int(offset))
@@ -311,6 +405,30 @@ func (d *disassembler) disassemble(prefix string) error {
 			offset := d.fetch()
 			d.writeOpf("JumpGreaterOrEqual 0x%04x", d.ip+int(offset))
 
+		case JumpEqualsNum:
+			offset := d.fetch()
+			d.writeOpf("JumpEqualsNum 0x%04x", d.ip+int(offset))
+
+		case JumpNotEqualsNum:
+			offset := d.fetch()
+			d.writeOpf("JumpNotEqualsNum 0x%04x", d.ip+int(offset))
+
+		case JumpLessNum:
+			offset := d.fetch()
+			d.writeOpf("JumpLessNum 0x%04x", d.ip+int(offset))
+
+		case JumpGreaterNum:
+			offset := d.fetch()
+			d.writeOpf("JumpGreaterNum 0x%04x", d.ip+int(offset))
+
+		case JumpLessOrEqualNum:
+			offset := d.fetch()
+			d.writeOpf("JumpLessOrEqualNum 0x%04x", d.ip+int(offset))
+
+		case JumpGreaterOrEqualNum:
+			offset := d.fetch()
+			d.writeOpf("JumpGreaterOrEqualNum 0x%04x", d.ip+int(offset))
+
 		case ForIn:
 			varScope := ast.VarScope(d.fetch())
 			varIndex := int(d.fetch())
@@ -333,11 +451,46 @@ func (d *disassembler) disassemble(prefix string) error {
 			arrayIndex := int(d.fetch())
 			d.writeOpf("CallSplitSep %s", d.arrayName(arrayScope, arrayIndex))
 
-		case CallSprintf:
+		case CallSplitSeps:
+			arrayScope := ast.VarScope(d.fetch())
+			arrayIndex := int(d.fetch())
+			sepsScope := ast.VarScope(d.fetch())
+			sepsIndex := int(d.fetch())
+			d.writeOpf("CallSplitSeps %s %s", d.arrayName(arrayScope, arrayIndex), d.arrayName(sepsScope, sepsIndex))
+
+		case CallMatch:
+			arrayScope := ast.VarScope(d.fetch())
+			arrayIndex := int(d.fetch())
+			d.writeOpf("CallMatch %s", d.arrayName(arrayScope, arrayIndex))
+
+		case CallParsequery, CallGlob, CallStat:
+			arrayScope := ast.VarScope(d.fetch())
+			arrayIndex := int(d.fetch())
+			d.writeOpf("%s %s", op, d.arrayName(arrayScope, arrayIndex))
+
+		case CallCopy, CallKeys, CallValues:
+			srcScope := ast.VarScope(d.fetch())
+			srcIndex := int(d.fetch())
+			dstScope := ast.VarScope(d.fetch())
+			dstIndex := int(d.fetch())
+			d.writeOpf("%s %s %s", op, d.arrayName(srcScope, srcIndex), d.arrayName(dstScope, dstIndex))
+
+		case CallSprintf, CallMax, CallMin, CallSqlExec:
 			numArgs := d.fetch()
-			d.writeOpf("CallSprintf %d", numArgs)
+			d.writeOpf("%s %d", op, numArgs)
+
+		case CallSqlQuery:
+			arrayScope := ast.VarScope(d.fetch())
+			arrayIndex := int(d.fetch())
+			numArgs := d.fetch()
+			d.writeOpf("CallSqlQuery %s %d", d.arrayName(arrayScope, arrayIndex), numArgs)
+
+		case CallDumparr:
+			arrayScope := ast.VarScope(d.fetch())
+			arrayIndex := int(d.fetch())
+			d.writeOpf("CallDumparr %s", d.arrayName(arrayScope, arrayIndex))
 
-		case CallUser:
+		case CallUser, TailCall:
 			funcIndex := d.fetch()
 			numArrayArgs := int(d.fetch())
 			var arrayArgs []string
@@ -346,7 +499,7 @@ func (d *disassembler) disassemble(prefix string) error {
 				arrayIndex := int(d.fetch())
 				arrayArgs = append(arrayArgs, d.arrayName(arrayScope, arrayIndex))
 			}
-			d.writeOpf("CallUser %s [%s]", d.program.Functions[funcIndex].Name, strings.Join(arrayArgs, ", "))
+			d.writeOpf("%s %s [%s]", op, d.program.Functions[funcIndex].Name, strings.Join(arrayArgs, ", "))
 
 		case CallNative:
 			funcIndex := d.fetch()
@@ -357,6 +510,10 @@ func (d *disassembler) disassemble(prefix string) error {
 			numNulls := d.fetch()
 			d.writeOpf("Nulls %d", numNulls)
 
+		case Cover:
+			coverIndex := d.fetch()
+			d.writeOpf("Cover %d", coverIndex)
+
 		case Print:
 			numArgs := d.fetch()
 			redirect := lexer.Token(d.fetch())
@@ -366,6 +523,27 @@ func (d *disassembler) disassemble(prefix string) error {
 				d.writeOpf("Print %d %s", numArgs, redirect)
 			}
 
+		case PrintFields:
+			numFields := int(d.fetch())
+			indexes := make([]string, numFields)
+			for i := range indexes {
+				indexes[i] = strconv.Itoa(int(d.fetch()))
+			}
+			d.writeOpf("PrintFields %s", strings.Join(indexes, " "))
+
+		case PrintSorted:
+			varScope := ast.VarScope(d.fetch())
+			varIndex := int(d.fetch())
+			arrayScope := ast.VarScope(d.fetch())
+			arrayIndex := int(d.fetch())
+			numArgs := d.fetch()
+			redirect := lexer.Token(d.fetch())
+			if redirect == lexer.ILLEGAL {
+				d.writeOpf("PrintSorted %s %s %d", d.varName(varScope, varIndex), d.arrayName(arrayScope, arrayIndex), numArgs)
+			} else {
+				d.writeOpf("PrintSorted %s %s %d %s", d.varName(varScope, varIndex), d.arrayName(arrayScope, arrayIndex), numArgs, redirect)
+			}
+
 		case Printf:
 			numArgs := d.fetch()
 			redirect := lexer.Token(d.fetch())
@@ -410,10 +588,26 @@ func (d *disassembler) disassemble(prefix string) error {
 		}
 	}
 
-	d.writef("\n")
+	if !d.json {
+		d.writef("\n")
+	}
 	return d.err
 }
 
+// If a group of instructions compiled from a different source line
+// starts at the current instruction, write that line as a comment.
+func (d *disassembler) writeSourceLine() {
+	for d.posIndex < len(d.positions) && d.positions[d.posIndex].Addr <= d.opAddr {
+		line := d.positions[d.posIndex].Pos.Line
+		d.posIndex++
+		if line < 1 || line > len(d.srcLines) || line == d.lastLine {
+			continue
+		}
+		d.writef("        # %d: %s\n", line, bytes.TrimSpace(d.srcLines[line-1]))
+		d.lastLine = line
+	}
+}
+
 // Fetch the next opcode and increment the "instruction pointer".
 func (d *disassembler) fetch() Opcode {
 	op := d.code[d.ip]
@@ -434,6 +628,13 @@ func (d *disassembler) writeOpf(format string, args ...interface{}) {
 	if d.err != nil {
 		return
 	}
+	if d.superOp != Nop {
+		format = d.superOp.String() + strings.TrimPrefix(format, baseOpcode(d.superOp).String())
+	}
+	if d.json {
+		d.writeJSON(fmt.Sprintf(format, args...))
+		return
+	}
 	addrStr := fmt.Sprintf("%04x", d.opAddr)
 	_, d.err = fmt.Fprintf(d.writer, addrStr+"    "+format+"\n", args...)
 }
@@ -489,3 +690,48 @@ func (d *disassembler) localArrayName(index int) string {
 	}
 	panic(fmt.Sprintf("unexpected local array index %d", index))
 }
+
+// JSON form of a single instruction (see DisassembleJSON).
+type jsonInstruction struct {
+	Block    string `json:"block"`
+	Action   *int   `json:"action,omitempty"`
+	Addr     int    `json:"addr"`
+	Opcode   string `json:"opcode"`
+	Operands []int  `json:"operands"`
+	Args     string `json:"args,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+}
+
+// Write the current instruction as a line of JSON, given its text
+// form (opcode name followed by resolved arguments).
+func (d *disassembler) writeJSON(text string) {
+	op := d.code[d.opAddr]
+	inst := jsonInstruction{
+		Block:    d.block,
+		Addr:     d.opAddr,
+		Opcode:   op.String(),
+		Operands: make([]int, 0, d.ip-d.opAddr-1),
+	}
+	if d.action >= 0 {
+		inst.Action = &d.action
+	}
+	for _, operand := range d.code[d.opAddr+1 : d.ip] {
+		inst.Operands = append(inst.Operands, int(operand))
+	}
+	inst.Args = strings.TrimSpace(strings.TrimPrefix(text, inst.Opcode))
+	for _, p := range d.positions {
+		if p.Addr > d.opAddr {
+			break
+		}
+		inst.Line = p.Pos.Line
+		inst.Column = p.Pos.Column
+	}
+	data, err := json.Marshal(inst)
+	if err != nil {
+		d.err = err
+		return
+	}
+	data = append(data, '\n')
+	_, d.err = d.writer.Write(data)
+}
@@ -29,6 +29,7 @@ func TestDisassembler(t *testing.T) {
 				scalarNames:     []string{"s"},
 				arrayNames:      []string{"a"},
 				nativeFuncNames: []string{"n"},
+				JumpTables:      []JumpTable{{Strs: map[string]int{"x": 0}}},
 			}
 			var buf bytes.Buffer
 			err := p.Disassemble(&buf)
@@ -0,0 +1,133 @@
+// Compiling loops that sum fields to SumFields instructions
+
+package compiler
+
+import (
+	"github.com/benhoyt/goawk/ast"
+	"github.com/benhoyt/goawk/lexer"
+)
+
+// Compile s to a SumFields instruction if it's a loop like
+// "for (i=1; i<=NF; i++) s += $i", reporting whether it did. The
+// instruction adds the fields to s one by one, like the loop does, so
+// the result is the same, and leaves i with the value the loop would.
+func (c *compiler) sumFields(s *ast.ForStmt) bool {
+	if c.program.coverIndex != nil {
+		// The body would need its own Cover count
+		return false
+	}
+	loopVar, start, ok := fieldSumStart(s.Pre)
+	if !ok || !isLoopVarLessOrEqualNF(s.Cond, loopVar) || !isIncrement(s.Post, loopVar) {
+		return false
+	}
+	sumVar, ok := fieldSumBody(s.Body, loopVar)
+	if !ok {
+		return false
+	}
+
+	c.stmt(s.Pre)
+	c.expr(sumVar)
+	c.add(SumFields, opcodeInt(start))
+	c.assign(sumVar)
+	c.assign(loopVar)
+	return true
+}
+
+// If stmt is "i = n", where n is a non-negative integer constant, return
+// i and n.
+func fieldSumStart(stmt ast.Stmt) (*ast.VarExpr, int, bool) {
+	s, ok := stmt.(*ast.ExprStmt)
+	if !ok {
+		return nil, 0, false
+	}
+	e, ok := s.Expr.(*ast.AssignExpr)
+	if !ok {
+		return nil, 0, false
+	}
+	v, ok := scalarVar(e.Left)
+	if !ok {
+		return nil, 0, false
+	}
+	n, ok := e.Right.(*ast.NumExpr)
+	if !ok || n.Value != float64(int(n.Value)) || n.Value < 0 || n.Value > maxFieldSumStart {
+		return nil, 0, false
+	}
+	return v, int(n.Value), true
+}
+
+// Larger starting fields are unlikely, and this keeps the operand in
+// range.
+const maxFieldSumStart = 1 << 20
+
+// Report whether expr is "v <= NF".
+func isLoopVarLessOrEqualNF(expr ast.Expr, v *ast.VarExpr) bool {
+	e, ok := expr.(*ast.BinaryExpr)
+	if !ok || e.Op != lexer.LTE || !sameSubject(e.Left, v) {
+		return false
+	}
+	nf, ok := e.Right.(*ast.VarExpr)
+	return ok && nf.Scope == ast.ScopeSpecial && nf.Index == ast.V_NF
+}
+
+// Report whether stmt is "v++", "++v", or "v += 1".
+func isIncrement(stmt ast.Stmt, v *ast.VarExpr) bool {
+	s, ok := stmt.(*ast.ExprStmt)
+	if !ok {
+		return false
+	}
+	switch e := s.Expr.(type) {
+	case *ast.IncrExpr:
+		return e.Op == lexer.INCR && sameSubject(e.Expr, v)
+	case *ast.AugAssignExpr:
+		n, ok := e.Right.(*ast.NumExpr)
+		return e.Op == lexer.ADD && sameSubject(e.Left, v) && ok && n.Value == 1
+	}
+	return false
+}
+
+// If body is "s += $i" or "s = s + $i", where i is loopVar and s is
+// another scalar variable, return s.
+func fieldSumBody(body ast.Stmts, loopVar *ast.VarExpr) (*ast.VarExpr, bool) {
+	if len(body) != 1 {
+		return nil, false
+	}
+	s, ok := body[0].(*ast.ExprStmt)
+	if !ok {
+		return nil, false
+	}
+	var left, field ast.Expr
+	switch e := s.Expr.(type) {
+	case *ast.AugAssignExpr:
+		if e.Op != lexer.ADD {
+			return nil, false
+		}
+		left, field = e.Left, e.Right
+	case *ast.AssignExpr:
+		add, ok := e.Right.(*ast.BinaryExpr)
+		if !ok || add.Op != lexer.ADD || !sameSubject(add.Left, e.Left) {
+			return nil, false
+		}
+		left, field = e.Left, add.Right
+	default:
+		return nil, false
+	}
+	sumVar, ok := scalarVar(left)
+	if !ok || sameSubject(sumVar, loopVar) {
+		return nil, false
+	}
+	f, ok := field.(*ast.FieldExpr)
+	if !ok || !sameSubject(f.Index, loopVar) {
+		return nil, false
+	}
+	return sumVar, true
+}
+
+// If expr is a global or local scalar variable (not a special
+// variable, as assigning those has side effects), return it.
+func scalarVar(expr ast.Expr) (*ast.VarExpr, bool) {
+	v, ok := expr.(*ast.VarExpr)
+	if !ok || (v.Scope != ast.ScopeGlobal && v.Scope != ast.ScopeLocal) {
+		return nil, false
+	}
+	return v, true
+}
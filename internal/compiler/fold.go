@@ -0,0 +1,157 @@
+// Constant folding of expressions at compile time
+
+package compiler
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+
+	"github.com/benhoyt/goawk/ast"
+	"github.com/benhoyt/goawk/lexer"
+)
+
+// foldConst returns the *ast.NumExpr or *ast.StrExpr that expr
+// evaluates to if it's a constant expression, for example 60*60*24 or
+// "a" "b", otherwise nil. Results are memoized, so calling this on
+// each sub-expression as it's compiled is still linear.
+func (c *compiler) foldConst(expr ast.Expr) ast.Expr {
+	switch expr.(type) {
+	case *ast.NumExpr, *ast.StrExpr:
+		return expr
+	case *ast.UnaryExpr, *ast.BinaryExpr:
+		// Only these can be folded, fall through to memoized fold()
+	default:
+		return nil
+	}
+	if folded, ok := c.folded[expr]; ok {
+		return folded
+	}
+	folded := c.fold(expr)
+	if c.folded == nil {
+		c.folded = make(map[ast.Expr]ast.Expr)
+	}
+	c.folded[expr] = folded
+	return folded
+}
+
+func (c *compiler) fold(expr ast.Expr) ast.Expr {
+	switch e := expr.(type) {
+	case *ast.UnaryExpr:
+		value := c.foldConst(e.Value)
+		switch v := value.(type) {
+		case *ast.NumExpr:
+			switch e.Op {
+			case lexer.SUB:
+				return &ast.NumExpr{Value: -v.Value}
+			case lexer.ADD:
+				return v
+			case lexer.NOT:
+				return boolExpr(v.Value == 0)
+			}
+		case *ast.StrExpr:
+			if e.Op == lexer.NOT {
+				return boolExpr(v.Value == "")
+			}
+		}
+
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case lexer.ADD, lexer.SUB, lexer.MUL, lexer.DIV, lexer.MOD, lexer.POW:
+			left, ok := c.foldConst(e.Left).(*ast.NumExpr)
+			if !ok {
+				return nil
+			}
+			right, ok := c.foldConst(e.Right).(*ast.NumExpr)
+			if !ok {
+				return nil
+			}
+			l, r := left.Value, right.Value
+			switch e.Op {
+			case lexer.ADD:
+				return &ast.NumExpr{Value: l + r}
+			case lexer.SUB:
+				return &ast.NumExpr{Value: l - r}
+			case lexer.MUL:
+				return &ast.NumExpr{Value: l * r}
+			case lexer.DIV:
+				if r == 0 {
+					return nil // leave "division by zero" as a runtime error
+				}
+				return &ast.NumExpr{Value: l / r}
+			case lexer.MOD:
+				if r == 0 {
+					return nil
+				}
+				return &ast.NumExpr{Value: math.Mod(l, r)}
+			default: // POW
+				return &ast.NumExpr{Value: math.Pow(l, r)}
+			}
+
+		case lexer.CONCAT:
+			left, ok := c.constStr(e.Left)
+			if !ok {
+				return nil
+			}
+			right, ok := c.constStr(e.Right)
+			if !ok {
+				return nil
+			}
+			return &ast.StrExpr{Value: left + right}
+
+		case lexer.MATCH, lexer.NOT_MATCH:
+			s, ok := c.constStr(e.Left)
+			if !ok {
+				return nil
+			}
+			regex, ok := c.constStr(e.Right)
+			if !ok {
+				return nil
+			}
+			re, err := regexp.Compile(regex)
+			if err != nil {
+				return nil // leave "invalid regex" as a runtime error
+			}
+			matched := re.MatchString(s)
+			if e.Op == lexer.NOT_MATCH {
+				matched = !matched
+			}
+			return boolExpr(matched)
+		}
+	}
+	return nil
+}
+
+// constStr returns the string value of expr if it's a constant whose
+// string conversion doesn't depend on CONVFMT (strings and integers).
+func (c *compiler) constStr(expr ast.Expr) (string, bool) {
+	switch e := c.foldConst(expr).(type) {
+	case *ast.StrExpr:
+		return e.Value, true
+	case *ast.NumExpr:
+		// Same integer check the interpreter uses when converting to string
+		if e.Value == float64(int(e.Value)) {
+			return strconv.Itoa(int(e.Value)), true
+		}
+	}
+	return "", false
+}
+
+// constBool returns the truthiness of expr and true if it's a constant
+// expression, otherwise false, false.
+func (c *compiler) constBool(expr ast.Expr) (bool, bool) {
+	switch e := c.foldConst(expr).(type) {
+	case *ast.NumExpr:
+		return e.Value != 0, true
+	case *ast.StrExpr:
+		return e.Value != "", true
+	}
+	return false, false
+}
+
+func boolExpr(b bool) *ast.NumExpr {
+	if b {
+		return &ast.NumExpr{Value: 1}
+	}
+	return &ast.NumExpr{Value: 0}
+}
@@ -0,0 +1,171 @@
+// Inlining of small user-defined functions
+
+package compiler
+
+import (
+	"github.com/benhoyt/goawk/ast"
+	"github.com/benhoyt/goawk/lexer"
+)
+
+// Maximum number of expression nodes in the body of a function that's
+// inlined at its call sites.
+const maxInlineSize = 16
+
+// inlineBodies returns, for each function, the expression its body
+// returns if it can be inlined, otherwise nil. To be inlinable, a
+// function must have no array parameters and a body that is a single
+// "return expr" statement, where expr is small and has no side effects
+// (so no assignments, getline, or calls to user-defined functions,
+// which also rules out recursion).
+func inlineBodies(funcs []ast.Function) []ast.Expr {
+	bodies := make([]ast.Expr, len(funcs))
+	for i, f := range funcs {
+		if len(f.Body) != 1 {
+			continue
+		}
+		ret, ok := f.Body[0].(*ast.ReturnStmt)
+		if !ok || ret.Value == nil {
+			continue
+		}
+		arrays := false
+		for _, a := range f.Arrays {
+			arrays = arrays || a
+		}
+		if arrays {
+			continue
+		}
+		size, ok := pureSize(ret.Value)
+		if ok && size <= maxInlineSize {
+			bodies[i] = ret.Value
+		}
+	}
+	return bodies
+}
+
+// pureSize returns the number of nodes in expr and true if expr has no
+// side effects, otherwise false.
+func pureSize(expr ast.Expr) (int, bool) {
+	var children []ast.Expr
+	switch e := expr.(type) {
+	case *ast.NumExpr, *ast.StrExpr, *ast.RegExpr, *ast.VarExpr:
+	case *ast.FieldExpr:
+		children = []ast.Expr{e.Index}
+	case *ast.UnaryExpr:
+		children = []ast.Expr{e.Value}
+	case *ast.BinaryExpr:
+		children = []ast.Expr{e.Left, e.Right}
+	case *ast.CondExpr:
+		children = []ast.Expr{e.Cond, e.True, e.False}
+	case *ast.CallExpr:
+		switch e.Func {
+		case lexer.F_ATAN2, lexer.F_COS, lexer.F_EXP, lexer.F_INDEX, lexer.F_INT,
+			lexer.F_LENGTH, lexer.F_LOG, lexer.F_SIN, lexer.F_SQRT, lexer.F_SUBSTR,
+			lexer.F_TOLOWER, lexer.F_TOUPPER:
+			children = e.Args
+		default:
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	size := 1
+	for _, child := range children {
+		n, ok := pureSize(child)
+		if !ok {
+			return 0, false
+		}
+		size += n
+	}
+	return size, true
+}
+
+// inlineCall returns an expression equivalent to the call e with the
+// function body substituted in, or nil if the call can't be inlined.
+// Because each parameter reference is replaced by its argument
+// expression, arguments may be evaluated more than once or not at all,
+// so they're restricted to constants, variables, and fields.
+func (c *compiler) inlineCall(e *ast.UserCallExpr) ast.Expr {
+	if e.Native || e.Index >= len(c.program.inlineBodies) {
+		return nil
+	}
+	body := c.program.inlineBodies[e.Index]
+	if body == nil || len(e.Args) != len(c.program.Functions[e.Index].Params) {
+		return nil
+	}
+	for i, arg := range e.Args {
+		switch a := arg.(type) {
+		case *ast.NumExpr, *ast.StrExpr, *ast.VarExpr:
+		case *ast.FieldExpr:
+			// Reading a field fails if the index is invalid, so only
+			// inline if the body always evaluates the parameter.
+			switch a.Index.(type) {
+			case *ast.NumExpr, *ast.VarExpr:
+			default:
+				return nil
+			}
+			if !alwaysUses(body, i) {
+				return nil
+			}
+		default:
+			return nil
+		}
+	}
+	return substituteParams(body, e.Args)
+}
+
+// alwaysUses reports whether evaluating expr always evaluates local
+// (parameter) variable index.
+func alwaysUses(expr ast.Expr, index int) bool {
+	switch e := expr.(type) {
+	case *ast.VarExpr:
+		return e.Scope == ast.ScopeLocal && e.Index == index
+	case *ast.FieldExpr:
+		return alwaysUses(e.Index, index)
+	case *ast.UnaryExpr:
+		return alwaysUses(e.Value, index)
+	case *ast.BinaryExpr:
+		if e.Op == lexer.AND || e.Op == lexer.OR {
+			// Right side isn't evaluated if left short-circuits
+			return alwaysUses(e.Left, index)
+		}
+		return alwaysUses(e.Left, index) || alwaysUses(e.Right, index)
+	case *ast.CondExpr:
+		return alwaysUses(e.Cond, index) ||
+			(alwaysUses(e.True, index) && alwaysUses(e.False, index))
+	case *ast.CallExpr:
+		for _, arg := range e.Args {
+			if alwaysUses(arg, index) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// substituteParams returns a copy of the (pure) expression expr with
+// each parameter reference replaced by the corresponding argument.
+func substituteParams(expr ast.Expr, args []ast.Expr) ast.Expr {
+	switch e := expr.(type) {
+	case *ast.VarExpr:
+		if e.Scope == ast.ScopeLocal {
+			return args[e.Index]
+		}
+		return e
+	case *ast.FieldExpr:
+		return &ast.FieldExpr{Index: substituteParams(e.Index, args)}
+	case *ast.UnaryExpr:
+		return &ast.UnaryExpr{Op: e.Op, Value: substituteParams(e.Value, args)}
+	case *ast.BinaryExpr:
+		return &ast.BinaryExpr{Left: substituteParams(e.Left, args), Op: e.Op, Right: substituteParams(e.Right, args)}
+	case *ast.CondExpr:
+		return &ast.CondExpr{Cond: substituteParams(e.Cond, args), True: substituteParams(e.True, args), False: substituteParams(e.False, args)}
+	case *ast.CallExpr:
+		newArgs := make([]ast.Expr, len(e.Args))
+		for i, arg := range e.Args {
+			newArgs[i] = substituteParams(arg, args)
+		}
+		return &ast.CallExpr{Func: e.Func, Args: newArgs}
+	default: // NumExpr, StrExpr, RegExpr
+		return e
+	}
+}
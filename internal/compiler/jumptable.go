@@ -0,0 +1,224 @@
+// Compiling if-else chains that compare against constants to jump tables
+
+package compiler
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/benhoyt/goawk/ast"
+	"github.com/benhoyt/goawk/lexer"
+)
+
+// Minimum number of constants an if-else chain must compare its
+// subject against to be compiled to a Switch instruction.
+const minJumpTableKeys = 4
+
+// JumpTable holds the targets of a Switch instruction, which pops a
+// value and jumps to the offset given for it in the table, or to
+// Default if it's not there. Offsets are relative to the end of the
+// instruction, like other jumps.
+//
+// If Nums is nil, the table's keys are strings, and the value is
+// converted to a string (using CONVFMT) and looked up in Strs, as for
+// the == operator with a string constant. Otherwise the keys are
+// integers: a numeric value is looked up in Nums, and a string value
+// (one == would compare as a string) is looked up in Strs, which holds
+// the same keys formatted as decimal integers.
+type JumpTable struct {
+	Nums    map[float64]int
+	Strs    map[string]int
+	Default int
+}
+
+// A chain of "if (x == k1) ... else if (x == k2 || x == k3) ..." tests
+// that can be compiled to a jump table.
+type jumpChain struct {
+	subject ast.Expr     // expression compared in every condition
+	keys    [][]ast.Expr // constants each arm's condition compares with
+	bodies  []ast.Stmts  // body of each arm
+	other   ast.Stmts    // final else (including any later tests)
+}
+
+// Compile s to a Switch instruction if it starts a long enough
+// chain of comparisons against constants, reporting whether it did.
+func (c *compiler) jumpTable(s *ast.IfStmt) bool {
+	if c.program.coverIndex != nil {
+		// Each "else if" would need its own Cover count
+		return false
+	}
+	chain, ok := c.jumpChain(s)
+	if !ok {
+		return false
+	}
+
+	c.expr(chain.subject)
+	c.add(Switch, opcodeInt(len(c.program.JumpTables)))
+	tableEnd := len(c.code)
+	table := JumpTable{Strs: make(map[string]int)}
+	if _, isNum := chain.keys[0][0].(*ast.NumExpr); isNum {
+		table.Nums = make(map[float64]int)
+	}
+
+	var endMarks []int
+	for i, body := range chain.bodies {
+		offset := len(c.code) - tableEnd
+		for _, key := range chain.keys[i] {
+			// Like the original chain, the first test of a key wins
+			switch k := key.(type) {
+			case *ast.NumExpr:
+				if _, ok := table.Nums[k.Value]; !ok {
+					table.Nums[k.Value] = offset
+					table.Strs[strconv.FormatInt(int64(k.Value), 10)] = offset
+				}
+			case *ast.StrExpr:
+				if _, ok := table.Strs[k.Value]; !ok {
+					table.Strs[k.Value] = offset
+				}
+			}
+		}
+		c.stmts(body)
+		if i < len(chain.bodies)-1 || len(chain.other) > 0 {
+			endMarks = append(endMarks, c.jumpForward(Jump))
+		}
+	}
+	table.Default = len(c.code) - tableEnd
+	c.stmts(chain.other)
+	c.patchForwards(endMarks)
+	c.program.JumpTables = append(c.program.JumpTables, table)
+	return true
+}
+
+// Find the chain of tests starting at s, which must all compare the
+// same side-effect-free subject with constants of the same kind.
+func (c *compiler) jumpChain(s *ast.IfStmt) (jumpChain, bool) {
+	var chain jumpChain
+	numKeys := 0
+	for {
+		subject, keys := c.chainKeys(s.Cond, chain.subject, nil)
+		if subject == nil {
+			break
+		}
+		if chain.subject == nil {
+			chain.subject = subject
+		}
+		chain.keys = append(chain.keys, keys)
+		numKeys += len(keys)
+		chain.bodies = append(chain.bodies, s.Body)
+		chain.other = s.Else
+		// A later test that doesn't fit ends the chain, and becomes
+		// part of the final else
+		next, ok := singleIf(s.Else)
+		if !ok {
+			break
+		}
+		s = next
+	}
+	if numKeys < minJumpTableKeys {
+		return jumpChain{}, false
+	}
+	// All keys must be of the same kind
+	_, firstIsNum := chain.keys[0][0].(*ast.NumExpr)
+	for _, keys := range chain.keys {
+		for _, key := range keys {
+			if _, isNum := key.(*ast.NumExpr); isNum != firstIsNum {
+				return jumpChain{}, false
+			}
+		}
+	}
+	return chain, true
+}
+
+// If stmts is a single if statement (an "else if"), return it.
+func singleIf(stmts ast.Stmts) (*ast.IfStmt, bool) {
+	if len(stmts) != 1 {
+		return nil, false
+	}
+	s, ok := stmts[0].(*ast.IfStmt)
+	return s, ok
+}
+
+// If cond is "subject == k" or several of those joined with ||, where
+// k is a string or integer constant, return the subject and append the
+// constants to keys. The subject must match want if it's not nil.
+// Return a nil subject if cond isn't like that.
+func (c *compiler) chainKeys(cond ast.Expr, want ast.Expr, keys []ast.Expr) (ast.Expr, []ast.Expr) {
+	e, ok := cond.(*ast.BinaryExpr)
+	if !ok {
+		return nil, nil
+	}
+	switch e.Op {
+	case lexer.OR:
+		subject, keys := c.chainKeys(e.Left, want, keys)
+		if subject == nil {
+			return nil, nil
+		}
+		return c.chainKeys(e.Right, subject, keys)
+	case lexer.EQUALS:
+		subject, key := e.Left, c.tableKey(e.Right)
+		if key == nil {
+			subject, key = e.Right, c.tableKey(e.Left)
+		}
+		if key == nil || !simpleSubject(subject) || (want != nil && !sameSubject(subject, want)) {
+			return nil, nil
+		}
+		return subject, append(keys, key)
+	}
+	return nil, nil
+}
+
+// Return expr (after constant folding) if it's a string constant or an
+// integer constant that can be a jump table key, otherwise nil.
+func (c *compiler) tableKey(expr ast.Expr) ast.Expr {
+	if folded := c.foldConst(expr); folded != nil {
+		expr = folded
+	}
+	switch e := expr.(type) {
+	case *ast.StrExpr:
+		return e
+	case *ast.NumExpr:
+		if e.Value == math.Trunc(e.Value) && math.Abs(e.Value) < 1<<53 {
+			return e
+		}
+	}
+	return nil
+}
+
+// Report whether expr is a variable or a field with a constant or
+// variable index, which can be evaluated once instead of once for
+// each test in the chain.
+func simpleSubject(expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.VarExpr:
+		return true
+	case *ast.FieldExpr:
+		switch e.Index.(type) {
+		case *ast.NumExpr, *ast.VarExpr:
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether simple subjects a and b are the same expression.
+func sameSubject(a, b ast.Expr) bool {
+	switch a := a.(type) {
+	case *ast.VarExpr:
+		b, ok := b.(*ast.VarExpr)
+		return ok && a.Scope == b.Scope && a.Index == b.Index
+	case *ast.FieldExpr:
+		b, ok := b.(*ast.FieldExpr)
+		if !ok {
+			return false
+		}
+		switch ai := a.Index.(type) {
+		case *ast.NumExpr:
+			bi, ok := b.Index.(*ast.NumExpr)
+			return ok && ai.Value == bi.Value
+		case *ast.VarExpr:
+			bi, ok := b.Index.(*ast.VarExpr)
+			return ok && ai.Scope == bi.Scope && ai.Index == bi.Index
+		}
+	}
+	return false
+}
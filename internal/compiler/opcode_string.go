@@ -23,84 +23,124 @@ func _() {
 	_ = x[ArrayLocal-12]
 	_ = x[InGlobal-13]
 	_ = x[InLocal-14]
-	_ = x[AssignField-15]
-	_ = x[AssignGlobal-16]
-	_ = x[AssignLocal-17]
-	_ = x[AssignSpecial-18]
-	_ = x[AssignArrayGlobal-19]
-	_ = x[AssignArrayLocal-20]
-	_ = x[Delete-21]
-	_ = x[DeleteAll-22]
-	_ = x[IncrField-23]
-	_ = x[IncrGlobal-24]
-	_ = x[IncrLocal-25]
-	_ = x[IncrSpecial-26]
-	_ = x[IncrArrayGlobal-27]
-	_ = x[IncrArrayLocal-28]
-	_ = x[AugAssignField-29]
-	_ = x[AugAssignGlobal-30]
-	_ = x[AugAssignLocal-31]
-	_ = x[AugAssignSpecial-32]
-	_ = x[AugAssignArrayGlobal-33]
-	_ = x[AugAssignArrayLocal-34]
-	_ = x[Regex-35]
-	_ = x[IndexMulti-36]
-	_ = x[ConcatMulti-37]
-	_ = x[Add-38]
-	_ = x[Subtract-39]
-	_ = x[Multiply-40]
-	_ = x[Divide-41]
-	_ = x[Power-42]
-	_ = x[Modulo-43]
-	_ = x[Equals-44]
-	_ = x[NotEquals-45]
-	_ = x[Less-46]
-	_ = x[Greater-47]
-	_ = x[LessOrEqual-48]
-	_ = x[GreaterOrEqual-49]
-	_ = x[Concat2-50]
-	_ = x[Match-51]
-	_ = x[NotMatch-52]
-	_ = x[Not-53]
-	_ = x[UnaryMinus-54]
-	_ = x[UnaryPlus-55]
-	_ = x[Boolean-56]
-	_ = x[Jump-57]
-	_ = x[JumpFalse-58]
-	_ = x[JumpTrue-59]
-	_ = x[JumpEquals-60]
-	_ = x[JumpNotEquals-61]
-	_ = x[JumpLess-62]
-	_ = x[JumpGreater-63]
-	_ = x[JumpLessOrEqual-64]
-	_ = x[JumpGreaterOrEqual-65]
-	_ = x[Next-66]
-	_ = x[Exit-67]
-	_ = x[ForIn-68]
-	_ = x[BreakForIn-69]
-	_ = x[CallBuiltin-70]
-	_ = x[CallSplit-71]
-	_ = x[CallSplitSep-72]
-	_ = x[CallSprintf-73]
-	_ = x[CallUser-74]
-	_ = x[CallNative-75]
-	_ = x[Return-76]
-	_ = x[ReturnNull-77]
-	_ = x[Nulls-78]
-	_ = x[Print-79]
-	_ = x[Printf-80]
-	_ = x[Getline-81]
-	_ = x[GetlineField-82]
-	_ = x[GetlineGlobal-83]
-	_ = x[GetlineLocal-84]
-	_ = x[GetlineSpecial-85]
-	_ = x[GetlineArray-86]
-	_ = x[EndOpcode-87]
+	_ = x[Record-15]
+	_ = x[SpecialNF-16]
+	_ = x[SpecialNR-17]
+	_ = x[CachedNF-18]
+	_ = x[AssignField-19]
+	_ = x[AssignGlobal-20]
+	_ = x[AssignLocal-21]
+	_ = x[AssignSpecial-22]
+	_ = x[AssignArrayGlobal-23]
+	_ = x[AssignArrayLocal-24]
+	_ = x[Delete-25]
+	_ = x[DeleteAll-26]
+	_ = x[IncrField-27]
+	_ = x[IncrGlobal-28]
+	_ = x[IncrLocal-29]
+	_ = x[IncrSpecial-30]
+	_ = x[IncrArrayGlobal-31]
+	_ = x[IncrArrayLocal-32]
+	_ = x[AugAssignField-33]
+	_ = x[AugAssignGlobal-34]
+	_ = x[AugAssignLocal-35]
+	_ = x[AugAssignSpecial-36]
+	_ = x[AugAssignArrayGlobal-37]
+	_ = x[AugAssignArrayLocal-38]
+	_ = x[Regex-39]
+	_ = x[IndexMulti-40]
+	_ = x[ConcatMulti-41]
+	_ = x[Add-42]
+	_ = x[Subtract-43]
+	_ = x[Multiply-44]
+	_ = x[Divide-45]
+	_ = x[Power-46]
+	_ = x[Modulo-47]
+	_ = x[Equals-48]
+	_ = x[NotEquals-49]
+	_ = x[Less-50]
+	_ = x[Greater-51]
+	_ = x[LessOrEqual-52]
+	_ = x[GreaterOrEqual-53]
+	_ = x[Concat2-54]
+	_ = x[Match-55]
+	_ = x[NotMatch-56]
+	_ = x[EqualsNum-57]
+	_ = x[NotEqualsNum-58]
+	_ = x[LessNum-59]
+	_ = x[GreaterNum-60]
+	_ = x[LessOrEqualNum-61]
+	_ = x[GreaterOrEqualNum-62]
+	_ = x[CompareSpecialNum-63]
+	_ = x[Not-64]
+	_ = x[UnaryMinus-65]
+	_ = x[UnaryPlus-66]
+	_ = x[Boolean-67]
+	_ = x[Jump-68]
+	_ = x[JumpFalse-69]
+	_ = x[JumpTrue-70]
+	_ = x[JumpEquals-71]
+	_ = x[JumpNotEquals-72]
+	_ = x[JumpLess-73]
+	_ = x[JumpGreater-74]
+	_ = x[JumpLessOrEqual-75]
+	_ = x[JumpGreaterOrEqual-76]
+	_ = x[JumpEqualsNum-77]
+	_ = x[JumpNotEqualsNum-78]
+	_ = x[JumpLessNum-79]
+	_ = x[JumpGreaterNum-80]
+	_ = x[JumpLessOrEqualNum-81]
+	_ = x[JumpGreaterOrEqualNum-82]
+	_ = x[Switch-83]
+	_ = x[SumFields-84]
+	_ = x[Next-85]
+	_ = x[Exit-86]
+	_ = x[ForIn-87]
+	_ = x[BreakForIn-88]
+	_ = x[CallBuiltin-89]
+	_ = x[CallSplit-90]
+	_ = x[CallSplitSep-91]
+	_ = x[CallSplitSeps-92]
+	_ = x[CallMatch-93]
+	_ = x[CallSprintf-94]
+	_ = x[CallDumparr-95]
+	_ = x[CallCopy-96]
+	_ = x[CallKeys-97]
+	_ = x[CallValues-98]
+	_ = x[CallMax-99]
+	_ = x[CallMin-100]
+	_ = x[CallParsequery-101]
+	_ = x[CallGlob-102]
+	_ = x[CallStat-103]
+	_ = x[CallSqlQuery-104]
+	_ = x[CallSqlExec-105]
+	_ = x[CallUser-106]
+	_ = x[CallNative-107]
+	_ = x[Return-108]
+	_ = x[ReturnNull-109]
+	_ = x[TailCall-110]
+	_ = x[Nulls-111]
+	_ = x[Print-112]
+	_ = x[Printf-113]
+	_ = x[PrintSorted-114]
+	_ = x[PrintFields-115]
+	_ = x[Getline-116]
+	_ = x[GetlineField-117]
+	_ = x[GetlineGlobal-118]
+	_ = x[GetlineLocal-119]
+	_ = x[GetlineSpecial-120]
+	_ = x[GetlineArray-121]
+	_ = x[Cover-122]
+	_ = x[FieldIntCompare-123]
+	_ = x[FieldIntJump-124]
+	_ = x[GlobalJumpNum-125]
+	_ = x[GlobalArithAssign-126]
+	_ = x[EndOpcode-127]
 }
 
-const _Opcode_name = "NopNumStrDupeDropSwapFieldFieldIntGlobalLocalSpecialArrayGlobalArrayLocalInGlobalInLocalAssignFieldAssignGlobalAssignLocalAssignSpecialAssignArrayGlobalAssignArrayLocalDeleteDeleteAllIncrFieldIncrGlobalIncrLocalIncrSpecialIncrArrayGlobalIncrArrayLocalAugAssignFieldAugAssignGlobalAugAssignLocalAugAssignSpecialAugAssignArrayGlobalAugAssignArrayLocalRegexIndexMultiConcatMultiAddSubtractMultiplyDividePowerModuloEqualsNotEqualsLessGreaterLessOrEqualGreaterOrEqualConcat2MatchNotMatchNotUnaryMinusUnaryPlusBooleanJumpJumpFalseJumpTrueJumpEqualsJumpNotEqualsJumpLessJumpGreaterJumpLessOrEqualJumpGreaterOrEqualNextExitForInBreakForInCallBuiltinCallSplitCallSplitSepCallSprintfCallUserCallNativeReturnReturnNullNullsPrintPrintfGetlineGetlineFieldGetlineGlobalGetlineLocalGetlineSpecialGetlineArrayEndOpcode"
+const _Opcode_name = "NopNumStrDupeDropSwapFieldFieldIntGlobalLocalSpecialArrayGlobalArrayLocalInGlobalInLocalRecordSpecialNFSpecialNRCachedNFAssignFieldAssignGlobalAssignLocalAssignSpecialAssignArrayGlobalAssignArrayLocalDeleteDeleteAllIncrFieldIncrGlobalIncrLocalIncrSpecialIncrArrayGlobalIncrArrayLocalAugAssignFieldAugAssignGlobalAugAssignLocalAugAssignSpecialAugAssignArrayGlobalAugAssignArrayLocalRegexIndexMultiConcatMultiAddSubtractMultiplyDividePowerModuloEqualsNotEqualsLessGreaterLessOrEqualGreaterOrEqualConcat2MatchNotMatchEqualsNumNotEqualsNumLessNumGreaterNumLessOrEqualNumGreaterOrEqualNumCompareSpecialNumNotUnaryMinusUnaryPlusBooleanJumpJumpFalseJumpTrueJumpEqualsJumpNotEqualsJumpLessJumpGreaterJumpLessOrEqualJumpGreaterOrEqualJumpEqualsNumJumpNotEqualsNumJumpLessNumJumpGreaterNumJumpLessOrEqualNumJumpGreaterOrEqualNumSwitchSumFieldsNextExitForInBreakForInCallBuiltinCallSplitCallSplitSepCallSplitSepsCallMatchCallSprintfCallDumparrCallCopyCallKeysCallValuesCallMaxCallMinCallParsequeryCallGlobCallStatCallSqlQueryCallSqlExecCallUserCallNativeReturnReturnNullTailCallNullsPrintPrintfPrintSortedPrintFieldsGetlineGetlineFieldGetlineGlobalGetlineLocalGetlineSpecialGetlineArrayCoverFieldIntCompareFieldIntJumpGlobalJumpNumGlobalArithAssignEndOpcode"
 
-var _Opcode_index = [...]uint16{0, 3, 6, 9, 13, 17, 21, 26, 34, 40, 45, 52, 63, 73, 81, 88, 99, 111, 122, 135, 152, 168, 174, 183, 192, 202, 211, 222, 237, 251, 265, 280, 294, 310, 330, 349, 354, 364, 375, 378, 386, 394, 400, 405, 411, 417, 426, 430, 437, 448, 462, 469, 474, 482, 485, 495, 504, 511, 515, 524, 532, 542, 555, 563, 574, 589, 607, 611, 615, 620, 630, 641, 650, 662, 673, 681, 691, 697, 707, 712, 717, 723, 730, 742, 755, 767, 781, 793, 802}
+var _Opcode_index = [...]uint16{0, 3, 6, 9, 13, 17, 21, 26, 34, 40, 45, 52, 63, 73, 81, 88, 94, 103, 112, 120, 131, 143, 154, 167, 184, 200, 206, 215, 224, 234, 243, 254, 269, 283, 297, 312, 326, 342, 362, 381, 386, 396, 407, 410, 418, 426, 432, 437, 443, 449, 458, 462, 469, 480, 494, 501, 506, 514, 523, 535, 542, 552, 566, 583, 600, 603, 613, 622, 629, 633, 642, 650, 660, 673, 681, 692, 707, 725, 738, 754, 765, 779, 797, 818, 824, 833, 837, 841, 846, 856, 867, 876, 888, 901, 910, 921, 932, 940, 948, 958, 965, 972, 986, 994, 1002, 1014, 1025, 1033, 1043, 1049, 1059, 1067, 1072, 1077, 1083, 1094, 1105, 1112, 1124, 1137, 1149, 1163, 1175, 1180, 1195, 1207, 1220, 1237, 1246}
 
 func (i Opcode) String() string {
 	if i < 0 || i >= Opcode(len(_Opcode_index)-1) {
@@ -158,11 +198,45 @@ func _() {
 	_ = x[BuiltinSystem-21]
 	_ = x[BuiltinTolower-22]
 	_ = x[BuiltinToupper-23]
+	_ = x[BuiltinAbs-24]
+	_ = x[BuiltinB64decode-25]
+	_ = x[BuiltinB64encode-26]
+	_ = x[BuiltinCeil-27]
+	_ = x[BuiltinChr-28]
+	_ = x[BuiltinFilesize-29]
+	_ = x[BuiltinFloor-30]
+	_ = x[BuiltinHmac-31]
+	_ = x[BuiltinMd5-32]
+	_ = x[BuiltinMktime-33]
+	_ = x[BuiltinMonotime-34]
+	_ = x[BuiltinMtime-35]
+	_ = x[BuiltinOrd-36]
+	_ = x[BuiltinRedisGet-37]
+	_ = x[BuiltinRedisIncr-38]
+	_ = x[BuiltinRedisSet-39]
+	_ = x[BuiltinRound-40]
+	_ = x[BuiltinRoundDigits-41]
+	_ = x[BuiltinSbAdd-42]
+	_ = x[BuiltinSbNew-43]
+	_ = x[BuiltinSbStr-44]
+	_ = x[BuiltinSetenv-45]
+	_ = x[BuiltinSha1-46]
+	_ = x[BuiltinSha256-47]
+	_ = x[BuiltinSleep-48]
+	_ = x[BuiltinSqlClose-49]
+	_ = x[BuiltinSqlOpen-50]
+	_ = x[BuiltinStrftime-51]
+	_ = x[BuiltinSystime-52]
+	_ = x[BuiltinTrunc-53]
+	_ = x[BuiltinTzconvert-54]
+	_ = x[BuiltinUnsetenv-55]
+	_ = x[BuiltinUrldecode-56]
+	_ = x[BuiltinUrlencode-57]
 }
 
-const _BuiltinOp_name = "BuiltinAtan2BuiltinCloseBuiltinCosBuiltinExpBuiltinFflushBuiltinFflushAllBuiltinGsubBuiltinIndexBuiltinIntBuiltinLengthBuiltinLengthArgBuiltinLogBuiltinMatchBuiltinRandBuiltinSinBuiltinSqrtBuiltinSrandBuiltinSrandSeedBuiltinSubBuiltinSubstrBuiltinSubstrLengthBuiltinSystemBuiltinTolowerBuiltinToupper"
+const _BuiltinOp_name = "BuiltinAtan2BuiltinCloseBuiltinCosBuiltinExpBuiltinFflushBuiltinFflushAllBuiltinGsubBuiltinIndexBuiltinIntBuiltinLengthBuiltinLengthArgBuiltinLogBuiltinMatchBuiltinRandBuiltinSinBuiltinSqrtBuiltinSrandBuiltinSrandSeedBuiltinSubBuiltinSubstrBuiltinSubstrLengthBuiltinSystemBuiltinTolowerBuiltinToupperBuiltinAbsBuiltinB64decodeBuiltinB64encodeBuiltinCeilBuiltinChrBuiltinFilesizeBuiltinFloorBuiltinHmacBuiltinMd5BuiltinMktimeBuiltinMonotimeBuiltinMtimeBuiltinOrdBuiltinRedisGetBuiltinRedisIncrBuiltinRedisSetBuiltinRoundBuiltinRoundDigitsBuiltinSbAddBuiltinSbNewBuiltinSbStrBuiltinSetenvBuiltinSha1BuiltinSha256BuiltinSleepBuiltinSqlCloseBuiltinSqlOpenBuiltinStrftimeBuiltinSystimeBuiltinTruncBuiltinTzconvertBuiltinUnsetenvBuiltinUrldecodeBuiltinUrlencode"
 
-var _BuiltinOp_index = [...]uint16{0, 12, 24, 34, 44, 57, 73, 84, 96, 106, 119, 135, 145, 157, 168, 178, 189, 201, 217, 227, 240, 259, 272, 286, 300}
+var _BuiltinOp_index = [...]uint16{0, 12, 24, 34, 44, 57, 73, 84, 96, 106, 119, 135, 145, 157, 168, 178, 189, 201, 217, 227, 240, 259, 272, 286, 300, 310, 326, 342, 353, 363, 378, 390, 401, 411, 424, 439, 451, 461, 476, 492, 507, 519, 537, 549, 561, 573, 586, 597, 610, 622, 637, 651, 666, 680, 692, 708, 723, 739, 755}
 
 func (i BuiltinOp) String() string {
 	if i < 0 || i >= BuiltinOp(len(_BuiltinOp_index)-1) {
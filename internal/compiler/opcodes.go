@@ -34,6 +34,13 @@ const (
 	InGlobal    // arrayIndex
 	InLocal     // arrayIndex
 
+	// Fetch $0, NF, or NR, which are read so often that they have their
+	// own opcodes (see specials.go)
+	Record
+	SpecialNF
+	SpecialNR
+	CachedNF
+
 	// Assign a field, variable, or array item
 	AssignField
 	AssignGlobal      // index
@@ -88,6 +95,19 @@ const (
 	Match
 	NotMatch
 
+	// Numeric comparisons, used when both operands are inferred to be
+	// numbers (these fall back to the general case if they're not)
+	EqualsNum
+	NotEqualsNum
+	LessNum
+	GreaterNum
+	LessOrEqualNum
+	GreaterOrEqualNum
+
+	// Compare NR, FNR, or NF with a number constant, for patterns like
+	// "NR > 1" (compareOp is one of Equals through GreaterOrEqual)
+	CompareSpecialNum // compareOp index numIndex
+
 	// Unary operators
 	Not
 	UnaryMinus
@@ -104,27 +124,61 @@ const (
 	JumpGreater        // offset
 	JumpLessOrEqual    // offset
 	JumpGreaterOrEqual // offset
+
+	// Numeric versions of the comparison jumps (see EqualsNum)
+	JumpEqualsNum         // offset
+	JumpNotEqualsNum      // offset
+	JumpLessNum           // offset
+	JumpGreaterNum        // offset
+	JumpLessOrEqualNum    // offset
+	JumpGreaterOrEqualNum // offset
+
+	// Pop a value and jump to its offset in a JumpTable (for if-else
+	// chains that compare one value with many constants)
+	Switch // tableIndex
+
+	// Pop a value s, then push start or NF+1 (the final value of the loop
+	// variable) and s plus the numeric values of fields start..NF (for
+	// loops that sum fields)
+	SumFields // start
+
 	Next
 	Exit
 	ForIn // varScope varIndex arrayScope arrayIndex offset
 	BreakForIn
 
 	// Builtin functions
-	CallBuiltin  // builtinOp
-	CallSplit    // arrayScope arrayIndex
-	CallSplitSep // arrayScope arrayIndex
-	CallSprintf  // numArgs
+	CallBuiltin    // builtinOp
+	CallSplit      // arrayScope arrayIndex
+	CallSplitSep   // arrayScope arrayIndex
+	CallSplitSeps  // arrayScope arrayIndex sepsScope sepsIndex
+	CallMatch      // arrayScope arrayIndex
+	CallSprintf    // numArgs
+	CallDumparr    // arrayScope arrayIndex
+	CallCopy       // srcScope srcIndex dstScope dstIndex
+	CallKeys       // srcScope srcIndex dstScope dstIndex
+	CallValues     // srcScope srcIndex dstScope dstIndex
+	CallMax        // numArgs
+	CallMin        // numArgs
+	CallParsequery // arrayScope arrayIndex
+	CallGlob       // arrayScope arrayIndex
+	CallStat       // arrayScope arrayIndex
+	CallSqlQuery   // arrayScope arrayIndex numArgs
+	CallSqlExec    // numArgs
 
 	// User and native functions
 	CallUser   // funcIndex numArrayArgs [arrayScope1 arrayIndex1 ...]
 	CallNative // funcIndex numArgs
 	Return
 	ReturnNull
-	Nulls // numNulls
+	TailCall // funcIndex numArrayArgs [arrayScope1 arrayIndex1 ...]
+	Nulls    // numNulls
 
 	// Print, printf, and getline
 	Print          // numArgs redirect
 	Printf         // numArgs redirect
+	PrintSorted    // varScope varIndex arrayScope arrayIndex numArgs redirect
+	PrintFields    // numFields index1 [index2 ...]
 	Getline        // redirect
 	GetlineField   // redirect
 	GetlineGlobal  // redirect index
@@ -132,6 +186,16 @@ const (
 	GetlineSpecial // redirect index
 	GetlineArray   // redirect arrayScope arrayIndex
 
+	// Only used when compiled with Options.Coverage
+	Cover // coverIndex
+
+	// Superinstructions (see super.go), which replace the opcode of the
+	// first instruction of a sequence and take its arguments
+	FieldIntCompare   // index
+	FieldIntJump      // index
+	GlobalJumpNum     // index
+	GlobalArithAssign // index
+
 	EndOpcode
 )
 
@@ -175,4 +239,40 @@ const (
 	BuiltinSystem
 	BuiltinTolower
 	BuiltinToupper
+
+	// GoAWK extension functions
+	BuiltinAbs
+	BuiltinB64decode
+	BuiltinB64encode
+	BuiltinCeil
+	BuiltinChr
+	BuiltinFilesize
+	BuiltinFloor
+	BuiltinHmac
+	BuiltinMd5
+	BuiltinMktime
+	BuiltinMonotime
+	BuiltinMtime
+	BuiltinOrd
+	BuiltinRedisGet
+	BuiltinRedisIncr
+	BuiltinRedisSet
+	BuiltinRound
+	BuiltinRoundDigits
+	BuiltinSbAdd
+	BuiltinSbNew
+	BuiltinSbStr
+	BuiltinSetenv
+	BuiltinSha1
+	BuiltinSha256
+	BuiltinSleep
+	BuiltinSqlClose
+	BuiltinSqlOpen
+	BuiltinStrftime
+	BuiltinSystime
+	BuiltinTrunc
+	BuiltinTzconvert
+	BuiltinUnsetenv
+	BuiltinUrldecode
+	BuiltinUrlencode
 )
@@ -0,0 +1,160 @@
+// Instruction operands, for sizing, assembling, and verifying instructions
+
+package compiler
+
+// operandKind is the kind of one of an instruction's arguments, which
+// determines how many words it uses, how the assembler parses it, and
+// how the verifier checks it.
+type operandKind int
+
+const (
+	numOperand         operandKind = iota // Nums index, written like "1.5 (3)"
+	strOperand                            // Strs index, written like `"foo" (3)`
+	regexOperand                          // Regexes index, written like `"a+" (3)`
+	intOperand                            // field index, amount, or count
+	globalOperand                         // global scalar index, written as its name
+	localOperand                          // local scalar index, written as its name
+	specialOperand                        // special variable index, written as its name
+	globalArrayOperand                    // global array index, written as its name
+	localArrayOperand                     // local array index, written as its name
+	scalarOperand                         // scope and index of any scalar (two words)
+	arrayOperand                          // scope and index of an array (two words)
+	augOpOperand                          // AugOp, written as its name
+	compareOperand                        // comparison opcode, Equals through GreaterOrEqual
+	jumpOperand                           // jump offset, written as the absolute target
+	switchOperand                         // JumpTables index, written as its key:target pairs
+	builtinOperand                        // BuiltinOp, written as its name
+	funcOperand                           // Functions index, written as the name
+	nativeOperand                         // native function index, written as the name
+	redirectOperand                       // redirect token
+	optRedirectOperand                    // redirect token, not written if it's ILLEGAL
+	coverOperand                          // CoverPos index
+	arrayListOperand                      // count n, then the scope and index of n arrays, written like "[a, b]"
+	fieldListOperand                      // count n, then n field indexes, written as the indexes
+)
+
+// Operands of each opcode, in order. Superinstructions take the
+// operands of the first instruction in their sequence (see baseOpcode).
+var operands = [EndOpcode][]operandKind{
+	Num: {numOperand},
+	Str: {strOperand},
+
+	FieldInt:    {intOperand},
+	Global:      {globalOperand},
+	Local:       {localOperand},
+	Special:     {specialOperand},
+	ArrayGlobal: {globalArrayOperand},
+	ArrayLocal:  {localArrayOperand},
+	InGlobal:    {globalArrayOperand},
+	InLocal:     {localArrayOperand},
+
+	AssignGlobal:      {globalOperand},
+	AssignLocal:       {localOperand},
+	AssignSpecial:     {specialOperand},
+	AssignArrayGlobal: {globalArrayOperand},
+	AssignArrayLocal:  {localArrayOperand},
+
+	Delete:    {arrayOperand},
+	DeleteAll: {arrayOperand},
+
+	IncrField:       {intOperand},
+	IncrGlobal:      {intOperand, globalOperand},
+	IncrLocal:       {intOperand, localOperand},
+	IncrSpecial:     {intOperand, specialOperand},
+	IncrArrayGlobal: {intOperand, globalArrayOperand},
+	IncrArrayLocal:  {intOperand, localArrayOperand},
+
+	AugAssignField:       {augOpOperand},
+	AugAssignGlobal:      {augOpOperand, globalOperand},
+	AugAssignLocal:       {augOpOperand, localOperand},
+	AugAssignSpecial:     {augOpOperand, specialOperand},
+	AugAssignArrayGlobal: {augOpOperand, globalArrayOperand},
+	AugAssignArrayLocal:  {augOpOperand, localArrayOperand},
+
+	Regex:       {regexOperand},
+	IndexMulti:  {intOperand},
+	ConcatMulti: {intOperand},
+
+	CompareSpecialNum: {compareOperand, specialOperand, numOperand},
+
+	Jump:                  {jumpOperand},
+	JumpFalse:             {jumpOperand},
+	JumpTrue:              {jumpOperand},
+	JumpEquals:            {jumpOperand},
+	JumpNotEquals:         {jumpOperand},
+	JumpLess:              {jumpOperand},
+	JumpGreater:           {jumpOperand},
+	JumpLessOrEqual:       {jumpOperand},
+	JumpGreaterOrEqual:    {jumpOperand},
+	JumpEqualsNum:         {jumpOperand},
+	JumpNotEqualsNum:      {jumpOperand},
+	JumpLessNum:           {jumpOperand},
+	JumpGreaterNum:        {jumpOperand},
+	JumpLessOrEqualNum:    {jumpOperand},
+	JumpGreaterOrEqualNum: {jumpOperand},
+	Switch:                {switchOperand},
+	SumFields:             {intOperand},
+	ForIn:                 {scalarOperand, arrayOperand, jumpOperand},
+
+	CallBuiltin:    {builtinOperand},
+	CallSplit:      {arrayOperand},
+	CallSplitSep:   {arrayOperand},
+	CallSplitSeps:  {arrayOperand, arrayOperand},
+	CallMatch:      {arrayOperand},
+	CallSprintf:    {intOperand},
+	CallDumparr:    {arrayOperand},
+	CallCopy:       {arrayOperand, arrayOperand},
+	CallKeys:       {arrayOperand, arrayOperand},
+	CallValues:     {arrayOperand, arrayOperand},
+	CallMax:        {intOperand},
+	CallMin:        {intOperand},
+	CallParsequery: {arrayOperand},
+	CallGlob:       {arrayOperand},
+	CallStat:       {arrayOperand},
+	CallSqlQuery:   {arrayOperand, intOperand},
+	CallSqlExec:    {intOperand},
+
+	CallUser:   {funcOperand, arrayListOperand},
+	CallNative: {nativeOperand, intOperand},
+	TailCall:   {funcOperand, arrayListOperand},
+	Nulls:      {intOperand},
+
+	Print:          {intOperand, optRedirectOperand},
+	Printf:         {intOperand, optRedirectOperand},
+	PrintSorted:    {scalarOperand, arrayOperand, intOperand, optRedirectOperand},
+	PrintFields:    {fieldListOperand},
+	Getline:        {redirectOperand},
+	GetlineField:   {redirectOperand},
+	GetlineGlobal:  {redirectOperand, globalOperand},
+	GetlineLocal:   {redirectOperand, localOperand},
+	GetlineSpecial: {redirectOperand, specialOperand},
+	GetlineArray:   {redirectOperand, arrayOperand},
+
+	Cover: {coverOperand},
+}
+
+// Return the number of words used by an operand of this kind starting
+// at code[i].
+func (k operandKind) size(code []Opcode, i int) int {
+	switch k {
+	case scalarOperand, arrayOperand:
+		return 2
+	case arrayListOperand:
+		return 1 + 2*int(code[i])
+	case fieldListOperand:
+		return 1 + int(code[i])
+	default:
+		return 1
+	}
+}
+
+// instructionSize returns the number of words used by the instruction at
+// code[ip], including its arguments. For a superinstruction, that's
+// the size of the first instruction in its sequence.
+func instructionSize(code []Opcode, ip int) int {
+	size := 1
+	for _, kind := range operands[baseOpcode(code[ip])] {
+		size += kind.size(code, ip+size)
+	}
+	return size
+}
@@ -0,0 +1,31 @@
+// Peephole optimizations on generated opcodes
+
+package compiler
+
+// threadJumps rewrites jumps (including ForIn's loop exit) whose target
+// is an unconditional Jump to go straight to that Jump's final target.
+// Nested if/else statements and loops inside conditionals generate
+// these jump chains.
+func threadJumps(code []Opcode) {
+	for ip := 0; ip < len(code); ip += instructionSize(code, ip) {
+		var offsetIndex int
+		switch code[ip] {
+		case Jump, JumpFalse, JumpTrue, JumpEquals, JumpNotEquals,
+			JumpLess, JumpGreater, JumpLessOrEqual, JumpGreaterOrEqual,
+			JumpEqualsNum, JumpNotEqualsNum, JumpLessNum, JumpGreaterNum,
+			JumpLessOrEqualNum, JumpGreaterOrEqualNum:
+			offsetIndex = ip + 1
+		case ForIn:
+			offsetIndex = ip + 5
+		default:
+			continue
+		}
+		target := offsetIndex + 1 + int(code[offsetIndex])
+		// Limit the number of hops to guard against "while (1) {}" style
+		// jump cycles.
+		for hops := 0; hops < len(code) && target < len(code) && code[target] == Jump; hops++ {
+			target = target + 2 + int(code[target+1])
+		}
+		code[offsetIndex] = opcodeInt(target - (offsetIndex + 1))
+	}
+}
@@ -0,0 +1,37 @@
+// Compiling prints of fields to PrintFields instructions
+
+package compiler
+
+import (
+	"github.com/benhoyt/goawk/ast"
+	"github.com/benhoyt/goawk/lexer"
+)
+
+// Compile s to a PrintFields instruction if it prints constant fields
+// to standard output, like "print", "print $0", or "print $2, $1",
+// reporting whether it did. The instruction writes the fields straight
+// to the output, without pushing them on the stack as values.
+func (c *compiler) printFields(s *ast.PrintStmt) bool {
+	if s.Redirect != lexer.ILLEGAL {
+		return false
+	}
+	indexes := make([]Opcode, 0, len(s.Args)+1)
+	for _, arg := range s.Args {
+		field, ok := arg.(*ast.FieldExpr)
+		if !ok {
+			return false
+		}
+		index, ok := field.Index.(*ast.NumExpr)
+		if !ok || index.Value < 0 || index.Value != float64(Opcode(index.Value)) {
+			return false
+		}
+		indexes = append(indexes, opcodeInt(int(index.Value)))
+	}
+	if len(indexes) == 0 {
+		// "print" with no args is equivalent to "print $0"
+		indexes = append(indexes, 0)
+	}
+	c.add(PrintFields, opcodeInt(len(indexes)))
+	c.add(indexes...)
+	return true
+}
@@ -0,0 +1,45 @@
+// Compiling loops that print an array to PrintSorted instructions
+
+package compiler
+
+import (
+	"github.com/benhoyt/goawk/ast"
+	"github.com/benhoyt/goawk/lexer"
+)
+
+// Compile s to a PrintSorted instruction if it's a loop like
+// "for (k in a) print k, a[k]" (often found in an END block),
+// reporting whether it did. The instruction prints the elements in
+// sorted key order (one of the orders the loop could use) without
+// running the loop body for each one, and leaves k set to the last key,
+// as the loop would.
+func (c *compiler) printSorted(s *ast.ForInStmt) bool {
+	if c.program.coverIndex != nil || len(s.Body) != 1 {
+		return false
+	}
+	if _, ok := scalarVar(s.Var); !ok {
+		return false
+	}
+	p, ok := s.Body[0].(*ast.PrintStmt)
+	if !ok || len(p.Args) < 1 || len(p.Args) > 2 || !sameSubject(p.Args[0], s.Var) {
+		return false
+	}
+	if len(p.Args) == 2 {
+		e, ok := p.Args[1].(*ast.IndexExpr)
+		if !ok || e.Array.Scope != s.Array.Scope || e.Array.Index != s.Array.Index ||
+			len(e.Index) != 1 || !sameSubject(e.Index[0], s.Var) {
+			return false
+		}
+	}
+	if p.Redirect != lexer.ILLEGAL {
+		// The destination is evaluated once, so it must be a constant
+		if _, ok := p.Dest.(*ast.StrExpr); !ok {
+			return false
+		}
+		c.expr(p.Dest)
+	}
+	c.add(PrintSorted, Opcode(s.Var.Scope), opcodeInt(s.Var.Index),
+		Opcode(s.Array.Scope), opcodeInt(s.Array.Index),
+		opcodeInt(len(p.Args)), Opcode(p.Redirect))
+	return true
+}
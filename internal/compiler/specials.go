@@ -0,0 +1,65 @@
+// Caching NF between reads that can't see a different record
+
+package compiler
+
+// markCachedNF rewrites the SpecialNF instructions in code that always
+// run after an earlier SpecialNF with nothing in between that could
+// change the current record, to CachedNF. The first read splits the
+// record into fields if it hasn't been already, so a CachedNF can read
+// the number of fields without checking that again.
+//
+// The analysis is a single pass over the straight-line runs of code:
+// the fields are only known to be split from a SpecialNF up to the next
+// jump target (which might be reached from elsewhere) or the next
+// instruction that could change $0 or NF, like a field assignment,
+// getline, or a function call.
+func markCachedNF(code []Opcode, tables []JumpTable) {
+	targets := jumpTargets(code, tables)
+	split := false
+	for ip := 0; ip < len(code); ip += instructionSize(code, ip) {
+		if targets[ip] {
+			split = false
+		}
+		switch baseOpcode(code[ip]) {
+		case SpecialNF:
+			if split {
+				code[ip] = CachedNF
+			}
+			split = true
+		case AssignField, AugAssignField, IncrField, AssignSpecial,
+			AugAssignSpecial, IncrSpecial, Getline, GetlineField,
+			GetlineSpecial, CallUser, TailCall, ForIn:
+			split = false
+		}
+	}
+}
+
+// Return the set of addresses in code that jumps (including ForIn loop
+// exits and the starts of ForIn bodies) can go to.
+func jumpTargets(code []Opcode, tables []JumpTable) map[int]bool {
+	targets := make(map[int]bool)
+	for ip := 0; ip < len(code); {
+		next := ip + instructionSize(code, ip)
+		switch baseOpcode(code[ip]) {
+		case Jump, JumpFalse, JumpTrue, JumpEquals, JumpNotEquals,
+			JumpLess, JumpGreater, JumpLessOrEqual, JumpGreaterOrEqual,
+			JumpEqualsNum, JumpNotEqualsNum, JumpLessNum, JumpGreaterNum,
+			JumpLessOrEqualNum, JumpGreaterOrEqualNum:
+			targets[next+int(code[ip+1])] = true
+		case ForIn:
+			targets[next] = true
+			targets[next+int(code[ip+5])] = true
+		case Switch:
+			table := tables[code[ip+1]]
+			for _, offset := range table.Nums {
+				targets[next+offset] = true
+			}
+			for _, offset := range table.Strs {
+				targets[next+offset] = true
+			}
+			targets[next+table.Default] = true
+		}
+		ip = next
+	}
+	return targets
+}
@@ -0,0 +1,128 @@
+// Superinstructions: common instruction sequences executed in one step
+
+package compiler
+
+// A superinstruction is a sequence of instructions that the virtual
+// machine executes in one step, to save the dispatch overhead of the
+// individual instructions. The compiler marks the start of a sequence
+// by replacing the first instruction's opcode with the superinstruction
+// opcode, and leaves the rest of the code as is. The superinstruction
+// takes the first instruction's operands, and the following
+// instructions are still there for the virtual machine to read their
+// operands from, for jumps to land on, and for the disassembler and
+// verifier to see as ordinary instructions.
+//
+// To add a superinstruction, add its opcode in opcodes.go, add it to
+// this table, and handle it in the virtual machine. Everything else
+// (disassembly, assembly, verification) is driven by this table.
+type superinstruction struct {
+	op    Opcode     // opcode that marks the first instruction
+	parts [][]Opcode // possible opcodes of each instruction in the sequence
+}
+
+// Comparisons, comparison jumps, and numeric comparison jumps, in the
+// same order so that, for example, JumpLess-JumpEquals is
+// Less-Equals.
+var (
+	comparisonOps   = []Opcode{Equals, NotEquals, Less, Greater, LessOrEqual, GreaterOrEqual}
+	jumpCompareOps  = []Opcode{JumpEquals, JumpNotEquals, JumpLess, JumpGreater, JumpLessOrEqual, JumpGreaterOrEqual}
+	jumpCompareNums = []Opcode{JumpEqualsNum, JumpNotEqualsNum, JumpLessNum, JumpGreaterNum, JumpLessOrEqualNum, JumpGreaterOrEqualNum}
+)
+
+// Only the last instruction of a sequence may jump.
+var superinstructions = []superinstruction{
+	// Patterns like "$3 > 100" or "$1 == \"foo\""
+	{FieldIntCompare, [][]Opcode{{FieldInt}, {Num, Str}, comparisonOps}},
+
+	// Conditions like "if ($3 > 100)"
+	{FieldIntJump, [][]Opcode{{FieldInt}, {Num, Str}, jumpCompareOps}},
+
+	// Loop tests like "i <= NF" or "i < n"
+	{GlobalJumpNum, [][]Opcode{{Global}, {Num, Global, Special, SpecialNF, SpecialNR, CachedNF}, jumpCompareNums}},
+
+	// Assignments like "x = x + 1" or "y = x * 2"
+	{GlobalArithAssign, [][]Opcode{{Global}, {Num}, {Add, Subtract, Multiply}, {AssignGlobal}}},
+}
+
+// Superinstructions by opcode, for looking up their parts.
+var superinstructionsByOp = make(map[Opcode]*superinstruction)
+
+func init() {
+	for i := range superinstructions {
+		s := &superinstructions[i]
+		superinstructionsByOp[s.op] = s
+	}
+}
+
+// Return the opcode of the first instruction of the superinstruction
+// op, or op itself if it isn't one.
+func baseOpcode(op Opcode) Opcode {
+	if s, ok := superinstructionsByOp[op]; ok {
+		return s.parts[0][0]
+	}
+	return op
+}
+
+// Mark the starts of sequences of instructions in code that can be
+// executed as superinstructions.
+func markSuperinstructions(code []Opcode) {
+	markRegion(code, 0, len(code))
+}
+
+// Mark superinstructions in code[start:end]. ForIn bodies are executed
+// as separate slices of code, so sequences can't cross into or out of
+// them.
+func markRegion(code []Opcode, start, end int) {
+	for ip := start; ip < end; {
+		next := ip + instructionSize(code, ip)
+		if code[ip] == ForIn {
+			bodyEnd := next + int(code[ip+5])
+			markRegion(code, next, bodyEnd)
+			next = bodyEnd
+		} else {
+			for i := range superinstructions {
+				s := &superinstructions[i]
+				if seqEnd := s.match(code, ip, end); seqEnd > 0 {
+					code[ip] = s.op
+					// Don't start a sequence inside this one, as the
+					// virtual machine reads the rest of it as is.
+					next = seqEnd
+					break
+				}
+			}
+		}
+		ip = next
+	}
+}
+
+// If the instructions at code[ip:end] start with the sequence s (with
+// its first opcode as the base opcode or s.op), return the address
+// after the sequence, otherwise return 0.
+func (s *superinstruction) match(code []Opcode, ip, end int) int {
+	for i, ops := range s.parts {
+		if ip >= end {
+			return 0
+		}
+		op := code[ip]
+		if i == 0 && op == s.op {
+			op = s.parts[0][0]
+		}
+		if !containsOpcode(ops, op) {
+			return 0
+		}
+		ip += instructionSize(code, ip)
+		if ip > end {
+			return 0
+		}
+	}
+	return ip
+}
+
+func containsOpcode(ops []Opcode, op Opcode) bool {
+	for _, o := range ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,271 @@
+// Static inference of which scalar variables are always numeric
+
+package compiler
+
+import (
+	"github.com/benhoyt/goawk/ast"
+	"github.com/benhoyt/goawk/lexer"
+)
+
+// typeInfo records which variables and function results are inferred
+// to always be numbers (or null, which compares like the number 0).
+//
+// This only guides which opcodes the compiler emits: globals can still
+// be set to strings from outside the program (with -v or a var=value
+// argument), so the numeric opcodes fall back to the general case if
+// an operand isn't actually a number.
+type typeInfo struct {
+	globals []bool   // per global scalar index
+	locals  [][]bool // per function, per local scalar index
+	returns []bool   // per function
+}
+
+// inferTypes determines which scalars in prog are only ever assigned
+// numeric values. It starts by assuming everything is numeric and
+// repeatedly walks the program, marking variables assigned possibly
+// non-numeric values as non-numeric, till nothing changes.
+func inferTypes(prog *ast.Program) *typeInfo {
+	t := &typeInfo{
+		globals: make([]bool, len(prog.Scalars)),
+		locals:  make([][]bool, len(prog.Functions)),
+		returns: make([]bool, len(prog.Functions)),
+	}
+	for i := range t.globals {
+		t.globals[i] = true
+	}
+	for i, f := range prog.Functions {
+		t.locals[i] = make([]bool, len(f.Params))
+		for j := range t.locals[i] {
+			t.locals[i][j] = true
+		}
+		t.returns[i] = true
+	}
+
+	w := &typeWalker{types: t, funcs: prog.Functions}
+	for {
+		w.changed = false
+		w.locals = nil
+		for _, stmts := range prog.Begin {
+			w.stmts(stmts)
+		}
+		for _, action := range prog.Actions {
+			w.exprs(action.Pattern)
+			w.stmts(action.Stmts)
+		}
+		for _, stmts := range prog.End {
+			w.stmts(stmts)
+		}
+		for i, f := range prog.Functions {
+			w.funcIndex = i
+			w.locals = t.locals[i]
+			w.stmts(f.Body)
+		}
+		if !w.changed {
+			return t
+		}
+	}
+}
+
+type typeWalker struct {
+	types     *typeInfo
+	funcs     []ast.Function
+	funcIndex int    // index of function being walked
+	locals    []bool // numeric flags for its locals, nil if not in a function
+	changed   bool
+}
+
+// Record that the variable expr (if it's a tracked scalar) is assigned
+// the result of some expression; numeric is whether that's numeric.
+func (w *typeWalker) assign(expr ast.Expr, numeric bool) {
+	v, ok := expr.(*ast.VarExpr)
+	if !ok || numeric {
+		return
+	}
+	var flags []bool
+	switch v.Scope {
+	case ast.ScopeGlobal:
+		flags = w.types.globals
+	case ast.ScopeLocal:
+		flags = w.locals
+	default:
+		return
+	}
+	if v.Index < len(flags) && flags[v.Index] {
+		flags[v.Index] = false
+		w.changed = true
+	}
+}
+
+func (w *typeWalker) stmts(stmts ast.Stmts) {
+	for _, stmt := range stmts {
+		w.stmt(stmt)
+	}
+}
+
+func (w *typeWalker) stmt(stmt ast.Stmt) {
+	switch s := stmt.(type) {
+	case *ast.PrintStmt:
+		w.exprs(s.Args)
+		w.expr(s.Dest)
+	case *ast.PrintfStmt:
+		w.exprs(s.Args)
+		w.expr(s.Dest)
+	case *ast.ExprStmt:
+		w.expr(s.Expr)
+	case *ast.IfStmt:
+		w.expr(s.Cond)
+		w.stmts(s.Body)
+		w.stmts(s.Else)
+	case *ast.ForStmt:
+		if s.Pre != nil {
+			w.stmt(s.Pre)
+		}
+		w.expr(s.Cond)
+		if s.Post != nil {
+			w.stmt(s.Post)
+		}
+		w.stmts(s.Body)
+	case *ast.ForInStmt:
+		w.assign(s.Var, false) // array keys are strings
+		w.stmts(s.Body)
+	case *ast.WhileStmt:
+		w.expr(s.Cond)
+		w.stmts(s.Body)
+	case *ast.DoWhileStmt:
+		w.stmts(s.Body)
+		w.expr(s.Cond)
+	case *ast.ExitStmt:
+		w.expr(s.Status)
+	case *ast.DeleteStmt:
+		w.exprs(s.Index)
+	case *ast.ReturnStmt:
+		if s.Value != nil && w.locals != nil {
+			w.expr(s.Value)
+			if w.types.returns[w.funcIndex] && !w.numeric(s.Value) {
+				w.types.returns[w.funcIndex] = false
+				w.changed = true
+			}
+		}
+	case *ast.BlockStmt:
+		w.stmts(s.Body)
+	}
+}
+
+func (w *typeWalker) exprs(exprs []ast.Expr) {
+	for _, expr := range exprs {
+		w.expr(expr)
+	}
+}
+
+// Walk expr, recording the assignments it makes.
+func (w *typeWalker) expr(expr ast.Expr) {
+	switch e := expr.(type) {
+	case *ast.FieldExpr:
+		w.expr(e.Index)
+	case *ast.UnaryExpr:
+		w.expr(e.Value)
+	case *ast.BinaryExpr:
+		w.expr(e.Left)
+		w.expr(e.Right)
+	case *ast.InExpr:
+		w.exprs(e.Index)
+	case *ast.CondExpr:
+		w.expr(e.Cond)
+		w.expr(e.True)
+		w.expr(e.False)
+	case *ast.IndexExpr:
+		w.exprs(e.Index)
+	case *ast.AssignExpr:
+		w.expr(e.Left)
+		w.expr(e.Right)
+		w.assign(e.Left, w.numeric(e.Right))
+	case *ast.AugAssignExpr:
+		w.expr(e.Left)
+		w.expr(e.Right)
+	case *ast.IncrExpr:
+		w.expr(e.Expr)
+	case *ast.CallExpr:
+		w.exprs(e.Args)
+		if (e.Func == lexer.F_SUB || e.Func == lexer.F_GSUB) && len(e.Args) == 3 {
+			w.assign(e.Args[2], false)
+		}
+	case *ast.UserCallExpr:
+		w.exprs(e.Args)
+		if e.Native {
+			break
+		}
+		// Arguments are assigned to the function's scalar parameters
+		f := w.funcs[e.Index]
+		scalarIndex := 0
+		for i, isArray := range f.Arrays {
+			if isArray {
+				continue
+			}
+			if i < len(e.Args) && !w.numeric(e.Args[i]) {
+				locals := w.types.locals[e.Index]
+				if locals[scalarIndex] {
+					locals[scalarIndex] = false
+					w.changed = true
+				}
+			}
+			scalarIndex++
+		}
+	case *ast.MultiExpr:
+		w.exprs(e.Exprs)
+	case *ast.GetlineExpr:
+		w.expr(e.Command)
+		w.expr(e.File)
+		w.assign(e.Target, false)
+	}
+}
+
+// Report whether expr always evaluates to a number (or null) in the
+// current context, given what's been inferred so far.
+func (w *typeWalker) numeric(expr ast.Expr) bool {
+	return w.types.numeric(expr, w.locals)
+}
+
+// Report whether expr always evaluates to a number (or null), where
+// locals are the numeric flags for the enclosing function's locals.
+func (t *typeInfo) numeric(expr ast.Expr, locals []bool) bool {
+	switch e := expr.(type) {
+	case *ast.NumExpr, *ast.RegExpr, *ast.InExpr, *ast.UnaryExpr,
+		*ast.AugAssignExpr, *ast.IncrExpr, *ast.GetlineExpr:
+		return true
+	case *ast.BinaryExpr:
+		return e.Op != lexer.CONCAT
+	case *ast.CondExpr:
+		return t.numeric(e.True, locals) && t.numeric(e.False, locals)
+	case *ast.AssignExpr:
+		return t.numeric(e.Right, locals)
+	case *ast.VarExpr:
+		switch e.Scope {
+		case ast.ScopeGlobal:
+			return e.Index < len(t.globals) && t.globals[e.Index]
+		case ast.ScopeLocal:
+			return e.Index < len(locals) && locals[e.Index]
+		default:
+			switch e.Index {
+			case ast.V_NF, ast.V_NR, ast.V_FNR, ast.V_RSTART, ast.V_RLENGTH, ast.V_ARGC:
+				return true
+			}
+			return false
+		}
+	case *ast.CallExpr:
+		switch e.Func {
+		case lexer.F_ATAN2, lexer.F_CLOSE, lexer.F_COS, lexer.F_EXP, lexer.F_FFLUSH,
+			lexer.F_GSUB, lexer.F_INDEX, lexer.F_INT, lexer.F_LENGTH, lexer.F_LOG,
+			lexer.F_MATCH, lexer.F_RAND, lexer.F_SIN, lexer.F_SPLIT, lexer.F_SQRT,
+			lexer.F_SRAND, lexer.F_SUB, lexer.F_SYSTEM, lexer.F_ABS, lexer.F_CEIL,
+			lexer.F_COPY, lexer.F_DUMPARR, lexer.F_FILESIZE, lexer.F_FLOOR, lexer.F_GLOB, lexer.F_KEYS, lexer.F_MAX,
+			lexer.F_MIN, lexer.F_MKTIME, lexer.F_MONOTIME, lexer.F_MTIME, lexer.F_ORD, lexer.F_PARSEQUERY, lexer.F_REDIS_SET, lexer.F_ROUND, lexer.F_SB_ADD,
+			lexer.F_SB_NEW, lexer.F_SETENV, lexer.F_SLEEP, lexer.F_SQL_CLOSE, lexer.F_SQL_EXEC, lexer.F_SQL_OPEN, lexer.F_SQL_QUERY, lexer.F_STAT, lexer.F_SYSTIME, lexer.F_TRUNC, lexer.F_UNSETENV, lexer.F_VALUES:
+			return true
+		}
+		return false
+	case *ast.UserCallExpr:
+		return !e.Native && t.returns[e.Index]
+	default:
+		return false
+	}
+}
@@ -0,0 +1,608 @@
+// Verification of compiled programs before they're executed
+
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/benhoyt/goawk/ast"
+	"github.com/benhoyt/goawk/lexer"
+)
+
+// Verify checks that the program's instructions are well-formed, so that
+// executing them can't index out of range or leave the stack unbalanced.
+// The compiler always produces valid programs, but ones that have been
+// assembled or loaded from elsewhere may not be. It checks that:
+//
+//   - every opcode is valid and its arguments fit in its block
+//   - constant, variable, function, builtin, and jump table operands
+//     are in range
+//   - jump targets (including those in jump tables) are the start of an instruction in the same block
+//     (or the end of it), and don't jump into or out of a ForIn body
+//   - the stack is never popped below the start of a block, each
+//     instruction sees the same stack depth however it's reached, and
+//     blocks leave the stack as they found it (patterns leave one value)
+//   - Return, TailCall, and BreakForIn are only used where they can
+//     work, and TailCall only calls the function it's in
+//   - Nulls is directly followed by the CallUser or TailCall that uses
+//     its values, and superinstructions by the rest of their sequence
+//
+// The error returned describes the first problem found, for example
+// "BEGIN: 0x0004: number index 7 out of range".
+func (p *Program) Verify() error {
+	if p.Begin != nil {
+		err := p.verifyBlock("BEGIN", p.Begin, nil, 0)
+		if err != nil {
+			return err
+		}
+	}
+	for i, action := range p.Actions {
+		if len(action.Pattern) > 2 {
+			return fmt.Errorf("action %d: too many patterns (%d)", i, len(action.Pattern))
+		}
+		for j, pattern := range action.Pattern {
+			name := "pattern"
+			if len(action.Pattern) == 2 {
+				name = [2]string{"start", "stop"}[j]
+			}
+			err := p.verifyBlock(fmt.Sprintf("action %d %s", i, name), pattern, nil, 1)
+			if err != nil {
+				return err
+			}
+		}
+		err := p.verifyBlock(fmt.Sprintf("action %d body", i), action.Body, nil, 0)
+		if err != nil {
+			return err
+		}
+	}
+	if p.End != nil {
+		err := p.verifyBlock("END", p.End, nil, 0)
+		if err != nil {
+			return err
+		}
+	}
+	for i := range p.Functions {
+		f := &p.Functions[i]
+		if len(f.Arrays) != len(f.Params) {
+			return fmt.Errorf("function %s: has %d params but %d array flags", f.Name, len(f.Params), len(f.Arrays))
+		}
+		numArrays := 0
+		for _, isArray := range f.Arrays {
+			if isArray {
+				numArrays++
+			}
+		}
+		if f.NumArrays != numArrays || f.NumScalars != len(f.Params)-numArrays {
+			return fmt.Errorf("function %s: NumScalars and NumArrays don't match params", f.Name)
+		}
+		err := p.verifyBlock("function "+f.Name, f.Body, f, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyError is the internal error type raised by the verifier.
+type verifyError struct {
+	message string
+}
+
+func (e *verifyError) Error() string {
+	return e.message
+}
+
+// Verify a single block of code (function is nil if it's not a function
+// body), which must leave endDepth values on the stack.
+func (p *Program) verifyBlock(name string, code []Opcode, function *Function, endDepth int) (err error) {
+	defer func() {
+		// Use panic/recover like the compiler to avoid checking errors
+		// on every operand.
+		if r := recover(); r != nil {
+			// Convert to verifyError or re-panic
+			err = r.(*verifyError)
+		}
+	}()
+	v := &verifier{program: p, block: name, code: code, function: function}
+	v.region(0, len(code), endDepth, false)
+	return nil
+}
+
+// Verifier state for a single block.
+type verifier struct {
+	program  *Program
+	block    string
+	code     []Opcode
+	function *Function
+	addr     int // address of instruction being verified, for errors
+}
+
+func (v *verifier) errorf(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	panic(&verifyError{fmt.Sprintf("%s: 0x%04x: %s", v.block, v.addr, message)})
+}
+
+// Verify the region code[start:end], which is either the whole block or
+// the body of a ForIn loop (which the interpreter executes as its own
+// slice of code, so jumps can't cross region boundaries).
+func (v *verifier) region(start, end, endDepth int, inForIn bool) {
+	// First decode the instructions, checking their operands.
+	starts := make(map[int]bool)
+	for ip := start; ip < end; {
+		v.addr = ip
+		starts[ip] = true
+		size := v.instruction(ip, end, inForIn)
+		if code := v.code; code[ip] == ForIn {
+			bodyStart := ip + size
+			bodyEnd := bodyStart + int(code[ip+5])
+			if code[ip+5] < 0 || bodyEnd > end {
+				v.errorf("ForIn body extends outside its block")
+			}
+			v.region(bodyStart, bodyEnd, 0, true)
+			size += int(code[ip+5])
+		}
+		ip += size
+	}
+
+	// Then check jump targets and stack depth by following control flow.
+	depths := map[int]int{start: 0}
+	work := []int{start}
+	if start == end {
+		work = nil
+		if endDepth != 0 {
+			v.addr = start
+			v.errorf("block must leave %d value(s) on stack, not 0", endDepth)
+		}
+	}
+	reach := func(target, depth int) {
+		if target != end && !starts[target] {
+			v.errorf("jump target 0x%04x isn't the start of an instruction in this block", target)
+		}
+		old, ok := depths[target]
+		if !ok {
+			depths[target] = depth
+			if target != end {
+				work = append(work, target)
+			}
+			return
+		}
+		if old != depth {
+			v.errorf("stack depth at 0x%04x is %d from one path and %d from another", target, old, depth)
+		}
+	}
+	for len(work) > 0 {
+		ip := work[len(work)-1]
+		work = work[:len(work)-1]
+		v.addr = ip
+		depth := depths[ip]
+		need, delta := v.stackEffect(ip)
+		if depth < need {
+			v.errorf("%s needs %d value(s) on stack, but there are %d", v.code[ip], need, depth)
+		}
+		depth += delta
+
+		op := baseOpcode(v.code[ip])
+		next := ip + instructionSize(v.code, ip)
+		switch op {
+		case Return, TailCall:
+			if depth != 0 {
+				v.errorf("stack has %d extra value(s) at %s", depth, op)
+			}
+			continue
+		case ReturnNull, Next, Exit, BreakForIn:
+			continue
+		case ForIn:
+			next += int(v.code[ip+5])
+		case Jump:
+			reach(next+int(v.code[ip+1]), depth)
+			continue
+		case JumpFalse, JumpTrue, JumpEquals, JumpNotEquals, JumpLess,
+			JumpGreater, JumpLessOrEqual, JumpGreaterOrEqual, JumpEqualsNum,
+			JumpNotEqualsNum, JumpLessNum, JumpGreaterNum, JumpLessOrEqualNum,
+			JumpGreaterOrEqualNum:
+			reach(next+int(v.code[ip+1]), depth)
+		case Switch:
+			table := v.program.JumpTables[v.code[ip+1]]
+			for _, offset := range table.Nums {
+				reach(next+offset, depth)
+			}
+			for _, offset := range table.Strs {
+				reach(next+offset, depth)
+			}
+			reach(next+table.Default, depth)
+			continue
+		}
+		reach(next, depth)
+	}
+	if depth, ok := depths[end]; ok && depth != endDepth {
+		v.addr = end
+		v.errorf("block must leave %d value(s) on stack, not %d", endDepth, depth)
+	}
+}
+
+// Check the instruction at code[ip] and its operands, returning its size.
+func (v *verifier) instruction(ip, end int, inForIn bool) int {
+	code := v.code
+	op := code[ip]
+	if op < 0 || op >= EndOpcode {
+		v.errorf("invalid opcode %d", op)
+	}
+	if s := superinstructionsByOp[op]; s != nil {
+		// The virtual machine runs the whole sequence without checking
+		// the opcodes after the first
+		if s.match(code, ip, end) == 0 {
+			v.errorf("%s isn't followed by the rest of its sequence", op)
+		}
+		op = baseOpcode(op)
+	}
+	// Check the operands, and that they fit in the block
+	pos := ip + 1
+	for _, kind := range operands[op] {
+		if pos >= end {
+			v.errorf("%s arguments extend past end of block", op)
+		}
+		switch kind {
+		case arrayListOperand:
+			if code[pos] < 0 {
+				v.errorf("negative number of array arguments %d", code[pos])
+			}
+		case fieldListOperand:
+			if code[pos] < 1 {
+				v.errorf("%s needs at least 1 field, not %d", op, code[pos])
+			}
+		}
+		next := pos + kind.size(code, pos)
+		if next > end {
+			v.errorf("%s arguments extend past end of block", op)
+		}
+		v.operand(op, kind, code[pos:next])
+		pos = next
+	}
+	size := pos - ip
+	arg := func(i int) int { return int(code[ip+1+i]) }
+	p := v.program
+
+	// Then the checks that depend on more than one operand's kind
+	switch op {
+	case PrintSorted:
+		if arg(4) != 1 && arg(4) != 2 {
+			v.errorf("PrintSorted prints 1 or 2 values, not %d", arg(4))
+		}
+	case IndexMulti, ConcatMulti:
+		v.count(op, arg(0), 0)
+	case Nulls:
+		v.count(op, arg(0), 0)
+		if ip+size >= end || (code[ip+size] != CallUser && code[ip+size] != TailCall) {
+			v.errorf("Nulls must be followed by CallUser or TailCall")
+		}
+	case CallSprintf, CallMax, CallMin:
+		v.count(op, arg(0), 1)
+	case CallSqlQuery:
+		v.count(op, arg(2), 2)
+	case CallSqlExec:
+		v.count(op, arg(0), 2)
+	case SumFields:
+		if arg(0) < 0 {
+			v.errorf("field index negative: %d", arg(0))
+		}
+	case Print:
+		v.count(op, arg(0), 0)
+	case Printf:
+		v.count(op, arg(0), 1)
+	case CompareSpecialNum:
+		if index := arg(1); index != ast.V_NR && index != ast.V_FNR && index != ast.V_NF {
+			v.errorf("special variable index %d can't be compared directly", index)
+		}
+	case CallUser, TailCall:
+		if op == TailCall {
+			switch {
+			case v.function == nil:
+				v.errorf("TailCall outside function")
+			case &p.Functions[arg(0)] != v.function:
+				v.errorf("TailCall to %s from function %s", p.Functions[arg(0)].Name, v.function.Name)
+			case inForIn:
+				v.errorf("TailCall inside ForIn body")
+			}
+		}
+		f := p.Functions[arg(0)]
+		if arg(1) > f.NumArrays {
+			v.errorf("%d array arguments passed to %s, which has %d array params", arg(1), f.Name, f.NumArrays)
+		}
+	case CallNative:
+		v.count(op, arg(1), 0)
+	case Return, ReturnNull:
+		if v.function == nil {
+			v.errorf("%s outside function", op)
+		}
+	case BreakForIn:
+		if !inForIn {
+			v.errorf("BreakForIn outside ForIn body")
+		}
+	}
+	return size
+}
+
+// Check an operand of the given kind of instruction op, whose words are
+// args (jump targets are checked by region).
+func (v *verifier) operand(op Opcode, kind operandKind, args []Opcode) {
+	p := v.program
+	arg := int(args[0])
+	switch kind {
+	case numOperand:
+		v.index("number", arg, len(p.Nums))
+	case strOperand:
+		v.index("string", arg, len(p.Strs))
+	case regexOperand:
+		v.index("regex", arg, len(p.Regexes))
+		if p.Regexes[arg] == nil {
+			v.errorf("regex index %d is nil", arg)
+		}
+	case globalOperand:
+		v.global(arg)
+	case localOperand:
+		v.local(arg)
+	case specialOperand:
+		v.special(arg)
+	case globalArrayOperand:
+		v.array(ast.ScopeGlobal, arg)
+	case localArrayOperand:
+		v.array(ast.ScopeLocal, arg)
+	case scalarOperand:
+		v.scalar(ast.VarScope(arg), int(args[1]))
+	case arrayOperand:
+		v.array(ast.VarScope(arg), int(args[1]))
+	case augOpOperand:
+		v.augOp(arg)
+	case compareOperand:
+		if compareOp := Opcode(arg); compareOp < Equals || compareOp > GreaterOrEqual {
+			v.errorf("invalid comparison %d", arg)
+		}
+	case switchOperand:
+		v.index("jump table", arg, len(p.JumpTables))
+	case builtinOperand:
+		if arg < 0 || arg >= len(builtinEffects) {
+			v.errorf("invalid builtin %d", arg)
+		}
+	case funcOperand:
+		v.index("function", arg, len(p.Functions))
+	case nativeOperand:
+		v.index("native function", arg, len(p.nativeFuncNames))
+	case redirectOperand, optRedirectOperand:
+		v.redirect(op, arg)
+	case coverOperand:
+		v.index("cover", arg, len(p.CoverPos))
+	case arrayListOperand:
+		for i := 0; i < arg; i++ {
+			v.array(ast.VarScope(args[1+2*i]), int(args[2+2*i]))
+		}
+	case fieldListOperand:
+		for _, index := range args[1:] {
+			if index < 0 {
+				v.errorf("field index negative: %d", index)
+			}
+		}
+	}
+}
+
+func (v *verifier) index(kind string, index, length int) {
+	if index < 0 || index >= length {
+		v.errorf("%s index %d out of range", kind, index)
+	}
+}
+
+func (v *verifier) global(index int) {
+	v.index("global", index, len(v.program.scalarNames))
+}
+
+func (v *verifier) local(index int) {
+	if v.function == nil {
+		v.errorf("local variable used outside function")
+	}
+	v.index("local", index, v.function.NumScalars)
+}
+
+func (v *verifier) special(index int) {
+	if index <= ast.V_ILLEGAL || index > ast.V_LAST {
+		v.errorf("special variable index %d out of range", index)
+	}
+}
+
+func (v *verifier) scalar(scope ast.VarScope, index int) {
+	switch scope {
+	case ast.ScopeGlobal:
+		v.global(index)
+	case ast.ScopeLocal:
+		v.local(index)
+	case ast.ScopeSpecial:
+		v.special(index)
+	default:
+		v.errorf("invalid variable scope %d", scope)
+	}
+}
+
+func (v *verifier) array(scope ast.VarScope, index int) {
+	switch scope {
+	case ast.ScopeGlobal:
+		v.index("global array", index, len(v.program.arrayNames))
+	case ast.ScopeLocal:
+		if v.function == nil {
+			v.errorf("local array used outside function")
+		}
+		v.index("local array", index, v.function.NumArrays)
+	default:
+		v.errorf("invalid array scope %d", scope)
+	}
+}
+
+func (v *verifier) augOp(op int) {
+	if op < int(AugOpAdd) || op > int(AugOpMod) {
+		v.errorf("invalid augmented assignment operation %d", op)
+	}
+}
+
+func (v *verifier) count(op Opcode, n, min int) {
+	if n < min {
+		v.errorf("%s needs at least %d argument(s), not %d", op, min, n)
+	}
+}
+
+// Check the redirect operand of a print or getline instruction.
+func (v *verifier) redirect(op Opcode, redirect int) {
+	isPrint := op == Print || op == Printf || op == PrintSorted
+	switch lexer.Token(redirect) {
+	case lexer.ILLEGAL, lexer.PIPE:
+		return
+	case lexer.GREATER, lexer.APPEND:
+		if isPrint {
+			return
+		}
+	case lexer.LESS:
+		if !isPrint {
+			return
+		}
+	}
+	v.errorf("invalid redirect %d for %s", redirect, op)
+}
+
+// Return the number of stack values the instruction at code[ip] needs
+// and the change in stack depth after it runs.
+func (v *verifier) stackEffect(ip int) (need, delta int) {
+	code := v.code
+	arg := func(i int) int { return int(code[ip+1+i]) }
+	redirectArg := func(i int) int {
+		if lexer.Token(arg(i)) == lexer.ILLEGAL {
+			return 0
+		}
+		return 1
+	}
+
+	switch baseOpcode(code[ip]) {
+	case Num, Str, FieldInt, Global, Local, Special, Regex, CompareSpecialNum,
+		Record, SpecialNF, SpecialNR, CachedNF, CallCopy:
+		return 0, 1
+	case Getline, GetlineGlobal, GetlineLocal, GetlineSpecial:
+		n := redirectArg(0)
+		return n, 1 - n
+	case Dupe:
+		return 1, 1
+	case Drop, AssignGlobal, AssignLocal, AssignSpecial, Delete, IncrField,
+		IncrArrayGlobal, IncrArrayLocal, AugAssignGlobal, AugAssignLocal,
+		AugAssignSpecial, JumpFalse, JumpTrue, Switch, Exit, Return:
+		return 1, -1
+	case Swap:
+		return 2, 0
+	case Field, ArrayGlobal, ArrayLocal, InGlobal, InLocal, Not, UnaryMinus,
+		UnaryPlus, Boolean, CallSplit, CallKeys, CallValues, CallParsequery,
+		CallGlob, CallStat:
+		return 1, 0
+	case AssignField, AssignArrayGlobal, AssignArrayLocal, AugAssignField,
+		AugAssignArrayGlobal, AugAssignArrayLocal, JumpEquals, JumpNotEquals,
+		JumpLess, JumpGreater, JumpLessOrEqual, JumpGreaterOrEqual,
+		JumpEqualsNum, JumpNotEqualsNum, JumpLessNum, JumpGreaterNum,
+		JumpLessOrEqualNum, JumpGreaterOrEqualNum:
+		return 2, -2
+	case Add, Subtract, Multiply, Divide, Power, Modulo, Equals, NotEquals,
+		Less, Greater, LessOrEqual, GreaterOrEqual, Concat2, Match, NotMatch,
+		EqualsNum, NotEqualsNum, LessNum, GreaterNum, LessOrEqualNum,
+		GreaterOrEqualNum, CallSplitSep, CallSplitSeps, CallMatch, CallDumparr:
+		return 2, -1
+	case IndexMulti, ConcatMulti, CallSprintf, CallMax, CallMin, CallNative, CallSqlExec, CallSqlQuery:
+		n := arg(0)
+		switch code[ip] {
+		case CallNative:
+			n = arg(1)
+		case CallSqlQuery:
+			n = arg(2)
+		}
+		return n, 1 - n
+	case CallBuiltin:
+		effect := builtinEffects[arg(0)]
+		return effect.need, effect.delta
+	case CallUser:
+		n := v.program.Functions[arg(0)].NumScalars
+		return n, 1 - n
+	case TailCall:
+		n := v.program.Functions[arg(0)].NumScalars
+		return n, -n
+	case Nulls:
+		return 0, arg(0)
+	case SumFields:
+		return 1, 1
+	case Print, Printf:
+		n := arg(0) + redirectArg(1)
+		return n, -n
+	case PrintSorted:
+		n := redirectArg(5)
+		return n, -n
+	case GetlineField, GetlineArray:
+		// Field or array index is below the redirect's file or command
+		n := 1 + redirectArg(0)
+		return n, 1 - n
+	default:
+		// Nop, DeleteAll, IncrGlobal, IncrLocal, IncrSpecial, Jump, Next,
+		// ForIn, BreakForIn, ReturnNull
+		return 0, 0
+	}
+}
+
+// Stack effect of each builtin function, indexed by BuiltinOp.
+var builtinEffects = [...]struct{ need, delta int }{
+	BuiltinAtan2:        {2, -1},
+	BuiltinClose:        {1, 0},
+	BuiltinCos:          {1, 0},
+	BuiltinExp:          {1, 0},
+	BuiltinFflush:       {1, 0},
+	BuiltinFflushAll:    {0, 1},
+	BuiltinGsub:         {3, -1},
+	BuiltinIndex:        {2, -1},
+	BuiltinInt:          {1, 0},
+	BuiltinLength:       {0, 1},
+	BuiltinLengthArg:    {1, 0},
+	BuiltinLog:          {1, 0},
+	BuiltinMatch:        {2, -1},
+	BuiltinRand:         {0, 1},
+	BuiltinSin:          {1, 0},
+	BuiltinSqrt:         {1, 0},
+	BuiltinSrand:        {0, 1},
+	BuiltinSrandSeed:    {1, 0},
+	BuiltinSub:          {3, -1},
+	BuiltinSubstr:       {2, -1},
+	BuiltinSubstrLength: {3, -2},
+	BuiltinSystem:       {1, 0},
+	BuiltinTolower:      {1, 0},
+	BuiltinToupper:      {1, 0},
+	BuiltinAbs:          {1, 0},
+	BuiltinB64decode:    {2, -1},
+	BuiltinB64encode:    {2, -1},
+	BuiltinCeil:         {1, 0},
+	BuiltinChr:          {1, 0},
+	BuiltinFilesize:     {1, 0},
+	BuiltinFloor:        {1, 0},
+	BuiltinHmac:         {3, -2},
+	BuiltinMd5:          {1, 0},
+	BuiltinMktime:       {2, -1},
+	BuiltinMonotime:     {0, 1},
+	BuiltinMtime:        {1, 0},
+	BuiltinOrd:          {1, 0},
+	BuiltinRedisGet:     {1, 0},
+	BuiltinRedisIncr:    {2, -1},
+	BuiltinRedisSet:     {2, -1},
+	BuiltinRound:        {1, 0},
+	BuiltinRoundDigits:  {2, -1},
+	BuiltinSbAdd:        {2, -1},
+	BuiltinSbNew:        {0, 1},
+	BuiltinSbStr:        {1, 0},
+	BuiltinSetenv:       {2, -1},
+	BuiltinSha1:         {1, 0},
+	BuiltinSha256:       {1, 0},
+	BuiltinSleep:        {1, 0},
+	BuiltinSqlClose:     {1, 0},
+	BuiltinSqlOpen:      {1, 0},
+	BuiltinStrftime:     {3, -2},
+	BuiltinSystime:      {0, 1},
+	BuiltinTrunc:        {1, 0},
+	BuiltinTzconvert:    {3, -2},
+	BuiltinUnsetenv:     {1, 0},
+	BuiltinUrldecode:    {1, 0},
+	BuiltinUrlencode:    {1, 0},
+}
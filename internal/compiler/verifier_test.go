@@ -0,0 +1,227 @@
+package compiler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/benhoyt/goawk/ast"
+)
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		asm string
+		err string
+	}{
+		{`// BEGIN
+0000    Num 1 (0)
+0002    Print 1`, ""},
+		{`// BEGIN
+0000    Num 1 (0)
+0002    JumpFalse 0x0008
+0004    Str "x" (0)
+0006    Jump 0x000a
+0008    Str "y" (1)
+000a    Print 1`, ""},
+		{`// pattern
+0000    FieldInt 1`, ""},
+		{`// BEGIN
+0000    ForIn k a 0x000a
+0006    BreakForIn
+0007    Jump 0x000a
+0009    Nop`, ""},
+		{`// BEGIN
+0000    Str "out" (0)
+0002    PrintSorted k a 2 >`, ""},
+		{`// { body }
+0000    PrintFields 3 1 0`, ""},
+		{`// BEGIN
+0000    PrintSorted k a 3`, "BEGIN: 0x0000: PrintSorted prints 1 or 2 values, not 3"},
+		{`// BEGIN
+0000    PrintSorted k a 1 <`, "BEGIN: 0x0000: invalid redirect 21 for PrintSorted"},
+		{`// BEGIN
+0000    PrintSorted k a 1 |`, "BEGIN: 0x0000: PrintSorted needs 1 value(s) on stack, but there are 0"},
+		{`// BEGIN
+0000    Drop`, "BEGIN: 0x0000: Drop needs 1 value(s) on stack, but there are 0"},
+		{`// BEGIN
+0000    Num 1 (0)`, "BEGIN: 0x0002: block must leave 0 value(s) on stack, not 1"},
+		{`// pattern
+0000    Nop`, "action 0 pattern: 0x0001: block must leave 1 value(s) on stack, not 0"},
+		{`// { body }
+0000    Str "a" (1)
+0002    Str "b" (0)
+0004    Add
+0005    Drop`, ""},
+		{`// BEGIN
+0000    FieldInt 1
+0002    JumpTrue 0x0006
+0004    FieldInt 2
+0006    Nop`, "BEGIN: 0x0004: stack depth at 0x0006 is 0 from one path and 1 from another"},
+		{`// BEGIN
+0000    Num 1 (0)
+0002    JumpTrue 0x0000`, ""},
+		{`// BEGIN
+0000    CallBuiltin BuiltinSub
+0002    Drop`, "BEGIN: 0x0000: CallBuiltin needs 3 value(s) on stack, but there are 0"},
+		{`// BEGIN
+0000    ForIn k a 0x000a
+0006    Jump 0x000c
+0008    Nop
+0009    Nop
+000a    Nop
+000b    Nop`, "BEGIN: 0x0006: jump target 0x000c isn't the start of an instruction in this block"},
+		{`// BEGIN
+0000    Jump 0x0008
+0002    ForIn k a 0x000a
+0008    Nop
+0009    Nop`, "BEGIN: 0x0000: jump target 0x0008 isn't the start of an instruction in this block"},
+		{`// BEGIN
+0000    BreakForIn`, "BEGIN: 0x0000: BreakForIn outside ForIn body"},
+		{`// BEGIN
+0000    ReturnNull`, "BEGIN: 0x0000: ReturnNull outside function"},
+		{`// function f(a, b[])
+0000    Local a
+0002    Local a
+0004    Return`, "function f: 0x0004: stack has 1 extra value(s) at Return"},
+		{`// function f(a, b[])
+0000    Local a
+0002    Return`, ""},
+		{`// BEGIN
+0000    Nulls 1
+0002    CallUser f []
+0005    Drop
+
+        // function f(a)
+0000    ReturnNull`, ""},
+		{`// BEGIN
+0000    CallUser f []
+0003    Drop
+
+        // function f(a)
+0000    ReturnNull`, "BEGIN: 0x0000: CallUser needs 1 value(s) on stack, but there are 0"},
+		{`// BEGIN
+0000    CallUser f [x]
+0005    Drop
+
+        // function f()
+0000    ReturnNull`, "BEGIN: 0x0000: 1 array arguments passed to f, which has 0 array params"},
+		{`// function f(a, b[])
+0000    Local a
+0002    TailCall f [b]`, ""},
+		{`// function f(a)
+0000    Nulls 1
+0002    TailCall f []`, ""},
+		{`// function f(a)
+0000    Local a
+0002    Local a
+0004    TailCall f []`, "function f: 0x0004: stack has 1 extra value(s) at TailCall"},
+		{`// BEGIN
+0000    Num 1 (0)
+0002    TailCall f []
+
+        // function f(a)
+0000    ReturnNull`, "BEGIN: 0x0002: TailCall outside function"},
+		{`// function f(a)
+0000    Local a
+0002    TailCall g []
+
+        // function g(b)
+0000    ReturnNull`, "function f: 0x0002: TailCall to g from function f"},
+		{`// function f(a, b[])
+0000    ForIn a b 0x000d
+0006    Local a
+0008    TailCall f [b]`, "function f: 0x0008: TailCall inside ForIn body"},
+		{`// BEGIN
+0000    FieldInt 1
+0002    Switch "a":0x0004 "b":0x0008 default:0x000a
+0004    Nop
+0005    Jump 0x000a
+0007    Nop
+0008    Nop
+0009    Nop`, ""},
+		{`// BEGIN
+0000    FieldInt 1
+0002    Switch 1:0x0004 default:0x0006
+0004    FieldInt 2
+0006    Nop`, "BEGIN: 0x0004: stack depth at 0x0006 is 0 from one path and 1 from another"},
+	}
+	for _, test := range tests {
+		t.Run(test.asm, func(t *testing.T) {
+			prog, err := Assemble(strings.NewReader(test.asm), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = prog.Verify()
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestVerifyOperands(t *testing.T) {
+	// Corrupt programs the assembler won't produce
+	f := Function{Name: "f", Params: []string{"a"}, Arrays: []bool{false}, NumScalars: 1}
+	tests := []struct {
+		code []Opcode
+		err  string
+	}{
+		{[]Opcode{-5}, "BEGIN: 0x0000: invalid opcode -5"},
+		{[]Opcode{Num}, "BEGIN: 0x0000: Num arguments extend past end of block"},
+		{[]Opcode{Num, 1, Drop}, "BEGIN: 0x0000: number index 1 out of range"},
+		{[]Opcode{Str, -1, Drop}, "BEGIN: 0x0000: string index -1 out of range"},
+		{[]Opcode{Global, 5, Drop}, "BEGIN: 0x0000: global index 5 out of range"},
+		{[]Opcode{Local, 0, Drop}, "BEGIN: 0x0000: local variable used outside function"},
+		{[]Opcode{Special, 99, Drop}, "BEGIN: 0x0000: special variable index 99 out of range"},
+		{[]Opcode{DeleteAll, 7, 0}, "BEGIN: 0x0000: invalid array scope 7"},
+		{[]Opcode{AugAssignField, 9}, "BEGIN: 0x0000: invalid augmented assignment operation 9"},
+		{[]Opcode{CallBuiltin, 999}, "BEGIN: 0x0000: invalid builtin 999"},
+		{[]Opcode{CallUser, 3, 0}, "BEGIN: 0x0000: function index 3 out of range"},
+		{[]Opcode{CallUser, 0}, "BEGIN: 0x0000: CallUser arguments extend past end of block"},
+		{[]Opcode{CallNative, 0, 0}, "BEGIN: 0x0000: native function index 0 out of range"},
+		{[]Opcode{Print, -1, 0}, "BEGIN: 0x0000: Print needs at least 0 argument(s), not -1"},
+		{[]Opcode{Print, 0, 1000}, "BEGIN: 0x0000: invalid redirect 1000 for Print"},
+		{[]Opcode{PrintFields}, "BEGIN: 0x0000: PrintFields arguments extend past end of block"},
+		{[]Opcode{PrintFields, 0}, "BEGIN: 0x0000: PrintFields needs at least 1 field, not 0"},
+		{[]Opcode{PrintFields, 2, 1}, "BEGIN: 0x0000: PrintFields arguments extend past end of block"},
+		{[]Opcode{PrintFields, 1, -1}, "BEGIN: 0x0000: field index negative: -1"},
+		{[]Opcode{Cover, 0}, "BEGIN: 0x0000: cover index 0 out of range"},
+		{[]Opcode{FieldInt, 1, Switch, 1}, "BEGIN: 0x0002: jump table index 1 out of range"},
+		{[]Opcode{FieldInt, 1, Switch, 0, Nop}, "BEGIN: 0x0002: jump target 0x0007 isn't the start of an instruction in this block"},
+		{[]Opcode{Num, 0, SumFields, -1, Drop, Drop}, "BEGIN: 0x0002: field index negative: -1"},
+		{[]Opcode{Nulls, 1, Drop}, "BEGIN: 0x0000: Nulls must be followed by CallUser or TailCall"},
+		{[]Opcode{CompareSpecialNum, Add, ast.V_NR, 0, Drop}, "BEGIN: 0x0000: invalid comparison 42"},
+		{[]Opcode{CompareSpecialNum, Less, ast.V_RSTART, 0, Drop}, "BEGIN: 0x0000: special variable index 14 can't be compared directly"},
+		{[]Opcode{CompareSpecialNum, Less, ast.V_NF, 1, Drop}, "BEGIN: 0x0000: number index 1 out of range"},
+		{[]Opcode{FieldIntCompare, 1, Num, 0, Drop}, "BEGIN: 0x0000: FieldIntCompare isn't followed by the rest of its sequence"},
+		{[]Opcode{GlobalArithAssign, 0, Num, 0, Add, Drop}, "BEGIN: 0x0000: GlobalArithAssign isn't followed by the rest of its sequence"},
+		{[]Opcode{Jump, 5}, "BEGIN: 0x0000: jump target 0x0007 isn't the start of an instruction in this block"},
+		{[]Opcode{ForIn, 1, 0, 1, 0, 2}, "BEGIN: 0x0000: ForIn body extends outside its block"},
+	}
+	for _, test := range tests {
+		t.Run(test.err, func(t *testing.T) {
+			p := &Program{
+				Begin:       test.code,
+				Functions:   []Function{f},
+				Nums:        []float64{0},
+				Strs:        []string{""},
+				scalarNames: []string{"x"},
+				arrayNames:  []string{"ARGV", "ENVIRON"},
+				JumpTables:  []JumpTable{{Strs: map[string]int{"a": 0}, Default: 3}},
+			}
+			err := p.Verify()
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	if len(builtinEffects) != len(_BuiltinOp_index)-1 {
+		t.Fatalf("builtinEffects has %d entries, expected %d", len(builtinEffects), len(_BuiltinOp_index)-1)
+	}
+}
@@ -0,0 +1,312 @@
+// AWK associative arrays, with integer keys stored separately
+
+package interp
+
+import (
+	"strconv"
+)
+
+// Largest absolute value of an integer key that's stored as an int.
+// Larger integers are stored as strings, like other keys, so that a
+// key's number and string forms always agree on where it's stored.
+const maxIntKey = 999999999999999 // 15 digits
+
+// An AWK array. Keys are strings, but the most common keys by far are
+// integers, as in count[n]++ or the elements split() creates. Keys that
+// are integers in the form AWK converts them to strings (like "42",
+// but not "042", "4.2", or "-0") are stored in a map with int keys, so
+// they don't need to be formatted as strings or hashed as strings.
+// Other keys are stored in a map with string keys.
+//
+// An ordered array (see Config.OrderedArrays) also records its keys in
+// the order they were added, for iterating in that order. Deleting an
+// element leaves its key in order (it's skipped), and the stale keys
+// are removed when there are enough of them.
+//
+// A disk-backed array (see NewDiskArrayStore) keeps its elements in a
+// file instead, and the maps aren't used. Its elements are visited in
+// the order they were added.
+type array struct {
+	ints    map[int]value
+	strs    map[string]value
+	ordered bool
+	order   []arrayKey
+	stale   int        // number of deleted keys still in order
+	disk    *diskArray // file the elements are in, if disk-backed
+}
+
+// Key of an array element, as an int if it's an integer key (see
+// array), otherwise as a string.
+type arrayKey struct {
+	n     int
+	s     string
+	isInt bool
+}
+
+func newArray(ordered bool) *array {
+	return &array{ordered: ordered}
+}
+
+// Create an array for elements 1 to n, as split() makes, which the
+// caller must then set in a.ints.
+func newListArray(ordered bool, n int) *array {
+	a := &array{ints: make(map[int]value, n), ordered: ordered}
+	if ordered {
+		a.order = make([]arrayKey, n)
+		for i := range a.order {
+			a.order[i] = arrayKey{n: i + 1, isInt: true}
+		}
+	}
+	return a
+}
+
+// Return the key for the array subscript v.
+func (p *interp) arrayKey(v value) arrayKey {
+	if v.typ == typeNum {
+		if v.n == float64(int(v.n)) && v.n >= -maxIntKey && v.n <= maxIntKey {
+			return arrayKey{n: int(v.n), isInt: true}
+		}
+	}
+	return strKey(p.toString(v))
+}
+
+// Return the key for the string subscript s.
+func strKey(s string) arrayKey {
+	if n, ok := intKey(s); ok {
+		return arrayKey{n: n, isInt: true}
+	}
+	return arrayKey{s: s}
+}
+
+// Parse s as an integer key: it must be exactly the string that
+// strconv.Itoa would return for the number, with at most 15 digits.
+func intKey(s string) (int, bool) {
+	i := 0
+	if len(s) > 0 && s[0] == '-' {
+		i = 1
+	}
+	digits := len(s) - i
+	if digits == 0 || digits > 15 || (s[i] == '0' && (digits > 1 || i > 0)) {
+		return 0, false
+	}
+	n := 0
+	for ; i < len(s); i++ {
+		c := s[i] - '0'
+		if c > 9 {
+			return 0, false
+		}
+		n = n*10 + int(c)
+	}
+	if s[0] == '-' {
+		n = -n
+	}
+	return n, true
+}
+
+// String form of the key.
+func (k arrayKey) String() string {
+	if k.isInt {
+		return strconv.Itoa(k.n)
+	}
+	return k.s
+}
+
+func (a *array) get(k arrayKey) (value, bool) {
+	if a.disk != nil {
+		return a.disk.get(k.String())
+	}
+	if k.isInt {
+		v, ok := a.ints[k.n]
+		return v, ok
+	}
+	v, ok := a.strs[k.s]
+	return v, ok
+}
+
+func (a *array) set(k arrayKey, v value) {
+	if a.disk != nil {
+		a.disk.set(k.String(), v)
+		return
+	}
+	if a.ordered {
+		if _, ok := a.get(k); !ok {
+			a.order = append(a.order, k)
+		}
+	}
+	if k.isInt {
+		if a.ints == nil {
+			a.ints = make(map[int]value)
+		}
+		a.ints[k.n] = v
+		return
+	}
+	if a.strs == nil {
+		a.strs = make(map[string]value)
+	}
+	a.strs[k.s] = v
+}
+
+func (a *array) delete(k arrayKey) {
+	if a.disk != nil {
+		a.disk.delete(k.String())
+		return
+	}
+	if a.ordered {
+		if _, ok := a.get(k); ok {
+			a.stale++
+		}
+	}
+	if k.isInt {
+		delete(a.ints, k.n)
+	} else {
+		delete(a.strs, k.s)
+	}
+	if a.stale > 16 && a.stale > len(a.order)/2 {
+		a.compact()
+	}
+}
+
+// Remove the deleted keys from an ordered array's list of keys. A key
+// that was deleted and added again is kept at its last position.
+func (a *array) compact() {
+	seen := make(map[arrayKey]bool, a.len())
+	j := len(a.order)
+	for i := len(a.order) - 1; i >= 0; i-- {
+		k := a.order[i]
+		if _, ok := a.get(k); !ok || seen[k] {
+			continue
+		}
+		seen[k] = true
+		j--
+		a.order[j] = k
+	}
+	n := copy(a.order, a.order[j:])
+	a.order = a.order[:n]
+	a.stale = 0
+}
+
+// Delete all the elements.
+func (a *array) clear() {
+	if a.disk != nil {
+		a.disk.clear()
+		return
+	}
+	for n := range a.ints {
+		delete(a.ints, n)
+	}
+	for s := range a.strs {
+		delete(a.strs, s)
+	}
+	a.order = a.order[:0]
+	a.stale = 0
+}
+
+// Replace the elements with copies of the elements of src (in the same
+// order, if both are ordered).
+func (a *array) copy(src *array) {
+	if a == src {
+		return
+	}
+	a.clear()
+	if a.disk != nil || src.disk != nil {
+		_ = src.each(func(key string, v value) error {
+			a.set(strKey(key), v)
+			return nil
+		})
+		return
+	}
+	if src.ordered {
+		if src.stale > 0 {
+			src.compact()
+		}
+		for _, k := range src.order {
+			v, _ := src.get(k)
+			a.set(k, v)
+		}
+		return
+	}
+	for n, v := range src.ints {
+		a.set(arrayKey{n: n, isInt: true}, v)
+	}
+	for s, v := range src.strs {
+		a.set(arrayKey{s: s}, v)
+	}
+}
+
+func (a *array) len() int {
+	if a.disk != nil {
+		return a.disk.count
+	}
+	return len(a.ints) + len(a.strs)
+}
+
+// Call f with the key and value of each element of the array, in an
+// unspecified order (or the order they were added for an ordered
+// array), stopping early if f returns an error. As when ranging over a
+// Go map, elements that f adds may or may not be visited, and elements
+// that f deletes before they're reached aren't.
+func (a *array) each(f func(key string, v value) error) error {
+	if a.disk != nil {
+		return a.disk.each(f)
+	}
+	if a.ordered {
+		if a.stale > 0 {
+			a.compact()
+		}
+		// Iterate over a copy, as f may add or delete elements
+		keys := append([]arrayKey(nil), a.order...)
+		for _, k := range keys {
+			v, ok := a.get(k)
+			if !ok {
+				continue
+			}
+			err := f(k.String(), v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for n, v := range a.ints {
+		err := f(strconv.Itoa(n), v)
+		if err != nil {
+			return err
+		}
+	}
+	for s, v := range a.strs {
+		err := f(s, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the keys of all the elements, in an unspecified order (or the
+// order they were added for an ordered array).
+func (a *array) keys() []string {
+	keys := make([]string, 0, a.len())
+	if a.disk != nil {
+		_ = a.disk.each(func(key string, _ value) error {
+			keys = append(keys, key)
+			return nil
+		})
+		return keys
+	}
+	if a.ordered {
+		if a.stale > 0 {
+			a.compact()
+		}
+		for _, k := range a.order {
+			keys = append(keys, k.String())
+		}
+		return keys
+	}
+	for n := range a.ints {
+		keys = append(keys, strconv.Itoa(n))
+	}
+	for s := range a.strs {
+		keys = append(keys, s)
+	}
+	return keys
+}
@@ -0,0 +1,176 @@
+// Batch API for feeding records to a program from Go
+
+package interp
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/benhoyt/goawk/parser"
+)
+
+// Batcher runs a program's pattern-action blocks over records passed in
+// by the caller in batches, rather than read from Stdin or files. This
+// is for embedding GoAWK in a service that streams lots of records, as
+// it avoids the per-call overhead of starting a new execution for every
+// record, and returns each batch's output in one allocation.
+//
+// The BEGIN block runs when the Batcher is created and the END block
+// runs when it's closed, and their output goes to Config.Output. The
+// output that the pattern-action blocks print for each record is
+// returned by Process instead (output redirected to files or commands
+// is written there as usual). Variables, arrays, NR, and range
+// patterns carry over from one batch to the next.
+//
+// A plain getline in an action reads the next record in the batch;
+// the record it reads gets no output of its own. A Batcher isn't safe
+// for concurrent use.
+type Batcher struct {
+	interp  *interp
+	source  *batchSource
+	output  io.Writer // where BEGIN and END output goes
+	buf     bytes.Buffer
+	inRange []bool
+	exited  bool // exit statement was executed
+	closed  bool
+}
+
+// NewBatcher creates a Batcher for program using config, which is used
+// the same way as for ExecProgram except that Stdin, Source, and the
+// input files in Args are ignored. It runs the program's BEGIN block
+// before returning.
+func NewBatcher(program *parser.Program, config *Config) (b *Batcher, err error) {
+	defer catchDiskArrayError(&err)
+	p := newInterp(program)
+	p.ctx = context.Background()
+	p.ctxDone = p.ctx.Done()
+	err = p.setup(config)
+	if err != nil {
+		return nil, err
+	}
+	started := false
+	defer func() {
+		if !started {
+			p.closeAll() // BEGIN failed
+			b = nil
+		}
+	}()
+	b = &Batcher{
+		interp:  p,
+		source:  &batchSource{},
+		output:  p.output,
+		inRange: make([]bool, len(program.Compiled.Actions)),
+	}
+	p.source = b.source
+	p.sourceStarted = true // don't push filters down to the batches
+
+	err = p.executeBeginEnd(program.Compiled.Begin, false)
+	if err == errExit {
+		b.exited = true
+	} else if err != nil {
+		return nil, err
+	}
+	started = true
+	return b, nil
+}
+
+// Process runs the pattern-action blocks over each record in records,
+// returning a slice of the same length with the output printed while
+// processing each record (nil if there was none). If the program has
+// executed an exit statement, the remaining records are skipped, as are
+// records in subsequent batches.
+//
+// If there's an error, outputs holds the output of the records
+// processed so far, and the Batcher shouldn't be used except to Close.
+func (b *Batcher) Process(records [][]byte) (outputs [][]byte, err error) {
+	defer catchDiskArrayError(&err)
+	if b.closed {
+		return nil, newError("Process called on closed Batcher")
+	}
+	p := b.interp
+	outputs = make([][]byte, len(records))
+	if b.exited {
+		return outputs, nil
+	}
+
+	// Output for all records is written to one buffer, then split up
+	// into outputs at the end (copying so the buffer can be reused).
+	b.buf.Reset()
+	ends := make([]int, len(records))
+	b.source.records = records
+	b.source.pos = 0
+	p.output = &b.buf
+	defer func() {
+		p.output = b.output
+		b.source.records = nil
+		all := append([]byte(nil), b.buf.Bytes()...)
+		start := 0
+		for i, end := range ends {
+			if end > start {
+				outputs[i] = all[start:end:end]
+				start = end
+			}
+		}
+	}()
+
+	for {
+		line, err := p.nextLine()
+		if err == io.EOF {
+			return outputs, nil
+		}
+		if err != nil {
+			return outputs, err
+		}
+		index := b.source.pos - 1
+		p.setLine(line, false)
+		err = p.execRecord(p.program.Compiled.Actions, b.inRange)
+		ends[index] = b.buf.Len()
+
+		// Records read by getline while processing this one have no
+		// output, and keep the end offsets increasing.
+		for i := index + 1; i < b.source.pos; i++ {
+			ends[i] = ends[index]
+		}
+		if err == errExit {
+			b.exited = true
+			return outputs, nil
+		}
+		if err != nil {
+			return outputs, err
+		}
+	}
+}
+
+// Close runs the program's END block, closes any files and commands the
+// program opened, and returns the program's exit status. Close must be
+// called when done with the Batcher, even if Process returned an error.
+func (b *Batcher) Close() (status int, err error) {
+	defer catchDiskArrayError(&err)
+	if b.closed {
+		return 0, newError("Batcher already closed")
+	}
+	b.closed = true
+	p := b.interp
+	defer p.closeAll()
+	err = p.executeBeginEnd(p.program.Compiled.End, true)
+	if err != nil && err != errExit {
+		return 0, err
+	}
+	return p.exitStatus, p.savePersistentArrays()
+}
+
+// RecordSource that reads from the current batch of records.
+type batchSource struct {
+	records [][]byte
+	pos     int
+}
+
+func (s *batchSource) Next() (string, error) {
+	if s.pos >= len(s.records) {
+		return "", io.EOF
+	}
+	record := s.records[s.pos]
+	s.pos++
+	return string(record), nil
+}
@@ -0,0 +1,114 @@
+// Caches for compiled regexes and formats, and split() results
+
+package interp
+
+import (
+	"container/list"
+)
+
+// lruCache is a cache with string keys that holds at most max entries,
+// evicting the least recently used entry when it's full. Programs that
+// generate lots of dynamic regexes or formats keep their active ones
+// cached, rather than the cache filling up with stale ones.
+type lruCache struct {
+	max     int
+	entries map[string]*list.Element // of *lruEntry
+	order   *list.List               // most recently used first
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLRUCache(max int) *lruCache {
+	return &lruCache{
+		max:     max,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Change the maximum number of entries to max, evicting the least
+// recently used entries if there are more than that.
+func (c *lruCache) resize(max int) {
+	c.max = max
+	for c.order.Len() > max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// Return the value cached for key, and mark it as most recently used.
+func (c *lruCache) get(key string) (interface{}, bool) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).value, true
+}
+
+// Cache value for key, evicting the least recently used entry if the
+// cache is full.
+func (c *lruCache) add(key string, value interface{}) {
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*lruEntry).value = value
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.order.Len() >= c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key, value})
+}
+
+const (
+	splitCacheSize      = 8
+	maxCachedSplitBytes = 64 * 1024 // don't cache splits of longer strings
+)
+
+// splitCache holds the results of the last few calls to split(), as
+// programs often split the same string with the same separator over
+// and over, for example in a loop over the fields of each record. The
+// parts are substrings of the string, so the memory used is bounded by
+// splitCacheSize strings of at most maxCachedSplitBytes, plus the
+// slices of parts.
+type splitCache struct {
+	entries [splitCacheSize]splitEntry
+	next    int // entry to replace next
+}
+
+type splitEntry struct {
+	s     string
+	fs    string
+	parts []string // nil if the entry isn't used
+}
+
+// Return the cached parts of s split with separator fs. Comparing the
+// strings is usually fast, as a repeated split is usually of the same
+// string (or a different one of a different length).
+func (c *splitCache) get(s, fs string) ([]string, bool) {
+	for i := range c.entries {
+		e := &c.entries[i]
+		if e.parts != nil && len(e.s) == len(s) && e.fs == fs && e.s == s {
+			return e.parts, true
+		}
+	}
+	return nil, false
+}
+
+// Cache the parts of s split with fs, replacing the oldest entry.
+func (c *splitCache) add(s, fs string, parts []string) {
+	if len(s) > maxCachedSplitBytes {
+		return
+	}
+	if parts == nil {
+		parts = []string{}
+	}
+	c.entries[c.next] = splitEntry{s, fs, parts}
+	c.next = (c.next + 1) % splitCacheSize
+}
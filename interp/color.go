@@ -0,0 +1,64 @@
+// Highlighting regex matches in output (see Config.Color)
+
+package interp
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ANSI escape sequences to start and end highlighting (bold red, like
+// grep --color)
+const (
+	colorStart = "\x1b[1;31m"
+	colorEnd   = "\x1b[0m"
+)
+
+// Record that re matched the current line, so that its matches are
+// highlighted when the line or its fields are printed. The list is
+// reset by setLine.
+func (p *interp) colorMatch(re *regexp.Regexp) {
+	for _, r := range p.colorRegexes {
+		if r == re {
+			return
+		}
+	}
+	p.colorRegexes = append(p.colorRegexes, re)
+}
+
+// Return s with the parts of it matched by the regexes that matched the
+// current line highlighted.
+func (p *interp) highlight(s string) string {
+	var spans [][]int
+	for _, re := range p.colorRegexes {
+		for _, span := range re.FindAllStringIndex(s, -1) {
+			if span[0] < span[1] {
+				spans = append(spans, span)
+			}
+		}
+	}
+	if len(spans) == 0 {
+		return s
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+
+	var sb strings.Builder
+	last := 0 // end of what's been written so far
+	for i := 0; i < len(spans); {
+		// Merge overlapping or adjacent matches into one highlight
+		start, end := spans[i][0], spans[i][1]
+		for i++; i < len(spans) && spans[i][0] <= end; i++ {
+			if spans[i][1] > end {
+				end = spans[i][1]
+			}
+		}
+		sb.WriteString(s[last:start])
+		sb.WriteString(colorStart)
+		sb.WriteString(s[start:end])
+		sb.WriteString(colorEnd)
+		last = end
+	}
+	sb.WriteString(s[last:])
+	return sb.String()
+}
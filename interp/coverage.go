@@ -0,0 +1,152 @@
+// Statement coverage counts and reports
+
+package interp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+
+	. "github.com/benhoyt/goawk/lexer"
+	"github.com/benhoyt/goawk/parser"
+)
+
+// Coverage records how many times each statement and pattern of a
+// program has run. The program must be parsed with
+// ParserConfig.Coverage set. Pass a Coverage to one or more executions
+// of the program via Config.Coverage, and the counts from all of them
+// are added together, for example when running a program's test suite.
+// A Coverage isn't safe for use by concurrent executions.
+type Coverage struct {
+	program *parser.Program
+	counts  []int
+}
+
+// CoverageCount is how many times the statement or pattern starting at
+// Position has run.
+type CoverageCount struct {
+	Position Position
+	Count    int
+}
+
+// CoverageFile describes one of the source files a program was
+// concatenated from, for reporting coverage by file (see WriteLCOV).
+type CoverageFile struct {
+	Name  string // file name to use in the report
+	Lines int    // number of lines the file takes up in the program
+
+	// Line of the file these lines start at, if they're only part of
+	// it (0 means 1), as in parser.File
+	StartLine int
+}
+
+// NewCoverage creates a Coverage for program, with all counts zero. It
+// returns an error if the program wasn't parsed with
+// ParserConfig.Coverage.
+func NewCoverage(program *parser.Program) (*Coverage, error) {
+	if program.Compiled.CoverPos == nil {
+		return nil, newError("program wasn't parsed with ParserConfig.Coverage")
+	}
+	return &Coverage{
+		program: program,
+		counts:  make([]int, len(program.Compiled.CoverPos)),
+	}, nil
+}
+
+// Counts returns the count for every statement and pattern in the
+// program, in source order. Statements the compiler eliminated because
+// they can never run are included with a count of zero.
+func (c *Coverage) Counts() []CoverageCount {
+	counts := make([]CoverageCount, len(c.counts))
+	for i, pos := range c.program.Compiled.CoverPos {
+		counts[i] = CoverageCount{pos, c.counts[i]}
+	}
+	return counts
+}
+
+// Coverage of one source line: the highest count of the statements
+// and patterns that start on it, and whether any of them never ran.
+type lineCoverage struct {
+	count   int
+	anyZero bool
+}
+
+func (c *Coverage) lines() map[int]lineCoverage {
+	lines := make(map[int]lineCoverage)
+	for _, cc := range c.Counts() {
+		line := lines[cc.Position.Line]
+		if cc.Count > line.count {
+			line.count = cc.Count
+		}
+		if cc.Count == 0 {
+			line.anyZero = true
+		}
+		lines[cc.Position.Line] = line
+	}
+	return lines
+}
+
+// WriteLCOV writes the line coverage to writer as an LCOV tracefile,
+// one record per file in files, in order (a file that @include split
+// into parts has a record for each part, which LCOV tools combine). A
+// line's count is the highest count of the statements that start on
+// it.
+func (c *Coverage) WriteLCOV(writer io.Writer, files []CoverageFile) error {
+	lines := c.lines()
+	w := bufio.NewWriter(writer)
+	start := 1
+	for _, file := range files {
+		fmt.Fprintf(w, "TN:\nSF:%s\n", file.Name)
+		found, hit := 0, 0
+		startLine := file.StartLine
+		if startLine < 1 {
+			startLine = 1
+		}
+		for line := start; line < start+file.Lines; line++ {
+			cov, ok := lines[line]
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(w, "DA:%d,%d\n", line-start+startLine, cov.count)
+			found++
+			if cov.count > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(w, "LF:%d\nLH:%d\nend_of_record\n", found, hit)
+		start += file.Lines
+	}
+	return w.Flush()
+}
+
+// WriteListing writes the program source src (which must be the
+// source it was parsed from), with each line prefixed by its count in
+// the style of gcov: "-" if no statements start on the line, "#####"
+// if none of them ran, otherwise the highest count of the statements
+// on the line. A "*" after the count means some of the statements on
+// the line ran but others didn't.
+func (c *Coverage) WriteListing(writer io.Writer, src []byte) error {
+	lines := c.lines()
+	w := bufio.NewWriter(writer)
+	srcLines := bytes.Split(src, []byte{'\n'})
+	for len(srcLines) > 0 && len(srcLines[len(srcLines)-1]) == 0 {
+		srcLines = srcLines[:len(srcLines)-1]
+	}
+	for i, srcLine := range srcLines {
+		count := "-"
+		if cov, ok := lines[i+1]; ok {
+			switch {
+			case cov.count == 0:
+				count = "#####"
+			case cov.anyZero:
+				count = strconv.Itoa(cov.count) + "*"
+			default:
+				count = strconv.Itoa(cov.count)
+			}
+		}
+		fmt.Fprintf(w, "%9s:%5d:%s\n", count, i+1, srcLine)
+	}
+	return w.Flush()
+}
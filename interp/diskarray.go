@@ -0,0 +1,594 @@
+// Disk-backed arrays, whose elements are kept in a file rather than in
+// memory (see NewDiskArrayStore)
+
+package interp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// A disk array's file is a hash table of its elements, so an element
+// can be found without reading the others, and an array can be larger
+// than memory. The file starts with a header:
+//
+//	magic    [8]byte  "GOAWKDA1"
+//	buckets  uint64   number of hash buckets (a power of 2)
+//	count    uint64   number of elements
+//	garbage  uint64   bytes used by deleted elements and moved values
+//	dirty    uint64   1 while the file is open
+//
+// This is followed by the bucket table, the offset of the first element
+// in each bucket's chain (or 0), and then the entries. Each entry is a
+// kind byte and a uint32 body size, then the body. An element's body
+// is:
+//
+//	next      uint64  offset of the next element in the chain, or 0
+//	valueOff  uint64  offset of the encoded value
+//	valueRoom uint32  bytes available at valueOff
+//	valueLen  uint32
+//	deleted   byte
+//	keyLen    uint32
+//	key       [keyLen]byte
+//	value     [room]byte  the value's initial room
+//
+// A value that outgrows its room is moved to a value entry at the end
+// of the file. Elements are appended as they're added, so reading the
+// entries in order visits the elements in the order they were added.
+// When there are too many elements for the buckets, or too much
+// garbage, the file is rebuilt. All integers are little-endian.
+const (
+	diskArrayMagic   = "GOAWKDA1"
+	diskHeaderSize   = 40
+	diskEntryHeader  = 5  // kind and body size
+	diskElementFixed = 29 // element body before the key
+	diskMinBuckets   = 1024
+
+	diskKindElement = 1
+	diskKindValue   = 2
+)
+
+// An open disk array file.
+type diskArray struct {
+	file      *os.File
+	path      string
+	buckets   uint64
+	count     int
+	garbage   int64
+	end       int64 // offset of the end of the entries
+	iterating int   // number of each calls in progress (which stop rebuilds)
+	cleared   int   // number of times cleared (which ends iterations)
+	failed    bool  // whether there's been an I/O error
+	buf       []byte
+	valueBuf  []byte
+}
+
+// Error reading or writing a disk array's file. The array methods can't
+// return errors, so they panic with this, and the interpreter's entry
+// points return it (see catchDiskArrayError).
+type diskArrayError struct {
+	err error
+}
+
+// Recover from a disk array error panic, setting *err to the error.
+// Each function that runs AWK code defers this.
+func catchDiskArrayError(err *error) {
+	if r := recover(); r != nil {
+		e, ok := r.(*diskArrayError)
+		if !ok {
+			panic(r)
+		}
+		*err = newError("disk array error: %v", e.err)
+	}
+}
+
+// Open the disk array file at path, creating it if it doesn't exist. A
+// file that wasn't closed properly (because the process was killed,
+// say) is rebuilt from its entries, as its counts and last entry may
+// not be complete.
+func openDiskArray(path string) (d *diskArray, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+		}
+	}()
+	d = &diskArray{file: f, path: path}
+	defer catchDiskArrayError(&err)
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		d.reset()
+	} else {
+		header := make([]byte, diskHeaderSize)
+		_, err = f.ReadAt(header, 0)
+		if err != nil || string(header[:8]) != diskArrayMagic {
+			return nil, fmt.Errorf("%s isn't a disk array file", path)
+		}
+		d.buckets = binary.LittleEndian.Uint64(header[8:])
+		d.count = int(binary.LittleEndian.Uint64(header[16:]))
+		d.garbage = int64(binary.LittleEndian.Uint64(header[24:]))
+		d.end = info.Size()
+		if d.buckets < diskMinBuckets || d.buckets&(d.buckets-1) != 0 || d.dataStart() > d.end {
+			return nil, fmt.Errorf("%s isn't a disk array file", path)
+		}
+		if binary.LittleEndian.Uint64(header[32:]) != 0 {
+			d.rebuild(d.buckets)
+		}
+	}
+	d.writeHeader(true)
+	return d, nil
+}
+
+// Write the header and close the file. The file is left marked dirty
+// after an I/O error, so it's rebuilt when it's next opened.
+func (d *diskArray) close() (err error) {
+	defer catchDiskArrayError(&err)
+	if !d.failed {
+		d.writeHeader(false)
+	}
+	return d.file.Close()
+}
+
+func (d *diskArray) fail(err error) {
+	d.failed = true
+	panic(&diskArrayError{err})
+}
+
+func (d *diskArray) readAt(n int, off int64) []byte {
+	if cap(d.buf) < n {
+		d.buf = make([]byte, n)
+	}
+	b := d.buf[:n]
+	_, err := d.file.ReadAt(b, off)
+	if err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("%s is truncated", d.path)
+		}
+		d.fail(err)
+	}
+	return b
+}
+
+// Like readAt, but read fewer than n bytes if the file ends first.
+func (d *diskArray) readAtMost(n int, off int64) []byte {
+	if cap(d.buf) < n {
+		d.buf = make([]byte, n)
+	}
+	b := d.buf[:n]
+	n, err := d.file.ReadAt(b, off)
+	if err != nil && err != io.EOF {
+		d.fail(err)
+	}
+	return b[:n]
+}
+
+func (d *diskArray) writeAt(b []byte, off int64) {
+	_, err := d.file.WriteAt(b, off)
+	if err != nil {
+		d.fail(err)
+	}
+}
+
+func (d *diskArray) readUint64(off int64) uint64 {
+	return binary.LittleEndian.Uint64(d.readAt(8, off))
+}
+
+func (d *diskArray) writeUint64(n uint64, off int64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], n)
+	d.writeAt(b[:], off)
+}
+
+func (d *diskArray) writeHeader(dirty bool) {
+	header := make([]byte, diskHeaderSize)
+	copy(header, diskArrayMagic)
+	binary.LittleEndian.PutUint64(header[8:], d.buckets)
+	binary.LittleEndian.PutUint64(header[16:], uint64(d.count))
+	binary.LittleEndian.PutUint64(header[24:], uint64(d.garbage))
+	if dirty {
+		binary.LittleEndian.PutUint64(header[32:], 1)
+	}
+	d.writeAt(header, 0)
+}
+
+// Offset of the first entry, after the bucket table.
+func (d *diskArray) dataStart() int64 {
+	return diskHeaderSize + int64(d.buckets)*8
+}
+
+// Offset of the head of key's bucket chain in the bucket table.
+func (d *diskArray) bucket(key string) int64 {
+	// FNV-1a
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return diskHeaderSize + int64(h&(d.buckets-1))*8
+}
+
+// Fixed fields of an element entry.
+type diskElement struct {
+	next      int64
+	valueOff  int64
+	valueRoom int
+	valueLen  int
+	deleted   bool
+	keyLen    int
+}
+
+func decodeDiskElement(b []byte) diskElement {
+	return diskElement{
+		next:      int64(binary.LittleEndian.Uint64(b[diskEntryHeader:])),
+		valueOff:  int64(binary.LittleEndian.Uint64(b[diskEntryHeader+8:])),
+		valueRoom: int(binary.LittleEndian.Uint32(b[diskEntryHeader+16:])),
+		valueLen:  int(binary.LittleEndian.Uint32(b[diskEntryHeader+20:])),
+		deleted:   b[diskEntryHeader+24] != 0,
+		keyLen:    int(binary.LittleEndian.Uint32(b[diskEntryHeader+25:])),
+	}
+}
+
+// Find the element with the given key, returning its offset and
+// fields, and the offset of the pointer to it (in the bucket table or
+// the previous element). The offset is 0 if it isn't found.
+func (d *diskArray) find(key string) (int64, diskElement, int64) {
+	link := d.bucket(key)
+	off := int64(d.readUint64(link))
+	for off != 0 {
+		// Read the key along with the fixed fields: if the element's
+		// key is a different length, it's not a match anyway.
+		b := d.readAtMost(diskEntryHeader+diskElementFixed+len(key), off)
+		if len(b) < diskEntryHeader+diskElementFixed {
+			d.fail(fmt.Errorf("%s is truncated", d.path))
+		}
+		e := decodeDiskElement(b)
+		if e.keyLen == len(key) && string(b[diskEntryHeader+diskElementFixed:]) == key {
+			return off, e, link
+		}
+		link = off + diskEntryHeader
+		off = e.next
+	}
+	return 0, diskElement{}, link
+}
+
+func (d *diskArray) readValue(e diskElement) value {
+	return decodeDiskValue(d.readAt(e.valueLen, e.valueOff))
+}
+
+func (d *diskArray) get(key string) (value, bool) {
+	off, e, _ := d.find(key)
+	if off == 0 {
+		return value{}, false
+	}
+	return d.readValue(e), true
+}
+
+func (d *diskArray) set(key string, v value) {
+	d.valueBuf = appendDiskValue(d.valueBuf[:0], v)
+	encoded := d.valueBuf
+	off, e, link := d.find(key)
+	if off != 0 {
+		if len(encoded) > e.valueRoom {
+			// Move the value to a new entry with twice the room
+			room := 2 * len(encoded)
+			valueOff := d.appendEntry(diskKindValue, room, func(b []byte) {
+				copy(b, encoded)
+			}) + diskEntryHeader
+			d.garbage += int64(e.valueRoom)
+			var b [12]byte
+			binary.LittleEndian.PutUint64(b[:], uint64(valueOff))
+			binary.LittleEndian.PutUint32(b[8:], uint32(room))
+			d.writeAt(b[:], off+diskEntryHeader+8)
+		} else {
+			d.writeAt(encoded, e.valueOff)
+		}
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(len(encoded)))
+		d.writeAt(b[:], off+diskEntryHeader+20)
+		d.maybeRebuild()
+		return
+	}
+
+	d.appendElement(key, encoded, int64(d.readUint64(link)), link)
+	d.count++
+	d.maybeRebuild()
+}
+
+// Append a new element to the file, with next as the next element in
+// its chain, and point the pointer at link to it.
+func (d *diskArray) appendElement(key string, encoded []byte, next int64, link int64) {
+	b := encodeDiskElement(key, encoded, next, d.end)
+	off := d.end
+	d.writeAt(b, off)
+	d.end += int64(len(b))
+	// Link the element in once it's been written
+	d.writeUint64(uint64(off), link)
+}
+
+// Return the entry for an element at offset off with the given key,
+// encoded value, and next element.
+func encodeDiskElement(key string, encoded []byte, next int64, off int64) []byte {
+	room := len(encoded)
+	if len(encoded) > 0 && valueType(encoded[0]) != typeNum {
+		room += room / 2 // leave room for strings to grow
+	}
+	size := diskElementFixed + len(key) + room
+	b := make([]byte, diskEntryHeader+size)
+	b[0] = diskKindElement
+	binary.LittleEndian.PutUint32(b[1:], uint32(size))
+	body := b[diskEntryHeader:]
+	binary.LittleEndian.PutUint64(body, uint64(next))
+	binary.LittleEndian.PutUint64(body[8:], uint64(off+diskEntryHeader+diskElementFixed+int64(len(key))))
+	binary.LittleEndian.PutUint32(body[16:], uint32(room))
+	binary.LittleEndian.PutUint32(body[20:], uint32(len(encoded)))
+	binary.LittleEndian.PutUint32(body[25:], uint32(len(key)))
+	copy(body[diskElementFixed:], key)
+	copy(body[diskElementFixed+len(key):], encoded)
+	return b
+}
+
+// Append an entry of the given kind and body size at the end of the
+// file, with its body filled in by fill, and return its offset.
+func (d *diskArray) appendEntry(kind byte, size int, fill func(body []byte)) int64 {
+	b := make([]byte, diskEntryHeader+size)
+	b[0] = kind
+	binary.LittleEndian.PutUint32(b[1:], uint32(size))
+	fill(b[diskEntryHeader:])
+	off := d.end
+	d.writeAt(b, off)
+	d.end += int64(len(b))
+	return off
+}
+
+func (d *diskArray) delete(key string) {
+	off, e, link := d.find(key)
+	if off == 0 {
+		return
+	}
+	// Mark it deleted (for reading the entries in order), then unlink
+	// it from its chain
+	d.writeAt([]byte{1}, off+diskEntryHeader+24)
+	d.writeUint64(uint64(e.next), link)
+	d.count--
+	d.garbage += int64(diskEntryHeader + diskElementFixed + e.keyLen + e.valueRoom)
+	d.maybeRebuild()
+}
+
+// Delete all the elements.
+func (d *diskArray) clear() {
+	err := d.file.Truncate(0)
+	if err != nil {
+		d.fail(err)
+	}
+	d.reset()
+	d.writeHeader(true)
+	d.cleared++
+}
+
+// Set up an empty table (in an empty file).
+func (d *diskArray) reset() {
+	d.buckets = diskMinBuckets
+	d.count = 0
+	d.garbage = 0
+	d.end = d.dataStart()
+	err := d.file.Truncate(d.end)
+	if err != nil {
+		d.fail(err)
+	}
+}
+
+// Call f with the key and value of each element, in the order they
+// were added, as for array.each. Elements added by f aren't visited,
+// and if f clears the array, the iteration stops.
+func (d *diskArray) each(f func(key string, v value) error) error {
+	d.iterating++
+	defer func() { d.iterating-- }()
+	end := d.end
+	cleared := d.cleared
+	for off := d.dataStart(); off < end && d.cleared == cleared; {
+		// A value entry may be shorter than an element's fixed fields
+		b := d.readAtMost(diskEntryHeader+diskElementFixed, off)
+		if len(b) < diskEntryHeader {
+			d.fail(fmt.Errorf("%s is truncated", d.path))
+		}
+		kind := b[0]
+		size := int64(binary.LittleEndian.Uint32(b[1:]))
+		if kind == diskKindElement {
+			if len(b) < diskEntryHeader+diskElementFixed {
+				d.fail(fmt.Errorf("%s is truncated", d.path))
+			}
+			e := decodeDiskElement(b)
+			if !e.deleted {
+				key := string(d.readAt(e.keyLen, off+diskEntryHeader+diskElementFixed))
+				err := f(key, d.readValue(e))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		off += diskEntryHeader + size
+	}
+	return nil
+}
+
+// Rebuild the file if there are too many elements for the number of
+// buckets, or if most of it is garbage (unless it's being iterated
+// over, when the entries mustn't move).
+func (d *diskArray) maybeRebuild() {
+	if d.iterating > 0 {
+		return
+	}
+	switch {
+	case uint64(d.count) > 2*d.buckets:
+		d.rebuild(2 * d.buckets)
+	case d.garbage > 1<<20 && 2*d.garbage > d.end:
+		d.rebuild(d.buckets)
+	}
+}
+
+// Rebuild the file with the given number of buckets, copying the
+// elements that haven't been deleted (in order) to a new file that then
+// replaces it. This also recovers a file that wasn't closed properly,
+// stopping at an entry that wasn't completely written.
+func (d *diskArray) rebuild(buckets uint64) {
+	info, err := d.file.Stat()
+	if err != nil {
+		d.fail(err)
+	}
+	fileSize := info.Size()
+	tmp, err := ioutil.TempFile(filepath.Dir(d.path), filepath.Base(d.path)+".*.tmp")
+	if err != nil {
+		d.fail(err)
+	}
+	tmpName := tmp.Name()
+	defer func() {
+		if tmp != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmpName)
+		}
+	}()
+	err = tmp.Chmod(info.Mode().Perm())
+	if err != nil {
+		d.fail(err)
+	}
+
+	// Write the elements after room for the header and bucket table,
+	// keeping the bucket table in memory till the end
+	rebuilt := &diskArray{file: tmp, path: tmpName, buckets: buckets}
+	rebuilt.end = rebuilt.dataStart()
+	writer := bufio.NewWriterSize(tmp, 64*1024)
+	_, err = writer.Write(make([]byte, rebuilt.end))
+	if err != nil {
+		d.fail(err)
+	}
+	heads := make([]int64, buckets)
+	count := 0
+	dataStart := d.dataStart()
+	reader := bufio.NewReaderSize(io.NewSectionReader(d.file, dataStart, fileSize-dataStart), 64*1024)
+	header := make([]byte, diskEntryHeader)
+	for off := dataStart; ; {
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			break // end of the entries (or an incomplete one)
+		}
+		size := int64(binary.LittleEndian.Uint32(header[1:]))
+		if off+diskEntryHeader+size > fileSize {
+			break
+		}
+		entry := make([]byte, diskEntryHeader+size)
+		copy(entry, header)
+		_, err = io.ReadFull(reader, entry[diskEntryHeader:])
+		if err != nil {
+			d.fail(err)
+		}
+		if header[0] == diskKindElement && size >= diskElementFixed {
+			e := decodeDiskElement(entry)
+			keyStart := diskEntryHeader + diskElementFixed
+			keyEnd := keyStart + e.keyLen
+			if !e.deleted && keyEnd <= len(entry) && e.valueOff+int64(e.valueLen) <= fileSize {
+				var encoded []byte
+				if e.valueOff == off+int64(keyEnd) && keyEnd+e.valueLen <= len(entry) {
+					encoded = entry[keyEnd : keyEnd+e.valueLen]
+				} else {
+					encoded = d.readAt(e.valueLen, e.valueOff)
+				}
+				key := string(entry[keyStart:keyEnd])
+				h := (rebuilt.bucket(key) - diskHeaderSize) / 8
+				b := encodeDiskElement(key, encoded, heads[h], rebuilt.end)
+				_, err = writer.Write(b)
+				if err != nil {
+					d.fail(err)
+				}
+				heads[h] = rebuilt.end
+				rebuilt.end += int64(len(b))
+				count++
+			}
+		}
+		off += diskEntryHeader + size
+	}
+	err = writer.Flush()
+	if err != nil {
+		d.fail(err)
+	}
+	table := make([]byte, 8*len(heads))
+	for i, head := range heads {
+		binary.LittleEndian.PutUint64(table[8*i:], uint64(head))
+	}
+	rebuilt.writeAt(table, diskHeaderSize)
+	rebuilt.count = count
+	rebuilt.writeHeader(true)
+	err = tmp.Close()
+	tmp = nil
+	if err != nil {
+		_ = os.Remove(tmpName)
+		d.fail(err)
+	}
+
+	// Replace the old file (closing it first, as Windows doesn't allow
+	// renaming over an open file) and reopen it
+	_ = d.file.Close()
+	err = os.Rename(tmpName, d.path)
+	if err != nil {
+		_ = os.Remove(tmpName)
+		d.reopen()
+		d.fail(err)
+	}
+	d.reopen()
+	d.buckets = buckets
+	d.count = count
+	d.garbage = 0
+	d.end = rebuilt.end
+}
+
+// Reopen the file after rebuilding it.
+func (d *diskArray) reopen() {
+	f, err := os.OpenFile(d.path, os.O_RDWR, 0)
+	if err != nil {
+		d.fail(err)
+	}
+	d.file = f
+}
+
+// Append the encoding of v to b: its type, then the number as a
+// float64 and the string, as its type has them.
+func appendDiskValue(b []byte, v value) []byte {
+	b = append(b, byte(v.typ))
+	if v.typ == typeNum || v.typ == typeParsedNumStr {
+		var n [8]byte
+		binary.LittleEndian.PutUint64(n[:], math.Float64bits(v.n))
+		b = append(b, n[:]...)
+	}
+	if v.typ != typeNum && v.typ != typeNull {
+		b = append(b, v.s...)
+	}
+	return b
+}
+
+// Decode a value encoded by appendDiskValue.
+func decodeDiskValue(b []byte) value {
+	if len(b) == 0 {
+		return value{}
+	}
+	v := value{typ: valueType(b[0])}
+	b = b[1:]
+	if (v.typ == typeNum || v.typ == typeParsedNumStr) && len(b) >= 8 {
+		v.n = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		b = b[8:]
+	}
+	if v.typ != typeNum && v.typ != typeNull {
+		v.s = string(b)
+	}
+	return v
+}
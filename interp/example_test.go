@@ -94,3 +94,55 @@ func Example_funcs() {
 	// Output:
 	// 0 1 9 xyzxyzxyz
 }
+
+func Example_new() {
+	// We'll execute this program multiple times on different inputs.
+	src := `{ print $1, x, $3; x++ }`
+
+	// Parse the program and set up the interpreter.
+	prog, err := parser.ParseProgram([]byte(src), nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	interpreter := interp.New(prog)
+
+	// Run it once on one input; variables start afresh each time.
+	for _, input := range []string{"one two three\nfour five six", "1 2 3"} {
+		_, err = interpreter.Execute(&interp.Config{
+			Stdin: strings.NewReader(input),
+		})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	// Output:
+	// one  three
+	// four 1 six
+	// 1  3
+}
+
+func Example_capture() {
+	src := `{ total += $2; count[$1]++ }`
+	input := "apple 3\nbanana 5\napple 4\n"
+
+	prog, err := parser.ParseProgram([]byte(src), nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	_, vars, err := interp.ExecProgramCapture(prog, &interp.Config{
+		Stdin:       strings.NewReader(input),
+		Output:      &bytes.Buffer{},
+		CaptureVars: []string{"total", "count", "NR"},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	count := vars["count"].(map[string]interface{})
+	fmt.Println(vars["total"], vars["NR"], count["apple"], count["banana"])
+	// Output:
+	// 12 3 2 1
+}
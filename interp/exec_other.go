@@ -0,0 +1,106 @@
+//go:build !js && !wasip1
+// +build !js,!wasip1
+
+// Running commands for system(), pipes, and "cmd" | getline
+
+package interp
+
+import (
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+const execSupported = true
+
+// command is a process started by a pipe or getline from a command.
+type command = exec.Cmd
+
+// Executes code using configured system shell
+func (p *interp) execShell(code string) *exec.Cmd {
+	p.cancelPrefetch() // the command might change the next input file
+	p.pauseInput()     // or the current one
+	executable := p.shellCommand[0]
+	args := p.shellCommand[1:]
+	args = append(args, code)
+	cmd := exec.CommandContext(p.ctx, executable, args...)
+	cmd.Env = p.environ
+	return cmd
+}
+
+// Start the command for output redirected to a pipe, returning a writer
+// to its stdin.
+func (p *interp) startOutputCommand(name string) (io.Writer, error) {
+	cmd := p.execShell(name)
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, newError("error connecting to stdin pipe: %v", err)
+	}
+	cmd.Stdout = p.output
+	cmd.Stderr = p.errorOutput
+	p.flushOutputAndError() // ensure synchronization
+	err = cmd.Start()
+	if err != nil {
+		p.printErrorf("%s\n", err)
+		return ioutil.Discard, nil
+	}
+	p.commands[name] = cmd
+	buffered := p.newBufferedWriteCloser(w, w)
+	p.outputStreams[name] = buffered
+	return buffered, nil
+}
+
+// Start the command for "cmd" | getline, returning a scanner for its
+// stdout.
+func (p *interp) startInputCommand(name string) (*recordReader, error) {
+	cmd := p.execShell(name)
+	cmd.Stdin = p.stdin
+	cmd.Stderr = p.errorOutput
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, newError("error connecting to stdout pipe: %v", err)
+	}
+	p.flushOutputAndError() // ensure synchronization
+	err = cmd.Start()
+	if err != nil {
+		p.printErrorf("%s\n", err)
+		p.setErrno(err)
+		return newRecordReader(strings.NewReader(""), 0, nil, 1), nil
+	}
+	scanner := p.newScanner(r)
+	p.commands[name] = cmd
+	p.inputStreams[name] = r
+	p.scanners[name] = scanner
+	return scanner, nil
+}
+
+// Run cmdline for system(), returning its exit status, or -1 if it
+// couldn't be run.
+func (p *interp) runSystem(cmdline string) float64 {
+	cmd := p.execShell(cmdline)
+	cmd.Stdout = p.output
+	cmd.Stderr = p.errorOutput
+	_ = p.flushAll() // ensure synchronization
+	err := cmd.Start()
+	if err != nil {
+		p.printErrorf("%s\n", err)
+		return -1
+	}
+	err = cmd.Wait()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return float64(exitErr.ProcessState.ExitCode())
+		}
+		p.printErrorf("unexpected error running command %q: %v\n", cmdline, err)
+		return -1
+	}
+	return 0
+}
+
+// Wait for the commands started by pipes and getline to exit.
+func (p *interp) waitCommands() {
+	for _, cmd := range p.commands {
+		_ = cmd.Wait()
+	}
+}
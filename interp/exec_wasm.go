@@ -0,0 +1,32 @@
+//go:build js || wasip1
+// +build js wasip1
+
+// WebAssembly (js and wasip1) can't start processes
+
+package interp
+
+import "io"
+
+const execSupported = false
+
+// command is a process started by a pipe or getline from a command,
+// which never exists on WebAssembly.
+type command struct{}
+
+// NoExec is always in effect on WebAssembly, so these aren't called, but
+// they return an error in case they are.
+
+func (p *interp) startOutputCommand(name string) (io.Writer, error) {
+	return nil, newError("can't write to pipe on WebAssembly")
+}
+
+func (p *interp) startInputCommand(name string) (*recordReader, error) {
+	return nil, newError("can't read from pipe on WebAssembly")
+}
+
+func (p *interp) runSystem(cmdline string) float64 {
+	p.printErrorf("can't run command %q on WebAssembly\n", cmdline)
+	return -1
+}
+
+func (p *interp) waitCommands() {}
@@ -0,0 +1,118 @@
+// Fast path for trivial filter programs
+
+package interp
+
+import (
+	"io"
+	"strings"
+
+	"github.com/benhoyt/goawk/internal/compiler"
+)
+
+// fastFilter describes a program whose only pattern-action block is a
+// plain filter like "/regex/", "{ print $3 }", or "/regex/ { print }",
+// which can be run by a simple loop over the input instead of
+// executing its code in the virtual machine for every record.
+type fastFilter struct {
+	regex matcher // regex to match $0 with, or nil to match all records
+	field int     // field to print, or 0 for $0
+}
+
+// Return the fastFilter equivalent to the program's pattern-action
+// blocks, or false if there isn't one. Programs with an END block
+// aren't handled, as END can see the state left by the last record.
+func (p *interp) findFastFilter() (fastFilter, bool) {
+	prog := p.program.Compiled
+	if len(prog.Actions) != 1 || len(prog.End) > 0 {
+		return fastFilter{}, false
+	}
+	action := prog.Actions[0]
+
+	var filter fastFilter
+	switch len(action.Pattern) {
+	case 0:
+	case 1:
+		code := action.Pattern[0]
+		if len(code) != 2 || code[0] != compiler.Regex {
+			return fastFilter{}, false
+		}
+		filter.regex = p.matchers[code[1]]
+	default:
+		return fastFilter{}, false
+	}
+
+	code := action.Body
+	switch {
+	case len(code) == 0:
+		// No action is equivalent to { print $0 }
+	case len(code) == 3 && code[0] == compiler.PrintFields && code[1] == 1:
+		// print with no arguments, print $0, or print $n
+		filter.field = int(code[2])
+	default:
+		return fastFilter{}, false
+	}
+	return filter, true
+}
+
+// Execute the pattern-action block of a trivial filter program (see
+// fastFilter) over all the input records.
+func (p *interp) execFastFilter(filter fastFilter) error {
+	for {
+		line, err := p.nextLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p.setLine(line, false)
+		err = p.checkContext()
+		if err != nil {
+			return err
+		}
+		if filter.regex != nil && !filter.regex.MatchString(line) {
+			continue
+		}
+		if filter.field > 0 {
+			switch {
+			case len(p.fieldSep) == 1 && (p.fieldSep == " " || p.recordSep != "") && !p.noFieldSplit:
+				line = nthField(line, p.fieldSep[0], filter.field)
+			default:
+				p.ensureFields()
+				line = ""
+				if filter.field <= len(p.fields) {
+					line = p.fields[filter.field-1]
+				}
+			}
+		}
+		err = p.printLine(p.output, line)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Return the n'th field of line split by fieldSplitter on sep (the
+// same field strings.Fields or strings.Split would), or "" if there
+// aren't that many, without splitting the whole line.
+func nthField(line string, sep byte, n int) string {
+	s := newFieldSplitter(line, sep)
+	var buf [1]string
+	for i := 1; i <= n; i++ {
+		field := s.split(buf[:0], 1)
+		if len(field) == 0 {
+			break
+		}
+		if i == n {
+			return field[0]
+		}
+	}
+	if s.unicode {
+		fields := strings.Fields(line)
+		if n > len(fields) {
+			return ""
+		}
+		return fields[n-1]
+	}
+	return ""
+}
@@ -4,15 +4,28 @@ package interp
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"unicode"
 	"unicode/utf8"
 
-	"github.com/benhoyt/goawk/internal/ast"
+	"github.com/benhoyt/goawk/ast"
 	. "github.com/benhoyt/goawk/lexer"
 )
 
@@ -243,26 +256,278 @@ func validNativeType(typ reflect.Type) bool {
 
 // Guts of the split() function
 func (p *interp) split(s string, scope ast.VarScope, index int, fs string) (int, error) {
-	var parts []string
-	if fs == " " {
-		parts = strings.Fields(s)
-	} else if s == "" {
+	parts, ok := p.splitCache.get(s, fs)
+	if !ok {
+		if fs == " " {
+			parts = strings.Fields(s)
+		} else if s == "" {
+			// Leave parts 0 length on empty string
+		} else if utf8.RuneCountInString(fs) <= 1 {
+			parts = strings.Split(s, fs)
+		} else {
+			re, err := p.compileRegex(fs)
+			if err != nil {
+				return 0, err
+			}
+			parts = re.Split(s, -1)
+		}
+		p.splitCache.add(s, fs, parts)
+	}
+	array := newListArray(p.orderedArrays, len(parts))
+	for i, part := range parts {
+		array.ints[i+1] = p.inputStr(part)
+	}
+	p.replaceArray(p.arrayIndex(scope, index), array)
+	return len(parts), nil
+}
+
+// Guts of the split(s, a, fs, seps) function: like split, but also
+// set seps[i] to the separator between a[i] and a[i+1]. When fs is " ",
+// leading and trailing whitespace (if any) go in seps[0] and seps[n].
+func (p *interp) splitSeps(s string, scope ast.VarScope, index int, sepsScope ast.VarScope, sepsIndex int, fs string) (int, error) {
+	arrayIndex := p.arrayIndex(scope, index)
+	sepsArrayIndex := p.arrayIndex(sepsScope, sepsIndex)
+	if arrayIndex == sepsArrayIndex {
+		return 0, newError("split: can't use the same array for the second and fourth arguments")
+	}
+	var parts, seps []string
+	var leading, trailing string
+	switch {
+	case fs == " ":
+		start := 0
+		for i := 0; i < len(s); {
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if !unicode.IsSpace(r) {
+				i += size
+				continue
+			}
+			end := i
+			for i < len(s) {
+				r, size = utf8.DecodeRuneInString(s[i:])
+				if !unicode.IsSpace(r) {
+					break
+				}
+				i += size
+			}
+			if end == 0 {
+				leading = s[:i]
+			} else if i == len(s) {
+				parts = append(parts, s[start:end])
+				trailing = s[end:]
+			} else {
+				parts = append(parts, s[start:end])
+				seps = append(seps, s[end:i])
+			}
+			start = i
+		}
+		if start < len(s) {
+			parts = append(parts, s[start:])
+		}
+	case s == "":
 		// Leave parts 0 length on empty string
-	} else if utf8.RuneCountInString(fs) <= 1 {
+	case fs == "":
+		parts = strings.Split(s, "")
+	case utf8.RuneCountInString(fs) == 1:
 		parts = strings.Split(s, fs)
-	} else {
+		for i := 1; i < len(parts); i++ {
+			seps = append(seps, fs)
+		}
+	default:
 		re, err := p.compileRegex(fs)
 		if err != nil {
 			return 0, err
 		}
-		parts = re.Split(s, -1)
+		// Same splitting as Regexp.Split, recording the matches
+		start, end := 0, 0
+		for _, match := range re.FindAllStringIndex(s, -1) {
+			end = match[0]
+			if match[1] != 0 {
+				parts = append(parts, s[start:end])
+				seps = append(seps, s[match[0]:match[1]])
+			}
+			start = match[1]
+		}
+		if end != len(s) {
+			parts = append(parts, s[start:])
+		}
+		if len(seps) >= len(parts) && len(parts) > 0 {
+			seps = seps[:len(parts)-1]
+		}
 	}
-	array := make(map[string]value, len(parts))
+
+	partsArray := newListArray(p.orderedArrays, len(parts))
 	for i, part := range parts {
-		array[strconv.Itoa(i+1)] = numStr(part)
+		partsArray.ints[i+1] = p.inputStr(part)
+	}
+	sepsArray := newArray(p.orderedArrays)
+	if leading != "" {
+		sepsArray.set(arrayKey{n: 0, isInt: true}, p.inputStr(leading))
+	}
+	for i, sep := range seps {
+		sepsArray.set(arrayKey{n: i + 1, isInt: true}, p.inputStr(sep))
+	}
+	if trailing != "" {
+		sepsArray.set(arrayKey{n: len(parts), isInt: true}, p.inputStr(trailing))
+	}
+	p.replaceArray(arrayIndex, partsArray)
+	p.replaceArray(sepsArrayIndex, sepsArray)
+	return len(parts), nil
+}
+
+// Guts of the match(s, regex, a) function: like match, but also set
+// a[0] to the matched text, a[i] to the text matched by each
+// parenthesized subexpression that took part in the match, and
+// a[i, "start"] and a[i, "length"] to their positions, as in gawk.
+func (p *interp) matchArray(s, regex string, scope ast.VarScope, index int) (int, error) {
+	re, err := p.compileRegex(regex)
+	if err != nil {
+		return 0, err
+	}
+	array := p.newArrayAt(p.arrayIndex(scope, index))
+	loc := re.FindStringSubmatchIndex(s)
+	if loc == nil {
+		p.matchStart = 0
+		p.matchLength = -1
+		return 0, nil
+	}
+	for i := 0; i < len(loc); i += 2 {
+		if loc[i] < 0 {
+			continue // subexpression didn't take part in the match
+		}
+		n := strconv.Itoa(i / 2)
+		array.set(strKey(n), p.inputStr(s[loc[i]:loc[i+1]]))
+		array.set(strKey(n+p.subscriptSep+"start"), num(float64(loc[i]+1)))
+		array.set(strKey(n+p.subscriptSep+"length"), num(float64(loc[i+1]-loc[i])))
+	}
+	p.matchStart = loc[0] + 1
+	p.matchLength = loc[1] - loc[0]
+	return p.matchStart, nil
+}
+
+// Set array[1] to array[n] to the names of the files matching the
+// shell pattern, in sorted order, for glob(). Return n.
+func (p *interp) glob(pattern string, scope ast.VarScope, index int) (int, error) {
+	if p.noFileReads {
+		return 0, newError("can't call glob() due to NoFileReads")
+	}
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return 0, newError("invalid glob pattern %q", pattern)
+	}
+	array := newListArray(p.orderedArrays, len(names))
+	for i, name := range names {
+		array.ints[i+1] = str(name)
+	}
+	p.replaceArray(p.arrayIndex(scope, index), array)
+	return len(names), nil
+}
+
+// Return the metadata of the file at path (not following a symlink), or
+// nil after setting ERRNO if that fails, for stat(), filesize(), and
+// mtime(). Return an error if file reads aren't allowed.
+func (p *interp) fileInfo(path string) (os.FileInfo, error) {
+	if p.noFileReads {
+		return nil, newError("can't read file metadata due to NoFileReads")
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		p.setErrno(err)
+		return nil, nil
+	}
+	return info, nil
+}
+
+// Set the elements of array to the metadata of the file at path, like
+// Gawk's filefuncs extension does, for stat(). Return 0, or -1 if the
+// file can't be read (which sets ERRNO).
+func (p *interp) stat(path string, scope ast.VarScope, index int) (int, error) {
+	info, err := p.fileInfo(path)
+	if err != nil {
+		return 0, err
+	}
+	array := p.newArrayAt(p.arrayIndex(scope, index))
+	if info == nil {
+		return -1, nil
+	}
+	mode := info.Mode()
+	array.set(strKey("name"), str(path))
+	array.set(strKey("size"), num(float64(info.Size())))
+	array.set(strKey("mtime"), num(float64(info.ModTime().Unix())))
+	array.set(strKey("mode"), num(float64(mode.Perm())))
+	array.set(strKey("type"), str(fileType(mode)))
+	if mode&os.ModeSymlink != 0 {
+		if target, err := os.Readlink(path); err == nil {
+			array.set(strKey("linkval"), str(target))
+		}
+	}
+	return 0, nil
+}
+
+// Return the name of the type of file mode, as Gawk's stat() does.
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "chardev"
+	case mode&os.ModeDevice != 0:
+		return "blockdev"
+	default:
+		return "unknown"
+	}
+}
+
+// Split the URL query string s (like "a=1&b=x+y") into array, with its
+// names as keys and its values as the elements, both URL-decoded, for
+// parsequery(). A name that appears more than once gets its last
+// value. Return the number of elements.
+func (p *interp) parseQuery(s string, scope ast.VarScope, index int) int {
+	array := p.newArrayAt(p.arrayIndex(scope, index))
+	for _, param := range strings.Split(s, "&") {
+		if param == "" {
+			continue
+		}
+		name, value := param, ""
+		if i := strings.IndexByte(param, '='); i >= 0 {
+			name, value = param[:i], param[i+1:]
+		}
+		array.set(strKey(urlDecode(name)), p.inputStr(urlDecode(value)))
+	}
+	return array.len()
+}
+
+// Decode the URL percent-encoding in s, and "+" as a space, for
+// urldecode(). Unlike url.QueryUnescape, a "%" that isn't followed by
+// two hex digits is left as is, as log data isn't always well formed.
+func urlDecode(s string) string {
+	if strings.IndexByte(s, '%') < 0 && strings.IndexByte(s, '+') < 0 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '+' {
+			b.WriteByte(' ')
+			continue
+		}
+		if c == '%' && i+2 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(c)
 	}
-	p.arrays[p.arrayIndex(scope, index)] = array
-	return len(array), nil
+	return b.String()
 }
 
 // Guts of the sub() and gsub() functions
@@ -271,40 +536,58 @@ func (p *interp) sub(regex, repl, in string, global bool) (out string, num int,
 	if err != nil {
 		return "", 0, err
 	}
-	count := 0
-	out = re.ReplaceAllStringFunc(in, func(s string) string {
-		// Only do the first replacement for sub(), or all for gsub()
-		if !global && count > 0 {
-			return s
-		}
-		count++
-		// Handle & (ampersand) properly in replacement string
-		r := make([]byte, 0, 64) // Up to 64 byte replacement won't require heap allocation
-		for i := 0; i < len(repl); i++ {
-			switch repl[i] {
-			case '&':
-				r = append(r, s...)
-			case '\\':
-				i++
-				if i < len(repl) {
-					switch repl[i] {
-					case '&':
-						r = append(r, '&')
-					case '\\':
-						r = append(r, '\\')
-					default:
-						r = append(r, '\\', repl[i])
-					}
-				} else {
-					r = append(r, '\\')
+	// Only do the first replacement for sub(), or all for gsub()
+	var matches [][]int
+	if global {
+		matches = re.FindAllStringIndex(in, -1)
+	} else if match := re.FindStringIndex(in); match != nil {
+		p.subMatch[0] = match
+		matches = p.subMatch[:]
+	}
+	if len(matches) == 0 {
+		return in, 0, nil
+	}
+
+	// Build the output in the scratch buffer, so the only allocation
+	// is the final string
+	buf := p.subBuf[:0]
+	last := 0
+	for _, match := range matches {
+		buf = append(buf, in[last:match[0]]...)
+		buf = appendReplacement(buf, repl, in[match[0]:match[1]])
+		last = match[1]
+	}
+	buf = append(buf, in[last:]...)
+	p.subBuf = buf
+	return string(buf), len(matches), nil
+}
+
+// Append the sub() or gsub() replacement string repl to buf, with
+// each & (ampersand) replaced by matched, the text it replaces.
+func appendReplacement(buf []byte, repl, matched string) []byte {
+	for i := 0; i < len(repl); i++ {
+		switch repl[i] {
+		case '&':
+			buf = append(buf, matched...)
+		case '\\':
+			i++
+			if i < len(repl) {
+				switch repl[i] {
+				case '&':
+					buf = append(buf, '&')
+				case '\\':
+					buf = append(buf, '\\')
+				default:
+					buf = append(buf, '\\', repl[i])
 				}
-			default:
-				r = append(r, repl[i])
+			} else {
+				buf = append(buf, '\\')
 			}
+		default:
+			buf = append(buf, repl[i])
 		}
-		return string(r)
-	})
-	return out, count, nil
+	}
+	return buf
 }
 
 type cachedFormat struct {
@@ -313,11 +596,12 @@ type cachedFormat struct {
 }
 
 // Parse given sprintf format string into Go format string, along with
-// type conversion specifiers. Output is memoized in a simple cache
-// for performance.
+// type conversion specifiers. Output is memoized in an LRU cache for
+// performance.
 func (p *interp) parseFmtTypes(s string) (format string, types []byte, err error) {
-	if item, ok := p.formatCache[s]; ok {
-		return item.format, item.types, nil
+	if item, ok := p.formatCache.get(s); ok {
+		cached := item.(cachedFormat)
+		return cached.format, cached.types, nil
 	}
 
 	out := []byte(s)
@@ -360,24 +644,32 @@ func (p *interp) parseFmtTypes(s string) (format string, types []byte, err error
 		}
 	}
 
-	// Dumb, non-LRU cache: just cache the first N formats
 	format = string(out)
-	if len(p.formatCache) < maxCachedFormats {
-		p.formatCache[s] = cachedFormat{format, types}
-	}
+	p.formatCache.add(s, cachedFormat{format, types})
 	return format, types, nil
 }
 
-// Guts of sprintf() function (also used by "printf" statement)
+// Guts of sprintf() function
 func (p *interp) sprintf(format string, args []value) (string, error) {
+	err := p.format(format, args)
+	if err != nil {
+		return "", err
+	}
+	return p.formatBuf.String(), nil
+}
+
+// Format args according to the AWK format string into p.formatBuf
+// (used by sprintf and the "printf" statement, which writes the
+// buffer's bytes without making a string of them).
+func (p *interp) format(format string, args []value) error {
 	format, types, err := p.parseFmtTypes(format)
 	if err != nil {
-		return "", newError("format error: %s", err)
+		return newError("format error: %s", err)
 	}
 	if len(types) > len(args) {
-		return "", newError("format error: got %d args, expected %d", len(args), len(types))
+		return newError("format error: got %d args, expected %d", len(args), len(types))
 	}
-	converted := make([]interface{}, len(types))
+	converted := p.formatArgs[:0]
 	for i, t := range types {
 		a := args[i]
 		var v interface{}
@@ -388,6 +680,9 @@ func (p *interp) sprintf(format string, args []value) (string, error) {
 			v = int(a.num())
 		case 'f':
 			v = a.num()
+			if p.locale.DecimalPoint != "." {
+				v = localeFloat{a.num(), p.locale.DecimalPoint}
+			}
 		case 'u':
 			v = uint(a.num())
 		case 'c':
@@ -407,7 +702,300 @@ func (p *interp) sprintf(format string, args []value) (string, error) {
 			}
 			v = c
 		}
-		converted[i] = v
+		converted = append(converted, v)
+	}
+	p.formatBuf.Reset()
+	fmt.Fprintf(&p.formatBuf, format, converted...)
+	// Don't hold on to the args' strings
+	for i := range converted {
+		converted[i] = nil
+	}
+	p.formatArgs = converted
+	return nil
+}
+
+// Decode the base64 string s, for b64decode(), with the URL-safe
+// alphabet if urlSafe is true. Padding is optional, so this decodes
+// both padded and unpadded input (as in JWTs). Return "" if s isn't
+// valid base64.
+func base64Decode(s string, urlSafe bool) string {
+	encoding := base64.RawStdEncoding
+	if urlSafe {
+		encoding = base64.RawURLEncoding
+	}
+	b, err := encoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// Return the hex digest of the HMAC of data with key, using the hash
+// named by algo, for hmac().
+func hmacDigest(key, data, algo string) (string, error) {
+	var h func() hash.Hash
+	switch algo {
+	case "md5":
+		h = md5.New
+	case "sha1":
+		h = sha1.New
+	case "sha256":
+		h = sha256.New
+	default:
+		return "", newError(`hmac algorithm must be "md5", "sha1", or "sha256", not %q`, algo)
+	}
+	mac := hmac.New(h, []byte(key))
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Round x to the given number of digits after the decimal point (or
+// before it, if digits is negative), with halves rounded away from
+// zero, for round(x, digits).
+func roundDigits(x float64, digits int) float64 {
+	scale := math.Pow10(digits)
+	if scale == 0 {
+		return 0 // so few digits that none are left
+	}
+	scaled := x * scale
+	if math.IsInf(scaled, 0) {
+		return x // so many digits that rounding doesn't change x
+	}
+	return math.Round(scaled) / scale
+}
+
+// Return the UTF-8 encoding of the code point n, for chr(). Return ""
+// if n isn't a valid code point.
+func chr(n float64) string {
+	if n < 0 || n > utf8.MaxRune || n != n {
+		return ""
+	}
+	r := rune(n)
+	if !utf8.ValidRune(r) {
+		return ""
+	}
+	return string(r)
+}
+
+// Return the code point of the first character of s, for ord(). If s
+// doesn't start with valid UTF-8, return its first byte instead, so
+// that ord works on binary data. Return 0 if s is empty.
+func ord(s string) int {
+	if s == "" {
+		return 0
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if r == utf8.RuneError && size == 1 {
+		return int(s[0])
+	}
+	return int(r)
+}
+
+// Return the string builder for the given sb_new() handle, or an error
+// if the handle is invalid.
+func (p *interp) stringBuilder(handle value) (*strings.Builder, error) {
+	n := int(handle.num())
+	if n < 1 || n > len(p.builders) {
+		return nil, newError("invalid string builder handle %s", p.toString(handle))
+	}
+	return p.builders[n-1], nil
+}
+
+// Set dst[1] to dst[n] to the keys of src (or its values if values is
+// true), for keys() and values(), first deleting the elements of dst.
+// If sorted is true they're in sorted key order, so that the keys and
+// the values lists of an array line up. Return n.
+func (p *interp) listArray(src, dst *array, values, sorted bool) int {
+	keys := src.keys()
+	if sorted {
+		sortKeys(keys, p.locale.Collate)
+	}
+	elems := make([]value, len(keys))
+	for i, k := range keys {
+		if values {
+			elems[i], _ = src.get(strKey(k))
+		} else {
+			elems[i] = str(k)
+		}
+	}
+	dst.clear()
+	for i, v := range elems {
+		dst.set(arrayKey{n: i + 1, isInt: true}, v)
+	}
+	return len(elems)
+}
+
+// Write array to dest (or stdout if dest is "") in the given format,
+// "tsv" (the default), "csv", or "json", in sorted key order. Return
+// the number of elements written.
+func (p *interp) dumpArray(scope ast.VarScope, index int, format string, dest value) (int, error) {
+	if format == "" {
+		format = "tsv"
+	}
+	if format != "tsv" && format != "csv" && format != "json" {
+		return 0, newError("dumparr format must be \"tsv\", \"csv\", or \"json\", not %q", format)
+	}
+	output := p.output
+	if p.toString(dest) != "" {
+		var err error
+		output, err = p.getOutputStream(GREATER, dest)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	array := p.array(scope, index)
+	keys := array.keys()
+	sortKeys(keys, p.locale.Collate)
+
+	if format == "json" {
+		var buf bytes.Buffer
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(&buf, k)
+			buf.WriteByte(':')
+			v, _ := array.get(strKey(k))
+			if v.typ == typeNum && !math.IsNaN(v.n) && !math.IsInf(v.n, 0) {
+				buf.WriteString(v.str(p.outputFormat))
+			} else {
+				writeJSONString(&buf, v.str(p.outputFormat))
+			}
+		}
+		buf.WriteByte('}')
+		return len(keys), p.printLine(output, buf.String())
 	}
-	return fmt.Sprintf(format, converted...), nil
+
+	quote := quoteTSV
+	sep := "\t"
+	if format == "csv" {
+		quote = quoteCSV
+		sep = ","
+	}
+	for _, k := range keys {
+		v, _ := array.get(strKey(k))
+		line := quote(k) + sep + quote(v.str(p.outputFormat))
+		err := p.printLine(output, line)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// Print the keys of an array (and their values if numArgs is 2) in
+// sorted key order, for "for (k in a) print k, a[k]". Like the loop,
+// leave the loop variable set to the last key.
+func (p *interp) printSorted(output io.Writer, varScope ast.VarScope, varIndex int,
+	arrayScope ast.VarScope, arrayIndex int, numArgs int) error {
+	array := p.array(arrayScope, arrayIndex)
+	keys := array.keys()
+	if !array.ordered {
+		sortKeys(keys, p.locale.Collate)
+	}
+
+	args := make([]value, numArgs)
+	for _, k := range keys {
+		err := p.checkContext()
+		if err != nil {
+			return err
+		}
+		args[0] = str(k)
+		if numArgs == 2 {
+			args[1], _ = array.get(strKey(k))
+		}
+		err = p.printValues(output, args)
+		if err != nil {
+			return err
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	last := str(keys[len(keys)-1])
+	switch varScope {
+	case ast.ScopeGlobal:
+		p.globals[varIndex] = last
+	case ast.ScopeLocal:
+		p.frame[varIndex] = last
+	default: // ScopeSpecial
+		return p.setSpecial(varIndex, last)
+	}
+	return nil
+}
+
+// Sort array keys: numeric keys first (in numeric order, with NaNs
+// last), then other keys in string order according to collate. A key is
+// numeric if it looks like a number as an input field would, and keys
+// that still compare equal are ordered by their bytes, so the order is
+// the same every time. Each key is parsed once, rather than on every
+// comparison.
+func sortKeys(keys []string, collate func(a, b string) int) {
+	s := keySorter{keys: keys, nums: make([]float64, len(keys)), isNum: make([]bool, len(keys)), collate: collate}
+	for i, k := range keys {
+		n, isStr := numStr(k).isTrueStr()
+		s.nums[i], s.isNum[i] = n, !isStr
+	}
+	sort.Sort(s)
+}
+
+type keySorter struct {
+	keys    []string
+	nums    []float64
+	isNum   []bool
+	collate func(a, b string) int
+}
+
+func (s keySorter) Len() int { return len(s.keys) }
+
+func (s keySorter) Less(i, j int) bool {
+	switch {
+	case s.isNum[i] && s.isNum[j]:
+		iNaN, jNaN := math.IsNaN(s.nums[i]), math.IsNaN(s.nums[j])
+		if iNaN != jNaN {
+			return jNaN
+		}
+		if !iNaN && s.nums[i] != s.nums[j] {
+			return s.nums[i] < s.nums[j]
+		}
+	case s.isNum[i]:
+		return true
+	case s.isNum[j]:
+		return false
+	default:
+		if c := s.collate(s.keys[i], s.keys[j]); c != 0 {
+			return c < 0
+		}
+	}
+	return s.keys[i] < s.keys[j]
+}
+
+func (s keySorter) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.nums[i], s.nums[j] = s.nums[j], s.nums[i]
+	s.isNum[i], s.isNum[j] = s.isNum[j], s.isNum[i]
+}
+
+var tsvReplacer = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+// Escape backslash, tab, and newline characters in a TSV field.
+func quoteTSV(s string) string {
+	return tsvReplacer.Replace(s)
+}
+
+// Quote a CSV field per RFC 4180 if it needs quoting.
+func quoteCSV(s string) string {
+	if !strings.ContainsAny(s, ",\"\r\n") {
+		return s
+	}
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(s)       // can't fail for a string
+	buf.Truncate(buf.Len() - 1) // remove newline added by Encode
 }
@@ -0,0 +1,36 @@
+// Garbage collector settings from Config
+
+package interp
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Apply the garbage collector settings in config, returning a function
+// that restores the previous ones.
+func applyGCSettings(config *Config) func() {
+	if config.GCPercent == 0 && config.MemoryLimit == 0 && config.GCBallast == 0 {
+		return func() {}
+	}
+	oldPercent, oldLimit := 0, int64(0)
+	if config.GCPercent != 0 {
+		oldPercent = debug.SetGCPercent(config.GCPercent)
+	}
+	if config.MemoryLimit != 0 {
+		oldLimit = setMemoryLimit(config.MemoryLimit)
+	}
+	var ballast []byte
+	if config.GCBallast > 0 {
+		ballast = make([]byte, config.GCBallast)
+	}
+	return func() {
+		if config.MemoryLimit != 0 {
+			setMemoryLimit(oldLimit)
+		}
+		if config.GCPercent != 0 {
+			debug.SetGCPercent(oldPercent)
+		}
+		runtime.KeepAlive(ballast)
+	}
+}
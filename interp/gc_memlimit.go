@@ -0,0 +1,11 @@
+//go:build go1.19
+// +build go1.19
+
+package interp
+
+import "runtime/debug"
+
+// Set the runtime's soft memory limit, returning the previous limit.
+func setMemoryLimit(limit int64) int64 {
+	return debug.SetMemoryLimit(limit)
+}
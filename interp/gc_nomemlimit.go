@@ -0,0 +1,10 @@
+//go:build !go1.19
+// +build !go1.19
+
+package interp
+
+// Go versions before 1.19 don't have a soft memory limit, so this
+// does nothing.
+func setMemoryLimit(limit int64) int64 {
+	return limit
+}
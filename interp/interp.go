@@ -4,11 +4,12 @@
 // cases and configuration options, first use the parser package to
 // parse the AWK source, and then use ExecProgram to execute it with
 // a specific configuration.
-//
 package interp
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"io"
@@ -16,15 +17,16 @@ import (
 	"math"
 	"math/rand"
 	"os"
-	"os/exec"
 	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
-	"github.com/benhoyt/goawk/internal/ast"
+	"github.com/benhoyt/goawk/ast"
 	"github.com/benhoyt/goawk/internal/compiler"
+	"github.com/benhoyt/goawk/lexer"
 	"github.com/benhoyt/goawk/parser"
 )
 
@@ -41,6 +43,11 @@ var (
 // interpreter error, for example a negative field index.
 type Error struct {
 	message string
+
+	// Source position of the statement or pattern that was executing
+	// when the error occurred, or the zero Position if it's not known
+	// (for example, for errors in the Config).
+	Position lexer.Position
 }
 
 func (e *Error) Error() string {
@@ -48,7 +55,17 @@ func (e *Error) Error() string {
 }
 
 func newError(format string, args ...interface{}) error {
-	return &Error{fmt.Sprintf(format, args...)}
+	return &Error{message: fmt.Sprintf(format, args...)}
+}
+
+// If err is an *Error without a position, set its position to that of
+// the instruction at code[ip-1], the one that was executing. Return
+// err.
+func (p *interp) locateError(err error, code []compiler.Opcode, ip int) error {
+	if e, ok := err.(*Error); ok && e.Position == (lexer.Position{}) && ip > 0 {
+		e.Position, _ = p.program.Compiled.Position(code, ip-1)
+	}
+	return err
 }
 
 type returnValue struct {
@@ -59,30 +76,48 @@ func (r returnValue) Error() string {
 	return "<return " + r.Value.str("%.6g") + ">"
 }
 
+// Returned by a TailCall instruction to tell the CallUser that started
+// the running function to run it again with the new arguments.
+type tailCall struct {
+	arrays []int // array arguments
+}
+
+func (t tailCall) Error() string {
+	return "<tail call>"
+}
+
 type interp struct {
 	// Input/output
 	output        io.Writer
 	errorOutput   io.Writer
-	scanner       *bufio.Scanner
-	scanners      map[string]*bufio.Scanner
+	printBuf      []byte        // scratch buffer for print output
+	formatBuf     bytes.Buffer  // scratch buffer for sprintf and printf output
+	formatArgs    []interface{} // scratch slice for format's converted args
+	subBuf        []byte        // scratch buffer for sub and gsub output
+	subMatch      [1][]int      // the match for sub, to avoid allocating a slice
+	scanner       recordScanner
+	scanners      map[string]*recordReader
 	stdin         io.Reader
 	filenameIndex int
 	hadFiles      bool
 	input         io.Reader
 	inputStreams  map[string]io.ReadCloser
 	outputStreams map[string]io.WriteCloser
-	commands      map[string]*exec.Cmd
+	commands      map[string]*command
 	noExec        bool
 	noFileWrites  bool
 	noFileReads   bool
+	argFiles      map[string]bool // files allowed despite noFileReads
 	shellCommand  []string
+	environ       []string // for commands, if changed by setenv() or unsetenv()
+	configEnviron []string
 
 	// Scalars, arrays, and function state
 	globals     []value
 	stack       []value
 	sp          int
 	frame       []value
-	arrays      []map[string]value
+	arrays      []*array
 	localArrays [][]int
 	callDepth   int
 	nativeFuncs []nativeFunc
@@ -91,16 +126,22 @@ type interp struct {
 	filename        value
 	line            string
 	lineIsTrueStr   bool
+	lineDirty       bool // fields assigned since line was built (see ensureLine)
 	lineNum         int
 	fileLineNum     int
 	fields          []string
 	fieldsIsTrueStr []bool
 	numFields       int
 	haveFields      bool
+	partialFields   bool          // fields holds only the first fields (see splitFieldsTo)
+	splitter        fieldSplitter // splits the rest of the line after them
+	noFieldSplit    bool
+	noFieldReuse    bool
 
 	// Built-in variables
 	argc             int
 	convertFormat    string
+	errno            string
 	outputFormat     string
 	fieldSep         string
 	fieldSepRegex    *regexp.Regexp
@@ -119,26 +160,84 @@ type interp struct {
 	nums      []float64
 	strs      []string
 	regexes   []*regexp.Regexp
+	matchers  []matcher // regexes as matchers, for the Regex instruction
 
 	// Misc pieces of state
-	random      *rand.Rand
-	randSeed    float64
-	exitStatus  int
-	regexCache  map[string]*regexp.Regexp
-	formatCache map[string]cachedFormat
+	random           *rand.Rand
+	randSeed         float64
+	exitStatus       int
+	regexCache       *lruCache // of *regexp.Regexp
+	matcherCache     *lruCache // of matcher
+	formatCache      *lruCache // of cachedFormat
+	splitCache       splitCache
+	builders         []*strings.Builder // string builders for sb_new() handles
+	databases        []*sql.DB          // databases for sql_open() handles (nil when closed)
+	sqlDriver        string
+	redis            *redisConn   // connection for redis_* functions (nil if not connected)
+	redisConfig      *redisConfig // nil if config.RedisURL isn't set
+	persistentArrays []persistentArray
+	locale           *Locale
+	numericPoint     string // decimal point for CONVFMT and OFMT output, if not "."
+	orderedArrays    bool
+	location         *time.Location
+	zones            map[string]*time.Location // cache for tzconvert()
+	startTime        time.Time                 // for monotime()
+
+	// Context for cancelling execution (see checkContext)
+	ctx        context.Context
+	ctxDone    <-chan struct{}
+	ctxCounter int
+
+	// Statement counts from Config.Coverage, if set
+	coverCounts []int
+
+	// Profile from Config.Profile, if set
+	profile *Profile
+
+	// Execution trace, if Config.Trace is set
+	trace *tracer
+
+	// Input from Config.Source or Config.Sources, if set
+	source          RecordSource
+	sourceStarted   bool
+	sources         map[string]func(url string) (RecordSource, error)
+	argSource       RecordSource // opened for the current ARGV file name, if any
+	recordInfoIndex int          // index of the RECORDINFO array, or -1 if unused
+	openURL         func(url string) (io.ReadCloser, error)
+
+	// Next input file being read in the background, if any
+	prefetchFiles bool
+	mmapFiles     bool
+	pipelineInput bool
+	prefetch      *prefetchedFile
+
+	outputBufSize       int
+	outputLineBuffered  bool
+	outputFlushInterval time.Duration
+	inputBufSize        int
+
+	// Limits from Config (or their defaults)
+	maxFieldIndex int
+	maxCallDepth  int
+
+	numberParser func(s string) (float64, bool)
+
+	// Regexes that matched the current line, if Config.Color is set
+	color        bool
+	colorRegexes []*regexp.Regexp
 }
 
-// Various const configuration. Could make these part of Config if
-// we wanted to, but no need for now.
+// Defaults for the limits and sizes that Config can change, and other
+// constant configuration.
 const (
 	maxCachedRegexes = 100
 	maxCachedFormats = 100
-	maxRecordLength  = 10 * 1024 * 1024 // 10MB seems like plenty
 	maxFieldIndex    = 1000000
 	maxCallDepth     = 1000
 	initialStackSize = 100
 	outputBufSize    = 64 * 1024
 	inputBufSize     = 64 * 1024
+	checkContextOps  = 1000 // number of checkContext calls between real checks
 )
 
 // Config defines the interpreter configuration for ExecProgram.
@@ -153,6 +252,42 @@ type Config struct {
 	// Writer for non-fatal error messages (defaults to os.Stderr)
 	Error io.Writer
 
+	// Size in bytes of the output buffers for standard output (when
+	// Output is nil) and for output redirected to files and commands.
+	// The default (0) is 64KB.
+	OutputBufferSize int
+
+	// Set to true to flush those output buffers after each write that
+	// includes a newline, like a terminal's line buffering, so that
+	// each line of output is seen as soon as it's printed.
+	OutputLineBuffered bool
+
+	// If nonzero, flush those output buffers at least this often, so
+	// that a consumer streaming the output doesn't wait long for output
+	// that's produced slowly (for example while the program waits for
+	// input). An Output writer provided by the caller isn't flushed.
+	OutputFlushInterval time.Duration
+
+	// Initial size in bytes of the buffers for reading input records,
+	// which grow as needed to hold longer records. The default (0) is
+	// 64KB.
+	InputBufferSize int
+
+	// Limits for programs that need more (or should be allowed less)
+	// than the defaults, which are used when these are zero:
+	//
+	// * MaxFieldIndex is the largest field index that can be assigned
+	//   to, and the largest value NF can be set to (1,000,000)
+	// * MaxCallDepth is the deepest nesting of calls to user-defined
+	//   functions (1000)
+	// * RegexCacheSize and FormatCacheSize are the numbers of dynamic
+	//   regexes and printf formats kept compiled, for programs that
+	//   cycle through more than that many (100 each)
+	MaxFieldIndex   int
+	MaxCallDepth    int
+	RegexCacheSize  int
+	FormatCacheSize int
+
 	// The name of the executable (accessible via ARGV[0])
 	Argv0 string
 
@@ -167,7 +302,9 @@ type Config struct {
 	Vars []string
 
 	// Map of named Go functions to allow calling from AWK. You need
-	// to pass this same map to the parser.ParseProgram config.
+	// to pass this same map to the parser.ParseProgram config. The
+	// functions loaded by the program's @load directives (see
+	// parser.Program.LoadedFuncs) are added to these.
 	//
 	// Functions can have any number of parameters, and variadic
 	// functions are supported. Functions can have no return values,
@@ -197,10 +334,18 @@ type Config struct {
 	// * NoFileWrites prevents writing to files via '>' or '>>'
 	// * NoFileReads prevents reading from files via getline or the
 	//   filenames in Args
+	//
+	// On WebAssembly (GOOS=js or wasip1), which can't run commands,
+	// NoExec is always in effect.
 	NoExec       bool
 	NoFileWrites bool
 	NoFileReads  bool
 
+	// Set to true along with NoFileReads to still allow reading the
+	// input files named in Args (but not files the program adds to
+	// ARGV, or reading with getline), like gawk's --sandbox option.
+	AllowArgFiles bool
+
 	// Exec args used to run system shell. Typically, this will
 	// be {"/bin/sh", "-c"}
 	ShellCommand []string
@@ -208,7 +353,210 @@ type Config struct {
 	// List of name-value pairs to be assigned to the ENVIRON special
 	// array, for example []string{"USER", "bob", "HOME", "/home/bob"}.
 	// If nil (the default), values from os.Environ() are used.
+	//
+	// Commands run with the process's environment, until the program
+	// calls setenv() or unsetenv(): after that they run with Environ
+	// (or the process's environment, if it's nil) with those changes.
 	Environ []string
+
+	// Locale used for case conversion, collation, and number and time
+	// formatting. If nil (the default), the POSIX "C" locale is used;
+	// the LANG and LC_* environment variables are never consulted.
+	Locale *Locale
+
+	// Time zone used by strftime() and mktime(). If nil (the default),
+	// the zone named by the TZ environment variable is used, taking TZ
+	// from Environ if that's set, otherwise the system's local time zone.
+	Location *time.Location
+
+	// Name of the database/sql driver that sql_open() uses, which the
+	// program using GoAWK must register (GoAWK doesn't include one),
+	// for example by importing a SQLite driver like
+	// github.com/mattn/go-sqlite3. If empty, the "sqlite3" driver is
+	// used if it's registered, otherwise the "sqlite" one.
+	SQLDriver string
+
+	// URL of the Redis server that redis_get(), redis_set(), and
+	// redis_incr() use, in the form redis://[[user]:password@]host[:port][/db]
+	// (or rediss:// to connect using TLS); the port defaults to 6379.
+	// This keeps the server's address and credentials out of the AWK
+	// source. If empty (the default), calling these is an error.
+	RedisURL string
+
+	// Names of variables whose final values ExecProgramCapture should
+	// return. These can be global scalars, arrays, or special variables
+	// like NR. ExecProgram ignores this field.
+	CaptureVars []string
+
+	// Source of input records to use instead of Stdin and the files in
+	// Args. If it's a FilteringSource, simple tests in the program's
+	// pattern may be pushed down to it to skip non-matching records.
+	Source RecordSource
+
+	// Functions that open record sources for input file names (in
+	// ARGV) that are URLs with a given scheme, keyed by the scheme. For
+	// example, if Sources["kafka"] is set, an argument like
+	// kafka://broker/topic is read from the RecordSource it returns
+	// for that URL, instead of being opened as a file, and FILENAME is
+	// the URL. The source is closed at its end if it's an io.Closer.
+	// These aren't used for getline < file.
+	Sources map[string]func(url string) (RecordSource, error)
+
+	// Function to open input file names that are URLs, like
+	// s3://bucket/key, in ARGV and for getline < file (other than the
+	// "string://" ones, and the schemes in Sources). The stream it
+	// returns is read like a file, as it's downloaded. See the objstore
+	// package's Open for one that handles S3 and Google Cloud Storage.
+	// Errors that are *os.PathError make getline return -1, as with a
+	// file that doesn't exist. If nil (the default), these are opened
+	// as file names.
+	OpenURL func(url string) (io.ReadCloser, error)
+
+	// If non-nil, add the number of times each statement and pattern
+	// runs to these counts. It must have been created with NewCoverage
+	// for the program being executed.
+	Coverage *Coverage
+
+	// If non-nil, add the time spent in each block and function to
+	// this profile. It must have been created with NewProfile for the
+	// program being executed, which must have been parsed with
+	// ParserConfig.NoInline so that every function call is counted.
+	Profile *Profile
+
+	// If non-nil, write a line to Trace as each statement and pattern
+	// runs, with its file and line, the current NR, and (the first
+	// line of) its source. The program must have been parsed with
+	// ParserConfig.Coverage, which marks where statements start.
+	// Normal output is flushed before each trace line, so the two are
+	// in order when they go to the same terminal.
+	Trace io.Writer
+
+	// With Trace, only trace the statements in these user-defined
+	// functions, instead of the whole program.
+	TraceFunctions []string
+
+	// With Trace, stop tracing after this many lines (and say so). If
+	// zero, there's no limit.
+	TraceLimit int
+
+	// Set to true to never split records into fields, regardless of
+	// FS: each non-empty record is a single field, so $1 is the same
+	// as $0 and NF is 1 (or 0 for an empty record). Records are
+	// only split when a field or NF is first used, so programs that
+	// only use $0 never pay for splitting anyway; this is for programs
+	// over wide records that use NF or $1 but don't need the fields.
+	NoFieldSplit bool
+
+	// Set to true to allocate new field slices for every record
+	// instead of reusing the previous record's (normally they're only
+	// allocated when a record has more fields than any before it).
+	// The field strings themselves are substrings of the record, so
+	// they're never copied either way. This is for debugging and
+	// comparing memory use.
+	NoFieldReuse bool
+
+	// Garbage collector settings to use while the program runs; the
+	// previous settings are restored when it finishes. The defaults
+	// favour low memory use, and programs that build large arrays
+	// often run much faster with the collector running less often.
+	//
+	// GCPercent is as for debug.SetGCPercent (setting it to 400, for
+	// example, lets the heap grow to five times the live data before
+	// a collection), with 0 meaning leave it as is. MemoryLimit is a
+	// soft limit in bytes on the total memory the Go runtime uses, as
+	// for debug.SetMemoryLimit, with 0 meaning leave it as is; it's
+	// ignored if GoAWK was built with a Go version before 1.19.
+	// Combining a high GCPercent (or -1 for off) with a MemoryLimit
+	// makes collections rare until memory gets tight.
+	//
+	// GCBallast is the size in bytes of an allocation held (but never
+	// touched, so it doesn't use physical memory) while the program
+	// runs. This is the older way of making collections less frequent
+	// for programs with little live data.
+	//
+	// These settings apply to the whole process, so they're meant for
+	// command-line use rather than running several programs at once.
+	GCPercent   int
+	MemoryLimit int64
+	GCBallast   int
+
+	// Set to true to read the next input file named in ARGV in the
+	// background while the current one is processed, overlapping I/O
+	// with executing the program (up to 1MB is read ahead). Input files
+	// named in ARGV that start with the gzip magic bytes are
+	// decompressed, in the background if they're prefetched (though
+	// not if they're mapped with MmapFiles). Only regular files are
+	// prefetched or decompressed, and a prefetch is discarded if
+	// ARGV changes, and not started or discarded when files are
+	// opened for writing or commands are run, in case they change the
+	// file. Files changed by other processes while GoAWK is running
+	// may be read as they were when the prefetch started.
+	PrefetchFiles bool
+
+	// Set to true to map regular input files named in ARGV into memory
+	// and scan records directly from the mapping, avoiding read system
+	// calls and copying for very large files. Standard input, pipes,
+	// and other files that aren't regular files are read the usual way
+	// (as are all files on platforms without mmap). When set, files
+	// aren't prefetched. A mapped file that's truncated by another
+	// process while it's being read may crash GoAWK on some platforms.
+	MmapFiles bool
+
+	// Set to true to read and split records of input files named in
+	// ARGV in a separate goroutine, a batch at a time, so that I/O and
+	// executing the program overlap. Records are still processed one
+	// at a time in order, and reading ahead is paused before files are
+	// opened for writing or reading with getline and before commands
+	// are run. Standard input is read the usual way, so that records
+	// are processed as soon as they're typed or piped in.
+	PipelineInput bool
+
+	// Function to convert numeric strings from input (fields, getline
+	// variables, split() elements, ARGV, ENVIRON, and -v assignments)
+	// to numbers, for data in formats AWK doesn't read, like Fortran D
+	// exponents ("1.5D+03") or comma decimals ("3,14"). If it returns
+	// false, the string is converted with the usual rules. A string it
+	// converts is a numeric string that compares and does arithmetic
+	// as the number returned, but prints as the original string.
+	//
+	// Records from a FilteringSource aren't filtered by the source when
+	// this is set, as it can't know which fields are numbers.
+	NumberParser func(s string) (float64, bool)
+
+	// Set to true to highlight, with ANSI terminal colors, the parts
+	// of each record matched by a /regex/ test (such as a /regex/
+	// pattern) when print writes the record, or values like fields of
+	// it, to the normal output. This is for interactive use, like
+	// grep --color.
+	Color bool
+
+	// Set to true to use Locale.DecimalPoint for all numbers, like
+	// gawk's --use-lc-numeric, not just in printf's floating point
+	// conversions: numbers converted to strings with CONVFMT and OFMT
+	// (as by print or concatenation) use it, and numeric strings from
+	// input (see NumberParser) may use it, so "3,14" from a field is
+	// the number 3.14 with a "," decimal point. Input numbers with a
+	// "." decimal point are still numeric too.
+	UseLocaleNumeric bool
+
+	// Set to true to make all arrays ordered: for (k in a) loops
+	// visit the elements in the order they were added (a deleted
+	// element that's added again goes at the end), rather than in an
+	// unspecified order. This includes printing the elements with
+	// for (k in a) print k, a[k], which is otherwise in sorted order.
+	OrderedArrays bool
+
+	// Global arrays whose elements persist between runs, each with
+	// the store it's kept in, for example to keep counts across runs:
+	// each array is loaded from its store before BEGIN, and saved back
+	// to it after END (or exit) if the program finishes without an
+	// error. Loaded values are numeric strings, like input. The
+	// elements are kept in memory while the program runs, except with
+	// a NewDiskArrayStore, whose array is kept in its file instead
+	// (so it can be larger than memory). Names the program doesn't use
+	// as arrays are ignored. See NewFileArrayStore for a store that
+	// uses a text file.
+	PersistentArrays map[string]ArrayStore
 }
 
 // ExecProgram executes the parsed program using the given interpreter
@@ -216,13 +564,105 @@ type Config struct {
 // on successful execution of the program, even if the program returns
 // a non-zero status code.
 func ExecProgram(program *parser.Program, config *Config) (int, error) {
-	if len(config.Vars)%2 != 0 {
-		return 0, newError("length of config.Vars must be a multiple of 2, not %d", len(config.Vars))
+	p := newInterp(program)
+	return p.executeAll(config)
+}
+
+// ExecProgramCapture is like ExecProgram, but also returns the final
+// values of the variables named in config.CaptureVars, after the END
+// actions have run (or the program has exited). The returned map is
+// keyed by variable name, and its values are:
+//
+// * float64 for numbers
+// * string for strings, including numeric strings from input
+// * map[string]interface{} for arrays, with the above as element values
+// * nil for variables that have never been set or aren't in the program
+func ExecProgramCapture(program *parser.Program, config *Config) (int, map[string]interface{}, error) {
+	p := newInterp(program)
+	status, err := p.executeAll(config)
+	if err != nil {
+		return 0, nil, err
 	}
-	if len(config.Environ)%2 != 0 {
-		return 0, newError("length of config.Environ must be a multiple of 2, not %d", len(config.Environ))
+	captured := make(map[string]interface{}, len(config.CaptureVars))
+	for _, name := range config.CaptureVars {
+		captured[name] = p.captureVar(name)
 	}
+	return status, captured, nil
+}
 
+// Return the Go value of the named global variable or array (see
+// ExecProgramCapture).
+func (p *interp) captureVar(name string) interface{} {
+	if index := ast.SpecialVarIndex(name); index > 0 {
+		return captureValue(p.getSpecial(index))
+	}
+	if index, ok := p.program.Scalars[name]; ok {
+		return captureValue(p.globals[index])
+	}
+	if index, ok := p.program.Arrays[name]; ok {
+		array := p.arrays[index]
+		m := make(map[string]interface{}, array.len())
+		_ = array.each(func(k string, v value) error {
+			m[k] = captureValue(v)
+			return nil
+		})
+		return m
+	}
+	return nil
+}
+
+func captureValue(v value) interface{} {
+	switch v.typ {
+	case typeNum:
+		return v.n
+	case typeStr, typeNumStr, typeParsedNumStr:
+		return v.s
+	default:
+		return nil
+	}
+}
+
+// Interpreter is an interpreter for a specific program, allowing you to
+// efficiently execute the same program over and over with different
+// inputs. Use New to create an Interpreter.
+//
+// Each Execute starts afresh, with all variables and arrays reset, but
+// reuses memory allocations and regex caches from previous executions.
+// An Interpreter isn't safe for concurrent use: use a separate one per
+// goroutine, for example by keeping them in a sync.Pool.
+//
+// Most programs won't need reusable execution, and should use the
+// simpler ExecProgram instead.
+type Interpreter struct {
+	interp *interp
+}
+
+// New creates a reusable interpreter for the given program.
+func New(program *parser.Program) *Interpreter {
+	return &Interpreter{interp: newInterp(program)}
+}
+
+// Execute runs this program with the given execution configuration
+// (input, output, and variables), returning the exit status code of
+// the program. Like ExecProgram, error is nil on successful execution
+// even if the program returns a non-zero status code.
+func (p *Interpreter) Execute(config *Config) (int, error) {
+	return p.ExecuteContext(context.Background(), config)
+}
+
+// ExecuteContext is like Execute, but stops execution with ctx.Err()
+// if ctx is cancelled or its deadline passes while the program is
+// running. The shell processes started by system() and pipes are killed
+// too (though not commands they've started themselves).
+func (p *Interpreter) ExecuteContext(ctx context.Context, config *Config) (int, error) {
+	p.interp.reset()
+	p.interp.ctx = ctx
+	p.interp.ctxDone = ctx.Done()
+	return p.interp.executeAll(config)
+}
+
+// Allocate a new interpreter for program.
+func newInterp(program *parser.Program) *interp {
 	p := &interp{
 		program:   program,
 		functions: program.Compiled.Functions,
@@ -234,14 +674,113 @@ func ExecProgram(program *parser.Program, config *Config) (int, error) {
 	// Allocate memory for variables and virtual machine stack
 	p.globals = make([]value, len(program.Scalars))
 	p.stack = make([]value, initialStackSize)
-	p.arrays = make([]map[string]value, len(program.Arrays), len(program.Arrays)+initialStackSize)
+	p.arrays = make([]*array, len(program.Arrays), len(program.Arrays)+initialStackSize)
 	for i := 0; i < len(program.Arrays); i++ {
-		p.arrays[i] = make(map[string]value)
+		p.arrays[i] = newArray(false) // see Config.OrderedArrays
+	}
+	p.regexCache = newLRUCache(maxCachedRegexes)
+	p.formatCache = newLRUCache(maxCachedFormats)
+
+	// A dynamic regex (or FS or RS) that's the same as a regex constant
+	// can use the constant's compiled regex
+	p.matcherCache = newLRUCache(maxCachedRegexes)
+	p.matchers = make([]matcher, len(p.regexes))
+	for i, re := range p.regexes {
+		p.regexCache.add(re.String(), re)
+		p.matchers[i] = regexMatcher(re)
+		p.matcherCache.add(re.String(), p.matchers[i])
+	}
+	return p
+}
+
+// Reset interpreter state after a previous execution, keeping the
+// allocated variables, stack, and caches.
+func (p *interp) reset() {
+	for i := range p.globals {
+		p.globals[i] = value{}
+	}
+	arrays := p.arrays[:len(p.program.Arrays)]
+	for _, array := range arrays {
+		array.clear()
+	}
+	*p = interp{
+		program:      p.program,
+		functions:    p.functions,
+		nums:         p.nums,
+		strs:         p.strs,
+		regexes:      p.regexes,
+		matchers:     p.matchers,
+		globals:      p.globals,
+		stack:        p.stack,
+		arrays:       arrays,
+		localArrays:  p.localArrays[:0],
+		regexCache:   p.regexCache,
+		matcherCache: p.matcherCache,
+		formatCache:  p.formatCache,
+		zones:        p.zones,
+	}
+}
+
+// Execute the program using the given config.
+func (p *interp) executeAll(config *Config) (status int, err error) {
+	defer catchDiskArrayError(&err)
+	program := p.program
+	err = p.setup(config)
+	if err != nil {
+		return 0, err
+	}
+	defer p.closeAll()
+	defer applyGCSettings(config)()
+
+	// Execute the program: BEGIN, then pattern/actions, then END
+	err = p.executeBeginEnd(program.Compiled.Begin, false)
+	if err != nil && err != errExit {
+		return 0, err
+	}
+	if program.Actions == nil && program.End == nil &&
+		program.Compiled.Actions == nil && program.Compiled.End == nil {
+		return p.exitStatus, p.savePersistentArrays()
+	}
+	if err != errExit {
+		if filter, ok := p.findFastFilter(); ok && p.profile == nil && !p.color {
+			err = p.execFastFilter(filter)
+		} else {
+			err = p.execActions(program.Compiled.Actions)
+		}
+		if err != nil && err != errExit {
+			return 0, err
+		}
+	}
+	err = p.executeBeginEnd(program.Compiled.End, true)
+	if err != nil && err != errExit {
+		return 0, err
+	}
+	return p.exitStatus, p.savePersistentArrays()
+}
+
+// Set up the interpreter to execute the program using the given config.
+// If this succeeds, the caller must call p.closeAll when done.
+func (p *interp) setup(config *Config) error {
+	program := p.program
+	if len(config.Vars)%2 != 0 {
+		return newError("length of config.Vars must be a multiple of 2, not %d", len(config.Vars))
+	}
+	if len(config.Environ)%2 != 0 {
+		return newError("length of config.Environ must be a multiple of 2, not %d", len(config.Environ))
+	}
+	if config.MemoryLimit < 0 || config.GCBallast < 0 {
+		return newError("config.MemoryLimit and config.GCBallast must not be negative")
+	}
+	if config.OutputBufferSize < 0 || config.InputBufferSize < 0 ||
+		config.MaxFieldIndex < 0 || config.MaxCallDepth < 0 ||
+		config.RegexCacheSize < 0 || config.FormatCacheSize < 0 {
+		return newError("config buffer sizes and limits must not be negative")
 	}
 
 	// Initialize defaults
-	p.regexCache = make(map[string]*regexp.Regexp, 10)
-	p.formatCache = make(map[string]cachedFormat, 10)
+	if p.ctx == nil {
+		p.ctx = context.Background()
+	}
 	p.randSeed = 1.0
 	seed := math.Float64bits(p.randSeed)
 	p.random = rand.New(rand.NewSource(int64(seed)))
@@ -252,12 +791,97 @@ func ExecProgram(program *parser.Program, config *Config) (int, error) {
 	p.outputFieldSep = " "
 	p.outputRecordSep = "\n"
 	p.subscriptSep = "\x1c"
-	p.noExec = config.NoExec
+	p.errno = ""
+	p.startTime = time.Now()
+	p.noExec = config.NoExec || !execSupported
 	p.noFileWrites = config.NoFileWrites
 	p.noFileReads = config.NoFileReads
-	err := p.initNativeFuncs(config.Funcs)
+	p.sqlDriver = config.SQLDriver
+	p.redisConfig = nil
+	if config.RedisURL != "" {
+		redisConfig, err := parseRedisURL(config.RedisURL)
+		if err != nil {
+			return newError("invalid config.RedisURL: %v", err)
+		}
+		p.redisConfig = redisConfig
+	}
+	p.argFiles = nil
+	if config.NoFileReads && config.AllowArgFiles {
+		p.argFiles = make(map[string]bool, len(config.Args))
+		for _, arg := range config.Args {
+			p.argFiles[arg] = true
+		}
+	}
+	p.noFieldSplit = config.NoFieldSplit
+	p.noFieldReuse = config.NoFieldReuse
+	p.prefetchFiles = config.PrefetchFiles
+	p.mmapFiles = config.MmapFiles && mmapSupported
+	p.pipelineInput = config.PipelineInput
+	p.outputBufSize = intOrDefault(config.OutputBufferSize, outputBufSize)
+	p.outputLineBuffered = config.OutputLineBuffered
+	p.outputFlushInterval = config.OutputFlushInterval
+	p.inputBufSize = intOrDefault(config.InputBufferSize, inputBufSize)
+	p.maxFieldIndex = intOrDefault(config.MaxFieldIndex, maxFieldIndex)
+	p.maxCallDepth = intOrDefault(config.MaxCallDepth, maxCallDepth)
+	p.regexCache.resize(intOrDefault(config.RegexCacheSize, maxCachedRegexes))
+	p.matcherCache.resize(intOrDefault(config.RegexCacheSize, maxCachedRegexes))
+	p.formatCache.resize(intOrDefault(config.FormatCacheSize, maxCachedFormats))
+	p.numberParser = config.NumberParser
+	p.color = config.Color
+	p.orderedArrays = config.OrderedArrays
+	for _, array := range p.arrays[:len(program.Arrays)] {
+		array.ordered = config.OrderedArrays // they're all empty here
+	}
+	p.coverCounts = nil
+	if config.Coverage != nil {
+		if config.Coverage.program != program {
+			return newError("config.Coverage was created for a different program")
+		}
+		p.coverCounts = config.Coverage.counts
+	}
+	p.profile = nil
+	if config.Profile != nil {
+		if config.Profile.program != program {
+			return newError("config.Profile was created for a different program")
+		}
+		if program.Compiled.HasInlinedCalls() {
+			return newError("config.Profile needs a program parsed with ParserConfig.NoInline")
+		}
+		p.profile = config.Profile
+	}
+	p.trace = nil
+	if config.Trace != nil {
+		trace, err := newTracer(program, config)
+		if err != nil {
+			return err
+		}
+		p.trace = trace
+	}
+	locale, err := resolveLocale(config.Locale)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	p.locale = locale
+	p.numericPoint = ""
+	if config.UseLocaleNumeric && locale.DecimalPoint != "." {
+		p.numericPoint = locale.DecimalPoint
+		p.numberParser = localeNumberParser(locale.DecimalPoint, config.NumberParser)
+	}
+	p.location = resolveLocation(config)
+	funcs := config.Funcs
+	if len(program.LoadedFuncs) > 0 {
+		// Add the native functions from the program's @load directives
+		funcs = make(map[string]interface{}, len(config.Funcs)+len(program.LoadedFuncs))
+		for name, f := range config.Funcs {
+			funcs[name] = f
+		}
+		for name, f := range program.LoadedFuncs {
+			funcs[name] = f
+		}
+	}
+	err = p.initNativeFuncs(funcs)
+	if err != nil {
+		return err
 	}
 
 	// Setup ARGV and other variables from config
@@ -265,28 +889,30 @@ func ExecProgram(program *parser.Program, config *Config) (int, error) {
 	p.setArrayValue(ast.ScopeGlobal, argvIndex, "0", str(config.Argv0))
 	p.argc = len(config.Args) + 1
 	for i, arg := range config.Args {
-		p.setArrayValue(ast.ScopeGlobal, argvIndex, strconv.Itoa(i+1), numStr(arg))
+		p.setArrayValue(ast.ScopeGlobal, argvIndex, strconv.Itoa(i+1), p.inputStr(arg))
 	}
 	p.filenameIndex = 1
 	p.hadFiles = false
 	for i := 0; i < len(config.Vars); i += 2 {
 		err := p.setVarByName(config.Vars[i], config.Vars[i+1])
 		if err != nil {
-			return 0, err
+			return err
 		}
 	}
 
 	// Setup ENVIRON from config or environment variables
+	p.environ = nil
+	p.configEnviron = config.Environ
 	environIndex := program.Arrays["ENVIRON"]
 	if config.Environ != nil {
 		for i := 0; i < len(config.Environ); i += 2 {
-			p.setArrayValue(ast.ScopeGlobal, environIndex, config.Environ[i], numStr(config.Environ[i+1]))
+			p.setArrayValue(ast.ScopeGlobal, environIndex, config.Environ[i], p.inputStr(config.Environ[i+1]))
 		}
 	} else {
 		for _, kv := range os.Environ() {
 			eq := strings.IndexByte(kv, '=')
 			if eq >= 0 {
-				p.setArrayValue(ast.ScopeGlobal, environIndex, kv[:eq], numStr(kv[eq+1:]))
+				p.setArrayValue(ast.ScopeGlobal, environIndex, kv[:eq], p.inputStr(kv[eq+1:]))
 			}
 		}
 	}
@@ -303,13 +929,21 @@ func ExecProgram(program *parser.Program, config *Config) (int, error) {
 	}
 
 	// Setup I/O structures
+	p.source = config.Source
+	p.sources = config.Sources
+	p.openURL = config.OpenURL
+	p.argSource = nil
+	p.recordInfoIndex = -1
+	if index, ok := program.Arrays["RECORDINFO"]; ok {
+		p.recordInfoIndex = index
+	}
 	p.stdin = config.Stdin
 	if p.stdin == nil {
 		p.stdin = os.Stdin
 	}
 	p.output = config.Output
 	if p.output == nil {
-		p.output = bufio.NewWriterSize(os.Stdout, outputBufSize)
+		p.output = p.newBufferedWriteCloser(os.Stdout, nil)
 	}
 	p.errorOutput = config.Error
 	if p.errorOutput == nil {
@@ -317,29 +951,20 @@ func ExecProgram(program *parser.Program, config *Config) (int, error) {
 	}
 	p.inputStreams = make(map[string]io.ReadCloser)
 	p.outputStreams = make(map[string]io.WriteCloser)
-	p.commands = make(map[string]*exec.Cmd)
-	p.scanners = make(map[string]*bufio.Scanner)
-	defer p.closeAll()
+	p.commands = make(map[string]*command)
+	p.scanners = make(map[string]*recordReader)
 
-	// Execute the program: BEGIN, then pattern/actions, then END
-	err = p.execute(program.Compiled.Begin)
-	if err != nil && err != errExit {
-		return 0, err
-	}
-	if program.Actions == nil && program.End == nil {
-		return p.exitStatus, nil
-	}
-	if err != errExit {
-		err = p.execActions(program.Compiled.Actions)
-		if err != nil && err != errExit {
-			return 0, err
-		}
-	}
-	err = p.execute(program.Compiled.End)
-	if err != nil && err != errExit {
-		return 0, err
+	// Load persistent arrays last, so that nothing else can fail after
+	// their files are opened
+	return p.loadPersistentArrays(config.PersistentArrays)
+}
+
+// Return n, or def if n is zero (the Config default).
+func intOrDefault(n, def int) int {
+	if n == 0 {
+		return def
 	}
-	return p.exitStatus, nil
+	return n
 }
 
 // Exec provides a simple way to parse and execute an AWK program
@@ -364,7 +989,6 @@ func Exec(source, fieldSep string, input io.Reader, output io.Writer) error {
 // Execute pattern-action blocks (may be multiple)
 func (p *interp) execActions(actions []compiler.Action) error {
 	inRange := make([]bool, len(actions))
-lineLoop:
 	for {
 		// Read and setup next line of input
 		line, err := p.nextLine()
@@ -375,65 +999,96 @@ lineLoop:
 			return err
 		}
 		p.setLine(line, false)
+		err = p.checkContext()
+		if err != nil {
+			return err
+		}
+		err = p.execRecord(actions, inRange)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		// Execute all the pattern-action blocks for each line
-		for i, action := range actions {
-			// First determine whether the pattern matches
-			matched := false
-			switch len(action.Pattern) {
-			case 0:
-				// No pattern is equivalent to pattern evaluating to true
-				matched = true
-			case 1:
-				// Single boolean pattern
-				err := p.execute(action.Pattern[0])
-				if err != nil {
-					return err
-				}
-				matched = p.pop().boolean()
-			case 2:
-				// Range pattern (matches between start and stop lines)
-				if !inRange[i] {
-					err := p.execute(action.Pattern[0])
-					if err != nil {
-						return err
-					}
-					inRange[i] = p.pop().boolean()
-				}
-				matched = inRange[i]
-				if inRange[i] {
-					err := p.execute(action.Pattern[1])
-					if err != nil {
-						return err
-					}
-					inRange[i] = !p.pop().boolean()
-				}
-			}
-			if !matched {
-				continue
-			}
-
-			// No action is equivalent to { print $0 }
-			if len(action.Body) == 0 {
-				err := p.printLine(p.output, p.line)
-				if err != nil {
-					return err
-				}
-				continue
+// Execute the pattern-action blocks for the current record. inRange
+// holds the state of range patterns between records.
+func (p *interp) execRecord(actions []compiler.Action, inRange []bool) error {
+	for i, action := range actions {
+		var err error
+		if p.profile != nil {
+			start := time.Now()
+			var matched bool
+			matched, err = p.execAction(i, action, inRange)
+			entry := &p.profile.actions[i]
+			entry.Count++
+			if matched {
+				entry.Matched++
 			}
+			entry.Time += time.Since(start)
+		} else {
+			_, err = p.execAction(i, action, inRange)
+		}
+		if err == errNext {
+			// "next" statement skips straight to next line
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			// Execute the body statements
-			err := p.execute(action.Body)
-			if err == errNext {
-				// "next" statement skips straight to next line
-				continue lineLoop
+// Execute the i'th pattern-action block for the current record,
+// returning whether its pattern matched.
+func (p *interp) execAction(i int, action compiler.Action, inRange []bool) (bool, error) {
+	// First determine whether the pattern matches
+	matched := false
+	switch len(action.Pattern) {
+	case 0:
+		// No pattern is equivalent to pattern evaluating to true
+		matched = true
+	case 1:
+		// Single boolean pattern
+		err := p.execute(action.Pattern[0])
+		if err != nil {
+			return false, err
+		}
+		matched = p.pop().boolean()
+	case 2:
+		// Range pattern (matches between start and stop lines)
+		if !inRange[i] {
+			err := p.execute(action.Pattern[0])
+			if err != nil {
+				return false, err
 			}
+			inRange[i] = p.pop().boolean()
+		}
+		matched = inRange[i]
+		if inRange[i] {
+			err := p.execute(action.Pattern[1])
 			if err != nil {
-				return err
+				return true, err
 			}
+			inRange[i] = !p.pop().boolean()
 		}
 	}
-	return nil
+	if !matched {
+		return false, nil
+	}
+
+	// No action is equivalent to { print $0 }
+	if len(action.Body) == 0 {
+		p.ensureLine()
+		if len(p.colorRegexes) > 0 {
+			return true, p.printLine(p.output, p.highlight(p.line))
+		}
+		return true, p.printLine(p.output, p.line)
+	}
+
+	// Execute the body statements
+	return true, p.execute(action.Body)
 }
 
 // Get a special variable by index
@@ -454,6 +1109,8 @@ func (p *interp) getSpecial(index int) value {
 		return num(float64(p.argc))
 	case ast.V_CONVFMT:
 		return str(p.convertFormat)
+	case ast.V_ERRNO:
+		return str(p.errno)
 	case ast.V_FILENAME:
 		return p.filename
 	case ast.V_FS:
@@ -479,11 +1136,11 @@ func (p *interp) getSpecial(index int) value {
 func (p *interp) setVarByName(name, value string) error {
 	index := ast.SpecialVarIndex(name)
 	if index > 0 {
-		return p.setSpecial(index, numStr(value))
+		return p.setSpecial(index, p.inputStr(value))
 	}
 	index, ok := p.program.Scalars[name]
 	if ok {
-		p.globals[index] = numStr(value)
+		p.globals[index] = p.inputStr(value)
 		return nil
 	}
 	// Ignore variables that aren't defined in program
@@ -498,7 +1155,7 @@ func (p *interp) setSpecial(index int, v value) error {
 		if numFields < 0 {
 			return newError("NF set to negative value: %d", numFields)
 		}
-		if numFields > maxFieldIndex {
+		if numFields > p.maxFieldIndex {
 			return newError("NF set too large: %d", numFields)
 		}
 		p.ensureFields()
@@ -511,7 +1168,7 @@ func (p *interp) setSpecial(index int, v value) error {
 			p.fields = append(p.fields, "")
 			p.fieldsIsTrueStr = append(p.fieldsIsTrueStr, false)
 		}
-		p.line = strings.Join(p.fields, p.outputFieldSep)
+		p.lineDirty = true
 		p.lineIsTrueStr = true
 	case ast.V_NR:
 		p.lineNum = int(v.num())
@@ -525,24 +1182,35 @@ func (p *interp) setSpecial(index int, v value) error {
 		p.argc = int(v.num())
 	case ast.V_CONVFMT:
 		p.convertFormat = p.toString(v)
+	case ast.V_ERRNO:
+		p.errno = p.toString(v)
 	case ast.V_FILENAME:
 		p.filename = v
 	case ast.V_FS:
+		if p.partialFields {
+			// Finish splitting the record with the FS it was started with
+			p.ensureFields()
+		}
 		p.fieldSep = p.toString(v)
 		if utf8.RuneCountInString(p.fieldSep) > 1 { // compare to interp.ensureFields
-			re, err := regexp.Compile(p.fieldSep)
+			re, err := p.compileRegex(p.fieldSep)
 			if err != nil {
-				return newError("invalid regex %q: %s", p.fieldSep, err)
+				return err
 			}
 			p.fieldSepRegex = re
 		}
 	case ast.V_OFMT:
 		p.outputFormat = p.toString(v)
 	case ast.V_OFS:
+		// Fields assigned before this are joined with the old OFS
+		p.ensureLine()
 		p.outputFieldSep = p.toString(v)
 	case ast.V_ORS:
 		p.outputRecordSep = p.toString(v)
 	case ast.V_RS:
+		if p.partialFields {
+			p.ensureFields()
+		}
 		p.recordSep = p.toString(v)
 		switch { // compare to interp.newScanner
 		case len(p.recordSep) <= 1:
@@ -552,9 +1220,9 @@ func (p *interp) setSpecial(index int, v value) error {
 			sep := regexp.QuoteMeta(p.recordSep) // not strictly necessary as no multi-byte chars are regex meta chars
 			p.recordSepRegex = regexp.MustCompile(sep)
 		default:
-			re, err := regexp.Compile(p.recordSep)
+			re, err := p.compileRegex(p.recordSep)
 			if err != nil {
-				return newError("invalid regex %q: %s", p.recordSep, err)
+				return err
 			}
 			p.recordSepRegex = re
 		}
@@ -580,32 +1248,79 @@ func (p *interp) arrayIndex(scope ast.VarScope, index int) int {
 }
 
 // Return array with given scope and index.
-func (p *interp) array(scope ast.VarScope, index int) map[string]value {
+func (p *interp) array(scope ast.VarScope, index int) *array {
 	return p.arrays[p.arrayIndex(scope, index)]
 }
 
+// Replace the array at index (in p.arrays, as from arrayIndex) with a,
+// for functions like split(). A disk-backed array keeps its file, so
+// a's elements are copied into it instead.
+func (p *interp) replaceArray(index int, a *array) {
+	if old := p.arrays[index]; old.disk != nil {
+		old.copy(a)
+		return
+	}
+	p.arrays[index] = a
+}
+
+// Store a new empty array at index (in p.arrays) and return it, for
+// functions that then fill it in, like match(s, re, a). A disk-backed
+// array is cleared and returned instead.
+func (p *interp) newArrayAt(index int) *array {
+	if old := p.arrays[index]; old.disk != nil {
+		old.clear()
+		return old
+	}
+	a := newArray(p.orderedArrays)
+	p.arrays[index] = a
+	return a
+}
+
 // Return local array with given index.
-func (p *interp) localArray(index int) map[string]value {
+func (p *interp) localArray(index int) *array {
 	return p.arrays[p.localArrays[len(p.localArrays)-1][index]]
 }
 
 // Set a value in given array by key (index)
 func (p *interp) setArrayValue(scope ast.VarScope, arrayIndex int, index string, v value) {
-	array := p.array(scope, arrayIndex)
-	array[index] = v
+	p.array(scope, arrayIndex).set(strKey(index), v)
 }
 
 // Get the value of given numbered field, equivalent to "$index"
+// Return the string of field index (which must not be negative), the
+// same string getField's value has, but without creating the value.
+func (p *interp) fieldString(index int) string {
+	if index == 0 {
+		p.ensureLine()
+		return p.line
+	}
+	if p.haveFields || !p.splitFieldsTo(index) {
+		p.ensureFields()
+	}
+	if index > len(p.fields) {
+		return ""
+	}
+	return p.fields[index-1]
+}
+
 func (p *interp) getField(index int) (value, error) {
 	if index < 0 {
 		return null(), newError("field index negative: %d", index)
 	}
 	if index == 0 {
+		p.ensureLine()
 		if p.lineIsTrueStr {
 			return str(p.line), nil
 		} else {
-			return numStr(p.line), nil
+			return p.inputStr(p.line), nil
+		}
+	}
+	if !p.haveFields && p.splitFieldsTo(index) {
+		// Fields from input are never true strings until assigned
+		if index > len(p.fields) {
+			return str(""), nil
 		}
+		return p.inputStr(p.fields[index-1]), nil
 	}
 	p.ensureFields()
 	if index > len(p.fields) {
@@ -614,7 +1329,7 @@ func (p *interp) getField(index int) (value, error) {
 	if p.fieldsIsTrueStr[index-1] {
 		return str(p.fields[index-1]), nil
 	} else {
-		return numStr(p.fields[index-1]), nil
+		return p.inputStr(p.fields[index-1]), nil
 	}
 }
 
@@ -627,7 +1342,7 @@ func (p *interp) setField(index int, value string) error {
 	if index < 0 {
 		return newError("field index negative: %d", index)
 	}
-	if index > maxFieldIndex {
+	if index > p.maxFieldIndex {
 		return newError("field index too large: %d", index)
 	}
 	// If there aren't enough fields, add empty string fields in between
@@ -639,28 +1354,57 @@ func (p *interp) setField(index int, value string) error {
 	p.fields[index-1] = value
 	p.fieldsIsTrueStr[index-1] = true
 	p.numFields = len(p.fields)
-	p.line = strings.Join(p.fields, p.outputFieldSep)
+	p.lineDirty = true
 	p.lineIsTrueStr = true
 	return nil
 }
 
+// Rebuild $0 by joining the fields with OFS, if they've been assigned
+// (or NF has) since it was last built. This is deferred until $0 is
+// used, so that assigning several fields only joins them once.
+func (p *interp) ensureLine() {
+	if p.lineDirty {
+		p.line = strings.Join(p.fields, p.outputFieldSep)
+		p.lineDirty = false
+	}
+}
+
+// Create a numeric string value for a string from input, converting
+// it with Config.NumberParser if that's set and accepts it.
+func (p *interp) inputStr(s string) value {
+	if p.numberParser != nil {
+		if n, ok := p.numberParser(s); ok {
+			return parsedNumStr(s, n)
+		}
+	}
+	return numStr(s)
+}
+
 // Convert value to string using current CONVFMT
 func (p *interp) toString(v value) string {
+	if p.numericPoint != "" && v.typ == typeNum {
+		return strings.Replace(v.str(p.convertFormat), ".", p.numericPoint, 1)
+	}
 	return v.str(p.convertFormat)
 }
 
+// Convert value to string for output using current OFMT
+func (p *interp) toOutputString(v value) string {
+	if p.numericPoint != "" && v.typ == typeNum {
+		return strings.Replace(v.str(p.outputFormat), ".", p.numericPoint, 1)
+	}
+	return v.str(p.outputFormat)
+}
+
 // Compile regex string (or fetch from regex cache)
 func (p *interp) compileRegex(regex string) (*regexp.Regexp, error) {
-	if re, ok := p.regexCache[regex]; ok {
-		return re, nil
+	if re, ok := p.regexCache.get(regex); ok {
+		return re.(*regexp.Regexp), nil
 	}
 	re, err := regexp.Compile(regex)
 	if err != nil {
 		return nil, newError("invalid regex %q: %s", regex, err)
 	}
-	// Dumb, non-LRU cache: just cache the first N regexes
-	if len(p.regexCache) < maxCachedRegexes {
-		p.regexCache[regex] = re
-	}
+	p.regexCache.add(regex, re)
 	return re, nil
 }
@@ -2,18 +2,31 @@
 package interp_test
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
+	"unicode"
 
 	"github.com/benhoyt/goawk/interp"
 	"github.com/benhoyt/goawk/parser"
@@ -62,6 +75,31 @@ var interpTests = []interpTest{
 NR==2, NR==4 { print $0 }
 NR==3, NR==5 { print NR }
 `, "a\nb\nc\nd\ne\nf\ng", "b\nc\n3\nd\n4\n5\n", "", ""},
+	{`NR > 1 && NR <= 3 || NR == 5`, "a\nb\nc\nd\ne\nf", "b\nc\ne\n", "", ""},
+	{`NR < 2 || NR >= 6 || NR != NR`, "a\nb\nc\nd\ne\nf", "a\nf\n", "", ""},
+	{`NF == 2 { n++ } NF > 2.5 { m++ } END { print n, m }`, "a b\nc\nd e f\ng h", "2 1\n", "", ""},
+	{`FNR == 2 { print (NF != 1), (NR < 1) }`, "a\nb\n", "0 0\n", "", ""},
+	{`{ NF = 1 } NF == 1 { print }`, "a b\nc", "a\nc\n", "", ""},
+	{`BEGIN { NR = 10 } NR == 11`, "a\nb", "a\n", "", ""},
+	{`{ print $2 }`, "a b c\n  d\te  \n\nf", "b\ne\n\n\n", "", ""},
+	{`{ print $3 }  # !awk !gawk !mawk - GoAWK splits on Unicode spaces`, "a\u00a0b c d\nx y", "c\n\n", "", ""},
+	{`{ print $2 }  # !awk !gawk !mawk - GoAWK splits on Unicode spaces`, "é\u00a0x y\nab ñ c", "x\nñ\n", "", ""},
+	{`{ print $2 } { print $1, $3 }  # !awk !gawk !mawk - GoAWK splits on Unicode spaces`, "é\u00a0x y\nab ñ c", "x\né y\nñ\nab c\n", "", ""},
+	{`BEGIN { FS = "," } { print $2 }`, "a,b,c\nd\n,e", "b\n\ne\n", "", ""},
+	{`BEGIN { FS = "," } { print $3 "|" }`, "a,b,c,d\na,b,\n,,\na,b\n\nc", "c|\n|\n|\n|\n|\n|\n", "", ""},
+	{`BEGIN { FS = "\t" } /b/ { print $1 }`, "a\tb\nc\td\n\tb", "a\n\n", "", ""},
+	{`BEGIN { FS = ":" } $2 == "b" { n++ } $2 < "c" { m++ } END { print n, m }`, "1:b\n2: b\n3:a\n4:c\n5:", "1 4\n", "", ""},
+	{`$1 == 10 { print "num", $1 } $1 == "10" { print "str", $1 }`, "10\n+10\n 1e1\n.10e2\n10x\nx10", "num 10\nstr 10\nnum +10\nnum 1e1\nnum .10e2\n", "", ""},
+	{`$1 { print "true", $1 } !$1 { print "false", $1 }`, "0\n-0\n.0\nx\n0.0x\n-", "false 0\nfalse -0\nfalse .0\ntrue x\ntrue 0.0x\ntrue -\n", "", ""},
+	{`BEGIN { FS = "[0-9]" } /x/ { print $2 }`, "ax1bx\nc2d\nx3", "bx\n\n", "", ""},
+	{`BEGIN { FS = "x+" } /x+/ { print $2 }`, "axxb\nc\n", "b\n", "", ""},
+	{`BEGIN { RS = "x+" } $0 !~ /x+/ { print }`, "axxbxc", "a\nb\nc\n", "", ""},
+	{`BEGIN { printf "%.1f %.1f %.1f\n", -0, 0, -(1-1) }`, "", "-0.0 0.0 -0.0\n", "", ""},
+	{`BEGIN { RS = "" } { print $2 }`, "a\nb c\n\nd e", "b\ne\n", "", ""},
+	{`BEGIN { ORS = "." } /b/ { print }`, "a\nb\nbc", "b.bc.", "", ""},
+	{`BEGIN { print "x" } /b/ { print $0 }`, "a\nb", "x\nb\n", "", ""},
+	{`{ print $0 }`, "a\n\nb", "a\n\nb\n", "", ""},
+	{`{ while (NF > 1) NF--; print }`, "a b c\nd", "a\nd\n", "", ""},
 
 	// print and printf statements
 	{`BEGIN { print "x", "y" }`, "", "x y\n", "", ""},
@@ -121,6 +159,28 @@ NR==3, NR==5 { print NR }
 	{`BEGIN { if ("b"<"a") print "t"; else print "f" }`, "", "f\n", "", ""},
 	{`BEGIN { if ("a"<="b") print "t"; else print "f" }`, "", "t\n", "", ""},
 	{`BEGIN { if ("b"<="a") print "t"; else print "f" }`, "", "f\n", "", ""},
+	{`{ if ($1 == "a") print "A"; else if ($1 == "b" || $1 == "c") print "BC"; else if ($1 == "d") print "D"; else if ($1 == "a") print "dup"; else print "other" }`,
+		"a\nb\nc\nd\ne\n\n", "A\nBC\nBC\nD\nother\nother\n", "", ""},
+	{`{ x = $1; if (x == 1) print "one"; else if (x == 2) print "two"; else if (3 == x) print "three"; else if (x == -4) print "minus four"; else print "none" }`,
+		"1\n1.0\n 2 \n3x\n-4\nabc\n", "one\none\ntwo\nnone\nminus four\nnone\n", "", ""},
+	{`BEGIN { split("1.0 1 3", a); a[4] = 1.0; for (i = 0; i <= 4; i++) { x = i ? a[i] : "1.0"; if (x == 1) print "one"; else if (x == 2) print "two"; else if (x == 3) print "three"; else if (x == 4) print "four"; else print "none" } }`,
+		"", "none\none\none\nthree\none\n", "", ""},
+	{`BEGIN { CONVFMT = "%.2f"; x = 0.5; if (x == "0.5") print "a"; else if (x == "0.50") print "b"; else if (x == ".5") print "c"; else if (x == "1") print "d" }`, "", "b\n", "", ""},
+	{`BEGIN { if (x == 1) print "one"; else if (x == 2) print "two"; else if (x == 0) print "zero"; else if (x == 3) print "three" }`, "", "zero\n", "", ""},
+	{`BEGIN { if (x == "a") print "a"; else if (x == "b") print "b"; else if (x == "") print "empty"; else if (x == "c") print "c" }`, "", "empty\n", "", ""},
+	{`function f(n) { if (n == 1) return "one"; else if (n == 2) return "two"; else if (n == 3) return "three"; else if (n == 4) return "four"; return "many" }  BEGIN { for (i = 0; i <= 5; i++) print f(i) }`,
+		"", "many\none\ntwo\nthree\nfour\nmany\n", "", ""},
+	{`$1 == 1 { print "one" }  $1 < "b" { print "lt" }`, "1.0\n1\nab\n\n", "one\nlt\none\nlt\nlt\nlt\n", "", ""},
+	{`{ if ($3 > 10) print "big"; else print "small" }`, "1 2 30\n1 2\n5 5 5x\n1 1 1e3\n", "big\nsmall\nbig\nbig\n", "", ""},
+	{`{ n = 0; for (i = 1; i <= NF; i++) n = n + 1; print n }`, "a b c\n\nd e\n", "3\n0\n2\n", "", ""},
+	{`BEGIN { x = "3x"; y = x * 2; x = x - 1; print x, y }`, "", "2 6\n", "", ""},
+	{`BEGIN { n = 10; while (i < n) i = i + 3; print i }`, "", "12\n", "", ""},
+	{`{ s = 0; for (i=1; i<=NF; i++) s += $i; print s, i }`, "1 2 3\n\n4.5 x 1e2\n", "6 4\n0 1\n104.5 4\n", "", ""},
+	{`{ for (i=0; i<=NF; i++) t = t + $i }  END { print t, i }`, "1 2\n3\n", "10 2\n", "", ""},
+	{`BEGIN { s = "abc" }  { for (i=5; i<=NF; i++) s += $i; print s, i }`, "1 2\n1 2 3 4 5\n", "abc 5\n5 6\n", "", ""},
+	{`BEGIN { s = 2^53 }  { for (i=1; i<=NF; i++) s += $i }  END { print s - 2^53 }`, "1 1\n", "0\n", "", ""},
+	{`function f(i, t) { for (i=1; i<=NF; i++) t += $i; return t }  { print f() }`, "1 2 3\n", "6\n", "", ""},
+	{`{ NF = 5; for (i=1; i<=NF; i++) s += $i; print s, i }`, "1 2 3 4 5 6 7\n", "15 6\n", "", ""},
 	{`BEGIN { for (;;) { print "x"; break } }`, "", "x\n", "", ""},
 	{`BEGIN { for (;;) { printf "%d ", i; i++; if (i>2) break; } }`, "", "0 1 2 ", "", ""},
 	{`BEGIN { for (i=5; ; ) { printf "%d ", i; i++; if (i>8) break; } }`, "", "5 6 7 8 ", "", ""},
@@ -180,6 +240,20 @@ BEGIN {
 	{`BEGIN { a[] }`, "", "", "parse error at 1:11: expected expression instead of ]", "syntax error"},
 	{`BEGIN { delete a[] }`, "", "", "parse error at 1:18: expected expression instead of ]", "syntax error"},
 	{`BEGIN { a["x"] = 3; a["y"] = 4; delete a; for (k in a) print k, a[k] }`, "", "", "", ""},
+	{`BEGIN { a[1]="n"; print a["1"], ("1" in a), ("01" in a), (1.0 in a); a["01"]="s"; print a[1], a["01"]; for (k in a) n++; print n }`,
+		"", "n 1 0 1\nn s\n2\n", "", ""},
+	{`BEGIN { a[-0]=1; a[-3]=2; print ("0" in a), ("-0" in a), a["-3"]; a[0.5]=3; print a["0.5"] }`, "", "1 0 2\n3\n", "", ""},
+	{`BEGIN { a[1e15]=1; a[999999999999999]=2; a[-999999999999999]=3; for (k in a) if (k == 1e15) print k
+	         print a["1000000000000000"], a["999999999999999"], a["-999999999999999"] }  # !mawk - uses CONVFMT for large integers`,
+		"", "1000000000000000\n1 2 3\n", "", ""},
+	{`BEGIN { split("a b c", a); a["x"] = "y"; delete a[2]; for (k in a) n++; print n, a[1] a["3"] a["x"], (2 in a) }`,
+		"", "3 acy 0\n", "", ""},
+	{`{ count[$1]++ } END { print count[1], count["01"], count[2], count["1"] }`, "1\n01\n1\n2", "2 1 1 2\n", "", ""},
+	{`{ a[$1] = $2 }  END { for (k in a) print k, a[k]; print "last", k }  # !awk !gawk !mawk - for (k in a) print k, a[k] is in sorted order`,
+		"b 2\na 1\n10 x\n9 y\nc 3\n", "9 y\n10 x\na 1\nb 2\nc 3\nlast c\n", "", ""},
+	{`BEGIN { OFS = "-"; ORS = ";"; a[1] = 0.1234567; a["x"]; for (k in a) print k, a[k] }  # !awk !gawk !mawk - sorted order`, "", "1-0.123457;x-;", "", ""},
+	{`function f(a, k) { for (k in a) print k; return k }  BEGIN { a["y"]; a["x"]; print f(a) }  # !awk !gawk !mawk - sorted order`, "", "x\ny\ny\n", "", ""},
+	{`BEGIN { k = "none"; for (k in a) print k; print k }`, "", "none\n", "", ""},
 	{`function f(a) { print "x" in a, "y" in a }  BEGIN { b["x"] = 3; f(b) }`, "", "1 0\n", "", ""},
 
 	// Unary expressions: ! + -
@@ -248,6 +322,7 @@ BEGIN {
 	{`BEGIN { print 2^3, 2^3^3, 2^-3, -2^3, "2"^"3", 3^.14 }`, "", "8 134217728 0.125 -8 8 1.16626\n", "", ""},
 	{`BEGIN { print 2**3, 2**3**3, 2**-3, -2**3, "2"**"3", 3**.14 }`, "", "8 134217728 0.125 -8 8 1.16626\n", "", ""},
 	{`BEGIN { print 1 2, "x" "yz", 1+2 3+4 }`, "", "12 xyz 37\n", "", ""},
+	{`BEGIN { x = 3.14159; CONVFMT = "%.2f"; print (x "a") ("b" (x 2)) x, "c" (x " ") }`, "", "3.14ab3.1423.14 c3.14 \n", "", ""},
 	{`BEGIN { print "food"~/oo/, "food"~/[oO]+d/, "food"~"f", "food"~"F", "food"~0 }`, "", "1 1 1 0 0\n", "", ""},
 	{`BEGIN { print "food"!~/oo/, "food"!~/[oO]+d/, "food"!~"f", "food"!~"F", "food"!~0 }`, "", "0 0 0 1 1\n", "", ""},
 	{`BEGIN { print 1+2*3/4^5%6 7, (1+2)*3/4^5%6 "7" }`, "", "1.005867 0.008789067\n", "", ""},
@@ -263,6 +338,15 @@ BEGIN {
 	{`{ print /foo/ }`, "food\nfoo\nxfooz\nbar\n", "1\n1\n1\n0\n", "", ""},
 	{`/[a-/`, "foo", "", "parse error at 1:1: error parsing regexp: missing closing ]: `[a-`", "terminated"},
 	{`/=foo/`, "=foo", "=foo\n", "", ""},
+	{`/ERROR|WARN|FATAL/`, "x ERROR y\nINFO\nWARNING\nFATA\nFATAL", "x ERROR y\nWARNING\nFATAL\n", "", ""},
+	{`{ print ($0 ~ "ab|cd"), ($0 !~ "ab|cd") }`, "xcdx\nacbd\nab", "1 0\n0 1\n1 0\n", "", ""},
+	{`/a1|b2|c3|d4|e5|f6|g7|h8|i9|i10/ { n++ } END { print n }`, "a2\nxi10\nh8\ni1\n\ni9", "3\n", "", ""},
+	{`/é|ü/ { n++ } END { print n }`, "café\nuber\nüber", "2\n", "", ""},
+	{`/a|b|/ { n++ } END { print n }  # !awk - empty alternative`, "x\ny", "2\n", "", ""},
+	{`BEGIN { printf "%s|%s\n", "caf\u00e9", "\u{1F600}" }  # !awk !gawk !mawk`, "", "caf\u00e9|\U0001F600\n", "", ""},
+	{`$0 ~ "^caf\u00e9$" || /^\u{FC}ber$/ || /^[\u00e0-\u00e9]$/ { n++ } END { print n }  # !awk !gawk !mawk`,
+		"caf\u00e9\n\u00fcber\nuber\n\u00e8\n\u00ea", "3\n", "", ""},
+	{`BEGIN { print "\u12" }  # !awk !gawk !mawk`, "", "", "parse error at 1:20: 4 hex digits expected after \\u", "hex digits"},
 	{`BEGIN { print "-12"+0, "+12"+0, " \t\r\n7foo"+0, ".5"+0, "5."+0, "+."+0 }`, "", "-12 12 7 0.5 5 0\n", "", ""},
 	{`BEGIN { print "1e3"+0, "1.2e-1"+0, "1e+1"+0, "1e"+0, "1e+"+0 }`, "", "1000 0.12 10 1 1\n", "", ""},
 	{`BEGIN { print -(11102200000000000000000000000000000000 1040000) }  # !gawk - gawk supports big numbers`,
@@ -382,10 +466,26 @@ BEGIN {
 	{`{ print NF; NF=1; $2="two"; print $0, NF }`, "\n", "0\n two 2\n", "", ""},
 	{`{ print NF; NF=2; $2="two"; print $0, NF}`, "\n", "0\n two 2\n", "", ""},
 	{`{ print NF; NF=3; $2="two"; print $0, NF}`, "a b c\n", "3\na two c 3\n", "", ""},
+	{`{ print NF, NF; $5="x"; print NF, NF; NF=2; print NF, $0 }`, "a b c\n", "3 3\n5 5\n2 a b\n", "", ""},
+	{`{ n = NF; getline; print n, NF, NR; sub(/b/, "x y"); print NF }`, "a\nb c d\n", "1 3 2\n4\n", "", ""},
+	{`function f() { $0 = "x y z" }  { n = NF; f(); print n, NF, $0 }`, "a\n", "1 3 x y z\n", "", ""},
+	{`{ for (i = NF; i > 0; i--) { if (NF == 3) $4 = "d"; s = s NF } } END { print s }`, "a b c\n", "444\n", "", ""},
 	{`{ print; print $1, $3, $NF }`, "a b c d e", "a b c d e\na c e\n", "", ""},
 	{`{ print $1,$3; $2="x"; print; print $2 }`, "a b c", "a c\na x c\nx\n", "", ""},
 	{`{ print; $0="x y z"; print; print $1, $3 }`, "a b c", "a b c\nx y z\nx z\n", "", ""},
 	{`{ print $1^2 }`, "10", "100\n", "", ""},
+	{`{ print $2; print NF; print $2, $5 "|" }`, "a b c", "b\n3\nb |\n", "", ""},
+	{`{ print $3; $2="X"; print; print $4 "|" }`, " a  b c ", "c\na X c\n|\n", "", ""},
+	{`{ print $1; print NF }`, "é b", "é\n2\n", "", ""},
+	{`{ print $1; FS=","; print $2 }`, "a,b c,d\nx,y z", "a,b\nc,d\nx\ny z\n", "", ""},
+	{`BEGIN { FS="," } { print $1; print $3 "|"; print NF }`, "a,b,", "a\n|\n3\n", "", ""},
+	{`BEGIN { FS=":" } { print $2 "|" NF }`, "\n", "|0\n", "", ""},
+	{`{ $1="x"; $3="z"; print length(), /x b z/; print }`, "a  b c", "5 1\nx b z\n", "", ""},
+	{`{ $1="x"; OFS="-"; print; $2="y"; print }`, "a b c", "x b c\nx-y-c\n", "", ""},
+	{`{ $1="9"; NF=2; print $0+0, $0 "|" }`, "a b c", "9 9 b|\n", "", ""},
+	{`BEGIN { OFS="-"; ORS="|\n" } { print $3, $1, $5; $2="x"; print $0, $2; OFS=":"; print $1, $2 }`, "a b c", "c-a-|\na-x-c-x|\na:x|\n", "", ""},
+	{`BEGIN { FS="," } { print $2, $1; NF=1; print $1, $2 "|"; print $1, $2 }`, "a,b,c\nd", "b a\na |\na \n d\nd |\nd \n", "", ""},
+	{`{ print $1, $1; $0="x y"; print $2, $1 }`, "1e3 z", "1e3 1e3\ny x\n", "", ""},
 	{`{ print $-1 }`, "x", "", "field index negative: -1", "field -1"},
 	{`{ NF=-1; }  # !awk - awk allows setting negative NF`,
 		"x", "", "NF set to negative value: -1", "negative value"},
@@ -477,10 +577,17 @@ BEGIN {
 	{`BEGIN { print match("x food y", "fo"), RSTART, RLENGTH }`, "", "3 3 2\n", "", ""},
 	{`BEGIN { print match("x food y", "fox"), RSTART, RLENGTH }`, "", "0 0 -1\n", "", ""},
 	{`BEGIN { print match("x food y", /[fod]+/), RSTART, RLENGTH }`, "", "3 3 4\n", "", ""},
+	{`BEGIN { print match("id=foo42;", /([a-z]+)([0-9]+)(x)?/, m), RSTART, RLENGTH; print m[0], m[1], m[2], (3 in m), m[2] + 1; print m[0, "start"], m[0, "length"], m[1, "start"], m[2, "start"], m[2, "length"], ((3, "start") in m) }  # !awk !mawk`,
+		"", "4 4 5\nfoo42 foo 42 0 43\n4 5 4 7 2 0\n", "", ""},
+	{`BEGIN { m["x"]; print match("abc", /z/, m), RSTART, RLENGTH, ("x" in m), (0 in m) }  # !awk !mawk`, "", "0 0 -1 0 0\n", "", ""},
+	{`{ if (match($0, "^([^:]+): *(.*)$", kv)) h[kv[1]] = kv[2] }  END { print h["Host"] "|" h["Accept"] }  # !awk !mawk`,
+		"Host: example.com\nAccept:  */*\nbad\n", "example.com|*/*\n", "", ""},
 	{`{ print length, length(), length("buzz"), length("") }`, "foo bar", "7 7 4 0\n", "", ""},
 	{`BEGIN { print index("foo", "f"), index("foo0", 0), index("foo", "o"), index("foo", "x") }`, "", "1 4 2 0\n", "", ""},
 	{`BEGIN { print atan2(1, 0.5), atan2(-1, 0) }`, "", "1.10715 -1.5708\n", "", ""},
 	{`BEGIN { print sprintf("%3d", 42) }`, "", " 42\n", "", ""},
+	{`BEGIN { for (i = 0; i < 500; i++) s = s sprintf("%" (i % 150 + 1) "d", 1); print length(s) }`, "", "35250\n", "", ""},
+	{`BEGIN { for (i = 0; i < 500; i++) { k = i % 150; n += k ~ ("^" k "$") && !(k+1 ~ ("^" k "$")) }; print n }`, "", "500\n", "", ""},
 	{`BEGIN { print sprintf("%d", 12, 34) }`, "", "12\n", "", ""},
 	{`BEGIN { print sprintf("%d") }`, "", "", "format error: got 0 args, expected 1", "not enough arg"},
 	{`BEGIN { print sprintf("%d", 12, 34) }`, "", "12\n", "", ""},
@@ -504,9 +611,23 @@ BEGIN {
 	{`BEGIN { n = split("", a); for (i=1; i<=n; i++) print a[i] }`, "", "", "", ""},
 	{`BEGIN { n = split("", a, "."); for (i=1; i<=n; i++) print a[i] }`, "", "", "", ""},
 	{`BEGIN { n = split("ab c d ", a); for (i=1; i<=n; i++) print a[i] }`, "", "ab\nc\nd\n", "", ""},
+	{`{ for (i = 0; i < 2; i++) { n = split($0, a); m = split($0, b, ","); print n, a[1], m, b[2]; a[1] = b[2] = "x" } }`,
+		"a,b c\n\np q", "2 a,b 2 b c\n2 a,b 2 b c\n0  0 \n0  0 \n2 p 1 \n2 p 1 \n", "", ""},
+	{`{ for (i = 0; i < 3; i++) { n = split($0, a, i == 1 ? "[,;]" : ";"); printf "%d %s|", n, a[n] } print "" }`,
+		"a;b,c\nd", "2 b,c|3 c|2 b,c|\n1 d|1 d|1 d|\n", "", ""},
 	{`BEGIN { n = split("ab,c,d,", a, ","); for (i=1; i<=n; i++) print a[i] }`, "", "ab\nc\nd\n\n", "", ""},
 	{`BEGIN { n = split("ab,c.d,", a, /[,.]/); for (i=1; i<=n; i++) print a[i] }`, "", "ab\nc\nd\n\n", "", ""},
 	{`BEGIN { n = split("1 2", a); print (n, a[1], a[2], a[1]==1, a[2]==2) }`, "", "2 1 2 1 1\n", "", ""},
+	{`BEGIN { n = split("  a  b c ", a, " ", s); for (i = 0; i <= n; i++) printf "%d[%s][%s]", i, a[i], s[i]; print "" }  # !awk !mawk`,
+		"", "0[][  ]1[a][  ]2[b][ ]3[c][ ]\n", "", ""},
+	{`BEGIN { n = split("a b", a, " ", s); print n, (0 in s), (1 in s), (2 in s) }  # !awk !mawk`, "", "2 0 1 0\n", "", ""},
+	{`BEGIN { n = split("a1b22c", a, /[0-9]+/, s); print n, a[1] s[1] a[2] s[2] a[3], (3 in s), s[2] + 1 }  # !awk !mawk`, "", "3 a1b22c 0 23\n", "", ""},
+	{`BEGIN { n = split("a:b::c", a, ":", s); print n, s[1] s[2] s[3], (4 in s) }  # !awk !mawk`, "", "4 ::: 0\n", "", ""},
+	{`BEGIN { n = split("", a, ":", s); s[1] = 1; n = split("", a, ":", s); print n, (1 in s) }  # !awk !mawk`, "", "0 0\n", "", ""},
+	{`BEGIN { FS = "[,;] *" } { n = split($0, f, FS, s); f[2] = "X"; out = f[1]; for (i = 1; i < n; i++) out = out s[i] f[i+1]; print out }  # !awk !mawk`,
+		"a, b;c\nd;  e", "a, X;c\nd;  X\n", "", ""},
+	{`function f(x, y) { split("a b", x, " ", y) }  BEGIN { f(a, a) }  # !awk !mawk`,
+		"", "", "split: can't use the same array for the second and fourth arguments", ""},
 	{`BEGIN { x = "1.2.3"; print sub(/\./, ",", x); print x }`, "", "1\n1,2.3\n", "", ""},
 	{`BEGIN { x = "1.2.3"; print sub(/\./, ",\\", x); print x }`, "", "1\n1,\\2.3\n", "", ""},
 	{`{ print sub(/\./, ","); print $0 }`, "1.2.3", "1\n1,2.3\n", "", ""},
@@ -547,6 +668,77 @@ BEGIN {
 		"", "error\n0\n", "", ""},
 	{`BEGIN { print system("exit 42") }  # !fuzz`, "", "42\n", "", ""},
 
+	// GoAWK extension functions
+	{`BEGIN { b = sb_new(); sb_add(b, "foo"); n = sb_add(b, 42); print n, sb_str(b) }  # !awk !gawk`,
+		"", "5 foo42\n", "", ""},
+	{`{ sb_add(b ? b : b = sb_new(), $1 ",") }  END { print sb_str(b), sb_str(sb_new()) "|" }  # !awk !gawk`,
+		"a\nb\nc\n", "a,b,c, |\n", "", ""},
+	{`BEGIN { sb_add(1, "x") }  # !awk !gawk`, "", "", "invalid string builder handle 1", ""},
+	{`BEGIN { sb_str(sb_new() + 1) }  # !awk !gawk`, "", "", "invalid string builder handle 2", ""},
+	{`BEGIN { sb_str = 3; print sb_str }  # !awk !gawk`, "", "3\n", "", ""},
+	{`BEGIN { print sb_new(), sb_new() }  function sb_new() { return "user" }`, "", "user user\n", "", ""},
+	{`function sb_new() { return "user" }  BEGIN { print sb_new() }`, "", "user\n", "", ""},
+	{`BEGIN { if (/x/ ~ "y") print "no"; print sb_str() }  function sb_str() { return "user" }`, "", "user\n", "", ""},
+	{`{ a[$1] = $2 }  END { print dumparr(a) }  # !awk !gawk`, "b 2\n10 x\na 1\n9 y\n", "9\ty\n10\tx\na\t1\nb\t2\n4\n", "", ""},
+	{`BEGIN { a["x\ty"] = "1\n2"; a["k"] = "\\"; dumparr(a, "tsv", "-") }  # !awk !gawk`, "", "k\t\\\\\nx\\ty\t1\\n2\n", "", ""},
+	{`BEGIN { a[1] = "x,y"; a[2] = "say \"hi\""; a[3] = 3; ORS = "|"; dumparr(a, "csv") }  # !awk !gawk`,
+		"", "1,\"x,y\"|2,\"say \"\"hi\"\"\"|3,3|", "", ""},
+	{`BEGIN { a["n"] = 1.5; a["s"] = "x\"<"; a["i"] = log(-1); split("7", b); a["f"] = b[1]; dumparr(a, "json") }  # !awk !gawk`,
+		"", "{\"f\":\"7\",\"i\":\"nan\",\"n\":1.5,\"s\":\"x\\\"<\"}\n", "", ""},
+	{`function f(arr) { return dumparr(arr, "json") }  BEGIN { print f(a) }  # !awk !gawk`, "", "{}\n0\n", "", ""},
+	{`BEGIN { dumparr(a, "xml") }  # !awk !gawk`, "", "", `dumparr format must be "tsv", "csv", or "json", not "xml"`, ""},
+	{`BEGIN { dumparr(x); x = 1 }  # !awk !gawk`, "", "", "parse error at 1:21: can't use array \"x\" as scalar", ""},
+	{`BEGIN { a[1] = "x"; a["k"] = 2; b["old"]; print copy(a, b), ("old" in b), b[1], b["k"]; a[1] = "y"; print b[1] }  # !awk !gawk !mawk`,
+		"", "2 0 x 2\nx\n", "", ""},
+	{`function f(src, dst) { return copy(src, dst) }  BEGIN { a[1]; a[2]; print f(a, b), (2 in b); print copy(a, a), (1 in a); print copy(e, a), (1 in a) }  # !awk !gawk !mawk`,
+		"", "2 1\n2 1\n0 0\n", "", ""},
+	{`BEGIN { a["b"] = 2; a["a"] = 1; a[10] = "t"; a[9] = "n"; n = keys(a, k, 1); values(a, v, 1); for (i = 1; i <= n; i++) print i, k[i], v[i] }  # !awk !gawk !mawk`,
+		"", "1 9 n\n2 10 t\n3 a 1\n4 b 2\n", "", ""},
+	{`BEGIN { a["x"]; a[" 3"]; a["10"]; a["nan"]; a["NaN"]; a["1e1"]; a["+inf"]; a["2"]; n = keys(a, k, 1); for (i = 1; i <= n; i++) printf "[%s]", k[i]; print "" }  # !awk !gawk !mawk`,
+		"", "[2][ 3][10][1e1][+inf][NaN][nan][x]\n", "", ""},
+	{`function f(src, dst) { dst["old"]; return keys(src, dst) }  BEGIN { a["x"] = 1; print f(a, b), b[1], ("old" in b) }  # !awk !gawk !mawk`,
+		"", "1 x 0\n", "", ""},
+	{`BEGIN { a["x"] = 5; a["y"] = 6; print values(a, a, "yes"), a[1], a[2], ("x" in a); print keys(e, a), (1 in a) }  # !awk !gawk !mawk`,
+		"", "2 5 6 0\n0 0\n", "", ""},
+	{`BEGIN { copy(x, y); y = 1 }  # !awk !gawk !mawk`, "", "", "parse error at 1:21: can't use array \"y\" as scalar", ""},
+	{`BEGIN { t = monotime(); print sleep(0.05); d = monotime() - t; print (d >= 0.05 && d < 5), sleep(0), sleep(-1), sleep("x") }  # !awk !gawk !mawk`,
+		"", "0\n1 0 0 0\n", "", ""},
+	{`BEGIN { print urlencode("a b&c=d/é"); print urldecode("a+b%26c%3Dd%2F%C3%A9"), urldecode("100%"), urldecode("%zz%4"), urldecode("%41") }  # !awk !gawk !mawk`,
+		"", "a+b%26c%3Dd%2F%C3%A9\na b&c=d/é 100% %zz%4 A\n", "", ""},
+	{`{ n = parsequery($2, q); print n, q["q"], q["x"], ("flag" in q), q["café"], (q["x"] < 10) }  # !awk !gawk !mawk`,
+		"GET q=hello+world&x=1&x=2&flag&&caf%C3%A9=%E2%82%AC\nGET\n", "4 hello world 2 1 € 1\n0   0  1\n", "", ""},
+	{`function f(s, a) { return parsequery(s, a) }  BEGIN { print f("a=1", arr), arr["a"] }  # !awk !gawk !mawk`, "", "1 1\n", "", ""},
+	{`BEGIN { print b64encode("hi?>"), b64encode("hi?>", 1), b64encode(""), b64decode("aGk/Pg=="), b64decode("aGk_Pg", 1), b64decode("aGk_Pg==", 1), b64decode("aGk") }  # !awk !gawk !mawk`,
+		"", "aGk/Pg== aGk_Pg  hi?> hi?> hi?> hi\n", "", ""},
+	{`BEGIN { print "[" b64decode("!!") "]", "[" b64decode("aGk_Pg") "]", b64decode(b64encode("\377\000x")) == "\377\000x" }  # !awk !gawk !mawk`,
+		"", "[] [] 1\n", "", ""},
+	{`BEGIN { print md5("abc"); print sha1("abc"); print sha256(""); print sha256(123) }  # !awk !gawk !mawk`, "",
+		"900150983cd24fb0d6963f7d28e17f72\na9993e364706816aba3e25717850c26c9cd0d89d\n" +
+			"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\na665a45920422f9d417e4867efdc4fb8a04a1f3fff1fa07e998e86f7f7a27ae3\n", "", ""},
+	{`BEGIN { d = "The quick brown fox jumps over the lazy dog"; print hmac("key", d); print hmac("key", d, "sha1"); print hmac("key", d, "md5") }  # !awk !gawk !mawk`, "",
+		"f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8\nde7c9b85b8b78aa6bc8a7a36f70a90701c9db4d9\n80070713463e7749b90c2dc24911e275\n", "", ""},
+	{`BEGIN { hmac("k", "d", "sha512") }  # !awk !gawk !mawk`, "", "", `hmac algorithm must be "md5", "sha1", or "sha256", not "sha512"`, ""},
+	{`BEGIN { print round(2.5), round(-2.5), round(2.4), ceil(1.2), ceil(-1.2), floor(1.8), floor(-1.2), trunc(-1.7), trunc(1.7), round("2.6") }  # !awk !gawk !mawk`,
+		"", "3 -3 2 2 -1 1 -2 -1 1 3\n", "", ""},
+	{`BEGIN { print round(3.14159, 2), round(-3.14159, 3), round(1234, -2), round(1.5e300, 400), round(123, -400) }  # !awk !gawk !mawk`,
+		"", "3.14 -3.142 1200 1.5e+300 0\n", "", ""},
+	{`BEGIN { print max(3, "10", 9), min("10", "9"), max(-1), min(2, "x", 5), abs(-3.5), abs("-2"), max("3abc", 2) }  # !awk !gawk !mawk`,
+		"", "10 9 -1 0 3.5 2 3\n", "", ""},
+	{`{ print max($1, $2), min($1, $2), max($1, $2) == $1 }  # !awk !gawk !mawk`, "10 9\n-1 -10\n", "10 9 1\n-1 -10 1\n", "", ""},
+	{`BEGIN { print min() }  # !awk !gawk !mawk`, "", "", "parse error at 1:19: expected expression instead of )", ""},
+	{`BEGIN { print chr(65) chr(233) chr(128512), ord("A"), ord("é"), ord("😀x"), ord(""), ord("\377x") }  # !awk !gawk !mawk`,
+		"", "Aé😀 65 233 128512 0 255\n", "", ""},
+	{`BEGIN { print length(chr(-1)), length(chr(55296)), length(chr(1114112)), chr(66.7), chr("67") }  # !awk !gawk !mawk`,
+		"", "0 0 0 B C\n", "", ""},
+	{`function ord(s) { return "user" }  BEGIN { print ord("A"), chr(97) }`, "", "user a\n", "", ""},
+	{`BEGIN { t = mktime("2021 03 14 15 09 26", 1); print t, strftime("%Y-%m-%d %H:%M:%S %a %B %j %U %W %V %u %e %I%p %%", t, 1) }  # !awk`,
+		"", "1615734566 2021-03-14 15:09:26 Sun March 073 11 10 10 7 14 03PM %\n", "", ""},
+	{`BEGIN { print mktime("2021 1 32 0 0 0", 1), mktime("2021 1 1", 1), mktime("x y z 1 2 3", 1) }  # !awk`, "", "1612137600 -1 -1\n", "", ""},
+	{`BEGIN { print strftime("%c|%D|%T|%s|%Q", 0, 1) }  # !awk`, "", "Thu Jan  1 00:00:00 1970|01/01/70|00:00:00|0|%Q\n", "", ""},
+	{`BEGIN { t = 1615734566; print tzconvert(t, "America/New_York"); print tzconvert(t, "Asia/Tokyo", "%F %T %z") }  # !awk !gawk`,
+		"", "Sun Mar 14 11:09:26 EDT 2021\n2021-03-15 00:09:26 +0900\n", "", ""},
+	{`BEGIN { tzconvert(0, "Nowhere/Special") }  # !awk !gawk`, "", "", `unknown time zone "Nowhere/Special"`, ""},
+
 	// Test bytes/unicode handling (GoAWK currently has char==byte, unlike Gawk).
 	{`BEGIN { print match("food", "foo"), RSTART, RLENGTH }  !gawk`, "", "1 1 3\n", "", ""},
 	{`BEGIN { print match("x food y", "fo"), RSTART, RLENGTH }  !gawk`, "", "3 3 2\n", "", ""},
@@ -661,6 +853,11 @@ BEGIN { early() }
 	{`BEGIN { arr[0]; f(arr) } function f(a) { printf "x" }`, "", "x", "", ""},
 	{`function f(x) { 0 in _; f(_) }  BEGIN { f() }  # !awk !gawk`, "", "", `calling "f" exceeded maximum call depth of 1000`, ""},
 	{`BEGIN { for (i=0; i<1001; i++) f(); print x }  function f() { x++ }`, "", "1001\n", "", ""},
+	{`function max(a, b) { return a > b ? a : b }  { for (i = 1; i <= NF; i++) m = max(m, $i) }  END { print m, max("10", 9), max(1) }`,
+		"3 14 2\n9 1", "14 9 1\n", "", ""},
+	{`function sq(x) { return x * x }  BEGIN { print sq(n++), n, sq(3), sq(sq(2)) }`, "", "0 1 9 16\n", "", ""},
+	{`function f(x, y) { return y ? x : 0 }  { print f($-1, 0) }`, "a", "", "field index negative: -1", "field -1"},
+	{`function f(x, y) { return y ? x : 0 }  BEGIN { i = -1; print f($i, 1) }`, "", "", "field index negative: -1", "field -1"},
 	{`
 function bar(y) { return y[1] }
 function foo() { return bar(x) }
@@ -683,6 +880,14 @@ BEGIN { a[1]=2; f1(a); print f2(a, 1) }
 		"", "", `parse error at 1:56: can't pass array "a" as scalar param`, "array"},
 	{`{ f(z) }  function f(x) { print NR }`, "abc", "1\n", "", ""},
 	{`function f() { f() }  BEGIN { f() }  # !awk !gawk`, "", "", `calling "f" exceeded maximum call depth of 1000`, ""},
+	{`function count(n, acc) { if (n == 0) return acc; return count(n-1, acc+1) }  BEGIN { print count(5000, 0) }  # !mawk - too deep for its stack`, "", "5000\n", "", ""},
+	{`function f(n, a, loc) { if (!n) { for (k in a) print k, a[k]; return } loc[n] = n; return f(n-1, loc) }  BEGIN { f(3) }`,
+		"", "1 1\n", "", ""},
+	{`function f(n, a, loc) { loc[n]; a[n]; if (!n) { for (k in a) c++; return c } return f(n-1, a) }  BEGIN { print f(3000, x); for (k in x) n++; print n }  # !mawk - too deep for its stack`,
+		"", "3001\n3001\n", "", ""},
+	{`function f(n, a, b) { if (!n) return a[1] b[1]; split(n, a); return f(n-1, b, a) }  BEGIN { print f(4, x, y) }`,
+		"", "21\n", "", ""},
+	{`function f(n, m) { if (n) return f(n-1); return n m }  BEGIN { print f(3, "x") }`, "", "0\n", "", ""},
 	{`function f(x) { 0 in x }  BEGIN { f(FS) }  # !awk`, "", "", `parse error at 1:35: can't pass scalar "FS" as array param`, "attempt to use scalar parameter `x' as an array"},
 	{`
 function foo(x) { print "foo", x }
@@ -706,10 +911,16 @@ BEGIN { foo(5); bar(10) }
 	{`BEGIN { getline $1; print $1 }`, "foo", "foo\n", "", ""},
 	{`BEGIN { "echo foo" | getline a[1]; print a[1] }`, "", "foo\n", "", ""},
 	{`BEGIN { "echo foo" | getline $1; print $1 }`, "", "foo\n", "", ""},
+	{`BEGIN { "echo foo bar" | getline $2; print; print NF }`, "", " foo bar\n2\n", "", ""},
+	{`{ getline $3; print; print NF }`, "a b\nc", "a b c\n3\n", "", ""},
 	{`BEGIN { print "foo" |"sort"; print "bar" |"sort" }  # !fuzz`, "", "bar\nfoo\n", "", ""},
 	{`BEGIN { print "foo" |">&2 echo error" }  # !gawk !fuzz`, "", "error\n", "", ""},
 	{`BEGIN { "cat" | getline; print }  # !fuzz`, "bar", "bar\n", "", ""},
 	{`BEGIN { print getline x < "/no/such/file" }  # !fuzz`, "", "-1\n", "", ""},
+	{`BEGIN { s = "a b\nc\n\nd e f"; src = "string://" s; while ((getline line < src) > 0) printf "%s|", line; print NR; close(src); RS = ""; while ((getline < src) > 0) printf "%d %s|", NF, $3; print "" }  # !awk !gawk !mawk`,
+		"", "a b|c||d e f|0\n3 c|3 f|\n", "", ""},
+	{`BEGIN { RS = "[,;]"; src = "string://x,y;z"; while ((getline w < src) > 0) printf "%s(%s)", w, RT; print ""; print (getline w < src), close(src), (getline w < src), w }  # !awk !gawk !mawk`,
+		"", "x(,)y(;)z()\n0 0 1 x\n", "", ""},
 	{`BEGIN { print getline "z"; print $0 }`, "foo", "1z\nfoo\n", "", ""},
 	{`BEGIN { print getline x+1; print x }`, "foo", "2\nfoo\n", "", ""},
 	{`BEGIN { print getline (x+1); print $0 }`, "foo", "11\nfoo\n", "", ""},
@@ -815,6 +1026,8 @@ func TestInterp(t *testing.T) {
 	longLine := strings.Repeat("x", 70000)
 	tests := append(interpTests,
 		interpTest{`{ print length() }`, longLine, fmt.Sprintf("%d\n", len(longLine)), "", ""},
+		// Deeply-nested expression to ensure the stack grows
+		interpTest{"BEGIN { print " + strings.Repeat("1+(", 300) + "1" + strings.Repeat(")", 300) + " }  # !mawk", "", "301\n", "", ""},
 	)
 
 	for _, test := range tests {
@@ -903,11 +1116,25 @@ func testGoAWK(
 		t.Fatal(err)
 	}
 
-	// Test that disassembler at least doesn't panic or return an error.
-	err = prog.Disassemble(ioutil.Discard)
+	// Test that disassembler at least doesn't panic or return an error,
+	// and that assembling its output gives back the same program.
+	var asm bytes.Buffer
+	err = prog.Disassemble(&asm)
+	if err != nil {
+		t.Fatalf("disassembler returned an error: %v", err)
+	}
+	assembled, err := parser.Assemble(bytes.NewReader(asm.Bytes()), parserConfig)
+	if err != nil {
+		t.Fatalf("assembler returned an error: %v\n%s", err, asm.String())
+	}
+	var reasm bytes.Buffer
+	err = assembled.Disassemble(&reasm)
 	if err != nil {
 		t.Fatalf("disassembler returned an error: %v", err)
 	}
+	if reasm.String() != asm.String() {
+		t.Fatalf("assembled program differs, expected:\n%s\ngot:\n%s", asm.String(), reasm.String())
+	}
 
 	outBuf := &concurrentBuffer{}
 	config := &interp.Config{
@@ -1185,6 +1412,38 @@ BEGIN { x=4; y=5; print foo(x), bar(y) }
 	}
 }
 
+func TestLoad(t *testing.T) {
+	load := func(name string) (map[string]interface{}, error) {
+		if name != "ext" {
+			return nil, fmt.Errorf("no extension %q", name)
+		}
+		return map[string]interface{}{
+			"double": func(n float64) float64 { return 2 * n },
+		}, nil
+	}
+	src := `@load "ext"
+BEGIN { print double(21), triple(2) }`
+	funcs := map[string]interface{}{
+		"triple": func(n float64) float64 { return 3 * n },
+	}
+	prog, err := parser.ParseProgram([]byte(src), &parser.ParserConfig{Funcs: funcs, Load: load})
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	var out bytes.Buffer
+	config := &interp.Config{Output: &out, Funcs: funcs}
+	_, err = interp.ExecProgram(prog, config)
+	if err != nil {
+		t.Fatalf("error interpreting: %v", err)
+	}
+	if out.String() != "42 6\n" {
+		t.Fatalf("expected %q, got %q", "42 6\n", out.String())
+	}
+	if len(funcs) != 1 {
+		t.Fatalf("expected config's Funcs to be unchanged, got %v", funcs)
+	}
+}
+
 func TestSafeMode(t *testing.T) {
 	tests := []struct {
 		src  string
@@ -1197,10 +1456,14 @@ func TestSafeMode(t *testing.T) {
 		{`BEGIN { print "hi" >>"out" }`, "", "", "can't write to file due to NoFileWrites", nil},
 		{`BEGIN { print "hi" |"sort" }`, "", "", "can't write to pipe due to NoExec", nil},
 		{`BEGIN { getline <"in" }`, "", "", "can't read from file due to NoFileReads", nil},
+		{`BEGIN { getline x <"string://in"; print x }`, "", "in\n", "", nil},
 		{`$0  # no files`, "1\n2\n", "1\n2\n", "", nil},
 		{`$0  # files`, "1\n2\n", "1\n2\n", "can't read from file due to NoFileReads", []string{"f1"}},
 		{`BEGIN { "echo foo" |getline }`, "", "", "can't read from pipe due to NoExec", nil},
 		{`BEGIN { system("echo foo") }`, "", "", "can't call system() due to NoExec", nil},
+		{`BEGIN { glob("*", files) }`, "", "", "can't call glob() due to NoFileReads", nil},
+		{`BEGIN { stat("in", s) }`, "", "", "can't read file metadata due to NoFileReads", nil},
+		{`BEGIN { filesize("in") }`, "", "", "can't read file metadata due to NoFileReads", nil},
 	}
 	for _, test := range tests {
 		testName := test.src
@@ -1218,224 +1481,2306 @@ func TestSafeMode(t *testing.T) {
 	}
 }
 
-func TestConfigVarsCorrect(t *testing.T) {
-	prog, err := parser.ParseProgram([]byte(`BEGIN { print x }`), nil)
-	if err != nil {
-		t.Fatalf("error parsing: %v", err)
+func TestAllowArgFiles(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	for _, name := range []string{a, b} {
+		err := ioutil.WriteFile(name, []byte(filepath.Base(name)+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
-	config := &interp.Config{
-		Stdin:  strings.NewReader(""),
-		Output: &bytes.Buffer{},
-		Error:  ioutil.Discard,
-		Vars:   []string{"FS"},
+	tests := []struct {
+		src string
+		out string
+		err string
+	}{
+		{`{ print }`, "a\n", ""},
+		{`BEGIN { ARGV[1] = "` + b + `" } { print }`, "", "can't read from file due to NoFileReads"},
+		{`BEGIN { ARGV[ARGC++] = "` + b + `" } { print }`, "a\n", "can't read from file due to NoFileReads"},
+		{`{ print; getline x <"` + b + `" }`, "a\n", "can't read from file due to NoFileReads"},
+		{`BEGIN { system("true") }`, "", "can't call system() due to NoExec"},
 	}
-	_, err = interp.ExecProgram(prog, config)
-	expected := "length of config.Vars must be a multiple of 2, not 1"
-	if err == nil || err.Error() != expected {
-		t.Fatalf("expected error %q, got: %v", expected, err)
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			testGoAWK(t, test.src, "", test.out, test.err, nil, func(config *interp.Config) {
+				config.Args = []string{a}
+				config.NoExec = true
+				config.NoFileWrites = true
+				config.NoFileReads = true
+				config.AllowArgFiles = true
+				config.PrefetchFiles = true
+			})
+		})
 	}
 }
 
-func TestShellCommand(t *testing.T) {
-	testGoAWK(t, `BEGIN { system("echo hello world") }`, "", "hello world\n", "", nil, nil)
-
-	if runtime.GOOS == "windows" {
-		testGoAWK(t, `BEGIN { system("echo hello world") }`, "", "hello world\n", "", nil,
-			func(config *interp.Config) {
-				config.ShellCommand = []string{"cmd.exe", "/c"}
-			})
-	} else {
-		testGoAWK(t, `BEGIN { system("world") }`, "", "hello world\n", "", nil,
-			func(config *interp.Config) {
-				config.ShellCommand = []string{"/bin/echo", "hello"}
-			})
-		testGoAWK(t, `BEGIN { "world" | getline; print }`, "", "hello world\n", "", nil,
-			func(config *interp.Config) {
-				config.ShellCommand = []string{"/bin/echo", "hello"}
-			})
-		testGoAWK(t, `BEGIN { print "hello world" | "-" }`, "", "hello world\n", "", nil,
-			func(config *interp.Config) {
-				config.ShellCommand = []string{"/bin/cat"}
-			})
-		testGoAWK(t, `BEGIN { print system("echo hi") }`, "", "exec: \"foobar3982\": executable file not found in $PATH\n-1\n", "", nil,
-			func(config *interp.Config) {
-				config.ShellCommand = []string{"foobar3982"}
-			})
+func TestGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.log", "a.log", "c.txt"} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pattern := strconv.Quote(filepath.Join(dir, "*.log"))
+	tests := []struct {
+		src string
+		out string
+		err string
+	}{
+		{`BEGIN { n = glob(` + pattern + `, f); for (i = 1; i <= n; i++) print substr(f[i], length(f[i]) - 4) }`, "a.log\nb.log\n", ""},
+		{`BEGIN { f["x"]; print glob(` + strconv.Quote(filepath.Join(dir, "*.csv")) + `, f), ("x" in f) }`, "0 0\n", ""},
+		{`function g(p, a) { return glob(p, a) }  BEGIN { n = g(` + pattern + `, f); ARGV[ARGC++] = f[1]; print n, ARGC }`, "2 2\n", ""},
+		{`BEGIN { glob("[", f) }`, "", `invalid glob pattern "["`},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			testGoAWK(t, test.src, "", test.out, test.err, nil, nil)
+		})
 	}
 }
 
-func TestSystemCommandNotFound(t *testing.T) {
-	prog, err := parser.ParseProgram([]byte(`BEGIN { print system("foobar3982") }`), nil)
+func TestStat(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "f.txt")
+	err := ioutil.WriteFile(file, []byte("hello\n"), 0640)
 	if err != nil {
-		t.Fatalf("error parsing: %v", err)
-	}
-	outBuf := &concurrentBuffer{}
-	config := &interp.Config{
-		Output: outBuf,
-		Error:  outBuf,
+		t.Fatal(err)
 	}
-	_, err = interp.ExecProgram(prog, config)
+	mtime := time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC)
+	err = os.Chtimes(file, mtime, mtime)
 	if err != nil {
-		t.Fatalf("expected no error, got %v", err)
+		t.Fatal(err)
 	}
-	got := outBuf.buffer.String()
-	if !strings.Contains(got, "foobar3982") || !strings.Contains(got, "not found") {
-		t.Fatalf(`expected output to contain "foobar3982" and "not found", got %q`, got)
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("f.txt", link); err != nil {
+		link = "" // symlinks not supported (for example, on Windows)
+	}
+	tests := []struct {
+		src string
+		out string
+		err string
+	}{
+		{`BEGIN { print stat(F, s), s["name"] == F, s["size"], s["mtime"], s["type"]; printf "%o\n", s["mode"] }`, "0 1 6 1615734566 file\n640\n", ""},
+		{`BEGIN { print filesize(F), mtime(F), stat(D, s), s["type"] }`, "6 1615734566 0 directory\n", ""},
+		{`BEGIN { s["x"]; print stat(F "x", s), ("x" in s), length(s["name"]), ERRNO != "", filesize(F "x"), mtime(F "x") }`, "-1 0 0 1 -1 -1\n", ""},
+		{`BEGIN { if (L == "") { print "symlink f.txt"; exit } stat(L, s); print s["type"], s["linkval"] }`, "symlink f.txt\n", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			testGoAWK(t, test.src, "", test.out, test.err, nil, func(config *interp.Config) {
+				config.Vars = []string{"F", file, "D", dir, "L", link}
+			})
+		})
 	}
 }
 
-type mockFlusher struct {
-	bytes.Buffer
-	flushes []string
+// A database/sql driver for testing the sql_* functions: each database
+// (by name) is a table of rows inserted with "insert id name score",
+// which "select" returns (only the one with the given id, if there's a
+// parameter). The "fail" query fails, as does opening "bad".
+type testDriver struct {
+	mu     sync.Mutex
+	tables map[string][][]driver.Value
 }
 
-func (f *mockFlusher) Flush() error {
-	f.flushes = append(f.flushes, normalizeNewlines(f.String()))
-	return nil
+type testConn struct {
+	d    *testDriver
+	name string
 }
 
-func TestFlushes(t *testing.T) {
-	src := `
-BEGIN {
-	print fflush()
-	print "x"
-	print "y"
-	print fflush()
-	print "z"
-	print fflush("")
-}`
-	f := &mockFlusher{}
-	testGoAWK(t, src, "", "", "", nil, func(config *interp.Config) {
-		config.Output = f
-	})
-	// The last one is from GoAWK itself flushing output after finishing
-	expected := []string{"", "0\nx\ny\n", "0\nx\ny\n0\nz\n", "0\nx\ny\n0\nz\n0\n"}
-	if !reflect.DeepEqual(f.flushes, expected) {
-		t.Fatalf("expected flushes %q, got %q", expected, f.flushes)
-	}
+type testStmt struct {
+	c     *testConn
+	query string
+}
 
-	// Ensure output is flushed before getline reads from stdin
-	src = `
-BEGIN {
-	printf "Prompt: "
-	getline x
-	print x
-}`
-	f = &mockFlusher{}
-	testGoAWK(t, src, "42\n", "", "", nil, func(config *interp.Config) {
-		config.Output = f
-	})
-	expected = []string{"Prompt: ", "Prompt: 42\n"}
-	if !reflect.DeepEqual(f.flushes, expected) {
-		t.Fatalf("expected flushes %q, got %q", expected, f.flushes)
-	}
+type testRows struct {
+	rows [][]driver.Value
+}
 
-	// Ensure output is flushed before system()
-	src = `
-BEGIN {
-  print "one"
-  system("echo .")
-  print "two"
-}`
-	f = &mockFlusher{}
-	testGoAWK(t, src, "", "", "", nil, func(config *interp.Config) {
-		config.Output = f
-	})
-	expected = []string{"one\n", "one\n.\ntwo\n"}
-	if !reflect.DeepEqual(f.flushes, expected) {
-		t.Fatalf("expected flushes %q, got %q", expected, f.flushes)
+func (d *testDriver) Open(name string) (driver.Conn, error) {
+	if name == "bad" {
+		return nil, errors.New("can't open bad")
 	}
+	return &testConn{d, name}, nil
 }
 
-type errorFlusher struct {
-	bytes.Buffer
-}
+func (c *testConn) Prepare(query string) (driver.Stmt, error) { return &testStmt{c, query}, nil }
+func (c *testConn) Close() error                              { return nil }
+func (c *testConn) Begin() (driver.Tx, error)                 { return nil, errors.New("no transactions") }
 
-func (f *errorFlusher) Flush() error {
-	return errors.New("that's not good, hackers")
-}
+func (s *testStmt) Close() error  { return nil }
+func (s *testStmt) NumInput() int { return -1 }
 
-func TestFlushError(t *testing.T) {
-	f := &errorFlusher{}
-	testGoAWK(t, `BEGIN { fflush() }`, "", "", "", nil, func(config *interp.Config) {
-		config.Output = f
-		config.Error = f
-	})
-	expected := "error flushing \"stdout\": that's not good, hackers\n"
-	if f.String() != expected {
-		t.Fatalf("expected %q, got %q", expected, f.String())
+func (s *testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.query != "insert" || len(args) != 3 {
+		return nil, fmt.Errorf("bad statement %q with %d args", s.query, len(args))
 	}
+	s.c.d.mu.Lock()
+	defer s.c.d.mu.Unlock()
+	s.c.d.tables[s.c.name] = append(s.c.d.tables[s.c.name], args)
+	return driver.RowsAffected(1), nil
 }
 
-func TestEnviron(t *testing.T) {
-	os.Setenv("GOAWK_TEN", "10") // to test that ENVIRON[x] is numeric string
-	src := `
-BEGIN {
-	n = 0
-	for (k in ENVIRON)
-		n++
-	print(n, ENVIRON["USER"], ENVIRON["GOAWK_TEN"] < 2)
-}`
-	expected := fmt.Sprintf("%d %s 0\n", len(os.Environ()), os.Getenv("USER"))
-	testGoAWK(t, src, "", expected, "", nil, nil)
+func (s *testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.query != "select" {
+		return nil, fmt.Errorf("bad query %q", s.query)
+	}
+	s.c.d.mu.Lock()
+	defer s.c.d.mu.Unlock()
+	var rows [][]driver.Value
+	for _, row := range s.c.d.tables[s.c.name] {
+		if len(args) == 0 || row[0] == args[0] {
+			rows = append(rows, append(row, nil)) // "note" is always NULL
+		}
+	}
+	return &testRows{rows}, nil
+}
 
-	expected = "2 bob 0\n"
-	testGoAWK(t, src, "", expected, "", nil, func(config *interp.Config) {
-		config.Environ = []string{"USER", "bob", "GOAWK_TEN", "10"}
-	})
+func (r *testRows) Columns() []string { return []string{"id", "name", "score", "note"} }
+func (r *testRows) Close() error      { return nil }
 
-	expected = "0  1\n"
-	testGoAWK(t, src, "", expected, "", nil, func(config *interp.Config) {
-		config.Environ = []string{}
-	})
+func (r *testRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
 
-	testGoAWK(t, src, "", "", "length of config.Environ must be a multiple of 2, not 3", nil, func(config *interp.Config) {
-		config.Environ = []string{"b", "a", "d"}
-	})
+func init() {
+	sql.Register("goawktest", &testDriver{tables: make(map[string][][]driver.Value)})
 }
 
-func TestExit(t *testing.T) {
+func TestSQL(t *testing.T) {
 	tests := []struct {
-		src    string
-		out    string
-		status int
+		src       string
+		out       string
+		err       string
+		configure func(config *interp.Config)
 	}{
-		{`BEGIN { print "x"; exit; print "y" }  { print "a" }  END { print "z" }`, "x\nz\n", 0},
-		{`BEGIN { print "x"; exit 1+2; print "y" }  { print "a" }  END { print "z" }`, "x\nz\n", 3},
-		{`{ print "x"; exit; print "y" }  END { print "z" }`, "x\nz\n", 0},
-		{`{ print "x"; exit 1+2; print "y" }  END { print "z" }`, "x\nz\n", 3},
-		{`END { print "x"; exit; print "y" }`, "x\n", 0},
-		{`END { print "x"; exit 1+2; print "y" }`, "x\n", 3},
+		{`BEGIN {
+	db = sql_open("t1")
+	print db, sql_exec(db, "insert", 1, "bob", 4.5), sql_exec(db, "insert", 2, "ann", "7")
+	n = sql_query(db, "select", rows)
+	print n, rows[0, 1], rows[0, 2], rows[0, 3], rows[0, 4]
+	for (i = 1; i <= n; i++) print rows[i, "id"], rows[i, "name"], rows[i, "score"] * 2, "[" rows[i, "note"] "]"
+	print sql_query(db, "select", rows, 2), rows[1, "name"], rows[1, "score"] < 10
+	print sql_close(db)
+}`, "1 1 1\n2 id name score note\n1 bob 9 []\n2 ann 14 []\n1 ann 1\n0\n", "", nil},
+		{`BEGIN { db = sql_open("t2"); print sql_query(db, "select", r, $1), length(r[0, 1]) }`, "0 2\n", "", nil},
+		{`BEGIN { print sql_open("bad"), ERRNO }`, "-1 can't open bad\n", "", nil},
+		{`BEGIN { db = sql_open("t3"); r[1]; print sql_query(db, "fail", r), (1 in r), ERRNO; print sql_exec(db, "fail") }`,
+			"-1 0 bad query \"fail\"\n-1\n", "", nil},
+		{`BEGIN { sql_exec(1, "insert") }`, "", "invalid database handle 1", nil},
+		{`BEGIN { db = sql_open("t4"); sql_close(db); sql_query(db, "select", r) }`, "", "invalid database handle 1", nil},
+		{`BEGIN { sql_open("t5") }`, "", `SQL driver "nope" isn't registered`, func(config *interp.Config) {
+			config.SQLDriver = "nope"
+		}},
+		{`BEGIN { sql_open("t6") }`, "", "can't open database due to NoFileReads", func(config *interp.Config) {
+			config.SQLDriver = "goawktest"
+			config.NoFileReads = true
+		}},
+		{`BEGIN { db = sql_open("t7"); print sql_query(db, "delete", r) }`, "",
+			"can't open database due to NoFileWrites", func(config *interp.Config) {
+				config.SQLDriver = "goawktest"
+				config.NoFileWrites = true
+			}},
+		{`BEGIN { db = sql_open("new.db"); print sql_query(db, "insert returning", r, 1, "x", 2) }`, "",
+			"can't open database due to NoFileWrites", func(config *interp.Config) {
+				config.SQLDriver = "goawktest"
+				config.NoFileWrites = true
+			}},
 	}
 	for _, test := range tests {
 		t.Run(test.src, func(t *testing.T) {
-			prog, err := parser.ParseProgram([]byte(test.src), nil)
-			if err != nil {
-				t.Fatalf("error parsing: %v", err)
+			configure := test.configure
+			if configure == nil {
+				configure = func(config *interp.Config) { config.SQLDriver = "goawktest" }
 			}
-			outBuf := &bytes.Buffer{}
-			config := &interp.Config{
-				Stdin:  strings.NewReader("line\n"),
-				Output: outBuf,
+			testGoAWK(t, test.src, "", test.out, test.err, nil, configure)
+		})
+	}
+}
+
+// Start a minimal Redis server for testing, which handles AUTH (with
+// password "secret"), SELECT, GET, SET, INCRBY, and INCRBYFLOAT, and
+// return its address.
+func startRedisServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var mu sync.Mutex
+	data := map[string]string{"s": "hello", "n": "41"}
+	handle := func(args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if args[len(args)-1] != "secret" {
+				return "-WRONGPASS invalid password\r\n"
 			}
-			status, err := interp.ExecProgram(prog, config)
-			if err != nil {
-				t.Fatalf("error interpreting: %v", err)
+			return "+OK\r\n"
+		case "SELECT":
+			return "+OK\r\n"
+		case "GET":
+			v, ok := data[args[1]]
+			if !ok {
+				return "$-1\r\n"
 			}
-			normalized := normalizeNewlines(outBuf.String())
-			if normalized != test.out {
-				t.Fatalf("expected %q, got %q", test.out, normalized)
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+		case "SET":
+			data[args[1]] = args[2]
+			return "+OK\r\n"
+		case "INCRBY", "INCRBYFLOAT":
+			n := 0.0
+			if v, ok := data[args[1]]; ok {
+				var err error
+				n, err = strconv.ParseFloat(v, 64)
+				if err != nil {
+					return "-ERR value is not an integer or out of range\r\n"
+				}
 			}
-			if status != test.status {
-				t.Fatalf("expected status %d, got %d", test.status, status)
+			by, _ := strconv.ParseFloat(args[2], 64)
+			data[args[1]] = strconv.FormatFloat(n+by, 'g', -1, 64)
+			if args[0] == "INCRBY" {
+				return ":" + data[args[1]] + "\r\n"
 			}
-		})
+			v := data[args[1]]
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+		default:
+			return "-ERR unknown command\r\n"
+		}
 	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					var n int
+					if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+						return
+					}
+					args := make([]string, n)
+					for i := range args {
+						var size int
+						if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+							return
+						}
+						buf := make([]byte, size+2)
+						if _, err := io.ReadFull(r, buf); err != nil {
+							return
+						}
+						args[i] = string(buf[:size])
+					}
+					if _, err := io.WriteString(conn, handle(args)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
 }
 
-func benchmarkProgram(b *testing.B, funcs map[string]interface{},
-	input, expected, srcFormat string, args ...interface{},
-) {
+func TestRedis(t *testing.T) {
+	addr := startRedisServer(t)
+	redisURL := "redis://:secret@" + addr + "/2"
+	tests := []struct {
+		src       string
+		out       string
+		err       string
+		configure func(config *interp.Config)
+	}{
+		{`BEGIN { print redis_get("s"), redis_get("n") + 1, "[" redis_get("missing") "]" }`, "hello 42 []\n", "", nil},
+		{`BEGIN { print redis_set("k", "v 1"), redis_get("k"); print redis_get("n") < 5 }`, "0 v 1\n0\n", "", nil},
+		{`BEGIN { print redis_incr("c"), redis_incr("c", 5), redis_incr("c", -1), redis_get("c") }`, "1 6 5 5\n", "", nil},
+		{`BEGIN { print redis_incr("f", 0.5), redis_incr("f", 0.25) * 4 }`, "0.5 3\n", "", nil},
+		{`BEGIN { print "[" redis_incr("s") "]", ERRNO }`, "[] ERR value is not an integer or out of range\n", "", nil},
+		{`BEGIN { print "[" redis_get("s") "]", ERRNO }`, "[] WRONGPASS invalid password\n", "", func(config *interp.Config) {
+			config.RedisURL = "redis://:wrong@" + addr
+		}},
+		{`BEGIN { redis_get("s") }`, "", "can't call redis_get() without config.RedisURL", func(config *interp.Config) {}},
+		{`BEGIN { redis_get("s") }`, "", `invalid config.RedisURL: scheme must be redis or rediss, not "http"`, func(config *interp.Config) {
+			config.RedisURL = "http://" + addr
+		}},
+		{`BEGIN { redis_get("s") }`, "", "can't call redis_get() due to NoFileReads", func(config *interp.Config) {
+			config.RedisURL = redisURL
+			config.NoFileReads = true
+		}},
+		{`BEGIN { print redis_get("s"); redis_set("s", "x") }`, "hello\n", "can't call redis_set() due to NoFileWrites", func(config *interp.Config) {
+			config.RedisURL = redisURL
+			config.NoFileWrites = true
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			configure := test.configure
+			if configure == nil {
+				configure = func(config *interp.Config) { config.RedisURL = redisURL }
+			}
+			testGoAWK(t, test.src, "", test.out, test.err, nil, configure)
+		})
+	}
+}
+
+// ArrayStore that keeps the elements in memory, for testing.
+type memoryArrayStore struct {
+	elements map[string]string
+	saves    int
+}
+
+func (s *memoryArrayStore) Load(set func(key, value string)) error {
+	for key, value := range s.elements {
+		set(key, value)
+	}
+	return nil
+}
+
+func (s *memoryArrayStore) Save(elements map[string]string) error {
+	s.elements = elements
+	s.saves++
+	return nil
+}
+
+func TestPersistentArrays(t *testing.T) {
+	src := `{ count[$1]++ } $1 == "err" { print 1/0 } END { print count["a"] + 0, count["b"] + 0 }`
+	prog, err := parser.ParseProgram([]byte(src), nil)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	store := &memoryArrayStore{elements: map[string]string{"a": "10"}}
+	stores := map[string]interp.ArrayStore{"count": store, "unused": nil}
+	run := func(input string) (string, error) {
+		var out bytes.Buffer
+		config := &interp.Config{
+			Stdin:            strings.NewReader(input),
+			Output:           &out,
+			PersistentArrays: stores,
+		}
+		_, err := interp.ExecProgram(prog, config)
+		return out.String(), err
+	}
+
+	out, err := run("a\nb\n")
+	if err != nil || out != "11 1\n" {
+		t.Fatalf("expected %q, got %q, %v", "11 1\n", out, err)
+	}
+	out, err = run("b\n")
+	if err != nil || out != "11 2\n" {
+		t.Fatalf("expected %q, got %q, %v", "11 2\n", out, err)
+	}
+	// Not saved if there's an error
+	_, err = run("a\nerr\n")
+	if err == nil {
+		t.Fatalf("expected division by zero error")
+	}
+	expected := map[string]string{"a": "11", "b": "2"}
+	if store.saves != 2 || !reflect.DeepEqual(store.elements, expected) {
+		t.Fatalf("expected 2 saves of %v, got %d of %v", expected, store.saves, store.elements)
+	}
+
+	path := filepath.Join(t.TempDir(), "bad.tsv")
+	err = ioutil.WriteFile(path, []byte("bad\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = interp.ExecProgram(prog, &interp.Config{
+		Stdin:            strings.NewReader(""),
+		Output:           ioutil.Discard,
+		PersistentArrays: map[string]interp.ArrayStore{"count": interp.NewFileArrayStore(path)},
+	})
+	errStr := `can't load persistent array "count": ` + path + ":1: expected tab between key and value"
+	if err == nil || err.Error() != errStr {
+		t.Fatalf("expected error %q, got %v", errStr, err)
+	}
+}
+
+func TestFileArrayStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "array.tsv")
+	store := interp.NewFileArrayStore(path)
+	loaded := map[string]string{}
+	set := func(key, value string) { loaded[key] = value }
+	err := store.Load(set)
+	if err != nil || len(loaded) != 0 {
+		t.Fatalf("expected nothing from missing file, got %v, %v", loaded, err)
+	}
+	elements := map[string]string{"a": "1", "tab\tkey": "new\nline", "x\x1cy": "", "": "\xff"}
+	err = store.Save(elements)
+	if err != nil {
+		t.Fatalf("error saving: %v", err)
+	}
+	err = store.Load(set)
+	if err != nil || !reflect.DeepEqual(loaded, elements) {
+		t.Fatalf("expected %v, got %v, %v", elements, loaded, err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `""` + "\t" + `"\xff"` + "\n" + `"a"` + "\t" + `"1"` + "\n" +
+		`"tab\tkey"` + "\t" + `"new\nline"` + "\n" + `"x\x1cy"` + "\t" + `""` + "\n"
+	if string(b) != expected {
+		t.Fatalf("expected file %q, got %q", expected, b)
+	}
+	if runtime.GOOS != "windows" {
+		// Saving keeps the file's permissions
+		err = os.Chmod(path, 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.Save(elements)
+		if err != nil {
+			t.Fatalf("error saving: %v", err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0640 {
+			t.Fatalf("expected mode 0640 after save, got %v", info.Mode().Perm())
+		}
+	}
+
+	err = ioutil.WriteFile(path, []byte(`"a"`+"\t"+`"1"`+"\n"+`"b" "2"`+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Load(set)
+	if err == nil || err.Error() != path+":2: expected tab between key and value" {
+		t.Fatalf("expected error on line 2, got %v", err)
+	}
+}
+
+func TestDiskArrayStore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "count.db")
+	run := func(src, input string, ordered bool) (string, error) {
+		prog, err := parser.ParseProgram([]byte(src), nil)
+		if err != nil {
+			t.Fatalf("error parsing: %v", err)
+		}
+		var out bytes.Buffer
+		_, err = interp.ExecProgram(prog, &interp.Config{
+			Stdin:            strings.NewReader(input),
+			Output:           &out,
+			OrderedArrays:    ordered,
+			PersistentArrays: map[string]interp.ArrayStore{"a": interp.NewDiskArrayStore(path)},
+		})
+		return out.String(), err
+	}
+	tests := []struct {
+		src     string
+		in      string
+		ordered bool
+		out     string
+		err     string
+	}{
+		{`{ a[$1]++ } END { for (k in a) print k, a[k] }`, "x\ny\nx\n", false, "x 2\ny 1\n", ""},
+		{`{ a[$1]++ } END { for (k in a) print k, a[k]; n = 0; for (k in a) n++; print n }`, "z\nx\n", false, "x 3\ny 1\nz 1\n3\n", ""},
+		// Changes are kept even if the program fails
+		{`{ a[$1] = "str" } END { print 1/0 }`, "y\n", false, "", "division by zero"},
+		{`BEGIN { print a["y"], a["x"] + 1, ("w" in a); delete a["x"]; a["x"] = "back"; a["w"]; delete a["w"] }`, "", false, "str 4 0\n", ""},
+		// Elements are visited in the order they were added
+		{`BEGIN { for (k in a) print k, a[k] }`, "", true, "y str\nz 1\nx back\n", ""},
+		// Values keep their types
+		{`BEGIN { delete a; a["n"] = 10; a["s"] = "10"; a["f"] = 2.5 }`, "", false, "", ""},
+		{`BEGIN { print (a["n"] < 9), (a["s"] < 9), a["f"] * 2; n = 0; for (k in a) n++; print n }`, "", false, "0 1 5\n3\n", ""},
+		// Functions that fill in arrays
+		{`BEGIN { print split("p q r", a), a[3]; match("foobar", /o+/, a); print a[0], a[0, "start"] }`, "", false, "3 r\noo 2\n", ""},
+		{`function f(arr) { arr["fn"] = 1 } BEGIN { f(a); for (k in a) print k }`, "", false, "0\n0\x1clength\n0\x1cstart\nfn\n", ""},
+		// Enough elements and deletes to rebuild the file several times
+		{`BEGIN { delete a; for (i = 0; i < 5000; i++) a["k" i] = i; for (i = 0; i < 4900; i++) delete a["k" i];
+		          for (i = 0; i < 3000; i++) a["s"] = a["s"] "x"; n = c = 0; for (k in a) { n += a[k]; c++ }; print c, n, length(a["s"]) }`,
+			"", false, "101 494950 3000\n", ""},
+		{`BEGIN { c = 0; for (k in a) c++; print c, a["k4999"], length(a["s"]) }`, "", false, "101 4999 3000\n", ""},
+	}
+	for _, test := range tests {
+		out, err := run(test.src, test.in, test.ordered)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("%s: expected error %q, got %v", test.src, test.err, err)
+			}
+			continue
+		}
+		if err != nil || out != test.out {
+			t.Fatalf("%s: expected %q, got %q, %v", test.src, test.out, out, err)
+		}
+	}
+
+	// Load and Save, and repairing a file that wasn't closed
+	store := interp.NewDiskArrayStore(filepath.Join(dir, "store.db"))
+	elements := map[string]string{"a": "1", "tab\tkey": "new\nline", "": "\xff"}
+	err := store.Save(elements)
+	if err != nil {
+		t.Fatalf("error saving: %v", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[32] = 1                         // mark it dirty
+	b = append(b, 1, 100, 0, 0, 0, 7) // incomplete entry
+	err = ioutil.WriteFile(filepath.Join(dir, "store.db"), b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := map[string]string{}
+	err = store.Load(func(key, value string) { loaded[key] = value })
+	if err != nil || !reflect.DeepEqual(loaded, elements) {
+		t.Fatalf("expected %v, got %v, %v", elements, loaded, err)
+	}
+
+	err = ioutil.WriteFile(path, []byte("not a disk array\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = run(`BEGIN { a[1] }`, "", false)
+	errStr := `can't load persistent array "a": ` + path + " isn't a disk array file"
+	if err == nil || err.Error() != errStr {
+		t.Fatalf("expected error %q, got %v", errStr, err)
+	}
+}
+
+// Variables inferred to be numeric can still be set to strings from
+// outside the program, so numeric comparisons must fall back to the
+// general rules.
+func TestNumericComparisonFallback(t *testing.T) {
+	src := `BEGIN { x = 1; if (x < 10) print "lt"; else print "ge"; print (x == 1) } { x = 2 }`
+	tests := []struct {
+		vars []string
+		args []string
+		out  string
+	}{
+		{nil, nil, "lt\n1\n"},
+		{[]string{"x", "5"}, nil, "lt\n1\n"},
+		{nil, []string{"x=abc"}, "lt\n1\n"},
+		{[]string{"x", "abc"}, nil, "lt\n1\n"},
+	}
+	for _, test := range tests {
+		testGoAWK(t, src, "", test.out, "", nil, func(config *interp.Config) {
+			config.Vars = test.vars
+			config.Args = test.args
+		})
+	}
+
+	src = `BEGIN { if (x < 10) print "lt"; else print "ge"; for (i = 0; i < x && i < 100; i++) n++; print n+0 } END { x = 0 }`
+	tests = []struct {
+		vars []string
+		args []string
+		out  string
+	}{
+		{nil, nil, "lt\n0\n"},
+		{[]string{"x", "3"}, nil, "lt\n3\n"},
+		{[]string{"x", "abc"}, nil, "ge\n100\n"},
+		{[]string{"x", "20"}, nil, "ge\n20\n"},
+		{[]string{"x", " 2 "}, nil, "lt\n2\n"},
+	}
+	for _, test := range tests {
+		testGoAWK(t, src, "", test.out, "", nil, func(config *interp.Config) {
+			config.Vars = test.vars
+			config.Args = test.args
+		})
+	}
+}
+
+func TestConfigVarsCorrect(t *testing.T) {
+	prog, err := parser.ParseProgram([]byte(`BEGIN { print x }`), nil)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	config := &interp.Config{
+		Stdin:  strings.NewReader(""),
+		Output: &bytes.Buffer{},
+		Error:  ioutil.Discard,
+		Vars:   []string{"FS"},
+	}
+	_, err = interp.ExecProgram(prog, config)
+	expected := "length of config.Vars must be a multiple of 2, not 1"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected error %q, got: %v", expected, err)
+	}
+}
+
+func TestNoFieldSplit(t *testing.T) {
+	tests := []struct {
+		src string
+		in  string
+		out string
+	}{
+		{`{ print NF, $1 "|" $2 }`, "a b c\n\n d ", "1 a b c|\n0 |\n1  d |\n"},
+		{`BEGIN { FS="," } { print NF, $1 }`, "a,b", "1 a,b\n"},
+		{`BEGIN { RS="" } { print NF, $1 }`, "a b\nc\n\nd", "1 a b\nc\n1 d\n"},
+		{`{ $3 = "x"; print; print NF }`, "a b", "a b  x\n3\n"},
+		{`{ NF = 2; print }`, "a b", "a b \n"},
+		{`{ print $1 }`, "a b\nc", "a b\nc\n"},
+		{`/b/ { print $1 }`, "a b\nc", "a b\n"},
+	}
+	for _, test := range tests {
+		testGoAWK(t, test.src, test.in, test.out, "", nil, func(config *interp.Config) {
+			config.NoFieldSplit = true
+		})
+	}
+}
+
+func TestColor(t *testing.T) {
+	tests := []struct {
+		src string
+		in  string
+		out string
+	}{
+		{`/o+/`, "foo boo\nbar", "f\x1b[1;31moo\x1b[0m b\x1b[1;31moo\x1b[0m\n"},
+		{`/fo/ || /x/`, "fox\n", "\x1b[1;31mfo\x1b[0mx\n"},  // /x/ isn't tested
+		{`/fo/ && /ox/`, "fox\n", "\x1b[1;31mfox\x1b[0m\n"}, // matches merged
+		{`/b/ { print $2, NR }`, "a b c\nb", "\x1b[1;31mb\x1b[0m 1\n 2\n"},
+		{`/b/ { print $3, $2 }`, "a b c\nb", "c \x1b[1;31mb\x1b[0m\n \n"},
+		{"NR == 1 && /a/\nNR == 2", "a\na", "\x1b[1;31ma\x1b[0m\na\n"}, // reset each record
+		{`{ print }`, "abc", "abc\n"},
+		{`$0 ~ "b"`, "abc", "abc\n"}, // only /regex/ tests
+	}
+	for _, test := range tests {
+		testGoAWK(t, test.src, test.in, test.out, "", nil, func(config *interp.Config) {
+			config.Color = true
+		})
+	}
+}
+
+func TestNumberParser(t *testing.T) {
+	// Accept Fortran D exponents and comma decimals
+	replacer := strings.NewReplacer("D", "e", "d", "e", ",", ".")
+	parseNumber := func(s string) (float64, bool) {
+		f, err := strconv.ParseFloat(replacer.Replace(strings.TrimSpace(s)), 64)
+		return f, err == nil
+	}
+	tests := []struct {
+		src string
+		in  string
+		out string
+	}{
+		{`{ print $1, $1+0, ($1 > 100), ($1 == 1500), ($1 == "1.5D+03") }`, "1.5D+03\n3,25\nfoo\n12", "1.5D+03 1500 1 1 1\n3,25 3.25 0 0 0\nfoo 0 1 0 0\n12 12 0 0 0\n"},
+		{`{ for (i=1; i<=NF; i++) s += $i }  END { print s }`, "1,5 2D1\n0,25", "21.75\n"},
+		{`{ s = 0; for (i=1; i<=NF; i++) s += $i; print s }`, "1,5 2D1", "21.5\n"},
+		{`{ $2 = "2,5"; print $1 + $2, $0 + 0 }`, "1,5 x", "3.5 1\n"},
+		{`{ n = split($0, a, ";"); print a[1] * 2, (a[2] < 10) }`, "1,5;1D1", "3 0\n"},
+		{`{ getline x; print $1 * x }`, "2,5\n1D1", "25\n"},
+		{`BEGIN { print v * 2, (v == 20) }`, "", "40 1\n"},
+		{`!$1 { print "zero" }`, "0,0\n1,0", "zero\n"},
+	}
+	for _, test := range tests {
+		testGoAWK(t, test.src, test.in, test.out, "", nil, func(config *interp.Config) {
+			config.NumberParser = parseNumber
+			config.Vars = []string{"v", "2D1"}
+		})
+	}
+
+	// A FilteringSource can't know how fields are converted
+	prog, err := parser.ParseProgram([]byte(`$1 > 1`), nil)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	source := &testSource{lines: []string{"1,5", "0,5"}}
+	outBuf := &bytes.Buffer{}
+	_, err = interp.ExecProgram(prog, &interp.Config{
+		Output:       outBuf,
+		Source:       source,
+		NumberParser: parseNumber,
+	})
+	if err != nil {
+		t.Fatalf("error interpreting: %v", err)
+	}
+	if source.preds != nil {
+		t.Errorf("expected no predicates, got %v", source.preds)
+	}
+	if outBuf.String() != "1,5\n" {
+		t.Errorf("expected %q, got %q", "1,5\n", outBuf.String())
+	}
+}
+
+func TestParseNonDecimal(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"0x1A", "26"},
+		{" -0XfF ", "-255"},
+		{"+0o17", "15"},
+		{"0O777", "511"},
+		{"0xffffffffffffffffff", "18446744073709552000"}, // maximum uint64
+		{"0x", "false"},
+		{"0x1G", "false"},
+		{"0o8", "false"},
+		{"0x_1", "false"},
+		{"017", "false"},
+		{"12", "false"},
+		{"abc", "false"},
+	}
+	for _, test := range tests {
+		n, ok := interp.ParseNonDecimal(test.in)
+		out := "false"
+		if ok {
+			out = strconv.FormatFloat(n, 'f', -1, 64)
+		}
+		if out != test.out {
+			t.Errorf("%q: expected %s, got %s", test.in, test.out, out)
+		}
+	}
+
+	src := `{ print $1 + 1, ($1 > 9), $1 }`
+	testGoAWK(t, src, "0x10\n0o7\n8", "17 1 0x10\n8 0 0o7\n9 0 8\n", "", nil, func(config *interp.Config) {
+		config.NumberParser = interp.ParseNonDecimal
+	})
+}
+
+func TestParsePOSIXNumber(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"12", "12"},
+		{" -1.5e3 ", "-1500"},
+		{".5", "0.5"},
+		{"0x1A", "26"},
+		{"-0X1.8p1", "-3"},
+		{"0xffP-4", "15.9375"},
+		{"inf", "+Inf"},
+		{"-Infinity", "-Inf"},
+		{"+NaN", "NaN"},
+		{"1e999", "+Inf"},
+		{"0x", "false"},
+		{"0x1G", "false"},
+		{"0x_1", "false"},
+		{"1_000", "false"},
+		{"1e", "false"},
+		{"--1", "false"},
+		{"infx", "false"},
+		{"", "false"},
+		{"abc", "false"},
+	}
+	for _, test := range tests {
+		n, ok := interp.ParsePOSIXNumber(test.in)
+		out := "false"
+		if ok {
+			out = strconv.FormatFloat(n, 'f', -1, 64)
+		}
+		if out != test.out {
+			t.Errorf("%q: expected %s, got %s", test.in, test.out, out)
+		}
+	}
+
+	// The "10" < "9" cases compare as numbers in both modes; they're
+	// only strings if they don't come from input
+	src := `{ print $1+0, ($1 < $2), ($2 < $3), (substr($2, 1) < "9") }`
+	input := "0x1A 10 9\n0x8 10 9\n"
+	testGoAWK(t, src, input, "0 1 0 1\n0 1 0 1\n", "", nil, nil)
+	testGoAWK(t, src, input, "26 0 0 1\n8 1 0 1\n", "", nil, func(config *interp.Config) {
+		config.NumberParser = interp.ParsePOSIXNumber
+	})
+	testGoAWK(t, `BEGIN { print (x < y), x+0 }`, "", "0 26\n", "", nil, func(config *interp.Config) {
+		config.Vars = []string{"x", "0x1A", "y", "9"}
+		config.NumberParser = interp.ParsePOSIXNumber
+	})
+}
+
+func TestGCSettings(t *testing.T) {
+	old := debug.SetGCPercent(150)
+	defer debug.SetGCPercent(old)
+
+	src := `{ a[$1] = $2 } END { for (k in a) n++; print n }`
+	testGoAWK(t, src, "a 1\nb 2\na 3", "2\n", "", nil, func(config *interp.Config) {
+		config.GCPercent = 400
+		config.MemoryLimit = 1 << 30
+		config.GCBallast = 1 << 20
+	})
+	if percent := debug.SetGCPercent(150); percent != 150 {
+		t.Fatalf("expected GC percent to be restored to 150, got %d", percent)
+	}
+
+	testGoAWK(t, src, "", "", "config.MemoryLimit and config.GCBallast must not be negative", nil, func(config *interp.Config) {
+		config.GCBallast = -1
+	})
+}
+
+func TestPrefetchFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goawk-prefetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var big strings.Builder
+	for i := 0; i < 200000; i++ {
+		fmt.Fprintf(&big, "line %d\n", i)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("g1\ng2\n"))
+	zw.Close()
+	files := map[string]string{"a": "a1\na2\n", "b": "b1\n", "c": "c1\n", "big": big.String(),
+		"gz": gz.String(), "badgz": "\x1f\x8bxyz"}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		src  string
+		args []string
+		out  string
+		err  string
+	}{
+		{`{ print FILENAME, $0 }`, []string{"a", "b", "c"}, "a a1\na a2\nb b1\nc c1\n", ""},
+		{`{ n++ } END { print n, $0 }`, []string{"big", "a", "big"}, "400002 line 199999\n", ""},
+		{`FNR == 1 && FILENAME == "a" { ARGV[2] = "c" } { print $0 }`, []string{"a", "b"}, "a1\na2\nc1\n", ""},
+		{`{ print x, $0 }`, []string{"a", "x=1", "b"}, " a1\n a2\n1 b1\n", ""},
+		{`FILENAME == "a" { print "new" >"b"; close("b") } { print $0 }`, []string{"a", "b"}, "a1\na2\nnew\n", ""},
+		{`NR == 1 { printf "" >"out" } { print $0 }`, []string{"a", "c"}, "a1\na2\nc1\n", ""},
+		{`{ print $0 }`, []string{"a", "missing"}, "a1\na2\n", "open missing: no such file or directory"},
+		{`NR == 1 { exit } END { print $0 }`, []string{"a", "big"}, "a1\n", ""},
+		{`{ print FILENAME, $0 }`, []string{"gz", "a", "gz"}, "gz g1\ngz g2\na a1\na a2\ngz g1\ngz g2\n", ""},
+		{`{ print $0 }`, []string{"badgz"}, "", "error reading from input: unexpected EOF"},
+		{`{ print $0 }`, []string{"a", "badgz"}, "a1\na2\n", "error reading from input: unexpected EOF"},
+	}
+	for _, test := range tests {
+		// Rewrite b each time, as one test changes it
+		err := ioutil.WriteFile(filepath.Join(dir, "b"), []byte(files["b"]), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(test.src, func(t *testing.T) {
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Chdir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chdir(wd)
+
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			config := &interp.Config{
+				Args:          test.args,
+				Output:        &out,
+				PrefetchFiles: true,
+			}
+			_, err = interp.ExecProgram(prog, config)
+			errStr := ""
+			if err != nil {
+				errStr = err.Error()
+			}
+			if errStr != test.err {
+				t.Fatalf("expected error %q, got %q", test.err, errStr)
+			}
+			if out.String() != test.out {
+				t.Fatalf("expected %q, got %q", test.out, out.String())
+			}
+		})
+	}
+}
+
+func TestMmapFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a":      "a1\na2\n",
+		"crlf":   "c1\r\nc2\r\n",
+		"noeol":  "n1\nn2",
+		"empty":  "",
+		"para":   "\n\np1\np2\n\n\nq1\n",
+		"fields": "x,y,z",
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		src   string
+		args  []string
+		stdin string
+		out   string
+		err   string
+	}{
+		{`{ print FILENAME, FNR, $0 }`, []string{"a", "noeol"}, "", "a 1 a1\na 2 a2\nnoeol 1 n1\nnoeol 2 n2\n", ""},
+		{`{ print $0 "|" }`, []string{"crlf"}, "", "c1|\nc2|\n", ""},
+		{`{ n++ } END { print n+0 }`, []string{"empty", "empty"}, "", "0\n", ""},
+		{`BEGIN { RS = "" } { print NR ": " $1 "," $2 }`, []string{"para"}, "", "1: p1,p2\n2: q1,\n", ""},
+		{`BEGIN { RS = "," } { print $0 }`, []string{"fields"}, "", "x\ny\nz\n", ""},
+		{`BEGIN { RS = "[,y]+" } { print $0, RT }`, []string{"fields"}, "", "x ,y,\nz \n", ""},
+		{`{ print FILENAME ":" $0 }`, []string{"a", "-"}, "s1\n", "a:a1\na:a2\n:s1\n", ""},
+		{`{ getline x <"noeol"; print $0, x }`, []string{"a"}, "", "a1 n1\na2 n2\n", ""},
+		{`{ print $0 }`, []string{"a", "missing"}, "", "a1\na2\n", "open missing: no such file or directory"},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Chdir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chdir(wd)
+
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			config := &interp.Config{
+				Args:      test.args,
+				Stdin:     strings.NewReader(test.stdin),
+				Output:    &out,
+				MmapFiles: true,
+			}
+			_, err = interp.ExecProgram(prog, config)
+			errStr := ""
+			if err != nil {
+				errStr = err.Error()
+			}
+			if errStr != test.err {
+				t.Fatalf("expected error %q, got %q", test.err, errStr)
+			}
+			if out.String() != test.out {
+				t.Fatalf("expected %q, got %q", test.out, out.String())
+			}
+		})
+	}
+}
+
+func TestLongRecords(t *testing.T) {
+	// Records longer than any fixed scanner buffer limit
+	long := strings.Repeat("x", 12*1024*1024)
+	tests := []struct {
+		src string
+		in  string
+		out string
+	}{
+		{`{ print length(), NF, NR }`, long + " y\nab\r\n" + long, "12582914 2 1\n2 1 2\n12582912 1 3\n"},
+		{`BEGIN { RS = ";" } { print length() }`, "a;" + long + ";b", "1\n12582912\n1\n"},
+		{`BEGIN { RS = "" } { print length($1), length($2), NF }`, "\n\n" + long + "\n" + long + "\n\n\nz\n", "12582912 12582912 2\n1 0 1\n"},
+		{`BEGIN { RS = "-+" } { print length(), RT }`, long + "---a", "12582912 ---\n1 \n"},
+		{`{ getline x; print length($0), length(x) }`, long + "\n" + long + "\n", "12582912 12582912\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			testGoAWK(t, test.src, "", test.out, "", nil, func(config *interp.Config) {
+				// Deliver the input in reads of varying sizes
+				config.Stdin = iotest.HalfReader(strings.NewReader(test.in))
+			})
+		})
+	}
+}
+
+func TestPipelineInput(t *testing.T) {
+	dir := t.TempDir()
+	var big strings.Builder
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&big, "line %d\n", i)
+	}
+	files := map[string]string{
+		"a":    "a1\na2\n",
+		"b":    "b1 b2,b3;b4",
+		"para": "\n\np1\np2\n\n\nq1\n",
+		"big":  big.String(),
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		src   string
+		args  []string
+		stdin string
+		out   string
+		err   string
+	}{
+		{`{ print FILENAME, NR, FNR, $0 }`, []string{"a", "b"}, "", "a 1 1 a1\na 2 2 a2\nb 3 1 b1 b2,b3;b4\n", ""},
+		{`{ n++; s += $2 } END { print n, s, $0 }`, []string{"big", "a", "big"}, "", "200002 9999900000 line 99999\n", ""},
+		{`NR % 1000 == 1 { getline; getline x; n++ } END { print n, NR, $0, x }`, []string{"big"}, "", "100 100000 line 99999 line 99002\n", ""},
+		{`BEGIN { RS = "" } { print NR ": " $1 "," $2 }`, []string{"para"}, "", "1: p1,p2\n2: q1,\n", ""},
+		{`BEGIN { RS = "[,;]" } { print $0 "|" RT }`, []string{"b"}, "", "b1 b2|,\nb3|;\nb4|\n", ""},
+		{`{ getline x <"a"; print $0, x }`, []string{"b", "a"}, "", "b1 b2,b3;b4 a1\na1 a2\na2 a2\n", ""},
+		{`NR == 150000 { print; exit } END { print NR }`, []string{"big", "big"}, "", "line 49999\n150000\n", ""},
+		{`{ print x, $0 }`, []string{"a", "x=1", "-"}, "s1\n", " a1\n a2\n1 s1\n", ""},
+		{`NR == 1 { print "x" >"out"; close("out"); getline y <"out"; print y }`, []string{"a"}, "", "x\n", ""},
+		{`{ print $0 }`, []string{"a", "missing"}, "", "a1\na2\n", "open missing: no such file or directory"},
+	}
+	for _, test := range tests {
+		for _, mmap := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s_mmap=%v", test.src, mmap), func(t *testing.T) {
+				wd, err := os.Getwd()
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.Chdir(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.Chdir(wd)
+
+				prog, err := parser.ParseProgram([]byte(test.src), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var out bytes.Buffer
+				config := &interp.Config{
+					Args:          test.args,
+					Stdin:         strings.NewReader(test.stdin),
+					Output:        &out,
+					PipelineInput: true,
+					MmapFiles:     mmap,
+				}
+				_, err = interp.ExecProgram(prog, config)
+				errStr := ""
+				if err != nil {
+					errStr = err.Error()
+				}
+				if errStr != test.err {
+					t.Fatalf("expected error %q, got %q", test.err, errStr)
+				}
+				if out.String() != test.out {
+					t.Fatalf("expected %q, got %q", test.out, out.String())
+				}
+			})
+		}
+	}
+}
+
+// Reading a low field splits a record lazily, but NF and $NF still
+// need the whole record, even when it has more fields than the largest
+// field index that can be assigned.
+func TestWideRecord(t *testing.T) {
+	in := strings.Repeat("x ", 1000004) + "y"
+	testGoAWK(t, `{ x = $1; print NF, $NF }`, in, "1000005 y\n", "", nil, nil)
+	testGoAWK(t, `BEGIN { FS = "," } { x = $1; print NF, $NF }`, strings.Replace(in, " ", ",", -1), "1000005 y\n", "", nil, nil)
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		src    string
+		in     string
+		out    string
+		err    string
+		config interp.Config
+	}{
+		{`BEGIN { $10 = "x"; print NF; NF = 12 }`, "", "10\n", "NF set too large: 12", interp.Config{MaxFieldIndex: 10}},
+		{`BEGIN { $11 = "x" }`, "", "", "field index too large: 11", interp.Config{MaxFieldIndex: 10}},
+		{`BEGIN { $1500000 = "x"; print NF }`, "", "1500000\n", "", interp.Config{MaxFieldIndex: 2000000}},
+		{`{ print $12, NF }`, "1 2 3 4 5 6 7 8 9 10 11 12", "12 12\n", "", interp.Config{MaxFieldIndex: 10}},
+		{`{ x = $1; print NF, $NF }`, "a b c d e f", "6 f\n", "", interp.Config{MaxFieldIndex: 2}},
+		{`BEGIN { FS = "," } { x = $1; print NF, $NF }`, "a,b,c,d", "4 d\n", "", interp.Config{MaxFieldIndex: 2}},
+		{`function f(n) { return n ? f(n-1) + 1 : 0 }  BEGIN { print f(5); print f(6) }`, "", "5\n",
+			`calling "f" exceeded maximum call depth of 6`, interp.Config{MaxCallDepth: 6}},
+		{`function f(n) { return n ? f(n-1) + 1 : 0 }  BEGIN { print f(5000) }`, "", "5000\n", "", interp.Config{MaxCallDepth: 10000}},
+		{`BEGIN { for (i = 0; i < 10; i++) { n += "a" i ~ ("^a" i%3); s = s sprintf("%" i%3+1 "d", i) } print n, s }`, "",
+			"3 0 1  23 4  56 7  89\n", "", interp.Config{RegexCacheSize: 1, FormatCacheSize: 1}},
+		{`{ print length(), $2 }`, "abcdefghij klm\r\nxy z\n", "14 klm\n4 z\n", "", interp.Config{InputBufferSize: 3}},
+		{`BEGIN { RS = "" } { print NF }`, "a b c\n\nd e\n", "3\n2\n", "", interp.Config{InputBufferSize: 1}},
+		{`BEGIN {}`, "", "", "config buffer sizes and limits must not be negative", interp.Config{MaxCallDepth: -1}},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			testGoAWK(t, test.src, test.in, test.out, test.err, nil, func(config *interp.Config) {
+				config.MaxFieldIndex = test.config.MaxFieldIndex
+				config.MaxCallDepth = test.config.MaxCallDepth
+				config.RegexCacheSize = test.config.RegexCacheSize
+				config.FormatCacheSize = test.config.FormatCacheSize
+				config.InputBufferSize = test.config.InputBufferSize
+			})
+		})
+	}
+}
+
+func TestOutputBuffering(t *testing.T) {
+	// Output to "out" is read back as "./out", a different stream, so
+	// reading it doesn't flush or close the output
+	tests := []struct {
+		name   string
+		src    string
+		config func(*interp.Config)
+		out    string
+	}{
+		{"default", `BEGIN { print "x" >"out"; print ((getline line <"./out") > 0) }`,
+			func(config *interp.Config) {}, "0\n"},
+		{"small buffer", `BEGIN { print "abc" >"out"; print "defgh" >"out"; getline line <"./out"; print line }`,
+			func(config *interp.Config) { config.OutputBufferSize = 4 }, "abc\n"},
+		{"line buffered", `BEGIN { printf "x" >"out"; print ((getline line <"./out") > 0); close("./out");
+			print "y" >"out"; getline line <"./out"; print line }`,
+			func(config *interp.Config) { config.OutputLineBuffered = true }, "0\nxy\n"},
+		{"flush interval", `BEGIN { print "x" >"out"; for (i = 0; i < 100000 && !found; i++) {
+			found = (getline line <"./out") > 0; close("./out") } print found, line }`,
+			func(config *interp.Config) { config.OutputFlushInterval = time.Millisecond }, "1 x\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Chdir(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chdir(wd)
+			testGoAWK(t, test.src, "", test.out, "", nil, test.config)
+		})
+	}
+}
+
+func TestNoFieldReuse(t *testing.T) {
+	tests := []struct {
+		src string
+		in  string
+		out string
+	}{
+		{`{ print NF, $1, $NF }`, "a b c\n\n d \ne", "3 a c\n0  \n1 d d\n1 e e\n"},
+		{`BEGIN { FS="," } { print NF, $2 }`, "a,b,c\nd\n,", "3 b\n1 \n2 \n"},
+		{`{ $5 = "x"; print; print NF }`, "a b\nc d e f g h", "a b   x\n5\nc d e f x h\n6\n"},
+		{`NR == 1 { NF = 1 } { print NF, $2 }`, "a b\nc d", "1 \n2 d\n"},
+		{`{ print $2 + 1 }`, " 1 2 \n3", "3\n1\n"},
+	}
+	for _, test := range tests {
+		for _, noReuse := range []bool{false, true} {
+			testGoAWK(t, test.src, test.in, test.out, "", nil, func(config *interp.Config) {
+				config.NoFieldReuse = noReuse
+			})
+		}
+	}
+}
+
+func TestSetenv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses POSIX shell syntax")
+	}
+	tests := []struct {
+		src     string
+		environ []string
+		out     string
+		err     string
+	}{
+		{`BEGIN { print setenv("TZ", "UTC"), ENVIRON["TZ"]; system("echo $TZ"); "echo $TZ" | getline v; print v }`, nil, "0 UTC\nUTC\nUTC\n", ""},
+		{`BEGIN { system("echo [$A] [$B]"); setenv("B", 2); system("echo [$A] [$B]"); unsetenv("A"); print ("A" in ENVIRON); system("echo [$A] [$B]") }`,
+			[]string{"A", "1"}, "[] []\n[1] [2]\n0\n[] [2]\n", ""},
+		{`{ setenv("REC", $1); system("echo $REC") }`, []string{}, "x\ny\n", ""},
+		{`BEGIN { setenv("A=B", 1) }`, nil, "", `invalid environment variable name "A=B"`},
+		{`BEGIN { unsetenv("") }`, nil, "", `invalid environment variable name ""`},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			testGoAWK(t, test.src, "x\ny\n", test.out, test.err, nil, func(config *interp.Config) {
+				config.Environ = test.environ
+			})
+		})
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	testGoAWK(t, `BEGIN { system("echo hello world") }`, "", "hello world\n", "", nil, nil)
+
+	if runtime.GOOS == "windows" {
+		testGoAWK(t, `BEGIN { system("echo hello world") }`, "", "hello world\n", "", nil,
+			func(config *interp.Config) {
+				config.ShellCommand = []string{"cmd.exe", "/c"}
+			})
+	} else {
+		testGoAWK(t, `BEGIN { system("world") }`, "", "hello world\n", "", nil,
+			func(config *interp.Config) {
+				config.ShellCommand = []string{"/bin/echo", "hello"}
+			})
+		testGoAWK(t, `BEGIN { "world" | getline; print }`, "", "hello world\n", "", nil,
+			func(config *interp.Config) {
+				config.ShellCommand = []string{"/bin/echo", "hello"}
+			})
+		testGoAWK(t, `BEGIN { print "hello world" | "-" }`, "", "hello world\n", "", nil,
+			func(config *interp.Config) {
+				config.ShellCommand = []string{"/bin/cat"}
+			})
+		testGoAWK(t, `BEGIN { print system("echo hi") }`, "", "exec: \"foobar3982\": executable file not found in $PATH\n-1\n", "", nil,
+			func(config *interp.Config) {
+				config.ShellCommand = []string{"foobar3982"}
+			})
+	}
+}
+
+func TestSystemCommandNotFound(t *testing.T) {
+	prog, err := parser.ParseProgram([]byte(`BEGIN { print system("foobar3982") }`), nil)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	outBuf := &concurrentBuffer{}
+	config := &interp.Config{
+		Output: outBuf,
+		Error:  outBuf,
+	}
+	_, err = interp.ExecProgram(prog, config)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	got := outBuf.buffer.String()
+	if !strings.Contains(got, "foobar3982") || !strings.Contains(got, "not found") {
+		t.Fatalf(`expected output to contain "foobar3982" and "not found", got %q`, got)
+	}
+}
+
+func TestErrorPosition(t *testing.T) {
+	tests := []struct {
+		src  string
+		err  string
+		line int
+		col  int
+	}{
+		{"BEGIN {\n  x = 1\n  y = x / 0\n}", "division by zero", 3, 3},
+		{"$(NF-3) == 1", "field index negative: -1", 1, 1},
+		{"NR == 1, $(NF-3) == 1", "field index negative: -1", 1, 10},
+		{"{ print }\n{ n++; print $(n-2) }", "field index negative: -1", 2, 8},
+		{"function f(i) {\n\treturn $i\n}\nEND { f(-1) }", "field index negative: -1", 2, 2},
+		{"END { a[1]; for (k in a) {\n  print x % 0 } }", "division by zero in mod", 2, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatalf("error parsing: %v", err)
+			}
+			config := &interp.Config{
+				Stdin:  strings.NewReader("a b\n"),
+				Output: ioutil.Discard,
+			}
+			_, err = interp.ExecProgram(prog, config)
+			e, ok := err.(*interp.Error)
+			if !ok || e.Error() != test.err {
+				t.Fatalf("expected *interp.Error %q, got %v", test.err, err)
+			}
+			if e.Position.Line != test.line || e.Position.Column != test.col {
+				t.Fatalf("expected position %d:%d, got %d:%d",
+					test.line, test.col, e.Position.Line, e.Position.Column)
+			}
+		})
+	}
+
+	// Errors that don't come from executing the program have no position
+	prog, err := parser.ParseProgram([]byte(`BEGIN {}`), nil)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	_, err = interp.ExecProgram(prog, &interp.Config{Vars: []string{"x"}})
+	e, ok := err.(*interp.Error)
+	if !ok || e.Position.Line != 0 {
+		t.Fatalf("expected *interp.Error without position, got %v", err)
+	}
+}
+
+type mockFlusher struct {
+	bytes.Buffer
+	flushes []string
+}
+
+func (f *mockFlusher) Flush() error {
+	f.flushes = append(f.flushes, normalizeNewlines(f.String()))
+	return nil
+}
+
+func TestFlushes(t *testing.T) {
+	src := `
+BEGIN {
+	print fflush()
+	print "x"
+	print "y"
+	print fflush()
+	print "z"
+	print fflush("")
+}`
+	f := &mockFlusher{}
+	testGoAWK(t, src, "", "", "", nil, func(config *interp.Config) {
+		config.Output = f
+	})
+	// The last one is from GoAWK itself flushing output after finishing
+	expected := []string{"", "0\nx\ny\n", "0\nx\ny\n0\nz\n", "0\nx\ny\n0\nz\n0\n"}
+	if !reflect.DeepEqual(f.flushes, expected) {
+		t.Fatalf("expected flushes %q, got %q", expected, f.flushes)
+	}
+
+	// Ensure output is flushed before getline reads from stdin
+	src = `
+BEGIN {
+	printf "Prompt: "
+	getline x
+	print x
+}`
+	f = &mockFlusher{}
+	testGoAWK(t, src, "42\n", "", "", nil, func(config *interp.Config) {
+		config.Output = f
+	})
+	expected = []string{"Prompt: ", "Prompt: 42\n"}
+	if !reflect.DeepEqual(f.flushes, expected) {
+		t.Fatalf("expected flushes %q, got %q", expected, f.flushes)
+	}
+
+	// Ensure output is flushed before system()
+	src = `
+BEGIN {
+  print "one"
+  system("echo .")
+  print "two"
+}`
+	f = &mockFlusher{}
+	testGoAWK(t, src, "", "", "", nil, func(config *interp.Config) {
+		config.Output = f
+	})
+	expected = []string{"one\n", "one\n.\ntwo\n"}
+	if !reflect.DeepEqual(f.flushes, expected) {
+		t.Fatalf("expected flushes %q, got %q", expected, f.flushes)
+	}
+}
+
+type errorFlusher struct {
+	bytes.Buffer
+}
+
+func (f *errorFlusher) Flush() error {
+	return errors.New("that's not good, hackers")
+}
+
+func TestFlushError(t *testing.T) {
+	f := &errorFlusher{}
+	testGoAWK(t, `BEGIN { fflush() }`, "", "", "", nil, func(config *interp.Config) {
+		config.Output = f
+		config.Error = f
+	})
+	expected := "error flushing \"stdout\": that's not good, hackers\n"
+	if f.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, f.String())
+	}
+}
+
+type mockWriter struct {
+	writes []string
+}
+
+func (w *mockWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestPrintWrites(t *testing.T) {
+	// Each print should be a single Write call on an unbuffered writer
+	src := `BEGIN { OFS="-"; ORS="|" } { print; print $2, 42, 1.5, $1; print $2, $1 }`
+	w := &mockWriter{}
+	testGoAWK(t, src, "a b\nc d", "", "", nil, func(config *interp.Config) {
+		config.Output = w
+	})
+	expected := []string{"a b|", "b-42-1.5-a|", "b-a|", "c d|", "d-42-1.5-c|", "d-c|"}
+	if !reflect.DeepEqual(w.writes, expected) {
+		t.Fatalf("expected writes %q, got %q", expected, w.writes)
+	}
+}
+
+func TestEnviron(t *testing.T) {
+	os.Setenv("GOAWK_TEN", "10") // to test that ENVIRON[x] is numeric string
+	src := `
+BEGIN {
+	n = 0
+	for (k in ENVIRON)
+		n++
+	print(n, ENVIRON["USER"], ENVIRON["GOAWK_TEN"] < 2)
+}`
+	expected := fmt.Sprintf("%d %s 0\n", len(os.Environ()), os.Getenv("USER"))
+	testGoAWK(t, src, "", expected, "", nil, nil)
+
+	expected = "2 bob 0\n"
+	testGoAWK(t, src, "", expected, "", nil, func(config *interp.Config) {
+		config.Environ = []string{"USER", "bob", "GOAWK_TEN", "10"}
+	})
+
+	expected = "0  1\n"
+	testGoAWK(t, src, "", expected, "", nil, func(config *interp.Config) {
+		config.Environ = []string{}
+	})
+
+	testGoAWK(t, src, "", "", "length of config.Environ must be a multiple of 2, not 3", nil, func(config *interp.Config) {
+		config.Environ = []string{"b", "a", "d"}
+	})
+}
+
+func TestLocale(t *testing.T) {
+	turkish := &interp.Locale{
+		Name:         "tr_TR",
+		ToUpper:      func(s string) string { return strings.ToUpperSpecial(unicode.TurkishCase, s) },
+		ToLower:      func(s string) string { return strings.ToLowerSpecial(unicode.TurkishCase, s) },
+		Collate:      func(a, b string) int { return strings.Compare(strings.ToLower(a), strings.ToLower(b)) },
+		DecimalPoint: ",",
+	}
+	src := `BEGIN { print toupper("ix"), tolower("IX"); printf "%.2f %5.1f %d %s|", 3.14159, 2.5, 42, 1.5; a["b"]; a["A"]; a["C"]; dumparr(a) }`
+
+	testGoAWK(t, src, "", "IX ix\n3.14   2.5 42 1.5|A\t\nC\t\nb\t\n", "", nil, nil)
+	testGoAWK(t, src, "", "İX ıx\n3,14   2,5 42 1.5|A\t\nb\t\nC\t\n", "", nil, func(config *interp.Config) {
+		config.Locale = turkish
+	})
+
+	testGoAWK(t, src, "", "", "Locale.DayNames must have 7 elements, not 1", nil, func(config *interp.Config) {
+		config.Locale = &interp.Locale{DayNames: []string{"Sunday"}}
+	})
+}
+
+func TestErrno(t *testing.T) {
+	dir := t.TempDir()
+	exists := filepath.Join(dir, "exists")
+	err := ioutil.WriteFile(exists, []byte("a\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := `
+BEGIN {
+	print (getline x < missing), ERRNO
+	print (getline x < dir), ERRNO
+	ERRNO = ""
+	print (getline x < exists), x, "[" ERRNO "]"
+	print (getline x < exists), "[" ERRNO "]"
+	print close(exists), "[" ERRNO "]"
+	print close(exists), ERRNO
+}
+`
+	expected := "-1 no such file or directory\n-1 is a directory\n1 a []\n0 []\n0 []\n-1 close of redirection that was never opened\n"
+	testGoAWK(t, src, "", expected, "", nil, func(config *interp.Config) {
+		config.Vars = []string{"missing", filepath.Join(dir, "missing"), "dir", dir, "exists", exists}
+	})
+}
+
+func TestOrderedArrays(t *testing.T) {
+	tests := []struct {
+		src string
+		out string
+	}{
+		{`BEGIN { a["z"]; a[3]; a["b"]; a[1]; for (k in a) printf "%s ", k; print "" }`, "z 3 b 1 \n"},
+		{`BEGIN { a["x"]; a["y"]; a["z"]; delete a["x"]; a["x"]; a["y"] = 1; for (k in a) printf "%s ", k; print "" }`, "y z x \n"},
+		{`BEGIN { a[2] = "b"; a[1] = "a"; for (k in a) print k, a[k] }`, "2 b\n1 a\n"},
+		{`BEGIN { n = split("c b a", a); a["x"]; for (k in a) printf "%s=%s ", k, a[k]; print "" }`, "1=c 2=b 3=a x= \n"},
+		{`BEGIN { for (i = 0; i < 100; i++) a[i]; for (i = 0; i < 98; i++) delete a[i]; a[0]; for (k in a) printf "%s ", k; print "" }`, "98 99 0 \n"},
+		{`BEGIN { a[1]; a[2]; a[3]; for (k in a) { delete a[3]; a[4]; printf "%s ", k } print "" }`, "1 2 \n"},
+		{`function f(l) { l["q"]; l["p"]; for (k in l) printf "%s ", k } BEGIN { f(); print "" }`, "q p \n"},
+		{`{ c[$1]++ } END { for (k in c) print k, c[k] }`, "b 2\na 1\n"},
+		{`BEGIN { a[3]; a[1]; delete a; a[2]; a[1]; for (k in a) printf "%s ", k; print "" }`, "2 1 \n"},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			testGoAWK(t, test.src, "b\nb\na\n", test.out, "", nil, func(config *interp.Config) {
+				config.OrderedArrays = true
+			})
+		})
+	}
+
+	// An interpreter reused with and without the option
+	prog, err := parser.ParseProgram([]byte(`BEGIN { a["b"]; a["a"]; for (k in a) printf "%s", k; print "" }`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interpreter := interp.New(prog)
+	for _, ordered := range []bool{true, false, true} {
+		var out bytes.Buffer
+		_, err := interpreter.Execute(&interp.Config{Output: &out, OrderedArrays: ordered})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ordered && out.String() != "ba\n" {
+			t.Errorf("expected %q, got %q", "ba\n", out.String())
+		}
+	}
+}
+
+func TestPrintSortedRedirect(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.txt")
+	err := ioutil.WriteFile(empty, []byte("keep\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := filepath.Join(dir, "full.txt")
+	src := `BEGIN { for (k in a) print k > empty; b["x"]; for (k in b) print k > full; for (k in a) print k | "cat" }`
+	testGoAWK(t, src, "", "", "", nil, func(config *interp.Config) {
+		config.Vars = []string{"empty", empty, "full", full}
+	})
+	for path, expected := range map[string]string{empty: "keep\n", full: "x\n"} {
+		b, err := ioutil.ReadFile(path)
+		if err != nil || string(b) != expected {
+			t.Errorf("expected %s to contain %q, got %q, %v", path, expected, b, err)
+		}
+	}
+}
+
+func TestUseLocaleNumeric(t *testing.T) {
+	src := `{ s += $1; x = $2 $3; print $1+0, ($2 > $3), x, s / 4 } END { printf "%.2f %s\n", s, s; CONVFMT = "%.1f"; y = s ""; print y, length(y) }`
+	input := "3,14 10,5 9\n-1,5e2 2.5 1\nabc 1 2\n"
+	config := func(config *interp.Config) {
+		config.Locale = &interp.Locale{DecimalPoint: ","}
+		config.UseLocaleNumeric = true
+	}
+	testGoAWK(t, src, input, "3,14 1 10,59 0,785\n-150 1 2.51 -36,715\n0 0 12 -36,715\n-146,86 -146,86\n-146,9 6\n", "", nil, config)
+	testGoAWK(t, src, input, "3 0 10,59 0.75\n-1 1 2.51 0.5\n0 0 12 0.5\n2,00 2\n2 1\n", "", nil, func(config *interp.Config) {
+		config.Locale = &interp.Locale{DecimalPoint: ","}
+	})
+
+	// Other number parsers are tried first
+	testGoAWK(t, `{ print $1 + $2 }`, "0x10 1,5\n", "17,5\n", "", nil, func(config *interp.Config) {
+		config.Locale = &interp.Locale{DecimalPoint: ","}
+		config.UseLocaleNumeric = true
+		config.NumberParser = interp.ParseNonDecimal
+	})
+}
+
+func TestLocation(t *testing.T) {
+	src := `BEGIN { print strftime("%H:%M %Z", 0), mktime("1970 01 01 00 00 00"), strftime("%A %B", 0) }`
+	testGoAWK(t, src, "", "05:30 IST -19800 Thursday January\n", "", nil, func(config *interp.Config) {
+		config.Location = time.FixedZone("IST", 5*60*60+30*60)
+	})
+	testGoAWK(t, src, "", "16:00 PST 28800 Wednesday December\n", "", nil, func(config *interp.Config) {
+		config.Environ = []string{"TZ", "America/Los_Angeles"}
+		config.Locale = &interp.Locale{MonthNames: []string{"01", "02", "03", "04", "05", "06", "07", "08", "09", "10", "11", "December"}}
+	})
+	testGoAWK(t, src, "", "00:00 UTC 0 Thursday January\n", "", nil, func(config *interp.Config) {
+		config.Environ = []string{"TZ", ""}
+	})
+}
+
+func TestInterpreterReuse(t *testing.T) {
+	src := `BEGIN { print int(rand()*1000), ("a" in a), x }  { a[$1]; x = x $1; n++ }  END { for (k in a) c++; print n+0, NR, FS, c+0, x; FS = ":"; exit n }`
+	prog, err := parser.ParseProgram([]byte(src), nil)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	interpreter := interp.New(prog)
+	tests := []struct {
+		in     string
+		fs     string
+		out    string
+		status int
+	}{
+		{"a\nb\na\n", " ", "606 0 \n3 3   2 aba\n", 3},
+		{"x,y\n", ",", "606 0 \n1 1 , 1 x\n", 1},
+		{"", " ", "606 0 \n0 0   0 \n", 0},
+	}
+	for _, test := range tests {
+		outBuf := &bytes.Buffer{}
+		status, err := interpreter.Execute(&interp.Config{
+			Stdin:  strings.NewReader(test.in),
+			Output: outBuf,
+			Vars:   []string{"FS", test.fs},
+		})
+		if err != nil {
+			t.Fatalf("error interpreting: %v", err)
+		}
+		if outBuf.String() != test.out || status != test.status {
+			t.Fatalf("expected %q (status %d), got %q (status %d)", test.out, test.status, outBuf.String(), status)
+		}
+	}
+}
+
+func TestExecuteContext(t *testing.T) {
+	tests := []string{
+		`BEGIN { while (1) n++ }`,
+		`BEGIN { for (;;) {} }`,
+		`BEGIN { do n++; while (n > 0) }`,
+		`BEGIN { for (i = 0; i >= 0; i++) a[i] }`,
+		`BEGIN { a[1]; a[2]; for (k in a) for (k2 in a) while (1) {} }`,
+		`function f(n) { return n < 2 ? n : f(n-1) + f(n-2) }  BEGIN { print f(100) }`,
+		"{ }  # infinite input",
+		`BEGIN { sleep(3600) }`,
+	}
+	for _, src := range tests {
+		t.Run(src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(src), nil)
+			if err != nil {
+				t.Fatalf("error parsing: %v", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			_, err = interp.New(prog).ExecuteContext(ctx, &interp.Config{
+				Stdin:  &infiniteReader{},
+				Output: ioutil.Discard,
+			})
+			if err != context.DeadlineExceeded {
+				t.Fatalf("expected error %v, got %v", context.DeadlineExceeded, err)
+			}
+		})
+	}
+}
+
+type infiniteReader struct{}
+
+func (r *infiniteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = '\n'
+	}
+	return len(p), nil
+}
+
+func TestExecProgramCapture(t *testing.T) {
+	src := `BEGIN { n = 2; s = "x"; a[1] = 1.5; a["k"]; FS = "," } { f = $1; exit 3 } END { e = 1 }`
+	prog, err := parser.ParseProgram([]byte(src), nil)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	status, captured, err := interp.ExecProgramCapture(prog, &interp.Config{
+		Stdin:       strings.NewReader("42,x\n"),
+		Output:      &bytes.Buffer{},
+		CaptureVars: []string{"n", "s", "a", "f", "e", "FS", "NR", "unset", "ENVIRON2"},
+	})
+	if err != nil {
+		t.Fatalf("error interpreting: %v", err)
+	}
+	if status != 3 {
+		t.Fatalf("expected status 3, got %d", status)
+	}
+	expected := map[string]interface{}{
+		"n":        2.0,
+		"s":        "x",
+		"a":        map[string]interface{}{"1": 1.5, "k": nil},
+		"f":        "42",
+		"e":        1.0,
+		"FS":       ",",
+		"NR":       1.0,
+		"unset":    nil,
+		"ENVIRON2": nil,
+	}
+	if !reflect.DeepEqual(captured, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, captured)
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	// Sum of second field with hand-written instructions, calling a
+	// native function and using a -v variable.
+	asm := `
+        // { body }
+0000    FieldInt 2
+0002    AugAssignGlobal AugOpAdd sum
+
+        // END
+0000    Global label
+0002    Global sum
+0004    CallNative twice 1
+0007    Print 2
+`
+	funcs := map[string]interface{}{
+		"twice": func(n float64) float64 { return 2 * n },
+		"abs":   func(n float64) float64 { return n },
+	}
+	prog, err := parser.Assemble(strings.NewReader(asm), &parser.ParserConfig{Funcs: funcs})
+	if err != nil {
+		t.Fatalf("error assembling: %v", err)
+	}
+	output := &bytes.Buffer{}
+	_, err = interp.ExecProgram(prog, &interp.Config{
+		Stdin:  strings.NewReader("a 1\nb 2\nc 3\n"),
+		Output: output,
+		Vars:   []string{"label", "total"},
+		Funcs:  funcs,
+	})
+	if err != nil {
+		t.Fatalf("error interpreting: %v", err)
+	}
+	if output.String() != "total 12\n" {
+		t.Fatalf("expected %q, got %q", "total 12\n", output.String())
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	src := `function twice(x) { return x * 2 }
+$1 > 1 { n += twice($1) }
+/never/ {
+	print "never"
+}
+END { if (n) print n; else print "none" }
+`
+	prog, err := parser.ParseProgram([]byte(src), &parser.ParserConfig{Coverage: true})
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	coverage, err := interp.NewCoverage(prog)
+	if err != nil {
+		t.Fatalf("error creating coverage: %v", err)
+	}
+
+	// Counts from both runs should be added together
+	for _, input := range []string{"1\n2\n3\n", "4\n"} {
+		_, err = interp.ExecProgram(prog, &interp.Config{
+			Stdin:    strings.NewReader(input),
+			Output:   ioutil.Discard,
+			Coverage: coverage,
+		})
+		if err != nil {
+			t.Fatalf("error interpreting: %v", err)
+		}
+	}
+
+	var counts []string
+	for _, c := range coverage.Counts() {
+		counts = append(counts, fmt.Sprintf("%d:%d=%d", c.Position.Line, c.Position.Column, c.Count))
+	}
+	expected := "1:21=3 2:1=4 2:10=3 3:1=4 4:2=0 6:7=2 6:14=2 6:28=0"
+	if strings.Join(counts, " ") != expected {
+		t.Fatalf("expected counts %s, got %s", expected, strings.Join(counts, " "))
+	}
+
+	var listing bytes.Buffer
+	err = coverage.WriteListing(&listing, []byte(src))
+	if err != nil {
+		t.Fatalf("error writing listing: %v", err)
+	}
+	expected = `        3:    1:function twice(x) { return x * 2 }
+        4:    2:$1 > 1 { n += twice($1) }
+        4:    3:/never/ {
+    #####:    4:	print "never"
+        -:    5:}
+       2*:    6:END { if (n) print n; else print "none" }
+`
+	if listing.String() != expected {
+		t.Fatalf("expected listing:\n%s\ngot:\n%s", expected, listing.String())
+	}
+
+	var lcov bytes.Buffer
+	err = coverage.WriteLCOV(&lcov, []interp.CoverageFile{{Name: "a.awk", Lines: 3}, {Name: "b.awk", Lines: 4}})
+	if err != nil {
+		t.Fatalf("error writing LCOV: %v", err)
+	}
+	expected = "TN:\nSF:a.awk\nDA:1,3\nDA:2,4\nDA:3,4\nLF:3\nLH:3\nend_of_record\n" +
+		"TN:\nSF:b.awk\nDA:1,0\nDA:3,2\nLF:2\nLH:1\nend_of_record\n"
+	if lcov.String() != expected {
+		t.Fatalf("expected LCOV:\n%s\ngot:\n%s", expected, lcov.String())
+	}
+
+	// Errors for misuse
+	other, err := parser.ParseProgram([]byte(src), nil)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	_, err = interp.NewCoverage(other)
+	if err == nil || err.Error() != "program wasn't parsed with ParserConfig.Coverage" {
+		t.Fatalf("expected NewCoverage error, got %v", err)
+	}
+	_, err = interp.ExecProgram(other, &interp.Config{Stdin: strings.NewReader(""), Coverage: coverage})
+	if err == nil || err.Error() != "config.Coverage was created for a different program" {
+		t.Fatalf("expected ExecProgram error, got %v", err)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	src := `BEGIN { x = 0 }
+$1 > 1 { x += fib($1) }
+/never/ { print "never" }
+function fib(n) {
+	return n < 2 ? n : fib(n-1) + fib(n-2)
+}
+END { print x }
+`
+	prog, err := parser.ParseProgram([]byte(src), &parser.ParserConfig{NoInline: true})
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	profile := interp.NewProfile(prog)
+	var output bytes.Buffer
+	_, err = interp.ExecProgram(prog, &interp.Config{
+		Stdin:   strings.NewReader("1\n2\n3\n"),
+		Output:  &output,
+		Profile: profile,
+	})
+	if err != nil {
+		t.Fatalf("error interpreting: %v", err)
+	}
+	if output.String() != "3\n" {
+		t.Fatalf("expected %q, got %q", "3\n", output.String())
+	}
+
+	var entries []string
+	for _, e := range profile.Entries() {
+		entries = append(entries, fmt.Sprintf("%s %s %d %d/%d", e.Kind, e.Name, e.Line, e.Matched, e.Count))
+		if e.Count > 0 && e.Kind != "action" && e.Time <= 0 {
+			t.Errorf("expected nonzero time for %s %s", e.Kind, e.Name)
+		}
+	}
+	expected := "BEGIN  1 0/1|action  2 2/3|action  3 0/3|END  7 0/1|function fib 5 0/8"
+	if strings.Join(entries, "|") != expected {
+		t.Fatalf("expected entries %s, got %s", expected, strings.Join(entries, "|"))
+	}
+
+	var report bytes.Buffer
+	err = profile.WriteReport(&report)
+	if err != nil {
+		t.Fatalf("error writing report: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(report.String()), "\n")
+	if len(lines) != 6 || !strings.HasSuffix(lines[0], "count    matched  where") ||
+		!strings.Contains(report.String(), "function fib (line 5)") {
+		t.Fatalf("unexpected report:\n%s", report.String())
+	}
+
+	var listing bytes.Buffer
+	err = profile.WriteListing(&listing, []byte(src))
+	if err != nil {
+		t.Fatalf("error writing listing: %v", err)
+	}
+	lines = strings.Split(strings.TrimSuffix(listing.String(), "\n"), "\n")
+	// Remove the time column, as the times vary (and may include "µ")
+	for i, line := range lines {
+		runes := []rune(line)
+		if len(runes) < 12 {
+			t.Fatalf("unexpected listing:\n%s", listing.String())
+		}
+		lines[i] = string(runes[12:])
+	}
+	expectedListing := `      count    matched
+          1           :    1:BEGIN { x = 0 }
+          3          2:    2:$1 > 1 { x += fib($1) }
+          3          0:    3:/never/ { print "never" }
+                      :    4:function fib(n) {
+          8           :    5:	return n < 2 ? n : fib(n-1) + fib(n-2)
+                      :    6:}
+          1           :    7:END { print x }`
+	if strings.Join(lines, "\n") != expectedListing {
+		t.Fatalf("expected listing:\n%s\ngot:\n%s", expectedListing, strings.Join(lines, "\n"))
+	}
+
+	other, err := parser.ParseProgram([]byte(src), nil)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	_, err = interp.ExecProgram(other, &interp.Config{Stdin: strings.NewReader(""), Profile: profile})
+	if err == nil || err.Error() != "config.Profile was created for a different program" {
+		t.Fatalf("expected ExecProgram error, got %v", err)
+	}
+
+	inlined, err := parser.ParseProgram([]byte(`function double(n) { return 2*n } BEGIN { print double(2) }`), nil)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	_, err = interp.ExecProgram(inlined, &interp.Config{Stdin: strings.NewReader(""), Profile: interp.NewProfile(inlined)})
+	if err == nil || err.Error() != "config.Profile needs a program parsed with ParserConfig.NoInline" {
+		t.Fatalf("expected ExecProgram error, got %v", err)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	src := `function big(n) {
+	if (n > 1) {
+		return "big"
+	}
+	return "small"
+}
+/skip/ { getline; next }
+{ print big($1) }`
+	tests := []struct {
+		funcs  []string
+		limit  int
+		output string
+	}{
+		{nil, 0, `line 7: NR=1: /skip/
+line 8: NR=1: print big($1)
+line 2: NR=1: if (n > 1) {
+line 5: NR=1: return "small"
+small
+line 7: NR=2: /skip/
+line 7: NR=2: getline
+line 7: NR=3: next
+line 7: NR=4: /skip/
+line 8: NR=4: print big($1)
+line 2: NR=4: if (n > 1) {
+line 3: NR=4: return "big"
+big
+`},
+		{[]string{"big"}, 0, `line 2: NR=1: if (n > 1) {
+line 5: NR=1: return "small"
+small
+line 2: NR=4: if (n > 1) {
+line 3: NR=4: return "big"
+big
+`},
+		{nil, 3, `line 7: NR=1: /skip/
+line 8: NR=1: print big($1)
+line 2: NR=1: if (n > 1) {
+trace limit of 3 lines reached
+small
+big
+`},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v/%d", test.funcs, test.limit), func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(src), &parser.ParserConfig{Coverage: true})
+			if err != nil {
+				t.Fatalf("error parsing: %v", err)
+			}
+			var output bytes.Buffer
+			_, err = interp.ExecProgram(prog, &interp.Config{
+				Stdin:          strings.NewReader("1\nskip\nx\n2\n"),
+				Output:         &output,
+				Trace:          &output,
+				TraceFunctions: test.funcs,
+				TraceLimit:     test.limit,
+			})
+			if err != nil {
+				t.Fatalf("error interpreting: %v", err)
+			}
+			if output.String() != test.output {
+				t.Fatalf("expected:\n%s\ngot:\n%s", test.output, output.String())
+			}
+		})
+	}
+
+	prog, err := parser.ParseProgram([]byte(src), nil)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	_, err = interp.ExecProgram(prog, &interp.Config{Stdin: strings.NewReader(""), Trace: ioutil.Discard})
+	if err == nil || err.Error() != "config.Trace requires a program parsed with ParserConfig.Coverage" {
+		t.Fatalf("expected ExecProgram error, got %v", err)
+	}
+	prog, err = parser.ParseProgram([]byte(src), &parser.ParserConfig{Coverage: true})
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	_, err = interp.ExecProgram(prog, &interp.Config{
+		Stdin:          strings.NewReader(""),
+		Trace:          ioutil.Discard,
+		TraceFunctions: []string{"nope"},
+	})
+	if err == nil || err.Error() != `can't trace undefined function "nope"` {
+		t.Fatalf("expected ExecProgram error, got %v", err)
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	src := `
+BEGIN { print "begin" }
+$1 == "skip" { getline; next }
+/start/,/stop/ { print "in range" }
+{ n++; print NR, toupper($2) }
+$1 == "exit" { exit 3 }
+END { print "end", n }
+`
+	prog, err := parser.ParseProgram([]byte(src), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &bytes.Buffer{}
+	b, err := interp.NewBatcher(prog, &interp.Config{Output: output})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != "begin\n" {
+		t.Fatalf("expected BEGIN output %q, got %q", "begin\n", output.String())
+	}
+
+	batches := [][]string{
+		{"a b", "start c", "d e"},
+		{},
+		{"skip x", "y z", "stop f", "g h"},
+		{"exit i", "j k"},
+		{"l m"},
+	}
+	expected := [][]string{
+		{"1 B\n", "in range\n2 C\n", "in range\n3 E\n"},
+		{},
+		{"", "", "in range\n6 F\n", "7 H\n"},
+		{"8 I\n", ""},
+		{""},
+	}
+	for i, batch := range batches {
+		var records [][]byte
+		for _, record := range batch {
+			records = append(records, []byte(record))
+		}
+		outputs, err := b.Process(records)
+		if err != nil {
+			t.Fatalf("batch %d: %v", i, err)
+		}
+		var strs []string
+		for _, out := range outputs {
+			strs = append(strs, string(out))
+		}
+		if strings.Join(strs, "|") != strings.Join(expected[i], "|") || len(outputs) != len(batch) {
+			t.Fatalf("batch %d: expected %q, got %q", i, expected[i], strs)
+		}
+	}
+
+	status, err := b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 3 {
+		t.Fatalf("expected status 3, got %d", status)
+	}
+	if output.String() != "begin\nend 6\n" {
+		t.Fatalf("expected output %q, got %q", "begin\nend 6\n", output.String())
+	}
+	_, err = b.Process(nil)
+	if err == nil || err.Error() != "Process called on closed Batcher" {
+		t.Fatalf("expected error after Close, got %v", err)
+	}
+}
+
+func TestSourcePushdown(t *testing.T) {
+	input := "a 1 ERROR\nb 20 ok\nc 300 ERROR\nd x ERROR\n"
+	tests := []struct {
+		src   string
+		preds string // predicates passed to SetFilter
+		out   string
+	}{
+		{`$3 == "ERROR" { print $1 }`, `$3 == "ERROR"`, "a\nc\nd\n"},
+		{`$3 == "ERROR" && 10 < $2 { print $1 }`, `$3 == "ERROR", $2 > 10`, "c\nd\n"},
+		{`$2 >= 20 && $2 != 300`, `$2 >= 20, $2 != 300`, "b 20 ok\nd x ERROR\n"},
+		{`/ok/ || $1 == "a" { print $1 }`, ``, "a\nb\n"},
+		{`/E/ && length($1) == 1 && $1 ~ "[bc]" { n++ } END { print n }`, `$0 ~ /E/, $1 ~ /[bc]/`, "1\n"},
+		{`$1 ~ /a|b/ && x++ && $3 == "ok" { print } END { print x }`, `$1 ~ /a|b/`, "b 20 ok\n2\n"},
+		{`BEGIN { CONVFMT = "%.1f" } $2 != 1.25`, `$2 != 1.25 (1.2)`, "a 1 ERROR\nb 20 ok\nc 300 ERROR\nd x ERROR\n"},
+
+		// Skipping records would change the result of these
+		{`$3 == "ERROR" { print NR }`, ``, "1\n3\n4\n"},
+		{`$3 == "ERROR" { n++ } END { print $1, n }`, ``, "d 3\n"},
+		{`$3 == "ERROR" { FS = "," } END { print n+0 }`, ``, "0\n"},
+		{`$3 == "ERROR" { getline; print }`, ``, "b 20 ok\nd x ERROR\n"},
+		{`$3 == "ERROR", $3 == "ok"`, ``, "a 1 ERROR\nb 20 ok\nc 300 ERROR\nd x ERROR\n"},
+		{`$3 == "ERROR" { print }  $1 == "b"`, ``, "a 1 ERROR\nb 20 ok\nc 300 ERROR\nd x ERROR\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatalf("error parsing: %v", err)
+			}
+			source := &testSource{lines: strings.Split(strings.TrimSuffix(input, "\n"), "\n")}
+			outBuf := &bytes.Buffer{}
+			_, err = interp.ExecProgram(prog, &interp.Config{
+				Output: outBuf,
+				Source: source,
+			})
+			if err != nil {
+				t.Fatalf("error interpreting: %v", err)
+			}
+			preds := make([]string, len(source.preds))
+			for i, p := range source.preds {
+				switch {
+				case p.Regex != nil:
+					preds[i] = fmt.Sprintf("$%d %s /%s/", p.Field, p.Op, p.Regex)
+				case p.Numeric && p.Value != fmt.Sprint(p.Number):
+					preds[i] = fmt.Sprintf("$%d %s %v (%s)", p.Field, p.Op, p.Number, p.Value)
+				case p.Numeric:
+					preds[i] = fmt.Sprintf("$%d %s %v", p.Field, p.Op, p.Number)
+				default:
+					preds[i] = fmt.Sprintf("$%d %s %q", p.Field, p.Op, p.Value)
+				}
+			}
+			if strings.Join(preds, ", ") != test.preds {
+				t.Errorf("expected predicates %q, got %q", test.preds, strings.Join(preds, ", "))
+			}
+			if outBuf.String() != test.out {
+				t.Errorf("expected %q, got %q", test.out, outBuf.String())
+			}
+		})
+	}
+}
+
+// testSource is a FilteringSource that applies the predicates it's
+// given to whitespace-separated fields.
+type testSource struct {
+	lines []string
+	preds []interp.Predicate
+}
+
+func (s *testSource) SetFilter(preds []interp.Predicate) {
+	s.preds = preds
+}
+
+func (s *testSource) Next() (string, error) {
+lines:
+	for len(s.lines) > 0 {
+		line := s.lines[0]
+		s.lines = s.lines[1:]
+		fields := append([]string{line}, strings.Fields(line)...)
+		for _, p := range s.preds {
+			if p.Field >= len(fields) || !p.Match(fields[p.Field]) {
+				continue lines
+			}
+		}
+		return line, nil
+	}
+	return "", io.EOF
+}
+
+// messageSource is a MetadataSource of messages, like a Kafka topic's,
+// whose metadata is their partition and offset.
+type messageSource struct {
+	messages []string
+	offset   int
+	closed   bool
+}
+
+func (s *messageSource) Next() (string, error) {
+	if s.offset >= len(s.messages) {
+		return "", io.EOF
+	}
+	s.offset++
+	return s.messages[s.offset-1], nil
+}
+
+func (s *messageSource) Metadata() map[string]string {
+	return map[string]string{"partition": "0", "offset": strconv.Itoa(s.offset - 1)}
+}
+
+func (s *messageSource) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestSources(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file.txt")
+	err := ioutil.WriteFile(file, []byte("from file\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opened []*messageSource
+	sources := map[string]func(url string) (interp.RecordSource, error){
+		"test": func(url string) (interp.RecordSource, error) {
+			if url == "test://bad" {
+				return nil, errors.New("can't connect to " + url)
+			}
+			s := &messageSource{messages: []string{"a b", "multi\nline"}}
+			opened = append(opened, s)
+			return s, nil
+		},
+	}
+	tests := []struct {
+		src  string
+		args []string
+		out  string
+		err  string
+	}{
+		{`{ print FILENAME, FNR, NR, ("offset" in RECORDINFO), RECORDINFO["partition"], RECORDINFO["offset"] + 1, $1 }`,
+			[]string{"test://broker/topic", file, "test://other"},
+			"test://broker/topic 1 1 1 0 1 a\ntest://broker/topic 2 2 1 0 2 multi\n" +
+				file + " 1 3 0  1 from\ntest://other 1 4 1 0 1 a\ntest://other 2 5 1 0 2 multi\n", ""},
+		{`{ n++ } END { print n, $0 }`, []string{"test://x", "x=1"}, "2 multi\nline\n", ""},
+		{`NR == 1 { exit } END { print $0 }`, []string{"test://x"}, "a b\n", ""},
+		{`{ print }`, []string{"test://bad"}, "", "can't connect to test://bad"},
+		{`{ print }`, []string{"other://x"}, "", "open other://x: no such file or directory"},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			opened = nil
+			testGoAWK(t, test.src, "", test.out, test.err, nil, func(config *interp.Config) {
+				config.Args = test.args
+				config.Sources = sources
+			})
+			for i, s := range opened {
+				if !s.closed {
+					t.Errorf("expected source %d to be closed", i)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenURL(t *testing.T) {
+	objects := map[string]string{"obj://bucket/a.log": "a 1\na 2\n", "obj://bucket/b.log": "b 3"}
+	var opened []string
+	openURL := func(url string) (io.ReadCloser, error) {
+		opened = append(opened, url)
+		s, ok := objects[url]
+		if !ok {
+			return nil, &os.PathError{Op: "open", Path: url, Err: errors.New("404 Not Found")}
+		}
+		return ioutil.NopCloser(strings.NewReader(s)), nil
+	}
+	tests := []struct {
+		src    string
+		args   []string
+		out    string
+		err    string
+		opened string
+	}{
+		{`{ print FILENAME, FNR, $2 }`, []string{"obj://bucket/a.log", "obj://bucket/b.log"},
+			"obj://bucket/a.log 1 1\nobj://bucket/a.log 2 2\nobj://bucket/b.log 1 3\n", "", "obj://bucket/a.log obj://bucket/b.log"},
+		{`BEGIN { while ((getline line < "obj://bucket/b.log") > 0) print line; print (getline x < "obj://bucket/nope"), ERRNO }`, nil,
+			"b 3\n-1 404 Not Found\n", "", "obj://bucket/b.log obj://bucket/nope"},
+		{`BEGIN { getline x < "string://s"; print x }`, nil, "s\n", "", ""},
+		{`{ print }`, []string{"obj://bucket/nope"}, "", "open obj://bucket/nope: 404 Not Found", "obj://bucket/nope"},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			opened = nil
+			testGoAWK(t, test.src, "", test.out, test.err, nil, func(config *interp.Config) {
+				config.Args = test.args
+				config.OpenURL = openURL
+				config.PrefetchFiles = true
+			})
+			if strings.Join(opened, " ") != test.opened {
+				t.Fatalf("expected %q to be opened, got %q", test.opened, opened)
+			}
+		})
+	}
+}
+
+func TestExit(t *testing.T) {
+	tests := []struct {
+		src    string
+		out    string
+		status int
+	}{
+		{`BEGIN { print "x"; exit; print "y" }  { print "a" }  END { print "z" }`, "x\nz\n", 0},
+		{`BEGIN { print "x"; exit 1+2; print "y" }  { print "a" }  END { print "z" }`, "x\nz\n", 3},
+		{`{ print "x"; exit; print "y" }  END { print "z" }`, "x\nz\n", 0},
+		{`{ print "x"; exit 1+2; print "y" }  END { print "z" }`, "x\nz\n", 3},
+		{`END { print "x"; exit; print "y" }`, "x\n", 0},
+		{`END { print "x"; exit 1+2; print "y" }`, "x\n", 3},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatalf("error parsing: %v", err)
+			}
+			outBuf := &bytes.Buffer{}
+			config := &interp.Config{
+				Stdin:  strings.NewReader("line\n"),
+				Output: outBuf,
+			}
+			status, err := interp.ExecProgram(prog, config)
+			if err != nil {
+				t.Fatalf("error interpreting: %v", err)
+			}
+			normalized := normalizeNewlines(outBuf.String())
+			if normalized != test.out {
+				t.Fatalf("expected %q, got %q", test.out, normalized)
+			}
+			if status != test.status {
+				t.Fatalf("expected status %d, got %d", test.status, status)
+			}
+		})
+	}
+}
+
+func benchmarkProgram(b *testing.B, funcs map[string]interface{},
+	input, expected, srcFormat string, args ...interface{},
+) {
 	b.StopTimer()
 	src := fmt.Sprintf(srcFormat, args...)
 	parserConfig := &parser.ParserConfig{
@@ -1467,6 +3812,33 @@ func benchmarkProgram(b *testing.B, funcs map[string]interface{},
 	}
 }
 
+func BenchmarkBatcher(b *testing.B) {
+	prog, err := parser.ParseProgram([]byte(`$2 > 50 { print $1, $2*2 }`), nil)
+	if err != nil {
+		b.Fatalf("error parsing: %v", err)
+	}
+	batcher, err := interp.NewBatcher(prog, &interp.Config{Output: ioutil.Discard})
+	if err != nil {
+		b.Fatalf("error creating batcher: %v", err)
+	}
+	records := make([][]byte, 1000)
+	for i := range records {
+		records[i] = []byte(fmt.Sprintf("r%d %d", i, i%100))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(records) {
+		_, err := batcher.Process(records)
+		if err != nil {
+			b.Fatalf("error processing: %v", err)
+		}
+	}
+	b.StopTimer()
+	_, err = batcher.Close()
+	if err != nil {
+		b.Fatalf("error closing: %v", err)
+	}
+}
+
 func BenchmarkGlobalVars(b *testing.B) {
 	benchmarkProgram(b, nil, "", "a 1", `
 BEGIN {
@@ -1803,6 +4175,38 @@ BEGIN {
 `, b.N)
 }
 
+func BenchmarkIfElseChain(b *testing.B) {
+	benchmarkProgram(b, nil, "", "", `
+BEGIN {
+  split("jan feb mar apr may jun jul aug sep oct nov dec", months)
+  for (i = 0; i < %d; i++) {
+    m = months[i%%12 + 1]
+    if (m == "jan") n = 1
+    else if (m == "feb") n = 2
+    else if (m == "mar") n = 3
+    else if (m == "apr") n = 4
+    else if (m == "may") n = 5
+    else if (m == "jun") n = 6
+    else if (m == "jul") n = 7
+    else if (m == "aug") n = 8
+    else if (m == "sep") n = 9
+    else if (m == "oct") n = 10
+    else if (m == "nov") n = 11
+    else n = 12
+  }
+}
+`, b.N)
+}
+
+func BenchmarkPrintSorted(b *testing.B) {
+	benchmarkProgram(b, nil, "", "", `
+BEGIN {
+  for (i = 0; i < %d; i++) a["k" i] = i
+  for (k in a) print k, a[k] > "/dev/null"
+}
+`, b.N)
+}
+
 func BenchmarkCondExpr(b *testing.B) {
 	benchmarkProgram(b, nil, "", "0", `
 BEGIN {
@@ -1839,6 +4243,91 @@ func BenchmarkSimplePattern(b *testing.B) {
 	benchmarkProgram(b, nil, input, expected, "$0")
 }
 
+func BenchmarkRegexFilter(b *testing.B) {
+	b.StopTimer()
+	inputLines := []string{}
+	expectedLines := []string{}
+	for i := 0; i < b.N; i++ {
+		line := fmt.Sprintf("%d bar %d", i, i*2)
+		if i%2 == 0 {
+			line = fmt.Sprintf("%d foo %d", i, i*2)
+			expectedLines = append(expectedLines, line)
+		}
+		inputLines = append(inputLines, line)
+	}
+	input := strings.Join(inputLines, "\n")
+	expected := strings.Join(expectedLines, "\n")
+	benchmarkProgram(b, nil, input, expected, "/foo/")
+}
+
+func BenchmarkPrintField(b *testing.B) {
+	b.StopTimer()
+	inputLines := []string{}
+	expectedLines := []string{}
+	for i := 1; i < b.N+1; i++ {
+		inputLines = append(inputLines, fmt.Sprintf("%d %d %d", i, i*2, i*3))
+		expectedLines = append(expectedLines, fmt.Sprintf("%d", i*2))
+	}
+	input := strings.Join(inputLines, "\n")
+	expected := strings.Join(expectedLines, "\n")
+	benchmarkProgram(b, nil, input, expected, "{ print $2 }")
+}
+
+func BenchmarkPrintFieldComma(b *testing.B) {
+	b.StopTimer()
+	inputLines := []string{}
+	expectedLines := []string{}
+	for i := 1; i < b.N+1; i++ {
+		inputLines = append(inputLines, fmt.Sprintf("%d,%d,%d,%d,%d,%d", i, i*2, i*3, i*4, i*5, i*6))
+		expectedLines = append(expectedLines, fmt.Sprintf("%d", i*2))
+	}
+	input := strings.Join(inputLines, "\n")
+	expected := strings.Join(expectedLines, "\n")
+	benchmarkProgram(b, nil, input, expected, `BEGIN { FS = "," } { print $2 }`)
+}
+
+func BenchmarkPrintFieldList(b *testing.B) {
+	b.StopTimer()
+	inputLines := []string{}
+	expectedLines := []string{}
+	for i := 1; i < b.N+1; i++ {
+		inputLines = append(inputLines, fmt.Sprintf("%d %d %d", i, i*2, i*3))
+		expectedLines = append(expectedLines, fmt.Sprintf("%d %d", i*3, i))
+	}
+	input := strings.Join(inputLines, "\n")
+	expected := strings.Join(expectedLines, "\n")
+	benchmarkProgram(b, nil, input, expected, "{ print $3, $1 }")
+}
+
+func BenchmarkCompareFieldString(b *testing.B) {
+	b.StopTimer()
+	inputLines := []string{}
+	n := 0
+	for i := 1; i < b.N+1; i++ {
+		name := "alice"
+		if i%3 == 0 {
+			name = "bob"
+			n++
+		}
+		inputLines = append(inputLines, fmt.Sprintf("%d,%s,%d", i, name, i*2))
+	}
+	input := strings.Join(inputLines, "\n")
+	benchmarkProgram(b, nil, input, strconv.Itoa(n), `BEGIN { FS = "," } $2 == "bob" { n++ } END { print n+0 }`)
+}
+
+func BenchmarkPrintFields(b *testing.B) {
+	b.StopTimer()
+	inputLines := []string{}
+	expectedLines := []string{}
+	for i := 1; i < b.N+1; i++ {
+		inputLines = append(inputLines, fmt.Sprintf("%d %d %d", i, i*2, i*3))
+		expectedLines = append(expectedLines, fmt.Sprintf("%d %d %d", i*3, i, i))
+	}
+	input := strings.Join(inputLines, "\n")
+	expected := strings.Join(expectedLines, "\n")
+	benchmarkProgram(b, nil, input, expected, "{ print $3, $1, NR }")
+}
+
 func BenchmarkGetField(b *testing.B) {
 	b.StopTimer()
 	inputLines := []string{}
@@ -1852,6 +4341,54 @@ func BenchmarkGetField(b *testing.B) {
 	benchmarkProgram(b, nil, input, expected, "{ print $1, $3 }")
 }
 
+func BenchmarkSpecialVars(b *testing.B) {
+	b.StopTimer()
+	inputLines := []string{}
+	n := 0
+	for i := 1; i < b.N+1; i++ {
+		line := fmt.Sprintf("%d %d %d", i, i*2, i*3)
+		inputLines = append(inputLines, line)
+		n += 3*3 + i + len(line)
+	}
+	input := strings.Join(inputLines, "\n")
+	benchmarkProgram(b, nil, input, strconv.Itoa(n),
+		`{ if (NF) n += NF * NF + NF + NR + length($0) - NF }  END { print n }`)
+}
+
+func BenchmarkGetFieldWide(b *testing.B) {
+	b.StopTimer()
+	inputLines := []string{}
+	expectedLines := []string{}
+	for i := 1; i < b.N+1; i++ {
+		fields := make([]string, 20)
+		for j := range fields {
+			fields[j] = strconv.Itoa(i + j)
+		}
+		inputLines = append(inputLines, strings.Join(fields, " "))
+		expectedLines = append(expectedLines, fields[0]+" "+fields[4])
+	}
+	input := strings.Join(inputLines, "\n")
+	expected := strings.Join(expectedLines, "\n")
+	benchmarkProgram(b, nil, input, expected, "{ print $1, $5 }")
+}
+
+func BenchmarkSumFields(b *testing.B) {
+	b.StopTimer()
+	inputLines := []string{}
+	total := 0
+	for i := 1; i < b.N+1; i++ {
+		fields := make([]string, 10)
+		for j := range fields {
+			fields[j] = strconv.Itoa(i + j)
+			total += i + j
+		}
+		inputLines = append(inputLines, strings.Join(fields, ","))
+	}
+	input := strings.Join(inputLines, "\n")
+	benchmarkProgram(b, nil, input, strconv.Itoa(total),
+		`BEGIN { FS="," } { for (i = 1; i <= NF; i++) s += $i } END { print s }`)
+}
+
 func BenchmarkSetField(b *testing.B) {
 	benchmarkProgram(b, nil, "1 2 3", "one 2 three", `
 {
@@ -1885,6 +4422,35 @@ BEGIN {
 `, b.N)
 }
 
+func BenchmarkDynamicRegexes(b *testing.B) {
+	benchmarkProgram(b, nil, "", "1", `
+BEGIN {
+  # Fill the cache with patterns that are never used again
+  for (i = 0; i < 500; i++) x = "a" ~ ("^stale" i "$")
+  for (i = 0; i < %d; i++) {
+    x = ("k" (i %% 20)) ~ ("^k" (i %% 20) "$")
+  }
+  print x
+}
+`, b.N)
+}
+
+func BenchmarkRegexAlternation(b *testing.B) {
+	benchmarkProgram(b, nil, "", "0", `
+BEGIN {
+  s = "2024-01-02 12:34:56 host42 INFO request handled in 12ms status=200"
+  for (i = 0; i < %d; i++) {
+  	x = s ~ /ERROR|WARN|FATAL/
+  	x = s ~ /ERROR|WARN|FATAL/
+  	x = s ~ /ERROR|WARN|FATAL/
+  	x = s ~ /ERROR|WARN|FATAL/
+  	x = s ~ /ERROR|WARN|FATAL/
+  }
+  print x
+}
+`, b.N)
+}
+
 func BenchmarkBinaryOperators(b *testing.B) {
 	benchmarkProgram(b, nil, "", "5.0293", `
 BEGIN {
@@ -9,43 +9,117 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
 	"unicode/utf8"
 
-	"github.com/benhoyt/goawk/internal/ast"
+	"github.com/benhoyt/goawk/ast"
+	"github.com/benhoyt/goawk/internal/compiler"
 	. "github.com/benhoyt/goawk/lexer"
 )
 
 // Print a line of output followed by a newline
 func (p *interp) printLine(writer io.Writer, line string) error {
-	err := writeOutput(writer, line)
-	if err != nil {
-		return err
+	switch w := writer.(type) {
+	case *bufio.Writer, *bufferedWriteCloser, *bytes.Buffer:
+		// Buffered writers are cheap to write to twice, which saves
+		// copying line to the scratch buffer first
+		err := writeOutput(w, line)
+		if err != nil {
+			return err
+		}
+		return writeOutput(w, p.outputRecordSep)
 	}
-	return writeOutput(writer, p.outputRecordSep)
-}
-
-// Implement a buffered version of WriteCloser so output is buffered
-// when redirecting to a file (eg: print >"out")
-type bufferedWriteCloser struct {
-	*bufio.Writer
-	io.Closer
+	if crlfNewline {
+		return writeOutput(writer, line+p.outputRecordSep)
+	}
+	// Otherwise write the line and ORS in a single Write call, as each
+	// call may be a system call (for example, when writing to a pipe)
+	p.printBuf = append(append(p.printBuf[:0], line...), p.outputRecordSep...)
+	_, err := writer.Write(p.printBuf)
+	return err
 }
 
-func newBufferedWriteCloser(w io.WriteCloser) *bufferedWriteCloser {
-	writer := bufio.NewWriterSize(w, outputBufSize)
-	return &bufferedWriteCloser{writer, w}
+// Print args separated by OFS and followed by ORS to writer, in a
+// single Write call and without building the line as a string first.
+func (p *interp) printValues(writer io.Writer, args []value) error {
+	if crlfNewline {
+		strs := make([]string, len(args))
+		for i, a := range args {
+			strs[i] = p.toOutputString(a)
+		}
+		return writeOutput(writer, strings.Join(strs, p.outputFieldSep)+p.outputRecordSep)
+	}
+	buf := p.printBuf[:0]
+	for i, a := range args {
+		if i > 0 {
+			buf = append(buf, p.outputFieldSep...)
+		}
+		if a.typ == typeNum && a.n == float64(int(a.n)) {
+			buf = strconv.AppendInt(buf, int64(a.n), 10)
+		} else {
+			buf = append(buf, p.toOutputString(a)...)
+		}
+	}
+	buf = append(buf, p.outputRecordSep...)
+	p.printBuf = buf
+	_, err := writer.Write(buf)
+	return err
 }
 
-func (wc *bufferedWriteCloser) Close() error {
-	err := wc.Writer.Flush()
-	if err != nil {
+// Print the fields with the given indexes (0 for $0) separated by OFS
+// and followed by ORS to standard output, as PrintFields does. Unlike
+// printValues, the field strings are written as is, without creating
+// values for them first, and straight to the output when it's buffered.
+func (p *interp) printFields(indexes []compiler.Opcode) error {
+	if len(indexes) == 1 && indexes[0] == 0 {
+		p.ensureLine()
+		line := p.line
+		if len(p.colorRegexes) > 0 {
+			line = p.highlight(line)
+		}
+		return p.printLine(p.output, line)
+	}
+	switch w := p.output.(type) {
+	case *bufferedWriteCloser, *bufio.Writer, *bytes.Buffer:
+		if crlfNewline || len(p.colorRegexes) > 0 {
+			break
+		}
+		sw := w.(io.StringWriter)
+		for i, index := range indexes {
+			if i > 0 {
+				_, err := sw.WriteString(p.outputFieldSep)
+				if err != nil {
+					return err
+				}
+			}
+			_, err := sw.WriteString(p.fieldString(int(index)))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := sw.WriteString(p.outputRecordSep)
 		return err
 	}
-	return wc.Closer.Close()
+	buf := p.printBuf[:0]
+	for i, index := range indexes {
+		if i > 0 {
+			buf = append(buf, p.outputFieldSep...)
+		}
+		field := p.fieldString(int(index))
+		if len(p.colorRegexes) > 0 {
+			field = p.highlight(field)
+		}
+		buf = append(buf, field...)
+	}
+	buf = append(buf, p.outputRecordSep...)
+	p.printBuf = buf
+	if crlfNewline {
+		return writeOutput(p.output, string(buf))
+	}
+	_, err := p.output.Write(buf)
+	return err
 }
 
 // Determine the output stream for given redirect token and
@@ -70,6 +144,8 @@ func (p *interp) getOutputStream(redirect Token, destValue value) (io.Writer, er
 			return nil, newError("can't write to file due to NoFileWrites")
 		}
 		p.flushOutputAndError() // ensure synchronization
+		p.cancelPrefetch()
+		p.pauseInput()
 		flags := os.O_CREATE | os.O_WRONLY
 		if redirect == GREATER {
 			flags |= os.O_TRUNC
@@ -80,7 +156,7 @@ func (p *interp) getOutputStream(redirect Token, destValue value) (io.Writer, er
 		if err != nil {
 			return nil, newError("output redirection error: %s", err)
 		}
-		buffered := newBufferedWriteCloser(w)
+		buffered := p.newBufferedWriteCloser(w, w)
 		p.outputStreams[name] = buffered
 		return buffered, nil
 
@@ -89,23 +165,7 @@ func (p *interp) getOutputStream(redirect Token, destValue value) (io.Writer, er
 		if p.noExec {
 			return nil, newError("can't write to pipe due to NoExec")
 		}
-		cmd := p.execShell(name)
-		w, err := cmd.StdinPipe()
-		if err != nil {
-			return nil, newError("error connecting to stdin pipe: %v", err)
-		}
-		cmd.Stdout = p.output
-		cmd.Stderr = p.errorOutput
-		p.flushOutputAndError() // ensure synchronization
-		err = cmd.Start()
-		if err != nil {
-			p.printErrorf("%s\n", err)
-			return ioutil.Discard, nil
-		}
-		p.commands[name] = cmd
-		buffered := newBufferedWriteCloser(w)
-		p.outputStreams[name] = buffered
-		return buffered, nil
+		return p.startOutputCommand(name)
 
 	default:
 		// Should never happen
@@ -113,17 +173,55 @@ func (p *interp) getOutputStream(redirect Token, destValue value) (io.Writer, er
 	}
 }
 
-// Executes code using configured system shell
-func (p *interp) execShell(code string) *exec.Cmd {
-	executable := p.shellCommand[0]
-	args := p.shellCommand[1:]
-	args = append(args, code)
-	cmd := exec.Command(executable, args...)
-	return cmd
+// Set environment variable name to value (or unset it if set is false)
+// in the environment of the commands run after this, and in ENVIRON,
+// for setenv() and unsetenv(). The environment starts as Config.Environ
+// if that's set, otherwise the process's environment, which isn't
+// changed (other interpreters in the process could be using it).
+func (p *interp) setenv(name, value string, set bool) error {
+	if name == "" || strings.ContainsAny(name, "=\x00") {
+		return newError("invalid environment variable name %q", name)
+	}
+	if p.environ == nil {
+		if p.configEnviron != nil {
+			p.environ = make([]string, 0, len(p.configEnviron)/2+1)
+			for i := 0; i < len(p.configEnviron); i += 2 {
+				p.environ = append(p.environ, p.configEnviron[i]+"="+p.configEnviron[i+1])
+			}
+		} else {
+			p.environ = os.Environ()
+		}
+	}
+	env := p.environ[:0]
+	for _, kv := range p.environ {
+		if !strings.HasPrefix(kv, name+"=") {
+			env = append(env, kv)
+		}
+	}
+	environ := p.array(ast.ScopeGlobal, p.program.Arrays["ENVIRON"])
+	if set {
+		env = append(env, name+"="+value)
+		environ.set(strKey(name), p.inputStr(value))
+	} else {
+		environ.delete(strKey(name))
+	}
+	p.environ = env
+	return nil
+}
+
+// Prefix of getline "file names" that are read as a string instead, as
+// in getline line < ("string://" s), which reads the records of s.
+const stringStreamPrefix = "string://"
+
+// Report whether the input file name is a URL that's opened with
+// Config.OpenURL.
+func (p *interp) isOpenURL(name string) bool {
+	return p.openURL != nil && strings.Contains(name, "://") &&
+		!strings.HasPrefix(name, stringStreamPrefix) && p.sourceOpener(name) == nil
 }
 
 // Get input Scanner to use for "getline" based on file name
-func (p *interp) getInputScannerFile(name string) (*bufio.Scanner, error) {
+func (p *interp) getInputScannerFile(name string) (*recordReader, error) {
 	if _, ok := p.outputStreams[name]; ok {
 		return nil, newError("can't read from writer stream")
 	}
@@ -139,10 +237,25 @@ func (p *interp) getInputScannerFile(name string) (*bufio.Scanner, error) {
 		p.scanners[name] = scanner
 		return scanner, nil
 	}
+	if strings.HasPrefix(name, stringStreamPrefix) {
+		// Read the records of the rest of the name (not a file)
+		r := ioutil.NopCloser(strings.NewReader(name[len(stringStreamPrefix):]))
+		scanner := p.newScanner(r)
+		p.scanners[name] = scanner
+		p.inputStreams[name] = r
+		return scanner, nil
+	}
 	if p.noFileReads {
 		return nil, newError("can't read from file due to NoFileReads")
 	}
-	r, err := os.Open(name)
+	p.pauseInput()
+	var r io.ReadCloser
+	var err error
+	if p.isOpenURL(name) {
+		r, err = p.openURL(name)
+	} else {
+		r, err = os.Open(name)
+	}
 	if err != nil {
 		return nil, err // *os.PathError is handled by caller (getline returns -1)
 	}
@@ -153,7 +266,7 @@ func (p *interp) getInputScannerFile(name string) (*bufio.Scanner, error) {
 }
 
 // Get input Scanner to use for "getline" based on pipe name
-func (p *interp) getInputScannerPipe(name string) (*bufio.Scanner, error) {
+func (p *interp) getInputScannerPipe(name string) (*recordReader, error) {
 	if _, ok := p.outputStreams[name]; ok {
 		return nil, newError("can't read from writer stream")
 	}
@@ -163,47 +276,44 @@ func (p *interp) getInputScannerPipe(name string) (*bufio.Scanner, error) {
 	if p.noExec {
 		return nil, newError("can't read from pipe due to NoExec")
 	}
-	cmd := p.execShell(name)
-	cmd.Stdin = p.stdin
-	cmd.Stderr = p.errorOutput
-	r, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, newError("error connecting to stdout pipe: %v", err)
+	return p.startInputCommand(name)
+}
+
+// Create a new buffered reader for input records
+func (p *interp) newScanner(input io.Reader) *recordReader {
+	return p.newRecordReader(input, &p.recordTerminator)
+}
+
+// Create the scanner for the current input file (or stdin).
+func (p *interp) newInputScanner() recordScanner {
+	if p.pipelineInput && p.input != p.stdin {
+		return p.newPipelinedScanner(p.input)
 	}
-	p.flushOutputAndError() // ensure synchronization
-	err = cmd.Start()
-	if err != nil {
-		p.printErrorf("%s\n", err)
-		return bufio.NewScanner(strings.NewReader("")), nil
+	if f, ok := p.input.(*mappedFile); ok {
+		return newMappedScanner(f.data, p.splitFunc(&p.recordTerminator))
 	}
-	scanner := p.newScanner(r)
-	p.commands[name] = cmd
-	p.inputStreams[name] = r
-	p.scanners[name] = scanner
-	return scanner, nil
+	return p.newScanner(p.input)
 }
 
-// Create a new buffered Scanner for reading input records
-func (p *interp) newScanner(input io.Reader) *bufio.Scanner {
-	scanner := bufio.NewScanner(input)
+// Return the split function for records separated by the current RS,
+// or nil for the Scanner default of splitting on newlines. Splitters
+// that determine the record terminator store it in *terminator.
+func (p *interp) splitFunc(terminator *string) bufio.SplitFunc {
 	switch {
 	case p.recordSep == "\n":
-		// Scanner default is to split on newlines
+		return nil
 	case p.recordSep == "":
 		// Empty string for RS means split on \n\n (blank lines)
-		splitter := blankLineSplitter{&p.recordTerminator}
-		scanner.Split(splitter.scan)
+		splitter := blankLineSplitter{terminator}
+		return splitter.scan
 	case len(p.recordSep) == 1:
 		splitter := byteSplitter{p.recordSep[0]}
-		scanner.Split(splitter.scan)
-	case utf8.RuneCountInString(p.recordSep) >= 1:
+		return splitter.scan
+	default:
 		// Multi-byte and single char but multi-byte RS use regex
-		splitter := regexSplitter{p.recordSepRegex, &p.recordTerminator}
-		scanner.Split(splitter.scan)
+		splitter := regexSplitter{p.recordSepRegex, terminator}
+		return splitter.scan
 	}
-	buffer := make([]byte, inputBufSize)
-	scanner.Buffer(buffer, maxRecordLength)
-	return scanner
 }
 
 // Copied from bufio/scan.go in the stdlib: I guess it's a bit more
@@ -335,7 +445,10 @@ func (p *interp) setFile(filename string) {
 func (p *interp) setLine(line string, isTrueStr bool) {
 	p.line = line
 	p.lineIsTrueStr = isTrueStr
+	p.lineDirty = false
 	p.haveFields = false
+	p.partialFields = false
+	p.colorRegexes = p.colorRegexes[:0]
 }
 
 // Ensure that the current line is parsed into fields, splitting it
@@ -346,24 +459,41 @@ func (p *interp) ensureFields() {
 	}
 	p.haveFields = true
 
+	// The slices holding the previous record's fields are only ever
+	// used by the interpreter, so reuse them for this record rather
+	// than allocating new ones each time.
+	var fields []string
+	if !p.noFieldReuse {
+		fields = p.fields[:0]
+	}
 	switch {
+	case p.partialFields && p.splitFieldsTo(-1):
+		// Some fields were split by getField, this split the rest
+		fields = p.fields
+		p.partialFields = false
+	case p.noFieldSplit:
+		if p.line != "" {
+			fields = append(fields, p.line)
+		}
 	case p.fieldSep == " ":
 		// FS space (default) means split fields on any whitespace
-		p.fields = strings.Fields(p.line)
+		fields = appendFields(fields, p.line)
 	case p.line == "":
-		p.fields = nil
-	case utf8.RuneCountInString(p.fieldSep) <= 1:
+	case len(p.fieldSep) == 1:
 		// 1-char FS is handled as plain split (not regex)
-		p.fields = strings.Split(p.line, p.fieldSep)
+		fields = appendSplit(fields, p.line, p.fieldSep[0])
+	case utf8.RuneCountInString(p.fieldSep) <= 1:
+		fields = strings.Split(p.line, p.fieldSep)
 	default:
 		// Split on FS as a regex
-		p.fields = p.fieldSepRegex.Split(p.line, -1)
+		fields = p.fieldSepRegex.Split(p.line, -1)
 	}
+	p.fields = fields
 
 	// Special case for when RS=="" and FS is single character,
 	// split on newline in addition to FS. See more here:
 	// https://www.gnu.org/software/gawk/manual/html_node/Multiple-Line.html
-	if p.recordSep == "" && utf8.RuneCountInString(p.fieldSep) == 1 {
+	if p.recordSep == "" && utf8.RuneCountInString(p.fieldSep) == 1 && !p.noFieldSplit {
 		fields := make([]string, 0, len(p.fields))
 		for _, field := range p.fields {
 			lines := strings.Split(field, "\n")
@@ -375,14 +505,149 @@ func (p *interp) ensureFields() {
 		p.fields = fields
 	}
 
-	p.fieldsIsTrueStr = make([]bool, len(p.fields))
+	if p.noFieldReuse || cap(p.fieldsIsTrueStr) < len(p.fields) {
+		p.fieldsIsTrueStr = make([]bool, len(p.fields))
+	} else {
+		p.fieldsIsTrueStr = p.fieldsIsTrueStr[:len(p.fields)]
+		for i := range p.fieldsIsTrueStr {
+			p.fieldsIsTrueStr[i] = false
+		}
+	}
 	p.numFields = len(p.fields)
 }
 
+// Split the current line into fields up to field number index (or to
+// the end of the line, if it has fewer fields or index is negative),
+// leaving the rest of it to split when it's needed. A program that only uses $1 of wide
+// records only splits off the first field, and the fields are
+// substrings of the line, so they aren't copied.
+//
+// This only handles the common cases of FS being a single space or a
+// single byte (and RS not being empty). It returns false if it can't
+// split the line, and the caller should use ensureFields instead.
+func (p *interp) splitFieldsTo(index int) bool {
+	if p.noFieldSplit || len(p.fieldSep) != 1 || p.recordSep == "" {
+		return false
+	}
+	if !p.partialFields {
+		p.partialFields = true
+		if p.noFieldReuse {
+			p.fields = nil
+		} else {
+			p.fields = p.fields[:0]
+		}
+		p.splitter = newFieldSplitter(p.line, p.fieldSep[0])
+	}
+	if index < 0 || len(p.fields) < index {
+		n := index - len(p.fields)
+		if index < 0 {
+			n = -1
+		}
+		p.fields = p.splitter.split(p.fields, n)
+		if p.splitter.unicode {
+			p.partialFields = false
+			return false
+		}
+	}
+	return true
+}
+
+// fieldSplitter splits a line into fields incrementally, on runs of
+// whitespace the same way as strings.Fields if sep is ' ', otherwise on
+// the single byte sep the same way as strings.Split (except that an
+// empty line has no fields). The fields are substrings of the line.
+type fieldSplitter struct {
+	rest    string // rest of the line after the fields so far
+	sep     byte
+	more    bool // whether rest has more fields
+	unicode bool // stopped at non-ASCII text when splitting on whitespace
+}
+
+func newFieldSplitter(line string, sep byte) fieldSplitter {
+	return fieldSplitter{rest: line, sep: sep, more: line != ""}
+}
+
+// Append up to n more fields to fields (all the rest of them if n is
+// negative) and return the result. When splitting on whitespace, it
+// stops and sets unicode at a field with non-ASCII bytes, as Unicode
+// whitespace is rare, so the caller should let strings.Fields handle
+// the line.
+func (s *fieldSplitter) split(fields []string, n int) []string {
+	if s.sep != ' ' {
+		for ; n != 0 && s.more; n-- {
+			i := strings.IndexByte(s.rest, s.sep)
+			if i < 0 {
+				fields = append(fields, s.rest)
+				s.more = false
+				break
+			}
+			fields = append(fields, s.rest[:i])
+			s.rest = s.rest[i+1:]
+		}
+		return fields
+	}
+	line := s.rest
+	i := 0
+	for ; n != 0 && s.more; n-- {
+		for i < len(line) && asciiSpace[line[i]] != 0 {
+			i++
+		}
+		start := i
+		for i < len(line) && asciiSpace[line[i]] == 0 {
+			if line[i] >= utf8.RuneSelf {
+				s.more = false
+				s.unicode = true
+				return fields
+			}
+			i++
+		}
+		if start == i {
+			s.more = false
+			break
+		}
+		fields = append(fields, line[start:i])
+	}
+	s.rest = line[i:]
+	return fields
+}
+
+// Append the whitespace-separated fields of line to fields, splitting
+// the same way as strings.Fields.
+func appendFields(fields []string, line string) []string {
+	n := len(fields)
+	s := newFieldSplitter(line, ' ')
+	fields = s.split(fields, -1)
+	if s.unicode {
+		return append(fields[:n], strings.Fields(line)...)
+	}
+	return fields
+}
+
+// Append the fields of line separated by the single byte sep to
+// fields, splitting the same way as strings.Split (but an empty line
+// has no fields).
+func appendSplit(fields []string, line string, sep byte) []string {
+	s := newFieldSplitter(line, sep)
+	return s.split(fields, -1)
+}
+
 // Fetch next line (record) of input from current input file, opening
 // next input file if done with previous one
 func (p *interp) nextLine() (string, error) {
+	if p.source != nil {
+		return p.nextSourceLine()
+	}
 	for {
+		if p.argSource != nil {
+			line, ok, err := p.nextArgSourceLine()
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				return line, nil
+			}
+			continue
+		}
 		if p.scanner == nil {
 			if prevInput, ok := p.input.(io.Closer); ok && p.input != p.stdin {
 				// Previous input is file, close it
@@ -402,10 +667,10 @@ func (p *interp) nextLine() (string, error) {
 				// Fetch next filename from ARGV. Can't use
 				// getArrayValue() here as it would set the value if
 				// not present
-				index := strconv.Itoa(p.filenameIndex)
 				argvIndex := p.program.Arrays["ARGV"]
 				argvArray := p.array(ast.ScopeGlobal, argvIndex)
-				filename := p.toString(argvArray[index])
+				arg, _ := argvArray.get(arrayKey{n: p.filenameIndex, isInt: true})
+				filename := p.toString(arg)
 				p.filenameIndex++
 
 				// Is it actually a var=value assignment?
@@ -427,19 +692,31 @@ func (p *interp) nextLine() (string, error) {
 					p.setFile("")
 				} else {
 					// A regular file name, open it
-					if p.noFileReads {
+					if p.noFileReads && !p.argFiles[filename] {
 						return "", newError("can't read from file due to NoFileReads")
 					}
-					input, err := os.Open(filename)
+					if open := p.sourceOpener(filename); open != nil {
+						source, err := open(filename)
+						if err != nil {
+							return "", err
+						}
+						p.input = nil
+						p.argSource = source
+						p.setFile(filename)
+						p.hadFiles = true
+						continue
+					}
+					input, err := p.openInputFile(filename)
 					if err != nil {
 						return "", err
 					}
 					p.input = input
 					p.setFile(filename)
 					p.hadFiles = true
+					p.startPrefetch()
 				}
 			}
-			p.scanner = p.newScanner(p.input)
+			p.scanner = p.newInputScanner()
 		}
 		p.recordTerminator = p.recordSep // will be overridden if RS is "" or multiple chars
 		if p.scanner.Scan() {
@@ -476,6 +753,8 @@ func writeOutput(w io.Writer, s string) error {
 
 // Close all streams, commands, and so on (after program execution).
 func (p *interp) closeAll() {
+	p.cancelPrefetch()
+	p.pauseInput() // stop reading before the input is closed
 	if prevInput, ok := p.input.(io.Closer); ok {
 		_ = prevInput.Close()
 	}
@@ -485,10 +764,16 @@ func (p *interp) closeAll() {
 	for _, w := range p.outputStreams {
 		_ = w.Close()
 	}
-	for _, cmd := range p.commands {
-		_ = cmd.Wait()
+	p.waitCommands()
+	if p.argSource != nil {
+		p.closeArgSource()
 	}
-	if f, ok := p.output.(flusher); ok {
+	p.closeDatabases()
+	p.closeRedis()
+	p.closeDiskArrays()
+	if w, ok := p.output.(*bufferedWriteCloser); ok {
+		_ = w.Close() // standard output, which this doesn't close
+	} else if f, ok := p.output.(flusher); ok {
 		_ = f.Flush()
 	}
 	if f, ok := p.errorOutput.(flusher); ok {
@@ -0,0 +1,93 @@
+// Matching regexes that are alternations of literal strings
+
+package interp
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// matcher reports whether a string contains a match of a regex. It's
+// implemented by *regexp.Regexp and by literalMatcher, which can be
+// used instead for regexes like "ERROR|WARN|FATAL".
+type matcher interface {
+	MatchString(s string) bool
+}
+
+// Alternations of up to this many literals are matched by searching for
+// each literal in turn, which with strings.Contains is much faster than
+// a single pass of the regexp engine. Longer ones look for the first
+// bytes of the literals in a single pass.
+const maxLiteralSearches = 8
+
+// literalMatcher matches a string that contains any of its literals.
+type literalMatcher struct {
+	literals []string
+	first    *[256][]string // literals by first byte, if there are lots
+}
+
+// Return a literalMatcher for regex if it's a plain alternation of
+// literals, otherwise nil.
+func newLiteralMatcher(regex string) *literalMatcher {
+	literals := strings.Split(regex, "|")
+	for _, lit := range literals {
+		// An empty alternative matches everything, and U+FFFD in the
+		// regex matches invalid UTF-8 in the input
+		if lit == "" || regexp.QuoteMeta(lit) != lit ||
+			!utf8.ValidString(lit) || strings.ContainsRune(lit, utf8.RuneError) {
+			return nil
+		}
+	}
+	m := &literalMatcher{literals: literals}
+	if len(literals) > maxLiteralSearches {
+		m.first = new([256][]string)
+		for _, lit := range literals {
+			m.first[lit[0]] = append(m.first[lit[0]], lit)
+		}
+	}
+	return m
+}
+
+func (m *literalMatcher) MatchString(s string) bool {
+	if m.first == nil {
+		for _, lit := range m.literals {
+			if strings.Contains(s, lit) {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		for _, lit := range m.first[s[i]] {
+			if strings.HasPrefix(s[i:], lit) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Return a matcher for the compiled regex re: a literalMatcher if it's
+// an alternation of literals, otherwise re itself.
+func regexMatcher(re *regexp.Regexp) matcher {
+	if m := newLiteralMatcher(re.String()); m != nil {
+		return m
+	}
+	return re
+}
+
+// Compile regex string to a matcher (or fetch it from the cache). This
+// is like compileRegex, for when only MatchString is needed.
+func (p *interp) compileMatcher(regex string) (matcher, error) {
+	if m, ok := p.matcherCache.get(regex); ok {
+		return m.(matcher), nil
+	}
+	re, err := p.compileRegex(regex)
+	if err != nil {
+		return nil, err
+	}
+	m := regexMatcher(re)
+	p.matcherCache.add(regex, m)
+	return m, nil
+}
@@ -0,0 +1,160 @@
+// Per-interpreter locale settings
+
+package interp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Locale holds the locale-specific settings for a single interpreter
+// (see Config.Locale). GoAWK doesn't read the process-wide locale
+// environment variables, so interpreters running concurrently can each
+// use a different locale. Zero-valued fields use the behaviour of the
+// POSIX "C" locale.
+type Locale struct {
+	// Name of the locale, for example "de_DE.UTF-8". Informational
+	// only: GoAWK doesn't load locale data by name.
+	Name string
+
+	// Case conversion functions used by toupper() and tolower(). If
+	// nil, strings.ToUpper and strings.ToLower are used.
+	ToUpper func(s string) string
+	ToLower func(s string) string
+
+	// Collate compares two strings, returning a negative number if
+	// a sorts before b, zero if they're equal, or a positive number if
+	// a sorts after b. It's used when sorting string keys, for example
+	// in dumparr(). If nil, strings are compared byte by byte.
+	Collate func(a, b string) int
+
+	// Radix character used when formatting floating point numbers
+	// with printf and sprintf (default ".").
+	DecimalPoint string
+
+	// Month and weekday names for time formatting, starting with
+	// January and Sunday respectively. If nil, English names are used;
+	// otherwise they must have 12 and 7 elements.
+	MonthNames      []string
+	ShortMonthNames []string
+	DayNames        []string
+	ShortDayNames   []string
+}
+
+var (
+	defaultMonthNames = []string{"January", "February", "March", "April", "May", "June",
+		"July", "August", "September", "October", "November", "December"}
+	defaultShortMonthNames = []string{"Jan", "Feb", "Mar", "Apr", "May", "Jun",
+		"Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}
+	defaultDayNames      = []string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"}
+	defaultShortDayNames = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+)
+
+// Return a copy of locale with defaults filled in for zero-valued
+// fields, or an error if the locale is invalid.
+func resolveLocale(locale *Locale) (*Locale, error) {
+	l := &Locale{}
+	if locale != nil {
+		*l = *locale
+	}
+	if l.Name == "" {
+		l.Name = "C"
+	}
+	if l.ToUpper == nil {
+		l.ToUpper = strings.ToUpper
+	}
+	if l.ToLower == nil {
+		l.ToLower = strings.ToLower
+	}
+	if l.Collate == nil {
+		l.Collate = strings.Compare
+	}
+	if l.DecimalPoint == "" {
+		l.DecimalPoint = "."
+	}
+	names := []struct {
+		field    string
+		names    *[]string
+		defaults []string
+	}{
+		{"MonthNames", &l.MonthNames, defaultMonthNames},
+		{"ShortMonthNames", &l.ShortMonthNames, defaultShortMonthNames},
+		{"DayNames", &l.DayNames, defaultDayNames},
+		{"ShortDayNames", &l.ShortDayNames, defaultShortDayNames},
+	}
+	for _, n := range names {
+		if *n.names == nil {
+			*n.names = n.defaults
+		} else if len(*n.names) != len(n.defaults) {
+			return nil, newError("Locale.%s must have %d elements, not %d", n.field, len(n.defaults), len(*n.names))
+		}
+	}
+	return l, nil
+}
+
+// Return a Config.NumberParser for input numbers with the given
+// decimal point (not "."), which tries parser first if it's not nil.
+func localeNumberParser(point string, parser func(s string) (float64, bool)) func(s string) (float64, bool) {
+	return func(s string) (float64, bool) {
+		if parser != nil {
+			if n, ok := parser(s); ok {
+				return n, true
+			}
+		}
+		return parseLocaleNumber(s, point)
+	}
+}
+
+// Parse s as a decimal number with the given decimal point (and
+// optional sign, exponent, and surrounding whitespace), like "-3,14".
+// Strings without that decimal point return false, so they're
+// converted with the usual rules.
+func parseLocaleNumber(s, point string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	i := strings.Index(s, point)
+	if i < 0 {
+		return 0, false
+	}
+	s = s[:i] + "." + s[i+len(point):]
+	for j := 0; j < len(s); j++ {
+		switch c := s[j]; {
+		case c >= '0' && c <= '9', c == '.', c == '+', c == '-', c == 'e', c == 'E':
+		default:
+			return 0, false // rule out "inf", hex, and so on
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return 0, false
+	}
+	return n, true
+}
+
+// Wraps a float64 printf argument to format it with a non-"." decimal
+// point.
+type localeFloat struct {
+	n     float64
+	point string
+}
+
+func (f localeFloat) Format(state fmt.State, verb rune) {
+	spec := []byte{'%'}
+	for _, flag := range "-+# 0" {
+		if state.Flag(int(flag)) {
+			spec = append(spec, byte(flag))
+		}
+	}
+	if width, ok := state.Width(); ok {
+		spec = strconv.AppendInt(spec, int64(width), 10)
+	}
+	if prec, ok := state.Precision(); ok {
+		spec = append(spec, '.')
+		spec = strconv.AppendInt(spec, int64(prec), 10)
+	}
+	spec = append(spec, string(verb)...)
+	s := fmt.Sprintf(string(spec), f.n)
+	_, _ = io.WriteString(state, strings.Replace(s, ".", f.point, 1))
+}
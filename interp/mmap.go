@@ -0,0 +1,120 @@
+// Scanning input files from a memory mapping (Config.MmapFiles)
+
+package interp
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// Scanner of input records: a *recordReader, or a mappedScanner for a
+// memory-mapped input file.
+type recordScanner interface {
+	Scan() bool
+	Text() string
+	Err() error
+}
+
+// mappedFile is an input file that's mapped into memory. Records are
+// scanned directly from the mapping, so there's no read system call
+// per buffer and no copy of the data into a scanner buffer. It
+// implements io.ReadCloser, but is only read via a mappedScanner.
+type mappedFile struct {
+	file   *os.File
+	data   []byte
+	offset int // for Read
+	closed bool
+}
+
+// Open and map the named file, or return nil and no error if it's not
+// a regular file or can't be mapped (the caller falls back to reading
+// it the usual way). Pipes, devices, and stdin are never mapped.
+func mapFile(name string) (*mappedFile, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() != int64(int(info.Size())) {
+		_ = file.Close()
+		return nil, nil
+	}
+	var data []byte
+	if info.Size() > 0 {
+		data, err = mmap(file, int(info.Size()))
+		if err != nil {
+			_ = file.Close()
+			return nil, nil
+		}
+	}
+	return &mappedFile{file: file, data: data}, nil
+}
+
+func (f *mappedFile) Read(b []byte) (int, error) {
+	if f.offset >= len(f.data) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.data[f.offset:])
+	f.offset += n
+	return n, nil
+}
+
+// Close unmaps and closes the file. Like os.File, it can be called
+// more than once.
+func (f *mappedFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	if f.data != nil {
+		_ = munmap(f.data)
+		f.data = nil
+	}
+	return f.file.Close()
+}
+
+// mappedScanner scans records from data (all of a mapped file) with a
+// split function, the way a bufio.Scanner does, but without copying
+// the data or limiting the length of a record.
+type mappedScanner struct {
+	data  []byte
+	split bufio.SplitFunc
+	token []byte
+	err   error
+}
+
+func newMappedScanner(data []byte, split bufio.SplitFunc) *mappedScanner {
+	if split == nil {
+		split = bufio.ScanLines
+	}
+	return &mappedScanner{data: data, split: split}
+}
+
+func (s *mappedScanner) Scan() bool {
+	for s.err == nil && len(s.data) > 0 {
+		advance, token, err := s.split(s.data, true)
+		if err != nil {
+			s.err = err
+			return false
+		}
+		if advance <= 0 || advance > len(s.data) {
+			// Like bufio.Scanner, stop if there's no final token
+			return false
+		}
+		s.data = s.data[advance:]
+		if token != nil {
+			s.token = token
+			return true
+		}
+	}
+	return false
+}
+
+func (s *mappedScanner) Text() string {
+	return string(s.token)
+}
+
+func (s *mappedScanner) Err() error {
+	return s.err
+}
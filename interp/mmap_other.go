@@ -0,0 +1,19 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package interp
+
+import (
+	"errors"
+	"os"
+)
+
+const mmapSupported = false
+
+func mmap(file *os.File, size int) ([]byte, error) {
+	return nil, errors.New("mmap not supported on this platform")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
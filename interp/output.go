@@ -0,0 +1,110 @@
+// Buffered output to stdout, files, and commands (see Config.OutputBufferSize)
+
+package interp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bufferedWriteCloser is the buffered writer for standard output (when
+// Config.Output isn't set) and for output redirected to files and
+// commands, so each print isn't a system call. It flushes according to
+// the Config's flush policy: after each newline if line buffered, and
+// every flush interval if that's set. The interval flushes are done by
+// a background goroutine, so the writer is guarded by a mutex then.
+type bufferedWriteCloser struct {
+	writer       *bufio.Writer
+	closer       io.Closer // nil for standard output
+	lineBuffered bool
+	mu           *sync.Mutex   // nil if there are no interval flushes
+	stop         chan struct{} // closed to stop the interval flushes
+	stopped      bool
+}
+
+// Create a buffered writer for w using the configured buffer size and
+// flush policy. If closer isn't nil, Close flushes and closes it.
+func (p *interp) newBufferedWriteCloser(w io.Writer, closer io.Closer) *bufferedWriteCloser {
+	wc := &bufferedWriteCloser{
+		writer:       bufio.NewWriterSize(w, p.outputBufSize),
+		closer:       closer,
+		lineBuffered: p.outputLineBuffered,
+	}
+	if p.outputFlushInterval > 0 {
+		wc.mu = &sync.Mutex{}
+		wc.stop = make(chan struct{})
+		go wc.flushEvery(p.outputFlushInterval)
+	}
+	return wc
+}
+
+func (wc *bufferedWriteCloser) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			wc.mu.Lock()
+			if wc.writer.Buffered() > 0 {
+				// An error is returned by the next write or flush
+				_ = wc.writer.Flush()
+			}
+			wc.mu.Unlock()
+		case <-wc.stop:
+			return
+		}
+	}
+}
+
+func (wc *bufferedWriteCloser) Write(b []byte) (int, error) {
+	if wc.mu != nil {
+		wc.mu.Lock()
+		defer wc.mu.Unlock()
+	}
+	n, err := wc.writer.Write(b)
+	if err == nil && wc.lineBuffered && bytes.IndexByte(b, '\n') >= 0 {
+		err = wc.writer.Flush()
+	}
+	return n, err
+}
+
+func (wc *bufferedWriteCloser) WriteString(s string) (int, error) {
+	if wc.mu != nil {
+		wc.mu.Lock()
+		defer wc.mu.Unlock()
+	}
+	n, err := wc.writer.WriteString(s)
+	if err == nil && wc.lineBuffered && strings.IndexByte(s, '\n') >= 0 {
+		err = wc.writer.Flush()
+	}
+	return n, err
+}
+
+func (wc *bufferedWriteCloser) Flush() error {
+	if wc.mu != nil {
+		wc.mu.Lock()
+		defer wc.mu.Unlock()
+	}
+	return wc.writer.Flush()
+}
+
+// Close stops the interval flushes, flushes the output, and closes the
+// underlying writer (unless it's standard output).
+func (wc *bufferedWriteCloser) Close() error {
+	if wc.stop != nil && !wc.stopped {
+		close(wc.stop)
+		wc.stopped = true
+	}
+	err := wc.Flush()
+	if err != nil {
+		return err
+	}
+	if wc.closer == nil {
+		return nil
+	}
+	return wc.closer.Close()
+}
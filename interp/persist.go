@@ -0,0 +1,276 @@
+// Persistent arrays, loaded from and saved to stores between runs (see
+// Config.PersistentArrays)
+
+package interp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ArrayStore is where the elements of a persistent array are kept
+// between runs (see Config.PersistentArrays). NewDiskArrayStore returns
+// one whose array is kept in a file as the program runs, and
+// NewFileArrayStore one that's loaded from and saved to a text file;
+// other implementations could use a key-value database like bbolt or
+// Badger.
+type ArrayStore interface {
+	// Load calls set with the key and value of each element in the
+	// store, in any order.
+	Load(set func(key, value string)) error
+
+	// Save replaces the elements in the store with elements.
+	Save(elements map[string]string) error
+}
+
+// A global array and the store it persists to.
+type persistentArray struct {
+	name  string
+	index int
+	store ArrayStore
+}
+
+// Load the elements of the program's persistent arrays from their
+// stores, and record the arrays for savePersistentArrays. Arrays that
+// the program doesn't use are ignored.
+func (p *interp) loadPersistentArrays(stores map[string]ArrayStore) error {
+	p.persistentArrays = nil
+	for name, store := range stores {
+		index, ok := p.program.Arrays[name]
+		if !ok {
+			if _, ok := p.program.Scalars[name]; ok {
+				return newError("can't use scalar %q as persistent array", name)
+			}
+			continue
+		}
+		p.persistentArrays = append(p.persistentArrays, persistentArray{name, index, store})
+	}
+	sort.Slice(p.persistentArrays, func(i, j int) bool {
+		return p.persistentArrays[i].name < p.persistentArrays[j].name
+	})
+	for _, a := range p.persistentArrays {
+		array := p.arrays[a.index]
+		if path, ok := a.store.(diskArrayStore); ok {
+			disk, err := openDiskArray(string(path))
+			if err != nil {
+				p.closeDiskArrays()
+				return newError("can't load persistent array %q: %v", a.name, err)
+			}
+			array.disk = disk
+			continue
+		}
+		err := a.store.Load(func(key, value string) {
+			array.set(strKey(key), p.inputStr(value))
+		})
+		if err != nil {
+			p.closeDiskArrays()
+			return newError("can't load persistent array %q: %v", a.name, err)
+		}
+	}
+	return nil
+}
+
+// Save the elements of the program's persistent arrays to their
+// stores, after the program has finished without an error. Disk-backed
+// arrays are already saved, and their files are closed.
+func (p *interp) savePersistentArrays() error {
+	for _, a := range p.persistentArrays {
+		array := p.arrays[a.index]
+		if array.disk != nil {
+			err := p.closeDiskArray(a.index)
+			if err != nil {
+				return newError("can't save persistent array %q: %v", a.name, err)
+			}
+			continue
+		}
+		elements := make(map[string]string, array.len())
+		_ = array.each(func(key string, v value) error {
+			elements[key] = p.toString(v)
+			return nil
+		})
+		err := a.store.Save(elements)
+		if err != nil {
+			return newError("can't save persistent array %q: %v", a.name, err)
+		}
+	}
+	return nil
+}
+
+// Close the file of the disk-backed array at index, and replace the
+// array with an empty one.
+func (p *interp) closeDiskArray(index int) error {
+	err := p.arrays[index].disk.close()
+	p.arrays[index] = newArray(p.orderedArrays)
+	return err
+}
+
+// Close the files of any disk-backed arrays that are still open (after
+// an error).
+func (p *interp) closeDiskArrays() {
+	for _, a := range p.persistentArrays {
+		if p.arrays[a.index].disk != nil {
+			_ = p.closeDiskArray(a.index)
+		}
+	}
+}
+
+// NewDiskArrayStore returns an ArrayStore for an array whose elements
+// are kept in the file at path, which is created if it doesn't exist,
+// so the array can be larger than memory. Unlike other stores, the
+// array isn't loaded into memory before the program runs: the file is
+// a hash table, and each element is read from it and written to it as
+// the program uses the element. So changes are kept even if the
+// program fails, and values keep their types (a number stays a
+// number). Elements are visited in the order they were added.
+//
+// The file should only be used by one program at a time. If a program
+// is killed while using it, it's repaired the next time it's opened,
+// though the last change may be lost.
+//
+// The store's Load and Save methods read and replace the elements of
+// the file, for use outside Config.PersistentArrays.
+func NewDiskArrayStore(path string) ArrayStore {
+	return diskArrayStore(path)
+}
+
+type diskArrayStore string
+
+func (s diskArrayStore) Load(set func(key, value string)) (err error) {
+	if _, err := os.Stat(string(s)); os.IsNotExist(err) {
+		return nil
+	}
+	disk, err := openDiskArray(string(s))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := disk.close(); err == nil {
+			err = closeErr
+		}
+	}()
+	defer catchDiskArrayError(&err)
+	return disk.each(func(key string, v value) error {
+		set(key, v.str("%.6g"))
+		return nil
+	})
+}
+
+func (s diskArrayStore) Save(elements map[string]string) (err error) {
+	disk, err := openDiskArray(string(s))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := disk.close(); err == nil {
+			err = closeErr
+		}
+	}()
+	defer catchDiskArrayError(&err)
+	keys := make([]string, 0, len(elements))
+	for key := range elements {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	disk.clear()
+	for _, key := range keys {
+		disk.set(key, numStr(elements[key]))
+	}
+	return nil
+}
+
+// NewFileArrayStore returns an ArrayStore that keeps the elements in
+// the file at path, one per line: the key and the value, each quoted
+// like a Go string, separated by a tab. Loading from a file that
+// doesn't exist gives no elements. Save writes the elements in key
+// order to a temporary file that's then renamed over the old one (and
+// given its permissions), so that a failed save doesn't lose the
+// previous elements.
+func NewFileArrayStore(path string) ArrayStore {
+	return fileArrayStore(path)
+}
+
+type fileArrayStore string
+
+func (s fileArrayStore) Load(set func(key, value string)) error {
+	f, err := os.Open(string(s))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	for lineNum := 1; ; lineNum++ {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		tab := strings.IndexByte(line, '\t')
+		if tab < 0 {
+			return fmt.Errorf("%s:%d: expected tab between key and value", s, lineNum)
+		}
+		key, err := strconv.Unquote(line[:tab])
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid key: %v", s, lineNum, err)
+		}
+		value, err := strconv.Unquote(line[tab+1:])
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid value: %v", s, lineNum, err)
+		}
+		set(key, value)
+	}
+}
+
+func (s fileArrayStore) Save(elements map[string]string) error {
+	keys := make([]string, 0, len(elements))
+	for key := range elements {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	path := string(s)
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	// The temporary file is created with mode 0600, so give it the old
+	// file's mode (or 0644 for a new file) before it replaces that
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	err = f.Chmod(mode)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	writer := bufio.NewWriter(f)
+	for _, key := range keys {
+		_, _ = writer.WriteString(strconv.Quote(key) + "\t" + strconv.Quote(elements[key]) + "\n")
+	}
+	err = writer.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+// Reading input records in a separate goroutine (Config.PipelineInput)
+
+package interp
+
+import (
+	"io"
+)
+
+const (
+	pipelineBatchRecords = 256       // batch at most this many records
+	pipelineBatchBytes   = 64 * 1024 // or about this many bytes of them
+)
+
+// pipelinedScanner scans the records of an input file in a background
+// goroutine, sending them to the interpreter in batches, so reading
+// and splitting records overlaps with executing the program. The
+// goroutine fills one batch while the interpreter works through the
+// previous one, so it reads at most two batches ahead.
+//
+// Records are returned in order, so NR and a plain getline work as
+// usual. Before anything that could change the input file or compete
+// for it, like opening a file for writing, running a command, or
+// opening a file for getline, the interpreter pauses the goroutine
+// (see pauseInput), and it only reads on once the records it already
+// read have been used.
+type pipelinedScanner struct {
+	scanner    recordScanner // only used by the goroutine while running
+	recordSep  string
+	readTerm   string  // set by the scanner's splitter (in the goroutine)
+	terminator *string // interpreter's RT, set for each record
+
+	batches chan *recordBatch
+	free    chan *recordBatch // used batches to fill again
+	stop    chan struct{}     // closed to pause the goroutine
+	done    chan struct{}     // closed when the goroutine has finished
+	running bool
+	pending *recordBatch // batch filled when the goroutine was paused
+
+	batch *recordBatch // batch being returned by Scan
+	pos   int
+	text  string
+	err   error
+}
+
+type recordBatch struct {
+	records     []string
+	terminators []string
+	eof         bool  // no more records after these
+	err         error // read error at EOF, if any
+}
+
+func (p *interp) newPipelinedScanner(input io.Reader) *pipelinedScanner {
+	s := &pipelinedScanner{
+		recordSep:  p.recordSep,
+		terminator: &p.recordTerminator,
+		batches:    make(chan *recordBatch),
+		free:       make(chan *recordBatch, 1),
+	}
+	if f, ok := input.(*mappedFile); ok {
+		s.scanner = newMappedScanner(f.data, p.splitFunc(&s.readTerm))
+	} else {
+		s.scanner = p.newRecordReader(input, &s.readTerm)
+	}
+	return s
+}
+
+func (s *pipelinedScanner) start() {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	s.running = true
+	go s.read(s.pending)
+	s.pending = nil
+}
+
+// Read batches of records and send them to Scan until EOF or paused.
+// If batch isn't nil, it's a batch filled before a pause, to be sent
+// first.
+func (s *pipelinedScanner) read(batch *recordBatch) {
+	defer close(s.done)
+	for {
+		if batch == nil {
+			batch = s.fill()
+		}
+		select {
+		case s.batches <- batch:
+		case <-s.stop:
+			s.pending = batch
+			return
+		}
+		if batch.eof {
+			return
+		}
+		batch = nil
+	}
+}
+
+func (s *pipelinedScanner) fill() *recordBatch {
+	var batch *recordBatch
+	select {
+	case batch = <-s.free:
+		batch.records = batch.records[:0]
+		batch.terminators = batch.terminators[:0]
+	default:
+		batch = &recordBatch{}
+	}
+	size := 0
+	for len(batch.records) < pipelineBatchRecords && size < pipelineBatchBytes {
+		s.readTerm = s.recordSep // overridden if RS is "" or multiple chars
+		if !s.scanner.Scan() {
+			batch.eof = true
+			batch.err = s.scanner.Err()
+			break
+		}
+		text := s.scanner.Text()
+		batch.records = append(batch.records, text)
+		batch.terminators = append(batch.terminators, s.readTerm)
+		size += len(text)
+	}
+	return batch
+}
+
+func (s *pipelinedScanner) Scan() bool {
+	for {
+		if s.batch != nil && s.pos < len(s.batch.records) {
+			s.text = s.batch.records[s.pos]
+			*s.terminator = s.batch.terminators[s.pos]
+			s.pos++
+			return true
+		}
+		if s.batch != nil {
+			if s.batch.eof {
+				s.err = s.batch.err
+				return false
+			}
+			select {
+			case s.free <- s.batch:
+			default:
+			}
+			s.batch = nil
+		}
+		if !s.running {
+			s.start()
+		}
+		s.batch = <-s.batches
+		s.pos = 0
+		if s.batch.eof {
+			// Wait for the goroutine to finish before the input is closed
+			<-s.done
+			s.running = false
+		}
+	}
+}
+
+func (s *pipelinedScanner) Text() string {
+	return s.text
+}
+
+func (s *pipelinedScanner) Err() error {
+	return s.err
+}
+
+// Stop the goroutine reading ahead and wait for it to finish. Records
+// it has already read are kept for Scan, which starts it again when
+// it needs more.
+func (s *pipelinedScanner) pause() {
+	if !s.running {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.running = false
+}
+
+// Pause reading the input in the background, if it's pipelined.
+func (p *interp) pauseInput() {
+	if s, ok := p.scanner.(*pipelinedScanner); ok {
+		s.pause()
+	}
+}
@@ -0,0 +1,215 @@
+// Reading the next input file in the background (Config.PrefetchFiles)
+
+package interp
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/benhoyt/goawk/ast"
+)
+
+const (
+	prefetchChunkSize = 64 * 1024
+	prefetchChunks    = 16 // read at most this many chunks ahead
+)
+
+// gzipMagic is the first two bytes of a gzip-compressed file.
+const gzipMagic = "\x1f\x8b"
+
+// prefetchedFile is an input file that's being read (and decompressed,
+// if it's compressed with gzip) by a background goroutine, so reading
+// it overlaps with processing the input before it. It implements
+// io.ReadCloser.
+type prefetchedFile struct {
+	name   string
+	file   *os.File
+	chunks chan []byte   // closed after the last chunk (and err is set)
+	stop   chan struct{} // closed to stop the goroutine early
+	err    error         // read error, or nil for EOF
+	chunk  []byte        // unread part of the current chunk
+	closed bool
+}
+
+// Open the named file and start reading it in the background, or
+// return nil if it can't be opened (the error is reported when the
+// file is opened for real) or isn't a regular file. Reading ahead from
+// a device or named pipe could take input meant for someone else.
+func prefetchFile(name string) *prefetchedFile {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		_ = file.Close()
+		return nil
+	}
+	f := &prefetchedFile{
+		name:   name,
+		file:   file,
+		chunks: make(chan []byte, prefetchChunks),
+		stop:   make(chan struct{}),
+	}
+	go f.readAll()
+	return f
+}
+
+func (f *prefetchedFile) readAll() {
+	defer close(f.chunks)
+	r, err := gunzipIfCompressed(f.file)
+	if err != nil {
+		f.err = err
+		return
+	}
+	for {
+		chunk := make([]byte, prefetchChunkSize)
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			select {
+			case f.chunks <- chunk[:n]:
+			case <-f.stop:
+				return
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return
+		}
+		if err != nil {
+			f.err = err
+			return
+		}
+	}
+}
+
+func (f *prefetchedFile) Read(b []byte) (int, error) {
+	if len(f.chunk) == 0 {
+		chunk, ok := <-f.chunks
+		if !ok {
+			if f.err != nil {
+				return 0, f.err
+			}
+			return 0, io.EOF
+		}
+		f.chunk = chunk
+	}
+	n := copy(b, f.chunk)
+	f.chunk = f.chunk[n:]
+	return n, nil
+}
+
+// Close stops the background reads and closes the file. Like
+// os.File, it can be called more than once.
+func (f *prefetchedFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	close(f.stop)
+	for range f.chunks {
+		// Wait for the goroutine to finish before closing the file
+	}
+	return f.file.Close()
+}
+
+// Return a reader that decompresses r if it starts with the gzip magic
+// bytes, otherwise one that reads it as is.
+func gunzipIfCompressed(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, prefetchChunkSize)
+	magic, _ := br.Peek(len(gzipMagic)) // a read error is returned by the next Read
+	if string(magic) != gzipMagic {
+		return br, nil
+	}
+	return gzip.NewReader(br)
+}
+
+// gunzippedFile is an input file that wasn't prefetched, which is
+// decompressed as it's read if it's compressed with gzip.
+type gunzippedFile struct {
+	file *os.File
+	r    io.Reader // nil until the first Read
+	err  error
+}
+
+func (f *gunzippedFile) Read(b []byte) (int, error) {
+	if f.r == nil && f.err == nil {
+		f.r, f.err = gunzipIfCompressed(f.file)
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	return f.r.Read(b)
+}
+
+func (f *gunzippedFile) Close() error {
+	return f.file.Close()
+}
+
+// Start reading the next file in ARGV, if it's a file name, in the
+// background. This is called after opening each input file. Nothing
+// is prefetched while output files or commands are open, as they
+// might be writing to the next file.
+func (p *interp) startPrefetch() {
+	p.cancelPrefetch()
+	if !p.prefetchFiles || p.mmapFiles || p.filenameIndex >= p.argc || len(p.outputStreams) > 0 {
+		return
+	}
+	argvIndex := p.program.Arrays["ARGV"]
+	argvArray := p.array(ast.ScopeGlobal, argvIndex)
+	arg, _ := argvArray.get(arrayKey{n: p.filenameIndex, isInt: true})
+	filename := p.toString(arg)
+	if filename == "" || filename == "-" || varRegex.MatchString(filename) ||
+		(p.noFileReads && !p.argFiles[filename]) || p.sourceOpener(filename) != nil ||
+		p.isOpenURL(filename) {
+		return
+	}
+	p.prefetch = prefetchFile(filename)
+}
+
+// Return the prefetched file if it's the one named, otherwise open it
+// the usual way.
+func (p *interp) openInputFile(filename string) (io.Reader, error) {
+	if p.prefetch != nil && p.prefetch.name == filename {
+		f := p.prefetch
+		p.prefetch = nil
+		return f, nil
+	}
+	// ARGV has changed since the prefetch started
+	p.cancelPrefetch()
+	if p.isOpenURL(filename) {
+		return p.openURL(filename)
+	}
+	if p.mmapFiles {
+		f, err := mapFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			return f, nil
+		}
+	}
+	input, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if p.prefetchFiles {
+		// Decompress the same files as a prefetch would have
+		info, err := input.Stat()
+		if err == nil && info.Mode().IsRegular() {
+			return &gunzippedFile{file: input}, nil
+		}
+	}
+	return input, nil
+}
+
+// Stop and discard any prefetched file. This is done before anything
+// that could change the file, like writing to a file or running a
+// command, so that it's read afresh when it's opened.
+func (p *interp) cancelPrefetch() {
+	if p.prefetch != nil {
+		_ = p.prefetch.Close()
+		p.prefetch = nil
+	}
+}
@@ -0,0 +1,230 @@
+// Profiling of time spent in each part of a program
+
+package interp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/benhoyt/goawk/internal/compiler"
+	"github.com/benhoyt/goawk/parser"
+)
+
+// Profile accumulates how many times the BEGIN and END blocks, each
+// pattern-action block, and each user-defined function of a program
+// run, and how long they take. Pass a Profile to one or more
+// executions of the program via Config.Profile, then call Entries or
+// WriteReport. Timing every block and function call slows execution
+// down, so only set Config.Profile when you want the results. A
+// Profile isn't safe for use by concurrent executions.
+type Profile struct {
+	program   *parser.Program
+	begin     ProfileEntry
+	actions   []ProfileEntry
+	end       ProfileEntry
+	functions []ProfileEntry
+	active    []int // number of active calls of each function
+}
+
+// ProfileEntry holds the profile of one part of a program.
+type ProfileEntry struct {
+	// "BEGIN", "END", "action" (for a pattern-action block), or
+	// "function", and the function's name for functions.
+	Kind string
+	Name string
+
+	// Line and column the part starts on (the first statement for
+	// functions), or 0 if they aren't known.
+	Line   int
+	Column int
+
+	// Number of times it ran: for actions, this is the number of
+	// records its pattern was tested on, and Matched is the number of
+	// those the pattern matched.
+	Count   int
+	Matched int
+
+	// Total elapsed time, including the time spent in any functions it
+	// calls. Recursive calls are only timed once, in the outermost call.
+	Time time.Duration
+}
+
+// NewProfile creates a Profile for program, with all counts zero. The
+// program must be parsed with ParserConfig.NoInline, as inlined calls
+// wouldn't be counted (ExecProgram returns an error if any were
+// inlined).
+func NewProfile(program *parser.Program) *Profile {
+	compiled := program.Compiled
+	prof := &Profile{
+		program:   program,
+		begin:     newProfileEntry("BEGIN", "", compiled.BeginPos),
+		actions:   make([]ProfileEntry, len(compiled.Actions)),
+		end:       newProfileEntry("END", "", compiled.EndPos),
+		functions: make([]ProfileEntry, len(compiled.Functions)),
+		active:    make([]int, len(compiled.Functions)),
+	}
+	for i, action := range compiled.Actions {
+		positions := action.BodyPos
+		if len(action.PatternPos) > 0 {
+			positions = action.PatternPos[0]
+		}
+		prof.actions[i] = newProfileEntry("action", "", positions)
+	}
+	for i, f := range compiled.Functions {
+		prof.functions[i] = newProfileEntry("function", f.Name, f.BodyPos)
+	}
+	return prof
+}
+
+func newProfileEntry(kind, name string, positions []compiler.SourcePos) ProfileEntry {
+	entry := ProfileEntry{Kind: kind, Name: name}
+	if len(positions) > 0 {
+		entry.Line = positions[0].Pos.Line
+		entry.Column = positions[0].Pos.Column
+	}
+	return entry
+}
+
+// Entries returns the profile of each part of the program that has
+// code: BEGIN, then the actions in source order, then END, then the
+// functions in the order they're defined.
+func (p *Profile) Entries() []ProfileEntry {
+	var entries []ProfileEntry
+	if len(p.program.Compiled.Begin) > 0 {
+		entries = append(entries, p.begin)
+	}
+	entries = append(entries, p.actions...)
+	if len(p.program.Compiled.End) > 0 {
+		entries = append(entries, p.end)
+	}
+	entries = append(entries, p.functions...)
+	return entries
+}
+
+// WriteReport writes a table of the profile entries to writer, slowest
+// first. The percentages are of the total time of BEGIN, END, and the
+// actions (function times are already included in those).
+func (p *Profile) WriteReport(writer io.Writer) error {
+	entries := p.Entries()
+	var total time.Duration
+	for _, e := range entries {
+		if e.Kind != "function" {
+			total += e.Time
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time > entries[j].Time
+	})
+
+	w := bufio.NewWriter(writer)
+	fmt.Fprintf(w, "%12s %7s %10s %10s  %s\n", "time", "percent", "count", "matched", "where")
+	for _, e := range entries {
+		percent := 0.0
+		if total > 0 {
+			percent = float64(e.Time) / float64(total) * 100
+		}
+		matched := ""
+		where := e.Kind
+		switch e.Kind {
+		case "action":
+			matched = fmt.Sprint(e.Matched)
+		case "function":
+			where += " " + e.Name
+		}
+		if e.Line > 0 {
+			where += fmt.Sprintf(" (line %d)", e.Line)
+		}
+		fmt.Fprintf(w, "%12s %6.1f%% %10d %10s  %s\n", e.Time.Round(time.Microsecond), percent, e.Count, matched, where)
+	}
+	return w.Flush()
+}
+
+// WriteListing writes the program source src (which must be the source
+// it was parsed from), with the time, count, and number of records
+// matched of each profile entry shown on the line the entry starts on.
+// If more than one entry starts on a line, as in a one-line program,
+// the others are shown on extra lines after it, with a "^" under the
+// column they start at. Entries whose line isn't known aren't shown.
+func (p *Profile) WriteListing(writer io.Writer, src []byte) error {
+	lineEntries := make(map[int][]ProfileEntry)
+	for _, e := range p.Entries() {
+		if e.Line > 0 {
+			lineEntries[e.Line] = append(lineEntries[e.Line], e)
+		}
+	}
+
+	w := bufio.NewWriter(writer)
+	srcLines := bytes.Split(src, []byte{'\n'})
+	for len(srcLines) > 0 && len(srcLines[len(srcLines)-1]) == 0 {
+		srcLines = srcLines[:len(srcLines)-1]
+	}
+	fmt.Fprintf(w, "%12s %10s %10s\n", "time", "count", "matched")
+	for i, srcLine := range srcLines {
+		entries := lineEntries[i+1]
+		if len(entries) == 0 {
+			fmt.Fprintf(w, "%12s %10s %10s:%5d:%s\n", "", "", "", i+1, srcLine)
+			continue
+		}
+		fmt.Fprintf(w, "%s:%5d:%s\n", entries[0].listingColumns(), i+1, srcLine)
+		for _, e := range entries[1:] {
+			// Indent with the line's own tabs so the "^" lines up
+			indent := make([]byte, 0, e.Column)
+			for j := 0; j < e.Column-1 && j < len(srcLine); j++ {
+				if srcLine[j] == '\t' {
+					indent = append(indent, '\t')
+				} else {
+					indent = append(indent, ' ')
+				}
+			}
+			fmt.Fprintf(w, "%s:%5s:%s^\n", e.listingColumns(), "", indent)
+		}
+	}
+	return w.Flush()
+}
+
+func (e ProfileEntry) listingColumns() string {
+	matched := ""
+	if e.Kind == "action" {
+		matched = fmt.Sprint(e.Matched)
+	}
+	return fmt.Sprintf("%12s %10d %10s", e.Time.Round(time.Microsecond), e.Count, matched)
+}
+
+// Execute the BEGIN or END code, timing it if profiling.
+func (p *interp) executeBeginEnd(code []compiler.Opcode, isEnd bool) error {
+	if p.profile == nil {
+		return p.execute(code)
+	}
+	entry := &p.profile.begin
+	if isEnd {
+		entry = &p.profile.end
+	}
+	start := time.Now()
+	err := p.execute(code)
+	entry.Count++
+	entry.Time += time.Since(start)
+	return err
+}
+
+// Called before and after a call to the user function with the given
+// index when profiling.
+func (p *Profile) enterFunction(index int) time.Time {
+	p.active[index]++
+	if p.active[index] > 1 {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (p *Profile) exitFunction(index int, start time.Time) {
+	p.active[index]--
+	entry := &p.functions[index]
+	entry.Count++
+	if !start.IsZero() {
+		entry.Time += time.Since(start)
+	}
+}
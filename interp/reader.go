@@ -0,0 +1,176 @@
+// Reading input records of any length
+
+package interp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// Number of reads in a row that return no data and no error before
+// Scan gives up (the same limit bufio.Scanner uses).
+const maxEmptyReads = 100
+
+// recordReader reads input records, like a bufio.Scanner, but without
+// a maximum record size: its buffer starts at Config.InputBufferSize
+// and grows (doubling) as needed to hold the longest record, so very
+// long lines like minified JSON work. Records are separated by the
+// single byte sep, or by split if it's not nil.
+//
+// For a single byte separator, which is by far the most common case,
+// each byte is only searched once: while a long record is read in over
+// several reads, only the new data is searched for the separator.
+type recordReader struct {
+	input io.Reader
+	sep   byte
+	split bufio.SplitFunc
+
+	buf      []byte
+	start    int // data not yet returned is buf[start:end]
+	end      int
+	searched int // buf[start:searched] has no sep in it
+	eof      bool
+	err      error
+	token    []byte
+}
+
+// Create a new reader for records from input separated by sep, or by
+// split if it's not nil. With sep '\n', a \r before it is dropped from
+// the record, as with bufio.ScanLines.
+func newRecordReader(input io.Reader, sep byte, split bufio.SplitFunc, bufSize int) *recordReader {
+	return &recordReader{
+		input: input,
+		sep:   sep,
+		split: split,
+		buf:   make([]byte, bufSize),
+	}
+}
+
+// Create a new reader for input records separated by the current RS.
+// Splitters that determine the record terminator store it in
+// *terminator.
+func (p *interp) newRecordReader(input io.Reader, terminator *string) *recordReader {
+	if len(p.recordSep) == 1 {
+		return newRecordReader(input, p.recordSep[0], nil, p.inputBufSize)
+	}
+	return newRecordReader(input, 0, p.splitFunc(terminator), p.inputBufSize)
+}
+
+// Scan reads the next record, which is then available via Text. It
+// returns false at the end of the input or after a read error.
+func (r *recordReader) Scan() bool {
+	for {
+		var ok bool
+		if r.split == nil {
+			ok = r.scanSep()
+		} else {
+			var err error
+			ok, err = r.scanSplit()
+			if err != nil {
+				r.err = err
+				return false
+			}
+		}
+		if ok {
+			return true
+		}
+		if r.eof {
+			return false
+		}
+		r.fill()
+	}
+}
+
+// Scan a record terminated by r.sep from the data read so far.
+func (r *recordReader) scanSep() bool {
+	if i := bytes.IndexByte(r.buf[r.searched:r.end], r.sep); i >= 0 {
+		i += r.searched
+		r.token = r.buf[r.start:i]
+		if r.sep == '\n' {
+			r.token = dropCR(r.token)
+		}
+		r.start = i + 1
+		r.searched = r.start
+		return true
+	}
+	r.searched = r.end
+	if r.eof && r.start < r.end {
+		// Final record without a terminator
+		r.token = r.buf[r.start:r.end]
+		if r.sep == '\n' {
+			r.token = dropCR(r.token)
+		}
+		r.start = r.end
+		r.searched = r.end
+		return true
+	}
+	return false
+}
+
+// Scan a record from the data read so far using r.split.
+func (r *recordReader) scanSplit() (bool, error) {
+	for r.start < r.end || r.eof {
+		data := r.buf[r.start:r.end]
+		advance, token, err := r.split(data, r.eof)
+		if err != nil {
+			return false, err
+		}
+		if advance < 0 || advance > len(data) {
+			return false, errors.New("record splitter returned invalid advance count")
+		}
+		r.start += advance
+		if token != nil {
+			r.token = token
+			return true, nil
+		}
+		if advance == 0 {
+			// Splitter needs more data (or there's none left)
+			return false, nil
+		}
+	}
+	return false, nil
+}
+
+// Read more input into the buffer, first moving the unread data to the
+// start of it, and growing it if it's full.
+func (r *recordReader) fill() {
+	if r.start > 0 {
+		copy(r.buf, r.buf[r.start:r.end])
+		r.end -= r.start
+		r.searched -= r.start
+		r.start = 0
+	}
+	if r.end == len(r.buf) {
+		buf := make([]byte, 2*len(r.buf))
+		copy(buf, r.buf[:r.end])
+		r.buf = buf
+	}
+	for i := 0; i < maxEmptyReads; i++ {
+		n, err := r.input.Read(r.buf[r.end:])
+		r.end += n
+		if err != nil {
+			if err != io.EOF {
+				r.err = err
+			}
+			r.eof = true
+			return
+		}
+		if n > 0 {
+			return
+		}
+	}
+	r.err = io.ErrNoProgress
+	r.eof = true
+}
+
+// Text returns the record read by the last call to Scan.
+func (r *recordReader) Text() string {
+	return string(r.token)
+}
+
+// Err returns the first read error (other than io.EOF), if any.
+func (r *recordReader) Err() error {
+	return r.err
+}
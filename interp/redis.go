@@ -0,0 +1,249 @@
+// Redis keys: redis_get(), redis_set(), and redis_incr()
+
+package interp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Connection settings parsed from Config.RedisURL.
+type redisConfig struct {
+	addr     string
+	tls      bool
+	username string
+	password string
+	db       string
+}
+
+// Parse a Redis URL of the form redis://[[user]:password@]host[:port][/db]
+// (or rediss:// for TLS), as in Config.RedisURL.
+func parseRedisURL(s string) (*redisConfig, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("scheme must be redis or rediss, not %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("missing host")
+	}
+	config := &redisConfig{addr: u.Host, tls: u.Scheme == "rediss"}
+	if u.Port() == "" {
+		config.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		config.username = u.User.Username()
+		config.password, _ = u.User.Password()
+	}
+	db := strings.TrimPrefix(u.Path, "/")
+	if db != "" {
+		if _, err := strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database number %q", db)
+		}
+		config.db = db
+	}
+	return config, nil
+}
+
+// A connection to a Redis server, speaking just enough of the RESP
+// protocol for simple commands.
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// Error reply from the Redis server, like "WRONGTYPE ...". Unlike I/O
+// errors, these leave the connection usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// Return the connection to the Redis server, connecting first (and
+// authenticating and selecting the database) if not connected yet.
+func (p *interp) redisConn() (*redisConn, error) {
+	if p.redis != nil {
+		return p.redis, nil
+	}
+	config := p.redisConfig
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(p.ctx, "tcp", config.addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.tls {
+		host, _, _ := net.SplitHostPort(config.addr)
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	r := &redisConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+	p.redis = r
+	if config.password != "" {
+		args := []string{"AUTH", config.password}
+		if config.username != "" {
+			args = []string{"AUTH", config.username, config.password}
+		}
+		if _, _, err := p.redisCommand(args...); err != nil {
+			p.closeRedis()
+			return nil, err
+		}
+	}
+	if config.db != "" {
+		if _, _, err := p.redisCommand("SELECT", config.db); err != nil {
+			p.closeRedis()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Send a command to the Redis server and return its reply, and whether
+// the reply is nil (as for GET of a key that doesn't exist). After an
+// I/O error the connection is closed, so the next command reconnects.
+func (p *interp) redisCommand(args ...string) (string, bool, error) {
+	r, err := p.redisConn()
+	if err != nil {
+		return "", false, err
+	}
+	if deadline, ok := p.ctx.Deadline(); ok {
+		_ = r.conn.SetDeadline(deadline)
+	}
+	fmt.Fprintf(r.writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(r.writer, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	err = r.writer.Flush()
+	if err != nil {
+		p.closeRedis()
+		return "", false, err
+	}
+	reply, isNil, err := r.readReply()
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			p.closeRedis()
+		}
+		return "", false, err
+	}
+	return reply, isNil, nil
+}
+
+// Read a simple string, error, integer, or bulk string reply.
+func (r *redisConn) readReply() (string, bool, error) {
+	line, err := r.reader.ReadString('\n')
+	if err != nil {
+		return "", false, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", false, errors.New("invalid reply from Redis server")
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+', ':':
+		return line[1:], false, nil
+	case '-':
+		return "", false, redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return "", false, errors.New("invalid reply from Redis server")
+		}
+		if n == -1 {
+			return "", true, nil
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(r.reader, buf)
+		if err != nil {
+			return "", false, err
+		}
+		return string(buf[:n]), false, nil
+	default:
+		return "", false, fmt.Errorf("unexpected reply from Redis server: %q", line)
+	}
+}
+
+// Close the connection to the Redis server, if there is one.
+func (p *interp) closeRedis() {
+	if p.redis != nil {
+		_ = p.redis.conn.Close()
+		p.redis = nil
+	}
+}
+
+// Check that the Redis functions can be called.
+func (p *interp) checkRedis(name string, write bool) error {
+	if p.redisConfig == nil {
+		return newError("can't call %s() without config.RedisURL", name)
+	}
+	if p.noFileReads {
+		return newError("can't call %s() due to NoFileReads", name)
+	}
+	if write && p.noFileWrites {
+		return newError("can't call %s() due to NoFileWrites", name)
+	}
+	return nil
+}
+
+// Return the value of the Redis key, for redis_get(). The value is a
+// numeric string if it looks like a number, and is "" if the key
+// doesn't exist or on error (which sets ERRNO).
+func (p *interp) redisGet(key string) (value, error) {
+	err := p.checkRedis("redis_get", false)
+	if err != nil {
+		return null(), err
+	}
+	reply, isNil, err := p.redisCommand("GET", key)
+	if err != nil {
+		p.setErrno(err)
+		return str(""), nil
+	}
+	if isNil {
+		return str(""), nil
+	}
+	return p.inputStr(reply), nil
+}
+
+// Set the Redis key to s, for redis_set(). Return 0, or -1 on error
+// (which sets ERRNO).
+func (p *interp) redisSet(key, s string) (int, error) {
+	err := p.checkRedis("redis_set", true)
+	if err != nil {
+		return 0, err
+	}
+	_, _, err = p.redisCommand("SET", key, s)
+	if err != nil {
+		p.setErrno(err)
+		return -1, nil
+	}
+	return 0, nil
+}
+
+// Add n to the number in the Redis key, which is created as 0 if it
+// doesn't exist, for redis_incr(). Return the new value, or "" on
+// error (which sets ERRNO).
+func (p *interp) redisIncr(key string, n float64) (value, error) {
+	err := p.checkRedis("redis_incr", true)
+	if err != nil {
+		return null(), err
+	}
+	var reply string
+	if n == float64(int64(n)) {
+		reply, _, err = p.redisCommand("INCRBY", key, strconv.FormatInt(int64(n), 10))
+	} else {
+		reply, _, err = p.redisCommand("INCRBYFLOAT", key, strconv.FormatFloat(n, 'g', -1, 64))
+	}
+	if err != nil {
+		p.setErrno(err)
+		return str(""), nil
+	}
+	return p.inputStr(reply), nil
+}
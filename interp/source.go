@@ -0,0 +1,410 @@
+// Pluggable record sources and predicate pushdown
+
+package interp
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/benhoyt/goawk/ast"
+	. "github.com/benhoyt/goawk/lexer"
+	"github.com/benhoyt/goawk/parser"
+)
+
+// RecordSource is a pluggable source of input records. If
+// Config.Source is set, records are read from it instead of from
+// Stdin and the files in Args (so var=value assignments in Args
+// aren't processed either).
+type RecordSource interface {
+	// Next returns the next record, or io.EOF at the end of input.
+	Next() (string, error)
+}
+
+// MetadataSource is a RecordSource whose records have details besides
+// their text, like the partition and offset of a Kafka message. If the
+// program uses the global array RECORDINFO, it's cleared and set to the
+// result of Metadata after each record is read (the values are numeric
+// strings, like fields).
+type MetadataSource interface {
+	RecordSource
+	// Metadata returns the details of the record last returned by Next.
+	Metadata() map[string]string
+}
+
+// FilteringSource is a RecordSource that can skip records itself, for
+// example by pushing a WHERE clause down to a database. If the program
+// only acts on records that satisfy simple tests on fields (such as
+// $3 == "ERROR"), and skipping the other records wouldn't change its
+// output, SetFilter is called once before the first call to Next with
+// those tests. Every record the program acts on satisfies all of the
+// predicates, so the source may skip records that fail any of them.
+//
+// Filtering is only an optimization: the program still evaluates its
+// pattern on each record, so a source is free to ignore some or all of
+// the predicates.
+type FilteringSource interface {
+	RecordSource
+	SetFilter(predicates []Predicate)
+}
+
+// Predicate is a test on one field of a record, using AWK's comparison
+// rules. Field numbers are as the program sees them after splitting
+// the record with FS (0 is the whole record).
+type Predicate struct {
+	Field int
+	Op    string // "==", "!=", "<", "<=", ">", ">=", "~", or "!~"
+
+	// For comparisons, the constant compared against. If Numeric is
+	// true, the constant is the number Number, and a field that looks
+	// like a number is compared to it numerically, but other fields
+	// are compared to Value, the number converted with CONVFMT.
+	Value   string
+	Number  float64
+	Numeric bool
+
+	// For "~" and "!~", the regex the field must (or must not) match.
+	Regex *regexp.Regexp
+
+	matcher matcher // Regex as a matcher, if set by the interpreter
+}
+
+// Match reports whether field satisfies the predicate.
+func (p Predicate) Match(field string) bool {
+	switch p.Op {
+	case "~":
+		return p.matchString(field)
+	case "!~":
+		return !p.matchString(field)
+	}
+	if p.Numeric {
+		n, isStr := numStr(field).isTrueStr()
+		if !isStr {
+			return compareOrdered(p.Op, n < p.Number, n == p.Number)
+		}
+	}
+	return compareOrdered(p.Op, field < p.Value, field == p.Value)
+}
+
+func (p Predicate) matchString(field string) bool {
+	if p.matcher != nil {
+		return p.matcher.MatchString(field)
+	}
+	return p.Regex.MatchString(field)
+}
+
+// Return the result of comparison op given whether left < right and
+// left == right.
+func compareOrdered(op string, less, equal bool) bool {
+	switch op {
+	case "==":
+		return equal
+	case "!=":
+		return !equal
+	case "<":
+		return less
+	case "<=":
+		return less || equal
+	case ">":
+		return !less && !equal
+	default: // ">="
+		return !less
+	}
+}
+
+// pushdownPredicate is a Predicate found by analyzing the program; its
+// Value (for numbers) is only known once CONVFMT has its final value.
+type pushdownPredicate struct {
+	field int
+	op    Token
+	expr  ast.Expr // *ast.NumExpr, *ast.StrExpr, or *ast.RegExpr
+}
+
+// findPushdown returns predicates that every record the program acts
+// on must satisfy, or nil if there aren't any or if skipping records
+// could change the program's behaviour. That requires a single
+// pattern-action with a plain pattern (not a range), no use of NR or
+// FNR, no plain getline (which reads the main input), no use of FS,
+// RS, or CONVFMT outside of BEGIN, and, if there's an END action, no
+// use of fields or NF in END or in functions.
+func findPushdown(prog *parser.Program) []pushdownPredicate {
+	if len(prog.Actions) != 1 || len(prog.Actions[0].Pattern) != 1 {
+		return nil
+	}
+	ok := true
+	check := func(expr ast.Expr, inBegin, inEnd bool) {
+		switch e := expr.(type) {
+		case *ast.VarExpr:
+			if e.Scope != ast.ScopeSpecial {
+				break
+			}
+			switch e.Index {
+			case ast.V_NR, ast.V_FNR:
+				ok = false
+			case ast.V_FS, ast.V_RS, ast.V_CONVFMT:
+				ok = ok && inBegin
+			case ast.V_NF:
+				ok = ok && !inEnd
+			}
+		case *ast.FieldExpr:
+			ok = ok && !inEnd
+		case *ast.GetlineExpr:
+			ok = ok && (e.Command != nil || e.File != nil)
+		}
+	}
+	hasEnd := len(prog.End) > 0
+	for _, stmts := range prog.Begin {
+		inspectExprs(stmts, func(e ast.Expr) { check(e, true, false) })
+	}
+	action := prog.Actions[0]
+	inspectExprs(action.Pattern[0], func(e ast.Expr) { check(e, false, false) })
+	inspectExprs(action.Stmts, func(e ast.Expr) { check(e, false, false) })
+	for _, stmts := range prog.End {
+		inspectExprs(stmts, func(e ast.Expr) { check(e, false, true) })
+	}
+	for _, f := range prog.Functions {
+		inspectExprs(f.Body, func(e ast.Expr) { check(e, false, hasEnd) })
+	}
+	if !ok {
+		return nil
+	}
+	return conjuncts(action.Pattern[0])
+}
+
+// Return the simple field tests in the pattern's top-level "&&" chain.
+// Tests after a term with side effects aren't included, because on
+// records that fail the test, that term would still have run.
+func conjuncts(pattern ast.Expr) []pushdownPredicate {
+	var terms []ast.Expr
+	var flatten func(expr ast.Expr)
+	flatten = func(expr ast.Expr) {
+		if e, ok := expr.(*ast.BinaryExpr); ok && e.Op == AND {
+			flatten(e.Left)
+			flatten(e.Right)
+			return
+		}
+		terms = append(terms, expr)
+	}
+	flatten(pattern)
+
+	var preds []pushdownPredicate
+	for _, term := range terms {
+		pred, ok := simplePredicate(term)
+		if ok {
+			preds = append(preds, pred)
+		} else if !pure(term) {
+			break
+		}
+	}
+	return preds
+}
+
+// Return the field test expr represents, if it's a simple one like
+// $3 == "ERROR", 100 < $2, $1 ~ /re/, or /re/.
+func simplePredicate(expr ast.Expr) (pushdownPredicate, bool) {
+	switch e := expr.(type) {
+	case *ast.RegExpr:
+		return pushdownPredicate{0, MATCH, e}, true
+	case *ast.BinaryExpr:
+		left, right, op := e.Left, e.Right, e.Op
+		if _, ok := left.(*ast.FieldExpr); !ok {
+			// Allow constant on the left, for example 100 < $2
+			left, right = right, left
+			switch op {
+			case LESS:
+				op = GREATER
+			case LTE:
+				op = GTE
+			case GREATER:
+				op = LESS
+			case GTE:
+				op = LTE
+			case MATCH, NOT_MATCH:
+				return pushdownPredicate{}, false
+			}
+		}
+		field, ok := left.(*ast.FieldExpr)
+		if !ok {
+			return pushdownPredicate{}, false
+		}
+		index, ok := field.Index.(*ast.NumExpr)
+		if !ok || index.Value < 0 || index.Value != float64(int(index.Value)) {
+			return pushdownPredicate{}, false
+		}
+		switch op {
+		case EQUALS, NOT_EQUALS, LESS, LTE, GREATER, GTE, MATCH, NOT_MATCH:
+		default:
+			return pushdownPredicate{}, false
+		}
+		switch right.(type) {
+		case *ast.NumExpr, *ast.StrExpr:
+		case *ast.RegExpr:
+			if op != MATCH && op != NOT_MATCH {
+				return pushdownPredicate{}, false
+			}
+		default:
+			return pushdownPredicate{}, false
+		}
+		return pushdownPredicate{int(index.Value), op, right}, true
+	}
+	return pushdownPredicate{}, false
+}
+
+// Report whether evaluating expr has no side effects.
+func pure(expr ast.Expr) bool {
+	result := true
+	inspectExprs(expr, func(e ast.Expr) {
+		switch e := e.(type) {
+		case *ast.AssignExpr, *ast.AugAssignExpr, *ast.IncrExpr,
+			*ast.GetlineExpr, *ast.UserCallExpr:
+			result = false
+		case *ast.CallExpr:
+			switch e.Func {
+			case F_ATAN2, F_COS, F_EXP, F_INDEX, F_INT, F_LENGTH, F_LOG,
+				F_SIN, F_SQRT, F_SUBSTR, F_TOLOWER, F_TOUPPER:
+			default:
+				result = false
+			}
+		}
+	})
+	return result
+}
+
+// Convert the pushdown predicates to their public form, or return nil
+// if they can't be converted (for example, a dynamic regex that doesn't
+// compile, which is a runtime error in the program).
+func (p *interp) predicates(preds []pushdownPredicate) []Predicate {
+	result := make([]Predicate, 0, len(preds))
+	for _, pd := range preds {
+		pred := Predicate{Field: pd.field, Op: pd.op.String()}
+		if pd.op == MATCH || pd.op == NOT_MATCH {
+			var src string
+			switch e := pd.expr.(type) {
+			case *ast.RegExpr:
+				src = e.Regex
+			case *ast.NumExpr:
+				src = p.toString(num(e.Value))
+			case *ast.StrExpr:
+				src = e.Value
+			}
+			re, err := p.compileRegex(src)
+			if err != nil {
+				return nil
+			}
+			pred.Regex = re
+			pred.matcher = regexMatcher(re)
+		} else {
+			switch e := pd.expr.(type) {
+			case *ast.NumExpr:
+				pred.Numeric = true
+				pred.Number = e.Value
+				pred.Value = p.toString(num(e.Value))
+			case *ast.StrExpr:
+				pred.Value = e.Value
+			}
+		}
+		result = append(result, pred)
+	}
+	return result
+}
+
+// Read the next record from the configured RecordSource, calling its
+// SetFilter first if applicable.
+func (p *interp) nextSourceLine() (string, error) {
+	if !p.sourceStarted {
+		p.sourceStarted = true
+		if fs, ok := p.source.(FilteringSource); ok && p.numberParser == nil {
+			preds := findPushdown(p.program)
+			if len(preds) > 0 {
+				converted := p.predicates(preds)
+				if len(converted) > 0 {
+					fs.SetFilter(converted)
+				}
+			}
+		}
+	}
+	line, err := p.source.Next()
+	if err != nil {
+		return "", err
+	}
+	p.lineNum++
+	p.fileLineNum++
+	p.setRecordInfo(p.source)
+	return line, nil
+}
+
+// Return the function from Config.Sources that opens the input file
+// name, if it's a URL with one of those schemes, otherwise nil.
+func (p *interp) sourceOpener(name string) func(url string) (RecordSource, error) {
+	i := strings.Index(name, "://")
+	if i <= 0 {
+		return nil
+	}
+	return p.sources[name[:i]]
+}
+
+// Read the next record from the RecordSource opened for the current
+// input file name (see Config.Sources). At the end of the source, it's
+// closed and p.argSource is set to nil so the next file is opened.
+func (p *interp) nextArgSourceLine() (string, bool, error) {
+	line, err := p.argSource.Next()
+	if err == io.EOF {
+		p.closeArgSource()
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("error reading from input: %s", err)
+	}
+	p.lineNum++
+	p.fileLineNum++
+	p.setRecordInfo(p.argSource)
+	return line, true, nil
+}
+
+// Close the RecordSource opened for the current input file name, if
+// it's an io.Closer, and clear RECORDINFO, which only applies to its
+// records.
+func (p *interp) closeArgSource() {
+	if c, ok := p.argSource.(io.Closer); ok {
+		_ = c.Close()
+	}
+	p.argSource = nil
+	if p.recordInfoIndex >= 0 {
+		p.array(ast.ScopeGlobal, p.recordInfoIndex).clear()
+	}
+}
+
+// Set the RECORDINFO array to the metadata of the record just read
+// from source, if it's a MetadataSource and the program uses the array.
+func (p *interp) setRecordInfo(source RecordSource) {
+	if p.recordInfoIndex < 0 {
+		return
+	}
+	ms, ok := source.(MetadataSource)
+	if !ok {
+		return
+	}
+	metadata := ms.Metadata()
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // so an ordered array's order is the same each time
+	array := p.array(ast.ScopeGlobal, p.recordInfoIndex)
+	array.clear()
+	for _, k := range keys {
+		array.set(strKey(k), p.inputStr(metadata[k]))
+	}
+}
+
+// Call fn for every expression (including subexpressions) in node.
+func inspectExprs(node ast.Node, fn func(ast.Expr)) {
+	ast.Inspect(node, func(n ast.Node) bool {
+		if e, ok := n.(ast.Expr); ok {
+			fn(e)
+		}
+		return true
+	})
+}
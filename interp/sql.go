@@ -0,0 +1,219 @@
+// SQL databases: sql_open(), sql_query(), sql_exec(), and sql_close()
+
+package interp
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/benhoyt/goawk/ast"
+)
+
+// Return the name of the database/sql driver sql_open() uses (see
+// Config.SQLDriver), or an error if it isn't registered.
+func (p *interp) sqlDriverName() (string, error) {
+	registered := make(map[string]bool)
+	for _, name := range sql.Drivers() {
+		registered[name] = true
+	}
+	if p.sqlDriver != "" {
+		if !registered[p.sqlDriver] {
+			return "", newError("SQL driver %q isn't registered", p.sqlDriver)
+		}
+		return p.sqlDriver, nil
+	}
+	for _, name := range []string{"sqlite3", "sqlite"} {
+		if registered[name] {
+			return name, nil
+		}
+	}
+	return "", newError("can't call sql_open() without a SQLite driver: the Go program using GoAWK must import one (see Config.SQLDriver)")
+}
+
+// Open the database named by dsn (for SQLite, the file name) and
+// return its handle for the other sql_* functions, for sql_open().
+// Return -1 if it can't be opened (which sets ERRNO).
+//
+// Opening isn't allowed with NoFileWrites, because SQLite creates the
+// file if it doesn't exist, and any query can write (a DELETE passed to
+// sql_query, or an INSERT ... RETURNING), so checking sql_exec() alone
+// wouldn't be enough.
+func (p *interp) sqlOpen(dsn string) (int, error) {
+	if p.noFileReads {
+		return 0, newError("can't open database due to NoFileReads")
+	}
+	if p.noFileWrites {
+		return 0, newError("can't open database due to NoFileWrites")
+	}
+	driver, err := p.sqlDriverName()
+	if err != nil {
+		return 0, err
+	}
+	db, err := sql.Open(driver, dsn)
+	if err == nil {
+		err = db.PingContext(p.ctx)
+		if err != nil {
+			_ = db.Close()
+		}
+	}
+	if err != nil {
+		p.setErrno(err)
+		return -1, nil
+	}
+	p.databases = append(p.databases, db)
+	return len(p.databases), nil
+}
+
+// Return the database for the given sql_open() handle, or an error if
+// the handle is invalid or the database has been closed.
+func (p *interp) database(handle value) (*sql.DB, error) {
+	n := int(handle.num())
+	if n < 1 || n > len(p.databases) || p.databases[n-1] == nil {
+		return nil, newError("invalid database handle %s", p.toString(handle))
+	}
+	return p.databases[n-1], nil
+}
+
+// Close the database with the given handle, for sql_close(). Return 0,
+// or -1 if closing it failed (which sets ERRNO).
+func (p *interp) sqlClose(handle value) (int, error) {
+	db, err := p.database(handle)
+	if err != nil {
+		return 0, err
+	}
+	p.databases[int(handle.num())-1] = nil
+	err = db.Close()
+	if err != nil {
+		p.setErrno(err)
+		return -1, nil
+	}
+	return 0, nil
+}
+
+// Close all the databases that are still open.
+func (p *interp) closeDatabases() {
+	for _, db := range p.databases {
+		if db != nil {
+			_ = db.Close()
+		}
+	}
+	p.databases = nil
+}
+
+// Run query with the given parameters on the database with the given
+// handle, for sql_query(). The array is cleared and set to the value
+// of each column of each row, as array[row, column], with rows
+// numbered from 1 and columns by name, and to the column names as
+// array[0, i], numbered from 1. Return the number of rows, or -1 if
+// the query fails (which sets ERRNO).
+func (p *interp) sqlQuery(handle value, query string, params []value, scope ast.VarScope, index int) (int, error) {
+	db, err := p.database(handle)
+	if err != nil {
+		return 0, err
+	}
+	array := p.newArrayAt(p.arrayIndex(scope, index))
+	rows, err := db.QueryContext(p.ctx, query, p.sqlArgs(params)...)
+	if err != nil {
+		p.setErrno(err)
+		return -1, nil
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		p.setErrno(err)
+		return -1, nil
+	}
+	for i, column := range columns {
+		array.set(strKey("0"+p.subscriptSep+strconv.Itoa(i+1)), str(column))
+	}
+	values := make([]interface{}, len(columns))
+	dests := make([]interface{}, len(columns))
+	for i := range values {
+		dests[i] = &values[i]
+	}
+	n := 0
+	for rows.Next() {
+		err = rows.Scan(dests...)
+		if err != nil {
+			p.setErrno(err)
+			return -1, nil
+		}
+		n++
+		prefix := strconv.Itoa(n) + p.subscriptSep
+		for i, column := range columns {
+			array.set(strKey(prefix+column), p.sqlValue(values[i]))
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		p.setErrno(err)
+		return -1, nil
+	}
+	return n, nil
+}
+
+// Run the statement with the given parameters on the database with
+// the given handle, for sql_exec(). Return the number of rows
+// affected (0 if the driver doesn't report it), or -1 if the statement
+// fails (which sets ERRNO).
+func (p *interp) sqlExec(handle value, stmt string, params []value) (int, error) {
+	db, err := p.database(handle)
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.ExecContext(p.ctx, stmt, p.sqlArgs(params)...)
+	if err != nil {
+		p.setErrno(err)
+		return -1, nil
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, nil
+	}
+	return int(n), nil
+}
+
+// Convert AWK values to SQL query parameters: numbers are passed as
+// integers if they're whole numbers, otherwise as floats, and strings
+// (including numeric strings, like fields) as strings.
+func (p *interp) sqlArgs(params []value) []interface{} {
+	args := make([]interface{}, len(params))
+	for i, v := range params {
+		if v.typ == typeNum {
+			if v.n == float64(int64(v.n)) {
+				args[i] = int64(v.n)
+			} else {
+				args[i] = v.n
+			}
+			continue
+		}
+		args[i] = p.toString(v)
+	}
+	return args
+}
+
+// Convert a column value from a SQL row to an AWK value. Text is a
+// numeric string if it looks like a number, as with input fields, and
+// NULL is the empty string.
+func (p *interp) sqlValue(v interface{}) value {
+	switch v := v.(type) {
+	case nil:
+		return str("")
+	case int64:
+		return num(float64(v))
+	case float64:
+		return num(v)
+	case bool:
+		return boolean(v)
+	case []byte:
+		return p.inputStr(string(v))
+	case string:
+		return p.inputStr(v)
+	case time.Time:
+		return str(v.Format(time.RFC3339Nano))
+	default:
+		return str(fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,223 @@
+// Time functions: strftime, mktime, tzconvert, and sleep
+
+package interp
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Return the time zone to use for config, per the Config.Location docs.
+func resolveLocation(config *Config) *time.Location {
+	if config.Location != nil {
+		return config.Location
+	}
+	for i := 0; i < len(config.Environ); i += 2 {
+		if config.Environ[i] == "TZ" {
+			// Like the C library, use UTC if TZ is empty or invalid
+			loc, err := time.LoadLocation(strings.TrimPrefix(config.Environ[i+1], ":"))
+			if err != nil {
+				return time.UTC
+			}
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// Load the named time zone (for example "America/New_York"), caching
+// the result.
+func (p *interp) loadZone(name string) (*time.Location, error) {
+	if loc, ok := p.zones[name]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "" {
+		return nil, newError("unknown time zone %q", name)
+	}
+	if p.zones == nil {
+		p.zones = make(map[string]*time.Location)
+	}
+	p.zones[name] = loc
+	return loc, nil
+}
+
+// Convert a "YYYY MM DD HH MM SS [DST]" time specification to seconds
+// since the epoch, or -1 if spec is invalid. Values outside their usual
+// range are normalized, so "2021 1 32 0 0 0" is February 1st. The DST
+// field is accepted for compatibility but ignored, as Go's time zone
+// data determines whether daylight saving time is in effect.
+func (p *interp) mktime(spec string, utc bool) float64 {
+	fields := strings.Fields(spec)
+	if len(fields) != 6 && len(fields) != 7 {
+		return -1
+	}
+	var n [7]int
+	for i, field := range fields {
+		v, err := strconv.Atoi(field)
+		if err != nil {
+			return -1
+		}
+		n[i] = v
+	}
+	loc := p.location
+	if utc {
+		loc = time.UTC
+	}
+	t := time.Date(n[0], time.Month(n[1]), n[2], n[3], n[4], n[5], 0, loc)
+	return float64(t.Unix())
+}
+
+// Format t according to the C strftime-style format, using the
+// interpreter's locale for month and weekday names. Unknown conversions
+// are output as is.
+func (p *interp) strftime(format string, t time.Time) string {
+	return string(p.appendStrftime(nil, format, t))
+}
+
+func (p *interp) appendStrftime(buf []byte, format string, t time.Time) []byte {
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' || i+1 >= len(format) {
+			buf = append(buf, c)
+			continue
+		}
+		i++
+		c = format[i]
+		if (c == 'E' || c == 'O') && i+1 < len(format) {
+			// Ignore POSIX alternative representation modifiers
+			i++
+			c = format[i]
+		}
+		yearDay := t.YearDay() - 1
+		weekday := int(t.Weekday())
+		switch c {
+		case 'a':
+			buf = append(buf, p.locale.ShortDayNames[weekday]...)
+		case 'A':
+			buf = append(buf, p.locale.DayNames[weekday]...)
+		case 'b', 'h':
+			buf = append(buf, p.locale.ShortMonthNames[t.Month()-1]...)
+		case 'B':
+			buf = append(buf, p.locale.MonthNames[t.Month()-1]...)
+		case 'c':
+			buf = p.appendStrftime(buf, "%a %b %e %H:%M:%S %Y", t)
+		case 'C':
+			buf = appendPadded(buf, t.Year()/100, 2, '0')
+		case 'd':
+			buf = appendPadded(buf, t.Day(), 2, '0')
+		case 'D', 'x':
+			buf = p.appendStrftime(buf, "%m/%d/%y", t)
+		case 'e':
+			buf = appendPadded(buf, t.Day(), 2, ' ')
+		case 'F':
+			buf = p.appendStrftime(buf, "%Y-%m-%d", t)
+		case 'g':
+			year, _ := t.ISOWeek()
+			buf = appendPadded(buf, year%100, 2, '0')
+		case 'G':
+			year, _ := t.ISOWeek()
+			buf = strconv.AppendInt(buf, int64(year), 10)
+		case 'H':
+			buf = appendPadded(buf, t.Hour(), 2, '0')
+		case 'I':
+			buf = appendPadded(buf, hour12(t), 2, '0')
+		case 'j':
+			buf = appendPadded(buf, yearDay+1, 3, '0')
+		case 'k':
+			buf = appendPadded(buf, t.Hour(), 2, ' ')
+		case 'l':
+			buf = appendPadded(buf, hour12(t), 2, ' ')
+		case 'm':
+			buf = appendPadded(buf, int(t.Month()), 2, '0')
+		case 'M':
+			buf = appendPadded(buf, t.Minute(), 2, '0')
+		case 'n':
+			buf = append(buf, '\n')
+		case 'p':
+			if t.Hour() < 12 {
+				buf = append(buf, "AM"...)
+			} else {
+				buf = append(buf, "PM"...)
+			}
+		case 'r':
+			buf = p.appendStrftime(buf, "%I:%M:%S %p", t)
+		case 'R':
+			buf = p.appendStrftime(buf, "%H:%M", t)
+		case 's':
+			buf = strconv.AppendInt(buf, t.Unix(), 10)
+		case 'S':
+			buf = appendPadded(buf, t.Second(), 2, '0')
+		case 't':
+			buf = append(buf, '\t')
+		case 'T', 'X':
+			buf = p.appendStrftime(buf, "%H:%M:%S", t)
+		case 'u':
+			buf = strconv.AppendInt(buf, int64((weekday+6)%7+1), 10)
+		case 'U':
+			buf = appendPadded(buf, (yearDay+7-weekday)/7, 2, '0')
+		case 'V':
+			_, week := t.ISOWeek()
+			buf = appendPadded(buf, week, 2, '0')
+		case 'w':
+			buf = strconv.AppendInt(buf, int64(weekday), 10)
+		case 'W':
+			buf = appendPadded(buf, (yearDay+7-(weekday+6)%7)/7, 2, '0')
+		case 'y':
+			buf = appendPadded(buf, t.Year()%100, 2, '0')
+		case 'Y':
+			buf = strconv.AppendInt(buf, int64(t.Year()), 10)
+		case 'z':
+			buf = t.AppendFormat(buf, "-0700")
+		case 'Z':
+			buf = t.AppendFormat(buf, "MST")
+		case '%':
+			buf = append(buf, '%')
+		default:
+			buf = append(buf, '%', c)
+		}
+	}
+	return buf
+}
+
+func hour12(t time.Time) int {
+	hour := t.Hour() % 12
+	if hour == 0 {
+		hour = 12
+	}
+	return hour
+}
+
+// Append n to buf, padded on the left with pad to at least width bytes.
+func appendPadded(buf []byte, n, width int, pad byte) []byte {
+	s := strconv.Itoa(n)
+	for i := len(s); i < width; i++ {
+		buf = append(buf, pad)
+	}
+	return append(buf, s...)
+}
+
+// Pause for the given number of seconds (which may be fractional), for
+// sleep(). Output is flushed first so it appears before the pause, as
+// in a polling loop. Return early with an error if the context is
+// cancelled.
+func (p *interp) sleep(seconds float64) error {
+	p.flushOutputAndError()
+	if !(seconds > 0) {
+		return nil
+	}
+	d := time.Duration(seconds * float64(time.Second))
+	if seconds >= float64(math.MaxInt64/time.Second) {
+		d = math.MaxInt64
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-p.ctxDone:
+		return p.ctx.Err()
+	}
+}
@@ -0,0 +1,117 @@
+// Execution tracing of statements and patterns (see Config.Trace)
+
+package interp
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/benhoyt/goawk/ast"
+	. "github.com/benhoyt/goawk/lexer"
+	"github.com/benhoyt/goawk/parser"
+)
+
+// State of a trace: written to by the Cover instruction at the start
+// of each statement and pattern, which are indexed as in CoverPos.
+type tracer struct {
+	writer  io.Writer
+	limit   int
+	lines   int
+	texts   []string // source of each statement or pattern (first line)
+	enabled []bool   // whether to trace each one (see TraceFunctions)
+}
+
+func newTracer(program *parser.Program, config *Config) (*tracer, error) {
+	positions := program.Compiled.CoverPos
+	if positions == nil {
+		return nil, newError("config.Trace requires a program parsed with ParserConfig.Coverage")
+	}
+	indexes := make(map[Position]int, len(positions))
+	for i, pos := range positions {
+		indexes[pos] = i
+	}
+	t := &tracer{
+		writer:  config.Trace,
+		limit:   config.TraceLimit,
+		texts:   make([]string, len(positions)),
+		enabled: make([]bool, len(positions)),
+	}
+	tree := program.AST()
+	for stmt, pos := range tree.StmtPositions {
+		t.texts[indexes[pos]] = firstLineOf(stmt.String())
+	}
+	for expr, pos := range tree.PatternPositions {
+		t.texts[indexes[pos]] = firstLineOf(expr.String())
+	}
+
+	if len(config.TraceFunctions) == 0 {
+		for i := range t.enabled {
+			t.enabled[i] = true
+		}
+		return t, nil
+	}
+	traceFunc := make(map[string]bool, len(config.TraceFunctions))
+	for _, name := range config.TraceFunctions {
+		if !hasFunction(tree, name) {
+			return nil, newError("can't trace undefined function %q", name)
+		}
+		traceFunc[name] = true
+	}
+	for _, f := range tree.Functions {
+		if !traceFunc[f.Name] {
+			continue
+		}
+		for _, stmt := range f.Body {
+			ast.Inspect(stmt, func(node ast.Node) bool {
+				if s, ok := node.(ast.Stmt); ok {
+					if pos, ok := tree.StmtPositions[s]; ok {
+						t.enabled[indexes[pos]] = true
+					}
+				}
+				return true
+			})
+		}
+	}
+	return t, nil
+}
+
+func hasFunction(tree *ast.Program, name string) bool {
+	for _, f := range tree.Functions {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func firstLineOf(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// Write a trace line for the statement or pattern with the given cover
+// index, if it's being traced and the limit hasn't been reached.
+func (p *interp) traceStmt(index int) error {
+	t := p.trace
+	if !t.enabled[index] || (t.limit > 0 && t.lines > t.limit) {
+		return nil
+	}
+	// Flush normal output first so it's interleaved with the trace in
+	// the order it happened (when both go to the terminal)
+	p.flushOutputAndError()
+	t.lines++
+	if t.limit > 0 && t.lines > t.limit {
+		_, err := fmt.Fprintf(t.writer, "trace limit of %d lines reached\n", t.limit)
+		return err
+	}
+	pos := p.program.Compiled.CoverPos[index]
+	where := fmt.Sprintf("line %d", pos.Line)
+	if name, line := p.program.FileLine(pos.Line); name != "" {
+		where = fmt.Sprintf("%s:%d", name, line)
+	}
+	_, err := fmt.Fprintf(t.writer, "%s: NR=%d: %s\n", where, p.lineNum, t.texts[index])
+	return err
+}
@@ -3,10 +3,12 @@
 package interp
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 type valueType uint8
@@ -16,13 +18,14 @@ const (
 	typeStr
 	typeNum
 	typeNumStr
+	typeParsedNumStr // numeric string converted by Config.NumberParser
 )
 
 // An AWK value (these are passed around by value)
 type value struct {
 	typ valueType // Type of value
-	s   string    // String value (for typeStr and typeNumStr)
-	n   float64   // Numeric value (for typeNum)
+	s   string    // String value (for typeStr and the numeric string types)
+	n   float64   // Numeric value (for typeNum and typeParsedNumStr)
 }
 
 // Create a new null value
@@ -45,6 +48,13 @@ func numStr(s string) value {
 	return value{typ: typeNumStr, s: s}
 }
 
+// Create a new value to represent a "numeric string" that's already been
+// converted to the number n. It behaves like a number whose string
+// value is s.
+func parsedNumStr(s string, n float64) value {
+	return value{typ: typeParsedNumStr, s: s, n: n}
+}
+
 // Create a numeric value from a Go bool
 func boolean(b bool) value {
 	if b {
@@ -62,11 +72,21 @@ func (v value) String() string {
 		return fmt.Sprintf("num(%s)", v.str("%.6g"))
 	case typeNumStr:
 		return fmt.Sprintf("numStr(%q)", v.s)
+	case typeParsedNumStr:
+		return fmt.Sprintf("parsedNumStr(%q, %s)", v.s, strconv.FormatFloat(v.n, 'g', -1, 64))
 	default:
 		return "null()"
 	}
 }
 
+// Report whether l and r are both numbers or null, so they can be
+// compared numerically using their n fields. This relies on typeStr
+// and typeNumStr being the only types with the low bit set (a
+// typeParsedNumStr has its n field set).
+func bothNum(l, r value) bool {
+	return (l.typ|r.typ)&1 == 0
+}
+
 // Return true if value is a "true string" (a string or a "numeric string"
 // from an input field that can't be converted to a number). If false,
 // also return the (possibly converted) number.
@@ -75,16 +95,40 @@ func (v value) isTrueStr() (float64, bool) {
 	case typeStr:
 		return 0, true
 	case typeNumStr:
+		if !mightBeNumber(v.s) {
+			return 0, true
+		}
 		f, err := strconv.ParseFloat(strings.TrimSpace(v.s), 64)
 		if err != nil {
 			return 0, true
 		}
 		return f, false
-	default: // typeNum, typeNull
+	default: // typeNum, typeNull, typeParsedNumStr
 		return v.n, false
 	}
 }
 
+// Report whether s might be a number that strconv.ParseFloat accepts,
+// judging by its first non-space character. This rules out most text
+// fields quickly, without the allocation of ParseFloat's error.
+func mightBeNumber(s string) bool {
+	i := 0
+	for i < len(s) && asciiSpace[s[i]] != 0 {
+		i++
+	}
+	if i >= len(s) {
+		return false
+	}
+	switch c := s[i]; {
+	case c >= '0' && c <= '9', c == '+', c == '-', c == '.':
+		return true
+	case c == 'i', c == 'I', c == 'n', c == 'N':
+		return true // inf, infinity, or nan
+	default:
+		return c >= utf8.RuneSelf // may be Unicode space, let TrimSpace handle it
+	}
+}
+
 // Return Go bool value of AWK value. For numbers or numeric strings,
 // zero is false and everything else is true. For strings, empty
 // string is false and everything else is true.
@@ -93,12 +137,15 @@ func (v value) boolean() bool {
 	case typeStr:
 		return v.s != ""
 	case typeNumStr:
+		if !mightBeNumber(v.s) {
+			return v.s != ""
+		}
 		f, err := strconv.ParseFloat(strings.TrimSpace(v.s), 64)
 		if err != nil {
 			return v.s != ""
 		}
 		return f != 0
-	default: // typeNum, typeNull
+	default: // typeNum, typeNull, typeParsedNumStr
 		return v.n != 0
 	}
 }
@@ -137,7 +184,7 @@ func (v value) num() float64 {
 	case typeStr, typeNumStr:
 		// Ensure string starts with a float and convert it
 		return parseFloatPrefix(v.s)
-	default: // typeNum, typeNull
+	default: // typeNum, typeNull, typeParsedNumStr
 		return v.n
 	}
 }
@@ -193,3 +240,79 @@ func parseFloatPrefix(s string) float64 {
 	f, _ := strconv.ParseFloat(floatStr, 64)
 	return f // Returns infinity in case of "value out of range" error
 }
+
+// ParseNonDecimal converts hexadecimal ("0x1A") and octal ("0o17")
+// strings, with an optional sign and surrounding whitespace, to
+// numbers. Use it as Config.NumberParser for input data with numbers
+// in these forms (like gawk's --non-decimal-data option). Other
+// strings return false, so they're converted with the usual rules.
+func ParseNonDecimal(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	sign := 1.0
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		if s[0] == '-' {
+			sign = -1
+		}
+		s = s[1:]
+	}
+	if len(s) < 3 || s[0] != '0' || strings.IndexByte("xXoO", s[1]) < 0 || strings.IndexByte(s, '_') >= 0 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s, 0, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return 0, false
+	}
+	return sign * float64(n), true // too-large values are the maximum
+}
+
+// ParsePOSIXNumber converts strings that look like numbers as POSIX
+// specifies for numeric strings, that is, as C's strtod accepts them
+// in full: decimal numbers, hexadecimal numbers like "0x1A" or
+// "0x1.8p3", and "inf", "infinity", or "nan" in any case, each with an
+// optional sign and surrounding whitespace. Use it as
+// Config.NumberParser for input data from programs written for a
+// strictly POSIX AWK (like gawk --posix).
+//
+// Without it, input strings are numeric as in gawk and mawk, where
+// hexadecimal strings like "0x1A" aren't numeric: they compare as
+// strings and convert to 0. Decimal strings like "10" and "9" are
+// numeric either way, so they compare as numbers.
+func ParsePOSIXNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	sign := 1.0
+	rest := s
+	if rest != "" && (rest[0] == '+' || rest[0] == '-') {
+		if rest[0] == '-' {
+			sign = -1
+		}
+		rest = rest[1:]
+	}
+	switch strings.ToLower(rest) {
+	case "inf", "infinity":
+		return math.Inf(int(sign)), true
+	case "nan":
+		return math.NaN(), true
+	}
+	if rest == "" || strings.IndexByte(rest, '_') >= 0 {
+		return 0, false
+	}
+	if len(rest) > 2 && rest[0] == '0' && (rest[1] == 'x' || rest[1] == 'X') {
+		// Go requires the "p" exponent in hexadecimal floats, C doesn't
+		if strings.IndexAny(rest, "pP") < 0 {
+			rest += "p0"
+		}
+		f, err := strconv.ParseFloat("0x"+rest[2:], 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return 0, false
+		}
+		return sign * f, true
+	}
+	if c := rest[0]; c != '.' && (c < '0' || c > '9') {
+		return 0, false // rule out Go's other special forms
+	}
+	f, err := strconv.ParseFloat(rest, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return 0, false
+	}
+	return sign * f, true // too-large values are infinity
+}
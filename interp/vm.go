@@ -3,14 +3,19 @@
 package interp
 
 import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"io"
 	"math"
+	"net/url"
 	"os"
-	"os/exec"
 	"strings"
 	"time"
 
-	"github.com/benhoyt/goawk/internal/ast"
+	"github.com/benhoyt/goawk/ast"
 	"github.com/benhoyt/goawk/internal/compiler"
 	"github.com/benhoyt/goawk/lexer"
 )
@@ -27,7 +32,21 @@ import (
 // reducing the number of opcodes (replacing a couple dozen Call* opcodes with
 // a single CallBuiltin -- that probably pushed it below a switch binary tree
 // branch threshold).
+//
+// Go 1.19 and later do compile this switch to a jump table, so the order of
+// the cases doesn't matter. What does matter is that the Go compiler only
+// inlines very cheap functions into a function as big as this one, so the
+// stack operations need to stay tiny. In particular push doesn't check
+// whether the stack needs to grow: instead we ensure there's room for
+// len(code) more values up front. No instruction pushes more than one value
+// (except Nulls, which grows the stack itself), and the stack depth at each
+// instruction is the same however it's reached, so the depth of the stack
+// can't grow by more than the number of instructions in the block.
 func (p *interp) execute(code []compiler.Opcode) error {
+	if p.sp+len(code) > len(p.stack) {
+		p.growStack(len(code))
+	}
+
 	for ip := 0; ip < len(code); {
 		op := code[ip]
 		ip++
@@ -58,7 +77,7 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			index := p.peekTop()
 			v, err := p.getField(int(index.num()))
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 			p.replaceTop(v)
 
@@ -67,7 +86,7 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			ip++
 			v, err := p.getField(int(index))
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 			p.push(v)
 
@@ -86,11 +105,31 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			ip++
 			p.push(p.getSpecial(int(index)))
 
+		case compiler.Record:
+			p.ensureLine()
+			if p.lineIsTrueStr {
+				p.push(str(p.line))
+			} else {
+				p.push(p.inputStr(p.line))
+			}
+
+		case compiler.SpecialNF:
+			p.ensureFields()
+			p.push(num(float64(p.numFields)))
+
+		case compiler.SpecialNR:
+			p.push(num(float64(p.lineNum)))
+
+		case compiler.CachedNF:
+			// The compiler has checked that a SpecialNF already split
+			// this record into fields
+			p.push(num(float64(p.numFields)))
+
 		case compiler.ArrayGlobal:
 			arrayIndex := code[ip]
 			ip++
 			array := p.arrays[arrayIndex]
-			index := p.toString(p.peekTop())
+			index := p.arrayKey(p.peekTop())
 			v := arrayGet(array, index)
 			p.replaceTop(v)
 
@@ -98,7 +137,7 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			arrayIndex := code[ip]
 			ip++
 			array := p.localArray(int(arrayIndex))
-			index := p.toString(p.peekTop())
+			index := p.arrayKey(p.peekTop())
 			v := arrayGet(array, index)
 			p.replaceTop(v)
 
@@ -106,23 +145,23 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			arrayIndex := code[ip]
 			ip++
 			array := p.arrays[arrayIndex]
-			index := p.toString(p.peekTop())
-			_, ok := array[index]
+			index := p.arrayKey(p.peekTop())
+			_, ok := array.get(index)
 			p.replaceTop(boolean(ok))
 
 		case compiler.InLocal:
 			arrayIndex := code[ip]
 			ip++
 			array := p.localArray(int(arrayIndex))
-			index := p.toString(p.peekTop())
-			_, ok := array[index]
+			index := p.arrayKey(p.peekTop())
+			_, ok := array.get(index)
 			p.replaceTop(boolean(ok))
 
 		case compiler.AssignField:
 			right, index := p.popTwo()
 			err := p.setField(int(index.num()), p.toString(right))
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 
 		case compiler.AssignGlobal:
@@ -140,7 +179,7 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			ip++
 			err := p.setSpecial(int(index), p.pop())
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 
 		case compiler.AssignArrayGlobal:
@@ -148,31 +187,29 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			ip++
 			array := p.arrays[arrayIndex]
 			v, index := p.popTwo()
-			array[p.toString(index)] = v
+			array.set(p.arrayKey(index), v)
 
 		case compiler.AssignArrayLocal:
 			arrayIndex := code[ip]
 			ip++
 			array := p.localArray(int(arrayIndex))
 			v, index := p.popTwo()
-			array[p.toString(index)] = v
+			array.set(p.arrayKey(index), v)
 
 		case compiler.Delete:
 			arrayScope := code[ip]
 			arrayIndex := code[ip+1]
 			ip += 2
 			array := p.array(ast.VarScope(arrayScope), int(arrayIndex))
-			index := p.toString(p.pop())
-			delete(array, index)
+			index := p.arrayKey(p.pop())
+			array.delete(index)
 
 		case compiler.DeleteAll:
 			arrayScope := code[ip]
 			arrayIndex := code[ip+1]
 			ip += 2
 			array := p.array(ast.VarScope(arrayScope), int(arrayIndex))
-			for k := range array {
-				delete(array, k)
-			}
+			array.clear()
 
 		case compiler.IncrField:
 			amount := code[ip]
@@ -180,11 +217,11 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			index := int(p.pop().num())
 			v, err := p.getField(index)
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 			err = p.setField(index, p.toString(num(v.num()+float64(amount))))
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 
 		case compiler.IncrGlobal:
@@ -206,7 +243,7 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			v := p.getSpecial(index)
 			err := p.setSpecial(index, num(v.num()+float64(amount)))
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 
 		case compiler.IncrArrayGlobal:
@@ -214,16 +251,18 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			arrayIndex := code[ip+1]
 			ip += 2
 			array := p.arrays[arrayIndex]
-			index := p.toString(p.pop())
-			array[index] = num(array[index].num() + float64(amount))
+			index := p.arrayKey(p.pop())
+			v, _ := array.get(index)
+			array.set(index, num(v.num()+float64(amount)))
 
 		case compiler.IncrArrayLocal:
 			amount := code[ip]
 			arrayIndex := code[ip+1]
 			ip += 2
 			array := p.localArray(int(arrayIndex))
-			index := p.toString(p.pop())
-			array[index] = num(array[index].num() + float64(amount))
+			index := p.arrayKey(p.pop())
+			v, _ := array.get(index)
+			array.set(index, num(v.num()+float64(amount)))
 
 		case compiler.AugAssignField:
 			operation := compiler.AugOp(code[ip])
@@ -232,15 +271,15 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			index := int(indexVal.num())
 			field, err := p.getField(index)
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 			v, err := p.augAssignOp(operation, field, right)
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 			err = p.setField(index, p.toString(v))
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 
 		case compiler.AugAssignGlobal:
@@ -249,7 +288,7 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			ip += 2
 			v, err := p.augAssignOp(operation, p.globals[index], p.pop())
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 			p.globals[index] = v
 
@@ -259,7 +298,7 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			ip += 2
 			v, err := p.augAssignOp(operation, p.frame[index], p.pop())
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 			p.frame[index] = v
 
@@ -269,11 +308,11 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			ip += 2
 			v, err := p.augAssignOp(operation, p.getSpecial(index), p.pop())
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 			err = p.setSpecial(index, v)
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 
 		case compiler.AugAssignArrayGlobal:
@@ -281,12 +320,13 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			arrayIndex := code[ip+1]
 			ip += 2
 			array := p.arrays[arrayIndex]
-			index := p.toString(p.pop())
-			v, err := p.augAssignOp(operation, array[index], p.pop())
+			index := p.arrayKey(p.pop())
+			old, _ := array.get(index)
+			v, err := p.augAssignOp(operation, old, p.pop())
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
-			array[index] = v
+			array.set(index, v)
 
 		case compiler.AugAssignArrayLocal:
 			operation := compiler.AugOp(code[ip])
@@ -294,19 +334,24 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			ip += 2
 			array := p.localArray(int(arrayIndex))
 			right, indexVal := p.popTwo()
-			index := p.toString(indexVal)
-			v, err := p.augAssignOp(operation, array[index], right)
+			index := p.arrayKey(indexVal)
+			old, _ := array.get(index)
+			v, err := p.augAssignOp(operation, old, right)
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
-			array[index] = v
+			array.set(index, v)
 
 		case compiler.Regex:
 			// Stand-alone /regex/ is equivalent to: $0 ~ /regex/
 			index := code[ip]
 			ip++
-			re := p.regexes[index]
-			p.push(boolean(re.MatchString(p.line)))
+			p.ensureLine()
+			matched := p.matchers[index].MatchString(p.line)
+			if matched && p.color {
+				p.colorMatch(p.regexes[index])
+			}
+			p.push(boolean(matched))
 
 		case compiler.IndexMulti:
 			numValues := int(code[ip])
@@ -320,21 +365,33 @@ func (p *interp) execute(code []compiler.Opcode) error {
 
 		case compiler.Add:
 			l, r := p.peekPop()
-			p.replaceTop(num(l.num() + r.num()))
+			if bothNum(l, r) {
+				p.replaceTop(num(l.n + r.n))
+			} else {
+				p.replaceTop(num(l.num() + r.num()))
+			}
 
 		case compiler.Subtract:
 			l, r := p.peekPop()
-			p.replaceTop(num(l.num() - r.num()))
+			if bothNum(l, r) {
+				p.replaceTop(num(l.n - r.n))
+			} else {
+				p.replaceTop(num(l.num() - r.num()))
+			}
 
 		case compiler.Multiply:
 			l, r := p.peekPop()
-			p.replaceTop(num(l.num() * r.num()))
+			if bothNum(l, r) {
+				p.replaceTop(num(l.n * r.n))
+			} else {
+				p.replaceTop(num(l.num() * r.num()))
+			}
 
 		case compiler.Divide:
 			l, r := p.peekPop()
 			rf := r.num()
 			if rf == 0.0 {
-				return newError("division by zero")
+				return p.locateError(newError("division by zero"), code, ip)
 			}
 			p.replaceTop(num(l.num() / rf))
 
@@ -346,7 +403,7 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			l, r := p.peekPop()
 			rf := r.num()
 			if rf == 0.0 {
-				return newError("division by zero in mod")
+				return p.locateError(newError("division by zero in mod"), code, ip)
 			}
 			p.replaceTop(num(math.Mod(l.num(), rf)))
 
@@ -410,6 +467,71 @@ func (p *interp) execute(code []compiler.Opcode) error {
 				p.replaceTop(boolean(ln >= rn))
 			}
 
+		case compiler.EqualsNum:
+			l, r := p.peekPop()
+			if bothNum(l, r) {
+				p.replaceTop(boolean(l.n == r.n))
+			} else {
+				p.replaceTop(boolean(p.compare(compiler.Equals, l, r)))
+			}
+
+		case compiler.NotEqualsNum:
+			l, r := p.peekPop()
+			if bothNum(l, r) {
+				p.replaceTop(boolean(l.n != r.n))
+			} else {
+				p.replaceTop(boolean(p.compare(compiler.NotEquals, l, r)))
+			}
+
+		case compiler.CompareSpecialNum:
+			compareOp := code[ip]
+			index := code[ip+1]
+			r := p.nums[code[ip+2]]
+			ip += 3
+			var l float64
+			switch index {
+			case ast.V_NR:
+				l = float64(p.lineNum)
+			case ast.V_FNR:
+				l = float64(p.fileLineNum)
+			default: // ast.V_NF
+				p.ensureFields()
+				l = float64(p.numFields)
+			}
+			p.push(boolean(compareNums(compareOp, l, r)))
+
+		case compiler.LessNum:
+			l, r := p.peekPop()
+			if bothNum(l, r) {
+				p.replaceTop(boolean(l.n < r.n))
+			} else {
+				p.replaceTop(boolean(p.compare(compiler.Less, l, r)))
+			}
+
+		case compiler.GreaterNum:
+			l, r := p.peekPop()
+			if bothNum(l, r) {
+				p.replaceTop(boolean(l.n > r.n))
+			} else {
+				p.replaceTop(boolean(p.compare(compiler.Greater, l, r)))
+			}
+
+		case compiler.LessOrEqualNum:
+			l, r := p.peekPop()
+			if bothNum(l, r) {
+				p.replaceTop(boolean(l.n <= r.n))
+			} else {
+				p.replaceTop(boolean(p.compare(compiler.LessOrEqual, l, r)))
+			}
+
+		case compiler.GreaterOrEqualNum:
+			l, r := p.peekPop()
+			if bothNum(l, r) {
+				p.replaceTop(boolean(l.n >= r.n))
+			} else {
+				p.replaceTop(boolean(p.compare(compiler.GreaterOrEqual, l, r)))
+			}
+
 		case compiler.Concat2:
 			l, r := p.peekPop()
 			p.replaceTop(str(p.toString(l) + p.toString(r)))
@@ -418,29 +540,37 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			numValues := int(code[ip])
 			ip++
 			values := p.popSlice(numValues)
+			// Convert the values to strings first so the result can be
+			// built with a single allocation.
+			size := 0
+			for i, v := range values {
+				s := p.toString(v)
+				values[i] = str(s)
+				size += len(s)
+			}
 			var sb strings.Builder
-
+			sb.Grow(size)
 			for _, v := range values {
-				sb.WriteString(p.toString(v))
+				sb.WriteString(v.s)
 			}
 			p.push(str(sb.String()))
 
 		case compiler.Match:
 			l, r := p.peekPop()
-			re, err := p.compileRegex(p.toString(r))
+			m, err := p.compileMatcher(p.toString(r))
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
-			matched := re.MatchString(p.toString(l))
+			matched := m.MatchString(p.toString(l))
 			p.replaceTop(boolean(matched))
 
 		case compiler.NotMatch:
 			l, r := p.peekPop()
-			re, err := p.compileRegex(p.toString(r))
+			m, err := p.compileMatcher(p.toString(r))
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
-			matched := re.MatchString(p.toString(l))
+			matched := m.MatchString(p.toString(l))
 			p.replaceTop(boolean(!matched))
 
 		case compiler.Not:
@@ -456,15 +586,77 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			p.replaceTop(boolean(p.peekTop().boolean()))
 
 		case compiler.Jump:
-			offset := code[ip]
-			ip += 1 + int(offset)
+			var err error
+			ip, err = p.jump(ip+1, code[ip])
+			if err != nil {
+				return p.locateError(err, code, ip)
+			}
+
+		case compiler.Switch:
+			table := &p.program.Compiled.JumpTables[code[ip]]
+			ip++
+			v := p.pop()
+			offset, ok := 0, false
+			if table.Nums != nil {
+				if n, isStr := v.isTrueStr(); !isStr {
+					offset, ok = table.Nums[n]
+				} else {
+					offset, ok = table.Strs[p.toString(v)]
+				}
+			} else {
+				offset, ok = table.Strs[p.toString(v)]
+			}
+			if !ok {
+				offset = table.Default
+			}
+			var err error
+			ip, err = p.jump(ip, compiler.Opcode(offset))
+			if err != nil {
+				return p.locateError(err, code, ip)
+			}
+
+		case compiler.SumFields:
+			start := int(code[ip])
+			ip++
+			p.ensureFields()
+			if start > p.numFields {
+				// Loop doesn't run, so the sum variable isn't touched
+				s := p.peekTop()
+				p.replaceTop(num(float64(start)))
+				p.push(s)
+				break
+			}
+			sum := p.peekTop().num()
+			if p.numberParser != nil {
+				// Slower path that converts fields like getField does
+				for i := start; i <= p.numFields; i++ {
+					v, _ := p.getField(i)
+					sum += v.num()
+				}
+			} else {
+				i := start
+				if i == 0 {
+					p.ensureLine()
+					sum += parseFloatPrefix(p.line)
+					i++
+				}
+				for _, field := range p.fields[i-1 : p.numFields] {
+					sum += parseFloatPrefix(field)
+				}
+			}
+			p.replaceTop(num(float64(p.numFields + 1)))
+			p.push(num(sum))
 
 		case compiler.JumpFalse:
 			offset := code[ip]
 			ip++
 			v := p.pop()
 			if !v.boolean() {
-				ip += int(offset)
+				var err error
+				ip, err = p.jump(ip, offset)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
 			}
 
 		case compiler.JumpTrue:
@@ -472,7 +664,11 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			ip++
 			v := p.pop()
 			if v.boolean() {
-				ip += int(offset)
+				var err error
+				ip, err = p.jump(ip, offset)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
 			}
 
 		case compiler.JumpEquals:
@@ -488,7 +684,11 @@ func (p *interp) execute(code []compiler.Opcode) error {
 				b = ln == rn
 			}
 			if b {
-				ip += int(offset)
+				var err error
+				ip, err = p.jump(ip, offset)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
 			}
 
 		case compiler.JumpNotEquals:
@@ -504,7 +704,11 @@ func (p *interp) execute(code []compiler.Opcode) error {
 				b = ln != rn
 			}
 			if b {
-				ip += int(offset)
+				var err error
+				ip, err = p.jump(ip, offset)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
 			}
 
 		case compiler.JumpLess:
@@ -520,7 +724,11 @@ func (p *interp) execute(code []compiler.Opcode) error {
 				b = ln < rn
 			}
 			if b {
-				ip += int(offset)
+				var err error
+				ip, err = p.jump(ip, offset)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
 			}
 
 		case compiler.JumpGreater:
@@ -536,7 +744,11 @@ func (p *interp) execute(code []compiler.Opcode) error {
 				b = ln > rn
 			}
 			if b {
-				ip += int(offset)
+				var err error
+				ip, err = p.jump(ip, offset)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
 			}
 
 		case compiler.JumpLessOrEqual:
@@ -552,7 +764,11 @@ func (p *interp) execute(code []compiler.Opcode) error {
 				b = ln <= rn
 			}
 			if b {
-				ip += int(offset)
+				var err error
+				ip, err = p.jump(ip, offset)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
 			}
 
 		case compiler.JumpGreaterOrEqual:
@@ -568,7 +784,119 @@ func (p *interp) execute(code []compiler.Opcode) error {
 				b = ln >= rn
 			}
 			if b {
-				ip += int(offset)
+				var err error
+				ip, err = p.jump(ip, offset)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
+			}
+
+		case compiler.JumpEqualsNum:
+			offset := code[ip]
+			ip++
+			l, r := p.popTwo()
+			var b bool
+			if bothNum(l, r) {
+				b = l.n == r.n
+			} else {
+				b = p.compare(compiler.Equals, l, r)
+			}
+			if b {
+				var err error
+				ip, err = p.jump(ip, offset)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
+			}
+
+		case compiler.JumpNotEqualsNum:
+			offset := code[ip]
+			ip++
+			l, r := p.popTwo()
+			var b bool
+			if bothNum(l, r) {
+				b = l.n != r.n
+			} else {
+				b = p.compare(compiler.NotEquals, l, r)
+			}
+			if b {
+				var err error
+				ip, err = p.jump(ip, offset)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
+			}
+
+		case compiler.JumpLessNum:
+			offset := code[ip]
+			ip++
+			l, r := p.popTwo()
+			var b bool
+			if bothNum(l, r) {
+				b = l.n < r.n
+			} else {
+				b = p.compare(compiler.Less, l, r)
+			}
+			if b {
+				var err error
+				ip, err = p.jump(ip, offset)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
+			}
+
+		case compiler.JumpGreaterNum:
+			offset := code[ip]
+			ip++
+			l, r := p.popTwo()
+			var b bool
+			if bothNum(l, r) {
+				b = l.n > r.n
+			} else {
+				b = p.compare(compiler.Greater, l, r)
+			}
+			if b {
+				var err error
+				ip, err = p.jump(ip, offset)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
+			}
+
+		case compiler.JumpLessOrEqualNum:
+			offset := code[ip]
+			ip++
+			l, r := p.popTwo()
+			var b bool
+			if bothNum(l, r) {
+				b = l.n <= r.n
+			} else {
+				b = p.compare(compiler.LessOrEqual, l, r)
+			}
+			if b {
+				var err error
+				ip, err = p.jump(ip, offset)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
+			}
+
+		case compiler.JumpGreaterOrEqualNum:
+			offset := code[ip]
+			ip++
+			l, r := p.popTwo()
+			var b bool
+			if bothNum(l, r) {
+				b = l.n >= r.n
+			} else {
+				b = p.compare(compiler.GreaterOrEqual, l, r)
+			}
+			if b {
+				var err error
+				ip, err = p.jump(ip, offset)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
 			}
 
 		case compiler.Next:
@@ -588,7 +916,11 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			ip += 5
 			array := p.array(ast.VarScope(arrayScope), int(arrayIndex))
 			loopCode := code[ip : ip+int(offset)]
-			for index := range array {
+			err := array.each(func(index string, _ value) error {
+				err := p.checkContext()
+				if err != nil {
+					return err
+				}
 				switch ast.VarScope(varScope) {
 				case ast.ScopeGlobal:
 					p.globals[varIndex] = str(index)
@@ -600,13 +932,10 @@ func (p *interp) execute(code []compiler.Opcode) error {
 						return err
 					}
 				}
-				err := p.execute(loopCode)
-				if err == errBreak {
-					break
-				}
-				if err != nil {
-					return err
-				}
+				return p.execute(loopCode)
+			})
+			if err != nil && err != errBreak {
+				return p.locateError(err, code, ip)
 			}
 			ip += int(offset)
 
@@ -618,7 +947,7 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			ip++
 			err := p.callBuiltin(builtinOp)
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 
 		case compiler.CallSplit:
@@ -628,7 +957,7 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			s := p.toString(p.peekTop())
 			n, err := p.split(s, ast.VarScope(arrayScope), int(arrayIndex), p.fieldSep)
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 			p.replaceTop(num(float64(n)))
 
@@ -639,28 +968,153 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			s, fieldSep := p.peekPop()
 			n, err := p.split(p.toString(s), ast.VarScope(arrayScope), int(arrayIndex), p.toString(fieldSep))
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
+			}
+			p.replaceTop(num(float64(n)))
+
+		case compiler.CallSplitSeps:
+			arrayScope := code[ip]
+			arrayIndex := code[ip+1]
+			sepsScope := code[ip+2]
+			sepsIndex := code[ip+3]
+			ip += 4
+			s, fieldSep := p.peekPop()
+			n, err := p.splitSeps(p.toString(s), ast.VarScope(arrayScope), int(arrayIndex),
+				ast.VarScope(sepsScope), int(sepsIndex), p.toString(fieldSep))
+			if err != nil {
+				return p.locateError(err, code, ip)
+			}
+			p.replaceTop(num(float64(n)))
+
+		case compiler.CallMatch:
+			arrayScope := code[ip]
+			arrayIndex := code[ip+1]
+			ip += 2
+			s, regex := p.peekPop()
+			n, err := p.matchArray(p.toString(s), p.toString(regex), ast.VarScope(arrayScope), int(arrayIndex))
+			if err != nil {
+				return p.locateError(err, code, ip)
+			}
+			p.replaceTop(num(float64(n)))
+
+		case compiler.CallParsequery:
+			arrayScope := code[ip]
+			arrayIndex := code[ip+1]
+			ip += 2
+			n := p.parseQuery(p.toString(p.peekTop()), ast.VarScope(arrayScope), int(arrayIndex))
+			p.replaceTop(num(float64(n)))
+
+		case compiler.CallGlob:
+			arrayScope := code[ip]
+			arrayIndex := code[ip+1]
+			ip += 2
+			n, err := p.glob(p.toString(p.peekTop()), ast.VarScope(arrayScope), int(arrayIndex))
+			if err != nil {
+				return p.locateError(err, code, ip)
 			}
 			p.replaceTop(num(float64(n)))
 
+		case compiler.CallStat:
+			arrayScope := code[ip]
+			arrayIndex := code[ip+1]
+			ip += 2
+			n, err := p.stat(p.toString(p.peekTop()), ast.VarScope(arrayScope), int(arrayIndex))
+			if err != nil {
+				return p.locateError(err, code, ip)
+			}
+			p.replaceTop(num(float64(n)))
+
+		case compiler.CallSqlQuery:
+			arrayScope := code[ip]
+			arrayIndex := code[ip+1]
+			numArgs := code[ip+2]
+			ip += 3
+			args := p.popSlice(int(numArgs))
+			n, err := p.sqlQuery(args[0], p.toString(args[1]), args[2:], ast.VarScope(arrayScope), int(arrayIndex))
+			if err != nil {
+				return p.locateError(err, code, ip)
+			}
+			p.push(num(float64(n)))
+
+		case compiler.CallSqlExec:
+			numArgs := code[ip]
+			ip++
+			args := p.popSlice(int(numArgs))
+			n, err := p.sqlExec(args[0], p.toString(args[1]), args[2:])
+			if err != nil {
+				return p.locateError(err, code, ip)
+			}
+			p.push(num(float64(n)))
+
 		case compiler.CallSprintf:
 			numArgs := code[ip]
 			ip++
 			args := p.popSlice(int(numArgs))
 			s, err := p.sprintf(p.toString(args[0]), args[1:])
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 			p.push(str(s))
 
+		case compiler.CallMax, compiler.CallMin:
+			numArgs := code[ip]
+			ip++
+			args := p.popSlice(int(numArgs))
+			n := args[0].num()
+			for _, arg := range args[1:] {
+				m := arg.num()
+				if (op == compiler.CallMax && m > n) || (op == compiler.CallMin && m < n) {
+					n = m
+				}
+			}
+			p.push(num(n))
+
+		case compiler.CallDumparr:
+			arrayScope := code[ip]
+			arrayIndex := code[ip+1]
+			ip += 2
+			format, dest := p.peekPop()
+			n, err := p.dumpArray(ast.VarScope(arrayScope), int(arrayIndex), p.toString(format), dest)
+			if err != nil {
+				return p.locateError(err, code, ip)
+			}
+			p.replaceTop(num(float64(n)))
+
+		case compiler.CallCopy:
+			srcScope := code[ip]
+			srcIndex := code[ip+1]
+			dstScope := code[ip+2]
+			dstIndex := code[ip+3]
+			ip += 4
+			src := p.array(ast.VarScope(srcScope), int(srcIndex))
+			dst := p.array(ast.VarScope(dstScope), int(dstIndex))
+			dst.copy(src)
+			p.push(num(float64(dst.len())))
+
+		case compiler.CallKeys, compiler.CallValues:
+			srcScope := code[ip]
+			srcIndex := code[ip+1]
+			dstScope := code[ip+2]
+			dstIndex := code[ip+3]
+			ip += 4
+			src := p.array(ast.VarScope(srcScope), int(srcIndex))
+			dst := p.array(ast.VarScope(dstScope), int(dstIndex))
+			sorted := p.peekTop().boolean()
+			n := p.listArray(src, dst, op == compiler.CallValues, sorted)
+			p.replaceTop(num(float64(n)))
+
 		case compiler.CallUser:
 			funcIndex := code[ip]
 			numArrayArgs := int(code[ip+1])
 			ip += 2
 
 			f := p.program.Compiled.Functions[funcIndex]
-			if p.callDepth >= maxCallDepth {
-				return newError("calling %q exceeded maximum call depth of %d", f.Name, maxCallDepth)
+			if p.callDepth >= p.maxCallDepth {
+				return p.locateError(newError("calling %q exceeded maximum call depth of %d", f.Name, p.maxCallDepth), code, ip)
+			}
+			err := p.checkContext()
+			if err != nil {
+				return p.locateError(err, code, ip)
 			}
 
 			// Set up frame for scalar arguments
@@ -678,13 +1132,37 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			oldArraysLen := len(p.arrays)
 			for j := numArrayArgs; j < f.NumArrays; j++ {
 				arrays = append(arrays, len(p.arrays))
-				p.arrays = append(p.arrays, make(map[string]value))
+				p.arrays = append(p.arrays, newArray(p.orderedArrays))
 			}
 			p.localArrays = append(p.localArrays, arrays)
 
 			// Execute the function!
 			p.callDepth++
-			err := p.execute(f.Body)
+			var start time.Time
+			if p.profile != nil {
+				start = p.profile.enterFunction(int(funcIndex))
+			}
+			for {
+				err = p.execute(f.Body)
+				tc, ok := err.(tailCall)
+				if !ok {
+					break
+				}
+				// The function called itself as a tail call: TailCall
+				// has already set the scalar params, so set up the
+				// arrays and run the body again in the same frame.
+				err = p.checkContext()
+				if err != nil {
+					break
+				}
+				p.localArrays[len(p.localArrays)-1] = p.tailCallArrays(f, tc.arrays, oldArraysLen)
+				if p.profile != nil {
+					p.profile.functions[funcIndex].Count++
+				}
+			}
+			if p.profile != nil {
+				p.profile.exitFunction(int(funcIndex), start)
+			}
 			p.callDepth--
 
 			// Pop the locals off the stack
@@ -696,7 +1174,7 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			if r, ok := err.(returnValue); ok {
 				p.push(r.Value)
 			} else if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			} else {
 				p.push(null())
 			}
@@ -709,7 +1187,7 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			args := p.popSlice(numArgs)
 			r, err := p.callNative(funcIndex, args)
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 			p.push(r)
 
@@ -720,42 +1198,203 @@ func (p *interp) execute(code []compiler.Opcode) error {
 		case compiler.ReturnNull:
 			return returnValue{null()}
 
+		case compiler.TailCall:
+			funcIndex := code[ip]
+			numArrayArgs := int(code[ip+1])
+			ip += 2
+
+			// Arguments replace the current frame's values (this is
+			// only used for calls of the function that's running)
+			f := p.program.Compiled.Functions[funcIndex]
+			copy(p.frame, p.popSlice(f.NumScalars))
+			var arrays []int
+			for j := 0; j < numArrayArgs; j++ {
+				arrayScope := ast.VarScope(code[ip])
+				arrayIndex := int(code[ip+1])
+				ip += 2
+				arrays = append(arrays, p.arrayIndex(arrayScope, arrayIndex))
+			}
+			return tailCall{arrays}
+
+		case compiler.Cover:
+			index := code[ip]
+			ip++
+			if p.coverCounts != nil {
+				p.coverCounts[index]++
+			}
+			if p.trace != nil {
+				err := p.traceStmt(int(index))
+				if err != nil {
+					return err
+				}
+			}
+
+		case compiler.FieldIntCompare:
+			// FieldInt index; Num|Str constIndex; Equals..GreaterOrEqual
+			l, err := p.getField(int(code[ip]))
+			if err != nil {
+				return p.locateError(err, code, ip)
+			}
+			r := p.constant(code[ip+1], code[ip+2])
+			compareOp := code[ip+3]
+			ip += 4
+			p.push(boolean(p.compare(compareOp, l, r)))
+
+		case compiler.FieldIntJump:
+			// FieldInt index; Num|Str constIndex; JumpEquals.. offset
+			l, err := p.getField(int(code[ip]))
+			if err != nil {
+				return p.locateError(err, code, ip)
+			}
+			r := p.constant(code[ip+1], code[ip+2])
+			compareOp := compiler.Equals + code[ip+3] - compiler.JumpEquals
+			offset := code[ip+4]
+			ip += 5
+			if p.compare(compareOp, l, r) {
+				var err error
+				ip, err = p.jump(ip, offset)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
+			}
+
+		case compiler.GlobalJumpNum:
+			// Global index; Num|Global|Special index or SpecialNF|SpecialNR|CachedNF;
+			// JumpEqualsNum.. offset
+			l := p.globals[code[ip]]
+			var r value
+			jump := ip + 3 // address of the jump, after the second instruction
+			switch code[ip+1] {
+			case compiler.Global:
+				r = p.globals[code[ip+2]]
+			case compiler.Special:
+				r = p.getSpecial(int(code[ip+2]))
+			case compiler.SpecialNF:
+				p.ensureFields()
+				r = num(float64(p.numFields))
+				jump = ip + 2
+			case compiler.SpecialNR:
+				r = num(float64(p.lineNum))
+				jump = ip + 2
+			case compiler.CachedNF:
+				r = num(float64(p.numFields))
+				jump = ip + 2
+			default: // Num
+				r = num(p.nums[code[ip+2]])
+			}
+			jumpOp := code[jump]
+			offset := code[jump+1]
+			ip = jump + 2
+			var b bool
+			if bothNum(l, r) {
+				b = compareNums(compiler.Equals+jumpOp-compiler.JumpEqualsNum, l.n, r.n)
+			} else {
+				b = p.compare(compiler.Equals+jumpOp-compiler.JumpEqualsNum, l, r)
+			}
+			if b {
+				var err error
+				ip, err = p.jump(ip, offset)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
+			}
+
+		case compiler.GlobalArithAssign:
+			// Global index; Num constIndex; Add|Subtract|Multiply; AssignGlobal index
+			l := p.globals[code[ip]].num()
+			r := p.nums[code[ip+2]]
+			var v float64
+			switch code[ip+3] {
+			case compiler.Add:
+				v = l + r
+			case compiler.Subtract:
+				v = l - r
+			default: // Multiply
+				v = l * r
+			}
+			p.globals[code[ip+5]] = num(v)
+			ip += 6
+
 		case compiler.Nulls:
 			numNulls := int(code[ip])
 			ip++
 			p.pushNulls(numNulls)
 
+		case compiler.PrintFields:
+			numFields := int(code[ip])
+			indexes := code[ip+1 : ip+1+numFields]
+			ip += 1 + numFields
+			err := p.printFields(indexes)
+			if err != nil {
+				return p.locateError(err, code, ip)
+			}
+
 		case compiler.Print:
 			numArgs := code[ip]
 			redirect := lexer.Token(code[ip+1])
 			ip += 2
 
 			// Print OFS-separated args followed by ORS (usually newline)
-			var line string
+			var args []value
 			if numArgs > 0 {
-				args := p.popSlice(int(numArgs))
-				strs := make([]string, len(args))
+				args = p.popSlice(int(numArgs))
+			}
+
+			output := p.output
+			if redirect != lexer.ILLEGAL {
+				var err error
+				dest := p.pop()
+				output, err = p.getOutputStream(redirect, dest)
+				if err != nil {
+					return p.locateError(err, code, ip)
+				}
+			}
+			if numArgs == 0 {
+				p.ensureLine()
+			}
+			line := p.line
+			if len(p.colorRegexes) > 0 && redirect == lexer.ILLEGAL {
 				for i, a := range args {
-					strs[i] = a.str(p.outputFormat)
+					args[i] = str(p.highlight(p.toOutputString(a)))
 				}
-				line = strings.Join(strs, p.outputFieldSep)
+				line = p.highlight(line)
+			}
+			var err error
+			if numArgs > 0 {
+				err = p.printValues(output, args)
 			} else {
 				// "print" with no args is equivalent to "print $0"
-				line = p.line
+				err = p.printLine(output, line)
+			}
+			if err != nil {
+				return p.locateError(err, code, ip)
 			}
 
+		case compiler.PrintSorted:
+			varScope := ast.VarScope(code[ip])
+			varIndex := int(code[ip+1])
+			arrayScope := ast.VarScope(code[ip+2])
+			arrayIndex := int(code[ip+3])
+			numArgs := int(code[ip+4])
+			redirect := lexer.Token(code[ip+5])
+			ip += 6
+
 			output := p.output
 			if redirect != lexer.ILLEGAL {
-				var err error
 				dest := p.pop()
-				output, err = p.getOutputStream(redirect, dest)
-				if err != nil {
-					return err
+				// An empty loop prints nothing, so it mustn't create or
+				// truncate the file (or start the command)
+				if p.array(arrayScope, arrayIndex).len() > 0 {
+					var err error
+					output, err = p.getOutputStream(redirect, dest)
+					if err != nil {
+						return p.locateError(err, code, ip)
+					}
 				}
 			}
-			err := p.printLine(output, line)
+			err := p.printSorted(output, varScope, varIndex, arrayScope, arrayIndex, numArgs)
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 
 		case compiler.Printf:
@@ -764,9 +1403,9 @@ func (p *interp) execute(code []compiler.Opcode) error {
 			ip += 2
 
 			args := p.popSlice(int(numArgs))
-			s, err := p.sprintf(p.toString(args[0]), args[1:])
+			err := p.format(p.toString(args[0]), args[1:])
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 
 			output := p.output
@@ -774,12 +1413,16 @@ func (p *interp) execute(code []compiler.Opcode) error {
 				dest := p.pop()
 				output, err = p.getOutputStream(redirect, dest)
 				if err != nil {
-					return err
+					return p.locateError(err, code, ip)
 				}
 			}
-			err = writeOutput(output, s)
+			if crlfNewline {
+				err = writeOutput(output, p.formatBuf.String())
+			} else {
+				_, err = output.Write(p.formatBuf.Bytes())
+			}
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 
 		case compiler.Getline:
@@ -788,7 +1431,7 @@ func (p *interp) execute(code []compiler.Opcode) error {
 
 			ret, line, err := p.getline(redirect)
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 			if ret == 1 {
 				p.setLine(line, false)
@@ -801,15 +1444,16 @@ func (p *interp) execute(code []compiler.Opcode) error {
 
 			ret, line, err := p.getline(redirect)
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
+			index := p.peekTop()
 			if ret == 1 {
-				err := p.setField(0, line)
+				err := p.setField(int(index.num()), line)
 				if err != nil {
-					return err
+					return p.locateError(err, code, ip)
 				}
 			}
-			p.push(num(ret))
+			p.replaceTop(num(ret))
 
 		case compiler.GetlineGlobal:
 			redirect := lexer.Token(code[ip])
@@ -818,10 +1462,10 @@ func (p *interp) execute(code []compiler.Opcode) error {
 
 			ret, line, err := p.getline(redirect)
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 			if ret == 1 {
-				p.globals[index] = numStr(line)
+				p.globals[index] = p.inputStr(line)
 			}
 			p.push(num(ret))
 
@@ -832,10 +1476,10 @@ func (p *interp) execute(code []compiler.Opcode) error {
 
 			ret, line, err := p.getline(redirect)
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 			if ret == 1 {
-				p.frame[index] = numStr(line)
+				p.frame[index] = p.inputStr(line)
 			}
 			p.push(num(ret))
 
@@ -846,12 +1490,12 @@ func (p *interp) execute(code []compiler.Opcode) error {
 
 			ret, line, err := p.getline(redirect)
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
 			if ret == 1 {
-				err := p.setSpecial(int(index), numStr(line))
+				err := p.setSpecial(int(index), p.inputStr(line))
 				if err != nil {
-					return err
+					return p.locateError(err, code, ip)
 				}
 			}
 			p.push(num(ret))
@@ -864,12 +1508,12 @@ func (p *interp) execute(code []compiler.Opcode) error {
 
 			ret, line, err := p.getline(redirect)
 			if err != nil {
-				return err
+				return p.locateError(err, code, ip)
 			}
-			index := p.toString(p.peekTop())
+			index := p.arrayKey(p.peekTop())
 			if ret == 1 {
 				array := p.array(ast.VarScope(arrayScope), int(arrayIndex))
-				array[index] = numStr(line)
+				array.set(index, p.inputStr(line))
 			}
 			p.replaceTop(num(ret))
 		}
@@ -891,6 +1535,7 @@ func (p *interp) callBuiltin(builtinOp compiler.BuiltinOp) error {
 			delete(p.inputStreams, name)
 			err := c.Close()
 			if err != nil {
+				p.setErrno(err)
 				p.replaceTop(num(-1))
 			} else {
 				p.replaceTop(num(0))
@@ -902,12 +1547,14 @@ func (p *interp) callBuiltin(builtinOp compiler.BuiltinOp) error {
 				delete(p.outputStreams, name)
 				err := c.Close()
 				if err != nil {
+					p.setErrno(err)
 					p.replaceTop(num(-1))
 				} else {
 					p.replaceTop(num(0))
 				}
 			} else {
 				// Nothing to close
+				p.errno = "close of redirection that was never opened"
 				p.replaceTop(num(-1))
 			}
 		}
@@ -960,6 +1607,7 @@ func (p *interp) callBuiltin(builtinOp compiler.BuiltinOp) error {
 		p.replaceTop(num(float64(int(p.peekTop().num()))))
 
 	case compiler.BuiltinLength:
+		p.ensureLine()
 		p.push(num(float64(len(p.line))))
 
 	case compiler.BuiltinLengthArg:
@@ -1053,64 +1701,327 @@ func (p *interp) callBuiltin(builtinOp compiler.BuiltinOp) error {
 			return newError("can't call system() due to NoExec")
 		}
 		cmdline := p.toString(p.peekTop())
-		cmd := p.execShell(cmdline)
-		cmd.Stdout = p.output
-		cmd.Stderr = p.errorOutput
-		_ = p.flushAll() // ensure synchronization
-		err := cmd.Start()
-		var ret float64
-		if err != nil {
-			p.printErrorf("%s\n", err)
-			ret = -1
-		} else {
-			err = cmd.Wait()
-			if err != nil {
-				if exitErr, ok := err.(*exec.ExitError); ok {
-					ret = float64(exitErr.ProcessState.ExitCode())
-				} else {
-					p.printErrorf("unexpected error running command %q: %v\n", cmdline, err)
-					ret = -1
-				}
-			} else {
-				ret = 0
-			}
+		ret := p.runSystem(cmdline)
+		if p.ctx.Err() != nil {
+			return p.ctx.Err()
 		}
 		p.replaceTop(num(ret))
 
 	case compiler.BuiltinTolower:
-		p.replaceTop(str(strings.ToLower(p.toString(p.peekTop()))))
+		p.replaceTop(str(p.locale.ToLower(p.toString(p.peekTop()))))
 
 	case compiler.BuiltinToupper:
-		p.replaceTop(str(strings.ToUpper(p.toString(p.peekTop()))))
+		p.replaceTop(str(p.locale.ToUpper(p.toString(p.peekTop()))))
+
+	case compiler.BuiltinAbs:
+		p.replaceTop(num(math.Abs(p.peekTop().num())))
+
+	case compiler.BuiltinB64decode:
+		s, urlSafe := p.peekPop()
+		p.replaceTop(str(base64Decode(p.toString(s), urlSafe.boolean())))
+
+	case compiler.BuiltinB64encode:
+		s, urlSafe := p.peekPop()
+		encoding := base64.StdEncoding
+		if urlSafe.boolean() {
+			encoding = base64.RawURLEncoding
+		}
+		p.replaceTop(str(encoding.EncodeToString([]byte(p.toString(s)))))
+
+	case compiler.BuiltinCeil:
+		p.replaceTop(num(math.Ceil(p.peekTop().num())))
+
+	case compiler.BuiltinChr:
+		p.replaceTop(str(chr(p.peekTop().num())))
+
+	case compiler.BuiltinFilesize, compiler.BuiltinMtime:
+		info, err := p.fileInfo(p.toString(p.peekTop()))
+		if err != nil {
+			return err
+		}
+		n := -1.0
+		if info != nil {
+			if builtinOp == compiler.BuiltinFilesize {
+				n = float64(info.Size())
+			} else {
+				n = float64(info.ModTime().Unix())
+			}
+		}
+		p.replaceTop(num(n))
+
+	case compiler.BuiltinFloor:
+		p.replaceTop(num(math.Floor(p.peekTop().num())))
+
+	case compiler.BuiltinHmac:
+		data, algo := p.popTwo()
+		s, err := hmacDigest(p.toString(p.peekTop()), p.toString(data), p.toString(algo))
+		if err != nil {
+			return err
+		}
+		p.replaceTop(str(s))
+
+	case compiler.BuiltinMd5:
+		sum := md5.Sum([]byte(p.toString(p.peekTop())))
+		p.replaceTop(str(hex.EncodeToString(sum[:])))
+
+	case compiler.BuiltinMktime:
+		spec, utc := p.peekPop()
+		p.replaceTop(num(p.mktime(p.toString(spec), utc.boolean())))
+
+	case compiler.BuiltinMonotime:
+		p.push(num(time.Since(p.startTime).Seconds()))
+
+	case compiler.BuiltinOrd:
+		p.replaceTop(num(float64(ord(p.toString(p.peekTop())))))
+
+	case compiler.BuiltinRedisGet:
+		v, err := p.redisGet(p.toString(p.peekTop()))
+		if err != nil {
+			return err
+		}
+		p.replaceTop(v)
+
+	case compiler.BuiltinRedisIncr:
+		key, n := p.peekPop()
+		v, err := p.redisIncr(p.toString(key), n.num())
+		if err != nil {
+			return err
+		}
+		p.replaceTop(v)
+
+	case compiler.BuiltinRedisSet:
+		key, v := p.peekPop()
+		n, err := p.redisSet(p.toString(key), p.toString(v))
+		if err != nil {
+			return err
+		}
+		p.replaceTop(num(float64(n)))
+
+	case compiler.BuiltinRound:
+		p.replaceTop(num(math.Round(p.peekTop().num())))
+
+	case compiler.BuiltinRoundDigits:
+		x, digits := p.peekPop()
+		p.replaceTop(num(roundDigits(x.num(), int(digits.num()))))
+
+	case compiler.BuiltinSbAdd:
+		handle, s := p.peekPop()
+		b, err := p.stringBuilder(handle)
+		if err != nil {
+			return err
+		}
+		b.WriteString(p.toString(s))
+		p.replaceTop(num(float64(b.Len())))
+
+	case compiler.BuiltinSbNew:
+		p.builders = append(p.builders, &strings.Builder{})
+		p.push(num(float64(len(p.builders))))
+
+	case compiler.BuiltinSbStr:
+		b, err := p.stringBuilder(p.peekTop())
+		if err != nil {
+			return err
+		}
+		p.replaceTop(str(b.String()))
+
+	case compiler.BuiltinSetenv:
+		name, v := p.peekPop()
+		err := p.setenv(p.toString(name), p.toString(v), true)
+		if err != nil {
+			return err
+		}
+		p.replaceTop(num(0))
+
+	case compiler.BuiltinSha1:
+		sum := sha1.Sum([]byte(p.toString(p.peekTop())))
+		p.replaceTop(str(hex.EncodeToString(sum[:])))
+
+	case compiler.BuiltinSha256:
+		sum := sha256.Sum256([]byte(p.toString(p.peekTop())))
+		p.replaceTop(str(hex.EncodeToString(sum[:])))
+
+	case compiler.BuiltinSleep:
+		err := p.sleep(p.peekTop().num())
+		if err != nil {
+			return err
+		}
+		p.replaceTop(num(0))
+
+	case compiler.BuiltinSqlClose:
+		n, err := p.sqlClose(p.peekTop())
+		if err != nil {
+			return err
+		}
+		p.replaceTop(num(float64(n)))
+
+	case compiler.BuiltinSqlOpen:
+		n, err := p.sqlOpen(p.toString(p.peekTop()))
+		if err != nil {
+			return err
+		}
+		p.replaceTop(num(float64(n)))
+
+	case compiler.BuiltinStrftime:
+		timestamp, utc := p.popTwo()
+		loc := p.location
+		if utc.boolean() {
+			loc = time.UTC
+		}
+		t := time.Unix(int64(timestamp.num()), 0).In(loc)
+		p.replaceTop(str(p.strftime(p.toString(p.peekTop()), t)))
+
+	case compiler.BuiltinSystime:
+		p.push(num(float64(time.Now().Unix())))
+
+	case compiler.BuiltinUnsetenv:
+		err := p.setenv(p.toString(p.peekTop()), "", false)
+		if err != nil {
+			return err
+		}
+		p.replaceTop(num(0))
+
+	case compiler.BuiltinUrldecode:
+		p.replaceTop(str(urlDecode(p.toString(p.peekTop()))))
+
+	case compiler.BuiltinUrlencode:
+		p.replaceTop(str(url.QueryEscape(p.toString(p.peekTop()))))
+
+	case compiler.BuiltinTrunc:
+		p.replaceTop(num(math.Trunc(p.peekTop().num())))
+
+	case compiler.BuiltinTzconvert:
+		zone, format := p.popTwo()
+		loc, err := p.loadZone(p.toString(zone))
+		if err != nil {
+			return err
+		}
+		t := time.Unix(int64(p.peekTop().num()), 0).In(loc)
+		p.replaceTop(str(p.strftime(p.toString(format), t)))
 	}
 
 	return nil
 }
 
+// Return the address of a jump by offset from ip, checking whether the
+// context has been cancelled if it's a backward jump (a loop back-edge).
+func (p *interp) jump(ip int, offset compiler.Opcode) (int, error) {
+	ip += int(offset)
+	if offset < 0 {
+		return ip, p.checkContext()
+	}
+	return ip, nil
+}
+
+// Check whether the context has been cancelled. This is called on loop
+// back-edges, function calls, and for each input record, so it only
+// does the (relatively slow) channel check every checkContextOps calls.
+// The counter check is kept separate so that it's small enough to be
+// inlined at each call site.
+func (p *interp) checkContext() error {
+	p.ctxCounter++
+	if p.ctxCounter < checkContextOps {
+		return nil
+	}
+	return p.checkContextSlow()
+}
+
+//go:noinline
+func (p *interp) checkContextSlow() error {
+	p.ctxCounter = 0
+	select {
+	case <-p.ctxDone:
+		return p.ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// Return the value of the Num or Str constant with the given index.
+func (p *interp) constant(op, index compiler.Opcode) value {
+	if op == compiler.Str {
+		return str(p.strs[index])
+	}
+	return num(p.nums[index])
+}
+
+// Compare l and r using the given comparison opcode (Equals through
+// GreaterOrEqual) and AWK's rules: as strings if either is a "true
+// string", otherwise as numbers.
+func (p *interp) compare(op compiler.Opcode, l, r value) bool {
+	var ln, rn float64
+	isStr := l.typ == typeStr || r.typ == typeStr
+	if !isStr {
+		// Only check whether numeric strings (like fields) look numeric
+		// if the other side isn't a string, as in $1 == "foo"
+		var lIsStr, rIsStr bool
+		ln, lIsStr = l.isTrueStr()
+		rn, rIsStr = r.isTrueStr()
+		isStr = lIsStr || rIsStr
+	}
+	if isStr {
+		ls, rs := p.toString(l), p.toString(r)
+		switch op {
+		case compiler.Equals:
+			return ls == rs
+		case compiler.NotEquals:
+			return ls != rs
+		case compiler.Less:
+			return ls < rs
+		case compiler.Greater:
+			return ls > rs
+		case compiler.LessOrEqual:
+			return ls <= rs
+		default: // GreaterOrEqual
+			return ls >= rs
+		}
+	}
+	return compareNums(op, ln, rn)
+}
+
+// Compare numbers l and r using comparison opcode op.
+func compareNums(op compiler.Opcode, l, r float64) bool {
+	switch op {
+	case compiler.Equals:
+		return l == r
+	case compiler.NotEquals:
+		return l != r
+	case compiler.Less:
+		return l < r
+	case compiler.Greater:
+		return l > r
+	case compiler.LessOrEqual:
+		return l <= r
+	default: // GreaterOrEqual
+		return l >= r
+	}
+}
+
 // Fetch the value at the given index from array. This handles the strange
 // POSIX behavior of creating a null entry for non-existent array elements.
 // Per the POSIX spec, "Any other reference to a nonexistent array element
 // [apart from "in" expressions] shall automatically create it."
-func arrayGet(array map[string]value, index string) value {
-	v, ok := array[index]
+func arrayGet(array *array, index arrayKey) value {
+	v, ok := array.get(index)
 	if !ok {
-		array[index] = v
+		array.set(index, v)
 	}
 	return v
 }
 
 // Stack operations follow. These should be inlined. Instead of just push and
 // pop, for efficiency we have custom operations for when we're replacing the
-// top of stack without changing the stack pointer. Primarily this avoids the
-// check for append in push.
+// top of stack without changing the stack pointer. Note that push relies on
+// execute having made room for the value (see comment on execute).
 func (p *interp) push(v value) {
-	sp := p.sp
-	if sp >= len(p.stack) {
-		p.stack = append(p.stack, null())
-	}
-	p.stack[sp] = v
-	sp++
-	p.sp = sp
+	p.stack[p.sp] = v
+	p.sp++
+}
+
+// Grow the stack so it has room for at least n more values.
+func (p *interp) growStack(n int) {
+	newStack := make([]value, 2*len(p.stack)+n)
+	copy(newStack, p.stack[:p.sp])
+	p.stack = newStack
 }
 
 func (p *interp) pushNulls(num int) {
@@ -1184,6 +2095,7 @@ func (p *interp) getline(redirect lexer.Token) (float64, string, error) {
 		}
 		if !scanner.Scan() {
 			if err := scanner.Err(); err != nil {
+				p.setErrno(err)
 				return -1, "", nil
 			}
 			return 0, "", nil
@@ -1195,14 +2107,16 @@ func (p *interp) getline(redirect lexer.Token) (float64, string, error) {
 		scanner, err := p.getInputScannerFile(name)
 		if err != nil {
 			if _, ok := err.(*os.PathError); ok {
-				// File not found is not a hard error, getline just returns -1.
-				// See: https://github.com/benhoyt/goawk/issues/41
+				// File not found is not a hard error, getline just returns -1
+				// and sets ERRNO. See: https://github.com/benhoyt/goawk/issues/41
+				p.setErrno(err)
 				return -1, "", nil
 			}
 			return 0, "", err
 		}
 		if !scanner.Scan() {
 			if err := scanner.Err(); err != nil {
+				p.setErrno(err)
 				return -1, "", nil
 			}
 			return 0, "", nil
@@ -1217,12 +2131,23 @@ func (p *interp) getline(redirect lexer.Token) (float64, string, error) {
 			return 0, "", nil
 		}
 		if err != nil {
+			p.setErrno(err)
 			return -1, "", nil
 		}
 		return 1, line, nil
 	}
 }
 
+// Set ERRNO to the text of an I/O error, without the operation and
+// file name that an *os.PathError includes (like gawk, which uses the
+// C library's error message).
+func (p *interp) setErrno(err error) {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	p.errno = err.Error()
+}
+
 // Perform augmented assignment operation.
 func (p *interp) augAssignOp(op compiler.AugOp, l, r value) (value, error) {
 	switch op {
@@ -1248,3 +2173,35 @@ func (p *interp) augAssignOp(op compiler.AugOp, l, r value) (value, error) {
 		return num(math.Mod(l.num(), rf)), nil
 	}
 }
+
+// Return the local array indexes for the next run of function f's body
+// after a tail call with the given array arguments. Arrays at index
+// base and above belong to the current call: those passed as arguments
+// are kept (moved down to base), the rest are discarded, and f's local
+// arrays that aren't params get new empty arrays.
+func (p *interp) tailCallArrays(f compiler.Function, args []int, base int) []int {
+	arrays := make([]int, 0, f.NumArrays)
+	var kept []int // indexes of current call's arrays passed as arguments
+	var keptMaps []*array
+	for _, index := range args {
+		if index < base {
+			arrays = append(arrays, index)
+			continue
+		}
+		j := 0
+		for j < len(kept) && kept[j] != index {
+			j++
+		}
+		if j == len(kept) {
+			kept = append(kept, index)
+			keptMaps = append(keptMaps, p.arrays[index])
+		}
+		arrays = append(arrays, base+j)
+	}
+	p.arrays = append(p.arrays[:base], keptMaps...)
+	for j := len(args); j < f.NumArrays; j++ {
+		arrays = append(arrays, len(p.arrays))
+		p.arrays = append(p.arrays, newArray(p.orderedArrays))
+	}
+	return arrays
+}
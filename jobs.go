@@ -0,0 +1,122 @@
+// Running a program on several input files in parallel (-jobs)
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/benhoyt/goawk/interp"
+	"github.com/benhoyt/goawk/parser"
+)
+
+// Orders that -jobs-order allows for writing each file's output
+const (
+	jobsOrderArgs   = "args"   // in the order the files were given
+	jobsOrderFinish = "finish" // as soon as each file is done
+)
+
+// Result of running the program on one input file
+type jobResult struct {
+	index  int
+	output bytes.Buffer
+	status int
+	err    error
+}
+
+// Run the program separately on each of the input files in
+// config.Args, up to numJobs of them at once, each with its own
+// interpreter (so BEGIN and END run once per file). Each file's output
+// is buffered and written to stdout in one piece, in the given order.
+//
+// The exit status is that of the first file (in argument order) with a
+// non-zero status. After an error no more output is written (apart
+// from the output of the failed file before the error), and the files
+// not yet started aren't run.
+func runJobs(prog *parser.Program, config *interp.Config, numJobs int, order string) (int, error) {
+	files := config.Args
+	for _, file := range files {
+		if file == "-" || varArgRegex.MatchString(file) {
+			return 0, errors.New("-jobs input files can't include - or name=value assignments")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	indexes := make(chan int)
+	results := make(chan *jobResult)
+	var wg sync.WaitGroup
+	for i := 0; i < numJobs && i < len(files); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			interpreter := interp.New(prog)
+			for index := range indexes {
+				result := &jobResult{index: index}
+				if ctx.Err() != nil {
+					result.err = ctx.Err()
+				} else {
+					jobConfig := *config
+					jobConfig.Args = files[index : index+1]
+					jobConfig.Output = &result.output
+					result.status, result.err = interpreter.ExecuteContext(ctx, &jobConfig)
+				}
+				results <- result
+			}
+		}()
+	}
+	go func() {
+		for i := range files {
+			indexes <- i
+		}
+		close(indexes)
+		wg.Wait()
+		close(results)
+	}()
+
+	var (
+		err       error
+		statuses  = make([]int, len(files))
+		pending   = make(map[int]*jobResult) // finished, waiting for earlier files
+		nextIndex = 0
+	)
+	write := func(result *jobResult) {
+		if err != nil {
+			return
+		}
+		// Write output from before an error, as a normal run would
+		_, err = io.Copy(os.Stdout, &result.output)
+		if result.err != nil {
+			err = result.err
+		}
+		if err != nil {
+			cancel()
+		}
+		statuses[result.index] = result.status
+	}
+	for result := range results {
+		if order == jobsOrderFinish {
+			write(result)
+			continue
+		}
+		pending[result.index] = result
+		for pending[nextIndex] != nil {
+			write(pending[nextIndex])
+			delete(pending, nextIndex)
+			nextIndex++
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, status := range statuses {
+		if status != 0 {
+			return status, nil
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,687 @@
+// Package kafka is a minimal Kafka consumer, so AWK programs can read
+// the messages of a topic as input records. It speaks just enough of
+// the Kafka protocol (the Metadata, ListOffsets, and Fetch requests,
+// over plain TCP) to read a topic named by a URL like
+// kafka://broker:9092/topic, without any dependencies. A Consumer can
+// be used as an interp.MetadataSource in interp.Config.Sources.
+//
+// The partitions are read in turn, each from its earliest offset to
+// the end it had when the topic was opened, so a program's END action
+// runs once the messages that were there have been read. The URL's
+// query can select one partition and the starting offset:
+//
+//	kafka://broker/topic?partition=2&offset=1000
+//
+// The consumer isn't a member of a consumer group and doesn't commit
+// offsets. It reads uncommitted messages of transactions, and it
+// doesn't support TLS, SASL authentication, or compression other than
+// gzip.
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiFetch       = 1
+	apiListOffsets = 2
+	apiMetadata    = 3
+
+	clientID        = "goawk"
+	defaultPort     = "9092"
+	dialTimeout     = 10 * time.Second
+	ioTimeout       = 30 * time.Second
+	maxFetchBytes   = 1 << 20
+	maxResponseSize = 64 << 20
+
+	earliestOffset = -2 // ListOffsets timestamps meaning the log start
+	latestOffset   = -1 // and end
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli) // for record batch CRCs
+
+// Consumer reads the messages of a Kafka topic, one per call to Next.
+type Consumer struct {
+	topic      string
+	partitions []*partition
+	current    int              // index in partitions of the one being read
+	conns      map[string]*conn // by broker address
+	records    []record         // fetched but not returned by Next yet
+	last       record           // the record last returned by Next
+}
+
+type partition struct {
+	id     int32
+	leader string // address of the leader broker
+	offset int64  // offset of the next record to fetch
+	end    int64  // high watermark when the topic was opened
+}
+
+type record struct {
+	partition int32
+	offset    int64
+	timestamp int64 // milliseconds since the epoch
+	key       []byte
+	value     []byte
+}
+
+// Open connects to the broker in url, kafka://host[:port]/topic, and
+// looks up the topic's partitions and their offsets, ready to read
+// its messages. If the topic can't be opened, the error is an
+// *os.PathError, as for a file that doesn't exist.
+func Open(url string) (*Consumer, error) {
+	c, err := open(url)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: url, Err: err}
+	}
+	return c, nil
+}
+
+func open(rawURL string) (*Consumer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "kafka" || u.Hostname() == "" {
+		return nil, errors.New("URL must be kafka://host[:port]/topic")
+	}
+	topic := strings.TrimPrefix(u.Path, "/")
+	if topic == "" || strings.Contains(topic, "/") {
+		return nil, errors.New("URL must be kafka://host[:port]/topic")
+	}
+	query := u.Query()
+	onlyPartition := int32(-1)
+	if s := query.Get("partition"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid partition %q", s)
+		}
+		onlyPartition = int32(n)
+	}
+	startOffset := int64(earliestOffset)
+	if s := query.Get("offset"); s != "" && s != "earliest" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid offset %q (must be a number or \"earliest\")", s)
+		}
+		startOffset = n
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+
+	c := &Consumer{topic: topic, conns: make(map[string]*conn)}
+	err = c.lookupPartitions(net.JoinHostPort(u.Hostname(), port), onlyPartition)
+	if err == nil {
+		err = c.lookupOffsets(startOffset)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Look up the topic's partitions and their leaders with a Metadata
+// request to the broker at addr (only partition only, if it's not -1).
+func (c *Consumer) lookupPartitions(addr string, only int32) error {
+	var e encoder
+	e.int32(1) // topics
+	e.string(c.topic)
+	e.int8(0) // allow_auto_topic_creation
+	d, err := c.request(addr, apiMetadata, 5, e.b)
+	if err != nil {
+		return err
+	}
+	d.int32() // throttle_time_ms
+	brokers := make(map[int32]string)
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // cluster_id
+	d.int32()  // controller_id
+	found := false
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		code := d.int16()
+		name := d.string()
+		d.int8() // is_internal
+		for n := d.int32(); n > 0 && d.err == nil; n-- {
+			partitionCode := d.int16()
+			id := d.int32()
+			leader := d.int32()
+			d.int32Array() // replica_nodes
+			d.int32Array() // isr_nodes
+			d.int32Array() // offline_replicas
+			if name != c.topic || (only >= 0 && id != only) {
+				continue
+			}
+			if partitionCode != 0 && partitionCode != errLeaderNotAvailable {
+				return fmt.Errorf("partition %d: %v", id, kafkaError(partitionCode))
+			}
+			leaderAddr, ok := brokers[leader]
+			if !ok {
+				return fmt.Errorf("partition %d has no leader", id)
+			}
+			c.partitions = append(c.partitions, &partition{id: id, leader: leaderAddr})
+		}
+		if name == c.topic {
+			if code != 0 {
+				return kafkaError(code)
+			}
+			found = true
+		}
+	}
+	if d.err != nil {
+		return fmt.Errorf("invalid Metadata response: %v", d.err)
+	}
+	if !found {
+		return kafkaError(errUnknownTopicOrPartition)
+	}
+	if len(c.partitions) == 0 {
+		if only >= 0 {
+			return fmt.Errorf("topic %q has no partition %d", c.topic, only)
+		}
+		return fmt.Errorf("topic %q has no partitions", c.topic)
+	}
+	sort.Slice(c.partitions, func(i, j int) bool {
+		return c.partitions[i].id < c.partitions[j].id
+	})
+	return nil
+}
+
+// Set each partition's starting offset (the earliest one, if start is
+// earliestOffset) and end with ListOffsets requests to its leader.
+func (c *Consumer) lookupOffsets(start int64) error {
+	for _, p := range c.partitions {
+		end, err := c.listOffset(p, latestOffset)
+		if err != nil {
+			return err
+		}
+		p.end = end
+		p.offset = start
+		if start == earliestOffset {
+			p.offset, err = c.listOffset(p, earliestOffset)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Return the partition's offset for timestamp, which is earliestOffset
+// or latestOffset.
+func (c *Consumer) listOffset(p *partition, timestamp int64) (int64, error) {
+	var e encoder
+	e.int32(-1) // replica_id
+	e.int8(0)   // isolation_level: read uncommitted
+	e.int32(1)  // topics
+	e.string(c.topic)
+	e.int32(1) // partitions
+	e.int32(p.id)
+	e.int64(timestamp)
+	d, err := c.request(p.leader, apiListOffsets, 2, e.b)
+	if err != nil {
+		return 0, err
+	}
+	d.int32() // throttle_time_ms
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		name := d.string()
+		for n := d.int32(); n > 0 && d.err == nil; n-- {
+			id := d.int32()
+			code := d.int16()
+			d.int64() // timestamp
+			offset := d.int64()
+			if name == c.topic && id == p.id && d.err == nil {
+				if code != 0 {
+					return 0, fmt.Errorf("partition %d: %v", id, kafkaError(code))
+				}
+				return offset, nil
+			}
+		}
+	}
+	if d.err != nil {
+		return 0, fmt.Errorf("invalid ListOffsets response: %v", d.err)
+	}
+	return 0, fmt.Errorf("no offset for partition %d in ListOffsets response", p.id)
+}
+
+// Next returns the value of the next message, or io.EOF once every
+// partition has been read to its end.
+func (c *Consumer) Next() (string, error) {
+	for len(c.records) == 0 {
+		if c.current >= len(c.partitions) {
+			return "", io.EOF
+		}
+		p := c.partitions[c.current]
+		if p.offset >= p.end {
+			c.current++
+			continue
+		}
+		err := c.fetch(p)
+		if err != nil {
+			return "", fmt.Errorf("%s partition %d: %v", c.topic, p.id, err)
+		}
+	}
+	c.last = c.records[0]
+	c.records = c.records[1:]
+	return string(c.last.value), nil
+}
+
+// Metadata returns the topic, partition, offset, timestamp (in
+// milliseconds since the epoch), and key of the message last returned
+// by Next.
+func (c *Consumer) Metadata() map[string]string {
+	return map[string]string{
+		"topic":     c.topic,
+		"partition": strconv.Itoa(int(c.last.partition)),
+		"offset":    strconv.FormatInt(c.last.offset, 10),
+		"timestamp": strconv.FormatInt(c.last.timestamp, 10),
+		"key":       string(c.last.key),
+	}
+}
+
+// Close closes the connections to the brokers.
+func (c *Consumer) Close() error {
+	var firstErr error
+	for addr, conn := range c.conns {
+		err := conn.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(c.conns, addr)
+	}
+	return firstErr
+}
+
+// Fetch the next records of the partition with a Fetch request to its
+// leader, adding them to c.records and advancing p.offset past them.
+func (c *Consumer) fetch(p *partition) error {
+	var e encoder
+	e.int32(-1)  // replica_id
+	e.int32(500) // max_wait_ms
+	e.int32(1)   // min_bytes
+	e.int32(maxFetchBytes)
+	e.int8(0)  // isolation_level: read uncommitted
+	e.int32(1) // topics
+	e.string(c.topic)
+	e.int32(1) // partitions
+	e.int32(p.id)
+	e.int64(p.offset)
+	e.int32(maxFetchBytes)
+	d, err := c.request(p.leader, apiFetch, 4, e.b)
+	if err != nil {
+		return err
+	}
+	d.int32() // throttle_time_ms
+	var records []byte
+	found := false
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		name := d.string()
+		for n := d.int32(); n > 0 && d.err == nil; n-- {
+			id := d.int32()
+			code := d.int16()
+			d.int64() // high_watermark
+			d.int64() // last_stable_offset
+			for n := d.int32(); n > 0 && d.err == nil; n-- {
+				d.int64() // aborted transaction's producer_id
+				d.int64() // and first_offset
+			}
+			b := d.bytes()
+			if name == c.topic && id == p.id && d.err == nil {
+				if code != 0 {
+					return kafkaError(code)
+				}
+				records = b
+				found = true
+			}
+		}
+	}
+	if d.err != nil {
+		return fmt.Errorf("invalid Fetch response: %v", d.err)
+	}
+	if !found {
+		return errors.New("partition missing from Fetch response")
+	}
+	next, err := c.decodeBatches(records, p)
+	if err != nil {
+		return err
+	}
+	if next <= p.offset {
+		return fmt.Errorf("no records fetched at offset %d", p.offset)
+	}
+	p.offset = next
+	return nil
+}
+
+// Decode the record batches (message format version 2) in b, adding
+// the records from p.offset up to p.end to c.records, and return the
+// offset after the last complete batch. A Fetch response may end with
+// part of a batch, which is ignored.
+func (c *Consumer) decodeBatches(b []byte, p *partition) (int64, error) {
+	next := p.offset
+	for len(b) >= 12 {
+		base := int64(binary.BigEndian.Uint64(b))
+		length := int(int32(binary.BigEndian.Uint32(b[8:])))
+		if length < 49 {
+			return 0, fmt.Errorf("invalid record batch length %d", length)
+		}
+		if 12+length > len(b) {
+			break
+		}
+		batch := &decoder{b: b[12 : 12+length]}
+		b = b[12+length:]
+
+		batch.int32() // partition_leader_epoch
+		if magic := batch.int8(); magic != 2 {
+			return 0, fmt.Errorf("unsupported message format version %d", magic)
+		}
+		crc := uint32(batch.int32())
+		if crc32.Checksum(batch.b, castagnoli) != crc {
+			return 0, fmt.Errorf("corrupt record batch at offset %d", base)
+		}
+		attributes := batch.int16()
+		lastOffsetDelta := batch.int32()
+		baseTimestamp := batch.int64()
+		maxTimestamp := batch.int64()
+		batch.int64() // producer_id
+		batch.int16() // producer_epoch
+		batch.int32() // base_sequence
+		count := batch.int32()
+		next = base + int64(lastOffsetDelta) + 1
+		if attributes&0x20 != 0 {
+			continue // control batch, such as a transaction's commit marker
+		}
+
+		data := batch.b
+		switch codec := attributes & 0x07; codec {
+		case 0:
+		case 1:
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return 0, fmt.Errorf("invalid gzip record batch: %v", err)
+			}
+			data, err = ioutil.ReadAll(io.LimitReader(r, maxResponseSize))
+			if err != nil {
+				return 0, fmt.Errorf("invalid gzip record batch: %v", err)
+			}
+		default:
+			return 0, fmt.Errorf("unsupported compression %s", codecName(codec))
+		}
+
+		d := &decoder{b: data}
+		for i := int32(0); i < count && d.err == nil; i++ {
+			r := &decoder{b: d.take(int(d.varint()))}
+			r.int8() // attributes
+			timestamp := baseTimestamp + r.varint()
+			offset := base + r.varint()
+			key := r.varBytes()
+			value := r.varBytes()
+			if attributes&0x08 != 0 {
+				timestamp = maxTimestamp // log append time
+			}
+			if r.err != nil {
+				d.err = r.err
+				break
+			}
+			if offset >= p.offset && offset < p.end {
+				c.records = append(c.records, record{p.id, offset, timestamp, key, value})
+			}
+		}
+		if d.err != nil {
+			return 0, fmt.Errorf("invalid record batch at offset %d: %v", base, d.err)
+		}
+	}
+	return next, nil
+}
+
+func codecName(codec int16) string {
+	switch codec {
+	case 2:
+		return "snappy"
+	case 3:
+		return "lz4"
+	case 4:
+		return "zstd"
+	default:
+		return "codec " + strconv.Itoa(int(codec))
+	}
+}
+
+// Send a request to the broker at addr, connecting to it first if
+// necessary, and return a decoder for the response body.
+func (c *Consumer) request(addr string, apiKey, version int16, body []byte) (*decoder, error) {
+	cn, ok := c.conns[addr]
+	if !ok {
+		netConn, err := net.DialTimeout("tcp", addr, dialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		cn = &conn{Conn: netConn}
+		c.conns[addr] = cn
+	}
+	d, err := cn.request(apiKey, version, body)
+	if err != nil {
+		// The connection's state is unknown, so make a new one next time
+		cn.Close()
+		delete(c.conns, addr)
+		return nil, err
+	}
+	return d, nil
+}
+
+// A connection to a broker.
+type conn struct {
+	net.Conn
+	correlationID int32
+}
+
+func (c *conn) request(apiKey, version int16, body []byte) (*decoder, error) {
+	c.correlationID++
+	var e encoder
+	e.int32(0) // size, set below
+	e.int16(apiKey)
+	e.int16(version)
+	e.int32(c.correlationID)
+	e.string(clientID)
+	e.b = append(e.b, body...)
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+
+	err := c.SetDeadline(time.Now().Add(ioTimeout))
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.Write(e.b)
+	if err != nil {
+		return nil, err
+	}
+	var header [8]byte
+	_, err = io.ReadFull(c, header[:])
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size < 4 || size > maxResponseSize {
+		return nil, fmt.Errorf("invalid response size %d", size)
+	}
+	if id := int32(binary.BigEndian.Uint32(header[4:])); id != c.correlationID {
+		return nil, fmt.Errorf("response has correlation ID %d, expected %d", id, c.correlationID)
+	}
+	resp := make([]byte, size-4)
+	_, err = io.ReadFull(c, resp)
+	if err != nil {
+		return nil, err
+	}
+	return &decoder{b: resp}, nil
+}
+
+// Kafka protocol error codes.
+const (
+	errLeaderNotAvailable      = 5
+	errUnknownTopicOrPartition = 3
+)
+
+type kafkaError int16
+
+var errorMessages = map[kafkaError]string{
+	1:  "offset out of range",
+	3:  "unknown topic or partition",
+	5:  "leader not available",
+	6:  "not leader for partition",
+	7:  "request timed out",
+	29: "topic authorization failed",
+	35: "unsupported protocol version",
+}
+
+func (e kafkaError) Error() string {
+	if msg, ok := errorMessages[e]; ok {
+		return msg
+	}
+	return fmt.Sprintf("Kafka error code %d", int16(e))
+}
+
+// Encodes a request body in the Kafka protocol's big-endian format.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) int8(v int8) {
+	e.b = append(e.b, byte(v))
+}
+
+func (e *encoder) int16(v int16) {
+	e.b = append(e.b, byte(v>>8), byte(v))
+}
+
+func (e *encoder) int32(v int32) {
+	e.b = append(e.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *encoder) int64(v int64) {
+	e.int32(int32(v >> 32))
+	e.int32(int32(v))
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// Decodes a response. After an error (the response being too short),
+// the methods return zero values, so only the final err needs to be
+// checked.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = errors.New("unexpected end of data")
+		d.b = nil
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) int8() int8 {
+	b := d.take(1)
+	if b == nil {
+		return 0
+	}
+	return int8(b[0])
+}
+
+func (d *decoder) int16() int16 {
+	b := d.take(2)
+	if b == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(b))
+}
+
+func (d *decoder) int32() int32 {
+	b := d.take(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+func (d *decoder) int64() int64 {
+	b := d.take(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// Decode a nullable string (a null one is returned as "").
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// Decode nullable bytes (null ones are returned as nil).
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+func (d *decoder) int32Array() {
+	n := d.int32()
+	if n > 0 {
+		d.take(4 * int(n))
+	}
+}
+
+// Decode a zigzag-encoded variable-length integer, as used in records.
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errors.New("invalid varint")
+		d.b = nil
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// Decode bytes with a varint length (-1 for null, returned as nil).
+func (d *decoder) varBytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
@@ -0,0 +1,403 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/benhoyt/goawk/interp"
+	"github.com/benhoyt/goawk/parser"
+)
+
+var _ interp.MetadataSource = (*Consumer)(nil)
+
+type testMessage struct {
+	offset    int64
+	timestamp int64
+	key       string // "" for a null key
+	value     string
+}
+
+// A broker that serves one topic, whose partitions each have a log of
+// record batches, answering the same requests as the consumer makes.
+type fakeBroker struct {
+	t        *testing.T
+	listener net.Listener
+	topic    string
+	logs     map[int32][]byte // concatenated record batches by partition
+	starts   map[int32]int64  // log start offset by partition
+	ends     map[int32]int64  // high watermark by partition
+}
+
+func newFakeBroker(t *testing.T, topic string) *fakeBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{
+		t:        t,
+		listener: listener,
+		topic:    topic,
+		logs:     make(map[int32][]byte),
+		starts:   make(map[int32]int64),
+		ends:     make(map[int32]int64),
+	}
+	go b.serve()
+	t.Cleanup(func() { listener.Close() })
+	return b
+}
+
+func (b *fakeBroker) url(path string) string {
+	return "kafka://" + b.listener.Addr().String() + "/" + path
+}
+
+// Add a record batch to the partition's log, compressed with codec
+// (0 for none or 1 for gzip). If control is true, it's a control batch.
+func (b *fakeBroker) addBatch(partition int32, codec int16, control bool, messages ...testMessage) {
+	if _, ok := b.starts[partition]; !ok {
+		b.starts[partition] = messages[0].offset
+	}
+	base := messages[0].offset
+	var records []byte
+	for _, m := range messages {
+		var r []byte
+		r = append(r, 0) // attributes
+		r = appendVarint(r, m.timestamp-messages[0].timestamp)
+		r = appendVarint(r, m.offset-base)
+		if m.key == "" {
+			r = appendVarint(r, -1)
+		} else {
+			r = appendVarint(r, int64(len(m.key)))
+			r = append(r, m.key...)
+		}
+		r = appendVarint(r, int64(len(m.value)))
+		r = append(r, m.value...)
+		r = appendVarint(r, 0) // headers
+		records = appendVarint(records, int64(len(r)))
+		records = append(records, r...)
+	}
+	if codec == 1 {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(records)
+		w.Close()
+		records = buf.Bytes()
+	}
+	attributes := codec
+	if control {
+		attributes |= 0x20
+	}
+	last := messages[len(messages)-1]
+	var e encoder
+	e.int16(attributes)
+	e.int32(int32(last.offset - base))
+	e.int64(messages[0].timestamp)
+	e.int64(last.timestamp)
+	e.int64(-1) // producer_id
+	e.int16(-1) // producer_epoch
+	e.int32(-1) // base_sequence
+	e.int32(int32(len(messages)))
+	e.b = append(e.b, records...)
+	crcd := e.b
+
+	var batch encoder
+	batch.int64(base)
+	batch.int32(int32(4 + 1 + 4 + len(crcd)))
+	batch.int32(0) // partition_leader_epoch
+	batch.int8(2)  // magic
+	batch.int32(int32(crc32.Checksum(crcd, castagnoli)))
+	batch.b = append(batch.b, crcd...)
+	b.logs[partition] = append(b.logs[partition], batch.b...)
+	b.ends[partition] = last.offset + 1
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func (b *fakeBroker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *fakeBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		_, err := io.ReadFull(conn, size[:])
+		if err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		_, err = io.ReadFull(conn, req)
+		if err != nil {
+			return
+		}
+		d := &decoder{b: req}
+		apiKey := d.int16()
+		version := d.int16()
+		correlationID := d.int32()
+		if d.string() != clientID {
+			b.t.Errorf("expected client ID %q", clientID)
+		}
+		var resp encoder
+		resp.int32(0) // size, set below
+		resp.int32(correlationID)
+		switch {
+		case apiKey == apiMetadata && version == 5:
+			b.metadata(d, &resp)
+		case apiKey == apiListOffsets && version == 2:
+			b.listOffsets(d, &resp)
+		case apiKey == apiFetch && version == 4:
+			b.fetch(d, &resp)
+		default:
+			b.t.Errorf("unexpected request: API key %d version %d", apiKey, version)
+			return
+		}
+		if d.err != nil || len(d.b) != 0 {
+			b.t.Errorf("invalid request with API key %d: %v, %d bytes left", apiKey, d.err, len(d.b))
+		}
+		binary.BigEndian.PutUint32(resp.b, uint32(len(resp.b)-4))
+		conn.Write(resp.b)
+	}
+}
+
+func (b *fakeBroker) metadata(d *decoder, resp *encoder) {
+	d.int32() // topics
+	topic := d.string()
+	d.int8() // allow_auto_topic_creation
+
+	host, portStr, _ := net.SplitHostPort(b.listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	resp.int32(0) // throttle_time_ms
+	resp.int32(1) // brokers
+	resp.int32(7) // node_id
+	resp.string(host)
+	resp.int32(int32(port))
+	resp.int16(-1) // rack
+	resp.int16(-1) // cluster_id
+	resp.int32(7)  // controller_id
+	resp.int32(1)  // topics
+	if topic != b.topic {
+		resp.int16(errUnknownTopicOrPartition)
+		resp.string(topic)
+		resp.int8(0)
+		resp.int32(0)
+		return
+	}
+	resp.int16(0)
+	resp.string(topic)
+	resp.int8(0)
+	resp.int32(int32(len(b.logs)))
+	for id := int32(len(b.logs) - 1); id >= 0; id-- { // out of order
+		resp.int16(0)
+		resp.int32(id)
+		resp.int32(7) // leader_id
+		for i := 0; i < 3; i++ {
+			resp.int32(1) // replica_nodes, isr_nodes, offline_replicas
+			resp.int32(7)
+		}
+	}
+}
+
+func (b *fakeBroker) listOffsets(d *decoder, resp *encoder) {
+	d.int32() // replica_id
+	d.int8()  // isolation_level
+	d.int32() // topics
+	topic := d.string()
+	d.int32() // partitions
+	id := d.int32()
+	timestamp := d.int64()
+
+	offset := b.ends[id]
+	if timestamp == earliestOffset {
+		offset = b.starts[id]
+	}
+	resp.int32(0) // throttle_time_ms
+	resp.int32(1)
+	resp.string(topic)
+	resp.int32(1)
+	resp.int32(id)
+	resp.int16(0)
+	resp.int64(-1) // timestamp
+	resp.int64(offset)
+}
+
+// Return the batches from the one containing offset onwards, like a
+// real broker does.
+func (b *fakeBroker) fetch(d *decoder, resp *encoder) {
+	d.int32() // replica_id
+	d.int32() // max_wait_ms
+	d.int32() // min_bytes
+	d.int32() // max_bytes
+	d.int8()  // isolation_level
+	d.int32() // topics
+	topic := d.string()
+	d.int32() // partitions
+	id := d.int32()
+	offset := d.int64()
+	d.int32() // partition_max_bytes
+
+	code := int16(0)
+	if offset < b.starts[id] || offset > b.ends[id] {
+		code = 1
+	}
+	log := b.logs[id]
+	for len(log) > 0 {
+		batchLen := 12 + int(binary.BigEndian.Uint32(log[8:]))
+		base := int64(binary.BigEndian.Uint64(log))
+		lastOffsetDelta := int64(binary.BigEndian.Uint32(log[23:]))
+		if base+lastOffsetDelta >= offset {
+			break
+		}
+		log = log[batchLen:]
+	}
+	resp.int32(0) // throttle_time_ms
+	resp.int32(1)
+	resp.string(topic)
+	resp.int32(1)
+	resp.int32(id)
+	resp.int16(code)
+	resp.int64(b.ends[id])                                                     // high_watermark
+	resp.int64(b.ends[id])                                                     // last_stable_offset
+	resp.int32(-1)                                                             // aborted_transactions
+	log = append(log[:len(log):len(log)], 0, 0, 0, 0, 0, 0, 0, 9, 0, 0, 0, 99) // partial batch
+	resp.int32(int32(len(log)))
+	resp.b = append(resp.b, log...)
+}
+
+func readAll(url string) (string, error) {
+	c, err := Open(url)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	var out strings.Builder
+	for {
+		line, err := c.Next()
+		if err == io.EOF {
+			return out.String(), nil
+		}
+		if err != nil {
+			return out.String(), err
+		}
+		m := c.Metadata()
+		out.WriteString(m["topic"] + " " + m["partition"] + " " + m["offset"] + " " +
+			m["timestamp"] + " " + m["key"] + ": " + line + "\n")
+	}
+}
+
+func TestConsumer(t *testing.T) {
+	b := newFakeBroker(t, "logs")
+	b.addBatch(0, 0, false,
+		testMessage{0, 1000, "", "zero"},
+		testMessage{1, 1001, "k", "one"},
+		testMessage{2, 1005, "", "two\nlines"})
+	b.addBatch(0, 0, false, testMessage{3, 1010, "", "three"})
+	b.addBatch(1, 0, true, testMessage{5, 2000, "", "commit marker"})
+	b.addBatch(1, 1, false,
+		testMessage{6, 2001, "a", "six"},
+		testMessage{8, 2002, "b", "eight"}) // offset 7 compacted away
+
+	tests := []struct {
+		url string
+		out string
+		err string
+	}{
+		{b.url("logs"), `
+logs 0 0 1000 : zero
+logs 0 1 1001 k: one
+logs 0 2 1005 : two
+lines
+logs 0 3 1010 : three
+logs 1 6 2001 a: six
+logs 1 8 2002 b: eight
+`, ""},
+		{b.url("logs?partition=1"), `
+logs 1 6 2001 a: six
+logs 1 8 2002 b: eight
+`, ""},
+		{b.url("logs?partition=0&offset=2"), `
+logs 0 2 1005 : two
+lines
+logs 0 3 1010 : three
+`, ""},
+		{b.url("logs?offset=earliest&partition=0"), `
+logs 0 0 1000 : zero
+logs 0 1 1001 k: one
+logs 0 2 1005 : two
+lines
+logs 0 3 1010 : three
+`, ""},
+		{b.url("logs?offset=4&partition=0"), "\n", ""},
+		{b.url("logs?partition=1&offset=2"), "\n", "logs partition 1: offset out of range"},
+		{b.url("logs?partition=2"), "", "open " + b.url("logs?partition=2") + `: topic "logs" has no partition 2`},
+		{b.url("logs?partition=x"), "", "open " + b.url("logs?partition=x") + `: invalid partition "x"`},
+		{b.url("logs?offset=-1"), "", "open " + b.url("logs?offset=-1") + `: invalid offset "-1" (must be a number or "earliest")`},
+		{b.url("nope"), "", "open " + b.url("nope") + ": unknown topic or partition"},
+		{"kafka:///logs", "", "open kafka:///logs: URL must be kafka://host[:port]/topic"},
+		{b.url(""), "", "open " + b.url("") + ": URL must be kafka://host[:port]/topic"},
+	}
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			out, err := readAll(test.url)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				if strings.HasPrefix(test.err, "open ") {
+					if _, ok := err.(*os.PathError); !ok {
+						t.Fatalf("expected *os.PathError, got %T", err)
+					}
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if test.out != "" && "\n"+out != test.out {
+				t.Fatalf("expected:\n%s\ngot:\n%s", test.out[1:], out)
+			}
+		})
+	}
+}
+
+func TestConsumerAsSource(t *testing.T) {
+	b := newFakeBroker(t, "events")
+	b.addBatch(0, 0, false, testMessage{0, 0, "", "a 1"}, testMessage{1, 0, "", "b 2"})
+	b.addBatch(1, 1, false, testMessage{4, 0, "", "c 3"})
+
+	prog, err := parser.ParseProgram([]byte(`
+{ print FILENAME ~ /^kafka:/, RECORDINFO["partition"], RECORDINFO["offset"], $1; total += $2 }
+END { print total }`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	config := &interp.Config{
+		Args:   []string{b.url("events")},
+		Output: &out,
+		Sources: map[string]func(url string) (interp.RecordSource, error){
+			"kafka": func(url string) (interp.RecordSource, error) { return Open(url) },
+		},
+	}
+	_, err = interp.ExecProgram(prog, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "1 0 0 a\n1 0 1 b\n1 1 4 c\n6\n"
+	if out.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, out.String())
+	}
+}
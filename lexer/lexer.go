@@ -8,16 +8,25 @@
 //
 package lexer
 
+import (
+	"bytes"
+	"strconv"
+	"unicode/utf8"
+)
+
 // Lexer tokenizes a byte string of AWK source code. Use NewLexer to
 // actually create a lexer, and Scan() or ScanRegex() to get tokens.
 type Lexer struct {
-	src      []byte
-	offset   int
-	ch       byte
-	pos      Position
-	nextPos  Position
-	hadSpace bool
-	lastTok  Token
+	src        []byte
+	offset     int
+	ch         byte
+	pos        Position
+	nextPos    Position
+	hadSpace   bool
+	lastTok    Token
+	comments   bool
+	posix      bool
+	nonDecimal bool
 }
 
 // Position stores the source line and column where a token starts.
@@ -47,6 +56,27 @@ func (l *Lexer) HadSpace() bool {
 	return l.hadSpace
 }
 
+// KeepComments makes Scan return each comment as a COMMENT token
+// instead of skipping it. The token's string value is the text of the
+// comment, including the "#" but not the newline.
+func (l *Lexer) KeepComments() {
+	l.comments = true
+}
+
+// POSIX makes Scan return an ILLEGAL token for GoAWK extensions to
+// the POSIX AWK syntax, like single-quoted strings, with an error
+// message naming the extension.
+func (l *Lexer) POSIX() {
+	l.posix = true
+}
+
+// NonDecimal makes Scan accept hexadecimal (0x1A) and octal (0o17)
+// numbers. They're NUMBER tokens whose string value is the number as
+// written, prefix included.
+func (l *Lexer) NonDecimal() {
+	l.nonDecimal = true
+}
+
 // Scan scans the next token and returns its position (line/column),
 // token value (one of the uppercase token constants), and the
 // string value of the token. For most tokens, the token value is
@@ -78,10 +108,19 @@ func (l *Lexer) scan() (Position, Token, string) {
 	}
 	if l.ch == '#' {
 		// Skip comment till end of line
+		pos := l.pos
+		start := l.offset - 1
 		l.next()
 		for l.ch != '\n' && l.ch != 0 {
 			l.next()
 		}
+		if l.comments {
+			end := l.offset - 1
+			if end > start+1 && l.src[end-1] == '\r' {
+				end--
+			}
+			return pos, COMMENT, string(l.src[start:end])
+		}
 	}
 	if l.ch == 0 {
 		// l.next() reached end of input
@@ -119,6 +158,12 @@ func (l *Lexer) scan() (Position, Token, string) {
 	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '.':
 		// Avoid make/append and use l.offset directly for performance
 		start := l.offset - 2
+		if ch == '0' && l.nonDecimal && (l.ch == 'x' || l.ch == 'X' || l.ch == 'o' || l.ch == 'O') {
+			if tok, val := l.scanNonDecimal(start); tok != ILLEGAL || val != "" {
+				return pos, tok, val
+			}
+			// Just "0x" or "0o", which is 0 followed by a name
+		}
 		gotDigit := false
 		if ch != '.' {
 			gotDigit = true
@@ -182,6 +227,9 @@ func (l *Lexer) scan() (Position, Token, string) {
 		// Note: POSIX awk spec doesn't allow single-quoted strings,
 		// but this helps without quoting, especially on Windows
 		// where the shell quote character is " (double quote).
+		if ch == '\'' && l.posix {
+			return pos, ILLEGAL, "single-quoted strings aren't in POSIX AWK"
+		}
 		chars := make([]byte, 0, 32) // most won't require heap allocation
 		for l.ch != ch {
 			c := l.ch
@@ -226,7 +274,7 @@ func (l *Lexer) scan() (Position, Token, string) {
 				l.next()
 				digit := hexDigit(l.ch)
 				if digit < 0 {
-					return l.pos, ILLEGAL, "1 or 2 hex digits expected"
+					return l.stringError(ch, "1 or 2 hex digits expected")
 				}
 				c = byte(digit)
 				l.next()
@@ -235,6 +283,19 @@ func (l *Lexer) scan() (Position, Token, string) {
 					c = c*16 + byte(digit)
 					l.next()
 				}
+			case 'u':
+				// Unicode code point, \uXXXX or \u{X...}, as UTF-8
+				if l.posix {
+					return l.stringError(ch, "\\u escapes aren't in POSIX AWK")
+				}
+				r, errMsg := l.unicodeEscape()
+				if errMsg != "" {
+					return l.stringError(ch, errMsg)
+				}
+				var buf [utf8.UTFMax]byte
+				n := utf8.EncodeRune(buf[:], r)
+				chars = append(chars, buf[:n]...)
+				continue
 			case '0', '1', '2', '3', '4', '5', '6', '7':
 				// Octal byte of 1-3 octal digits
 				c = l.ch - '0'
@@ -289,6 +350,12 @@ func (l *Lexer) scan() (Position, Token, string) {
 		case '*':
 			l.next()
 			tok = l.choice('=', POW, POW_ASSIGN)
+			if l.posix {
+				if tok == POW_ASSIGN {
+					return pos, ILLEGAL, "**= operator isn't in POSIX AWK (use ^=)"
+				}
+				return pos, ILLEGAL, "** operator isn't in POSIX AWK (use ^)"
+			}
 		case '=':
 			l.next()
 			tok = MUL_ASSIGN
@@ -331,6 +398,27 @@ func (l *Lexer) scan() (Position, Token, string) {
 		}
 	case '|':
 		tok = l.choice('|', PIPE, OR)
+	case '@':
+		// The @ directives are @include "file" and @load "name" (as
+		// in gawk)
+		rest := l.src[l.offset-1:]
+		for _, directive := range []Token{INCLUDE, LOAD} {
+			name := directive.String()[1:]
+			if bytes.HasPrefix(rest, []byte(name)) &&
+				(len(rest) == len(name) || !(isNameStart(rest[len(name)]) || isDigit(rest[len(name)]))) {
+				tok = directive
+				break
+			}
+		}
+		if tok == ILLEGAL {
+			return pos, ILLEGAL, "unexpected char"
+		}
+		if l.posix {
+			return pos, ILLEGAL, tok.String() + " isn't in POSIX AWK"
+		}
+		for i := 0; i < len(tok.String())-1; i++ {
+			l.next()
+		}
 	default:
 		tok = ILLEGAL
 		val = "unexpected char"
@@ -374,6 +462,18 @@ func (l *Lexer) scanRegex() (Position, Token, string) {
 		}
 		if c == '\\' {
 			l.next()
+			if l.ch == 'u' && !l.posix {
+				// Go's regexp package doesn't have \u, so convert
+				// \uXXXX or \u{X...} to the equivalent \x{X...}
+				r, errMsg := l.unicodeEscape()
+				if errMsg != "" {
+					return l.pos, ILLEGAL, errMsg
+				}
+				chars = append(chars, `\x{`...)
+				chars = strconv.AppendInt(chars, int64(r), 16)
+				chars = append(chars, '}')
+				continue
+			}
 			if l.ch != '/' {
 				chars = append(chars, '\\')
 			}
@@ -386,6 +486,39 @@ func (l *Lexer) scanRegex() (Position, Token, string) {
 	return pos, REGEX, string(chars)
 }
 
+// Scan the rest of a \u escape (l.ch is the 'u'), either exactly four
+// hex digits or 1-6 hex digits in braces, and return the code point it
+// specifies. Return a non-empty error message if it's invalid.
+func (l *Lexer) unicodeEscape() (rune, string) {
+	l.next()
+	braces := l.ch == '{'
+	if braces {
+		l.next()
+	}
+	var r rune
+	n := 0
+	for (braces || n < 4) && isHexDigit(l.ch) {
+		r = r*16 + rune(hexDigit(l.ch))
+		n++
+		l.next()
+		if n > 6 {
+			return 0, "too many hex digits in \\u{...} escape"
+		}
+	}
+	switch {
+	case braces && (n == 0 || l.ch != '}'):
+		return 0, "1 to 6 hex digits and '}' expected in \\u{...} escape"
+	case !braces && n < 4:
+		return 0, "4 hex digits expected after \\u"
+	case !utf8.ValidRune(r):
+		return 0, "invalid Unicode code point in \\u escape"
+	}
+	if braces {
+		l.next()
+	}
+	return r, ""
+}
+
 // Load the next character into l.ch (or 0 on end of input) and update
 // line and column position.
 func (l *Lexer) next() {
@@ -411,6 +544,27 @@ func (l *Lexer) next() {
 	l.offset++
 }
 
+// Return an ILLEGAL token for an error at the current position in a
+// string, after skipping the rest of the string (up to its end quote,
+// or the end of the line), so that scanning resumes after it rather
+// than treating its end quote as the start of another string.
+func (l *Lexer) stringError(quote byte, message string) (Position, Token, string) {
+	pos := l.pos
+	for l.ch != quote && l.ch != '\n' && l.ch != '\r' && l.ch != 0 {
+		if l.ch == '\\' {
+			l.next()
+			if l.ch == '\n' || l.ch == '\r' || l.ch == 0 {
+				break
+			}
+		}
+		l.next()
+	}
+	if l.ch == quote {
+		l.next()
+	}
+	return pos, ILLEGAL, message
+}
+
 // Un-read the character just scanned (doesn't handle line boundaries).
 func (l *Lexer) unread() {
 	l.offset--
@@ -419,6 +573,41 @@ func (l *Lexer) unread() {
 	l.ch = l.src[l.offset-1]
 }
 
+// Scan the rest of a hexadecimal or octal number starting at src[start]
+// (l.ch is the 'x' or 'o' after the "0"). Return ILLEGAL and "" if
+// there are no digits after the prefix, having only scanned the "0".
+func (l *Lexer) scanNonDecimal(start int) (Token, string) {
+	isBaseDigit := isHexDigit
+	kind := "hexadecimal"
+	if l.ch == 'o' || l.ch == 'O' {
+		isBaseDigit = isOctalDigit
+		kind = "octal"
+	}
+	l.next()
+	if !isBaseDigit(l.ch) {
+		l.unread()
+		return ILLEGAL, ""
+	}
+	for isBaseDigit(l.ch) {
+		l.next()
+	}
+	if isDigit(l.ch) {
+		return ILLEGAL, "invalid digit in octal number"
+	}
+	if l.posix {
+		return ILLEGAL, kind + " numbers aren't in POSIX AWK"
+	}
+	return NUMBER, string(l.src[start : l.offset-1])
+}
+
+func isHexDigit(ch byte) bool {
+	return isDigit(ch) || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
+func isOctalDigit(ch byte) bool {
+	return ch >= '0' && ch <= '7'
+}
+
 func isNameStart(ch byte) bool {
 	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
 }
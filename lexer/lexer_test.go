@@ -38,8 +38,15 @@ func TestLexer(t *testing.T) {
 		{`'x`, `1:3 <illegal> "didn't find end quote in string"`},
 		{"'x\n'", `1:3 <illegal> "can't have newline in string", 1:3 <newline> "", 2:2 <illegal> "didn't find end quote in string"`},
 		{`"\x0.\x00.\x0A\x10\xff\xFF\x41"`, `1:1 string "\x00.\x00.\n\x10\xff\xffA"`},
-		{`"\xg"`, `1:4 <illegal> "1 or 2 hex digits expected", 1:4 name "g", 1:6 <illegal> "didn't find end quote in string"`},
+		{`"\xg" x`, `1:4 <illegal> "1 or 2 hex digits expected", 1:7 name "x"`},
 		{`"\0\78\7\77\777\0 \141 "`, `1:1 string "\x00\a8\a?\xff\x00 a "`},
+		{`"\u00e9\u20AC1\u{1F600}\u{41}"`, `1:1 string "é€1😀A"`},
+		{`"\u00g"`, `1:6 <illegal> "4 hex digits expected after \\u"`},
+		{`"\u{}"`, `1:5 <illegal> "1 to 6 hex digits and '}' expected in \\u{...} escape"`},
+		{`"\u{1234567}"`, `1:12 <illegal> "too many hex digits in \\u{...} escape"`},
+		{`"\uD800" }`, `1:8 <illegal> "invalid Unicode code point in \\u escape", 1:10 } ""`},
+		{`"\uD800 \" y" x`, `1:8 <illegal> "invalid Unicode code point in \\u escape", 1:15 name "x"`},
+		{`"\xg` + "\n" + `x"`, `1:4 <illegal> "1 or 2 hex digits expected", 1:5 <newline> "", 2:1 name "x", 2:3 <illegal> "didn't find end quote in string"`},
 
 		// Number tokens
 		{"0", `1:1 number "0"`},
@@ -67,6 +74,13 @@ func TestLexer(t *testing.T) {
 
 		// Misc errors
 		{"&=", `1:2 <illegal> "unexpected char after '&'", 1:2 = ""`},
+		{"@loader", `1:1 <illegal> "unexpected char", 1:2 name "loader"`},
+
+		// @load and @include directives
+		{`@load "x"`, `1:1 @load "", 1:7 string "x"`},
+		{"@load\"x\"", `1:1 @load "", 1:6 string "x"`},
+		{`@include "lib.awk"`, `1:1 @include "", 1:10 string "lib.awk"`},
+		{"@includes", `1:1 <illegal> "unexpected char", 1:2 name "includes"`},
 	}
 	for _, test := range tests {
 		t.Run(test.input, func(t *testing.T) {
@@ -96,6 +110,93 @@ func TestLexer(t *testing.T) {
 	}
 }
 
+func TestKeepComments(t *testing.T) {
+	l := NewLexer([]byte("# top\r\nx # after x\n\t#\n#end"))
+	l.KeepComments()
+	strs := []string{}
+	for {
+		pos, tok, val := l.Scan()
+		if tok == EOF {
+			break
+		}
+		strs = append(strs, fmt.Sprintf("%d:%d %s %q", pos.Line, pos.Column, tok, val))
+	}
+	output := strings.Join(strs, ", ")
+	expected := `1:1 comment "# top", 1:6 <newline> "", 2:1 name "x", 2:3 comment "# after x", ` +
+		`2:12 <newline> "", 3:2 comment "#", 3:3 <newline> "", 4:1 comment "#end"`
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestPOSIX(t *testing.T) {
+	l := NewLexer([]byte(`x ^ 2 "s" 's' x**2 x **= 2 "\u00e9"`))
+	l.POSIX()
+	strs := []string{}
+	for {
+		pos, tok, val := l.Scan()
+		if tok == EOF {
+			break
+		}
+		strs = append(strs, fmt.Sprintf("%d:%d %s %q", pos.Line, pos.Column, tok, val))
+	}
+	output := strings.Join(strs, ", ")
+	expected := `1:1 name "x", 1:3 ^ "", 1:5 number "2", 1:7 string "s", ` +
+		`1:11 <illegal> "single-quoted strings aren't in POSIX AWK", 1:12 name "s", 1:13 <illegal> "single-quoted strings aren't in POSIX AWK", ` +
+		`1:15 name "x", 1:16 <illegal> "** operator isn't in POSIX AWK (use ^)", 1:18 number "2", ` +
+		`1:20 name "x", 1:22 <illegal> "**= operator isn't in POSIX AWK (use ^=)", 1:26 number "2", ` +
+		`1:30 <illegal> "\\u escapes aren't in POSIX AWK"`
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestNonDecimal(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{"0x1A", `1:1 number "0x1A"`},
+		{"0XfF 0o17 0O7", `1:1 number "0XfF", 1:6 number "0o17", 1:11 number "0O7"`},
+		{"0x 0og", `1:1 number "0", 1:2 name "x", 1:4 number "0", 1:5 name "og"`},
+		{"0x1Fz", `1:1 number "0x1F", 1:5 name "z"`},
+		{"0o18", `1:1 <illegal> "invalid digit in octal number"`},
+		{"017 0.5", `1:1 number "017", 1:5 number "0.5"`},
+	}
+	for _, test := range tests {
+		l := NewLexer([]byte(test.input))
+		l.NonDecimal()
+		strs := []string{}
+		for {
+			pos, tok, val := l.Scan()
+			if tok == EOF {
+				break
+			}
+			strs = append(strs, fmt.Sprintf("%d:%d %s %q", pos.Line, pos.Column, tok, val))
+			if tok == ILLEGAL {
+				break
+			}
+		}
+		output := strings.Join(strs, ", ")
+		if output != test.output {
+			t.Errorf("%q: expected %q, got %q", test.input, test.output, output)
+		}
+	}
+
+	// Disabled by default, and in POSIX mode
+	_, _, val := NewLexer([]byte("0x1A")).Scan()
+	if val != "0" {
+		t.Errorf("expected 0x1A to scan as 0 by default, got %q", val)
+	}
+	l := NewLexer([]byte("0x1A"))
+	l.NonDecimal()
+	l.POSIX()
+	_, tok, val := l.Scan()
+	if tok != ILLEGAL || val != "hexadecimal numbers aren't in POSIX AWK" {
+		t.Errorf("expected POSIX error, got %s %q", tok, val)
+	}
+}
+
 func TestRegex(t *testing.T) {
 	tests := []struct {
 		input  string
@@ -105,6 +206,7 @@ func TestRegex(t *testing.T) {
 		{`/=foo/`, `1:1 regex "=foo"`},
 		{`/a\/b/`, `1:1 regex "a/b"`},
 		{`/a\/\zb/`, `1:1 regex "a/\\zb"`},
+		{`/[\u00e9\u{1F600}]/`, `1:1 regex "[\\x{e9}\\x{1f600}]"`},
 		{`/a`, `1:3 <illegal> "didn't find end slash in regex"`},
 		{"/a\n", `1:3 <illegal> "can't have newline in regex"`},
 	}
@@ -216,12 +318,49 @@ func TestKeywordToken(t *testing.T) {
 	}
 }
 
+func TestExtensionToken(t *testing.T) {
+	tests := []struct {
+		name string
+		tok  Token
+	}{
+		{"abs", F_ABS},
+		{"b64encode", F_B64ENCODE},
+		{"chr", F_CHR},
+		{"glob", F_GLOB},
+		{"copy", F_COPY},
+		{"max", F_MAX},
+		{"ord", F_ORD},
+		{"redis_get", F_REDIS_GET},
+		{"round", F_ROUND},
+		{"sb_new", F_SB_NEW},
+		{"sb_str", F_SB_STR},
+		{"setenv", F_SETENV},
+		{"sha256", F_SHA256},
+		{"sleep", F_SLEEP},
+		{"sql_query", F_SQL_QUERY},
+		{"stat", F_STAT},
+		{"tzconvert", F_TZCONVERT},
+		{"urlencode", F_URLENCODE},
+		{"values", F_VALUES},
+		{"split", ILLEGAL},
+		{"foo", ILLEGAL},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tok := ExtensionToken(test.name)
+			if tok != test.tok {
+				t.Errorf("expected %v, got %v", test.tok, tok)
+			}
+		})
+	}
+}
+
 func TestAllTokens(t *testing.T) {
 	input := "# comment line\n" +
 		"+ += && = : , -- /\n/= $ == >= > >> ++ { [ < ( #\n" +
 		"<= ~ % %= * *= !~ ! != | || ^ ^= ** **= ? } ] ) ; - -= " +
 		"BEGIN break continue delete do else END exit " +
-		"for function getline if in next print printf return while " +
+		"for function getline if in @include @load next print printf return while " +
 		"atan2 close cos exp fflush gsub index int length log match rand " +
 		"sin split sprintf sqrt srand sub substr system tolower toupper " +
 		"x \"str\\n\" 1234\n" +
@@ -244,7 +383,7 @@ func TestAllTokens(t *testing.T) {
 		"+ += && = : , -- / <newline> /= $ == >= > >> ++ { [ < ( <newline> " +
 		"<= ~ % %= * *= !~ ! != | || ^ ^= ^ ^= ? } ] ) ; - -= " +
 		"BEGIN break continue delete do else END exit " +
-		"for function getline if in next print printf return while " +
+		"for function getline if in @include @load next print printf return while " +
 		"atan2 close cos exp fflush gsub index int length log match rand " +
 		"sin split sprintf sqrt srand sub substr system tolower toupper " +
 		"name string number <newline> " +
@@ -254,7 +393,8 @@ func TestAllTokens(t *testing.T) {
 	}
 
 	for i, s := range seen {
-		if !s && Token(i) != CONCAT && Token(i) != REGEX {
+		isExtFunc := Token(i) >= FIRST_EXT_FUNC && Token(i) <= LAST_EXT_FUNC
+		if !s && Token(i) != CONCAT && Token(i) != REGEX && Token(i) != COMMENT && !isExtFunc {
 			t.Errorf("token %s (%d) not seen", Token(i), i)
 		}
 	}
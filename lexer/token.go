@@ -68,6 +68,8 @@ const (
 	GETLINE
 	IF
 	IN
+	INCLUDE
+	LOAD
 	NEXT
 	PRINT
 	PRINTF
@@ -99,6 +101,53 @@ const (
 	F_TOLOWER
 	F_TOUPPER
 
+	// GoAWK extension functions (not keywords, see ExtensionToken)
+
+	F_ABS
+	F_B64DECODE
+	F_B64ENCODE
+	F_CEIL
+	F_CHR
+	F_COPY
+	F_DUMPARR
+	F_FILESIZE
+	F_FLOOR
+	F_GLOB
+	F_HMAC
+	F_KEYS
+	F_MAX
+	F_MD5
+	F_MIN
+	F_MKTIME
+	F_MONOTIME
+	F_MTIME
+	F_ORD
+	F_PARSEQUERY
+	F_REDIS_GET
+	F_REDIS_INCR
+	F_REDIS_SET
+	F_ROUND
+	F_SB_ADD
+	F_SB_NEW
+	F_SB_STR
+	F_SETENV
+	F_SHA1
+	F_SHA256
+	F_SLEEP
+	F_SQL_CLOSE
+	F_SQL_EXEC
+	F_SQL_OPEN
+	F_SQL_QUERY
+	F_STAT
+	F_STRFTIME
+	F_SYSTIME
+	F_TRUNC
+	F_TZCONVERT
+	F_UNSETENV
+	F_URLDECODE
+	F_URLENCODE
+	F_VALUES
+
 	// Literals and names (variables and arrays)
 
 	NAME
@@ -106,9 +155,15 @@ const (
 	STRING
 	REGEX
 
-	LAST       = REGEX
-	FIRST_FUNC = F_ATAN2
-	LAST_FUNC  = F_TOUPPER
+	// Comment (only scanned if Lexer.KeepComments has been called)
+
+	COMMENT
+
+	LAST           = COMMENT
+	FIRST_FUNC     = F_ATAN2
+	LAST_FUNC      = F_VALUES
+	FIRST_EXT_FUNC = F_ABS
+	LAST_EXT_FUNC  = F_VALUES
 )
 
 var keywordTokens = map[string]Token{
@@ -161,6 +216,62 @@ func KeywordToken(name string) Token {
 	return keywordTokens[name]
 }
 
+var extensionTokens = map[string]Token{
+	"abs":        F_ABS,
+	"b64decode":  F_B64DECODE,
+	"b64encode":  F_B64ENCODE,
+	"ceil":       F_CEIL,
+	"chr":        F_CHR,
+	"copy":       F_COPY,
+	"dumparr":    F_DUMPARR,
+	"filesize":   F_FILESIZE,
+	"floor":      F_FLOOR,
+	"glob":       F_GLOB,
+	"hmac":       F_HMAC,
+	"keys":       F_KEYS,
+	"max":        F_MAX,
+	"md5":        F_MD5,
+	"min":        F_MIN,
+	"mktime":     F_MKTIME,
+	"monotime":   F_MONOTIME,
+	"mtime":      F_MTIME,
+	"ord":        F_ORD,
+	"parsequery": F_PARSEQUERY,
+	"redis_get":  F_REDIS_GET,
+	"redis_incr": F_REDIS_INCR,
+	"redis_set":  F_REDIS_SET,
+	"round":      F_ROUND,
+	"sb_add":     F_SB_ADD,
+	"sb_new":     F_SB_NEW,
+	"sb_str":     F_SB_STR,
+	"setenv":     F_SETENV,
+	"sha1":       F_SHA1,
+	"sha256":     F_SHA256,
+	"sleep":      F_SLEEP,
+	"sql_close":  F_SQL_CLOSE,
+	"sql_exec":   F_SQL_EXEC,
+	"sql_open":   F_SQL_OPEN,
+	"sql_query":  F_SQL_QUERY,
+	"stat":       F_STAT,
+	"strftime":   F_STRFTIME,
+	"systime":    F_SYSTIME,
+	"trunc":      F_TRUNC,
+	"tzconvert":  F_TZCONVERT,
+	"unsetenv":   F_UNSETENV,
+	"urldecode":  F_URLDECODE,
+	"urlencode":  F_URLENCODE,
+	"values":     F_VALUES,
+}
+
+// ExtensionToken returns the token associated with the given GoAWK
+// extension function name, or ILLEGAL if name is not an extension
+// function. Extension functions aren't keywords: the lexer scans them
+// as NAME, and the parser only treats a call as an extension function
+// call if there's no user-defined or native function of that name.
+func ExtensionToken(name string) Token {
+	return extensionTokens[name]
+}
+
 var tokenNames = map[Token]string{
 	ILLEGAL: "<illegal>",
 	EOF:     "EOF",
@@ -220,6 +331,8 @@ var tokenNames = map[Token]string{
 	GETLINE:  "getline",
 	IF:       "if",
 	IN:       "in",
+	INCLUDE:  "@include",
+	LOAD:     "@load",
 	NEXT:     "next",
 	PRINT:    "print",
 	PRINTF:   "printf",
@@ -249,10 +362,57 @@ var tokenNames = map[Token]string{
 	F_TOLOWER: "tolower",
 	F_TOUPPER: "toupper",
 
+	F_ABS:        "abs",
+	F_B64DECODE:  "b64decode",
+	F_B64ENCODE:  "b64encode",
+	F_CEIL:       "ceil",
+	F_CHR:        "chr",
+	F_COPY:       "copy",
+	F_DUMPARR:    "dumparr",
+	F_FILESIZE:   "filesize",
+	F_FLOOR:      "floor",
+	F_GLOB:       "glob",
+	F_HMAC:       "hmac",
+	F_KEYS:       "keys",
+	F_MAX:        "max",
+	F_MD5:        "md5",
+	F_MIN:        "min",
+	F_MKTIME:     "mktime",
+	F_MONOTIME:   "monotime",
+	F_MTIME:      "mtime",
+	F_ORD:        "ord",
+	F_PARSEQUERY: "parsequery",
+	F_REDIS_GET:  "redis_get",
+	F_REDIS_INCR: "redis_incr",
+	F_REDIS_SET:  "redis_set",
+	F_ROUND:      "round",
+	F_SB_ADD:     "sb_add",
+	F_SB_NEW:     "sb_new",
+	F_SB_STR:     "sb_str",
+	F_SETENV:     "setenv",
+	F_SHA1:       "sha1",
+	F_SHA256:     "sha256",
+	F_SLEEP:      "sleep",
+	F_SQL_CLOSE:  "sql_close",
+	F_SQL_EXEC:   "sql_exec",
+	F_SQL_OPEN:   "sql_open",
+	F_SQL_QUERY:  "sql_query",
+	F_STAT:       "stat",
+	F_STRFTIME:   "strftime",
+	F_SYSTIME:    "systime",
+	F_TRUNC:      "trunc",
+	F_TZCONVERT:  "tzconvert",
+	F_UNSETENV:   "unsetenv",
+	F_URLDECODE:  "urldecode",
+	F_URLENCODE:  "urlencode",
+	F_VALUES:     "values",
+
 	NAME:   "name",
 	NUMBER: "number",
 	STRING: "string",
 	REGEX:  "regex",
+
+	COMMENT: "comment",
 }
 
 // String returns the string name of this token.
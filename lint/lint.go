@@ -0,0 +1,504 @@
+// Package lint finds likely mistakes in AWK programs, such as unused
+// variables and functions.
+//
+// Check the tree of a parsed program with Check, for example:
+//
+//	prog, err := parser.ParseProgram(src, nil)
+//	...
+//	for _, w := range lint.Check(prog.AST()) {
+//	    fmt.Printf("%d:%d: %s\n", w.Position.Line, w.Position.Column, w.Message)
+//	}
+package lint
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/benhoyt/goawk/ast"
+	. "github.com/benhoyt/goawk/lexer"
+)
+
+// Warning is a problem Check found in a program.
+type Warning struct {
+	Position Position
+	Message  string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%d:%d: %s", w.Position.Line, w.Position.Column, w.Message)
+}
+
+// Check looks for the following problems in prog, returning them in
+// source order:
+//
+//   - functions that are never called (other than by themselves)
+//   - global and local variables that are assigned but never used,
+//     and function parameters that are never used
+//   - assignments to special variables that AWK sets but never reads
+//     itself (like RSTART), when the program doesn't read them either
+//   - comparisons of a field with a numeric string constant, like
+//     $1 == "10", which compare as strings
+//   - local variables the caller doesn't pass that are used before
+//     they're assigned
+func Check(prog *ast.Program) []Warning {
+	c := &checker{
+		prog:    prog,
+		globals: make(map[string]*usage),
+		minArgs: make(map[int]int),
+		calls:   make(map[int][]int),
+	}
+	c.findCalls()
+	c.checkFunctions()
+
+	c.function = -1
+	for _, stmts := range prog.Begin {
+		c.stmts(stmts)
+	}
+	for _, action := range prog.Actions {
+		c.exprs(action.Pattern)
+		c.stmts(action.Stmts)
+	}
+	for _, stmts := range prog.End {
+		c.stmts(stmts)
+	}
+	for i, f := range prog.Functions {
+		c.function = i
+		c.locals = make(map[string]*usage)
+		c.assigned = make(map[string]bool)
+		c.reported = make(map[string]bool)
+		c.stmts(f.Body)
+		c.checkLocals(i, f)
+	}
+	c.checkGlobals()
+
+	sort.SliceStable(c.warnings, func(i, j int) bool {
+		pi, pj := c.warnings[i].Position, c.warnings[j].Position
+		return pi.Line < pj.Line || pi.Line == pj.Line && pi.Column < pj.Column
+	})
+	return c.warnings
+}
+
+type checker struct {
+	prog     *ast.Program
+	warnings []Warning
+
+	globals map[string]*usage // by name, including special variables
+
+	// For each function (by index), the fewest arguments it's called
+	// with, and the functions that call it
+	minArgs map[int]int
+	calls   map[int][]int
+
+	// State for the current function (function is -1 outside them)
+	function int
+	locals   map[string]*usage
+	assigned map[string]bool // locals assigned so far, in source order
+	reported map[string]bool // locals reported as used before assigned
+}
+
+// How a variable or array is used.
+type usage struct {
+	reads  int // reads of its value (array elements count for arrays)
+	writes int // assignments, updates like x++, and deletes
+	pos    Position
+}
+
+func (c *checker) warnf(pos Position, format string, args ...interface{}) {
+	c.warnings = append(c.warnings, Warning{pos, fmt.Sprintf(format, args...)})
+}
+
+// Find the fewest arguments each user function is called with, and
+// which function (or -1 for outside functions) each call is in.
+func (c *checker) findCalls() {
+	find := func(caller int, node ast.Node) {
+		ast.Inspect(node, func(node ast.Node) bool {
+			call, ok := node.(*ast.UserCallExpr)
+			if ok && !call.Native {
+				if n, ok := c.minArgs[call.Index]; !ok || len(call.Args) < n {
+					c.minArgs[call.Index] = len(call.Args)
+				}
+				c.calls[call.Index] = append(c.calls[call.Index], caller)
+			}
+			return true
+		})
+	}
+	for _, stmts := range c.prog.Begin {
+		find(-1, stmts)
+	}
+	for i := range c.prog.Actions {
+		find(-1, &c.prog.Actions[i])
+	}
+	for _, stmts := range c.prog.End {
+		find(-1, stmts)
+	}
+	for i := range c.prog.Functions {
+		find(i, &c.prog.Functions[i])
+	}
+}
+
+// Report functions that can't be called from the BEGIN blocks,
+// actions, or END blocks, directly or indirectly.
+func (c *checker) checkFunctions() {
+	called := make(map[int]bool)
+	var mark func(int)
+	mark = func(f int) {
+		if called[f] {
+			return
+		}
+		called[f] = true
+		// Mark the functions f calls
+		for callee, callers := range c.calls {
+			for _, caller := range callers {
+				if caller == f {
+					mark(callee)
+				}
+			}
+		}
+	}
+	for callee, callers := range c.calls {
+		for _, caller := range callers {
+			if caller == -1 {
+				mark(callee)
+			}
+		}
+	}
+	for i, f := range c.prog.Functions {
+		if !called[i] {
+			c.warnf(c.functionPos(i), "function %s is never called", f.Name)
+		}
+	}
+}
+
+func (c *checker) functionPos(i int) Position {
+	if i < len(c.prog.FunctionPositions) {
+		return c.prog.FunctionPositions[i]
+	}
+	return Position{}
+}
+
+func (c *checker) checkLocals(index int, f ast.Function) {
+	pos := c.functionPos(index)
+	passed, ok := c.minArgs[index]
+	if !ok {
+		passed = len(f.Params)
+	}
+	for i, name := range f.Params {
+		u := c.locals[name]
+		switch {
+		case u == nil:
+			c.warnf(pos, "parameter %s of function %s is never used", name, f.Name)
+		case u.reads == 0 && (!f.Arrays[i] || i >= passed):
+			// Assigning to a scalar parameter or a local array is
+			// pointless, but an array parameter is passed by
+			// reference, so elements assigned are seen by the caller.
+			c.warnf(u.pos, "local variable %s is assigned but never used", name)
+		}
+	}
+}
+
+func (c *checker) checkGlobals() {
+	var names []string
+	for name := range c.globals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		u := c.globals[name]
+		if u.reads > 0 || u.writes == 0 {
+			continue
+		}
+		switch name {
+		case "ARGV", "ENVIRON":
+			// These are read by AWK itself
+		case "RSTART", "RLENGTH", "FILENAME":
+			c.warnf(u.pos, "special variable %s is assigned but never used", name)
+		default:
+			if ast.SpecialVarIndex(name) == 0 {
+				c.warnf(u.pos, "global variable %s is assigned but never used", name)
+			}
+		}
+	}
+}
+
+// Return the usage record for a variable with the given scope and name.
+func (c *checker) usage(scope ast.VarScope, name string, pos Position) *usage {
+	vars := c.globals
+	if scope == ast.ScopeLocal {
+		vars = c.locals
+	}
+	u := vars[name]
+	if u == nil {
+		u = &usage{pos: pos}
+		vars[name] = u
+	}
+	return u
+}
+
+func (c *checker) exprPos(expr ast.Expr) Position {
+	return c.prog.ExprPositions[expr]
+}
+
+// Record a read of scalar variable v.
+func (c *checker) readVar(v *ast.VarExpr) {
+	pos := c.exprPos(v)
+	c.usage(v.Scope, v.Name, pos).reads++
+	if v.Scope != ast.ScopeLocal || c.assigned[v.Name] || c.reported[v.Name] {
+		return
+	}
+	params := c.prog.Functions[c.function].Params
+	passed, called := c.minArgs[c.function]
+	for i, name := range params {
+		if name == v.Name && called && i >= passed {
+			c.warnf(pos, "local variable %s is used before it's assigned", v.Name)
+			c.reported[v.Name] = true
+		}
+	}
+}
+
+// Record an assignment or update of scalar variable v.
+func (c *checker) writeVar(v *ast.VarExpr) {
+	c.usage(v.Scope, v.Name, c.exprPos(v)).writes++
+	if v.Scope == ast.ScopeLocal {
+		c.assigned[v.Name] = true
+	}
+}
+
+func (c *checker) readArray(a *ast.ArrayExpr) {
+	c.usage(a.Scope, a.Name, c.exprPos(a)).reads++
+}
+
+func (c *checker) writeArray(a *ast.ArrayExpr) {
+	c.usage(a.Scope, a.Name, c.exprPos(a)).writes++
+}
+
+// Record an assignment or update of lvalue expr.
+func (c *checker) lvalue(expr ast.Expr) {
+	switch e := expr.(type) {
+	case *ast.VarExpr:
+		c.writeVar(e)
+	case *ast.IndexExpr:
+		c.exprs(e.Index)
+		c.writeArray(e.Array)
+	case *ast.FieldExpr:
+		c.expr(e.Index)
+	default:
+		c.expr(expr)
+	}
+}
+
+// Record an update like x++ of lvalue expr, and a read of it if the
+// result is used (as in a[++n]), though not as a use before it's
+// assigned, as locals are often counted up from zero.
+func (c *checker) update(expr ast.Expr, used bool) {
+	if used {
+		switch e := expr.(type) {
+		case *ast.VarExpr:
+			c.usage(e.Scope, e.Name, c.exprPos(e)).reads++
+		case *ast.IndexExpr:
+			c.readArray(e.Array)
+		}
+	}
+	c.lvalue(expr)
+}
+
+func (c *checker) stmts(stmts ast.Stmts) {
+	for _, s := range stmts {
+		c.stmt(s)
+	}
+}
+
+func (c *checker) stmt(stmt ast.Stmt) {
+	switch s := stmt.(type) {
+	case *ast.PrintStmt:
+		c.exprs(s.Args)
+		c.optExpr(s.Dest)
+	case *ast.PrintfStmt:
+		c.exprs(s.Args)
+		c.optExpr(s.Dest)
+	case *ast.ExprStmt:
+		// The value of an update statement like x++ isn't used
+		switch e := s.Expr.(type) {
+		case *ast.IncrExpr:
+			c.update(e.Expr, false)
+		case *ast.AugAssignExpr:
+			c.expr(e.Right)
+			c.update(e.Left, false)
+		default:
+			c.expr(s.Expr)
+		}
+	case *ast.IfStmt:
+		c.expr(s.Cond)
+		c.stmts(s.Body)
+		c.stmts(s.Else)
+	case *ast.ForStmt:
+		if s.Pre != nil {
+			c.stmt(s.Pre)
+		}
+		c.optExpr(s.Cond)
+		c.stmts(s.Body)
+		if s.Post != nil {
+			c.stmt(s.Post)
+		}
+	case *ast.ForInStmt:
+		c.readArray(s.Array)
+		c.writeVar(s.Var)
+		c.stmts(s.Body)
+	case *ast.WhileStmt:
+		c.expr(s.Cond)
+		c.stmts(s.Body)
+	case *ast.DoWhileStmt:
+		c.stmts(s.Body)
+		c.expr(s.Cond)
+	case *ast.ExitStmt:
+		c.optExpr(s.Status)
+	case *ast.DeleteStmt:
+		c.exprs(s.Index)
+		c.writeArray(s.Array)
+	case *ast.ReturnStmt:
+		c.optExpr(s.Value)
+	case *ast.BlockStmt:
+		c.stmts(s.Body)
+	}
+}
+
+func (c *checker) optExpr(expr ast.Expr) {
+	if expr != nil {
+		c.expr(expr)
+	}
+}
+
+func (c *checker) exprs(exprs []ast.Expr) {
+	for _, expr := range exprs {
+		c.expr(expr)
+	}
+}
+
+func (c *checker) expr(expr ast.Expr) {
+	switch e := expr.(type) {
+	case *ast.VarExpr:
+		c.readVar(e)
+	case *ast.ArrayExpr:
+		c.readArray(e)
+	case *ast.IndexExpr:
+		c.exprs(e.Index)
+		c.readArray(e.Array)
+	case *ast.InExpr:
+		c.exprs(e.Index)
+		c.readArray(e.Array)
+	case *ast.FieldExpr:
+		c.expr(e.Index)
+	case *ast.UnaryExpr:
+		c.expr(e.Value)
+	case *ast.BinaryExpr:
+		c.expr(e.Left)
+		c.expr(e.Right)
+		c.checkComparison(e)
+	case *ast.CondExpr:
+		c.expr(e.Cond)
+		c.expr(e.True)
+		c.expr(e.False)
+	case *ast.AssignExpr:
+		// The right side is evaluated before the assignment
+		c.expr(e.Right)
+		c.lvalue(e.Left)
+	case *ast.AugAssignExpr:
+		c.expr(e.Right)
+		c.update(e.Left, true)
+	case *ast.IncrExpr:
+		c.update(e.Expr, true)
+	case *ast.CallExpr:
+		switch {
+		case e.Func == F_SPLIT:
+			c.expr(e.Args[0])
+			c.writeArray(e.Args[1].(*ast.ArrayExpr))
+			if len(e.Args) > 2 {
+				c.expr(e.Args[2])
+			}
+			if len(e.Args) > 3 {
+				c.writeArray(e.Args[3].(*ast.ArrayExpr))
+			}
+		case e.Func == F_COPY || e.Func == F_KEYS || e.Func == F_VALUES:
+			c.readArray(e.Args[0].(*ast.ArrayExpr))
+			c.writeArray(e.Args[1].(*ast.ArrayExpr))
+			if len(e.Args) > 2 {
+				c.expr(e.Args[2])
+			}
+		case e.Func == F_MATCH && len(e.Args) == 3:
+			c.exprs(e.Args[:2])
+			c.writeArray(e.Args[2].(*ast.ArrayExpr))
+		case e.Func == F_GLOB || e.Func == F_PARSEQUERY || e.Func == F_STAT:
+			c.expr(e.Args[0])
+			c.writeArray(e.Args[1].(*ast.ArrayExpr))
+		case e.Func == F_SQL_QUERY:
+			c.exprs(e.Args[:2])
+			c.writeArray(e.Args[2].(*ast.ArrayExpr))
+			c.exprs(e.Args[3:])
+		case (e.Func == F_SUB || e.Func == F_GSUB) && len(e.Args) == 3:
+			c.exprs(e.Args[:2])
+			c.lvalue(e.Args[2])
+		default:
+			c.exprs(e.Args)
+		}
+	case *ast.UserCallExpr:
+		c.userCall(e)
+	case *ast.MultiExpr:
+		c.exprs(e.Exprs)
+	case *ast.GetlineExpr:
+		c.optExpr(e.Command)
+		c.optExpr(e.File)
+		if e.Target != nil {
+			c.lvalue(e.Target)
+		}
+	}
+}
+
+func (c *checker) userCall(call *ast.UserCallExpr) {
+	if call.Native {
+		c.exprs(call.Args)
+		return
+	}
+	arrays := c.prog.Functions[call.Index].Arrays
+	for i, arg := range call.Args {
+		v, ok := arg.(*ast.VarExpr)
+		if ok && i < len(arrays) && arrays[i] {
+			// Array passed by reference, which the function may read
+			// or assign elements of
+			u := c.usage(v.Scope, v.Name, c.exprPos(v))
+			u.reads++
+			u.writes++
+			continue
+		}
+		c.expr(arg)
+	}
+}
+
+// Report comparisons like $1 == "10", which compare as strings (so
+// they're false if the field is "10.0" or " 10"), though they look
+// like numeric comparisons.
+func (c *checker) checkComparison(e *ast.BinaryExpr) {
+	switch e.Op {
+	case EQUALS, NOT_EQUALS, LESS, LTE, GREATER, GTE:
+	default:
+		return
+	}
+	for _, pair := range [][2]ast.Expr{{e.Left, e.Right}, {e.Right, e.Left}} {
+		field, ok := pair[0].(*ast.FieldExpr)
+		if !ok {
+			continue
+		}
+		str, ok := pair[1].(*ast.StrExpr)
+		if !ok {
+			continue
+		}
+		value := strings.TrimSpace(str.Value)
+		if _, err := strconv.ParseFloat(value, 64); err != nil || value == "" {
+			continue
+		}
+		c.warnf(c.exprPos(e), "comparison of %s with string %q is a string comparison; use %s to compare numbers",
+			field, str.Value, value)
+		return
+	}
+}
+
@@ -0,0 +1,73 @@
+package lint_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/benhoyt/goawk/lint"
+	"github.com/benhoyt/goawk/parser"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		src      string
+		warnings string
+	}{
+		// Unused variables
+		{`BEGIN { x = 1 }`, "1:9: global variable x is assigned but never used"},
+		{`BEGIN { x = 1; print x }`, ""},
+		{`BEGIN { x++; y += 2 }`, "1:9: global variable x is assigned but never used\n" +
+			"1:14: global variable y is assigned but never used"},
+		{`{ a[++n] = $1 } END { for (k in a) print a[k] }`, ""},
+		{`{ a[$1] = 1 }`, "1:3: global variable a is assigned but never used"},
+		{`{ n = split($0, parts) } END { print n }`, "1:17: global variable parts is assigned but never used"},
+		{`{ getline line < "f" }`, "1:11: global variable line is assigned but never used"},
+		{`{ s = $0; gsub(/a/, "b", s) }`, "1:3: global variable s is assigned but never used"},
+		{`BEGIN { print x }`, ""}, // could be set with -v
+		{`BEGIN { ARGV[1] = "f"; ENVIRON["X"] = 1; FS = ":" }`, ""},
+		{`BEGIN { RSTART = 1 }`, "1:9: special variable RSTART is assigned but never used"},
+		{`{ RSTART = 0; match($0, /x/); print RSTART }`, ""},
+
+		// Functions and their locals
+		{`function f() {}`, "1:1: function f is never called"},
+		{`function f(n) { return f(n-1) } function g() { f(1) }`,
+			"1:1: function f is never called\n1:33: function g is never called"},
+		{`BEGIN { g() } function f(n) { return n } function g() { return f(1) }`, ""},
+		{`BEGIN { f(1) }
+function f(a, b) { return 1 }`, "2:1: parameter a of function f is never used\n" +
+			"2:1: parameter b of function f is never used"},
+		{`BEGIN { f(1) }
+function f(a,   x) { x = a }`, "2:22: local variable x is assigned but never used"},
+		{`BEGIN { f(a); print a[1] }
+function f(arr) { arr[1] = 1 }`, ""},
+		{`BEGIN { f(1) }
+function f(n,   tmp) { tmp[1] = n }`, "2:24: local variable tmp is assigned but never used"},
+		{`BEGIN { f(1) }
+function f(n,   x, i) { x = x + n; for (i = 0; i < n; i++) ; return x }`, "2:29: local variable x is used before it's assigned"},
+		{`BEGIN { f(1, 2) }
+function f(n,   x) { return x + n }`, ""}, // every call passes x
+		{`BEGIN { f(1) }
+function f(n,   c, a) { a[++c] = n; return a[c] }`, ""},
+
+		// Comparisons
+		{`$1 == "10"`, `1:1: comparison of $1 with string "10" is a string comparison; use 10 to compare numbers`},
+		{`"2.5" < $NF { print }`, `1:1: comparison of $NF with string "2.5" is a string comparison; use 2.5 to compare numbers`},
+		{`$1 == "abc" || $2 == "" || $3 == 10`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			prog, err := parser.ParseProgram([]byte(test.src), nil)
+			if err != nil {
+				t.Fatalf("error parsing: %v", err)
+			}
+			var warnings []string
+			for _, w := range lint.Check(prog.AST()) {
+				warnings = append(warnings, w.String())
+			}
+			got := strings.Join(warnings, "\n")
+			if got != test.warnings {
+				t.Fatalf("expected warnings:\n%s\ngot:\n%s", test.warnings, got)
+			}
+		})
+	}
+}
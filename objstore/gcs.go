@@ -0,0 +1,222 @@
+// Google Cloud Storage objects, with OAuth 2 access tokens
+
+package objstore
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	gcsEndpoint   = "https://storage.googleapis.com"
+	gcsTokenURL   = "https://oauth2.googleapis.com/token"
+	gcsReadScope  = "https://www.googleapis.com/auth/devstorage.read_only"
+	jwtBearerType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+)
+
+func (o *opener) openGCS(bucket, object string) (io.ReadCloser, error) {
+	endpoint := gcsEndpoint
+	if host := o.getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		endpoint = host
+		if !strings.Contains(host, "://") {
+			endpoint = "http://" + host
+		}
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid GCS endpoint %q", endpoint)
+	}
+	// Download with the JSON API, where the object name is one path
+	// segment (with any slashes escaped)
+	path := "/storage/v1/b/" + bucket + "/o/" + object
+	u.RawPath = u.Path + "/storage/v1/b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(object)
+	u.Path += path
+	u.RawQuery = "alt=media"
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	token, err := o.gcsAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return o.get(req, gcsErrorMessage)
+}
+
+// Credentials file, either a service account key or an authorized
+// user's refresh token, as written by "gcloud auth application-default
+// login".
+type gcsCredentials struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Return an access token for reading objects, or "" if there are no
+// credentials (for anonymous access). Tokens fetched with a credentials
+// file are cached until shortly before they expire.
+func (o *opener) gcsAccessToken() (string, error) {
+	if token := o.getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+	path := o.getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	explicit := path != ""
+	if !explicit {
+		path = o.homeFile(".config", "gcloud", "application_default_credentials.json")
+		if path == "" {
+			return "", nil
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.gcsToken != "" && o.now().Before(o.gcsTokenExp) {
+		return o.gcsToken, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var creds gcsCredentials
+	err = json.Unmarshal(data, &creds)
+	if err != nil {
+		return "", fmt.Errorf("invalid credentials file %s: %v", path, err)
+	}
+	var form url.Values
+	tokenURL := gcsTokenURL
+	switch creds.Type {
+	case "service_account":
+		if creds.TokenURI != "" {
+			tokenURL = creds.TokenURI
+		}
+		assertion, err := o.signedJWT(&creds, tokenURL)
+		if err != nil {
+			return "", fmt.Errorf("invalid credentials file %s: %v", path, err)
+		}
+		form = url.Values{"grant_type": {jwtBearerType}, "assertion": {assertion}}
+	case "authorized_user":
+		form = url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {creds.ClientID},
+			"client_secret": {creds.ClientSecret},
+			"refresh_token": {creds.RefreshToken},
+		}
+	default:
+		return "", fmt.Errorf("unsupported credentials type %q in %s", creds.Type, path)
+	}
+	token, expiresIn, err := o.fetchToken(tokenURL, form)
+	if err != nil {
+		return "", fmt.Errorf("can't get access token: %v", err)
+	}
+	o.gcsToken = token
+	o.gcsTokenExp = o.now().Add(time.Duration(expiresIn)*time.Second - time.Minute)
+	return token, nil
+}
+
+// Return a JWT asserting the service account's identity, signed with
+// its private key, to exchange at tokenURL for an access token.
+func (o *opener) signedJWT(creds *gcsCredentials, tokenURL string) (string, error) {
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return "", errors.New("private_key isn't PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return "", err
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("private_key isn't an RSA key")
+	}
+	now := o.now().Unix()
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": gcsReadScope,
+		"aud":   tokenURL,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+	if err != nil {
+		return "", err
+	}
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + encoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + encoding.EncodeToString(signature), nil
+}
+
+// POST the form to the OAuth 2 token endpoint and return the access
+// token and the number of seconds until it expires.
+func (o *opener) fetchToken(tokenURL string, form url.Values) (string, int, error) {
+	resp, err := o.client.PostForm(tokenURL, form)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result)
+	if resp.StatusCode != http.StatusOK {
+		if result.Error != "" {
+			return "", 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(result.Error+" "+result.ErrorDescription))
+		}
+		return "", 0, errors.New(resp.Status)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	if result.AccessToken == "" {
+		return "", 0, errors.New("no access_token in response")
+	}
+	return result.AccessToken, result.ExpiresIn, nil
+}
+
+// Return the message from a GCS JSON error response, or "" if there
+// isn't one.
+func gcsErrorMessage(body []byte) string {
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &e) != nil {
+		return ""
+	}
+	return e.Error.Message
+}
@@ -0,0 +1,135 @@
+// Package objstore opens objects in cloud object storage for reading,
+// so AWK programs can read them as input files without downloading
+// them first. It handles Amazon S3 URLs, s3://bucket/key, and Google
+// Cloud Storage URLs, gs://bucket/object. Open can be used as
+// interp.Config.OpenURL.
+//
+// Credentials come from the places the cloud SDKs look, apart from
+// instance metadata services, which aren't supported:
+//
+// For S3, they're the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and
+// AWS_SESSION_TOKEN environment variables, or the AWS_PROFILE profile
+// (default "default") in the shared credentials file,
+// AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials. The region is
+// AWS_REGION or AWS_DEFAULT_REGION (default us-east-1), and
+// AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL set an S3-compatible
+// endpoint, which is used with path-style URLs.
+//
+// For GCS, they're an access token in GOOGLE_OAUTH_ACCESS_TOKEN, or
+// the service account key or authorized user ("gcloud auth
+// application-default login") file named by
+// GOOGLE_APPLICATION_CREDENTIALS, or
+// ~/.config/gcloud/application_default_credentials.json. The
+// STORAGE_EMULATOR_HOST environment variable sets the endpoint of an
+// emulator.
+//
+// Without credentials, requests are made anonymously, which works for
+// public objects.
+package objstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Opens objects using the given environment, HTTP client, and clock
+// (all replaceable for testing).
+type opener struct {
+	getenv func(string) string
+	client *http.Client
+	now    func() time.Time
+
+	mu          sync.Mutex
+	gcsToken    string // cached GCS access token, if any
+	gcsTokenExp time.Time
+}
+
+var defaultOpener = &opener{getenv: os.Getenv, client: http.DefaultClient, now: time.Now}
+
+// Open opens the object named by url, s3://bucket/key or
+// gs://bucket/object, for reading. The object is streamed as it's read
+// from the returned ReadCloser, which the caller must close. If the
+// object can't be opened, the error is an *os.PathError, as for a file
+// that doesn't exist.
+func Open(url string) (io.ReadCloser, error) {
+	return defaultOpener.open(url)
+}
+
+func (o *opener) open(url string) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	var err error
+	switch {
+	case strings.HasPrefix(url, "s3://"):
+		bucket, key, ok := splitObjectURL(url[len("s3://"):])
+		if !ok {
+			return nil, pathError(url, errors.New("URL must be s3://bucket/key"))
+		}
+		r, err = o.openS3(bucket, key)
+	case strings.HasPrefix(url, "gs://"):
+		bucket, object, ok := splitObjectURL(url[len("gs://"):])
+		if !ok {
+			return nil, pathError(url, errors.New("URL must be gs://bucket/object"))
+		}
+		r, err = o.openGCS(bucket, object)
+	default:
+		return nil, pathError(url, errors.New("unsupported URL scheme (must be s3:// or gs://)"))
+	}
+	if err != nil {
+		return nil, pathError(url, err)
+	}
+	return r, nil
+}
+
+// Split bucket/name into the bucket and the object name, neither of
+// which may be empty.
+func splitObjectURL(s string) (bucket, name string, ok bool) {
+	i := strings.IndexByte(s, '/')
+	if i <= 0 || i == len(s)-1 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+func pathError(url string, err error) error {
+	return &os.PathError{Op: "open", Path: url, Err: err}
+}
+
+// Send the request, returning the response body if it succeeded, or
+// an error that includes the message extracted from the error response
+// by message, if it finds one.
+func (o *opener) get(req *http.Request, message func(body []byte) string) (io.ReadCloser, error) {
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if msg := message(body); msg != "" {
+		return nil, fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	return nil, errors.New(resp.Status)
+}
+
+// Return the path of a file in the user's home directory, or "" if the
+// home directory isn't known.
+func (o *opener) homeFile(elem ...string) string {
+	home := o.getenv("HOME")
+	if home == "" {
+		home = o.getenv("USERPROFILE") // Windows
+	}
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(append([]string{home}, elem...)...)
+}
@@ -0,0 +1,258 @@
+// Amazon S3 objects, with requests signed using AWS Signature Version 4
+
+package objstore
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS credentials. If sessionToken is set, they're temporary.
+type awsCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// Payload hash for a request whose body isn't signed (a GET has none).
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+func (o *opener) openS3(bucket, key string) (io.ReadCloser, error) {
+	region := o.getenv("AWS_REGION")
+	if region == "" {
+		region = o.getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	u, err := o.s3URL(region, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := o.awsCredentials()
+	if err != nil {
+		return nil, err
+	}
+	if creds != nil {
+		signV4(req, creds, region, "s3", o.now(), unsignedPayload)
+	}
+	return o.get(req, s3ErrorMessage)
+}
+
+// Return the URL of the object: virtual-hosted style for AWS (unless
+// the bucket name has dots, which don't work with its certificate),
+// and path style for a custom endpoint.
+func (o *opener) s3URL(region, bucket, key string) (*url.URL, error) {
+	endpoint := o.getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = o.getenv("AWS_ENDPOINT_URL")
+	}
+	var u *url.URL
+	var path string
+	switch {
+	case endpoint != "":
+		var err error
+		u, err = url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint URL %q", endpoint)
+		}
+		path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + key
+	case strings.Contains(bucket, "."):
+		u = &url.URL{Scheme: "https", Host: "s3." + region + ".amazonaws.com"}
+		path = "/" + bucket + "/" + key
+	default:
+		u = &url.URL{Scheme: "https", Host: bucket + ".s3." + region + ".amazonaws.com"}
+		path = "/" + key
+	}
+	u.Path = path
+	u.RawPath = uriEncode(path, false)
+	return u, nil
+}
+
+// Return the credentials from the environment, or from the shared
+// credentials file, or nil if there aren't any (for anonymous access).
+func (o *opener) awsCredentials() (*awsCredentials, error) {
+	if key := o.getenv("AWS_ACCESS_KEY_ID"); key != "" {
+		secret := o.getenv("AWS_SECRET_ACCESS_KEY")
+		if secret == "" {
+			return nil, errors.New("AWS_ACCESS_KEY_ID is set but AWS_SECRET_ACCESS_KEY isn't")
+		}
+		return &awsCredentials{key, secret, o.getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	path := o.getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		path = o.homeFile(".aws", "credentials")
+		if path == "" {
+			return nil, nil
+		}
+	}
+	profile := o.getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	settings, err := readINISection(path, profile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if settings == nil {
+		if o.getenv("AWS_PROFILE") != "" {
+			return nil, fmt.Errorf("AWS profile %q not found in %s", profile, path)
+		}
+		return nil, nil
+	}
+	creds := &awsCredentials{
+		accessKey:    settings["aws_access_key_id"],
+		secretKey:    settings["aws_secret_access_key"],
+		sessionToken: settings["aws_session_token"],
+	}
+	if creds.accessKey == "" || creds.secretKey == "" {
+		return nil, fmt.Errorf("AWS profile %q in %s doesn't have aws_access_key_id and aws_secret_access_key", profile, path)
+	}
+	return creds, nil
+}
+
+// Read the "key = value" settings in the [name] section of an INI file
+// like ~/.aws/credentials, or return nil if there's no such section.
+func readINISection(path, name string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var settings map[string]string
+	inSection := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[' && line[len(line)-1] == ']':
+			inSection = strings.TrimSpace(line[1:len(line)-1]) == name
+			if inSection && settings == nil {
+				settings = make(map[string]string)
+			}
+		case inSection:
+			if eq := strings.IndexByte(line, '='); eq >= 0 {
+				settings[strings.TrimSpace(line[:eq])] = strings.TrimSpace(line[eq+1:])
+			}
+		}
+	}
+	return settings, scanner.Err()
+}
+
+// Sign the request for the given service and region with AWS Signature
+// Version 4, adding the X-Amz-* and Authorization headers. All the
+// request's headers are signed, along with Host. The request must not
+// have a query string.
+func signV4(req *http.Request, creds *awsCredentials, region, service string, now time.Time, payloadHash string) {
+	timestamp := now.UTC().Format("20060102T150405Z")
+	date := timestamp[:8]
+	req.Header.Set("X-Amz-Date", timestamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"", // query string
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + sha256Hex(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// URI-encode s as AWS signing requires: every byte but the unreserved
+// characters A-Z, a-z, 0-9, '-', '.', '_', and '~' is percent-encoded
+// (and '/', unless encodeSlash is true).
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Return the message from an S3 XML error response, like "NoSuchKey:
+// The specified key does not exist.", or "" if there isn't one.
+func s3ErrorMessage(body []byte) string {
+	var e struct {
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(body, &e) != nil || e.Code == "" {
+		return ""
+	}
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Message
+}
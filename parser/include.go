@@ -0,0 +1,188 @@
+// Expanding @include "file" directives
+
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/benhoyt/goawk/lexer"
+)
+
+// An @include directive found in the source, at the top level.
+type includeDirective struct {
+	pos   Position // of the "@"
+	name  string   // file name, as written
+	start int      // byte offset of the "@"
+	end   int      // byte offset after the directive's line
+}
+
+// ExpandIncludes returns src with each top-level @include "file"
+// directive replaced by the file's contents (whose own directives are
+// expanded in turn), and the files the expanded source's lines come
+// from, for ParserConfig.Files. files are the files src was
+// concatenated from, or nil if it's a single unnamed source, and the
+// included files are searched for in the directories in path, as for
+// FindFile. A file is only included the first time it's named, so
+// later directives for it (and cycles) are dropped. An error is a
+// *ParseError with Filename set (if the file has a name).
+//
+// ParseProgram does this itself if ParserConfig.IncludePath is set;
+// callers that want the expanded source, for example to show the
+// lines that errors are on, can call it first.
+func ExpandIncludes(src []byte, files []File, path []string) ([]byte, []File, error) {
+	return expandIncludes(src, files, path, make(map[string]bool))
+}
+
+func expandIncludes(src []byte, files []File, path []string, included map[string]bool) ([]byte, []File, error) {
+	if len(files) == 0 {
+		files = []File{{Lines: bytes.Count(src, []byte{'\n'}) + 1}}
+	}
+	directives, err := findIncludes(src)
+	if err != nil {
+		return nil, nil, fileErrors(err, files)
+	}
+	if len(directives) == 0 {
+		return src, files, nil
+	}
+
+	var out []byte
+	var outFiles []File
+	offset := 0
+	line := 1 // line of src at offset
+	for _, d := range directives {
+		// The source before the directive, ending the line it's on
+		out = append(out, src[offset:d.start]...)
+		out = append(out, '\n')
+		outFiles = append(outFiles, fileParts(files, line, d.pos.Line-line+1)...)
+		offset = d.end
+		line = d.pos.Line + 1
+
+		found, err := FindFile(d.name, path)
+		if err != nil {
+			return nil, nil, fileErrors(&ParseError{Position: d.pos, Message: err.Error()}, files)
+		}
+		key := filepath.Clean(found)
+		if abs, err := filepath.Abs(found); err == nil {
+			key = abs
+		}
+		if included[key] {
+			continue
+		}
+		included[key] = true
+		content, err := ioutil.ReadFile(found)
+		if err != nil {
+			if e, ok := err.(*os.PathError); ok {
+				err = e.Err
+			}
+			message := fmt.Sprintf("can't include %q: %v", d.name, err)
+			return nil, nil, fileErrors(&ParseError{Position: d.pos, Message: message}, files)
+		}
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			content = append(content, '\n')
+		}
+		content, contentFiles, err := expandIncludes(content, []File{{Name: found, Lines: bytes.Count(content, []byte{'\n'})}}, path, included)
+		if err != nil {
+			return nil, nil, err
+		}
+		out = append(out, content...)
+		outFiles = append(outFiles, contentFiles...)
+	}
+	out = append(out, src[offset:]...)
+	outFiles = append(outFiles, fileParts(files, line, -1)...)
+	return out, outFiles, nil
+}
+
+// Find the top-level @include directives in src (outside braces),
+// scanning it like scanFuncNames does.
+func findIncludes(src []byte) ([]includeDirective, error) {
+	var directives []includeDirective
+	lexer := NewLexer(src)
+	prevTok := ILLEGAL
+	depth := 0
+	for {
+		pos, tok, _ := lexer.Scan()
+		switch tok {
+		case EOF:
+			return directives, nil
+		case LBRACE:
+			depth++
+		case RBRACE:
+			depth--
+		case INCLUDE:
+			if depth > 0 {
+				break // the parser reports this as a syntax error
+			}
+			_, tok, name := lexer.Scan()
+			if tok != STRING {
+				return nil, &ParseError{Position: pos, Message: "expected file name string after @include"}
+			}
+			endPos, tok, _ := lexer.Scan()
+			if tok != NEWLINE && tok != EOF {
+				return nil, &ParseError{Position: endPos, Message: "expected newline after @include \"" + name + "\""}
+			}
+			end := len(src)
+			if tok == NEWLINE {
+				end = offsetOf(src, endPos) + 1
+			}
+			directives = append(directives, includeDirective{pos, name, offsetOf(src, pos), end})
+		case DIV, DIV_ASSIGN:
+			switch prevTok {
+			case NAME, NUMBER, STRING, REGEX, RPAREN, RBRACKET, DOLLAR, INCR, DECR, F_LENGTH:
+				// Slash after an operand is division
+			default:
+				lexer.ScanRegex()
+				tok = REGEX
+			}
+		}
+		prevTok = tok
+	}
+}
+
+// Return the byte offset in src of pos, whose column the lexer counts
+// in bytes, but not including carriage returns.
+func offsetOf(src []byte, pos Position) int {
+	offset := 0
+	for line := 1; line < pos.Line; line++ {
+		offset += bytes.IndexByte(src[offset:], '\n') + 1
+	}
+	for column := 1; offset < len(src); offset++ {
+		if src[offset] == '\r' {
+			continue
+		}
+		if column == pos.Column {
+			break
+		}
+		column++
+	}
+	return offset
+}
+
+// Return the files (or the parts of them) that n lines of the source
+// come from, starting at line first, or all the lines from there to the
+// end if n is negative.
+func fileParts(files []File, first, n int) []File {
+	var parts []File
+	start := 1 // line of the source that files[i] starts at
+	for _, f := range files {
+		lo, hi := first, first+n
+		if lo < start {
+			lo = start
+		}
+		if n < 0 || hi > start+f.Lines {
+			hi = start + f.Lines
+		}
+		if lo < hi {
+			part := File{Name: f.Name, Lines: hi - lo}
+			if lo > start || f.StartLine > 1 {
+				part.StartLine = f.startLine() + lo - start
+			}
+			parts = append(parts, part)
+		}
+		start += f.Lines
+	}
+	return parts
+}
@@ -2,36 +2,60 @@
 //
 // Use the ParseProgram function to parse an AWK program, and then
 // give the result to one of the interp.Exec* functions to execute it.
-//
 package parser
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
-	"github.com/benhoyt/goawk/internal/ast"
+	"github.com/benhoyt/goawk/ast"
 	"github.com/benhoyt/goawk/internal/compiler"
 	. "github.com/benhoyt/goawk/lexer"
 )
 
 // ParseError (actually *ParseError) is the type of error returned by
-// ParseProgram.
+// ParseProgram (unless ParserConfig.MaxErrors is greater than 1).
 type ParseError struct {
-	// Source line/column position where the error occurred.
+	// Source line/column position where the error occurred. If
+	// Filename is set, the line number is the line in that file.
 	Position Position
 	// Error message.
 	Message string
+	// Name of the file the error occurred in, if ParserConfig.Files
+	// was set, or "" if not.
+	Filename string
 }
 
 // Error returns a formatted version of the error, including the line
-// and column numbers.
+// and column numbers (and the filename, if known).
 func (e *ParseError) Error() string {
+	if e.Filename != "" {
+		return fmt.Sprintf("parse error at %s:%d:%d: %s", e.Filename, e.Position.Line, e.Position.Column, e.Message)
+	}
 	return fmt.Sprintf("parse error at %d:%d: %s", e.Position.Line, e.Position.Column, e.Message)
 }
 
+// ErrorList is the type of error returned by ParseProgram if
+// ParserConfig.MaxErrors is greater than 1: the parse errors in the
+// order they were found.
+type ErrorList []*ParseError
+
+// Error returns the first error, and how many more there are.
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
 // ParserConfig lets you specify configuration for the parsing
 // process (for example printing type information for debugging).
 type ParserConfig struct {
@@ -44,12 +68,122 @@ type ParserConfig struct {
 	// Map of named Go functions to allow calling from AWK. See docs
 	// on interp.Config.Funcs for details.
 	Funcs map[string]interface{}
+
+	// Directories to search for the files named by @include "file"
+	// directives, in order, as for FindFile (for example the AWKPATH
+	// environment variable split with filepath.SplitList). A
+	// directive is replaced by the file's contents, so its functions
+	// and rules are part of the program, and errors in it report the
+	// file's name and line. Each file is only included once. If nil,
+	// @include is a parse error; an empty (non-nil) slice means file
+	// names are used as is, relative to the current directory.
+	IncludePath []string
+
+	// Function to load the extension named by an @load "name"
+	// directive, returning the native Go functions it provides (in
+	// the same form as Funcs). The program can call these like the
+	// functions in Funcs, and Program.LoadedFuncs records them for
+	// the interpreter. If nil, @load is a parse error.
+	Load func(name string) (map[string]interface{}, error)
+
+	// io.Writer to print warnings on (for example, os.Stderr), such
+	// as for code the compiler eliminated because it can never run.
+	// If nil, warnings aren't printed.
+	WarningWriter io.Writer
+
+	// Compile the program so that it counts how many times each
+	// statement and pattern runs, for use with interp.Coverage. This
+	// makes the program run a bit slower.
+	Coverage bool
+
+	// Don't inline calls to small user-defined functions. Inlined
+	// calls aren't counted or timed by interp.Profile, so set this
+	// when profiling a program.
+	NoInline bool
+
+	// If greater than 1, the parser recovers from syntax errors at
+	// the next statement (or top-level item) and returns up to this
+	// many errors as an ErrorList, instead of stopping at the first
+	// one.
+	MaxErrors int
+
+	// Enable strict mode, where it's an error to use a global
+	// variable that's never assigned in the program, to catch typos
+	// like "totl" for "total". Special variables like NR, and
+	// variables named in Assigned, don't need to be assigned. A
+	// program can also enable strict mode with a "# goawk:strict"
+	// comment line.
+	Strict bool
+
+	// Names of variables assigned outside the program, like with
+	// "-v name=value" on the command line (only used in strict mode).
+	Assigned []string
+
+	// Only allow POSIX AWK, so that a program that parses will also
+	// run under other AWKs: it's an error to use a GoAWK extension,
+	// like a single-quoted string, the ** operator, an extension
+	// function like strftime, a native Go function (from Funcs), or
+	// the special variable RT.
+	POSIX bool
+
+	// Accept hexadecimal (0x1A) and octal (0o17) number literals.
+	// Without this, 0x1A is 0 concatenated with the variable x1A, as
+	// in other AWKs. See interp.ParseNonDecimal for input data.
+	NonDecimal bool
+
+	// The files the source was concatenated from, in order, for
+	// example with several -f options on the command line. If set,
+	// errors report the file and the line within it, and
+	// Program.FileLine maps the line of a position in the program
+	// (such as an interp.Error's) to its file and line.
+	Files []File
+}
+
+// File describes one of the files a program's source was concatenated
+// from (see ParserConfig.Files).
+type File struct {
+	// Name to show in errors, for example "prog.awk" or "<stdin>".
+	Name string
+	// Number of lines the file takes up in the source. If the file
+	// doesn't end with a newline, one must be added when it's
+	// concatenated with the next file.
+	Lines int
+	// Line of the file these lines start at, if they're only part of
+	// it (0 means 1). Expanding @include directives splits the file
+	// that includes another one into the parts before and after.
+	StartLine int
+}
+
+func (f File) startLine() int {
+	if f.StartLine > 0 {
+		return f.StartLine
+	}
+	return 1
 }
 
 // ParseProgram parses an entire AWK program, returning the *Program
 // abstract syntax tree or a *ParseError on error. "config" describes
 // the parser configuration (and is allowed to be nil).
 func ParseProgram(src []byte, config *ParserConfig) (prog *Program, err error) {
+	lexer := NewLexer(src)
+	lexer.KeepComments()
+	p := parser{lexer: lexer}
+	if config != nil {
+		p.debugTypes = config.DebugTypes
+		p.debugWriter = config.DebugWriter
+		p.nativeFuncs = config.Funcs
+		p.loader = config.Load
+		p.maxErrors = config.MaxErrors
+		p.strict = config.Strict
+		p.assigned = config.Assigned
+		p.posix = config.POSIX
+		if p.posix {
+			lexer.POSIX()
+		}
+		if config.NonDecimal {
+			lexer.NonDecimal()
+		}
+	}
 	defer func() {
 		// The parser uses panic with a *ParseError to signal parsing
 		// errors internally, and they're caught here. This
@@ -57,33 +191,118 @@ func ParseProgram(src []byte, config *ParserConfig) (prog *Program, err error) {
 		// we don't have to check errors everywhere.
 		if r := recover(); r != nil {
 			// Convert to ParseError or re-panic
-			err = r.(*ParseError)
+			switch r := r.(type) {
+			case ErrorList:
+				err = r
+			default:
+				if p.maxErrors > 1 {
+					err = append(p.errors, r.(*ParseError))
+				} else {
+					err = r.(*ParseError)
+				}
+			}
+			prog = nil
+			if config != nil && len(config.Files) > 0 {
+				err = fileErrors(err, config.Files)
+			}
 		}
 	}()
-	lexer := NewLexer(src)
-	p := parser{lexer: lexer}
-	if config != nil {
-		p.debugTypes = config.DebugTypes
-		p.debugWriter = config.DebugWriter
-		p.nativeFuncs = config.Funcs
+	if config != nil && config.IncludePath != nil && bytes.Contains(src, []byte("@include")) {
+		var files []File
+		src, files, err = ExpandIncludes(src, config.Files, config.IncludePath)
+		if err != nil {
+			return nil, err
+		}
+		// Parse the expanded source, with errors reported in the files
+		// its lines came from
+		configCopy := *config
+		configCopy.Files = files
+		config = &configCopy
+		lexer = NewLexer(src)
+		lexer.KeepComments()
+		p.lexer = lexer
+		if p.posix {
+			lexer.POSIX()
+		}
+		if config.NonDecimal {
+			lexer.NonDecimal()
+		}
 	}
+	p.funcNames = scanFuncNames(src)
 	p.initResolve()
 	p.next() // initialize p.tok
 
 	// Parse into abstract syntax tree
 	prog = p.program()
+	if len(p.errors) > 0 {
+		if len(config.Files) > 0 { // p.errors is only set if config != nil
+			return nil, fileErrors(p.errors, config.Files)
+		}
+		return nil, p.errors
+	}
+	if config != nil {
+		prog.files = config.Files
+	}
 
 	// Compile to virtual machine code
-	prog.Compiled, err = compiler.Compile(prog.toAST())
+	var options compiler.Options
+	if config != nil {
+		options.Coverage = config.Coverage
+		options.NoInline = config.NoInline
+	}
+	prog.Compiled, err = compiler.Compile(prog.AST(), options)
+	if err == nil && config != nil && config.WarningWriter != nil {
+		for _, warning := range prog.Compiled.Warnings {
+			fmt.Fprintf(config.WarningWriter, "warning: %s\n", warning)
+		}
+	}
 	return prog, err
 }
 
+// Assemble reads virtual machine instructions in the text format written
+// by Program.Disassemble and returns a *Program the interpreter can run.
+// The program has no syntax tree, so String returns an empty program,
+// and it has no source positions. "config" is only used for its Funcs,
+// the native functions the instructions may call (it's allowed to be
+// nil). The instructions are checked with Verify before they're
+// returned, so that a bad program can't crash the interpreter.
+func Assemble(src io.Reader, config *ParserConfig) (*Program, error) {
+	var nativeNames []string
+	if config != nil {
+		for name := range config.Funcs {
+			nativeNames = append(nativeNames, name)
+		}
+		sort.Strings(nativeNames)
+	}
+	compiled, err := compiler.Assemble(src, nativeNames)
+	if err != nil {
+		return nil, err
+	}
+	err = compiled.Verify()
+	if err != nil {
+		return nil, err
+	}
+	prog := &Program{
+		Scalars:  make(map[string]int),
+		Arrays:   make(map[string]int),
+		Compiled: compiled,
+	}
+	scalars, arrays := compiled.GlobalNames()
+	for i, name := range scalars {
+		prog.Scalars[name] = i
+	}
+	for i, name := range arrays {
+		prog.Arrays[name] = i
+	}
+	return prog, nil
+}
+
 // Program is the parsed and compiled representation of an entire AWK program.
 type Program struct {
-	// These fields aren't intended to be used or modified directly,
-	// but are exported for the interpreter (Program itself needs to
-	// be exported in package "parser", otherwise these could live in
-	// "internal/ast".)
+	// The parsed program. These can be traversed with the ast
+	// package's Walk and Inspect, but modifying them doesn't change
+	// the code in Compiled, which is what the interpreter runs. To
+	// run a transformed program, parse the String of its AST.
 	Begin     []ast.Stmts
 	Actions   []ast.Action
 	End       []ast.Stmts
@@ -91,12 +310,30 @@ type Program struct {
 	Scalars   map[string]int
 	Arrays    map[string]int
 	Compiled  *compiler.Program
+
+	// Names of the extensions loaded by the program's @load
+	// directives, in order, and the native functions they provide.
+	// The interpreter adds LoadedFuncs to interp.Config.Funcs.
+	Loads         []string
+	LoadedFuncs   map[string]interface{}
+	loadPositions []Position
+
+	stmtPositions    map[ast.Stmt]Position
+	patternPositions map[ast.Expr]Position
+	exprPositions    map[ast.Expr]Position
+	itemPositions    [4][]Position // BEGIN blocks, actions, END blocks, functions
+
+	comments     []ast.Comment
+	stmtComments map[ast.Stmt]*ast.Comments
+	itemComments [4][]*ast.Comments
+
+	files []File
 }
 
 // String returns an indented, pretty-printed version of the parsed
 // program.
 func (p *Program) String() string {
-	return p.toAST().String()
+	return p.AST().String()
 }
 
 // Disassemble writes a human-readable form of the program's virtual machine
@@ -105,8 +342,24 @@ func (p *Program) Disassemble(writer io.Writer) error {
 	return p.Compiled.Disassemble(writer)
 }
 
-// toAST converts the *Program to an *ast.Program.
-func (p *Program) toAST() *ast.Program {
+// DisassembleSource is like Disassemble, but writes each line of the
+// program's source above the instructions compiled from it. src must
+// be the source the program was parsed from.
+func (p *Program) DisassembleSource(writer io.Writer, src []byte) error {
+	return p.Compiled.DisassembleSource(writer, src)
+}
+
+// DisassembleJSON writes the program's virtual machine instructions to
+// writer as JSON Lines, one object per instruction, including the
+// source line and column each came from. See
+// compiler.Program.DisassembleJSON for the fields.
+func (p *Program) DisassembleJSON(writer io.Writer) error {
+	return p.Compiled.DisassembleJSON(writer)
+}
+
+// AST returns the program's abstract syntax tree as an *ast.Program,
+// which shares the program's statements and expressions.
+func (p *Program) AST() *ast.Program {
 	return &ast.Program{
 		Begin:     p.Begin,
 		Actions:   p.Actions,
@@ -114,7 +367,82 @@ func (p *Program) toAST() *ast.Program {
 		Functions: p.Functions,
 		Scalars:   p.Scalars,
 		Arrays:    p.Arrays,
+		Loads:     p.Loads,
+
+		StmtPositions:    p.stmtPositions,
+		PatternPositions: p.patternPositions,
+		ExprPositions:    p.exprPositions,
+
+		BeginPositions:    p.itemPositions[0],
+		ActionPositions:   p.itemPositions[1],
+		EndPositions:      p.itemPositions[2],
+		FunctionPositions: p.itemPositions[3],
+		LoadPositions:     p.loadPositions,
+
+		Comments:         p.comments,
+		StmtComments:     p.stmtComments,
+		BeginComments:    p.itemComments[0],
+		ActionComments:   p.itemComments[1],
+		EndComments:      p.itemComments[2],
+		FunctionComments: p.itemComments[3],
+	}
+}
+
+// FileLine returns the name of the file that the given source line
+// came from, and the line number within that file, using the
+// ParserConfig.Files the program was parsed with. If Files wasn't set,
+// it returns "" and the line unchanged.
+func (p *Program) FileLine(line int) (string, int) {
+	return fileLine(p.files, line)
+}
+
+func fileLine(files []File, line int) (string, int) {
+	start := 1
+	for _, f := range files {
+		if line >= start && line < start+f.Lines {
+			return f.Name, line - start + f.startLine()
+		}
+		start += f.Lines
+	}
+	if len(files) > 0 {
+		// Past the end, like an "unexpected EOF" error
+		last := files[len(files)-1]
+		return last.Name, line - start + last.Lines + last.startLine()
+	}
+	return "", line
+}
+
+// Convert the line numbers in err, a *ParseError or ErrorList, to
+// lines within the files the source was concatenated from.
+func fileErrors(err error, files []File) error {
+	toFile := func(e *ParseError) {
+		e.Filename, e.Position.Line = fileLine(files, e.Position.Line)
+	}
+	switch err := err.(type) {
+	case *ParseError:
+		toFile(err)
+	case ErrorList:
+		for _, e := range err {
+			toFile(e)
+		}
+	}
+	return err
+}
+
+// Position returns the source position of node, a statement or
+// expression in the program (for example prog.Begin[0][1]), and
+// whether it's known. The position of an expression is where it
+// starts.
+func (p *Program) Position(node interface{}) (Position, bool) {
+	var pos Position
+	var ok bool
+	switch node := node.(type) {
+	case ast.Stmt:
+		pos, ok = p.stmtPositions[node]
+	case ast.Expr:
+		pos, ok = p.exprPositions[node]
 	}
+	return pos, ok
 }
 
 // Parser state
@@ -125,6 +453,7 @@ type parser struct {
 	tok     Token    // last lexed token
 	prevTok Token    // previously lexed token
 	val     string   // string value of last token (or "")
+	endPos  Position // position of the last token parsed, other than a newline
 
 	// Parsing state
 	inAction  bool   // true if parsing an action (false in BEGIN or END)
@@ -138,61 +467,213 @@ type parser struct {
 	arrayRefs  []arrayRef                     // all array references
 	multiExprs map[*ast.MultiExpr]Position    // tracks comma-separated expressions
 
+	// Source positions of statements, patterns, and expressions (see
+	// ast.Program)
+	stmtPositions    map[ast.Stmt]Position
+	patternPositions map[ast.Expr]Position
+	exprPositions    map[ast.Expr]Position
+
+	// Comments (see ast.Program), ones lexed but not yet attached to a
+	// node, and ones in the last empty block parsed
+	comments        []ast.Comment
+	stmtComments    map[ast.Stmt]*ast.Comments
+	pendingComments []ast.Comment
+	innerComments   []ast.Comment
+
 	// Function tracking
 	functions   map[string]int // map of function name to index
 	userCalls   []userCall     // record calls so we can resolve them later
 	nativeFuncs map[string]interface{}
+	loader      func(name string) (map[string]interface{}, error)
+	funcNames   map[string]bool // names of all user-defined functions (pre-scanned)
 
 	// Configuration and debugging
 	debugTypes  bool      // show variable types for debugging
 	debugWriter io.Writer // where the debug output goes
+
+	// Syntax errors so far, if recovering from them
+	maxErrors int
+	errors    ErrorList
+
+	// Strict mode and POSIX mode (see ParserConfig)
+	strict   bool
+	assigned []string
+	posix    bool
 }
 
 // Parse an entire AWK program.
 func (p *parser) program() *Program {
 	prog := &Program{}
+	p.stmtPositions = make(map[ast.Stmt]Position)
+	p.patternPositions = make(map[ast.Expr]Position)
+	p.exprPositions = make(map[ast.Expr]Position)
+	prog.stmtPositions = p.stmtPositions
+	prog.patternPositions = p.patternPositions
+	prog.exprPositions = p.exprPositions
+	p.stmtComments = make(map[ast.Stmt]*ast.Comments)
+	prog.stmtComments = p.stmtComments
 	p.optionalNewlines()
+	lastKind := -1 // kind of the last item (index into itemComments)
 	for p.tok != EOF {
-		switch p.tok {
-		case BEGIN:
-			p.next()
-			prog.Begin = append(prog.Begin, p.stmtsBrace())
-		case END:
-			p.next()
-			prog.End = append(prog.End, p.stmtsBrace())
-		case FUNCTION:
-			function := p.function()
-			p.addFunction(function.Name, len(prog.Functions))
-			prog.Functions = append(prog.Functions, function)
-		default:
-			p.inAction = true
-			// Allow empty pattern, normal pattern, or range pattern
-			pattern := []ast.Expr{}
-			if !p.matches(LBRACE, EOF) {
-				pattern = append(pattern, p.expr())
-			}
-			if !p.matches(LBRACE, EOF, NEWLINE) {
-				p.commaNewlines()
-				pattern = append(pattern, p.expr())
-			}
-			// Or an empty action (equivalent to { print $0 })
-			action := ast.Action{pattern, nil}
-			if p.tok == LBRACE {
-				action.Stmts = p.stmtsBrace()
-			}
-			prog.Actions = append(prog.Actions, action)
-			p.inAction = false
+		if kind := p.item(prog); kind >= 0 {
+			lastKind = kind
 		}
 		p.optionalNewlines()
 	}
+	if len(p.pendingComments) > 0 && lastKind >= 0 {
+		// Comments at the end of the program
+		comments := prog.itemComments[lastKind]
+		last := &comments[len(comments)-1]
+		if *last == nil {
+			*last = &ast.Comments{}
+		}
+		(*last).After = p.takeComments()
+	}
+	prog.comments = p.comments
 
+	if len(p.errors) > 0 {
+		// Don't resolve a program with syntax errors
+		return prog
+	}
 	p.resolveUserCalls(prog)
 	p.resolveVars(prog)
 	p.checkMultiExprs()
+	if p.strict || p.hasStrictPragma() {
+		p.checkStrict(prog)
+	}
 
 	return prog
 }
 
+// Parse a top-level item (BEGIN or END block, pattern-action, or
+// function) and add it to prog, returning its kind (the index into
+// itemPositions). When reporting multiple errors, a syntax error in it
+// is recorded, the rest of the item is skipped, and it returns -1.
+func (p *parser) item(prog *Program) (kind int) {
+	if p.maxErrors > 1 {
+		defer func() {
+			if r := recover(); r != nil {
+				p.recordError(r)
+				p.inAction = false
+				p.funcName = ""
+				p.locals = nil
+				p.loopDepth = 0
+				p.skip(false)
+				kind = -1
+			}
+		}()
+	}
+	if p.tok == LOAD {
+		// Any comments before it are left for the next item
+		p.load(prog)
+		return -1
+	}
+	if p.tok == INCLUDE {
+		// Directives are expanded before parsing, unless it's disabled
+		p.next()
+		if p.tok != STRING {
+			panic(p.errorf("expected file name string after @include"))
+		}
+		panic(p.errorf("can't include %q: including files isn't enabled", p.val))
+	}
+	pos := p.pos
+	leading := p.takeComments()
+	kind = 1
+	switch p.tok {
+	case BEGIN:
+		p.next()
+		prog.Begin = append(prog.Begin, p.stmtsBrace())
+		kind = 0
+	case END:
+		p.next()
+		prog.End = append(prog.End, p.stmtsBrace())
+		kind = 2
+	case FUNCTION:
+		function := p.function()
+		p.addFunction(function.Name, len(prog.Functions))
+		prog.Functions = append(prog.Functions, function)
+		kind = 3
+	default:
+		p.inAction = true
+		// Allow empty pattern, normal pattern, or range pattern
+		pattern := []ast.Expr{}
+		if !p.matches(LBRACE, EOF) {
+			pattern = append(pattern, p.pattern())
+		}
+		if !p.matches(LBRACE, EOF, NEWLINE) {
+			p.commaNewlines()
+			pattern = append(pattern, p.pattern())
+		}
+		// Or an empty action (equivalent to { print $0 })
+		action := ast.Action{Pattern: pattern}
+		if p.tok == LBRACE {
+			action.Stmts = p.stmtsBrace()
+		}
+		prog.Actions = append(prog.Actions, action)
+		p.inAction = false
+	}
+	prog.itemPositions[kind] = append(prog.itemPositions[kind], pos)
+	prog.itemComments[kind] = append(prog.itemComments[kind], p.nodeComments(leading))
+	return kind
+}
+
+// Parse an @load "name" directive, adding the native functions the
+// extension provides (from ParserConfig.Load) to the ones the program
+// can call. Loading the same extension again does nothing.
+func (p *parser) load(prog *Program) {
+	pos := p.pos
+	p.next()
+	if p.tok != STRING {
+		panic(p.errorf("expected extension name string after @load"))
+	}
+	name := p.val
+	p.next()
+	if !p.matches(NEWLINE, SEMICOLON, EOF) {
+		panic(p.errorf("expected newline after @load %q", name))
+	}
+	if p.tok == SEMICOLON {
+		p.next()
+	}
+	for _, loaded := range prog.Loads {
+		if loaded == name {
+			return
+		}
+	}
+	if p.loader == nil {
+		panic(p.posErrorf(pos, "can't load %q: loading extensions isn't enabled", name))
+	}
+	funcs, err := p.loader(name)
+	if err != nil {
+		panic(p.posErrorf(pos, "can't load %q: %v", name, err))
+	}
+	if prog.LoadedFuncs == nil {
+		// Copy the native functions so the config's map isn't changed
+		prog.LoadedFuncs = make(map[string]interface{})
+		nativeFuncs := make(map[string]interface{}, len(p.nativeFuncs)+len(funcs))
+		for funcName, f := range p.nativeFuncs {
+			nativeFuncs[funcName] = f
+		}
+		p.nativeFuncs = nativeFuncs
+	}
+	for funcName, f := range funcs {
+		if _, ok := p.nativeFuncs[funcName]; ok {
+			panic(p.posErrorf(pos, "can't load %q: native function %q already defined", name, funcName))
+		}
+		p.nativeFuncs[funcName] = f
+		prog.LoadedFuncs[funcName] = f
+	}
+	prog.Loads = append(prog.Loads, name)
+	prog.loadPositions = append(prog.loadPositions, pos)
+}
+
+// Parse a pattern expression, recording its position.
+func (p *parser) pattern() ast.Expr {
+	pos := p.pos
+	expr := p.expr()
+	p.patternPositions[expr] = pos
+	return expr
+}
+
 // Parse a list of statements.
 func (p *parser) stmts() ast.Stmts {
 	switch p.tok {
@@ -216,6 +697,17 @@ func (p *parser) stmtsBrace() ast.Stmts {
 	for p.tok != RBRACE && p.tok != EOF {
 		ss = append(ss, p.stmt())
 	}
+	if comments := p.takeComments(); len(comments) > 0 {
+		if len(ss) == 0 {
+			p.innerComments = append(p.innerComments, comments...)
+		} else {
+			last := ss[len(ss)-1]
+			if p.stmtComments[last] == nil {
+				p.stmtComments[last] = &ast.Comments{}
+			}
+			p.stmtComments[last].After = comments
+		}
+	}
 	p.expect(RBRACE)
 	if p.tok == SEMICOLON {
 		p.next()
@@ -245,12 +737,12 @@ func (p *parser) simpleStmt() ast.Stmt {
 			dest = p.expr()
 		}
 		if op == PRINT {
-			return &ast.PrintStmt{args, redirect, dest}
+			return &ast.PrintStmt{Args: args, Redirect: redirect, Dest: dest}
 		} else {
 			if len(args) == 0 {
 				panic(p.errorf("expected printf args, got none"))
 			}
-			return &ast.PrintfStmt{args, redirect, dest}
+			return &ast.PrintfStmt{Args: args, Redirect: redirect, Dest: dest}
 		}
 	case DELETE:
 		p.next()
@@ -265,19 +757,93 @@ func (p *parser) simpleStmt() ast.Stmt {
 			}
 			p.expect(RBRACKET)
 		}
-		return &ast.DeleteStmt{ref, index}
+		return &ast.DeleteStmt{Array: ref, Index: index}
 	case IF, FOR, WHILE, DO, BREAK, CONTINUE, NEXT, EXIT, RETURN:
 		panic(p.errorf("expected print/printf, delete, or expression"))
 	default:
-		return &ast.ExprStmt{p.expr()}
+		return &ast.ExprStmt{Expr: p.expr()}
+	}
+}
+
+// Parse any top-level statement. When reporting multiple errors, a
+// syntax error in it is recorded and the rest of it is skipped.
+func (p *parser) stmt() (s ast.Stmt) {
+	if p.maxErrors > 1 {
+		loopDepth := p.loopDepth
+		defer func() {
+			if r := recover(); r != nil {
+				p.recordError(r)
+				p.loopDepth = loopDepth
+				p.skip(true)
+				s = &ast.BlockStmt{} // placeholder, it won't be compiled
+			}
+		}()
+	}
+	return p._stmt()
+}
+
+// Record the syntax error r recovered from a panic (re-panicking if
+// it's not a *ParseError, or if that's as many as we report).
+func (p *parser) recordError(r interface{}) {
+	err, ok := r.(*ParseError)
+	if !ok {
+		panic(r)
+	}
+	if n := len(p.errors); n > 0 && p.errors[n-1].Position == err.Position {
+		// Only report the first error at a given position, such as
+		// several at EOF after an unclosed statement
+		return
+	}
+	p.errors = append(p.errors, err)
+	if len(p.errors) >= p.maxErrors {
+		panic(p.errors)
+	}
+}
+
+// Skip tokens after a syntax error, to the end of the line or (if
+// inStmt is true) statement, not counting ones in nested braces. The
+// end of a statement is after its semicolons or newlines, or before
+// the right brace of the block it's in.
+func (p *parser) skip(inStmt bool) {
+	depth := 0
+	for p.tok != EOF {
+		switch p.tok {
+		case LBRACE:
+			depth++
+		case RBRACE:
+			if depth == 0 && inStmt {
+				return
+			}
+			depth--
+		case NEWLINE, SEMICOLON:
+			if depth <= 0 && (inStmt || p.tok == NEWLINE) {
+				for p.matches(NEWLINE, SEMICOLON) {
+					p.skipToken()
+				}
+				return
+			}
+		}
+		p.skipToken()
+	}
+}
+
+// Scan the next token, ignoring lexer errors while skipping.
+func (p *parser) skipToken() {
+	p.prevTok = p.tok
+	p.pos, p.tok, p.val = p.lexer.Scan()
+	for p.tok == COMMENT || p.tok == ILLEGAL {
+		p.pos, p.tok, p.val = p.lexer.Scan()
 	}
 }
 
-// Parse any top-level statement.
-func (p *parser) stmt() ast.Stmt {
+func (p *parser) _stmt() ast.Stmt {
 	for p.matches(SEMICOLON, NEWLINE) {
 		p.next()
 	}
+	pos := p.pos
+	leading := p.takeComments()
+	outerInner := p.innerComments
+	p.innerComments = nil
 	var s ast.Stmt
 	switch p.tok {
 	case IF:
@@ -294,7 +860,7 @@ func (p *parser) stmt() ast.Stmt {
 			p.optionalNewlines()
 			elseBody = p.stmts()
 		}
-		s = &ast.IfStmt{cond, body, elseBody}
+		s = &ast.IfStmt{Cond: cond, Body: body, Else: elseBody}
 	case FOR:
 		// Parse for statement, either "for in" or C-like for loop.
 		//
@@ -329,7 +895,7 @@ func (p *parser) stmt() ast.Stmt {
 				panic(p.errorf("expected 'for (var in array) ...'"))
 			}
 			body := p.loopStmts()
-			s = &ast.ForInStmt{varExpr, inExpr.Array, body}
+			s = &ast.ForInStmt{Var: varExpr, Array: inExpr.Array, Body: body}
 		} else {
 			// Match: for ([pre]; [cond]; [post]) body
 			p.expect(SEMICOLON)
@@ -347,7 +913,7 @@ func (p *parser) stmt() ast.Stmt {
 			p.expect(RPAREN)
 			p.optionalNewlines()
 			body := p.loopStmts()
-			s = &ast.ForStmt{pre, cond, post, body}
+			s = &ast.ForStmt{Pre: pre, Cond: cond, Post: post, Body: body}
 		}
 	case WHILE:
 		p.next()
@@ -356,7 +922,7 @@ func (p *parser) stmt() ast.Stmt {
 		p.expect(RPAREN)
 		p.optionalNewlines()
 		body := p.loopStmts()
-		s = &ast.WhileStmt{cond, body}
+		s = &ast.WhileStmt{Cond: cond, Body: body}
 	case DO:
 		p.next()
 		p.optionalNewlines()
@@ -365,7 +931,7 @@ func (p *parser) stmt() ast.Stmt {
 		p.expect(LPAREN)
 		cond := p.expr()
 		p.expect(RPAREN)
-		s = &ast.DoWhileStmt{body, cond}
+		s = &ast.DoWhileStmt{Body: body, Cond: cond}
 	case BREAK:
 		if p.loopDepth == 0 {
 			panic(p.errorf("break must be inside a loop body"))
@@ -390,7 +956,7 @@ func (p *parser) stmt() ast.Stmt {
 		if !p.matches(NEWLINE, SEMICOLON, RBRACE) {
 			status = p.expr()
 		}
-		s = &ast.ExitStmt{status}
+		s = &ast.ExitStmt{Status: status}
 	case RETURN:
 		if p.funcName == "" {
 			panic(p.errorf("return must be inside a function"))
@@ -400,10 +966,10 @@ func (p *parser) stmt() ast.Stmt {
 		if !p.matches(NEWLINE, SEMICOLON, RBRACE) {
 			value = p.expr()
 		}
-		s = &ast.ReturnStmt{value}
+		s = &ast.ReturnStmt{Value: value}
 	case LBRACE:
 		body := p.stmtsBrace()
-		s = &ast.BlockStmt{body}
+		s = &ast.BlockStmt{Body: body}
 	default:
 		s = p.simpleStmt()
 	}
@@ -415,6 +981,11 @@ func (p *parser) stmt() ast.Stmt {
 	for p.matches(NEWLINE, SEMICOLON) {
 		p.next()
 	}
+	p.stmtPositions[s] = pos
+	if comments := p.nodeComments(leading); comments != nil {
+		p.stmtComments[s] = comments
+	}
+	p.innerComments = outerInner
 	return s
 }
 
@@ -471,7 +1042,7 @@ func (p *parser) function() ast.Function {
 	p.stopFunction()
 	p.locals = nil
 
-	return ast.Function{name, params, nil, body}
+	return ast.Function{Name: name, Params: params, Body: body}
 }
 
 // Parse expressions separated by commas: args to print[f] or user
@@ -502,27 +1073,27 @@ func (p *parser) printExpr() ast.Expr { return p._assign(p.printCond) }
 
 // Parse an "expr | getline [lvalue]" expression:
 //
-//     assign [PIPE GETLINE [lvalue]]
-//
+//	assign [PIPE GETLINE [lvalue]]
 func (p *parser) getLine() ast.Expr {
+	pos := p.pos
 	expr := p._assign(p.cond)
 	if p.tok == PIPE {
 		p.next()
 		p.expect(GETLINE)
 		target := p.optionalLValue()
-		return &ast.GetlineExpr{expr, target, nil}
+		return p.exprAt(&ast.GetlineExpr{Command: expr, Target: target}, pos)
 	}
 	return expr
 }
 
 // Parse an = assignment expression:
 //
-//     lvalue [assign_op assign]
+//	lvalue [assign_op assign]
 //
 // An lvalue is a variable name, an array[expr] index expression, or
 // an $expr field expression.
-//
 func (p *parser) _assign(higher func() ast.Expr) ast.Expr {
+	pos := p.pos
 	expr := higher()
 	if ast.IsLValue(expr) && p.matches(ASSIGN, ADD_ASSIGN, DIV_ASSIGN,
 		MOD_ASSIGN, MUL_ASSIGN, POW_ASSIGN, SUB_ASSIGN) {
@@ -531,7 +1102,7 @@ func (p *parser) _assign(higher func() ast.Expr) ast.Expr {
 		right := p._assign(higher)
 		switch op {
 		case ASSIGN:
-			return &ast.AssignExpr{expr, right}
+			return p.exprAt(&ast.AssignExpr{Left: expr, Right: right}, pos)
 		case ADD_ASSIGN:
 			op = ADD
 		case DIV_ASSIGN:
@@ -545,19 +1116,19 @@ func (p *parser) _assign(higher func() ast.Expr) ast.Expr {
 		case SUB_ASSIGN:
 			op = SUB
 		}
-		return &ast.AugAssignExpr{expr, op, right}
+		return p.exprAt(&ast.AugAssignExpr{Left: expr, Op: op, Right: right}, pos)
 	}
 	return expr
 }
 
 // Parse a ?: conditional expression:
 //
-//     or [QUESTION NEWLINE* cond COLON NEWLINE* cond]
-//
+//	or [QUESTION NEWLINE* cond COLON NEWLINE* cond]
 func (p *parser) cond() ast.Expr      { return p._cond(p.or) }
 func (p *parser) printCond() ast.Expr { return p._cond(p.printOr) }
 
 func (p *parser) _cond(higher func() ast.Expr) ast.Expr {
+	pos := p.pos
 	expr := higher()
 	if p.tok == QUESTION {
 		p.next()
@@ -566,85 +1137,84 @@ func (p *parser) _cond(higher func() ast.Expr) ast.Expr {
 		p.expect(COLON)
 		p.optionalNewlines()
 		f := p.expr()
-		return &ast.CondExpr{expr, t, f}
+		return p.exprAt(&ast.CondExpr{Cond: expr, True: t, False: f}, pos)
 	}
 	return expr
 }
 
 // Parse an || or expression:
 //
-//     and [OR NEWLINE* and] [OR NEWLINE* and] ...
-//
+//	and [OR NEWLINE* and] [OR NEWLINE* and] ...
 func (p *parser) or() ast.Expr      { return p.binaryLeft(p.and, true, OR) }
 func (p *parser) printOr() ast.Expr { return p.binaryLeft(p.printAnd, true, OR) }
 
 // Parse an && and expression:
 //
-//     in [AND NEWLINE* in] [AND NEWLINE* in] ...
-//
+//	in [AND NEWLINE* in] [AND NEWLINE* in] ...
 func (p *parser) and() ast.Expr      { return p.binaryLeft(p.in, true, AND) }
 func (p *parser) printAnd() ast.Expr { return p.binaryLeft(p.printIn, true, AND) }
 
 // Parse an "in" expression:
 //
-//     match [IN NAME] [IN NAME] ...
-//
+//	match [IN NAME] [IN NAME] ...
 func (p *parser) in() ast.Expr      { return p._in(p.match) }
 func (p *parser) printIn() ast.Expr { return p._in(p.printMatch) }
 
 func (p *parser) _in(higher func() ast.Expr) ast.Expr {
+	pos := p.pos
 	expr := higher()
 	for p.tok == IN {
 		p.next()
 		ref := p.arrayRef(p.val, p.pos)
 		p.expect(NAME)
-		expr = &ast.InExpr{[]ast.Expr{expr}, ref}
+		expr = p.exprAt(&ast.InExpr{Index: []ast.Expr{expr}, Array: ref}, pos)
 	}
 	return expr
 }
 
 // Parse a ~ match expression:
 //
-//     compare [MATCH|NOT_MATCH compare]
-//
+//	compare [MATCH|NOT_MATCH compare]
 func (p *parser) match() ast.Expr      { return p._match(p.compare) }
 func (p *parser) printMatch() ast.Expr { return p._match(p.printCompare) }
 
 func (p *parser) _match(higher func() ast.Expr) ast.Expr {
+	pos := p.pos
 	expr := higher()
 	if p.matches(MATCH, NOT_MATCH) {
 		op := p.tok
 		p.next()
 		right := p.regexStr(higher) // Not match() as these aren't associative
-		return &ast.BinaryExpr{expr, op, right}
+		return p.exprAt(&ast.BinaryExpr{Left: expr, Op: op, Right: right}, pos)
 	}
 	return expr
 }
 
 // Parse a comparison expression:
 //
-//     concat [EQUALS|NOT_EQUALS|LESS|LTE|GREATER|GTE concat]
-//
+//	concat [EQUALS|NOT_EQUALS|LESS|LTE|GREATER|GTE concat]
 func (p *parser) compare() ast.Expr      { return p._compare(EQUALS, NOT_EQUALS, LESS, LTE, GTE, GREATER) }
 func (p *parser) printCompare() ast.Expr { return p._compare(EQUALS, NOT_EQUALS, LESS, LTE, GTE) }
 
 func (p *parser) _compare(ops ...Token) ast.Expr {
+	pos := p.pos
 	expr := p.concat()
 	if p.matches(ops...) {
 		op := p.tok
 		p.next()
 		right := p.concat() // Not compare() as these aren't associative
-		return &ast.BinaryExpr{expr, op, right}
+		return p.exprAt(&ast.BinaryExpr{Left: expr, Op: op, Right: right}, pos)
 	}
 	return expr
 }
 
 func (p *parser) concat() ast.Expr {
+	pos := p.pos
 	expr := p.add()
 	for p.matches(DOLLAR, NOT, NAME, NUMBER, STRING, LPAREN, INCR, DECR) ||
 		(p.tok >= FIRST_FUNC && p.tok <= LAST_FUNC) {
 		right := p.add()
-		expr = &ast.BinaryExpr{expr, CONCAT, right}
+		expr = p.exprAt(&ast.BinaryExpr{Left: expr, Op: CONCAT, Right: right}, pos)
 	}
 	return expr
 }
@@ -659,17 +1229,19 @@ func (p *parser) mul() ast.Expr {
 
 func (p *parser) pow() ast.Expr {
 	// Note that pow (expr ^ expr) is right-associative
+	pos := p.pos
 	expr := p.preIncr()
 	if p.tok == POW {
 		p.next()
 		right := p.pow()
-		return &ast.BinaryExpr{expr, POW, right}
+		return p.exprAt(&ast.BinaryExpr{Left: expr, Op: POW, Right: right}, pos)
 	}
 	return expr
 }
 
 func (p *parser) preIncr() ast.Expr {
 	if p.tok == INCR || p.tok == DECR {
+		pos := p.pos
 		op := p.tok
 		p.next()
 		exprPos := p.pos
@@ -677,45 +1249,59 @@ func (p *parser) preIncr() ast.Expr {
 		if !ast.IsLValue(expr) {
 			panic(p.posErrorf(exprPos, "expected lvalue after ++ or --"))
 		}
-		return &ast.IncrExpr{expr, op, true}
+		return p.exprAt(&ast.IncrExpr{Expr: expr, Op: op, Pre: true}, pos)
 	}
 	return p.postIncr()
 }
 
 func (p *parser) postIncr() ast.Expr {
+	pos := p.pos
 	expr := p.primary()
 	if (p.tok == INCR || p.tok == DECR) && ast.IsLValue(expr) {
 		op := p.tok
 		p.next()
-		return &ast.IncrExpr{expr, op, false}
+		return p.exprAt(&ast.IncrExpr{Expr: expr, Op: op}, pos)
 	}
 	return expr
 }
 
 func (p *parser) primary() ast.Expr {
+	pos := p.pos
+	return p.exprAt(p._primary(), pos)
+}
+
+func (p *parser) _primary() ast.Expr {
 	switch p.tok {
 	case NUMBER:
-		// AWK allows forms like "1.5e", but ParseFloat doesn't
-		s := strings.TrimRight(p.val, "eE")
-		n, _ := strconv.ParseFloat(s, 64)
+		var n float64
+		if len(p.val) > 2 && p.val[0] == '0' && strings.IndexByte("xXoO", p.val[1]) >= 0 {
+			// Hexadecimal or octal, like 0x1A or 0o17 (too-large
+			// values are the maximum)
+			u, _ := strconv.ParseUint(p.val, 0, 64)
+			n = float64(u)
+		} else {
+			// AWK allows forms like "1.5e", but ParseFloat doesn't
+			s := strings.TrimRight(p.val, "eE")
+			n, _ = strconv.ParseFloat(s, 64)
+		}
 		p.next()
-		return &ast.NumExpr{n}
+		return &ast.NumExpr{Value: n}
 	case STRING:
 		s := p.val
 		p.next()
-		return &ast.StrExpr{s}
+		return &ast.StrExpr{Value: s}
 	case DIV, DIV_ASSIGN:
 		// If we get to DIV or DIV_ASSIGN as a primary expression,
 		// it's actually a regex.
 		regex := p.nextRegex()
-		return &ast.RegExpr{regex}
+		return &ast.RegExpr{Regex: regex}
 	case DOLLAR:
 		p.next()
-		return &ast.FieldExpr{p.primary()}
+		return &ast.FieldExpr{Index: p.primary()}
 	case NOT, ADD, SUB:
 		op := p.tok
 		p.next()
-		return &ast.UnaryExpr{op, p.pow()}
+		return &ast.UnaryExpr{Op: op, Value: p.pow()}
 	case NAME:
 		name := p.val
 		namePos := p.pos
@@ -728,7 +1314,7 @@ func (p *parser) primary() ast.Expr {
 				panic(p.errorf("expected expression instead of ]"))
 			}
 			p.expect(RBRACKET)
-			return &ast.IndexExpr{p.arrayRef(name, namePos), index}
+			return &ast.IndexExpr{Array: p.arrayRef(name, namePos), Index: index}
 		} else if p.tok == LPAREN && !p.lexer.HadSpace() {
 			if p.locals[name] {
 				panic(p.errorf("can't call local variable %q as function", name))
@@ -736,6 +1322,12 @@ func (p *parser) primary() ast.Expr {
 			// Grammar requires no space between function name and
 			// left paren for user function calls, hence the funky
 			// lexer.HadSpace() method.
+			if op := ExtensionToken(name); op != ILLEGAL && !p.funcNames[name] && p.nativeFuncs[name] == nil {
+				if p.posix {
+					panic(p.posErrorf(namePos, "function %s isn't in POSIX AWK", name))
+				}
+				return p.extensionCall(op)
+			}
 			return p.userCall(name, namePos)
 		}
 		return p.varRef(name, namePos)
@@ -756,7 +1348,7 @@ func (p *parser) primary() ast.Expr {
 				p.next()
 				ref := p.arrayRef(p.val, p.pos)
 				p.expect(NAME)
-				return &ast.InExpr{exprs, ref}
+				return &ast.InExpr{Index: exprs, Array: ref}
 			}
 			// MultiExpr is used as a pseudo-expression for print[f] parsing.
 			return p.multiExpr(exprs, parenPos)
@@ -769,7 +1361,7 @@ func (p *parser) primary() ast.Expr {
 			p.next()
 			file = p.primary()
 		}
-		return &ast.GetlineExpr{nil, target, file}
+		return &ast.GetlineExpr{Target: target, File: file}
 	// Below is the parsing of all the builtin function calls. We
 	// could unify these but several of them have special handling
 	// (array/lvalue/regex params, optional arguments, and so on).
@@ -792,7 +1384,7 @@ func (p *parser) primary() ast.Expr {
 			args = append(args, in)
 		}
 		p.expect(RPAREN)
-		return &ast.CallExpr{op, args}
+		return &ast.CallExpr{Func: op, Args: args}
 	case F_SPLIT:
 		p.next()
 		p.expect(LPAREN)
@@ -804,22 +1396,41 @@ func (p *parser) primary() ast.Expr {
 		if p.tok == COMMA {
 			p.commaNewlines()
 			args = append(args, p.regexStr(p.expr))
+			if p.tok == COMMA {
+				if p.posix {
+					panic(p.errorf("split() seps argument isn't in POSIX AWK"))
+				}
+				p.commaNewlines()
+				seps := p.arrayRef(p.val, p.pos)
+				p.expect(NAME)
+				args = append(args, seps)
+			}
 		}
 		p.expect(RPAREN)
-		return &ast.CallExpr{F_SPLIT, args}
+		return &ast.CallExpr{Func: F_SPLIT, Args: args}
 	case F_MATCH:
 		p.next()
 		p.expect(LPAREN)
 		str := p.expr()
 		p.commaNewlines()
 		regex := p.regexStr(p.expr)
+		args := []ast.Expr{str, regex}
+		if p.tok == COMMA {
+			if p.posix {
+				panic(p.errorf("match() array argument isn't in POSIX AWK"))
+			}
+			p.commaNewlines()
+			ref := p.arrayRef(p.val, p.pos)
+			p.expect(NAME)
+			args = append(args, ref)
+		}
 		p.expect(RPAREN)
-		return &ast.CallExpr{F_MATCH, []ast.Expr{str, regex}}
+		return &ast.CallExpr{Func: F_MATCH, Args: args}
 	case F_RAND:
 		p.next()
 		p.expect(LPAREN)
 		p.expect(RPAREN)
-		return &ast.CallExpr{F_RAND, nil}
+		return &ast.CallExpr{Func: F_RAND}
 	case F_SRAND:
 		p.next()
 		p.expect(LPAREN)
@@ -828,7 +1439,7 @@ func (p *parser) primary() ast.Expr {
 			args = append(args, p.expr())
 		}
 		p.expect(RPAREN)
-		return &ast.CallExpr{F_SRAND, args}
+		return &ast.CallExpr{Func: F_SRAND, Args: args}
 	case F_LENGTH:
 		p.next()
 		var args []ast.Expr
@@ -840,7 +1451,7 @@ func (p *parser) primary() ast.Expr {
 			}
 			p.expect(RPAREN)
 		}
-		return &ast.CallExpr{F_LENGTH, args}
+		return &ast.CallExpr{Func: F_LENGTH, Args: args}
 	case F_SUBSTR:
 		p.next()
 		p.expect(LPAREN)
@@ -853,7 +1464,7 @@ func (p *parser) primary() ast.Expr {
 			args = append(args, p.expr())
 		}
 		p.expect(RPAREN)
-		return &ast.CallExpr{F_SUBSTR, args}
+		return &ast.CallExpr{Func: F_SUBSTR, Args: args}
 	case F_SPRINTF:
 		p.next()
 		p.expect(LPAREN)
@@ -863,7 +1474,7 @@ func (p *parser) primary() ast.Expr {
 			args = append(args, p.expr())
 		}
 		p.expect(RPAREN)
-		return &ast.CallExpr{F_SPRINTF, args}
+		return &ast.CallExpr{Func: F_SPRINTF, Args: args}
 	case F_FFLUSH:
 		p.next()
 		p.expect(LPAREN)
@@ -872,7 +1483,7 @@ func (p *parser) primary() ast.Expr {
 			args = append(args, p.expr())
 		}
 		p.expect(RPAREN)
-		return &ast.CallExpr{F_FFLUSH, args}
+		return &ast.CallExpr{Func: F_FFLUSH, Args: args}
 	case F_COS, F_SIN, F_EXP, F_LOG, F_SQRT, F_INT, F_TOLOWER, F_TOUPPER, F_SYSTEM, F_CLOSE:
 		// Simple 1-argument functions
 		op := p.tok
@@ -880,7 +1491,7 @@ func (p *parser) primary() ast.Expr {
 		p.expect(LPAREN)
 		arg := p.expr()
 		p.expect(RPAREN)
-		return &ast.CallExpr{op, []ast.Expr{arg}}
+		return &ast.CallExpr{Func: op, Args: []ast.Expr{arg}}
 	case F_ATAN2, F_INDEX:
 		// Simple 2-argument functions
 		op := p.tok
@@ -890,7 +1501,7 @@ func (p *parser) primary() ast.Expr {
 		p.commaNewlines()
 		arg2 := p.expr()
 		p.expect(RPAREN)
-		return &ast.CallExpr{op, []ast.Expr{arg1, arg2}}
+		return &ast.CallExpr{Func: op, Args: []ast.Expr{arg1, arg2}}
 	default:
 		panic(p.errorf("expected expression instead of %s", p.tok))
 	}
@@ -898,6 +1509,7 @@ func (p *parser) primary() ast.Expr {
 
 // Parse an optional lvalue
 func (p *parser) optionalLValue() ast.Expr {
+	pos := p.pos
 	switch p.tok {
 	case NAME:
 		if p.lexer.PeekByte() == '(' {
@@ -915,12 +1527,12 @@ func (p *parser) optionalLValue() ast.Expr {
 				panic(p.errorf("expected expression instead of ]"))
 			}
 			p.expect(RBRACKET)
-			return &ast.IndexExpr{p.arrayRef(name, namePos), index}
+			return p.exprAt(&ast.IndexExpr{Array: p.arrayRef(name, namePos), Index: index}, pos)
 		}
-		return p.varRef(name, namePos)
+		return p.exprAt(p.varRef(name, namePos), pos)
 	case DOLLAR:
 		p.next()
-		return &ast.FieldExpr{p.primary()}
+		return p.exprAt(&ast.FieldExpr{Index: p.primary()}, pos)
 	default:
 		return nil
 	}
@@ -928,12 +1540,12 @@ func (p *parser) optionalLValue() ast.Expr {
 
 // Parse /.../ regex or generic expression:
 //
-//     REGEX | expr
-//
+//	REGEX | expr
 func (p *parser) regexStr(parse func() ast.Expr) ast.Expr {
 	if p.matches(DIV, DIV_ASSIGN) {
+		pos := p.pos
 		regex := p.nextRegex()
-		return &ast.StrExpr{regex}
+		return p.exprAt(&ast.StrExpr{Value: regex}, pos)
 	}
 	return parse()
 }
@@ -941,9 +1553,9 @@ func (p *parser) regexStr(parse func() ast.Expr) ast.Expr {
 // Parse left-associative binary operator. Allow newlines after
 // operator if allowNewline is true.
 //
-//     parse [op parse] [op parse] ...
-//
+//	parse [op parse] [op parse] ...
 func (p *parser) binaryLeft(higher func() ast.Expr, allowNewline bool, ops ...Token) ast.Expr {
+	pos := p.pos
 	expr := higher()
 	for p.matches(ops...) {
 		op := p.tok
@@ -952,15 +1564,24 @@ func (p *parser) binaryLeft(higher func() ast.Expr, allowNewline bool, ops ...To
 			p.optionalNewlines()
 		}
 		right := higher()
-		expr = &ast.BinaryExpr{expr, op, right}
+		expr = p.exprAt(&ast.BinaryExpr{Left: expr, Op: op, Right: right}, pos)
+	}
+	return expr
+}
+
+// Record that expr starts at source position pos, unless it's already
+// recorded (a parenthesized expression has the position of what's
+// inside the parentheses), and return expr.
+func (p *parser) exprAt(expr ast.Expr, pos Position) ast.Expr {
+	if _, ok := p.exprPositions[expr]; !ok {
+		p.exprPositions[expr] = pos
 	}
 	return expr
 }
 
 // Parse comma followed by optional newlines:
 //
-//     COMMA NEWLINE*
-//
+//	COMMA NEWLINE*
 func (p *parser) commaNewlines() {
 	p.expect(COMMA)
 	p.optionalNewlines()
@@ -968,8 +1589,7 @@ func (p *parser) commaNewlines() {
 
 // Parse zero or more optional newlines:
 //
-//    [NEWLINE] [NEWLINE] ...
-//
+//	[NEWLINE] [NEWLINE] ...
 func (p *parser) optionalNewlines() {
 	for p.tok == NEWLINE {
 		p.next()
@@ -979,12 +1599,50 @@ func (p *parser) optionalNewlines() {
 // Parse next token into p.tok (and set p.pos and p.val).
 func (p *parser) next() {
 	p.prevTok = p.tok
+	if p.tok != NEWLINE {
+		p.endPos = p.pos
+	}
 	p.pos, p.tok, p.val = p.lexer.Scan()
+	for p.tok == COMMENT {
+		comment := ast.Comment{Position: p.pos, Text: p.val}
+		p.comments = append(p.comments, comment)
+		p.pendingComments = append(p.pendingComments, comment)
+		p.pos, p.tok, p.val = p.lexer.Scan()
+	}
 	if p.tok == ILLEGAL {
 		panic(p.errorf("%s", p.val))
 	}
 }
 
+// Return the comments lexed since the last call, and clear them.
+func (p *parser) takeComments() []ast.Comment {
+	comments := p.pendingComments
+	p.pendingComments = nil
+	return comments
+}
+
+// Return the comments for a statement or item that's just been parsed,
+// or nil if it has none. Leading comments are the ones before it, and
+// the ones lexed since are trailing if they're before the end of its
+// last line. It also picks up the comments of any empty block in it.
+func (p *parser) nodeComments(leading []ast.Comment) *ast.Comments {
+	var trailing []ast.Comment
+	n := 0
+	for n < len(p.pendingComments) && p.pendingComments[n].Position.Line <= p.endPos.Line {
+		n++
+	}
+	if n > 0 {
+		trailing = p.pendingComments[:n:n]
+		p.pendingComments = p.pendingComments[n:]
+	}
+	inner := p.innerComments
+	p.innerComments = nil
+	if leading == nil && trailing == nil && inner == nil {
+		return nil
+	}
+	return &ast.Comments{Leading: leading, Trailing: trailing, Inner: inner}
+}
+
 // Parse next regex and return it (must only be called after DIV or
 // DIV_ASSIGN token).
 func (p *parser) nextRegex() string {
@@ -1029,7 +1687,7 @@ func (p *parser) errorf(format string, args ...interface{}) error {
 // Like errorf, but with an explicit position.
 func (p *parser) posErrorf(pos Position, format string, args ...interface{}) error {
 	message := fmt.Sprintf(format, args...)
-	return &ParseError{pos, message}
+	return &ParseError{Position: pos, Message: message}
 }
 
 // Parse call to a user-defined function (and record call site for
@@ -1048,7 +1706,185 @@ func (p *parser) userCall(name string, pos Position) *ast.UserCallExpr {
 		i++
 	}
 	p.expect(RPAREN)
-	call := &ast.UserCallExpr{false, -1, name, args} // index is resolved later
+	call := &ast.UserCallExpr{Index: -1, Name: name, Args: args} // index is resolved later
 	p.recordUserCall(call, pos)
 	return call
 }
+
+// Parse call to a GoAWK extension function (p.tok is the LPAREN after
+// the function name).
+func (p *parser) extensionCall(op Token) ast.Expr {
+	switch op {
+	case F_COPY:
+		p.expect(LPAREN)
+		src := p.arrayRef(p.val, p.pos)
+		p.expect(NAME)
+		p.commaNewlines()
+		dst := p.arrayRef(p.val, p.pos)
+		p.expect(NAME)
+		p.expect(RPAREN)
+		return &ast.CallExpr{Func: op, Args: []ast.Expr{src, dst}}
+	case F_B64DECODE, F_B64ENCODE, F_ROUND:
+		p.expect(LPAREN)
+		args := []ast.Expr{p.expr()}
+		if p.tok == COMMA {
+			p.commaNewlines()
+			args = append(args, p.expr())
+		}
+		p.expect(RPAREN)
+		return &ast.CallExpr{Func: op, Args: args}
+	case F_MAX, F_MIN:
+		p.expect(LPAREN)
+		args := []ast.Expr{p.expr()}
+		for p.tok == COMMA {
+			p.commaNewlines()
+			args = append(args, p.expr())
+		}
+		p.expect(RPAREN)
+		return &ast.CallExpr{Func: op, Args: args}
+	case F_SQL_EXEC, F_SQL_QUERY:
+		// sql_exec(db, stmt[, param...]) and sql_query(db, query, rows[, param...])
+		p.expect(LPAREN)
+		args := []ast.Expr{p.expr()}
+		p.commaNewlines()
+		args = append(args, p.expr())
+		if op == F_SQL_QUERY {
+			p.commaNewlines()
+			args = append(args, p.arrayRef(p.val, p.pos))
+			p.expect(NAME)
+		}
+		for p.tok == COMMA {
+			p.commaNewlines()
+			args = append(args, p.expr())
+		}
+		p.expect(RPAREN)
+		return &ast.CallExpr{Func: op, Args: args}
+	case F_GLOB, F_PARSEQUERY, F_STAT:
+		p.expect(LPAREN)
+		s := p.expr()
+		p.commaNewlines()
+		ref := p.arrayRef(p.val, p.pos)
+		p.expect(NAME)
+		p.expect(RPAREN)
+		return &ast.CallExpr{Func: op, Args: []ast.Expr{s, ref}}
+	case F_KEYS, F_VALUES:
+		p.expect(LPAREN)
+		src := p.arrayRef(p.val, p.pos)
+		p.expect(NAME)
+		p.commaNewlines()
+		dst := p.arrayRef(p.val, p.pos)
+		p.expect(NAME)
+		args := []ast.Expr{src, dst}
+		if p.tok == COMMA {
+			p.commaNewlines()
+			args = append(args, p.expr())
+		}
+		p.expect(RPAREN)
+		return &ast.CallExpr{Func: op, Args: args}
+	case F_DUMPARR:
+		p.expect(LPAREN)
+		ref := p.arrayRef(p.val, p.pos)
+		p.expect(NAME)
+		args := []ast.Expr{ref}
+		if p.tok == COMMA {
+			p.commaNewlines()
+			args = append(args, p.expr())
+			if p.tok == COMMA {
+				p.commaNewlines()
+				args = append(args, p.expr())
+			}
+		}
+		p.expect(RPAREN)
+		return &ast.CallExpr{Func: op, Args: args}
+	case F_MONOTIME, F_SB_NEW:
+		p.expect(LPAREN)
+		p.expect(RPAREN)
+		return &ast.CallExpr{Func: op}
+	case F_ABS, F_CEIL, F_CHR, F_FILESIZE, F_FLOOR, F_MD5, F_MTIME, F_ORD, F_SB_STR, F_SHA1, F_SHA256, F_SLEEP,
+		F_REDIS_GET, F_SQL_CLOSE, F_SQL_OPEN, F_TRUNC, F_UNSETENV, F_URLDECODE, F_URLENCODE:
+		p.expect(LPAREN)
+		arg := p.expr()
+		p.expect(RPAREN)
+		return &ast.CallExpr{Func: op, Args: []ast.Expr{arg}}
+	case F_REDIS_SET, F_SB_ADD, F_SETENV:
+		p.expect(LPAREN)
+		arg1 := p.expr()
+		p.commaNewlines()
+		arg2 := p.expr()
+		p.expect(RPAREN)
+		return &ast.CallExpr{Func: op, Args: []ast.Expr{arg1, arg2}}
+	case F_SYSTIME:
+		p.expect(LPAREN)
+		p.expect(RPAREN)
+		return &ast.CallExpr{Func: op}
+	case F_STRFTIME:
+		// strftime([format[, timestamp[, utc]]])
+		p.expect(LPAREN)
+		var args []ast.Expr
+		if p.tok != RPAREN {
+			args = append(args, p.expr())
+			for len(args) < 3 && p.tok == COMMA {
+				p.commaNewlines()
+				args = append(args, p.expr())
+			}
+		}
+		p.expect(RPAREN)
+		return &ast.CallExpr{Func: op, Args: args}
+	case F_MKTIME, F_REDIS_INCR:
+		// mktime(spec[, utc]) or redis_incr(key[, n])
+		p.expect(LPAREN)
+		args := []ast.Expr{p.expr()}
+		if p.tok == COMMA {
+			p.commaNewlines()
+			args = append(args, p.expr())
+		}
+		p.expect(RPAREN)
+		return &ast.CallExpr{Func: op, Args: args}
+	case F_HMAC, F_TZCONVERT:
+		// hmac(key, data[, algo]) or tzconvert(timestamp, zone[, format])
+		p.expect(LPAREN)
+		args := []ast.Expr{p.expr()}
+		p.commaNewlines()
+		args = append(args, p.expr())
+		if p.tok == COMMA {
+			p.commaNewlines()
+			args = append(args, p.expr())
+		}
+		p.expect(RPAREN)
+		return &ast.CallExpr{Func: op, Args: args}
+	default:
+		panic(p.errorf("unexpected extension function %s", op))
+	}
+}
+
+// Scan the tokens of the entire source to find the names of all
+// user-defined functions, so that a user-defined function with the
+// same name as an extension function (for example "max") takes
+// precedence, even if it's called before it's defined. The parser
+// knows when a slash starts a regex, but this quick scan doesn't,
+// so it guesses based on the previous token.
+func scanFuncNames(src []byte) map[string]bool {
+	names := make(map[string]bool)
+	lexer := NewLexer(src)
+	prevTok := ILLEGAL
+	for {
+		_, tok, val := lexer.Scan()
+		switch tok {
+		case EOF:
+			return names
+		case NAME:
+			if prevTok == FUNCTION {
+				names[val] = true
+			}
+		case DIV, DIV_ASSIGN:
+			switch prevTok {
+			case NAME, NUMBER, STRING, REGEX, RPAREN, RBRACKET, DOLLAR, INCR, DECR, F_LENGTH:
+				// Slash after an operand is division
+			default:
+				lexer.ScanRegex()
+				tok = REGEX
+			}
+		}
+		prevTok = tok
+	}
+}
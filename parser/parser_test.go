@@ -5,9 +5,14 @@ package parser_test
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/benhoyt/goawk/ast"
+	"github.com/benhoyt/goawk/lexer"
 	"github.com/benhoyt/goawk/parser"
 )
 
@@ -190,6 +195,510 @@ function set(a, k, v) {
 	}
 }
 
+func TestPositions(t *testing.T) {
+	src := "BEGIN {\n  x = a[1] + $2\n  print length(x), (y)\n}"
+	prog, err := parser.ParseProgram([]byte(src), nil)
+	if err != nil {
+		t.Fatalf("error parsing program: %v", err)
+	}
+	assign := prog.Begin[0][0].(*ast.ExprStmt).Expr.(*ast.AssignExpr)
+	add := assign.Right.(*ast.BinaryExpr)
+	index := add.Left.(*ast.IndexExpr)
+	field := add.Right.(*ast.FieldExpr)
+	print := prog.Begin[0][1].(*ast.PrintStmt)
+	tests := []struct {
+		node interface{}
+		pos  lexer.Position
+	}{
+		{prog.Begin[0][0], lexer.Position{Line: 2, Column: 3}},
+		{assign, lexer.Position{Line: 2, Column: 3}},
+		{assign.Left, lexer.Position{Line: 2, Column: 3}},
+		{add, lexer.Position{Line: 2, Column: 7}},
+		{index, lexer.Position{Line: 2, Column: 7}},
+		{index.Array, lexer.Position{Line: 2, Column: 7}},
+		{index.Index[0], lexer.Position{Line: 2, Column: 9}},
+		{field, lexer.Position{Line: 2, Column: 14}},
+		{field.Index, lexer.Position{Line: 2, Column: 15}},
+		{print, lexer.Position{Line: 3, Column: 3}},
+		{print.Args[0], lexer.Position{Line: 3, Column: 9}},
+		{print.Args[0].(*ast.CallExpr).Args[0], lexer.Position{Line: 3, Column: 16}},
+		{print.Args[1], lexer.Position{Line: 3, Column: 21}},
+	}
+	for _, test := range tests {
+		pos, ok := prog.Position(test.node)
+		if !ok || pos != test.pos {
+			t.Errorf("expected %s at %v, got %v (%v)", test.node, test.pos, pos, ok)
+		}
+	}
+	if _, ok := prog.Position(&ast.NumExpr{Value: 1}); ok {
+		t.Errorf("expected no position for expression not in program")
+	}
+}
+
+func TestComments(t *testing.T) {
+	src := `# start
+BEGIN {
+	# leading
+	x = 1 # trailing
+	while (x) {
+		break # out
+	}
+	# end of BEGIN
+} # after BEGIN
+function f() { # not done
+}
+# end`
+	prog, err := parser.ParseProgram([]byte(src), nil)
+	if err != nil {
+		t.Fatalf("error parsing program: %v", err)
+	}
+	tree := prog.AST()
+	if len(tree.Comments) != 8 {
+		t.Errorf("expected 8 comments, got %d", len(tree.Comments))
+	}
+	texts := func(comments []ast.Comment) string {
+		strs := make([]string, len(comments))
+		for i, c := range comments {
+			strs[i] = fmt.Sprintf("%d:%s", c.Position.Line, c.Text)
+		}
+		return strings.Join(strs, ", ")
+	}
+	describe := func(c *ast.Comments) string {
+		if c == nil {
+			return "none"
+		}
+		return fmt.Sprintf("leading [%s] trailing [%s] after [%s] inner [%s]",
+			texts(c.Leading), texts(c.Trailing), texts(c.After), texts(c.Inner))
+	}
+	loop := prog.Begin[0][1].(*ast.WhileStmt)
+	tests := []struct {
+		name     string
+		comments *ast.Comments
+		expected string
+	}{
+		{"BEGIN", tree.BeginComments[0], "leading [1:# start] trailing [9:# after BEGIN] after [] inner []"},
+		{"x = 1", tree.StmtComments[prog.Begin[0][0]], "leading [3:# leading] trailing [4:# trailing] after [] inner []"},
+		{"while", tree.StmtComments[loop], "leading [] trailing [] after [8:# end of BEGIN] inner []"},
+		{"break", tree.StmtComments[loop.Body[0]], "leading [] trailing [6:# out] after [] inner []"},
+		{"function", tree.FunctionComments[0], "leading [] trailing [] after [12:# end] inner [10:# not done]"},
+	}
+	for _, test := range tests {
+		if got := describe(test.comments); got != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestMultipleErrors(t *testing.T) {
+	src := `BEGIN { x = ; y = 1 +; print "ok" }
+{ if (x { print } }
+function f(( { }
+END { break; z = 1 }
+`
+	_, err := parser.ParseProgram([]byte(src), &parser.ParserConfig{MaxErrors: 10})
+	errs, ok := err.(parser.ErrorList)
+	if !ok {
+		t.Fatalf("expected ErrorList, got %T %v", err, err)
+	}
+	var got []string
+	for _, e := range errs {
+		got = append(got, fmt.Sprintf("%d:%d: %s", e.Position.Line, e.Position.Column, e.Message))
+	}
+	expected := []string{
+		"1:13: expected expression instead of ;",
+		"1:22: expected expression instead of ;",
+		"2:9: expected ) instead of {",
+		"3:12: expected name instead of (",
+		"4:7: break must be inside a loop body",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected errors:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+	expectedMsg := "parse error at 1:13: expected expression instead of ; (and 4 more errors)"
+	if err.Error() != expectedMsg {
+		t.Fatalf("expected %q, got %q", expectedMsg, err.Error())
+	}
+
+	// Parsing stops at MaxErrors
+	_, err = parser.ParseProgram([]byte(src), &parser.ParserConfig{MaxErrors: 2})
+	if errs, ok := err.(parser.ErrorList); !ok || len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", err)
+	}
+
+	// Without MaxErrors, only the first error is returned
+	_, err = parser.ParseProgram([]byte(src), nil)
+	if e, ok := err.(*parser.ParseError); !ok || e.Position.Line != 1 || e.Position.Column != 13 {
+		t.Fatalf("expected ParseError at 1:13, got %v", err)
+	}
+
+	// After an error in a string, parsing resumes after the string (or
+	// the line), rather than at a quote that seems to start another one
+	src = "BEGIN { print \"\\uD800\" }\nBEGIN { x = \"a\\xg\"; y = }\nBEGIN { s = \"abc\n}\nEND { z = }\n"
+	_, err = parser.ParseProgram([]byte(src), &parser.ParserConfig{MaxErrors: 10})
+	got = nil
+	for _, e := range err.(parser.ErrorList) {
+		got = append(got, fmt.Sprintf("%d:%d: %s", e.Position.Line, e.Position.Column, e.Message))
+	}
+	expected = []string{
+		"1:22: invalid Unicode code point in \\u escape",
+		"2:17: 1 or 2 hex digits expected",
+		"2:25: expected expression instead of }",
+		"3:17: can't have newline in string",
+		"5:11: expected expression instead of }",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected errors:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestFiles(t *testing.T) {
+	src := "BEGIN { x = 1 }\n\nEND { y = 2 }\n{ z = }\n"
+	files := []parser.File{{Name: "a.awk", Lines: 2}, {Name: "b.awk", Lines: 2}}
+	_, err := parser.ParseProgram([]byte(src), &parser.ParserConfig{Files: files})
+	expected := "parse error at b.awk:2:7: expected expression instead of }"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected %q, got %v", expected, err)
+	}
+
+	// With MaxErrors, each error has its file
+	src = "BEGIN { x = }\nEND { y = }\n"
+	files = []parser.File{{Name: "a.awk", Lines: 1}, {Name: "b.awk", Lines: 1}}
+	_, err = parser.ParseProgram([]byte(src), &parser.ParserConfig{Files: files, MaxErrors: 10})
+	var got []string
+	for _, e := range err.(parser.ErrorList) {
+		got = append(got, e.Error())
+	}
+	expectedErrs := []string{
+		"parse error at a.awk:1:13: expected expression instead of }",
+		"parse error at b.awk:1:11: expected expression instead of }",
+	}
+	if !reflect.DeepEqual(got, expectedErrs) {
+		t.Fatalf("expected errors:\n%s\ngot:\n%s", strings.Join(expectedErrs, "\n"), strings.Join(got, "\n"))
+	}
+
+	// An error at EOF is in the last file
+	files = []parser.File{{Name: "a.awk", Lines: 1}}
+	_, err = parser.ParseProgram([]byte("BEGIN {\n"), &parser.ParserConfig{Files: files})
+	expected = "parse error at a.awk:2:1: expected } instead of EOF"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected %q, got %v", expected, err)
+	}
+
+	// Lines of positions in the program map to the files
+	prog, err := parser.ParseProgram([]byte("BEGIN {}\nEND {}\n{}\n"), &parser.ParserConfig{
+		Files: []parser.File{{Name: "a.awk", Lines: 1}, {Name: "b.awk", Lines: 2}},
+	})
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	for line, expected := range []string{"a.awk:1", "b.awk:1", "b.awk:2"} {
+		name, fileLine := prog.FileLine(line + 1)
+		if got := fmt.Sprintf("%s:%d", name, fileLine); got != expected {
+			t.Errorf("line %d: expected %s, got %s", line+1, expected, got)
+		}
+	}
+	prog, _ = parser.ParseProgram([]byte("BEGIN {}"), nil)
+	if name, line := prog.FileLine(3); name != "" || line != 3 {
+		t.Errorf("expected no file, got %q %d", name, line)
+	}
+}
+
+func TestFindFile(t *testing.T) {
+	dir1 := t.TempDir()
+	dir2 := t.TempDir()
+	writeFile := func(path string) {
+		err := ioutil.WriteFile(path, []byte("BEGIN {}\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(filepath.Join(dir1, "b.awk"))
+	writeFile(filepath.Join(dir2, "a"))
+	writeFile(filepath.Join(dir2, "a.awk"))
+	writeFile(filepath.Join(dir2, "b.awk"))
+	path := []string{dir1, dir2}
+
+	tests := []struct {
+		name     string
+		path     []string
+		expected string
+	}{
+		{"a", path, filepath.Join(dir2, "a")},
+		{"a.awk", path, filepath.Join(dir2, "a.awk")},
+		{"b", path, filepath.Join(dir1, "b.awk")}, // earlier directories first
+		{"b", nil, "b"},
+		{"./b", path, "./b"},
+		{"-", path, "-"},
+	}
+	for _, test := range tests {
+		found, err := parser.FindFile(test.name, test.path)
+		if err != nil || found != test.expected {
+			t.Errorf("%q: expected %q, got %q, %v", test.name, test.expected, found, err)
+		}
+	}
+
+	_, err := parser.FindFile("c", path)
+	expected := fmt.Sprintf(`file "c" not found in AWKPATH (tried %s, %s, %s, %s)`,
+		filepath.Join(dir1, "c"), filepath.Join(dir1, "c.awk"),
+		filepath.Join(dir2, "c"), filepath.Join(dir2, "c.awk"))
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected %q, got %v", expected, err)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"lib.awk":   "@include \"util\"\nfunction double(x) { return 2*x }\n",
+		"util.awk":  "function inc(x) { return x+1 }",
+		"cycle.awk": "@include \"cycle\"\nBEGIN { x = 1 }\n",
+		"bad.awk":   "function f() {\n  print (\n}\n",
+		"nested":    "BEGIN {\n@include \"util\"\n}\n",
+	} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := []string{dir}
+
+	tests := []struct {
+		src    string
+		path   []string
+		output string
+		err    string
+	}{
+		{"BEGIN { print double(inc(1)) }\n@include \"lib\"\n@include \"util.awk\"",
+			path, "BEGIN {\n    print double(inc(1))\n}\n\nfunction inc(x) {\n    return (x + 1)\n}\n\nfunction double(x) {\n    return (2 * x)\n}", ""},
+		{"@include \"cycle\" # comment\nBEGIN { y = 2 }", path,
+			"BEGIN {\n    x = 1\n}\n\nBEGIN {\n    y = 2\n}", ""},
+		{"BEGIN {}\n@include \"bad\"", path, "",
+			"parse error at " + filepath.Join(dir, "bad.awk") + ":2:10: expected expression, not <newline>"},
+		{"BEGIN {}\n\n@include \"missing\"", path, "",
+			"parse error at <cmdline>:3:1: file \"missing\" not found in AWKPATH (tried " +
+				filepath.Join(dir, "missing") + ", " + filepath.Join(dir, "missing.awk") + ")"},
+		{"@include \"missing\"", []string{}, "", "parse error at <cmdline>:1:1: can't include \"missing\": no such file or directory"},
+		{"@include \"lib\"\nBEGIN {\n  print (\n}", path, "", "parse error at <cmdline>:3:10: expected expression, not <newline>"},
+		{"@include \"nested\"", path, "", "parse error at " + filepath.Join(dir, "nested") + ":2:1: expected expression instead of @include"},
+		{"@include lib", path, "", "parse error at <cmdline>:1:1: expected file name string after @include"},
+		{"@include \"lib\" BEGIN {}", path, "", "parse error at <cmdline>:1:16: expected newline after @include \"lib\""},
+		{"@include \"lib\"", nil, "", "parse error at <cmdline>:1:10: can't include \"lib\": including files isn't enabled"},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			config := &parser.ParserConfig{
+				IncludePath: test.path,
+				Files:       []parser.File{{Name: "<cmdline>", Lines: strings.Count(test.src, "\n") + 1}},
+			}
+			prog, err := parser.ParseProgram([]byte(test.src), config)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prog.String() != test.output {
+				t.Fatalf("expected:\n%s\ngot:\n%s", test.output, prog.String())
+			}
+		})
+	}
+
+	// Lines of the expanded source map to the files they came from
+	src, files, err := parser.ExpandIncludes([]byte("BEGIN {}\n@include \"lib\"\nEND {}\n"), nil, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedSrc := "BEGIN {}\n\n\nfunction inc(x) { return x+1 }\nfunction double(x) { return 2*x }\nEND {}\n"
+	if string(src) != expectedSrc {
+		t.Fatalf("expected source %q, got %q", expectedSrc, src)
+	}
+	expectedFiles := []parser.File{
+		{Name: "", Lines: 2},
+		{Name: filepath.Join(dir, "lib.awk"), Lines: 1},
+		{Name: filepath.Join(dir, "util.awk"), Lines: 1},
+		{Name: filepath.Join(dir, "lib.awk"), Lines: 1, StartLine: 2},
+		{Name: "", Lines: 2, StartLine: 3},
+	}
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Fatalf("expected files %v, got %v", expectedFiles, files)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	tests := []struct {
+		src      string
+		assigned []string
+		error    string
+	}{
+		{`{ total += $1 } END { print totl }`, nil, `parse error at 1:29: variable "totl" is never assigned (strict mode)`},
+		{`{ total += $1 } END { print total }`, nil, ""},
+		{`END { print totl }`, []string{"totl"}, ""},
+		{`BEGIN { print NR, FS, ARGV[0], ENVIRON["HOME"], RECORDINFO["offset"] }`, nil, ""},
+		{`BEGIN { for (k in a) print k }`, nil, `parse error at 1:19: variable "a" is never assigned (strict mode)`},
+		{`BEGIN { a[1]; for (k in a) print k }`, nil, `parse error at 1:9: variable "a" is never assigned (strict mode)`},
+		{`BEGIN { a[1] = 1; for (k in a) print k }`, nil, ""},
+		{`BEGIN { n = split("a b", parts); getline line; sub(/x/, "y", s); print n, parts[1], line, s }`, nil, ""},
+		{`BEGIN { fill(a); print a[1] } function fill(arr) { arr[1] = 1 }`, nil, ""},
+		{`BEGIN { f() } function f(   x) { x = 1; print x, y }`, nil, `parse error at 1:50: variable "y" is never assigned (strict mode)`},
+		{`function f(x) { x = 1 } BEGIN { f(); print x }`, nil, `parse error at 1:44: variable "x" is never assigned (strict mode)`},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			config := &parser.ParserConfig{Strict: true, Assigned: test.assigned}
+			_, err := parser.ParseProgram([]byte(test.src), config)
+			var got string
+			if err != nil {
+				got = err.Error()
+			}
+			if got != test.error {
+				t.Fatalf("expected error %q, got %q", test.error, got)
+			}
+		})
+	}
+
+	// Strict mode is off by default, and a comment enables it
+	src := "BEGIN { print x }"
+	if _, err := parser.ParseProgram([]byte(src), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	_, err := parser.ParseProgram([]byte("# goawk:strict\n"+src), nil)
+	if err == nil || !strings.Contains(err.Error(), "never assigned") {
+		t.Fatalf("expected strict mode error, got %v", err)
+	}
+}
+
+func TestPOSIX(t *testing.T) {
+	tests := []struct {
+		src   string
+		error string
+	}{
+		{`BEGIN { print "a" "b"; x = 2 ^ 3; x ^= 2; print length($0), substr("abc", 2) }`, ""},
+		{`BEGIN { print 'a' }`, "parse error at 1:15: single-quoted strings aren't in POSIX AWK"},
+		{`BEGIN { print 2 ** 3 }`, "parse error at 1:17: ** operator isn't in POSIX AWK (use ^)"},
+		{`BEGIN { x **= 3 }`, "parse error at 1:11: **= operator isn't in POSIX AWK (use ^=)"},
+		{`BEGIN { print strftime("%Y") }`, "parse error at 1:15: function strftime isn't in POSIX AWK"},
+		{`function strftime(f) { return f } BEGIN { print strftime("%Y") }`, ""},
+		{`BEGIN { print native(1) }`, `parse error at 1:15: native function "native" isn't in POSIX AWK`},
+		{`{ print RT }`, "parse error at 1:9: special variable RT isn't in POSIX AWK"},
+		{`BEGIN { split("a b", a, " ", seps) }`, "parse error at 1:28: split() seps argument isn't in POSIX AWK"},
+		{`BEGIN { match("ab", /b/, m) }`, "parse error at 1:24: match() array argument isn't in POSIX AWK"},
+		{`BEGIN { getline x < "f"; print ERRNO }`, "parse error at 1:32: special variable ERRNO isn't in POSIX AWK"},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			config := &parser.ParserConfig{
+				POSIX: true,
+				Funcs: map[string]interface{}{"native": func(n int) int { return n }},
+			}
+			_, err := parser.ParseProgram([]byte(test.src), config)
+			var got string
+			if err != nil {
+				got = err.Error()
+			}
+			if got != test.error {
+				t.Fatalf("expected error %q, got %q", test.error, got)
+			}
+			if test.error != "" {
+				// Without POSIX mode, the extensions are allowed
+				config.POSIX = false
+				if _, err := parser.ParseProgram([]byte(test.src), config); err != nil {
+					t.Fatalf("expected no error without POSIX mode, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	loads := 0
+	config := &parser.ParserConfig{
+		Funcs: map[string]interface{}{"native": func() int { return 1 }},
+		Load: func(name string) (map[string]interface{}, error) {
+			loads++
+			switch name {
+			case "ext":
+				return map[string]interface{}{"double": func(n int) int { return 2 * n }}, nil
+			case "clash":
+				return map[string]interface{}{"native": func() int { return 2 }}, nil
+			}
+			return nil, fmt.Errorf("no extension %q", name)
+		},
+	}
+	tests := []struct {
+		src   string
+		out   string // String form of program, or error
+		loads int
+	}{
+		{`@load "ext"
+BEGIN { print double(native()) }`, "@load \"ext\"\n\nBEGIN {\n    print double(native())\n}", 1},
+		{`@load "ext"; @load "ext"
+@load "ext"`, `@load "ext"`, 1},
+		{`BEGIN { print double(1) }`, `parse error at 1:15: undefined function "double"`, 0},
+		{`@load "nope"`, `parse error at 1:1: can't load "nope": no extension "nope"`, 1},
+		{`@load "clash"`, `parse error at 1:1: can't load "clash": native function "native" already defined`, 1},
+		{`@load ext`, "parse error at 1:7: expected extension name string after @load", 0},
+		{`@load "ext" BEGIN {}`, `parse error at 1:13: expected newline after @load "ext"`, 0},
+		{`BEGIN { @load "ext" }`, "parse error at 1:9: expected expression instead of @load", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.src, func(t *testing.T) {
+			loads = 0
+			prog, err := parser.ParseProgram([]byte(test.src), config)
+			var got string
+			if err != nil {
+				got = err.Error()
+			} else {
+				got = prog.String()
+			}
+			if got != test.out {
+				t.Fatalf("expected %q, got %q", test.out, got)
+			}
+			if loads != test.loads {
+				t.Fatalf("expected %d loads, got %d", test.loads, loads)
+			}
+		})
+	}
+	if len(config.Funcs) != 1 {
+		t.Fatalf("expected config's Funcs to be unchanged, got %v", config.Funcs)
+	}
+
+	_, err := parser.ParseProgram([]byte(`@load "ext"`), nil)
+	expected := `parse error at 1:1: can't load "ext": loading extensions isn't enabled`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected error %q, got %v", expected, err)
+	}
+	_, err = parser.ParseProgram([]byte(`@load "ext"`), &parser.ParserConfig{POSIX: true, Load: config.Load})
+	expected = "parse error at 1:1: @load isn't in POSIX AWK"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestNonDecimal(t *testing.T) {
+	src := `BEGIN { print 0x1A, 0o17 + 0XFF, x0x1 }`
+	prog, err := parser.ParseProgram([]byte(src), &parser.ParserConfig{NonDecimal: true})
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	expected := "BEGIN {\n    print 26, (15 + 255), x0x1\n}"
+	if prog.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, prog.String())
+	}
+
+	// Without NonDecimal, 0x1A is 0 concatenated with x1A
+	prog, err = parser.ParseProgram([]byte(`BEGIN { print 0x1A }`), nil)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	expected = "BEGIN {\n    print (0 x1A)\n}"
+	if prog.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, prog.String())
+	}
+}
+
 func TestResolveTooManyIterations(t *testing.T) {
 	var buf bytes.Buffer
 	var i int
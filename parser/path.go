@@ -0,0 +1,45 @@
+// Finding program files in a search path, like AWKPATH
+
+package parser
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FindFile returns the path of the program file name, searching the
+// directories in path in order (for example the AWKPATH environment
+// variable split with filepath.SplitList). In each directory it tries
+// name, then name with ".awk" appended if it doesn't already have that
+// extension. An empty directory means the current directory.
+//
+// If path is empty, or name contains a directory separator (like
+// "lib/util.awk" or "/usr/share/awk/util.awk"), name is returned as is
+// without checking that it exists. If the file isn't found, the error
+// lists the paths tried.
+func FindFile(name string, path []string) (string, error) {
+	if len(path) == 0 || name == "-" || strings.ContainsRune(name, '/') ||
+		strings.ContainsRune(name, filepath.Separator) {
+		return name, nil
+	}
+	var tried []string
+	for _, dir := range path {
+		if dir == "" {
+			dir = "."
+		}
+		candidates := []string{filepath.Join(dir, name)}
+		if filepath.Ext(name) != ".awk" {
+			candidates = append(candidates, filepath.Join(dir, name+".awk"))
+		}
+		for _, candidate := range candidates {
+			info, err := os.Stat(candidate)
+			if err == nil && !info.IsDir() {
+				return candidate, nil
+			}
+			tried = append(tried, candidate)
+		}
+	}
+	return "", fmt.Errorf("file %q not found in AWKPATH (tried %s)", name, strings.Join(tried, ", "))
+}
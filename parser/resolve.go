@@ -7,7 +7,7 @@ import (
 	"reflect"
 	"sort"
 
-	"github.com/benhoyt/goawk/internal/ast"
+	"github.com/benhoyt/goawk/ast"
 	. "github.com/benhoyt/goawk/lexer"
 )
 
@@ -75,8 +75,8 @@ func (p *parser) initResolve() {
 	p.varTypes = make(map[string]map[string]typeInfo)
 	p.varTypes[""] = make(map[string]typeInfo) // globals
 	p.functions = make(map[string]int)
-	p.arrayRef("ARGV", Position{1, 1})    // interpreter relies on ARGV being present
-	p.arrayRef("ENVIRON", Position{1, 1}) // and ENVIRON
+	p.arrayRef("ARGV", Position{Line: 1, Column: 1})    // interpreter relies on ARGV being present
+	p.arrayRef("ENVIRON", Position{Line: 1, Column: 1}) // and ENVIRON
 	p.multiExprs = make(map[*ast.MultiExpr]Position, 3)
 }
 
@@ -131,6 +131,9 @@ func (p *parser) resolveUserCalls(prog *Program) {
 			if !haveNative {
 				panic(p.posErrorf(c.pos, "undefined function %q", c.call.Name))
 			}
+			if p.posix {
+				panic(p.posErrorf(c.pos, "native function %q isn't in POSIX AWK", c.call.Name))
+			}
 			typ := reflect.TypeOf(f)
 			if !typ.IsVariadic() && len(c.call.Args) > typ.NumIn() {
 				panic(p.posErrorf(c.pos, "%q called with more arguments than declared", c.call.Name))
@@ -177,11 +180,20 @@ func (p *parser) getScope(name string) (ast.VarScope, string) {
 	}
 }
 
+// Special variables that are GoAWK extensions (not in POSIX AWK)
+var extensionVars = map[string]bool{
+	"ERRNO": true,
+	"RT":    true,
+}
+
 // Record a variable (scalar) reference and return the *VarExpr (but
 // VarExpr.Index won't be set till later)
 func (p *parser) varRef(name string, pos Position) *ast.VarExpr {
 	scope, funcName := p.getScope(name)
-	expr := &ast.VarExpr{scope, 0, name}
+	if scope == ast.ScopeSpecial && p.posix && extensionVars[name] {
+		panic(p.posErrorf(pos, "special variable %s isn't in POSIX AWK", name))
+	}
+	expr := &ast.VarExpr{Scope: scope, Index: 0, Name: name}
 	p.varRefs = append(p.varRefs, varRef{funcName, expr, false, pos})
 	info := p.varTypes[funcName][name]
 	if info.typ == typeUnknown {
@@ -197,8 +209,11 @@ func (p *parser) arrayRef(name string, pos Position) *ast.ArrayExpr {
 	if scope == ast.ScopeSpecial {
 		panic(p.errorf("can't use scalar %q as array", name))
 	}
-	expr := &ast.ArrayExpr{scope, 0, name}
+	expr := &ast.ArrayExpr{Scope: scope, Index: 0, Name: name}
 	p.arrayRefs = append(p.arrayRefs, arrayRef{funcName, expr, pos})
+	if p.exprPositions != nil { // nil for the ARGV and ENVIRON refs in initResolve
+		p.exprAt(expr, pos)
+	}
 	info := p.varTypes[funcName][name]
 	if info.typ == typeUnknown {
 		p.varTypes[funcName][name] = typeInfo{typeArray, nil, scope, 0, info.callName, 0}
@@ -443,7 +458,7 @@ func (p *parser) getVarFuncName(prog *Program, name, inFunc string) string {
 // Record a "multi expression" (comma-separated pseudo-expression
 // used to allow commas around print/printf arguments).
 func (p *parser) multiExpr(exprs []ast.Expr, pos Position) ast.Expr {
-	expr := &ast.MultiExpr{exprs}
+	expr := &ast.MultiExpr{Exprs: exprs}
 	p.multiExprs[expr] = pos
 	return expr
 }
@@ -459,7 +474,7 @@ func (p *parser) checkMultiExprs() {
 		return
 	}
 	// Show error on first comma-separated expression
-	min := Position{1000000000, 1000000000}
+	min := Position{Line: 1000000000, Column: 1000000000}
 	for _, pos := range p.multiExprs {
 		if pos.Line < min.Line || (pos.Line == min.Line && pos.Column < min.Column) {
 			min = pos
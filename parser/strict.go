@@ -0,0 +1,120 @@
+// Strict mode: checking that global variables are assigned
+
+package parser
+
+import (
+	"strings"
+
+	"github.com/benhoyt/goawk/ast"
+	. "github.com/benhoyt/goawk/lexer"
+)
+
+// Comment that enables strict mode from inside a program
+const strictPragma = "goawk:strict"
+
+// Report whether the program has a "# goawk:strict" comment line.
+func (p *parser) hasStrictPragma() bool {
+	for _, c := range p.comments {
+		if strings.TrimSpace(strings.TrimPrefix(c.Text, "#")) == strictPragma {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that every global variable or array the program uses is
+// assigned somewhere in it (or is one of p.assigned, the ones assigned
+// from outside), reporting the first use of one that isn't.
+func (p *parser) checkStrict(prog *Program) {
+	isAssigned := map[string]bool{"ARGV": true, "ENVIRON": true, "RECORDINFO": true}
+	for _, name := range p.assigned {
+		isAssigned[name] = true
+	}
+	markAssigned := func(expr ast.Expr) {
+		switch e := expr.(type) {
+		case *ast.VarExpr:
+			if e.Scope == ast.ScopeGlobal {
+				isAssigned[e.Name] = true
+			}
+		case *ast.IndexExpr:
+			if e.Array.Scope == ast.ScopeGlobal {
+				isAssigned[e.Array.Name] = true
+			}
+		}
+	}
+
+	// Globals used, in source order
+	type use struct {
+		name string
+		pos  Position
+	}
+	var uses []use
+	tree := prog.AST()
+	ast.Inspect(tree, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.VarExpr:
+			if n.Scope == ast.ScopeGlobal {
+				uses = append(uses, use{n.Name, p.exprPositions[n]})
+			}
+		case *ast.ArrayExpr:
+			if n.Scope == ast.ScopeGlobal {
+				uses = append(uses, use{n.Name, p.exprPositions[n]})
+			}
+		case *ast.AssignExpr:
+			markAssigned(n.Left)
+		case *ast.AugAssignExpr:
+			markAssigned(n.Left)
+		case *ast.IncrExpr:
+			markAssigned(n.Expr)
+		case *ast.ForInStmt:
+			markAssigned(n.Var)
+		case *ast.GetlineExpr:
+			markAssigned(n.Target)
+		case *ast.CallExpr:
+			switch {
+			case n.Func == F_SPLIT:
+				for i := 1; i < len(n.Args); i += 2 {
+					// The array, and the seps array if it's there
+					if a := n.Args[i].(*ast.ArrayExpr); a.Scope == ast.ScopeGlobal {
+						isAssigned[a.Name] = true
+					}
+				}
+			case n.Func == F_COPY || n.Func == F_KEYS || n.Func == F_VALUES:
+				if a := n.Args[1].(*ast.ArrayExpr); a.Scope == ast.ScopeGlobal {
+					isAssigned[a.Name] = true
+				}
+			case n.Func == F_MATCH && len(n.Args) == 3:
+				if a := n.Args[2].(*ast.ArrayExpr); a.Scope == ast.ScopeGlobal {
+					isAssigned[a.Name] = true
+				}
+			case n.Func == F_GLOB || n.Func == F_PARSEQUERY || n.Func == F_STAT:
+				if a := n.Args[1].(*ast.ArrayExpr); a.Scope == ast.ScopeGlobal {
+					isAssigned[a.Name] = true
+				}
+			case n.Func == F_SQL_QUERY:
+				if a := n.Args[2].(*ast.ArrayExpr); a.Scope == ast.ScopeGlobal {
+					isAssigned[a.Name] = true
+				}
+			case (n.Func == F_SUB || n.Func == F_GSUB) && len(n.Args) == 3:
+				markAssigned(n.Args[2])
+			}
+		case *ast.UserCallExpr:
+			if !n.Native {
+				// The function may assign elements of arrays passed to it
+				arrays := tree.Functions[n.Index].Arrays
+				for i, arg := range n.Args {
+					if i < len(arrays) && arrays[i] {
+						markAssigned(arg)
+					}
+				}
+			}
+		}
+		return true
+	})
+
+	for _, u := range uses {
+		if !isAssigned[u.name] {
+			panic(p.posErrorf(u.pos, "variable %q is never assigned (strict mode)", u.name))
+		}
+	}
+}
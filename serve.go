@@ -0,0 +1,455 @@
+// The "goawk serve" subcommand: run AWK programs as an HTTP service
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benhoyt/goawk/interp"
+	"github.com/benhoyt/goawk/parser"
+)
+
+const serveUsage = `usage: goawk serve [-addr addr] [-F fs] [-reload interval] [-tenants file]
+                   [-timeout d] [-max-input n] [-max-output n] [-allow-exec]
+                   [-allow-file-reads] [-allow-file-writes] name=progfile ...
+
+Serve the given AWK programs over HTTP. POST input to /run/name to run
+program "name" on it; the response body is the program's output, and the
+Goawk-Exit-Status header holds its exit status. Query parameters:
+
+  v=name=value  variable assignment (multiple allowed)
+  F=fs          field separator (overrides -F)
+  exec=1        allow system() and pipes (only if -allow-exec)
+  filereads=1   allow reading files (only if -allow-file-reads)
+  filewrites=1  allow writing files (only if -allow-file-writes)
+
+Requests are sandboxed unless they opt out as above, and ENVIRON is empty.
+Each run is limited to -timeout of execution (0 means no limit), and to
+-max-input and -max-output bytes of input and output (0 means no limit).
+
+With -reload (for example -reload 2s), program files are checked for changes
+at that interval and recompiled. Requests in progress finish using the old
+version; if the new source has errors, the old version keeps running.
+
+With -tenants, requests must include an "Authorization: Bearer key" header
+and are limited by that tenant's settings instead of the flags above. The
+file is a JSON object mapping tenant names to settings, for example:
+
+  {"alice": {"key": "s3cret", "programs": ["sum"], "timeout": "2s",
+             "max_concurrent": 4, "max_input": 1048576,
+             "max_output": 65536, "allow_exec": false,
+             "allow_file_reads": false, "allow_file_writes": false}}
+
+All settings but "key" are optional: "programs" lists the programs the
+tenant may run (default all), "max_concurrent" limits how many of its
+requests run at once (0 means no limit), and the others are as for the
+flags.
+
+Memory isn't limited. Input is streamed to the program and output is held
+in memory only up to the output limit, but a program's variables and arrays
+can grow without bound, so limit untrusted programs with "timeout" and
+"max_concurrent", or run the server under an OS or container memory limit.
+`
+
+// server is an http.Handler that runs AWK programs on posted input.
+type server struct {
+	programs  map[string]*programFile
+	fieldSep  string
+	tenants   map[string]*tenant // keyed by tenant key, nil if not using -tenants
+	anonymous *tenant            // limits when not using -tenants
+	reloadLog io.Writer          // where to log reloads and reload errors
+}
+
+// tenant holds the limits and permissions for a group of requests.
+type tenant struct {
+	Key             string   `json:"key"`
+	Programs        []string `json:"programs"`
+	Timeout         duration `json:"timeout"`
+	MaxConcurrent   int      `json:"max_concurrent"`
+	MaxInput        int64    `json:"max_input"`
+	MaxOutput       int64    `json:"max_output"`
+	AllowExec       bool     `json:"allow_exec"`
+	AllowFileReads  bool     `json:"allow_file_reads"`
+	AllowFileWrites bool     `json:"allow_file_writes"`
+
+	name    string
+	running chan struct{} // semaphore for MaxConcurrent, nil if unlimited
+}
+
+// duration is a time.Duration that's a string like "2s" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return fmt.Errorf("duration must be a string like \"2s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// Report whether tenant t may run the named program.
+func (t *tenant) canRun(name string) bool {
+	if t.Programs == nil {
+		return true
+	}
+	for _, p := range t.Programs {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Load the tenants file at path, returning the tenants keyed by key.
+func loadTenants(path string, programs map[string]*programFile) (map[string]*tenant, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var byName map[string]*tenant
+	err = json.Unmarshal(data, &byName)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	tenants := make(map[string]*tenant)
+	for name, t := range byName {
+		if t == nil || t.Key == "" {
+			return nil, fmt.Errorf("%s: tenant %q must have a key", path, name)
+		}
+		if other, ok := tenants[t.Key]; ok {
+			return nil, fmt.Errorf("%s: tenants %q and %q have the same key", path, other.name, name)
+		}
+		for _, p := range t.Programs {
+			if _, ok := programs[p]; !ok {
+				return nil, fmt.Errorf("%s: tenant %q has unknown program %q", path, name, p)
+			}
+		}
+		t.name = name
+		t.init()
+		tenants[t.Key] = t
+	}
+	return tenants, nil
+}
+
+func (t *tenant) init() {
+	if t.MaxConcurrent > 0 {
+		t.running = make(chan struct{}, t.MaxConcurrent)
+	}
+}
+
+// programFile is a served program loaded from a file. The program is
+// swapped out atomically when the file is reloaded.
+type programFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+	current atomic.Value // *servedProgram
+}
+
+// Load (or reload) the program from its file.
+func (f *programFile) load() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	src, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	prog, err := parser.ParseProgram(src, nil)
+	if err != nil {
+		if err, ok := err.(*parser.ParseError); ok {
+			return fmt.Errorf("%s:%d:%d: %s", f.path, err.Position.Line, err.Position.Column, err.Message)
+		}
+		return err
+	}
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.current.Store(newServedProgram(prog))
+	return nil
+}
+
+// Reload any program files that have changed since they were last
+// loaded, keeping the old version if a file can't be loaded.
+func (s *server) reloadChanged() {
+	for name, f := range s.programs {
+		info, err := os.Stat(f.path)
+		if err == nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+			continue
+		}
+		if err == nil {
+			err = f.load()
+		}
+		if err != nil {
+			fmt.Fprintf(s.reloadLog, "error reloading %q, keeping previous version: %v\n", name, err)
+			// Don't retry till the file changes again
+			if info != nil {
+				f.modTime = info.ModTime()
+				f.size = info.Size()
+			}
+			continue
+		}
+		fmt.Fprintf(s.reloadLog, "reloaded %q from %s\n", name, f.path)
+	}
+}
+
+// servedProgram is a parsed program and a pool of interpreters for it,
+// so that concurrent requests don't share interpreter state.
+type servedProgram struct {
+	prog *parser.Program
+	pool sync.Pool
+}
+
+func newServedProgram(prog *parser.Program) *servedProgram {
+	p := &servedProgram{prog: prog}
+	p.pool.New = func() interface{} {
+		return interp.New(prog)
+	}
+	return p
+}
+
+func serveMain(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, serveUsage)
+	}
+	addr := flags.String("addr", "localhost:8080", "")
+	reload := flags.Duration("reload", 0, "")
+	tenantsPath := flags.String("tenants", "", "")
+	timeout := flags.Duration("timeout", 0, "")
+	anonymous := &tenant{}
+	s := &server{programs: make(map[string]*programFile), anonymous: anonymous, reloadLog: os.Stderr}
+	flags.StringVar(&s.fieldSep, "F", " ", "")
+	flags.Int64Var(&anonymous.MaxInput, "max-input", 0, "")
+	flags.Int64Var(&anonymous.MaxOutput, "max-output", 0, "")
+	flags.BoolVar(&anonymous.AllowExec, "allow-exec", false, "")
+	flags.BoolVar(&anonymous.AllowFileReads, "allow-file-reads", false, "")
+	flags.BoolVar(&anonymous.AllowFileWrites, "allow-file-writes", false, "")
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		errorExitf("%s", serveUsage)
+	}
+	anonymous.Timeout = duration(*timeout)
+
+	for _, arg := range flags.Args() {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			errorExitf("program must be in format name=progfile, not %q", arg)
+		}
+		f := &programFile{path: parts[1]}
+		err := f.load()
+		if err != nil {
+			errorExit(err)
+		}
+		s.programs[parts[0]] = f
+	}
+
+	if *tenantsPath != "" {
+		tenants, err := loadTenants(*tenantsPath, s.programs)
+		if err != nil {
+			errorExit(err)
+		}
+		s.tenants = tenants
+	}
+
+	if *reload > 0 {
+		go func() {
+			for range time.Tick(*reload) {
+				s.reloadChanged()
+			}
+		}()
+	}
+
+	fmt.Fprintf(os.Stderr, "serving %d program(s) on http://%s/run/\n", len(s.programs), *addr)
+	errorExit(http.ListenAndServe(*addr, s))
+}
+
+var (
+	errInputLimit  = errors.New("input limit exceeded")
+	errOutputLimit = errors.New("output limit exceeded")
+)
+
+// limitedReader is like io.LimitedReader, but returns errInputLimit if
+// there's more input than the limit.
+type limitedReader struct {
+	r io.Reader
+	n int64 // bytes remaining
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errInputLimit
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n+1] // read one past the limit to detect overflow
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n + int(l.n), errInputLimit
+	}
+	return n, err
+}
+
+// limitedWriter writes to a buffer, returning errOutputLimit if more
+// than n bytes in total are written.
+type limitedWriter struct {
+	buf bytes.Buffer
+	n   int64 // bytes remaining
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		l.buf.Write(p[:l.n])
+		l.n = -1
+		return 0, errOutputLimit
+	}
+	l.n -= int64(len(p))
+	return l.buf.Write(p)
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/run/") {
+		http.NotFound(w, r)
+		return
+	}
+	t := s.anonymous
+	if s.tenants != nil {
+		key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		t = s.tenants[key]
+		if key == "" || t == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or invalid tenant key", http.StatusUnauthorized)
+			return
+		}
+	}
+	name := r.URL.Path[len("/run/"):]
+	f, ok := s.programs[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("program %q not found", name), http.StatusNotFound)
+		return
+	}
+	if !t.canRun(name) {
+		http.Error(w, fmt.Sprintf("program %q not allowed for tenant %q", name, t.name), http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method must be POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	fieldSep := s.fieldSep
+	if fs, ok := query["F"]; ok {
+		fieldSep = fs[0]
+	}
+	input := &limitedReader{r: r.Body, n: math.MaxInt64}
+	if t.MaxInput > 0 {
+		input.n = t.MaxInput
+	}
+	output := &limitedWriter{n: math.MaxInt64}
+	if t.MaxOutput > 0 {
+		output.n = t.MaxOutput
+	}
+	config := &interp.Config{
+		Stdin:        input,
+		Output:       output,
+		Error:        ioutil.Discard,
+		Argv0:        "goawk",
+		Vars:         []string{"FS", fieldSep},
+		NoExec:       true,
+		NoFileReads:  true,
+		NoFileWrites: true,
+		Environ:      []string{},
+	}
+	for _, v := range query["v"] {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			http.Error(w, "v parameter must be in format name=value", http.StatusBadRequest)
+			return
+		}
+		config.Vars = append(config.Vars, parts[0], parts[1])
+	}
+	permissions := []struct {
+		param   string
+		allowed bool
+		flag    *bool
+	}{
+		{"exec", t.AllowExec, &config.NoExec},
+		{"filereads", t.AllowFileReads, &config.NoFileReads},
+		{"filewrites", t.AllowFileWrites, &config.NoFileWrites},
+	}
+	for _, perm := range permissions {
+		if query.Get(perm.param) != "1" {
+			continue
+		}
+		if !perm.allowed {
+			http.Error(w, fmt.Sprintf("%s not allowed by server", perm.param), http.StatusForbidden)
+			return
+		}
+		*perm.flag = false
+	}
+
+	if t.running != nil {
+		select {
+		case t.running <- struct{}{}:
+			defer func() { <-t.running }()
+		default:
+			http.Error(w, fmt.Sprintf("too many concurrent requests (limit %d)", t.MaxConcurrent), http.StatusTooManyRequests)
+			return
+		}
+	}
+	ctx := r.Context()
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(t.Timeout))
+		defer cancel()
+	}
+
+	program := f.current.Load().(*servedProgram)
+	interpreter := program.pool.Get().(*interp.Interpreter)
+	status, err := interpreter.ExecuteContext(ctx, config)
+	program.pool.Put(interpreter)
+	// Check input and output limits first, as exceeding one can cause
+	// other errors, or even look like success if the program ignores
+	// write errors (for example, by writing to a closed pipe).
+	switch {
+	case input.n < 0:
+		http.Error(w, fmt.Sprintf("input larger than limit of %d bytes", t.MaxInput), http.StatusRequestEntityTooLarge)
+		return
+	case output.n < 0:
+		http.Error(w, fmt.Sprintf("output larger than limit of %d bytes", t.MaxOutput), http.StatusInternalServerError)
+		return
+	case err == context.DeadlineExceeded:
+		http.Error(w, fmt.Sprintf("program took longer than time limit of %s", time.Duration(t.Timeout)), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Goawk-Exit-Status", strconv.Itoa(status))
+	_, _ = w.Write(output.buf.Bytes())
+}
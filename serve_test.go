@@ -0,0 +1,275 @@
+// Tests for the "goawk serve" subcommand
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	sources := map[string]string{
+		"sum":   `{ s += $2 } END { print s+0, x; exit n }`,
+		"sys":   `BEGIN { system("echo hi") }`,
+		"read":  `BEGIN { getline x <"serve.go"; print (length(x) > 0) }`,
+		"error": `{ print $-1 }`,
+		"env":   `BEGIN { for (k in ENVIRON) n++; print n+0 }`,
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s := newTestServer(t, dir, sources)
+	s.anonymous.AllowFileReads = true
+
+	tests := []struct {
+		method string
+		path   string
+		input  string
+		code   int
+		status string
+		output string
+	}{
+		{"POST", "/run/sum", "a 1\nb 2\n", 200, "0", "3 \n"},
+		{"POST", "/run/sum?v=x=foo&v=n=2", "a 5\n", 200, "2", "5 foo\n"},
+		{"POST", "/run/sum?F=,", "a,4,x\nb,5\n", 200, "0", "9 \n"},
+		{"POST", "/run/sum?v=x", "", 400, "", "v parameter must be in format name=value\n"},
+		{"POST", "/run/sys", "", 500, "", "can't call system() due to NoExec\n"},
+		{"POST", "/run/sys?exec=1", "", 403, "", "exec not allowed by server\n"},
+		{"POST", "/run/read", "", 500, "", "can't read from file due to NoFileReads\n"},
+		{"POST", "/run/read?filereads=1", "", 200, "0", "1\n"},
+		{"POST", "/run/error", "x\n", 500, "", "field index negative: -1\n"},
+		{"POST", "/run/env", "", 200, "0", "0\n"},
+		{"GET", "/run/sum", "", 405, "", "method must be POST\n"},
+		{"POST", "/run/nope", "", 404, "", "program \"nope\" not found\n"},
+		{"POST", "/other", "", 404, "", "404 page not found\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.input))
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != test.code {
+				t.Errorf("expected code %d, got %d", test.code, w.Code)
+			}
+			if status := w.Header().Get("Goawk-Exit-Status"); status != test.status {
+				t.Errorf("expected exit status %q, got %q", test.status, status)
+			}
+			if w.Body.String() != test.output {
+				t.Errorf("expected output %q, got %q", test.output, w.Body.String())
+			}
+		})
+	}
+
+	// Concurrent requests must each get their own interpreter
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPost, "/run/sum", strings.NewReader(strings.Repeat("x 1\n", 100)))
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Body.String() != "100 \n" {
+				t.Errorf("expected output %q, got %q", "100 \n", w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestServeReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s := newTestServer(t, dir, map[string]string{"p": `{ print "v1", $0 }`})
+	var log bytes.Buffer
+	s.reloadLog = &log
+	path := s.programs["p"].path
+
+	run := func() string {
+		r := httptest.NewRequest(http.MethodPost, "/run/p", strings.NewReader("x\n"))
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	// Ensure the modification time changes, even on coarse filesystems
+	modTime := time.Now()
+	update := func(src string) {
+		modTime = modTime.Add(time.Second)
+		err := ioutil.WriteFile(path, []byte(src), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.reloadChanged()
+	}
+
+	if out := run(); out != "v1 x\n" {
+		t.Fatalf("expected %q, got %q", "v1 x\n", out)
+	}
+	update(`{ print "v2", $0 }`)
+	if out := run(); out != "v2 x\n" {
+		t.Fatalf("expected %q, got %q", "v2 x\n", out)
+	}
+	update(`{ print "v3", $0`)
+	if out := run(); out != "v2 x\n" {
+		t.Fatalf("expected old version after bad reload, got %q", out)
+	}
+	s.reloadChanged() // unchanged, shouldn't log again
+	expected := "reloaded \"p\" from " + path + "\n" +
+		"error reloading \"p\", keeping previous version: " + path + ":1:17: expected , instead of EOF\n"
+	if log.String() != expected {
+		t.Fatalf("expected log:\n%s\ngot:\n%s", expected, log.String())
+	}
+}
+
+func TestServeTenants(t *testing.T) {
+	sources := map[string]string{
+		"echo": `{ print }`,
+		"loop": `BEGIN { while (1) n++ }`,
+		"fib":  `function fib(n) { return n < 2 ? n : fib(n-1) + fib(n-2) } BEGIN { print fib(100) }`,
+		"sys":  `BEGIN { system("exec sleep 10") }`,
+		"wait": `{ print; fflush(); system("sleep 0.5") }`,
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s := newTestServer(t, dir, sources)
+	tenantsPath := filepath.Join(dir, "tenants.json")
+	err := ioutil.WriteFile(tenantsPath, []byte(`{
+		"small": {"key": "k1", "programs": ["echo", "loop", "fib"], "timeout": "50ms",
+		          "max_input": 10, "max_output": 8},
+		"big":   {"key": "k2", "timeout": "100ms", "allow_exec": true, "max_concurrent": 1}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.tenants, err = loadTenants(tenantsPath, s.programs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key    string
+		path   string
+		input  string
+		code   int
+		output string
+	}{
+		{"", "/run/echo", "", 401, "missing or invalid tenant key\n"},
+		{"bad", "/run/echo", "", 401, "missing or invalid tenant key\n"},
+		{"k1", "/run/echo", "abc\n", 200, "abc\n"},
+		{"k1", "/run/echo", "abcdefg\n", 200, "abcdefg\n"},
+		{"k1", "/run/echo", "abcdefghij\n", 413, "input larger than limit of 10 bytes\n"},
+		{"k1", "/run/echo", "abc\ndefgh\n", 500, "output larger than limit of 8 bytes\n"},
+		{"k1", "/run/loop", "", 503, "program took longer than time limit of 50ms\n"},
+		{"k1", "/run/fib", "", 503, "program took longer than time limit of 50ms\n"},
+		{"k1", "/run/sys", "", 403, "program \"sys\" not allowed for tenant \"small\"\n"},
+		{"k1", "/run/echo?exec=1", "", 403, "exec not allowed by server\n"},
+		{"k2", "/run/echo", "abcdefghijklmnop\n", 200, "abcdefghijklmnop\n"},
+		{"k2", "/run/sys?exec=1", "", 503, "program took longer than time limit of 100ms\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.key+" "+test.path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(test.input))
+			if test.key != "" {
+				r.Header.Set("Authorization", "Bearer "+test.key)
+			}
+			w := httptest.NewRecorder()
+			start := time.Now()
+			s.ServeHTTP(w, r)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("request took too long: %s", elapsed)
+			}
+			if w.Code != test.code {
+				t.Errorf("expected code %d, got %d", test.code, w.Code)
+			}
+			if w.Body.String() != test.output {
+				t.Errorf("expected output %q, got %q", test.output, w.Body.String())
+			}
+		})
+	}
+
+	// Tenant "big" can only run one request at a time
+	s.tenants["k2"].Timeout = 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := httptest.NewRequest(http.MethodPost, "/run/wait?exec=1", strings.NewReader("x\n"))
+		r.Header.Set("Authorization", "Bearer k2")
+		s.ServeHTTP(httptest.NewRecorder(), r)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	r := httptest.NewRequest(http.MethodPost, "/run/echo", strings.NewReader("x\n"))
+	r.Header.Set("Authorization", "Bearer k2")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	<-done
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected code %d, got %d: %s", http.StatusTooManyRequests, w.Code, w.Body.String())
+	}
+}
+
+func TestLoadTenantsErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	programs := map[string]*programFile{"p": {}}
+	tests := []struct {
+		json string
+		err  string
+	}{
+		{`{"a": {}}`, `tenant "a" must have a key`},
+		{`{"a": {"key": "k", "programs": ["q"]}}`, `tenant "a" has unknown program "q"`},
+		{`{"a": {"key": "k", "timeout": 5}}`, `duration must be a string like "2s"`},
+		{`{"a": {"key": "k", "timeout": "5 secs"}}`, `time: unknown unit`},
+		{`[]`, `cannot unmarshal array`},
+	}
+	for _, test := range tests {
+		t.Run(test.json, func(t *testing.T) {
+			path := filepath.Join(dir, "tenants.json")
+			err := ioutil.WriteFile(path, []byte(test.json), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = loadTenants(path, programs)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+// Create a server that serves the given sources (keyed by name), which
+// are written to files in directory dir.
+func newTestServer(t *testing.T, dir string, sources map[string]string) *server {
+	s := &server{programs: make(map[string]*programFile), fieldSep: " ", anonymous: &tenant{}, reloadLog: ioutil.Discard}
+	for name, src := range sources {
+		f := &programFile{path: filepath.Join(dir, name+".awk")}
+		err := ioutil.WriteFile(f.path, []byte(src), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.load()
+		if err != nil {
+			t.Fatalf("error loading %s: %v", name, err)
+		}
+		s.programs[name] = f
+	}
+	return s
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "goawk-serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
@@ -0,0 +1,124 @@
+//go:build js && wasm
+// +build js,wasm
+
+// GoAWK for WebAssembly in the browser (or Node.js)
+//
+// Build with:
+//
+//     GOOS=js GOARCH=wasm go build -o goawk.wasm ./wasm
+//
+// and load goawk.wasm using the wasm_exec.js shim that comes with Go
+// (in $(go env GOROOT)/lib/wasm or misc/wasm). This sets a global
+// "goawk" object with the following functions:
+//
+//     goawk.compile(src) -> {program, error}
+//         Parse AWK source src. On success, program is an object
+//         with a run(input, vars) method that executes the program
+//         (see goawk.run). On failure, error is the parse error
+//         message and program is null.
+//
+//     goawk.run(src, input, vars) -> {output, error, status}
+//         Parse and execute src with input (a string) as standard
+//         input. vars is an optional object mapping variable names
+//         to string values to assign before the program starts, for
+//         example {FS: ","}. output is everything the program wrote
+//         to standard output and standard error, error is an error
+//         message or "", and status is the exit status.
+//
+// There's no shell or file system in the browser, so the programs run
+// with NoExec, NoFileReads, and NoFileWrites set. To run GoAWK under
+// WASI instead, build the usual command with GOOS=wasip1.
+
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"syscall/js"
+
+	"github.com/benhoyt/goawk/interp"
+	"github.com/benhoyt/goawk/parser"
+)
+
+func main() {
+	goawk := js.Global().Get("Object").New()
+	goawk.Set("compile", js.FuncOf(compile))
+	goawk.Set("run", js.FuncOf(run))
+	js.Global().Set("goawk", goawk)
+
+	// Exported functions are called by the JavaScript side, so block
+	// forever instead of exiting.
+	select {}
+}
+
+func compile(this js.Value, args []js.Value) interface{} {
+	prog, err := parser.ParseProgram([]byte(stringArg(args, 0)), nil)
+	if err != nil {
+		return map[string]interface{}{"program": nil, "error": err.Error()}
+	}
+	program := js.Global().Get("Object").New()
+	program.Set("run", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return execute(prog, stringArg(args, 0), varsArg(args, 1))
+	}))
+	return map[string]interface{}{"program": program, "error": ""}
+}
+
+func run(this js.Value, args []js.Value) interface{} {
+	prog, err := parser.ParseProgram([]byte(stringArg(args, 0)), nil)
+	if err != nil {
+		return map[string]interface{}{"output": "", "error": err.Error(), "status": 2}
+	}
+	return execute(prog, stringArg(args, 1), varsArg(args, 2))
+}
+
+// Execute prog with the given input and variables, returning the
+// result object for goawk.run.
+func execute(prog *parser.Program, input string, vars []string) interface{} {
+	var output bytes.Buffer
+	config := &interp.Config{
+		Stdin:        strings.NewReader(input),
+		Output:       &output,
+		Error:        &output,
+		Argv0:        "goawk",
+		Vars:         vars,
+		Environ:      []string{},
+		NoExec:       true,
+		NoFileReads:  true,
+		NoFileWrites: true,
+	}
+	status, err := interp.ExecProgram(prog, config)
+	errMsg := ""
+	if err != nil {
+		errMsg = err.Error()
+		status = 2
+	}
+	return map[string]interface{}{"output": output.String(), "error": errMsg, "status": status}
+}
+
+// Return args[i] as a string, or "" if it's missing or undefined.
+func stringArg(args []js.Value, i int) string {
+	if i >= len(args) || args[i].IsUndefined() || args[i].IsNull() {
+		return ""
+	}
+	return args[i].String()
+}
+
+// Return args[i], an object of variable names and values, as a list
+// of name-value pairs suitable for Config.Vars.
+func varsArg(args []js.Value, i int) []string {
+	if i >= len(args) || args[i].Type() != js.TypeObject {
+		return nil
+	}
+	keys := js.Global().Get("Object").Call("keys", args[i])
+	names := make([]string, keys.Length())
+	for j := range names {
+		names[j] = keys.Index(j).String()
+	}
+	sort.Strings(names)
+	var vars []string
+	for _, name := range names {
+		vars = append(vars, name, args[i].Get(name).String())
+	}
+	return vars
+}